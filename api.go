@@ -17,6 +17,7 @@ package zoekt // import "github.com/google/zoekt"
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/zoekt/query"
@@ -27,8 +28,8 @@ type FileMatch struct {
 	// Ranking; the higher, the better.
 	Score float64 // TODO - hide this field?
 
-	// For debugging. Needs DebugScore set, but public so tests in
-	// other packages can print some diagnostics.
+	// Breakdown of Score into its components. Only set if
+	// SearchOptions.DebugScore is set.
 	Debug string
 
 	FileName string
@@ -58,6 +59,29 @@ type FileMatch struct {
 
 	// Commit SHA1 (hex) of the (sub)repo holding the file.
 	Version string
+
+	// ChunkMatches is set instead of LineMatches if
+	// SearchOptions.ChunkMatches is set.
+	ChunkMatches []ChunkMatch
+
+	// RepositoryID is the ID of the repository, see Repository.ID.
+	RepositoryID uint32
+
+	// LineEnding is the line terminator convention of the file.
+	LineEnding LineEnding
+
+	// Category holds the categories of the file, such as
+	// generated or vendored.
+	Category FileCategory
+
+	// Size of the file in bytes.
+	Size int64
+
+	// Executable is set if the file has its executable bit set.
+	Executable bool
+
+	// ModTime is the time the file was last changed, if known.
+	ModTime time.Time
 }
 
 // LineMatch holds the matches within a single line in a file.
@@ -75,6 +99,83 @@ type LineMatch struct {
 	// within the file, does not take rank of file into account
 	Score         float64
 	LineFragments []LineFragmentMatch
+
+	// Breakdown of Score into its components. Only set if
+	// SearchOptions.DebugScore is set.
+	Debug string
+}
+
+// LineEnding is the line terminator convention of a file. Lines may
+// end in "\n", "\r\n" or a lone "\r"; line numbers and LineMatch.Line
+// never include the terminator, whatever the convention.
+type LineEnding byte
+
+const (
+	// LineEndingLF is used for "\n", and for files without line
+	// terminators.
+	LineEndingLF LineEnding = iota
+	LineEndingCRLF
+	LineEndingCR
+
+	// LineEndingMixed is used for files mixing terminators.
+	LineEndingMixed
+)
+
+func (e LineEnding) String() string {
+	switch e {
+	case LineEndingLF:
+		return "LF"
+	case LineEndingCRLF:
+		return "CRLF"
+	case LineEndingCR:
+		return "CR"
+	case LineEndingMixed:
+		return "mixed"
+	}
+	return fmt.Sprintf("LineEnding(%d)", byte(e))
+}
+
+// FileCategory is a set of categories of files that are usually less
+// interesting than hand-written code. Files in a category score
+// lower, see ScoreWeights.Category.
+type FileCategory byte
+
+const (
+	// FileCategoryGenerated is set for files written by tools,
+	// such as protobuf stubs or minified JavaScript.
+	FileCategoryGenerated FileCategory = 1 << iota
+
+	// FileCategoryVendored is set for copies of third party code.
+	FileCategoryVendored
+
+	// FileCategoryTest is set for tests.
+	FileCategoryTest
+)
+
+var fileCategoryNames = []struct {
+	c    FileCategory
+	name string
+}{
+	{FileCategoryGenerated, "generated"},
+	{FileCategoryVendored, "vendored"},
+	{FileCategoryTest, "test"},
+}
+
+func (c FileCategory) String() string {
+	if c == 0 {
+		return "none"
+	}
+	var names []string
+	for _, n := range fileCategoryNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+			c &^= n.c
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("FileCategory(%d)", byte(c)))
+	}
+	return strings.Join(names, ",")
 }
 
 // LineFragmentMatch a segment of matching text within a line.
@@ -87,6 +188,55 @@ type LineFragmentMatch struct {
 
 	// Number bytes that match.
 	MatchLength int
+
+	// 1-based column of the start of the match, counted in runes
+	// from the start of the line.
+	Column int
+
+	// Number of runes that match.
+	MatchRunes int
+}
+
+// ChunkMatch is a run of consecutive lines holding one or more
+// matches, including surrounding context lines.
+type ChunkMatch struct {
+	// Content holds the lines of the chunk, without the trailing
+	// newline.
+	Content []byte
+
+	// ContentStart is the location of the first byte of Content.
+	ContentStart Location
+
+	// If set, this was a match on the filename.
+	FileName bool
+
+	// Ranges holds the matches within the chunk.
+	Ranges []Range
+
+	// The higher the better. Only ranks the quality of the match
+	// within the file, does not take rank of file into account
+	Score float64
+}
+
+// Range is a span of text within a file.
+type Range struct {
+	// Start is the location of the first byte.
+	Start Location
+
+	// End is the location just past the last byte.
+	End Location
+}
+
+// Location is a position within a file.
+type Location struct {
+	// Offset from file start, in bytes.
+	ByteOffset uint32
+
+	// 1-based line number.
+	LineNumber uint32
+
+	// 1-based column, counted in runes.
+	Column uint32
 }
 
 // Stats contains interesting numbers on the search
@@ -131,6 +281,62 @@ type Stats struct {
 
 	// Wall clock time for queued search.
 	Wait time.Duration
+
+	// Number of regexps compiled, and the time spent compiling
+	// them.
+	RegexpsCompiled       int
+	RegexpCompileDuration time.Duration
+
+	// Truncated says why the search stopped before finding all
+	// matches, if it did.
+	Truncated TruncateReason
+}
+
+// TruncateReason is the deadline or limit that cut a search short.
+type TruncateReason byte
+
+const (
+	NotTruncated TruncateReason = iota
+
+	// TruncatedMatchBytes is set when the matches found exceed
+	// SearchOptions.MaxMatchBytes.
+	TruncatedMatchBytes
+
+	// TruncatedCandidateDocs is set when more documents than
+	// SearchOptions.MaxCandidateDocs had to be evaluated.
+	TruncatedCandidateDocs
+
+	// TruncatedDeadline is set when SearchOptions.MaxWallTime or
+	// the deadline of the context passed before all shards were
+	// searched.
+	TruncatedDeadline
+
+	// TruncatedShardMatchLimit is set when a shard stopped after
+	// SearchOptions.ShardMaxMatchCount or
+	// ShardMaxImportantMatch matches.
+	TruncatedShardMatchLimit
+
+	// TruncatedTotalMatchLimit is set when the search stopped
+	// after SearchOptions.TotalMaxMatchCount matches.
+	TruncatedTotalMatchLimit
+)
+
+func (r TruncateReason) String() string {
+	switch r {
+	case NotTruncated:
+		return "none"
+	case TruncatedMatchBytes:
+		return "match-bytes"
+	case TruncatedCandidateDocs:
+		return "candidate-docs"
+	case TruncatedDeadline:
+		return "deadline"
+	case TruncatedShardMatchLimit:
+		return "shard-match-limit"
+	case TruncatedTotalMatchLimit:
+		return "total-match-limit"
+	}
+	return fmt.Sprintf("TruncateReason(%d)", byte(r))
 }
 
 func (s *Stats) Add(o Stats) {
@@ -145,6 +351,11 @@ func (s *Stats) Add(o Stats) {
 	s.NgramMatches += o.NgramMatches
 	s.ShardFilesConsidered += o.ShardFilesConsidered
 	s.ShardsSkipped += o.ShardsSkipped
+	s.RegexpsCompiled += o.RegexpsCompiled
+	s.RegexpCompileDuration += o.RegexpCompileDuration
+	if s.Truncated == NotTruncated {
+		s.Truncated = o.Truncated
+	}
 }
 
 // SearchResult contains search matches and extra data
@@ -158,6 +369,73 @@ type SearchResult struct {
 	// FragmentNames holds a repo => template string map, for
 	// the line number fragment.
 	LineFragments map[string]string
+
+	// RepoStats holds match counts per repository. Only set if
+	// SearchOptions.Facets or SearchOptions.CountOnly is set.
+	RepoStats map[string]*RepoMatchStats
+
+	// CachedAt is set if the result was served from a cache. It
+	// holds the time the result was computed; the index has not
+	// changed since.
+	CachedAt time.Time
+
+	// NextCursor is set if MaxDocDisplayCount cut off the
+	// files. Pass it as SearchOptions.Cursor to get the next
+	// page.
+	NextCursor string
+
+	// Suggestions are relaxed queries that do find files, if
+	// SearchOptions.SuggestQueries is set and the search found
+	// nothing.
+	Suggestions []QuerySuggestion
+}
+
+// QuerySuggestion is a relaxation of a query that found nothing.
+type QuerySuggestion struct {
+	// Reason says how the query was relaxed, such as
+	// "case-insensitive".
+	Reason string
+
+	// Query is the relaxed query.
+	Query query.Q
+
+	// FileCount is the number of files Query finds, up to the
+	// match limits of the search.
+	FileCount int
+}
+
+// RepoMatchStats holds aggregate counts of the matches in a
+// repository, for narrowing down a search.
+type RepoMatchStats struct {
+	// Number of files containing a match.
+	FileCount int
+
+	// Number of non-overlapping matches.
+	MatchCount int
+
+	// Languages and Extensions hold the number of matches per
+	// language and per file extension (eg. ".go", or "" for files
+	// without extension).
+	Languages  map[string]int
+	Extensions map[string]int
+}
+
+// Add adds the counts in o to s.
+func (s *RepoMatchStats) Add(o *RepoMatchStats) {
+	s.FileCount += o.FileCount
+	s.MatchCount += o.MatchCount
+	if s.Languages == nil {
+		s.Languages = map[string]int{}
+	}
+	for k, v := range o.Languages {
+		s.Languages[k] += v
+	}
+	if s.Extensions == nil {
+		s.Extensions = map[string]int{}
+	}
+	for k, v := range o.Extensions {
+		s.Extensions[k] += v
+	}
 }
 
 // RepositoryBranch describes an indexed branch, which is a name
@@ -171,6 +449,20 @@ type RepositoryBranch struct {
 type Repository struct {
 	// The repository name
 	Name string
+
+	// ID is a stable identifier of the repository, assigned by
+	// whoever indexes it, eg. the ID of the repository in the code
+	// host. Unlike the name, it survives renames. Zero means no
+	// ID.
+	ID uint32
+
+	// TenantID is the tenant owning the repository in deployments
+	// serving several isolated customers. Its shards are kept in
+	// a subdirectory of the index, see TenantDir, and only
+	// searched on behalf of the tenant, see WithTenant. Empty
+	// means no tenant.
+	TenantID string
+
 	// The repository URL.
 	URL string
 
@@ -197,6 +489,36 @@ type Repository struct {
 
 	// Importance of the repository, bigger is more important
 	Rank uint16
+
+	// Priority of the repository, eg. its number of stars. Results
+	// from repositories with a higher priority are ranked higher
+	// when searching across repositories. Zero means no priority.
+	Priority float64
+
+	// Archived is set if the repository is archived, ie. read-only.
+	Archived bool
+
+	// Fork is set if the repository is a fork of another one.
+	Fork bool
+
+	// Public is set if the repository is publicly visible.
+	Public bool
+
+	// Description is a short summary of what the repository is.
+	Description string
+
+	// Topics categorize the repository, eg. "database" or "golang".
+	Topics []string
+
+	// Tombstone is set if the repository was deleted. Its shards
+	// are not searched, and can be removed. Usually set through
+	// the sidecar metadata, see ShardMetaName.
+	Tombstone bool
+
+	// FileNamesOnly is set if only the file names of the
+	// repository and the lines defining symbols were indexed, not
+	// the full content of its files.
+	FileNamesOnly bool `json:",omitempty"`
 }
 
 // IndexMetadata holds metadata stored in the index file.
@@ -207,6 +529,14 @@ type IndexMetadata struct {
 	PlainASCII          bool
 	LanguageMap         map[string]byte
 	ZoektVersion        string
+
+	// ContentCompression is how file contents are stored: empty
+	// for uncompressed, or ContentCompressionZstd.
+	ContentCompression string `json:",omitempty"`
+
+	// PostingEncoding is how ngram posting lists are stored:
+	// empty for varint deltas, or PostingEncodingRoaring.
+	PostingEncoding string `json:",omitempty"`
 }
 
 // Statistics of a (collection of) repositories.
@@ -240,6 +570,11 @@ type RepoListEntry struct {
 	Repository    Repository
 	IndexMetadata IndexMetadata
 	Stats         RepoStats
+
+	// ShardFiles are the names of the index files holding the
+	// repository. Searchers loading an index directory list them
+	// relative to it.
+	ShardFiles []string `json:",omitempty"`
 }
 
 // RepoList holds a set of Repository metadata.
@@ -260,6 +595,31 @@ type Searcher interface {
 	String() string
 }
 
+// Sender receives the results of a streaming search.
+type Sender interface {
+	Send(*SearchResult)
+}
+
+// SenderFunc adapts a function to the Sender interface.
+type SenderFunc func(*SearchResult)
+
+// Send calls f(r).
+func (f SenderFunc) Send(r *SearchResult) {
+	f(r)
+}
+
+// Streamer is a Searcher that can send results while a search is
+// running, rather than once it completes.
+type Streamer interface {
+	Searcher
+
+	// StreamSearch sends the results of a search to sender as
+	// they are found, typically one shard at a time. Send is not
+	// called concurrently. The last result has no files; it
+	// holds the statistics of the whole search.
+	StreamSearch(ctx context.Context, q query.Q, opts *SearchOptions, sender Sender) error
+}
+
 type SearchOptions struct {
 	// Return an upper-bound estimate of eligible documents in
 	// stats.ShardFilesConsidered.
@@ -286,9 +646,171 @@ type SearchOptions struct {
 	// Abort the search after this much time has passed.
 	MaxWallTime time.Duration
 
+	// Stop the search once the returned matches hold this many
+	// bytes of file names, lines and content, and set
+	// Stats.Truncated. The budget is shared by all shards. Zero
+	// means no limit.
+	MaxMatchBytes int64
+
+	// Stop the search after evaluating this many candidate
+	// documents, ie. documents that contain the ngrams of the
+	// query, and set Stats.Truncated. The budget is shared by all
+	// shards. Zero means no limit.
+	MaxCandidateDocs int
+
 	// Trim the number of results after collating and sorting the
 	// results
 	MaxDocDisplayCount int
+
+	// Return matches as ChunkMatches rather than LineMatches.
+	ChunkMatches bool
+
+	// Merge file matches that show the same matches in the same
+	// file on different branches into one, listing all their
+	// branches. Without it, a file whose content differs between
+	// branches is returned once per version, even if the
+	// matching lines are the same. Streamed results drop such
+	// duplicates instead, as the first one was already sent.
+	DedupBranches bool
+
+	// If the search finds no files, try cheap relaxations of the
+	// query, see query.Relax, and return those that do find files
+	// as SearchResult.Suggestions. Not supported by streaming
+	// searches.
+	SuggestQueries bool
+
+	// Number of lines of context to add around each chunk. Only
+	// used with ChunkMatches.
+	NumContextLines int
+
+	// Compute match counts per repository, language and file
+	// extension in SearchResult.RepoStats. The counts cover all
+	// matches found, not just the ones returned.
+	Facets bool
+
+	// Only count matches: return no files, just Stats.MatchCount,
+	// Stats.FileCount and the per-repository counts in
+	// SearchResult.RepoStats. This skips line splitting, scoring
+	// and loading content beyond what is needed to verify
+	// matches. MatchCount counts non-overlapping matches rather
+	// than matching lines.
+	CountOnly bool
+
+	// Weights for combining the parts of the score. Zero weights
+	// are taken from DefaultScoreWeights.
+	ScoreWeights ScoreWeights
+
+	// Explain scores in FileMatch.Debug and LineMatch.Debug.
+	DebugScore bool
+
+	// Maximum size of a compiled regexp, in instructions. Larger
+	// regexps fail the search with CodeQueryTooExpensive. Zero
+	// means no limit.
+	MaxRegexpSize int
+
+	// Match atoms with smart case, overriding their CaseSensitive
+	// field: patterns containing upper case characters match
+	// case-sensitively, others case-insensitively. See
+	// query.SmartCase.
+	SmartCase bool
+
+	// SortBy is the order of the files in the result. Files are
+	// found in the order of the index regardless, so with match
+	// limits a different order may still miss files that sort
+	// first.
+	SortBy SortOrder
+
+	// Return the page of files after this cursor, taken from
+	// SearchResult.NextCursor of the previous page. Pages are
+	// consistent as long as the index does not change and the
+	// match limits do not truncate the search.
+	Cursor string
+}
+
+// SortOrder is the order of the files in search results.
+type SortOrder byte
+
+const (
+	// SortByScore puts the best matches first.
+	SortByScore SortOrder = iota
+
+	// SortByPath orders files by name, then repository.
+	SortByPath
+
+	// SortByRepo orders files by repository, then name.
+	SortByRepo
+
+	// SortByModTime puts the most recently modified files first.
+	SortByModTime
+)
+
+var sortOrderNames = []string{"score", "path", "repo", "modtime"}
+
+func (o SortOrder) String() string {
+	if int(o) < len(sortOrderNames) {
+		return sortOrderNames[o]
+	}
+	return fmt.Sprintf("SortOrder(%d)", byte(o))
+}
+
+// ParseSortOrder parses the name of a SortOrder, as returned by its
+// String method. The empty string means SortByScore.
+func ParseSortOrder(s string) (SortOrder, error) {
+	if s == "" {
+		return SortByScore, nil
+	}
+	for i, n := range sortOrderNames {
+		if s == n {
+			return SortOrder(i), nil
+		}
+	}
+	return 0, Errorf(CodeQueryParse, "unknown sort order %q; want one of %s", s, strings.Join(sortOrderNames, ", "))
+}
+
+// ScoreWeights scales parts of the score of a file match. A weight of
+// 1 keeps the built-in scoring; a zero weight means the weight in
+// DefaultScoreWeights, so setting one weight leaves the others alone.
+type ScoreWeights struct {
+	// FileName scales the score of matches in the file name.
+	FileName float64
+
+	// Symbol scales the bonus for matches on symbol definitions.
+	Symbol float64
+
+	// DocRank scales the bonus for the rank of the document, see
+	// Document.Rank.
+	DocRank float64
+
+	// Category scales the penalty for files in a category, see
+	// Document.Category.
+	Category float64
+}
+
+// DefaultScoreWeights holds the weights used for the zero fields of
+// SearchOptions.ScoreWeights.
+var DefaultScoreWeights = ScoreWeights{
+	FileName: 1,
+	Symbol:   1,
+	DocRank:  1,
+	Category: 1,
+}
+
+// withDefaults returns w with its zero weights taken from
+// DefaultScoreWeights.
+func (w ScoreWeights) withDefaults() ScoreWeights {
+	if w.FileName == 0 {
+		w.FileName = DefaultScoreWeights.FileName
+	}
+	if w.Symbol == 0 {
+		w.Symbol = DefaultScoreWeights.Symbol
+	}
+	if w.DocRank == 0 {
+		w.DocRank = DefaultScoreWeights.DocRank
+	}
+	if w.Category == 0 {
+		w.Category = DefaultScoreWeights.Category
+	}
+	return w
 }
 
 func (s *SearchOptions) String() string {
@@ -43,11 +43,31 @@ func generateCaseNgrams(g ngram) []ngram {
 	return variants
 }
 
-func toLower(in []byte) []byte {
+// foldRune returns the canonical case folding of r: the smallest
+// rune that is equivalent to r under Unicode simple case folding, eg.
+// 'K' for 'k' and the Kelvin sign, and 'Σ' for 'σ' and 'ς'.
+func foldRune(r rune) rune {
+	if r < utf8.RuneSelf {
+		if 'a' <= r && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		return r
+	}
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+// foldCase applies foldRune to all runes of in.
+func foldCase(in []byte) []byte {
 	out := make([]byte, 0, len(in))
 	var buf [4]byte
 	for _, c := range string(in) {
-		i := utf8.EncodeRune(buf[:], unicode.ToLower(c))
+		i := utf8.EncodeRune(buf[:], foldRune(c))
 		out = append(out, buf[:i]...)
 	}
 	return out
@@ -83,25 +103,25 @@ func caseFoldingEqualsASCII(lower, mixed []byte) bool {
 	return true
 }
 
-// compare 'lower' and 'mixed', where lower is the needle. 'mixed' may
-// be larger than 'lower'. Returns whether there was a match, and if
-// yes, the byte size of the match.
-func caseFoldingEqualsRunes(lower, mixed []byte) (int, bool) {
+// compare 'folded' and 'mixed', where folded is the needle, case
+// folded with foldCase. 'mixed' may be larger than 'folded'. Returns
+// whether there was a match, and if yes, the byte size of the match.
+func caseFoldingEqualsRunes(folded, mixed []byte) (int, bool) {
 	matchTotal := 0
-	for len(lower) > 0 && len(mixed) > 0 {
-		lr, lsz := utf8.DecodeRune(lower)
-		lower = lower[lsz:]
+	for len(folded) > 0 && len(mixed) > 0 {
+		fr, fsz := utf8.DecodeRune(folded)
+		folded = folded[fsz:]
 
 		mr, msz := utf8.DecodeRune(mixed)
 		mixed = mixed[msz:]
 		matchTotal += msz
 
-		if lr != unicode.ToLower(mr) {
+		if fr != foldRune(mr) {
 			return 0, false
 		}
 	}
 
-	return matchTotal, len(lower) == 0
+	return matchTotal, len(folded) == 0
 }
 
 type ngram uint64
@@ -76,3 +76,40 @@ func TestNextFileIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestFoldRune(t *testing.T) {
+	for _, c := range [][]rune{
+		{'a', 'A'},
+		{'k', 'K', 'K'},
+		{'σ', 'Σ', 'ς'},
+		{'ß', 'ẞ'},
+		{'1'},
+	} {
+		for _, r := range c {
+			if got := foldRune(r); got != foldRune(c[0]) {
+				t.Errorf("foldRune(%q) = %q, want %q", r, got, foldRune(c[0]))
+			}
+		}
+	}
+	if foldRune('a') == foldRune('b') {
+		t.Errorf("a and b fold to the same rune")
+	}
+}
+
+func TestCaseFoldingEqualsRunes(t *testing.T) {
+	for _, c := range []struct {
+		needle, mixed string
+		size          int
+		ok            bool
+	}{
+		{"kelvin", "Kelvin", 8, true},
+		{"σίσυφος", "ΣΊΣΥΦΟΣ rolls", len("ΣΊΣΥΦΟΣ"), true},
+		{"abc", "abd", 0, false},
+		{"abc", "ab", 0, false},
+	} {
+		size, ok := caseFoldingEqualsRunes(foldCase([]byte(c.needle)), []byte(c.mixed))
+		if ok != c.ok || ok && size != c.size {
+			t.Errorf("caseFoldingEqualsRunes(%q, %q) = %d, %v, want %d, %v", c.needle, c.mixed, size, ok, c.size, c.ok)
+		}
+	}
+}
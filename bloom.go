@@ -0,0 +1,167 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+
+	"github.com/google/zoekt/query"
+)
+
+// bloomBitsPerNgram sizes the bloom filter of a shard. With
+// bloomHashes hash functions, this gives about 1% false positives.
+const (
+	bloomBitsPerNgram = 10
+	bloomHashes       = 7
+)
+
+// bloomFilter holds the case folded ngrams of the contents and names
+// of the files in a shard. It answers whether a shard may contain a
+// string without looking at the ngram tables. It is serialized as
+// the number of hash functions in one byte, followed by the bits.
+type bloomFilter struct {
+	hashes uint32
+	bits   []byte
+}
+
+func newBloomFilter(ngrams int) *bloomFilter {
+	n := (ngrams*bloomBitsPerNgram + 7) / 8
+	if n < 8 {
+		n = 8
+	}
+	return &bloomFilter{
+		hashes: bloomHashes,
+		bits:   make([]byte, n),
+	}
+}
+
+// readBloomFilter parses a serialized bloomFilter. The bits are not
+// copied.
+func readBloomFilter(blob []byte) (*bloomFilter, error) {
+	if len(blob) < 2 || blob[0] == 0 {
+		return nil, fmt.Errorf("bloom filter of %d bytes is too short", len(blob))
+	}
+	return &bloomFilter{
+		hashes: uint32(blob[0]),
+		bits:   blob[1:],
+	}, nil
+}
+
+func (f *bloomFilter) marshal() []byte {
+	return append([]byte{byte(f.hashes)}, f.bits...)
+}
+
+// probes returns the two hashes from which the bit positions of ng
+// are derived, see "Less Hashing, Same Performance" by Kirsch and
+// Mitzenmacher.
+func (f *bloomFilter) probes(ng ngram) (uint32, uint32) {
+	// The finalizer of MurmurHash3.
+	h := uint64(foldNGram(ng))
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return uint32(h), uint32(h>>32) | 1
+}
+
+func (f *bloomFilter) add(ng ngram) {
+	h1, h2 := f.probes(ng)
+	m := uint32(len(f.bits) * 8)
+	for i := uint32(0); i < f.hashes; i++ {
+		b := (h1 + i*h2) % m
+		f.bits[b/8] |= 1 << (b % 8)
+	}
+}
+
+// mayContain returns false if ng, ignoring case, is certainly not in
+// the filter.
+func (f *bloomFilter) mayContain(ng ngram) bool {
+	h1, h2 := f.probes(ng)
+	m := uint32(len(f.bits) * 8)
+	for i := uint32(0); i < f.hashes; i++ {
+		b := (h1 + i*h2) % m
+		if f.bits[b/8]&(1<<(b%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mayMatch returns false if no file can match q, because it requires
+// a string whose ngrams are not all in the filter.
+func (f *bloomFilter) mayMatch(q query.Q) bool {
+	switch s := q.(type) {
+	case *query.And:
+		for _, ch := range s.Children {
+			if !f.mayMatch(ch) {
+				return false
+			}
+		}
+		return true
+	case *query.Or:
+		for _, ch := range s.Children {
+			if f.mayMatch(ch) {
+				return true
+			}
+		}
+		return false
+	case *query.Const:
+		return s.Value
+	case *query.Type:
+		return f.mayMatch(s.Child)
+	case *query.Symbol:
+		return f.mayMatch(s.Atom)
+	case *query.Regexp:
+		return f.mayMatch(query.RegexpToQuery(s.Regexp, ngramSize))
+	case *query.Substring:
+		for _, o := range splitNGrams([]byte(s.Pattern)) {
+			if !f.mayContain(o.ngram) {
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
+
+// foldNGram applies foldRune to the runes of ng.
+func foldNGram(ng ngram) ngram {
+	rs := ngramToRunes(ng)
+	for i, r := range rs {
+		rs[i] = foldRune(r)
+	}
+	return runesToNGram(rs)
+}
+
+// ngramBloom returns the bloom filter of the ngrams of the files
+// added so far.
+func (b *IndexBuilder) ngramBloom() *bloomFilter {
+	f := newBloomFilter(len(b.contentPostings.postings) + len(b.namePostings.postings))
+	for ng := range b.contentPostings.postings {
+		f.add(ng)
+	}
+	for ng := range b.namePostings.postings {
+		f.add(ng)
+	}
+	return f
+}
+
+// MayMatch returns false if the shard certainly has no file matching
+// q, judged by the bloom filter of its ngrams. This is much cheaper
+// than a search, so it lets callers skip shards.
+func (d *indexData) MayMatch(q query.Q) bool {
+	return d.bloom.mayMatch(q)
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// searchBudget tracks SearchOptions.MaxMatchBytes and
+// MaxCandidateDocs across the shards of a search.
+type searchBudget struct {
+	maxMatchBytes int64
+	maxDocs       int64
+
+	matchBytes int64
+	docs       int64
+}
+
+type searchBudgetKey struct{}
+
+// WithSearchBudget returns a context whose searches share the budgets
+// of opts, so searchers over many shards should call it once per
+// search. It returns ctx if opts sets no budget.
+func WithSearchBudget(ctx context.Context, opts *SearchOptions) context.Context {
+	if opts.MaxMatchBytes <= 0 && opts.MaxCandidateDocs <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, searchBudgetKey{}, newSearchBudget(opts))
+}
+
+func newSearchBudget(opts *SearchOptions) *searchBudget {
+	return &searchBudget{
+		maxMatchBytes: opts.MaxMatchBytes,
+		maxDocs:       int64(opts.MaxCandidateDocs),
+	}
+}
+
+// searchBudgetFor returns the budget set up by WithSearchBudget, or a
+// fresh one for this shard alone.
+func searchBudgetFor(ctx context.Context, opts *SearchOptions) *searchBudget {
+	if b, ok := ctx.Value(searchBudgetKey{}).(*searchBudget); ok {
+		return b
+	}
+	return newSearchBudget(opts)
+}
+
+// addDoc accounts for a candidate document. It returns
+// TruncatedCandidateDocs if the document is over budget.
+func (b *searchBudget) addDoc() TruncateReason {
+	if b.maxDocs > 0 && atomic.AddInt64(&b.docs, 1) > b.maxDocs {
+		return TruncatedCandidateDocs
+	}
+	return b.exhausted()
+}
+
+// addMatch accounts for the bytes of a file match. It returns
+// TruncatedMatchBytes if the budget is used up; the match itself is
+// still returned, so a search may exceed the budget by one file.
+func (b *searchBudget) addMatch(fm *FileMatch) TruncateReason {
+	if b.maxMatchBytes <= 0 {
+		return NotTruncated
+	}
+	if atomic.AddInt64(&b.matchBytes, matchBytes(fm)) >= b.maxMatchBytes {
+		return TruncatedMatchBytes
+	}
+	return NotTruncated
+}
+
+// exhausted returns why the budget is used up, if it is.
+func (b *searchBudget) exhausted() TruncateReason {
+	if b.maxMatchBytes > 0 && atomic.LoadInt64(&b.matchBytes) >= b.maxMatchBytes {
+		return TruncatedMatchBytes
+	}
+	if b.maxDocs > 0 && atomic.LoadInt64(&b.docs) > b.maxDocs {
+		return TruncatedCandidateDocs
+	}
+	return NotTruncated
+}
+
+// matchBytes approximates the memory held by fm.
+func matchBytes(fm *FileMatch) int64 {
+	n := len(fm.FileName) + len(fm.Content)
+	for _, lm := range fm.LineMatches {
+		n += len(lm.Line)
+	}
+	for _, cm := range fm.ChunkMatches {
+		n += len(cm.Content)
+	}
+	return int64(n)
+}
@@ -17,6 +17,7 @@
 package build
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"io"
@@ -24,17 +25,18 @@ import (
 	"log"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/ctags"
+	"github.com/google/zoekt/ignore"
 )
 
 var DefaultDir = filepath.Join(os.Getenv("HOME"), ".zoekt")
@@ -47,7 +49,9 @@ type Branch struct {
 
 // Options sets options for the index building.
 type Options struct {
-	// IndexDir is a directory that holds *.zoekt index files.
+	// IndexDir is a directory that holds *.zoekt index files. The
+	// shards of repositories with a tenant go in its subdirectory,
+	// see zoekt.TenantDir.
 	IndexDir string
 
 	// SizeMax is the maximum file size
@@ -62,17 +66,84 @@ type Options struct {
 	// RepositoryDescription holds names and URLs for the repository.
 	RepositoryDescription zoekt.Repository
 
-	// SubRepositories is a path => sub repository map.
+	// SubRepositories is a path => sub repository map. Documents
+	// added without a SubRepositoryPath are assigned to the sub
+	// repository with the longest path prefix of their name, so
+	// several source roots can be merged into one repository.
 	SubRepositories map[string]*zoekt.Repository
 
-	// Path to exuberant ctags binary to run
+	// Path to the universal-ctags binary to extract symbols with.
+	// It runs as a few long-lived processes, one per shard built
+	// in parallel. If empty, no symbols are extracted.
 	CTags string
 
 	// If set, ctags must succeed.
 	CTagsMustSucceed bool
 
+	// If set, ctags runs sandboxed, which is advisable when
+	// indexing untrusted code. See ctags.ParserOptions.Sandbox.
+	CTagsSandbox bool
+
+	// CTagsLanguageMap maps file name patterns to ctags languages,
+	// eg. ".pyx" => "Python", in addition to the built-in map.
+	CTagsLanguageMap map[string]string
+
 	// Write memory profiles to this file.
 	MemProfile string
+
+	// If set, finished shards are recorded in a checkpoint file,
+	// and kept if the build is interrupted. A later build with the
+	// same options, adding the same documents in the same order,
+	// resumes after the recorded shards.
+	Checkpoint bool
+
+	// IgnorePatterns are gitignore-style patterns of files that
+	// are not indexed at all. They are applied after those of the
+	// ignore.FileName file at the root of the repository, so they
+	// take precedence.
+	IgnorePatterns []string
+
+	// LFSPointers says what to do with Git LFS pointer files, one
+	// of the LFSPointers* values. It defaults to LFSPointersIndex.
+	LFSPointers string
+
+	// LFSFetch returns the object of an LFS pointer, for
+	// LFSPointersFetch. It returns an error satisfying
+	// os.IsNotExist if the object is not available.
+	LFSFetch func(ctx context.Context, p LFSPointer) ([]byte, error)
+
+	// PresetCategories is set if documents come with their final
+	// categories, eg. because the indexer applied the .gitattributes
+	// files of all directories. The builder then neither detects
+	// categories nor reads the .gitattributes file itself.
+	PresetCategories bool
+
+	// Transformers rewrite every document, in order, before it
+	// is checked for size and binary content and indexed.
+	Transformers []DocumentTransformer
+
+	// ContentCompression compresses the contents of files in the
+	// shards if set to zoekt.ContentCompressionZstd. This makes
+	// shards of text-heavy repositories much smaller, at the cost
+	// of decompressing files while searching.
+	ContentCompression string
+
+	// PostingEncoding stores the ngram posting lists as roaring
+	// bitmaps if set to zoekt.PostingEncodingRoaring, rather than
+	// as varint encoded deltas.
+	PostingEncoding string
+
+	// KeepVersions is the number of earlier versions of the
+	// repository whose shards are kept when a new version is
+	// indexed, so searches can be pinned to them with
+	// query.RepoCommit. Zero keeps none.
+	KeepVersions int
+
+	// If set, index only the names of files and the lines
+	// defining their symbols, leaving the other lines empty. This
+	// keeps gigantic repositories findable by path and symbol at
+	// a fraction of the index size.
+	FileNamesOnly bool
 }
 
 // Builder manages (parallel) creation of uniformly sized shards.
@@ -80,12 +151,33 @@ type Builder struct {
 	opts     Options
 	throttle chan int
 
+	// Canceling ctx interrupts the build.
+	ctx context.Context
+
+	// Number of documents added, and the number of leading
+	// documents that are already in shards from a checkpoint.
+	docs     int
+	skipDocs int
+
+	// shard number => number of documents added up to and
+	// including the shard.
+	shardEnds map[int]int
+
+	// shard number => temp name, for finished shards.
+	shardTemps map[int]string
+
 	nextShardNum int
 	todo         []*zoekt.Document
 	size         int
 
 	parser ctags.Parser
 
+	// ignore matches the files to leave out of the index.
+	ignore *ignore.Matcher
+
+	// attributes override the detected categories of files.
+	attributes GitAttributes
+
 	building sync.WaitGroup
 
 	errMu      sync.Mutex
@@ -102,22 +194,8 @@ type finishedShard struct {
 
 // SetDefaults sets reasonable default options.
 func (o *Options) SetDefaults() {
-	if o.CTags == "" {
-		ctags, err := exec.LookPath("universal-ctags")
-		if err == nil {
-			o.CTags = ctags
-		}
-	}
-
-	if o.CTags == "" {
-		ctags, err := exec.LookPath("ctags-exuberant")
-		if err == nil {
-			o.CTags = ctags
-		}
-	}
-
-	// Sourcegraph modification: We never want to run ctags
-	o.CTags = ""
+	// Sourcegraph modification: ctags is opt-in, so CTags is not
+	// looked up in $PATH.
 
 	if o.Parallelism == 0 {
 		o.Parallelism = 1
@@ -143,14 +221,41 @@ func hashString(s string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-// ShardName returns the name the given index shard.
-func (o *Options) shardName(n int) (string, error) {
+// shardPrefix returns the file name prefix shared by all files of
+// the repository.
+func (o *Options) shardPrefix() string {
 	abs := url.QueryEscape(o.RepositoryDescription.Name)
 	if len(abs) > 200 {
 		abs = abs[:200] + hashString(abs)[:8]
 	}
-	return filepath.Join(o.IndexDir,
-		fmt.Sprintf("%s_v%d.%05d.zoekt", abs, zoekt.IndexFormatVersion, n)), nil
+	return abs
+}
+
+// shardDir returns the directory holding the shards of the
+// repository: IndexDir, or the subdirectory of its tenant.
+func (o *Options) shardDir() string {
+	return zoekt.TenantDir(o.IndexDir, o.RepositoryDescription.TenantID)
+}
+
+// ShardName returns the name the given index shard.
+func (o *Options) shardName(n int) (string, error) {
+	return filepath.Join(o.shardDir(),
+		fmt.Sprintf("%s_v%d.%05d.zoekt", o.shardPrefix(), zoekt.IndexFormatVersion, n)), nil
+}
+
+// subRepositoryPath returns the longest sub repository path that
+// contains the given file name, or "" if there is none.
+func (o *Options) subRepositoryPath(name string) string {
+	best := ""
+	for p := range o.SubRepositories {
+		if p == "" || len(p) <= len(best) {
+			continue
+		}
+		if strings.HasPrefix(name, p+"/") {
+			best = p
+		}
+	}
+	return best
 }
 
 // IndexVersions returns the versions as present in the index, for
@@ -179,31 +284,101 @@ func (o *Options) IndexVersions() []zoekt.RepositoryBranch {
 	if index.IndexFeatureVersion != zoekt.FeatureVersion {
 		return nil
 	}
+	if repo.FileNamesOnly != o.FileNamesOnly {
+		return nil
+	}
+	// Shards stored differently are rebuilt, eg. once a canary
+	// enables compression for the repository.
+	if index.ContentCompression != o.ContentCompression || index.PostingEncoding != o.PostingEncoding {
+		return nil
+	}
 
 	return repo.Branches
 }
 
 // NewBuilder creates a new Builder instance.
 func NewBuilder(opts Options) (*Builder, error) {
+	return NewBuilderContext(context.Background(), opts)
+}
+
+// NewBuilderContext is like NewBuilder, but the build is interrupted
+// when ctx is canceled: Add and Finish then return the context's
+// error. With Options.Checkpoint, the shards finished so far are
+// kept for a later build to resume from.
+func NewBuilderContext(ctx context.Context, opts Options) (*Builder, error) {
 	opts.SetDefaults()
 	if opts.RepositoryDescription.Name == "" {
 		return nil, fmt.Errorf("builder: must set Name")
 	}
+	if t := opts.RepositoryDescription.TenantID; t != "" && !zoekt.ValidTenantID(t) {
+		return nil, fmt.Errorf("builder: invalid tenant ID %q", t)
+	}
+
+	if len(opts.SubRepositories) > 0 {
+		// Sub repositories without branches of their own (eg. extra
+		// source roots) share the branches of the super project.
+		subs := make(map[string]*zoekt.Repository, len(opts.SubRepositories))
+		for p, r := range opts.SubRepositories {
+			if len(r.Branches) == 0 {
+				cp := *r
+				cp.Branches = opts.RepositoryDescription.Branches
+				r = &cp
+			}
+			subs[p] = r
+		}
+		opts.SubRepositories = subs
+	}
 
 	b := &Builder{
 		opts:           opts,
 		throttle:       make(chan int, opts.Parallelism),
+		ctx:            ctx,
+		shardEnds:      map[int]int{},
+		shardTemps:     map[int]string{},
 		finishedShards: map[string]string{},
 	}
 
+	var err error
+	if b.ignore, err = ignore.New(opts.IgnorePatterns); err != nil {
+		return nil, err
+	}
+
+	switch opts.LFSPointers {
+	case "", LFSPointersIndex, LFSPointersSkip:
+	case LFSPointersFetch:
+		if opts.LFSFetch == nil {
+			return nil, fmt.Errorf("builder: fetching LFS objects requires LFSFetch")
+		}
+	default:
+		return nil, fmt.Errorf("builder: unknown LFS pointer handling %q", opts.LFSPointers)
+	}
+
+	switch opts.ContentCompression {
+	case "", zoekt.ContentCompressionZstd:
+	default:
+		return nil, fmt.Errorf("builder: unknown content compression %q", opts.ContentCompression)
+	}
+	switch opts.PostingEncoding {
+	case "", zoekt.PostingEncodingRoaring:
+	default:
+		return nil, fmt.Errorf("builder: unknown posting encoding %q", opts.PostingEncoding)
+	}
+
 	if b.opts.CTags == "" && b.opts.CTagsMustSucceed {
 		return nil, fmt.Errorf("ctags binary not found, but CTagsMustSucceed set.")
 	}
 
-	if strings.Contains(opts.CTags, "universal-ctags") {
-		parser, err := ctags.NewParser(opts.CTags)
+	if opts.CTags != "" {
+		parser, err := ctags.NewParser(ctags.ParserOptions{
+			Bin:         opts.CTags,
+			Sandbox:     opts.CTagsSandbox,
+			LanguageMap: opts.CTagsLanguageMap,
+			Processes:   opts.Parallelism,
+		})
 		if err != nil && opts.CTagsMustSucceed {
 			return nil, fmt.Errorf("ctags.NewParser: %v", err)
+		} else if err != nil {
+			log.Printf("not extracting symbols: %v", err)
 		}
 
 		b.parser = parser
@@ -212,6 +387,9 @@ func NewBuilder(opts Options) (*Builder, error) {
 		return nil, err
 	}
 
+	if opts.Checkpoint {
+		b.resume()
+	}
 	return b, nil
 }
 
@@ -220,11 +398,58 @@ func (b *Builder) AddFile(name string, content []byte) error {
 }
 
 func (b *Builder) Add(doc zoekt.Document) error {
+	if err := b.ctx.Err(); err != nil {
+		return b.interrupt(err)
+	}
+
+	if doc.Name == ignore.FileName && doc.SubRepositoryPath == "" {
+		if err := b.addIgnoreFile(doc.Content); err != nil {
+			log.Printf("ignoring %s: %v", ignore.FileName, err)
+		}
+	}
+	if b.ignore.Match(doc.Name) {
+		return nil
+	}
+	if doc.Name == GitAttributesFile && doc.SubRepositoryPath == "" && !b.opts.PresetCategories {
+		if err := b.addGitAttributes(doc.Content); err != nil {
+			log.Printf("ignoring %s: %v", GitAttributesFile, err)
+		}
+	}
+
+	b.docs++
+	if b.docs <= b.skipDocs {
+		// Already in a shard from the checkpoint.
+		return nil
+	}
+	if !b.resolveLFS(&doc) {
+		return nil
+	}
+
+	// Files over the size limit are skipped below; don't spend
+	// time and memory decoding them.
+	if len(doc.Content) <= b.opts.SizeMax {
+		if content, ok := decodeUTF16(doc.Content); ok {
+			if doc.Size == 0 {
+				doc.Size = int64(len(doc.Content))
+			}
+			doc.Content = content
+		}
+	}
+	b.opts.transform(&doc)
+	if !b.opts.PresetCategories {
+		doc.Category = b.attributes.Category(doc.Name, doc.Category|DetectCategory(doc.Name, doc.Content))
+	}
+	if doc.SubRepositoryPath == "" {
+		doc.SubRepositoryPath = b.opts.subRepositoryPath(doc.Name)
+	}
+
 	// We could pass the document on to the shardbuilder, but if
 	// we pass through a part of the source tree with binary/large
 	// files, the corresponding shard would be mostly empty, so
 	// insert a reason here too.
-	if len(doc.Content) > b.opts.SizeMax {
+	if doc.SkipReason != "" {
+		// Skipped by a transformer.
+	} else if len(doc.Content) > b.opts.SizeMax {
 		doc.SkipReason = fmt.Sprintf("document size %d larger than limit %d", len(doc.Content), b.opts.SizeMax)
 	} else if err := zoekt.CheckText(doc.Content); err != nil {
 		doc.SkipReason = err.Error()
@@ -240,19 +465,89 @@ func (b *Builder) Add(doc zoekt.Document) error {
 	return nil
 }
 
+// addIgnoreFile adds the patterns of the ignore file of the
+// repository. Documents added before it are dropped if they are not
+// in a shard yet, so the file should be added early.
+func (b *Builder) addIgnoreFile(content []byte) error {
+	m, err := ignore.Parse(content)
+	if err != nil {
+		return err
+	}
+	if opts, err := ignore.New(b.opts.IgnorePatterns); err == nil {
+		m.Merge(opts)
+	}
+	b.ignore = m
+
+	if b.nextShardNum > 0 {
+		log.Printf("%s added after the first shard was built; its patterns only apply to later files", ignore.FileName)
+	}
+	kept := b.todo[:0]
+	b.size = 0
+	for _, d := range b.todo {
+		if !b.ignore.Match(d.Name) {
+			kept = append(kept, d)
+			b.size += len(d.Name) + len(d.Content)
+		}
+	}
+	b.todo = kept
+	return nil
+}
+
+// addGitAttributes reads the linguist attributes of the repository.
+// Like the ignore file, it only applies to documents that are not in
+// a shard yet.
+func (b *Builder) addGitAttributes(content []byte) error {
+	attrs, err := ParseGitAttributes(content)
+	if err != nil {
+		return err
+	}
+	b.attributes = attrs
+
+	if b.nextShardNum > 0 {
+		log.Printf("%s added after the first shard was built; its attributes only apply to later files", GitAttributesFile)
+	}
+	for _, d := range b.todo {
+		d.Category = attrs.Category(d.Name, d.Category)
+	}
+	return nil
+}
+
 func (b *Builder) Finish() error {
+	if b.parser != nil {
+		defer b.parser.Close()
+	}
+	if err := b.ctx.Err(); err != nil {
+		return b.interrupt(err)
+	}
+
 	b.flush()
 	b.building.Wait()
 
+	if err := b.ctx.Err(); err != nil {
+		return b.interrupt(err)
+	}
+
 	if b.buildError != nil {
 		for tmp := range b.finishedShards {
 			log.Printf("Builder.Finish %s", tmp)
 			os.Remove(tmp)
 		}
+		os.Remove(b.opts.checkpointName())
 		return b.buildError
 	}
 
+	if b.opts.KeepVersions > 0 {
+		if err := b.keepIndexedVersion(); err != nil {
+			for tmp := range b.finishedShards {
+				os.Remove(tmp)
+			}
+			return err
+		}
+	}
+
 	for tmp, final := range b.finishedShards {
+		// The new shard has up to date metadata.
+		os.Remove(zoekt.ShardMetaName(final))
 		if err := os.Rename(tmp, final); err != nil {
 			b.buildError = err
 		}
@@ -261,9 +556,44 @@ func (b *Builder) Finish() error {
 	if b.nextShardNum > 0 {
 		b.deleteRemainingShards()
 	}
+	if b.buildError == nil {
+		b.deleteOlderVersions()
+	}
+	if b.opts.Checkpoint {
+		os.Remove(b.opts.checkpointName())
+	}
 	return b.buildError
 }
 
+// interrupt stops the build after the shards in progress are
+// done. Without checkpointing, the finished shards are discarded.
+func (b *Builder) interrupt(err error) error {
+	b.building.Wait()
+
+	b.errMu.Lock()
+	defer b.errMu.Unlock()
+	if b.buildError == nil {
+		b.buildError = err
+	}
+	if !b.opts.Checkpoint {
+		for tmp := range b.finishedShards {
+			os.Remove(tmp)
+		}
+		b.finishedShards = map[string]string{}
+	}
+	return b.buildError
+}
+
+// shardDone records a successfully built shard. Must be called with
+// b.errMu held.
+func (b *Builder) shardDone(shard int, done *finishedShard) {
+	b.finishedShards[done.temp] = done.final
+	b.shardTemps[shard] = done.temp
+	if b.opts.Checkpoint {
+		b.writeCheckpoint()
+	}
+}
+
 func (b *Builder) deleteRemainingShards() {
 	for {
 		shard := b.nextShardNum
@@ -274,12 +604,37 @@ func (b *Builder) deleteRemainingShards() {
 		}
 
 		log.Printf("Builder.deleteRemainingShards %s", name)
+		os.Remove(zoekt.ShardMetaName(name))
 		if err := os.Remove(name); os.IsNotExist(err) {
 			break
 		}
 	}
 }
 
+var shardVersionRE = regexp.MustCompile(`^_v([0-9]+)\.[0-9]+\.zoekt$`)
+
+// deleteOlderVersions deletes the shards of the repository in older
+// format versions. Those may still be searchable, and would
+// duplicate the new shards.
+func (b *Builder) deleteOlderVersions() {
+	prefix := filepath.Join(b.opts.shardDir(), b.opts.shardPrefix())
+	fs, err := filepath.Glob(prefix + "_v*.zoekt")
+	if err != nil {
+		return
+	}
+	for _, fn := range fs {
+		m := shardVersionRE.FindStringSubmatch(fn[len(prefix):])
+		if m == nil {
+			continue
+		}
+		if v, err := strconv.Atoi(m[1]); err == nil && v < zoekt.IndexFormatVersion {
+			log.Printf("Builder.deleteOlderVersions %s", fn)
+			os.Remove(fn)
+			os.Remove(zoekt.ShardMetaName(fn))
+		}
+	}
+}
+
 func (b *Builder) flush() error {
 	todo := b.todo
 	b.todo = nil
@@ -297,6 +652,7 @@ func (b *Builder) flush() error {
 
 	shard := b.nextShardNum
 	b.nextShardNum++
+	b.shardEnds[shard] = b.docs
 
 	if b.opts.Parallelism > 1 {
 		b.building.Add(1)
@@ -311,7 +667,7 @@ func (b *Builder) flush() error {
 				b.buildError = err
 			}
 			if err == nil {
-				b.finishedShards[done.temp] = done.final
+				b.shardDone(shard, done)
 			}
 			b.building.Done()
 		}()
@@ -321,7 +677,7 @@ func (b *Builder) flush() error {
 		done, err := b.buildShard(todo, shard)
 		b.buildError = err
 		if err == nil {
-			b.finishedShards[done.temp] = done.final
+			b.shardDone(shard, done)
 		}
 		if b.opts.MemProfile != "" {
 			// drop memory, and profile.
@@ -373,6 +729,9 @@ func rank(d *zoekt.Document, origIdx int) []float64 {
 
 	// Smaller is earlier (=better).
 	return []float64{
+		// Prefer docs with a high explicit rank
+		1.0 - d.Rank,
+
 		// Prefer docs that are not tests
 		test,
 
@@ -419,8 +778,8 @@ func sortDocuments(todo []*zoekt.Document) {
 }
 
 func (b *Builder) buildShard(todo []*zoekt.Document, nextShardNum int) (*finishedShard, error) {
-	if b.opts.CTags != "" {
-		err := ctagsAddSymbols(todo, b.parser, b.opts.CTags)
+	if b.parser != nil {
+		err := ctagsAddSymbols(todo, b.parser)
 		if b.opts.CTagsMustSucceed && err != nil {
 			return nil, err
 		}
@@ -429,6 +788,12 @@ func (b *Builder) buildShard(todo []*zoekt.Document, nextShardNum int) (*finishe
 		}
 	}
 
+	if b.opts.FileNamesOnly {
+		for _, t := range todo {
+			keepSymbolLines(t)
+		}
+	}
+
 	name, err := b.opts.shardName(nextShardNum)
 	if err != nil {
 		return nil, err
@@ -451,11 +816,18 @@ func (b *Builder) buildShard(todo []*zoekt.Document, nextShardNum int) (*finishe
 func (b *Builder) newShardBuilder() (*zoekt.IndexBuilder, error) {
 	desc := b.opts.RepositoryDescription
 	desc.SubRepoMap = b.opts.SubRepositories
+	desc.FileNamesOnly = b.opts.FileNamesOnly
 
 	shardBuilder, err := zoekt.NewIndexBuilder(&desc)
 	if err != nil {
 		return nil, err
 	}
+	if err := shardBuilder.SetContentCompression(b.opts.ContentCompression); err != nil {
+		return nil, err
+	}
+	if err := shardBuilder.SetPostingEncoding(b.opts.PostingEncoding); err != nil {
+		return nil, err
+	}
 	return shardBuilder, nil
 }
 
@@ -0,0 +1,225 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/ignore"
+)
+
+// GitAttributesFile holds the linguist-generated and
+// linguist-vendored attributes that override DetectCategory.
+const GitAttributesFile = ".gitattributes"
+
+// vendorDirs are directories holding third party code.
+var vendorDirs = map[string]bool{
+	"vendor":           true,
+	"node_modules":     true,
+	"bower_components": true,
+	"third_party":      true,
+	"third-party":      true,
+	"Godeps":           true,
+}
+
+// testDirs are directories holding tests and their data.
+var testDirs = map[string]bool{
+	"test":      true,
+	"tests":     true,
+	"__tests__": true,
+	"spec":      true,
+	"testdata":  true,
+}
+
+// generatedSuffixes are file name endings of generated files.
+var generatedSuffixes = []string{
+	".pb.go", ".pb.gw.go", ".pb.cc", ".pb.h", "_pb2.py", "_pb2_grpc.py",
+	"_generated.go", ".gen.go",
+	".min.js", ".min.css", ".js.map", ".css.map",
+}
+
+// lockFiles are the lock files of package managers.
+var lockFiles = map[string]bool{
+	"package-lock.json": true,
+	"yarn.lock":         true,
+	"pnpm-lock.yaml":    true,
+	"go.sum":            true,
+	"Cargo.lock":        true,
+	"Gemfile.lock":      true,
+	"composer.lock":     true,
+	"poetry.lock":       true,
+}
+
+// testSuffixes are file name endings of tests.
+var testSuffixes = []string{
+	"_test.go", "_test.py", "_test.cc", "_test.rb", "_spec.rb",
+	"Test.java", "Tests.java", "Test.kt", "Tests.cs",
+	".test.js", ".test.ts", ".test.jsx", ".test.tsx",
+	".spec.js", ".spec.ts", ".spec.jsx", ".spec.tsx",
+}
+
+// generatedHeaderSize is how much of the start of a file is searched
+// for a marker of generated code.
+const generatedHeaderSize = 1024
+
+// DetectCategory guesses the categories of a file from its name and
+// the start of its content, after the heuristics of GitHub's
+// linguist.
+func DetectCategory(name string, content []byte) zoekt.FileCategory {
+	var c zoekt.FileCategory
+	dirs := strings.Split(path.Dir(name), "/")
+	for _, d := range dirs {
+		if vendorDirs[d] {
+			c |= zoekt.FileCategoryVendored
+		}
+		if testDirs[d] {
+			c |= zoekt.FileCategoryTest
+		}
+	}
+
+	base := path.Base(name)
+	if lockFiles[base] || hasAnySuffix(base, generatedSuffixes) || hasGeneratedHeader(content) {
+		c |= zoekt.FileCategoryGenerated
+	}
+	if hasAnySuffix(base, testSuffixes) || strings.HasPrefix(base, "test_") && strings.HasSuffix(base, ".py") {
+		c |= zoekt.FileCategoryTest
+	}
+	return c
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suf := range suffixes {
+		if strings.HasSuffix(s, suf) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGeneratedHeader returns whether a line at the start of content
+// marks the file as generated, such as the "Code generated ... DO
+// NOT EDIT." comment of Go, or "@generated".
+func hasGeneratedHeader(content []byte) bool {
+	if len(content) > generatedHeaderSize {
+		content = content[:generatedHeaderSize]
+	}
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if bytes.Contains(line, []byte("@generated")) {
+			return true
+		}
+		if bytes.Contains(line, []byte("DO NOT EDIT")) && bytes.Contains(bytes.ToLower(line), []byte("generated")) {
+			return true
+		}
+	}
+	return false
+}
+
+// attributeRule sets or unsets an attribute for the files matching a
+// pattern of a .gitattributes file.
+type attributeRule struct {
+	files *ignore.Matcher
+	attr  string
+	set   bool
+}
+
+// GitAttributes are the attributes of a .gitattributes file that
+// zoekt understands. Later rules take precedence.
+type GitAttributes []attributeRule
+
+// exportIgnore marks files left out of archives by git archive, and
+// so also out of the tarballs indexed by zoekt-archive-index.
+const exportIgnore = "export-ignore"
+
+// linguistAttributes maps the linguist attributes we understand to
+// the category they set.
+var linguistAttributes = map[string]zoekt.FileCategory{
+	"linguist-generated": zoekt.FileCategoryGenerated,
+	"linguist-vendored":  zoekt.FileCategoryVendored,
+}
+
+// ParseGitAttributes reads the linguist-generated, linguist-vendored
+// and export-ignore attributes from the content of a .gitattributes
+// file. Other attributes are ignored.
+func ParseGitAttributes(content []byte) (GitAttributes, error) {
+	var attrs GitAttributes
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var files *ignore.Matcher
+		for _, a := range fields[1:] {
+			set := true
+			if strings.HasPrefix(a, "-") || strings.HasPrefix(a, "!") {
+				set = false
+				a = a[1:]
+			}
+			if i := strings.Index(a, "="); i >= 0 {
+				switch a[i+1:] {
+				case "true", "set":
+				case "false", "unset":
+					set = false
+				default:
+					continue
+				}
+				a = a[:i]
+			}
+			if _, ok := linguistAttributes[a]; !ok && a != exportIgnore {
+				continue
+			}
+			if files == nil {
+				m, err := ignore.New([]string{fields[0]})
+				if err != nil {
+					return nil, err
+				}
+				files = m
+			}
+			attrs = append(attrs, attributeRule{files: files, attr: a, set: set})
+		}
+	}
+	return attrs, scanner.Err()
+}
+
+// Category returns the categories of the file name, starting from c.
+func (a GitAttributes) Category(name string, c zoekt.FileCategory) zoekt.FileCategory {
+	for _, r := range a {
+		cat, ok := linguistAttributes[r.attr]
+		if !ok || !r.files.Match(name) {
+			continue
+		}
+		if r.set {
+			c |= cat
+		} else {
+			c &^= cat
+		}
+	}
+	return c
+}
+
+// ExportIgnore returns whether the file name has the export-ignore
+// attribute, starting from ignored.
+func (a GitAttributes) ExportIgnore(name string, ignored bool) bool {
+	for _, r := range a {
+		if r.attr == exportIgnore && r.files.Match(name) {
+			ignored = r.set
+		}
+	}
+	return ignored
+}
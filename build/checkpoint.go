@@ -0,0 +1,181 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/zoekt"
+)
+
+// checkpoint records the finished shards of an interrupted build.
+type checkpoint struct {
+	// Key identifies the build; a checkpoint is only resumed by a
+	// build with the same key.
+	Key string
+
+	// Docs is the number of documents added to Shards.
+	Docs int
+
+	// Shards holds the temporary file names of the finished
+	// shards, in order.
+	Shards []string
+}
+
+// checkpointName returns the name of the checkpoint file.
+func (o *Options) checkpointName() string {
+	return filepath.Join(o.shardDir(),
+		fmt.Sprintf("%s_v%d.checkpoint", o.shardPrefix(), zoekt.IndexFormatVersion))
+}
+
+// checkpointKey summarizes the options that determine the shard
+// contents, so a checkpoint of a different build is not resumed.
+func (o *Options) checkpointKey() string {
+	blob, _ := json.Marshal(struct {
+		Format, Feature   int
+		ShardMax, SizeMax int
+		Branches          []zoekt.RepositoryBranch
+		Subs              map[string]*zoekt.Repository
+		FileNamesOnly     bool
+		LFSPointers       string
+	}{
+		zoekt.IndexFormatVersion, zoekt.FeatureVersion,
+		o.ShardMax, o.SizeMax,
+		o.RepositoryDescription.Branches,
+		o.SubRepositories,
+		o.FileNamesOnly,
+		o.LFSPointers,
+	})
+	return hashString(string(blob))
+}
+
+// resume picks up the shards of a previous, interrupted build. The
+// documents they hold are skipped when added again.
+func (b *Builder) resume() {
+	fn := b.opts.checkpointName()
+	blob, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return
+	}
+
+	var cp checkpoint
+	if err == nil {
+		err = json.Unmarshal(blob, &cp)
+	}
+	if err == nil && cp.Key != b.opts.checkpointKey() {
+		err = fmt.Errorf("options changed")
+	}
+	for _, tmp := range cp.Shards {
+		if err != nil {
+			break
+		}
+		_, err = os.Stat(tmp)
+	}
+	if err != nil {
+		log.Printf("discarding checkpoint %s: %v", fn, err)
+		for _, tmp := range cp.Shards {
+			os.Remove(tmp)
+		}
+		os.Remove(fn)
+		return
+	}
+
+	for i, tmp := range cp.Shards {
+		final, err := b.opts.shardName(i)
+		if err != nil {
+			return
+		}
+		b.finishedShards[tmp] = final
+		b.shardTemps[i] = tmp
+	}
+	b.nextShardNum = len(cp.Shards)
+	b.skipDocs = cp.Docs
+	if len(cp.Shards) > 0 {
+		b.shardEnds[len(cp.Shards)-1] = cp.Docs
+	}
+	log.Printf("resuming from %s: %d shards, %d documents", fn, len(cp.Shards), cp.Docs)
+}
+
+// writeCheckpoint records the longest run of finished shards
+// starting at shard 0. Must be called with b.errMu held.
+func (b *Builder) writeCheckpoint() {
+	cp := checkpoint{Key: b.opts.checkpointKey()}
+	for n := 0; ; n++ {
+		tmp, ok := b.shardTemps[n]
+		if !ok {
+			break
+		}
+		cp.Shards = append(cp.Shards, tmp)
+		cp.Docs = b.shardEnds[n]
+	}
+	if len(cp.Shards) == 0 {
+		return
+	}
+
+	blob, err := json.Marshal(&cp)
+	if err != nil {
+		log.Printf("checkpoint: %v", err)
+		return
+	}
+	fn := b.opts.checkpointName()
+	if err := ioutil.WriteFile(fn+".tmp", blob, 0644); err != nil {
+		log.Printf("checkpoint: %v", err)
+		return
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		log.Printf("checkpoint: %v", err)
+	}
+}
+
+// tempShardRE matches the temporary files of shards being written,
+// see Builder.writeShard.
+var tempShardRE = regexp.MustCompile(`\.zoekt[0-9]+$`)
+
+// CleanTemporaryFiles removes the temporary files of an interrupted
+// build of the repository, eg. one whose process was killed. The
+// finished shards recorded in its checkpoint are kept, so the next
+// build resumes from them.
+func (o *Options) CleanTemporaryFiles() error {
+	keep := map[string]bool{}
+	if blob, err := ioutil.ReadFile(o.checkpointName()); err == nil {
+		var cp checkpoint
+		if json.Unmarshal(blob, &cp) == nil {
+			for _, tmp := range cp.Shards {
+				keep[tmp] = true
+			}
+		}
+	}
+
+	fs, err := filepath.Glob(filepath.Join(o.shardDir(),
+		fmt.Sprintf("%s_v%d.*", o.shardPrefix(), zoekt.IndexFormatVersion)))
+	if err != nil {
+		return err
+	}
+	for _, fn := range fs {
+		if keep[fn] || !tempShardRE.MatchString(fn) && filepath.Ext(fn) != ".tmp" {
+			continue
+		}
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,15 +15,20 @@
 package build
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf16"
 
 	"golang.org/x/net/context"
 
@@ -253,6 +258,67 @@ func TestDeleteOldShards(t *testing.T) {
 	}
 }
 
+func TestDeleteOlderVersions(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, fmt.Sprintf("repo_v%d.00000.zoekt", zoekt.IndexFormatVersion-1))
+	other := filepath.Join(dir, fmt.Sprintf("repo_vendor_v%d.00000.zoekt", zoekt.IndexFormatVersion-1))
+	for _, fn := range []string{old, other} {
+		if err := ioutil.WriteFile(fn, []byte("old shard"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewBuilder(Options{
+		IndexDir:              dir,
+		RepositoryDescription: zoekt.Repository{Name: "repo"},
+	})
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("F", []byte("content"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("shard of the previous version was kept: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("shard of another repository: %v", err)
+	}
+}
+
+func TestTenantDir(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewBuilder(Options{
+		IndexDir:              dir,
+		RepositoryDescription: zoekt.Repository{Name: "repo", TenantID: "../x"},
+	}); err == nil {
+		t.Errorf("NewBuilder accepted an invalid tenant ID")
+	}
+
+	b, err := NewBuilder(Options{
+		IndexDir:              dir,
+		RepositoryDescription: zoekt.Repository{Name: "repo", TenantID: "acme"},
+	})
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("F", []byte("content"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	fs, err := zoekt.ListShards(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "tenant-acme", fmt.Sprintf("repo_v%d.00000.zoekt", zoekt.IndexFormatVersion))
+	if len(fs) != 1 || fs[0] != want {
+		t.Errorf("got shards %v, want %s", fs, want)
+	}
+}
+
 func TestPartialSuccess(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -414,3 +480,621 @@ func TestEmptyContent(t *testing.T) {
 		t.Errorf("got %+v, want 1 repo.", result.Repos)
 	}
 }
+
+func TestMergedRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name:     "repo",
+			Branches: []zoekt.RepositoryBranch{{Name: "master", Version: "v1"}},
+		},
+		SubRepositories: map[string]*zoekt.Repository{
+			"docs": {
+				Name:            "docs-repo",
+				FileURLTemplate: "https://docs/{{.Path}}",
+			},
+		},
+	}
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.Add(zoekt.Document{Name: "main.go", Content: []byte("needle in code"), Branches: []string{"master"}})
+	b.Add(zoekt.Document{Name: "docs/index.md", Content: []byte("needle in docs"), Branches: []string{"master"}})
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	result, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle in docs"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(result.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", result.Files)
+	}
+	f := result.Files[0]
+	if f.Repository != "repo" || f.SubRepositoryName != "docs-repo" || f.SubRepositoryPath != "docs" || f.Version != "v1" {
+		t.Errorf("got %#v, want file in docs-repo subrepository", f)
+	}
+	if got := result.RepoURLs["docs-repo"]; got != "https://docs/{{.Path}}" {
+		t.Errorf("got URL template %q for docs-repo", got)
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		ShardMax: 512,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		SizeMax:    1 << 20,
+		Checkpoint: true,
+	}
+
+	// Each document fills a shard. Interrupt after two of them.
+	ctx, cancel := context.WithCancel(context.Background())
+	b, err := NewBuilderContext(ctx, opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			cancel()
+		}
+		s := fmt.Sprintf("%d", i)
+		if err := b.AddFile("F"+s, []byte(strings.Repeat(s, 1000))); err != nil {
+			if i != 2 || err != context.Canceled {
+				t.Fatalf("AddFile %d: %v", i, err)
+			}
+			break
+		}
+	}
+	if err := b.Finish(); err != context.Canceled {
+		t.Fatalf("Finish: got %v, want context.Canceled", err)
+	}
+	if fs, _ := filepath.Glob(filepath.Join(dir, "*.zoekt")); len(fs) != 0 {
+		t.Fatalf("got final shards %v after interrupt", fs)
+	}
+	if _, err := os.Stat(opts.checkpointName()); err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+
+	b, err = NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	if b.skipDocs != 2 || b.nextShardNum != 2 {
+		t.Errorf("resumed at doc %d, shard %d, want 2, 2", b.skipDocs, b.nextShardNum)
+	}
+	for i := 0; i < 4; i++ {
+		s := fmt.Sprintf("%d", i)
+		if err := b.AddFile("F"+s, []byte(strings.Repeat(s, 1000))); err != nil {
+			t.Fatalf("AddFile %d: %v", i, err)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if _, err := os.Stat(opts.checkpointName()); !os.IsNotExist(err) {
+		t.Errorf("checkpoint still present: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+	for i := 0; i < 4; i++ {
+		q := &query.Substring{Pattern: strings.Repeat(fmt.Sprintf("%d", i), 3)}
+		res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) != 1 {
+			t.Errorf("%s: got %v, want 1 file", q, res.Files)
+		}
+	}
+}
+
+func TestCleanTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		IndexDir:              dir,
+		RepositoryDescription: zoekt.Repository{Name: "repo"},
+	}
+	shard0, _ := opts.shardName(0)
+	shard1, _ := opts.shardName(1)
+	other := Options{
+		IndexDir:              dir,
+		RepositoryDescription: zoekt.Repository{Name: "other"},
+	}
+	otherShard, _ := other.shardName(0)
+
+	blob, _ := json.Marshal(&checkpoint{Shards: []string{shard0 + "123"}})
+	if err := ioutil.WriteFile(opts.checkpointName(), blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	kept := []string{
+		opts.checkpointName(),
+		shard0,
+		zoekt.ShardMetaName(shard0),
+		shard0 + "123",
+		otherShard + "789",
+	}
+	removed := []string{
+		shard1 + "456",
+		zoekt.ShardMetaName(shard0) + ".tmp",
+		opts.checkpointName() + ".tmp",
+	}
+	for _, fn := range append(kept[1:], removed...) {
+		if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := opts.CleanTemporaryFiles(); err != nil {
+		t.Fatalf("CleanTemporaryFiles: %v", err)
+	}
+	got, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(kept)
+	if !reflect.DeepEqual(got, kept) {
+		t.Errorf("got %v, want %v", got, kept)
+	}
+}
+
+func TestKeepVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, v := range []string{"v1", "v2", "v3"} {
+		opts := Options{
+			IndexDir: dir,
+			RepositoryDescription: zoekt.Repository{
+				Name:     "repo",
+				Branches: []zoekt.RepositoryBranch{{Name: "HEAD", Version: v}},
+			},
+			KeepVersions: 1,
+		}
+		b, err := NewBuilder(opts)
+		if err != nil {
+			t.Fatalf("NewBuilder: %v", err)
+		}
+		b.Add(zoekt.Document{Name: "F", Content: []byte("needle " + v), Branches: []string{"HEAD"}})
+		if err := b.Finish(); err != nil {
+			t.Fatalf("Finish: %v", err)
+		}
+	}
+
+	fs, err := filepath.Glob(filepath.Join(dir, "*.zoekt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 2 {
+		t.Fatalf("got shards %v, want the current and one kept version", fs)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		q    query.Q
+		want string
+	}{
+		{&query.Substring{Pattern: "needle"}, "v3"},
+		{query.NewAnd(&query.Substring{Pattern: "needle"}, &query.RepoCommit{Repo: "repo", Commit: "v3"}), "v3"},
+		{query.NewAnd(&query.Substring{Pattern: "needle"}, &query.RepoCommit{Repo: "repo", Commit: "v2"}), "v2"},
+	} {
+		res, err := ss.Search(ctx, c.q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search(%s): %v", c.q, err)
+		}
+		if len(res.Files) != 1 || res.Files[0].Version != c.want {
+			t.Errorf("Search(%s): got %v, want 1 file at %s", c.q, res.Files, c.want)
+		}
+	}
+
+	q := &query.RepoCommit{Repo: "repo", Commit: "v1"}
+	if _, err := ss.Search(ctx, q, &zoekt.SearchOptions{}); zoekt.ErrorCodeOf(err) != zoekt.CodeCommitNotIndexed {
+		t.Errorf("Search(%s): got error %v, want code %v", q, err, zoekt.CodeCommitNotIndexed)
+	}
+}
+
+func TestTransformers(t *testing.T) {
+	dir := t.TempDir()
+
+	redact := regexp.MustCompile(`password=\S+`)
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		Transformers: []DocumentTransformer{
+			DocumentTransformerFunc(func(doc *zoekt.Document) error {
+				doc.Content = redact.ReplaceAll(doc.Content, []byte("password=REDACTED"))
+				return nil
+			}),
+			DocumentTransformerFunc(func(doc *zoekt.Document) error {
+				if strings.HasSuffix(doc.Name, ".ipynb") {
+					return fmt.Errorf("notebooks not supported")
+				}
+				return nil
+			}),
+		},
+	}
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("config", []byte("user=me password=hunter2"))
+	b.AddFile("nb.ipynb", []byte("needle"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	ctx := context.Background()
+	for pat, want := range map[string]int{"hunter2": 0, "REDACTED": 1, "needle": 0, "notebooks not supported": 1} {
+		result, err := ss.Search(ctx, &query.Substring{Pattern: pat}, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(result.Files) != want {
+			t.Errorf("%q: got %d files, want %d", pat, len(result.Files), want)
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		IgnorePatterns: []string{"*.min.js"},
+	}
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	// Added before the ignore file, but still dropped.
+	b.AddFile(".github/generated.go", []byte("needle"))
+	b.AddFile(".zoektignore", []byte("vendor/\ngenerated.go\n"))
+	b.AddFile("main.go", []byte("needle"))
+	b.AddFile("app.min.js", []byte("needle"))
+	b.AddFile("vendor/dep.go", []byte("needle"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	result, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	var names []string
+	for _, f := range result.Files {
+		names = append(names, f.FileName)
+	}
+	if want := []string{"main.go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+	}
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	// Added before the attributes, but still marked.
+	b.AddFile("gen/schema.go", []byte("needle"))
+	b.AddFile(".gitattributes", []byte("gen/** linguist-generated\napi.pb.go -linguist-generated\n*.txt text\n"))
+	b.AddFile("main.go", []byte("needle"))
+	b.AddFile("api.pb.go", []byte("needle"))
+	b.AddFile("stub.go", []byte("// Code generated by stringer. DO NOT EDIT.\nneedle"))
+	b.AddFile("vendor/dep/dep.go", []byte("needle"))
+	b.AddFile("main_test.go", []byte("needle"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	result, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got := map[string]zoekt.FileCategory{}
+	for _, f := range result.Files {
+		got[f.FileName] = f.Category
+	}
+	want := map[string]zoekt.FileCategory{
+		"gen/schema.go":     zoekt.FileCategoryGenerated,
+		"main.go":           0,
+		"api.pb.go":         0,
+		"stub.go":           zoekt.FileCategoryGenerated,
+		"vendor/dep/dep.go": zoekt.FileCategoryVendored,
+		"main_test.go":      zoekt.FileCategoryTest,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUTF16(t *testing.T) {
+	dir := t.TempDir()
+
+	encode := func(s string, bom bool, bigEndian bool) []byte {
+		var out []byte
+		if bom {
+			out = append(out, 0xff, 0xfe)
+			if bigEndian {
+				out[0], out[1] = 0xfe, 0xff
+			}
+		}
+		for _, u := range utf16.Encode([]rune(s)) {
+			if bigEndian {
+				out = append(out, byte(u>>8), byte(u))
+			} else {
+				out = append(out, byte(u), byte(u>>8))
+			}
+		}
+		return out
+	}
+
+	b, err := NewBuilder(Options{
+		IndexDir:              dir,
+		RepositoryDescription: zoekt.Repository{Name: "repo"},
+		SizeMax:               64,
+	})
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	// The size limit applies before decoding.
+	b.AddFile("large.txt", encode("needle "+strings.Repeat("x", 30), true, false))
+	b.AddFile("le-bom.txt", encode("needle one\r\nhaystack", true, false))
+	b.AddFile("be-bom.txt", encode("needle twö\r\nhaystack", true, true))
+	b.AddFile("le.txt", encode("needle three\r\nhaystack", false, false))
+	b.AddFile("bin", []byte{0, 0, 'n', 0, 'e', 0, 'e', 0, 'd', 0, 'l', 0, 'e', 0})
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range res.Files {
+		for _, lm := range f.LineMatches {
+			got[f.FileName] = string(lm.Line)
+		}
+		if f.LineEnding != zoekt.LineEndingCRLF {
+			t.Errorf("%s: got line ending %v, want CRLF", f.FileName, f.LineEnding)
+		}
+	}
+	want := map[string]string{
+		"le-bom.txt": "needle one",
+		"be-bom.txt": "needle twö",
+		"le.txt":     "needle three",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLFSPointers(t *testing.T) {
+	object := []byte("needle in a large file\n")
+	p := LFSPointer{OID: fmt.Sprintf("%x", sha256.Sum256(object)), Size: int64(len(object))}
+	if got, ok := ParseLFSPointer(p.Bytes()); !ok || got != p {
+		t.Fatalf("ParseLFSPointer(%q) = %v, %v, want %v", p.Bytes(), got, ok, p)
+	}
+	for _, c := range []string{
+		"needle\n",
+		"version https://git-lfs.github.com/spec/v1\nsize 12\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:abc\nsize 12\n",
+	} {
+		if _, ok := ParseLFSPointer([]byte(c)); ok {
+			t.Errorf("ParseLFSPointer(%q) succeeded", c)
+		}
+	}
+
+	// missing points to an object that is not in the store.
+	missing := LFSPointer{OID: strings.Repeat("0", 64), Size: 6}
+	store := t.TempDir()
+	fn := LFSObjectPath(store, p)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, object, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for mode, want := range map[string]map[string]string{
+		LFSPointersIndex: {"big.txt": "skipped", "gone.txt": "skipped", "small.txt": "needle"},
+		LFSPointersSkip:  {"small.txt": "needle"},
+		LFSPointersFetch: {"big.txt": "needle", "gone.txt": "skipped", "small.txt": "needle"},
+	} {
+		dir := t.TempDir()
+		opts := Options{
+			IndexDir:              dir,
+			RepositoryDescription: zoekt.Repository{Name: "repo"},
+			LFSPointers:           mode,
+			LFSFetch:              LFSDirFetcher(store),
+		}
+		b, err := NewBuilder(opts)
+		if err != nil {
+			t.Fatalf("NewBuilder: %v", err)
+		}
+		b.AddFile("big.txt", p.Bytes())
+		b.AddFile("gone.txt", missing.Bytes())
+		b.AddFile("small.txt", []byte("needle\n"))
+		if err := b.Finish(); err != nil {
+			t.Fatalf("Finish: %v", err)
+		}
+
+		ss, err := shards.NewDirectorySearcher(dir)
+		if err != nil {
+			t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+		}
+		result, err := ss.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{Whole: true})
+		ss.Close()
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		got := map[string]string{}
+		for _, f := range result.Files {
+			got[f.FileName] = "skipped"
+			if strings.Contains(string(f.Content), "needle") {
+				got[f.FileName] = "needle"
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestFileNamesOnly(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name:     "repo",
+			Branches: []zoekt.RepositoryBranch{{Name: "HEAD", Version: "v1"}},
+		},
+		FileNamesOnly: true,
+	}
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	content := []byte("needle one\r\nfunc Needle() {\r\n}\r\n")
+	if err := b.Add(zoekt.Document{
+		Name:    "main.go",
+		Content: content,
+		Symbols: []zoekt.DocumentSection{{Start: 17, End: 23}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b.AddFile("needle.txt", []byte("needle two"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if v := opts.IndexVersions(); len(v) != 1 {
+		t.Errorf("got versions %v, want the indexed branch", v)
+	}
+	// Switching modes reindexes the repository.
+	full := opts
+	full.FileNamesOnly = false
+	if v := full.IndexVersions(); v != nil {
+		t.Errorf("got versions %v without FileNamesOnly, want none", v)
+	}
+	compressed := opts
+	compressed.ContentCompression = zoekt.ContentCompressionZstd
+	if v := compressed.IndexVersions(); v != nil {
+		t.Errorf("got versions %v with compression, want none", v)
+	}
+
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	ctx := context.Background()
+	res, err := ss.Search(ctx, &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range res.Files {
+		for _, lm := range f.LineMatches {
+			got[f.FileName] = fmt.Sprintf("%d:%s", lm.LineNumber, lm.Line)
+		}
+		if f.Size == 0 {
+			t.Errorf("%s: lost its size", f.FileName)
+		}
+	}
+	want := map[string]string{
+		"main.go":    "2:func Needle() {",
+		"needle.txt": "0:needle.txt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	res, err = ss.Search(ctx, &query.Symbol{Atom: &query.Substring{Pattern: "Needle"}}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 || res.Files[0].LineMatches[0].LineFragments[0].LineOffset != 5 {
+		t.Errorf("symbol search: got %v", res.Files)
+	}
+
+	rl, err := ss.List(ctx, &query.Repo{Pattern: "repo"})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(rl.Repos) != 1 || !rl.Repos[0].Repository.FileNamesOnly {
+		t.Errorf("got %v, want a repo indexed with file names only", rl.Repos)
+	}
+}
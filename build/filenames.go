@@ -0,0 +1,73 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/google/zoekt"
+)
+
+// keepSymbolLines reduces the content of doc to the lines holding
+// its symbols, for Options.FileNamesOnly. The other lines are left
+// empty, so line numbers of symbol matches stay correct. Documents
+// without symbols keep no content at all.
+func keepSymbolLines(doc *zoekt.Document) {
+	if doc.SkipReason != "" {
+		return
+	}
+	if doc.Size == 0 {
+		doc.Size = int64(len(doc.Content))
+	}
+	if len(doc.Symbols) == 0 {
+		doc.Content = nil
+		return
+	}
+
+	syms := doc.Symbols
+	sort.Slice(syms, func(i, j int) bool { return syms[i].Start < syms[j].Start })
+
+	content := doc.Content
+	out := make([]byte, 0, len(content)/8)
+	next := 0
+	for start := 0; start < len(content); {
+		end := len(content)
+		if i := bytes.IndexByte(content[start:], '\n'); i >= 0 {
+			end = start + i + 1
+		}
+
+		if next < len(syms) && int(syms[next].Start) < end {
+			for ; next < len(syms) && int(syms[next].Start) < end; next++ {
+				s := &syms[next]
+				if int(s.End) > end {
+					s.End = uint32(end)
+				}
+				s.Start = s.Start - uint32(start) + uint32(len(out))
+				s.End = s.End - uint32(start) + uint32(len(out))
+			}
+			out = append(out, content[start:end]...)
+		} else {
+			// Keep the line terminator only.
+			for _, c := range content[start:end] {
+				if c == '\r' || c == '\n' {
+					out = append(out, c)
+				}
+			}
+		}
+		start = end
+	}
+	doc.Content = out
+}
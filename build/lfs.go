@@ -0,0 +1,179 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/zoekt"
+)
+
+// Values of Options.LFSPointers.
+const (
+	// LFSPointersIndex indexes the names of Git LFS pointer files,
+	// with the size of the object they point to. Their content is
+	// not indexed; the SkipReason says why.
+	LFSPointersIndex = "index"
+
+	// LFSPointersSkip leaves Git LFS pointer files out of the index.
+	LFSPointersSkip = "skip"
+
+	// LFSPointersFetch indexes the objects of Git LFS pointer
+	// files up to SizeMax bytes, fetched with Options.LFSFetch.
+	// Pointers to larger objects, or whose objects cannot be
+	// fetched, are indexed as with LFSPointersIndex.
+	LFSPointersFetch = "fetch"
+)
+
+// lfsPointerMax is the largest size of a pointer file that Git LFS
+// accepts.
+const lfsPointerMax = 1024
+
+// lfsVersions are the first lines of Git LFS pointer files.
+var lfsVersions = [][]byte{
+	[]byte("version https://git-lfs.github.com/spec/v1\n"),
+	// Written by the pre-release of Git LFS.
+	[]byte("version https://hawser.github.com/spec/v1\n"),
+}
+
+// LFSPointer is a Git LFS pointer file, which git stores instead of
+// the content of a large file.
+type LFSPointer struct {
+	// OID is the hex encoded SHA-256 of the object.
+	OID string
+
+	// Size of the object in bytes.
+	Size int64
+}
+
+// ParseLFSPointer returns the pointer held by content, if it is a
+// Git LFS pointer file.
+func ParseLFSPointer(content []byte) (LFSPointer, bool) {
+	var p LFSPointer
+	if len(content) > lfsPointerMax || !bytes.HasSuffix(content, []byte("\n")) {
+		return p, false
+	}
+	isPointer := false
+	for _, v := range lfsVersions {
+		if bytes.HasPrefix(content, v) {
+			isPointer = true
+		}
+	}
+	if !isPointer {
+		return p, false
+	}
+
+	haveSize := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")[1:] {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return p, false
+		}
+		switch key, value := line[:i], line[i+1:]; key {
+		case "oid":
+			oid := strings.TrimPrefix(value, "sha256:")
+			if len(oid) != 2*sha256.Size || oid == value {
+				return p, false
+			}
+			if _, err := hex.DecodeString(oid); err != nil {
+				return p, false
+			}
+			p.OID = strings.ToLower(oid)
+		case "size":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return p, false
+			}
+			p.Size = n
+			haveSize = true
+		}
+	}
+	return p, p.OID != "" && haveSize
+}
+
+// Bytes returns the pointer file of p.
+func (p LFSPointer) Bytes() []byte {
+	return []byte(fmt.Sprintf("%soid sha256:%s\nsize %d\n", lfsVersions[0], p.OID, p.Size))
+}
+
+// Verify returns an error unless content is the object of p.
+func (p LFSPointer) Verify(content []byte) error {
+	if int64(len(content)) != p.Size {
+		return fmt.Errorf("LFS object %s has %d bytes, want %d", p.OID, len(content), p.Size)
+	}
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != p.OID {
+		return fmt.Errorf("LFS object %s has SHA-256 %x", p.OID, sum)
+	}
+	return nil
+}
+
+// LFSObjectPath returns the path of the object of p in the Git LFS
+// object store dir, eg. .git/lfs/objects.
+func LFSObjectPath(dir string, p LFSPointer) string {
+	return filepath.Join(dir, p.OID[:2], p.OID[2:4], p.OID)
+}
+
+// LFSDirFetcher returns an Options.LFSFetch that reads objects from
+// the Git LFS object store dir.
+func LFSDirFetcher(dir string) func(context.Context, LFSPointer) ([]byte, error) {
+	return func(_ context.Context, p LFSPointer) ([]byte, error) {
+		return ioutil.ReadFile(LFSObjectPath(dir, p))
+	}
+}
+
+// resolveLFS handles doc if it is a Git LFS pointer file, following
+// Options.LFSPointers. It returns false if doc should not be indexed.
+func (b *Builder) resolveLFS(doc *zoekt.Document) bool {
+	if doc.SkipReason != "" {
+		return true
+	}
+	p, ok := ParseLFSPointer(doc.Content)
+	if !ok {
+		return true
+	}
+	switch b.opts.LFSPointers {
+	case LFSPointersSkip:
+		return false
+	case LFSPointersFetch:
+		if p.Size > int64(b.opts.SizeMax) {
+			break
+		}
+		content, err := b.opts.LFSFetch(b.ctx, p)
+		if err == nil {
+			err = p.Verify(content)
+		}
+		if err == nil {
+			doc.Content = content
+			return true
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("fetching LFS object of %s: %v", doc.Name, err)
+		}
+	}
+	doc.Content = nil
+	doc.Size = p.Size
+	doc.SkipReason = fmt.Sprintf("Git LFS object of %d bytes, sha256:%s", p.Size, p.OID)
+	return true
+}
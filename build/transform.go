@@ -0,0 +1,55 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+
+	"github.com/google/zoekt"
+)
+
+// DocumentTransformer rewrites documents before they are indexed, for
+// example to strip the outputs of Jupyter notebooks, redact secrets or
+// extract the text of generated formats. UTF-16 files are converted to
+// UTF-8 before transformers run.
+type DocumentTransformer interface {
+	// Transform modifies doc in place. It may change any field,
+	// including the name, or set a SkipReason so only the name of
+	// the document is indexed. If it returns an error, the
+	// document is skipped with the error as its SkipReason.
+	Transform(doc *zoekt.Document) error
+}
+
+// DocumentTransformerFunc adapts a function to the
+// DocumentTransformer interface.
+type DocumentTransformerFunc func(doc *zoekt.Document) error
+
+// Transform calls f(doc).
+func (f DocumentTransformerFunc) Transform(doc *zoekt.Document) error {
+	return f(doc)
+}
+
+// transform runs the transformers of the options on doc, in order,
+// until one of them skips it.
+func (o *Options) transform(doc *zoekt.Document) {
+	for _, t := range o.Transformers {
+		if err := t.Transform(doc); err != nil {
+			doc.SkipReason = fmt.Sprintf("transform: %v", err)
+		}
+		if doc.SkipReason != "" {
+			return
+		}
+	}
+}
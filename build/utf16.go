@@ -0,0 +1,107 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// utf16Sample is the number of bytes inspected to detect UTF-16
+// without a byte order mark.
+const utf16Sample = 4096
+
+var (
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// decodeUTF16 returns content converted to UTF-8 if it looks like
+// UTF-16 or UCS-2, as often written by Windows tools. Files are
+// recognized by their byte order mark, or by text that is mostly
+// ASCII with a NUL byte in every other position.
+func decodeUTF16(content []byte) ([]byte, bool) {
+	if len(content) < 2 || len(content)%2 != 0 {
+		return nil, false
+	}
+
+	var bigEndian bool
+	switch {
+	case bytes.HasPrefix(content, bomUTF16LE):
+		content = content[2:]
+	case bytes.HasPrefix(content, bomUTF16BE):
+		content = content[2:]
+		bigEndian = true
+	default:
+		var ok bool
+		if bigEndian, ok = guessUTF16(content); !ok {
+			return nil, false
+		}
+	}
+
+	units := make([]uint16, len(content)/2)
+	for i := range units {
+		lo, hi := content[2*i], content[2*i+1]
+		if bigEndian {
+			lo, hi = hi, lo
+		}
+		units[i] = uint16(hi)<<8 | uint16(lo)
+	}
+
+	runes := utf16.Decode(units)
+	out := make([]byte, 0, len(runes))
+	var buf [utf8.UTFMax]byte
+	for _, r := range runes {
+		if r == utf8.RuneError || r == 0 {
+			// Unpaired surrogates or NULs: not text after all.
+			return nil, false
+		}
+		n := utf8.EncodeRune(buf[:], r)
+		out = append(out, buf[:n]...)
+	}
+	return out, true
+}
+
+// guessUTF16 reports whether content without a byte order mark is
+// UTF-16, and its byte order. This only recognizes text with mostly
+// ASCII characters, whose high bytes are NUL.
+func guessUTF16(content []byte) (bigEndian, ok bool) {
+	if len(content) > utf16Sample {
+		content = content[:utf16Sample]
+	}
+	var even, odd int
+	for i, c := range content {
+		if c != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+
+	// Require NULs in at least half the characters, all on the
+	// same side.
+	pairs := len(content) / 2
+	switch {
+	case even == 0 && odd*2 >= pairs:
+		return false, true
+	case odd == 0 && even*2 >= pairs:
+		return true, true
+	}
+	return false, false
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/zoekt"
+)
+
+// versionTag identifies a version of the repository in the names of
+// kept shards.
+func versionTag(branches []zoekt.RepositoryBranch) string {
+	var parts []string
+	for _, b := range branches {
+		parts = append(parts, b.Name+"="+b.Version)
+	}
+	return hashString(strings.Join(parts, "\x00"))[:12]
+}
+
+// keptShardName returns the name of shard n of the kept version with
+// the given tag.
+func (o *Options) keptShardName(tag string, n int) string {
+	return filepath.Join(o.shardDir(),
+		fmt.Sprintf("%s@%s_v%d.%05d.zoekt", o.shardPrefix(), tag, zoekt.IndexFormatVersion, n))
+}
+
+// keepIndexedVersion renames the shards of the version currently in
+// the index, so the build does not overwrite them, and deletes kept
+// versions beyond Options.KeepVersions. Reindexing the same version
+// replaces its shards as usual.
+func (b *Builder) keepIndexedVersion() error {
+	versions := b.opts.IndexVersions()
+	if versions == nil || reflect.DeepEqual(versions, b.opts.RepositoryDescription.Branches) {
+		return nil
+	}
+
+	tag := versionTag(versions)
+	for n := 0; ; n++ {
+		fn, err := b.opts.shardName(n)
+		if err != nil {
+			return err
+		}
+		kept := b.opts.keptShardName(tag, n)
+		if err := os.Rename(fn, kept); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := os.Rename(zoekt.ShardMetaName(fn), zoekt.ShardMetaName(kept)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return b.opts.pruneKeptVersions()
+}
+
+// pruneKeptVersions deletes the shards of all but the most recently
+// indexed Options.KeepVersions kept versions.
+func (o *Options) pruneKeptVersions() error {
+	prefix := filepath.Join(o.shardDir(), o.shardPrefix()+"@")
+	fs, err := filepath.Glob(fmt.Sprintf("%s*_v%d.*.zoekt", prefix, zoekt.IndexFormatVersion))
+	if err != nil {
+		return err
+	}
+
+	// tag => files, and tag => modification time of its first shard.
+	files := map[string][]string{}
+	mtimes := map[string]int64{}
+	for _, fn := range fs {
+		i := strings.LastIndex(fn, "_v")
+		if i < len(prefix) {
+			continue
+		}
+		tag := fn[len(prefix):i]
+		files[tag] = append(files[tag], fn)
+		if fi, err := os.Stat(fn); err == nil && fi.ModTime().UnixNano() > mtimes[tag] {
+			mtimes[tag] = fi.ModTime().UnixNano()
+		}
+	}
+
+	var tags []string
+	for t := range files {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return mtimes[tags[i]] > mtimes[tags[j]]
+	})
+	if len(tags) <= o.KeepVersions {
+		return nil
+	}
+	for _, t := range tags[o.KeepVersions:] {
+		for _, fn := range files[t] {
+			log.Printf("deleting old version %s", fn)
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			os.Remove(zoekt.ShardMetaName(fn))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client provides clients for Go programs that talk to a
+// remote zoekt-webserver. Client is a zoekt.Searcher wrapping the RPC
+// protocol; JSONClient wraps the JSON API, including streaming
+// search. Both retry transient failures and report errors as *Error
+// values.
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/rpc"
+	keegancsmithrpc "github.com/keegancsmith/rpc"
+)
+
+// Options configures a Client. The zero value is usable.
+type Options struct {
+	// Path is the RPC endpoint on the server. Defaults to
+	// rpc.DefaultRPCPath.
+	Path string
+
+	// MaxRetries is the number of times a call that failed with a
+	// transient error is retried. Defaults to 2; use a negative
+	// value to disable retries.
+	MaxRetries int
+
+	// Backoff is the wait before the first retry. It doubles on
+	// every subsequent retry. Defaults to 100ms.
+	Backoff time.Duration
+
+	// Timeout bounds each call whose context has no deadline. Zero
+	// means no timeout.
+	Timeout time.Duration
+
+	// HTTPClient is used by JSONClient. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func (o *Options) setDefaults() {
+	if o.Path == "" {
+		o.Path = rpc.DefaultRPCPath
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 2
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.Backoff == 0 {
+		o.Backoff = 100 * time.Millisecond
+	}
+	if o.HTTPClient == nil {
+		o.HTTPClient = http.DefaultClient
+	}
+}
+
+// Error is returned by all Client methods.
+type Error struct {
+	// Op is the method that failed, eg. "Search".
+	Op string
+
+	// Addr is the server address, or the base URL for a
+	// JSONClient.
+	Addr string
+
+	// Remote is set if the server executed the call and returned
+	// an error. Remote errors are only retried if their code is
+	// temporary, eg. zoekt.CodeOverloaded.
+	Remote bool
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("zoekt %s %s: remote: %v", e.Op, e.Addr, e.Err)
+	}
+	return fmt.Sprintf("zoekt %s %s: %v", e.Op, e.Addr, e.Err)
+}
+
+// Temporary returns true if the call may succeed when retried.
+func (e *Error) Temporary() bool {
+	if e.Remote {
+		return e.ErrorCode().Temporary()
+	}
+	return e.Err != context.Canceled && e.Err != context.DeadlineExceeded
+}
+
+// ErrorCode returns the code of the underlying error.
+func (e *Error) ErrorCode() zoekt.ErrorCode {
+	return zoekt.ErrorCodeOf(e.Err)
+}
+
+// Client is a zoekt.Searcher backed by a remote server. It is safe
+// for concurrent use.
+type Client struct {
+	caller
+	searcher zoekt.Searcher
+}
+
+var _ zoekt.Searcher = (*Client)(nil)
+
+// New returns a Client for the zoekt-webserver at address
+// (host:port). The connection is established lazily. opts may be
+// nil.
+func New(address string, opts *Options) *Client {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.setDefaults()
+	return &Client{
+		caller:   caller{addr: address, opts: o},
+		searcher: rpc.ClientAtPath(address, o.Path),
+	}
+}
+
+// Search runs q on the server.
+func (c *Client) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	if opts == nil {
+		opts = &zoekt.SearchOptions{}
+	}
+	var res *zoekt.SearchResult
+	err := c.do(ctx, "Search", func(ctx context.Context) (err error) {
+		res, err = c.searcher.Search(ctx, q, opts)
+		return err
+	})
+	return res, err
+}
+
+// List lists the repositories matching q on the server.
+func (c *Client) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	var res *zoekt.RepoList
+	err := c.do(ctx, "List", func(ctx context.Context) (err error) {
+		res, err = c.searcher.List(ctx, q)
+		return err
+	})
+	return res, err
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() {
+	c.searcher.Close()
+}
+
+func (c *Client) String() string {
+	return fmt.Sprintf("client(%s)", c.addr)
+}
+
+// caller retries calls to a server.
+type caller struct {
+	addr string
+	opts Options
+}
+
+// do runs call, retrying it with exponential backoff while it fails
+// with a transient error.
+func (c *caller) do(ctx context.Context, op string, call func(context.Context) error) error {
+	if _, ok := ctx.Deadline(); !ok && c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	backoff := c.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := call(ctx)
+		if err == nil {
+			return nil
+		}
+		zerr := c.wrap(op, err)
+		if !zerr.Temporary() || attempt >= c.opts.MaxRetries {
+			return zerr
+		}
+
+		select {
+		case <-ctx.Done():
+			return c.wrap(op, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *caller) wrap(op string, err error) *Error {
+	remote := false
+	switch err.(type) {
+	case keegancsmithrpc.ServerError, *zoekt.Error:
+		remote = true
+	}
+	return &Error{Op: op, Addr: c.addr, Remote: remote, Err: err}
+}
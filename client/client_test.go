@@ -0,0 +1,108 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/rpc"
+)
+
+type failingSearcher struct {
+	calls int32
+}
+
+func (s *failingSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, errors.New("boom")
+}
+
+func (s *failingSearcher) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return &zoekt.RepoList{Crashes: 1}, nil
+}
+
+func (*failingSearcher) Close() {}
+
+func (*failingSearcher) String() string { return "failingSearcher" }
+
+func TestRemoteErrorNotRetried(t *testing.T) {
+	s := &failingSearcher{}
+	ts := httptest.NewServer(rpc.Server(s))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(u.Host, &Options{Backoff: time.Millisecond})
+	defer c.Close()
+
+	_, err = c.Search(context.Background(), &query.Const{Value: true}, nil)
+	zerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %T (%v), want *Error", err, err)
+	}
+	if !zerr.Remote || zerr.Temporary() || zerr.Op != "Search" {
+		t.Errorf("got %+v, want non-temporary remote Search error", zerr)
+	}
+	if n := atomic.LoadInt32(&s.calls); n != 1 {
+		t.Errorf("got %d calls, want 1", n)
+	}
+
+	l, err := c.List(context.Background(), &query.Repo{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if l.Crashes != 1 {
+		t.Errorf("got %+v, want 1 crash", l)
+	}
+}
+
+func TestDialErrorRetried(t *testing.T) {
+	// Grab a free port, and close it so dialing fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := New(addr, &Options{MaxRetries: 2, Backoff: 10 * time.Millisecond})
+	defer c.Close()
+
+	start := time.Now()
+	_, err = c.List(context.Background(), &query.Repo{})
+	zerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %T (%v), want *Error", err, err)
+	}
+	if zerr.Remote || !zerr.Temporary() {
+		t.Errorf("got %+v, want temporary local error", zerr)
+	}
+	// Two retries, waiting 10ms and 20ms.
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("failed after %v, want retries with backoff", d)
+	}
+}
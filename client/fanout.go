@@ -0,0 +1,454 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// FanoutOptions configures a Fanout. The zero value is usable.
+type FanoutOptions struct {
+	// Client configures the client of each replica.
+	Client Options
+
+	// HedgeDelay is how long to wait for a replica before sending
+	// the same call to another replica of its partition, using
+	// whichever answers first. Zero disables hedging.
+	HedgeDelay time.Duration
+
+	// UnhealthyAfter is the number of consecutive failures after
+	// which a replica is considered unhealthy. Defaults to 3.
+	UnhealthyAfter int
+
+	// HealthCheckInterval is how often replicas are probed. A
+	// successful probe makes a replica healthy again. Defaults to
+	// 10s; use a negative value to disable probes.
+	HealthCheckInterval time.Duration
+}
+
+func (o *FanoutOptions) setDefaults() {
+	if o.UnhealthyAfter <= 0 {
+		o.UnhealthyAfter = 3
+	}
+	if o.HealthCheckInterval == 0 {
+		o.HealthCheckInterval = 10 * time.Second
+	}
+}
+
+// replica is a server holding the shards of a partition.
+type replica struct {
+	addr     string
+	searcher zoekt.Searcher
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (r *replica) healthy(unhealthyAfter int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures < unhealthyAfter
+}
+
+// callError returns whether err is an error of the call itself, such
+// as a bad query, which says nothing about the health of the replica
+// and would fail on any replica.
+func callError(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Remote && !e.Temporary()
+}
+
+// record notes the outcome of a call.
+func (r *replica) record(err error) {
+	if callError(err) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.failures = 0
+	} else {
+		r.failures++
+	}
+}
+
+// partition is a part of the index, served by one or more replicas
+// holding the same shards.
+type partition struct {
+	replicas []*replica
+
+	// next rotates the replica tried first, to spread the load.
+	next uint32
+}
+
+// order returns the replicas in the order to try them: healthy ones
+// first, starting at a different replica for every call.
+func (p *partition) order(unhealthyAfter int) []*replica {
+	start := int(atomic.AddUint32(&p.next, 1))
+	var healthy, unhealthy []*replica
+	for i := range p.replicas {
+		r := p.replicas[(start+i)%len(p.replicas)]
+		if r.healthy(unhealthyAfter) {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		// Better to try than to give up on the partition.
+		return unhealthy
+	}
+	return healthy
+}
+
+// Fanout is a zoekt.Searcher that searches an index split over
+// several zoekt-webservers and merges their results. Each partition
+// of the index may be served by several replicas: calls go to a
+// healthy replica, and are hedged to another one if it is slow.
+//
+// Partitions may also overlap, as when zoekt-sourcegraph-indexserver
+// places every repository on several nodes with
+// -replication_factor. The matches of a repository are then taken
+// from only one of the partitions that found it. It is safe for
+// concurrent use.
+type Fanout struct {
+	opts       FanoutOptions
+	partitions []*partition
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ zoekt.Searcher = (*Fanout)(nil)
+
+// NewFanout returns a Fanout over partitions, each a list of the
+// addresses (host:port) of the replicas serving it. opts may be nil.
+func NewFanout(partitions [][]string, opts *FanoutOptions) *Fanout {
+	var o FanoutOptions
+	if opts != nil {
+		o = *opts
+	}
+	var ps [][]*replica
+	for _, addrs := range partitions {
+		var rs []*replica
+		for _, addr := range addrs {
+			rs = append(rs, &replica{addr: addr, searcher: New(addr, &o.Client)})
+		}
+		ps = append(ps, rs)
+	}
+	return newFanout(ps, o)
+}
+
+func newFanout(partitions [][]*replica, opts FanoutOptions) *Fanout {
+	opts.setDefaults()
+	f := &Fanout{
+		opts: opts,
+		done: make(chan struct{}),
+	}
+	for _, rs := range partitions {
+		f.partitions = append(f.partitions, &partition{replicas: rs})
+	}
+	if opts.HealthCheckInterval > 0 {
+		f.wg.Add(1)
+		go f.checkHealth()
+	}
+	return f
+}
+
+// checkHealth probes all replicas periodically, until Close.
+func (f *Fanout) checkHealth() {
+	defer f.wg.Done()
+	t := time.NewTicker(f.opts.HealthCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-t.C:
+		}
+		var wg sync.WaitGroup
+		for _, p := range f.partitions {
+			for _, r := range p.replicas {
+				wg.Add(1)
+				go func(r *replica) {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), f.opts.HealthCheckInterval)
+					defer cancel()
+					_, err := r.searcher.List(ctx, &query.Const{Value: false})
+					r.record(err)
+				}(r)
+			}
+		}
+		wg.Wait()
+	}
+}
+
+// call runs fn on a replica of p, and returns the first successful
+// result. If the replica fails with a transient error, or has not
+// answered after HedgeDelay, fn is also run on the next replica.
+func (f *Fanout) call(ctx context.Context, p *partition, fn func(context.Context, zoekt.Searcher) (interface{}, error)) (interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		v   interface{}
+		err error
+		r   *replica
+	}
+	replicas := p.order(f.opts.UnhealthyAfter)
+	results := make(chan result, len(replicas))
+	next := 0
+	var hedge <-chan time.Time
+	start := func() {
+		r := replicas[next]
+		next++
+		go func() {
+			v, err := fn(ctx, r.searcher)
+			results <- result{v, err, r}
+		}()
+		if f.opts.HedgeDelay > 0 && next < len(replicas) {
+			hedge = time.After(f.opts.HedgeDelay)
+		} else {
+			hedge = nil
+		}
+	}
+
+	start()
+	running := 1
+	var firstErr error
+	for running > 0 {
+		select {
+		case res := <-results:
+			running--
+			if res.err == nil || ctx.Err() == nil {
+				// Calls fail when the caller gives up, whatever
+				// the health of the replica.
+				res.r.record(res.err)
+			}
+			if res.err == nil {
+				return res.v, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if callError(res.err) {
+				return nil, res.err
+			}
+			if next < len(replicas) && ctx.Err() == nil {
+				start()
+				running++
+			}
+		case <-hedge:
+			start()
+			running++
+		}
+	}
+	return nil, firstErr
+}
+
+// each runs fn on every partition in parallel. It returns the
+// results of the partitions that succeeded, in partition order, the
+// number that failed, and the error of the first failed partition.
+func (f *Fanout) each(ctx context.Context, fn func(context.Context, zoekt.Searcher) (interface{}, error)) ([]interface{}, int, error) {
+	type result struct {
+		v   interface{}
+		err error
+	}
+	results := make([]result, len(f.partitions))
+	var wg sync.WaitGroup
+	for i, p := range f.partitions {
+		wg.Add(1)
+		go func(i int, p *partition) {
+			defer wg.Done()
+			v, err := f.call(ctx, p, fn)
+			results[i] = result{v, err}
+		}(i, p)
+	}
+	wg.Wait()
+
+	var vs []interface{}
+	var firstErr error
+	failed := 0
+	for _, res := range results {
+		if res.err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		vs = append(vs, res.v)
+	}
+	return vs, failed, firstErr
+}
+
+// Search runs q on every partition and merges the results. If some
+// partitions fail, the results of the others are returned, and the
+// failures are counted in Stats.Crashes.
+func (f *Fanout) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	if opts == nil {
+		opts = &zoekt.SearchOptions{}
+	}
+	// Ask for one more file than is shown, so the merged page
+	// knows whether a next page exists.
+	pOpts := *opts
+	if pOpts.MaxDocDisplayCount > 0 {
+		pOpts.MaxDocDisplayCount++
+	}
+	vs, failed, err := f.each(ctx, func(ctx context.Context, s zoekt.Searcher) (interface{}, error) {
+		return s.Search(ctx, q, &pOpts)
+	})
+	if len(vs) == 0 && err != nil {
+		return nil, err
+	}
+
+	aggregate := &zoekt.SearchResult{
+		RepoURLs:      map[string]string{},
+		LineFragments: map[string]string{},
+	}
+	aggregate.Stats.Crashes += failed
+
+	// owner maps each repository to the first result that has it,
+	// ie. the lowest partition that has it, so replicas of a
+	// repository on several partitions resolve the same way on every
+	// search.
+	owner := map[string]int{}
+	for i, v := range vs {
+		sr := v.(*zoekt.SearchResult)
+		for _, fm := range sr.Files {
+			if _, ok := owner[fm.Repository]; !ok {
+				owner[fm.Repository] = i
+			}
+		}
+		for k := range sr.RepoStats {
+			if _, ok := owner[k]; !ok {
+				owner[k] = i
+			}
+		}
+	}
+
+	for i, v := range vs {
+		sr := v.(*zoekt.SearchResult)
+		stats := sr.Stats
+		for _, fm := range sr.Files {
+			if owner[fm.Repository] != i {
+				// A replica of a repository already found
+				// elsewhere; don't count its matches twice.
+				if sr.RepoStats[fm.Repository] == nil {
+					stats.FileCount--
+					stats.MatchCount -= len(fm.LineMatches)
+				}
+				continue
+			}
+			aggregate.Files = append(aggregate.Files, fm)
+		}
+		for k, v := range sr.RepoStats {
+			if owner[k] != i {
+				stats.FileCount -= v.FileCount
+				stats.MatchCount -= v.MatchCount
+			}
+		}
+		aggregate.Stats.Add(stats)
+		for k, v := range sr.RepoURLs {
+			aggregate.RepoURLs[k] = v
+		}
+		for k, v := range sr.LineFragments {
+			aggregate.LineFragments[k] = v
+		}
+		for k, v := range sr.RepoStats {
+			if owner[k] != i {
+				continue
+			}
+			if aggregate.RepoStats == nil {
+				aggregate.RepoStats = map[string]*zoekt.RepoMatchStats{}
+			}
+			st := aggregate.RepoStats[k]
+			if st == nil {
+				st = &zoekt.RepoMatchStats{}
+				aggregate.RepoStats[k] = st
+			}
+			st.Add(v)
+		}
+	}
+
+	zoekt.SortFiles(aggregate.Files, opts.SortBy)
+	if opts.DedupBranches {
+		aggregate.Files = zoekt.DedupBranches(aggregate.Files)
+	}
+	// The partitions already skipped the files up to the cursor.
+	aggregate.Files, aggregate.NextCursor, err = zoekt.Page(aggregate.Files, opts.SortBy, "", opts.MaxDocDisplayCount)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate, nil
+}
+
+// List lists the repositories of every partition. A repository on
+// several partitions is listed once, as found on the lowest of them.
+func (f *Fanout) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	vs, failed, err := f.each(ctx, func(ctx context.Context, s zoekt.Searcher) (interface{}, error) {
+		return s.List(ctx, q)
+	})
+	if len(vs) == 0 && err != nil {
+		return nil, err
+	}
+
+	res := &zoekt.RepoList{Crashes: failed}
+	uniq := map[string]bool{}
+	for _, v := range vs {
+		rl := v.(*zoekt.RepoList)
+		res.Crashes += rl.Crashes
+		for _, r := range rl.Repos {
+			if uniq[r.Repository.Name] {
+				continue
+			}
+			uniq[r.Repository.Name] = true
+			res.Repos = append(res.Repos, r)
+		}
+	}
+	return res, nil
+}
+
+// Close stops the health checks and closes the connections to all
+// replicas.
+func (f *Fanout) Close() {
+	close(f.done)
+	f.wg.Wait()
+	for _, p := range f.partitions {
+		for _, r := range p.replicas {
+			r.searcher.Close()
+		}
+	}
+}
+
+func (f *Fanout) String() string {
+	var ps []string
+	for _, p := range f.partitions {
+		var addrs []string
+		for _, r := range p.replicas {
+			addrs = append(addrs, r.addr)
+		}
+		ps = append(ps, strings.Join(addrs, "|"))
+	}
+	return fmt.Sprintf("fanout(%s)", strings.Join(ps, ","))
+}
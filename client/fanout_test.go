@@ -0,0 +1,282 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// fakeReplica returns the files named in files, after delay, or
+// fails if down is set. A file "r/f" is in repository r; any other
+// file is a repository of its own.
+type fakeReplica struct {
+	files []string
+	delay time.Duration
+	down  int32
+	calls int32
+}
+
+func (s *fakeReplica) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if atomic.LoadInt32(&s.down) != 0 {
+		return nil, errors.New("connection refused")
+	}
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	res := &zoekt.SearchResult{}
+	for _, f := range s.files {
+		res.Files = append(res.Files, zoekt.FileMatch{Repository: fakeRepo(f), FileName: f, Score: 1})
+	}
+	res.Stats.FileCount = len(res.Files)
+	files, next, err := zoekt.Page(res.Files, opts.SortBy, opts.Cursor, opts.MaxDocDisplayCount)
+	res.Files, res.NextCursor = files, next
+	return res, err
+}
+
+func (s *fakeReplica) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	if atomic.LoadInt32(&s.down) != 0 {
+		return nil, errors.New("connection refused")
+	}
+	res := &zoekt.RepoList{}
+	seen := map[string]bool{}
+	for _, f := range s.files {
+		if r := fakeRepo(f); !seen[r] {
+			seen[r] = true
+			res.Repos = append(res.Repos, &zoekt.RepoListEntry{Repository: zoekt.Repository{Name: r}})
+		}
+	}
+	return res, nil
+}
+
+func fakeRepo(f string) string {
+	if i := strings.Index(f, "/"); i >= 0 {
+		return f[:i]
+	}
+	return f
+}
+
+func (*fakeReplica) Close() {}
+
+func (*fakeReplica) String() string { return "fakeReplica" }
+
+func fanoutForTest(opts FanoutOptions, partitions ...[]*fakeReplica) *Fanout {
+	var ps [][]*replica
+	for _, p := range partitions {
+		var rs []*replica
+		for i, s := range p {
+			rs = append(rs, &replica{addr: string(rune('a' + i)), searcher: s})
+		}
+		ps = append(ps, rs)
+	}
+	return newFanout(ps, opts)
+}
+
+func fileNames(res *zoekt.SearchResult) []string {
+	var names []string
+	for _, f := range res.Files {
+		names = append(names, f.FileName)
+	}
+	return names
+}
+
+func TestFanoutMerge(t *testing.T) {
+	f := fanoutForTest(FanoutOptions{HealthCheckInterval: -1},
+		[]*fakeReplica{{files: []string{"a", "c", "e"}}},
+		[]*fakeReplica{{files: []string{"b", "d"}}},
+	)
+	defer f.Close()
+
+	var got []string
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		res, err := f.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{
+			MaxDocDisplayCount: 2,
+			Cursor:             cursor,
+		})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		got = append(got, fileNames(res)...)
+		if cursor = res.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got pages %v, want %v", got, want)
+	}
+}
+
+func TestFanoutUnhealthy(t *testing.T) {
+	bad := &fakeReplica{files: []string{"a"}, down: 1}
+	good := &fakeReplica{files: []string{"a"}}
+	f := fanoutForTest(FanoutOptions{HealthCheckInterval: -1, UnhealthyAfter: 1},
+		[]*fakeReplica{bad, good})
+	defer f.Close()
+
+	for i := 0; i < 4; i++ {
+		res, err := f.Search(context.Background(), &query.Const{Value: true}, nil)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) != 1 {
+			t.Fatalf("got %d files, want 1", len(res.Files))
+		}
+	}
+	// The failed replica is tried once, and then skipped.
+	if n := atomic.LoadInt32(&bad.calls); n != 1 {
+		t.Errorf("got %d calls to the failed replica, want 1", n)
+	}
+
+	// Without healthy replicas, the partition is counted as
+	// crashed.
+	atomic.StoreInt32(&good.down, 1)
+	other := &fakeReplica{files: []string{"b"}}
+	f2 := fanoutForTest(FanoutOptions{HealthCheckInterval: -1},
+		[]*fakeReplica{good}, []*fakeReplica{other})
+	defer f2.Close()
+	res, err := f2.Search(context.Background(), &query.Const{Value: true}, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if got := fileNames(res); res.Stats.Crashes != 1 || !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got files %v, %d crashes, want [b] and 1 crash", got, res.Stats.Crashes)
+	}
+}
+
+func TestFanoutHealthCheck(t *testing.T) {
+	s := &fakeReplica{files: []string{"a"}, down: 1}
+	f := fanoutForTest(FanoutOptions{HealthCheckInterval: time.Millisecond, UnhealthyAfter: 1},
+		[]*fakeReplica{s})
+	defer f.Close()
+
+	r := f.partitions[0].replicas[0]
+	for deadline := time.Now().Add(10 * time.Second); r.healthy(1); {
+		if time.Now().After(deadline) {
+			t.Fatal("replica still healthy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&s.down, 0)
+	for deadline := time.Now().Add(10 * time.Second); !r.healthy(1); {
+		if time.Now().After(deadline) {
+			t.Fatal("replica still unhealthy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFanoutHedge(t *testing.T) {
+	slow := &fakeReplica{files: []string{"a"}, delay: time.Minute}
+	fast := &fakeReplica{files: []string{"a"}}
+	f := fanoutForTest(FanoutOptions{HealthCheckInterval: -1, HedgeDelay: time.Millisecond},
+		[]*fakeReplica{slow, fast})
+	defer f.Close()
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		res, err := f.Search(context.Background(), &query.Const{Value: true}, nil)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) != 1 {
+			t.Fatalf("got %d files, want 1", len(res.Files))
+		}
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("search took %v, want the fast replica to answer", d)
+		}
+	}
+	// The slow replica was canceled, not marked as failed.
+	if !f.partitions[0].replicas[0].healthy(1) {
+		t.Errorf("slow replica marked unhealthy")
+	}
+}
+
+func TestFanoutReplicated(t *testing.T) {
+	// Every repository is on two of the three nodes.
+	nodes := []*fakeReplica{
+		{files: []string{"r1/a", "r1/b", "r3/e"}},
+		{files: []string{"r1/a", "r1/b", "r2/c", "r2/d"}},
+		{files: []string{"r2/c", "r2/d", "r3/e"}},
+	}
+	f := fanoutForTest(FanoutOptions{HealthCheckInterval: -1},
+		[]*fakeReplica{nodes[0]}, []*fakeReplica{nodes[1]}, []*fakeReplica{nodes[2]})
+	defer f.Close()
+
+	want := []string{"r1/a", "r1/b", "r2/c", "r2/d", "r3/e"}
+	for down := -1; down < len(nodes); down++ {
+		for i, n := range nodes {
+			var v int32
+			if i == down {
+				v = 1
+			}
+			atomic.StoreInt32(&n.down, v)
+		}
+
+		res, err := f.Search(context.Background(), &query.Const{Value: true}, nil)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if got := fileNames(res); !reflect.DeepEqual(got, want) {
+			t.Errorf("node %d down: got %v, want %v", down, got, want)
+		}
+		if res.Stats.FileCount != len(want) {
+			t.Errorf("node %d down: got FileCount %d, want %d", down, res.Stats.FileCount, len(want))
+		}
+
+		rl, err := f.List(context.Background(), &query.Const{Value: true})
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		var repos []string
+		for _, r := range rl.Repos {
+			repos = append(repos, r.Repository.Name)
+		}
+		sort.Strings(repos)
+		if want := []string{"r1", "r2", "r3"}; !reflect.DeepEqual(repos, want) {
+			t.Errorf("node %d down: got repos %v, want %v", down, repos, want)
+		}
+	}
+}
+
+func TestFanoutOwnerIsLowestPartition(t *testing.T) {
+	// Both partitions have repository r, in different versions. The
+	// first partition answers last, but still wins.
+	f := fanoutForTest(FanoutOptions{HealthCheckInterval: -1},
+		[]*fakeReplica{{files: []string{"r/new"}, delay: 50 * time.Millisecond}},
+		[]*fakeReplica{{files: []string{"r/old"}}},
+	)
+	defer f.Close()
+
+	res, err := f.Search(context.Background(), &query.Const{Value: true}, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if got, want := fileNames(res), []string{"r/new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/web"
+)
+
+// JSONClient talks to the JSON API of a zoekt-webserver started with
+// -html, for programs that cannot use the RPC protocol, eg. because
+// only plain HTTP requests reach the server. It is safe for
+// concurrent use.
+type JSONClient struct {
+	caller
+	base string
+}
+
+// NewJSON returns a JSONClient for the zoekt-webserver at baseURL, eg.
+// "http://localhost:6070". opts may be nil.
+func NewJSON(baseURL string, opts *Options) *JSONClient {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.setDefaults()
+	return &JSONClient{
+		caller: caller{addr: baseURL, opts: o},
+		base:   strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// SearchParams are the optional parameters of JSONClient.Search.
+type SearchParams struct {
+	// Num is the number of files per page.
+	Num int
+
+	// Sort is the order of the files: "score" (the default),
+	// "path", "repo" or "modtime".
+	Sort string
+
+	// Cursor selects the page following the one that returned it
+	// as NextCursor.
+	Cursor string
+}
+
+// Search runs the query q, in the query language of the webserver,
+// and returns a page of results. p may be nil.
+func (c *JSONClient) Search(ctx context.Context, q string, p *SearchParams) (*web.SearchResponse, error) {
+	vals := url.Values{"q": {q}}
+	if p != nil {
+		if p.Num > 0 {
+			vals.Set("num", strconv.Itoa(p.Num))
+		}
+		if p.Sort != "" {
+			vals.Set("sort", p.Sort)
+		}
+		if p.Cursor != "" {
+			vals.Set("cursor", p.Cursor)
+		}
+	}
+	var res web.SearchResponse
+	if err := c.getJSON(ctx, "Search", "/api/search", vals, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListRepos lists the repositories matching q, eg. "r:foo", or all
+// repositories if q is empty.
+func (c *JSONClient) ListRepos(ctx context.Context, q string) (*web.RepoListResponse, error) {
+	vals := url.Values{}
+	if q != "" {
+		vals.Set("q", q)
+	}
+	var res web.RepoListResponse
+	if err := c.getJSON(ctx, "ListRepos", "/api/repos", vals, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Stream runs the query q and calls fn with the files as the server
+// finds them, typically once per shard, for up to num files. It
+// returns the statistics of the whole search. If fn returns an
+// error, the search is abandoned and Stream returns that error.
+//
+// Only connecting to the server is retried, as results may already
+// have been passed to fn when a later failure occurs. Options.Timeout
+// bounds the whole stream.
+func (c *JSONClient) Stream(ctx context.Context, q string, num int, fn func(*web.StreamMatches) error) (*zoekt.Stats, error) {
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); !ok && c.opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	vals := url.Values{"q": {q}}
+	if num > 0 {
+		vals.Set("num", strconv.Itoa(num))
+	}
+	var body io.ReadCloser
+	err := c.do(ctx, "Stream", func(ctx context.Context) (err error) {
+		body, err = c.get(ctx, "/api/stream", vals)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var stats *zoekt.Stats
+	var fnErr error
+	err = readEvents(body, func(name string, data []byte) error {
+		switch name {
+		case "matches":
+			var m web.StreamMatches
+			if err := json.Unmarshal(data, &m); err != nil {
+				return c.wrap("Stream", err)
+			}
+			fnErr = fn(&m)
+			return fnErr
+		case "done":
+			var d web.StreamDone
+			if err := json.Unmarshal(data, &d); err != nil {
+				return c.wrap("Stream", err)
+			}
+			stats = &d.Stats
+			return io.EOF
+		case "error":
+			var se web.StreamError
+			if err := json.Unmarshal(data, &se); err != nil {
+				return c.wrap("Stream", err)
+			}
+			return c.wrap("Stream", remoteError(se.Error, 0))
+		}
+		return nil
+	})
+	switch err.(type) {
+	case nil:
+		return nil, c.wrap("Stream", io.ErrUnexpectedEOF)
+	case *Error:
+		return nil, err
+	}
+	if err == io.EOF {
+		return stats, nil
+	} else if fnErr != nil {
+		return nil, fnErr
+	}
+	return nil, c.wrap("Stream", err)
+}
+
+// readEvents calls fn for every server-sent event read from r, until
+// fn returns an error or r is exhausted.
+func readEvents(r io.Reader, fn func(name string, data []byte) error) error {
+	sc := bufio.NewScanner(r)
+	// A matches event holds a whole shard's worth of files.
+	sc.Buffer(nil, 64<<20)
+
+	var name string
+	var data bytes.Buffer
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if name != "" || data.Len() > 0 {
+				if err := fn(name, data.Bytes()); err != nil {
+					return err
+				}
+			}
+			name = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return sc.Err()
+}
+
+func (c *JSONClient) getJSON(ctx context.Context, op, path string, vals url.Values, res interface{}) error {
+	return c.do(ctx, op, func(ctx context.Context) error {
+		body, err := c.get(ctx, path, vals)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return json.NewDecoder(body).Decode(res)
+	})
+}
+
+// get requests path and returns the body of a successful response.
+// Failed responses are returned as remote errors.
+func (c *JSONClient) get(ctx context.Context, path string, vals url.Values) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.base+path+"?"+vals.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.opts.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, remoteError(strings.TrimSpace(string(msg)), resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// remoteError returns the error the server reported with msg. The
+// webserver prefixes messages with their error code, see
+// zoekt.ErrorFromString; without one, a status that asks to come
+// back later is treated as zoekt.CodeOverloaded.
+func remoteError(msg string, status int) *zoekt.Error {
+	if err := zoekt.ErrorFromString(msg); err != nil {
+		return err
+	}
+	code := zoekt.CodeUnknown
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		code = zoekt.CodeOverloaded
+	}
+	if status != 0 {
+		msg = fmt.Sprintf("%d %s: %s", status, http.StatusText(status), msg)
+	}
+	return &zoekt.Error{Code: code, Message: msg}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/web"
+	"github.com/google/zoekt/zoekttest"
+)
+
+func jsonServerForTest(t *testing.T) *httptest.Server {
+	s := zoekttest.NewSearcher(t, &zoekt.Repository{Name: "repo"},
+		zoekt.Document{Name: "f1", Content: []byte("to carry water")},
+		zoekt.Document{Name: "f2", Content: []byte("water under the bridge")},
+		zoekt.Document{Name: "f3", Content: []byte("fire")},
+	)
+	mux, err := web.NewMux(&web.Server{
+		Searcher: s,
+		Top:      web.Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestJSONSearch(t *testing.T) {
+	ts := jsonServerForTest(t)
+	defer ts.Close()
+	c := NewJSON(ts.URL+"/", nil)
+
+	var got []string
+	p := &SearchParams{Num: 1, Sort: "path"}
+	for i := 0; i < 3; i++ {
+		res, err := c.Search(context.Background(), "water", p)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		for _, fm := range res.FileMatches {
+			got = append(got, fm.FileName)
+		}
+		if p.Cursor = res.NextCursor; p.Cursor == "" {
+			break
+		}
+	}
+	if len(got) != 2 || got[0] != "f1" || got[1] != "f2" {
+		t.Errorf("got pages %v, want [f1 f2]", got)
+	}
+
+	repos, err := c.ListRepos(context.Background(), "")
+	if err != nil {
+		t.Fatalf("ListRepos: %v", err)
+	}
+	if len(repos.Repos) != 1 || repos.Repos[0].Name != "repo" {
+		t.Errorf("got repos %+v", repos.Repos)
+	}
+
+	_, err = c.Search(context.Background(), "(", nil)
+	zerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %T (%v), want *Error", err, err)
+	}
+	if !zerr.Remote || zerr.Temporary() || zerr.ErrorCode() != zoekt.CodeQueryParse {
+		t.Errorf("got %+v, want remote query parse error", zerr)
+	}
+}
+
+func TestJSONStream(t *testing.T) {
+	ts := jsonServerForTest(t)
+	defer ts.Close()
+	c := NewJSON(ts.URL, nil)
+
+	var got []string
+	stats, err := c.Stream(context.Background(), "water", 0, func(m *web.StreamMatches) error {
+		for _, fm := range m.FileMatches {
+			got = append(got, fm.FileName)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "f1" || got[1] != "f2" {
+		t.Errorf("got files %v, want [f1 f2]", got)
+	}
+	if stats.FileCount != 2 {
+		t.Errorf("got FileCount %d, want 2", stats.FileCount)
+	}
+
+	_, err = c.Stream(context.Background(), "(", 0, func(*web.StreamMatches) error { return nil })
+	if zerr, ok := err.(*Error); !ok || !zerr.Remote || zerr.Temporary() {
+		t.Errorf("got %v, want non-temporary remote error", err)
+	}
+}
+
+func TestJSONRetryOverloaded(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"Query":"water"}`))
+	}))
+	defer ts.Close()
+
+	c := NewJSON(ts.URL, &Options{Backoff: time.Millisecond})
+	res, err := c.Search(context.Background(), "water", nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if res.Query != "water" {
+		t.Errorf("got %+v", res)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("got %d calls, want 2", n)
+	}
+}
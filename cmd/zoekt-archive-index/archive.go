@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 type Archive interface {
@@ -19,8 +20,10 @@ type Archive interface {
 
 type File struct {
 	io.Reader
-	Name string
-	Size int64
+	Name       string
+	Size       int64
+	Executable bool
+	ModTime    time.Time
 }
 
 type tarArchive struct {
@@ -41,9 +44,11 @@ func (a *tarArchive) Next() (*File, error) {
 		}
 
 		return &File{
-			Reader: a.tr,
-			Name:   hdr.Name,
-			Size:   hdr.Size,
+			Reader:     a.tr,
+			Name:       hdr.Name,
+			Size:       hdr.Size,
+			Executable: hdr.Mode&0111 != 0,
+			ModTime:    hdr.ModTime,
 		}, nil
 	}
 }
@@ -8,6 +8,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -15,11 +16,15 @@ import (
 	"io/ioutil"
 	"log"
 	"net/url"
+	"os"
+	"os/signal"
 	"reflect"
 	"strings"
+	"syscall"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
+	zoektctags "github.com/google/zoekt/ctags"
 )
 
 // stripComponents removes the specified number of leading path
@@ -35,6 +40,14 @@ func stripComponents(path string, count int) string {
 	return path
 }
 
+// splitPatterns splits a comma separated list of patterns.
+func splitPatterns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 // isGitOID checks if the revision is a git OID SHA string.
 //
 // Note: This doesn't mean the SHA exists in a repository, nor does it mean it
@@ -112,7 +125,7 @@ func (o *Options) SetDefaults() {
 	}
 }
 
-func do(opts Options, bopts build.Options) error {
+func do(ctx context.Context, opts Options, bopts build.Options) error {
 	opts.SetDefaults()
 
 	if opts.Name == "" && opts.RepoURL == "" {
@@ -154,7 +167,7 @@ func do(opts Options, bopts build.Options) error {
 	}
 	defer a.Close()
 
-	builder, err := build.NewBuilder(bopts)
+	builder, err := build.NewBuilderContext(ctx, bopts)
 	if err != nil {
 		return err
 	}
@@ -184,9 +197,11 @@ func do(opts Options, bopts build.Options) error {
 		}
 
 		err = builder.Add(zoekt.Document{
-			Name:     name,
-			Content:  contents,
-			Branches: brs,
+			Name:       name,
+			Content:    contents,
+			Branches:   brs,
+			Executable: f.Executable,
+			ModTime:    f.ModTime,
 		})
 		if err != nil {
 			return err
@@ -204,12 +219,36 @@ func main() {
 		indexDir    = flag.String("index", build.DefaultDir, "index directory for *.zoekt files.")
 		incremental = flag.Bool("incremental", true, "only index changed repositories")
 		ctags       = flag.Bool("require_ctags", false, "If set, ctags calls must succeed.")
+		ctagsBin    = flag.String("ctags", "", "universal-ctags binary to extract symbols with. If empty, symbols are not extracted.")
+		ctagsSbox   = flag.Bool("ctags_sandbox", true, "run ctags sandboxed, without network access.")
+		ctagsMap    = flag.String("ctags_map", "", "comma separated pattern=language pairs mapping files to ctags languages, eg. .pyx=Python.")
+		ignoreStr   = flag.String("ignore", "", "comma separated gitignore-style patterns of files not to index, in addition to those in the .zoektignore file of the archive.")
 
 		name   = flag.String("name", "", "The repository name for the archive")
 		urlRaw = flag.String("url", "", "The repository URL for the archive")
 		branch = flag.String("branch", "", "The branch name for the archive")
 		commit = flag.String("commit", "", "The commit sha for the archive. If incremental this will avoid updating shards already at commit")
 		strip  = flag.Int("strip_components", 0, "Remove the specified number of leading path elements. Pathnames with fewer elements will be silently skipped.")
+
+		repoID   = flag.Uint("repo_id", 0, "stable numeric ID of the repository, eg. its ID in the code host. Zero means no ID.")
+		tenant   = flag.String("tenant", "", "ID of the tenant owning the repository. Its shards are written to a subdirectory of -index.")
+		priority = flag.Float64("priority", 0, "priority of the repository for ranking across repositories, eg. its star count.")
+		archived = flag.Bool("archived", false, "mark the repository as archived, for the archived: query atom.")
+		fork     = flag.Bool("fork", false, "mark the repository as a fork, for the fork: query atom.")
+		public   = flag.Bool("public", false, "mark the repository as public, for the public: query atom.")
+
+		description = flag.String("description", "", "description of the repository, for the repo.desc: query atom.")
+		topics      = flag.String("topics", "", "comma separated topics of the repository, for the topic: query atom.")
+
+		checkpoint   = flag.Bool("checkpoint", false, "keep finished shards when interrupted, and resume from them on the next run.")
+		keepVersions = flag.Int("keep_versions", 0, "number of earlier versions of the repository to keep in the index, for searches pinned to a commit.")
+		compression  = flag.String("compress", "", "compress file contents in the shards with this algorithm; only zstd is supported. Compressed shards are smaller but slower to search.")
+		fileNames    = flag.Bool("file_names_only", false, "index only file names and the lines defining symbols, not the full content of files.")
+
+		lfs        = flag.String("lfs", build.LFSPointersIndex, "what to do with Git LFS pointer files: index their names (index), leave them out (skip) or index the objects they point to up to -file_limit bytes (fetch), read from -lfs_objects.")
+		lfsObjects = flag.String("lfs_objects", "", "Git LFS object store, eg. the .git/lfs/objects directory of a clone, for -lfs=fetch.")
+
+		postingEncoding = flag.String("posting_encoding", "", "encoding of ngram posting lists: empty for varint deltas, or roaring for roaring bitmaps, which are smaller for corpora with dense ngrams.")
 	)
 	flag.Parse()
 
@@ -220,12 +259,40 @@ func main() {
 	}
 	archive := flag.Args()[0]
 
+	languageMap, err := zoektctags.ParseLanguageMap(*ctagsMap)
+	if err != nil {
+		log.Fatal(err)
+	}
 	bopts := build.Options{
 		Parallelism:      *parallelism,
 		SizeMax:          *sizeMax,
 		ShardMax:         *shardLimit,
 		IndexDir:         *indexDir,
+		CTags:            *ctagsBin,
 		CTagsMustSucceed: *ctags,
+		CTagsSandbox:     *ctagsSbox,
+		CTagsLanguageMap: languageMap,
+		IgnorePatterns:   splitPatterns(*ignoreStr),
+		Checkpoint:       *checkpoint,
+		KeepVersions:     *keepVersions,
+		FileNamesOnly:    *fileNames,
+
+		ContentCompression: *compression,
+		PostingEncoding:    *postingEncoding,
+		LFSPointers:        *lfs,
+	}
+	if *lfsObjects != "" {
+		bopts.LFSFetch = build.LFSDirFetcher(*lfsObjects)
+	}
+	bopts.RepositoryDescription.ID = uint32(*repoID)
+	bopts.RepositoryDescription.TenantID = *tenant
+	bopts.RepositoryDescription.Priority = *priority
+	bopts.RepositoryDescription.Archived = *archived
+	bopts.RepositoryDescription.Fork = *fork
+	bopts.RepositoryDescription.Public = *public
+	bopts.RepositoryDescription.Description = *description
+	if *topics != "" {
+		bopts.RepositoryDescription.Topics = strings.Split(*topics, ",")
 	}
 	opts := Options{
 		Incremental: *incremental,
@@ -238,7 +305,10 @@ func main() {
 		Strip:   *strip,
 	}
 
-	if err := do(opts, bopts); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := do(ctx, opts, bopts); err != nil {
 		log.Fatal(err)
 	}
 }
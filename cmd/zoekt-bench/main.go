@@ -0,0 +1,250 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary replays a log of queries against an index directory or
+// a zoekt-webserver, and reports the latency distribution. Use it to
+// check the performance impact of changes to the index format or the
+// evaluation of queries.
+//
+// The log holds one query per line, either in the query syntax, or
+// as a JSON record of the slow query log of zoekt-webserver, whose
+// query and options are replayed exactly.
+//
+// Example:
+//
+//	zoekt-webserver -log_format json -slow_query_threshold 1s 2> server.log
+//	zoekt-bench -index_dir /data/index -concurrency 8 server.log
+//	zoekt-bench -remote localhost:6070 -repeat 3 queries.txt
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/client"
+	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/shards"
+)
+
+// benchQuery is a search to replay.
+type benchQuery struct {
+	q    query.Q
+	opts zoekt.SearchOptions
+}
+
+// logRecord holds the fields of a slow query log record used for
+// replaying it.
+type logRecord struct {
+	Msg         string          `json:"msg"`
+	QueryJSON   json.RawMessage `json:"query_json"`
+	OptionsJSON json.RawMessage `json:"options_json"`
+}
+
+// readQueries parses the query log in r. Lines that are not queries,
+// such as other log records, are skipped and counted. defaults are
+// the options of queries that do not have their own.
+func readQueries(r io.Reader, defaults zoekt.SearchOptions) (qs []benchQuery, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		bq := benchQuery{opts: defaults}
+		if strings.HasPrefix(line, "{") {
+			var rec logRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil || len(rec.QueryJSON) == 0 {
+				skipped++
+				continue
+			}
+			if bq.q, err = query.Unmarshal(rec.QueryJSON); err != nil {
+				skipped++
+				continue
+			}
+			if len(rec.OptionsJSON) > 0 {
+				if err := json.Unmarshal(rec.OptionsJSON, &bq.opts); err != nil {
+					skipped++
+					continue
+				}
+			}
+		} else if bq.q, err = query.Parse(line); err != nil {
+			skipped++
+			continue
+		}
+		qs = append(qs, bq)
+	}
+	return qs, skipped, scanner.Err()
+}
+
+// result is the outcome of a single search.
+type result struct {
+	duration time.Duration
+	err      error
+}
+
+// replay runs all queries repeat times, with concurrency searches in
+// flight at once.
+func replay(ctx context.Context, s zoekt.Searcher, qs []benchQuery, concurrency, repeat int) []result {
+	work := make(chan benchQuery)
+	go func() {
+		defer close(work)
+		for i := 0; i < repeat; i++ {
+			for _, q := range qs {
+				select {
+				case work <- q:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var results []result
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range work {
+				opts := q.opts
+				start := time.Now()
+				_, err := s.Search(ctx, q.q, &opts)
+				r := result{duration: time.Since(start), err: err}
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p/100*float64(len(sorted)-1)+0.5)]
+}
+
+// report writes the latency distribution of results, which took
+// elapsed in total, to w.
+func report(w io.Writer, results []result, elapsed time.Duration) {
+	var durations []time.Duration
+	errs := map[string]int{}
+	for _, r := range results {
+		durations = append(durations, r.duration)
+		if r.err != nil {
+			errs[zoekt.ErrorCodeOf(r.err).String()]++
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	fmt.Fprintf(w, "searches: %d in %v (%.1f/s)\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	for _, p := range []float64{50, 90, 95, 99, 100} {
+		fmt.Fprintf(w, "p%-3g %v\n", p, percentile(durations, p))
+	}
+	var codes []string
+	for c := range errs {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	for _, c := range codes {
+		fmt.Fprintf(w, "errors %s: %d\n", c, errs[c])
+	}
+}
+
+func main() {
+	index := flag.String("index_dir",
+		filepath.Join(os.Getenv("HOME"), ".zoekt"), "search the index files in `directory`")
+	remote := flag.String("remote", "", "search the zoekt-webserver at this `address`, e.g. localhost:6070, instead of local index files. The server must run with -rpc.")
+	concurrency := flag.Int("concurrency", 1, "number of searches to run at once")
+	repeat := flag.Int("repeat", 1, "number of times to replay the log")
+	num := flag.Int("num", 50, "maximum number of files to return, for queries logged without options")
+	maxWallTime := flag.Duration("max_wall_time", 10*time.Second, "time limit of a search, for queries logged without options")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [options] QUERY-LOG...\n\nReads standard input without QUERY-LOG.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	defaults := zoekt.SearchOptions{
+		MaxDocDisplayCount: *num,
+		MaxWallTime:        *maxWallTime,
+	}
+	var qs []benchQuery
+	skipped := 0
+	read := func(r io.Reader) {
+		q, n, err := readQueries(r, defaults)
+		if err != nil {
+			log.Fatal(err)
+		}
+		qs = append(qs, q...)
+		skipped += n
+	}
+	if flag.NArg() == 0 {
+		read(os.Stdin)
+	}
+	for _, fn := range flag.Args() {
+		f, err := os.Open(fn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		read(f)
+		f.Close()
+	}
+	if len(qs) == 0 {
+		log.Fatalf("no queries found (%d lines skipped)", skipped)
+	}
+	if skipped > 0 {
+		log.Printf("skipped %d lines that are not queries", skipped)
+	}
+
+	var searcher zoekt.Searcher
+	if *remote != "" {
+		addr := *remote
+		if u, err := url.Parse(addr); err == nil && u.Host != "" {
+			addr = u.Host
+		}
+		searcher = client.New(addr, &client.Options{MaxRetries: -1})
+	} else {
+		var err error
+		searcher, err = shards.NewDirectorySearcher(*index)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer searcher.Close()
+
+	start := time.Now()
+	results := replay(context.Background(), searcher, qs, *concurrency, *repeat)
+	report(os.Stdout, results, time.Since(start))
+}
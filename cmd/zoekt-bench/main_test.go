@@ -0,0 +1,86 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+func TestReadQueries(t *testing.T) {
+	in := `
+# comment
+needle file:java
+{"time":"2018-01-01T00:00:00Z","level":"INFO","msg":"listening"}
+{"msg":"slow search","query":"substr:\"bla\"","query_json":{"version":1,"query":{"kind":"substring","pattern":"bla","content":true}},"options_json":{"MaxDocDisplayCount":3}}
+(unbalanced
+`
+	qs, skipped, err := readQueries(strings.NewReader(in), zoekt.SearchOptions{MaxDocDisplayCount: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 2 {
+		t.Errorf("got %d skipped, want 2", skipped)
+	}
+	if len(qs) != 2 {
+		t.Fatalf("got %d queries, want 2", len(qs))
+	}
+	if want, _ := query.Parse("needle file:java"); qs[0].q.String() != want.String() || qs[0].opts.MaxDocDisplayCount != 50 {
+		t.Errorf("got %v %+v", qs[0].q, qs[0].opts)
+	}
+	if want := `content_substr:"bla"`; qs[1].q.String() != want || qs[1].opts.MaxDocDisplayCount != 3 {
+		t.Errorf("got %v %+v, want %s", qs[1].q, qs[1].opts, want)
+	}
+}
+
+type countingSearcher struct {
+	zoekt.Searcher
+	n int64
+}
+
+func (s *countingSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	atomic.AddInt64(&s.n, 1)
+	return &zoekt.SearchResult{}, nil
+}
+
+func TestReplay(t *testing.T) {
+	s := &countingSearcher{}
+	qs := []benchQuery{{q: &query.Const{Value: true}}, {q: &query.Const{Value: false}}}
+	results := replay(context.Background(), s, qs, 3, 4)
+	if len(results) != 8 || s.n != 8 {
+		t.Errorf("got %d results, %d searches, want 8", len(results), s.n)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 1; i <= 100; i++ {
+		ds = append(ds, time.Duration(i))
+	}
+	for p, want := range map[float64]time.Duration{0: 1, 50: 51, 99: 99, 100: 100} {
+		if got := percentile(ds, p); got != want {
+			t.Errorf("percentile(%g): got %v, want %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of nothing: got %v", got)
+	}
+}
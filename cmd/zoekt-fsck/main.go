@@ -0,0 +1,178 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary verifies the shards in an index directory. It reads
+// every shard completely and checks its section checksums and
+// internal consistency. Corrupt shards can be moved out of the way,
+// so the webserver does not load them, and their repositories sent
+// to zoekt-sourcegraph-indexserver for reindexing.
+//
+// Example:
+//
+//	zoekt-fsck -index $HOME/.zoekt
+//	zoekt-fsck -quarantine -reindex http://localhost:6072 -index /data/index
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+)
+
+// quarantineDir is the subdirectory of the index directory that
+// corrupt shards are moved to.
+const quarantineDir = "quarantine"
+
+// checkShard verifies the shard fn.
+func checkShard(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	defer iFile.Close()
+	return zoekt.VerifyShard(iFile)
+}
+
+var shardSuffix = regexp.MustCompile(`(@[^_]*)?_v[0-9]+\.[0-9]+\.zoekt$`)
+
+// repoName returns the repository of the shard fn. It uses the
+// metadata if it can be read, and the file name otherwise.
+func repoName(fn string) string {
+	if f, err := os.Open(fn); err == nil {
+		if iFile, err := zoekt.NewIndexFile(f); err == nil {
+			defer iFile.Close()
+			if repo, _, err := zoekt.ReadMetadata(iFile); err == nil && repo.Name != "" {
+				return repo.Name
+			}
+		}
+	}
+	name, err := url.QueryUnescape(shardSuffix.ReplaceAllString(filepath.Base(fn), ""))
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// quarantine moves the shard fn into the quarantine directory of
+// indexDir.
+func quarantine(indexDir, fn string) error {
+	dir := filepath.Join(indexDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dest := filepath.Join(dir, filepath.Base(fn))
+	if err := os.Rename(zoekt.ShardMetaName(fn), zoekt.ShardMetaName(dest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(fn, dest)
+}
+
+// reindex asks the indexserver at base to index repo again.
+func reindex(base, repo string) error {
+	resp, err := http.PostForm(strings.TrimSuffix(base, "/")+"/", url.Values{"repo": {repo}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reindex %s: %s", repo, resp.Status)
+	}
+	return nil
+}
+
+// fsck checks the shards of indexDir, and returns the corrupt ones.
+// Shards of another format version are reported, but not considered
+// corrupt.
+func fsck(indexDir string, verbose bool) ([]string, error) {
+	fs, err := zoekt.ListShards(indexDir)
+	if err != nil {
+		return nil, err
+	}
+	var corrupt []string
+	for _, fn := range fs {
+		err := checkShard(fn)
+		switch {
+		case err == nil:
+			if verbose {
+				fmt.Printf("%s: ok\n", fn)
+			}
+		case zoekt.ErrorCodeOf(err) == zoekt.CodeIndexStale:
+			fmt.Printf("%s: stale: %v\n", fn, err)
+		default:
+			fmt.Printf("%s: corrupt: %v\n", fn, err)
+			corrupt = append(corrupt, fn)
+		}
+	}
+	return corrupt, nil
+}
+
+func main() {
+	indexDir := flag.String("index", build.DefaultDir, "index directory to check.")
+	verbose := flag.Bool("v", false, "also list intact shards.")
+	doQuarantine := flag.Bool("quarantine", false, "move corrupt shards into the "+quarantineDir+" subdirectory of -index.")
+	reindexURL := flag.String("reindex", "", "URL of a zoekt-sourcegraph-indexserver to reindex the repositories of corrupt shards. Requires -quarantine.")
+	flag.Parse()
+
+	if *reindexURL != "" && !*doQuarantine {
+		log.Fatal("-reindex requires -quarantine, or the corrupt shard would be kept")
+	}
+
+	corrupt, err := fsck(*indexDir, *verbose)
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := false
+	for _, fn := range corrupt {
+		if !*doQuarantine {
+			continue
+		}
+		repo := repoName(fn)
+		if err := quarantine(*indexDir, fn); err != nil {
+			log.Printf("quarantine %s: %v", fn, err)
+			failed = true
+			continue
+		}
+		if *reindexURL == "" {
+			continue
+		}
+		if repo == "" {
+			log.Printf("%s: unknown repository, not reindexing", fn)
+			continue
+		}
+		if err := reindex(*reindexURL, repo); err != nil {
+			log.Print(err)
+			failed = true
+		}
+	}
+
+	if len(corrupt) > 0 {
+		fmt.Printf("%d corrupt shards\n", len(corrupt))
+	}
+	if failed || len(corrupt) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+)
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"good", "bad/repo"} {
+		b, err := build.NewBuilder(build.Options{
+			IndexDir:              dir,
+			RepositoryDescription: zoekt.Repository{Name: name},
+		})
+		if err != nil {
+			t.Fatalf("NewBuilder: %v", err)
+		}
+		b.AddFile("F", []byte("needle haystack"))
+		if err := b.Finish(); err != nil {
+			t.Fatalf("Finish: %v", err)
+		}
+	}
+
+	bad, err := filepath.Glob(filepath.Join(dir, "bad*.zoekt"))
+	if err != nil || len(bad) != 1 {
+		t.Fatalf("Glob: %v, %v", bad, err)
+	}
+	data, err := ioutil.ReadFile(bad[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[bytes.Index(data, []byte("needle"))] = 'N'
+	if err := ioutil.WriteFile(bad[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt, err := fsck(dir, false)
+	if err != nil {
+		t.Fatalf("fsck: %v", err)
+	}
+	if !reflect.DeepEqual(corrupt, bad) {
+		t.Fatalf("got corrupt %v, want %v", corrupt, bad)
+	}
+
+	if got := repoName(bad[0]); got != "bad/repo" {
+		t.Errorf("repoName: got %q, want %q", got, "bad/repo")
+	}
+	if err := quarantine(dir, bad[0]); err != nil {
+		t.Fatalf("quarantine: %v", err)
+	}
+	if _, err := os.Stat(bad[0]); !os.IsNotExist(err) {
+		t.Errorf("shard still in index after quarantine: %v", err)
+	}
+	moved := filepath.Join(dir, quarantineDir, filepath.Base(bad[0]))
+	if _, err := os.Stat(moved); err != nil {
+		t.Errorf("quarantined shard: %v", err)
+	}
+	if got := repoName(bad[0]); got != "bad/repo" {
+		t.Errorf("repoName from file name: got %q, want %q", got, "bad/repo")
+	}
+
+	var reindexed string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reindexed = r.FormValue("repo")
+	}))
+	defer ts.Close()
+	if err := reindex(ts.URL, "bad/repo"); err != nil {
+		t.Fatalf("reindex: %v", err)
+	}
+	if reindexed != "bad/repo" {
+		t.Errorf("reindexed %q, want %q", reindexed, "bad/repo")
+	}
+}
@@ -15,15 +15,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
+	zoektctags "github.com/google/zoekt/ctags"
 	"github.com/google/zoekt/gitindex"
 )
 
@@ -35,8 +39,13 @@ func main() {
 	var parallelism = flag.Int("parallelism", 4, "maximum number of parallel indexing processes.")
 	allowMissing := flag.Bool("allow_missing_branches", false, "allow missing branches.")
 	submodules := flag.Bool("submodules", true, "if set to false, do not recurse into submodules")
-	branchesStr := flag.String("branches", "HEAD", "git branches to index.")
+	submoduleRewrites := flag.String("submodule_url_rewrite", "", "comma separated FROM=TO pairs of URL prefixes, rewriting the URLs of submodules before they are looked up in -repo_cache, eg. https://git.corp/=https://github.com/.")
+	submoduleInclude := flag.String("submodule_include", "", "comma separated patterns of the paths of submodules to index, eg. third_party/*. Defaults to all submodules.")
+	submoduleExclude := flag.String("submodule_exclude", "", "comma separated patterns of the paths of submodules not to index. They take precedence over -submodule_include.")
+	branchesStr := flag.String("branches", "HEAD", "comma separated git branches to index, eg. HEAD,release-*. Branches may be shell patterns.")
 	branchPrefix := flag.String("prefix", "refs/heads/", "prefix for branch names")
+	worktree := flag.Bool("worktree", false, "index the checked-out working tree, including uncommitted changes, instead of -branches.")
+	worktreeStaged := flag.Bool("worktree_staged", false, "with -worktree, index the staged contents of files rather than their contents on disk.")
 
 	indexDir := flag.String("index", build.DefaultDir, "index directory for *.zoekt files.")
 	incremental := flag.Bool("incremental", true, "only index changed repositories")
@@ -44,7 +53,18 @@ func main() {
 		"this is used to find repositories for submodules. "+
 		"It also affects name if the indexed repository is under this directory.")
 	ctags := flag.Bool("require_ctags", false, "If set, ctags calls must succeed.")
+	ctagsBin := flag.String("ctags", "", "universal-ctags binary to extract symbols with. If empty, symbols are not extracted.")
+	ctagsSandbox := flag.Bool("ctags_sandbox", true, "run ctags sandboxed, without network access.")
+	ctagsMap := flag.String("ctags_map", "", "comma separated pattern=language pairs mapping files to ctags languages, eg. .pyx=Python.")
+	ignoreStr := flag.String("ignore", "", "comma separated gitignore-style patterns of files not to index, in addition to those in the .zoektignore file of each repository.")
 	version := flag.Bool("version", false, "Print version number")
+	checkpoint := flag.Bool("checkpoint", false, "keep finished shards when interrupted, and resume from them on the next run.")
+	compression := flag.String("compress", "", "compress file contents in the shards with this algorithm; only zstd is supported. Compressed shards are smaller but slower to search.")
+	postingEncoding := flag.String("posting_encoding", "", "encoding of ngram posting lists: empty for varint deltas, or roaring for roaring bitmaps, which are smaller for corpora with dense ngrams.")
+	keepVersions := flag.Int("keep_versions", 0, "number of earlier versions of each repository to keep in the index, for searches pinned to a commit.")
+	fileNamesOnly := flag.Bool("file_names_only", false, "index only file names and the lines defining symbols, not the full content of files.")
+	fileNamesOnlyAbove := flag.Int64("file_names_only_above", 0, "index repositories whose files add up to more than this many bytes as with -file_names_only. 0 disables this.")
+	lfs := flag.String("lfs", build.LFSPointersIndex, "what to do with Git LFS pointer files: index their names (index), leave them out (skip) or index the objects they point to up to -file_limit bytes (fetch), read from the LFS store of the repository or downloaded with git lfs.")
 	flag.Parse()
 
 	if *version {
@@ -59,15 +79,49 @@ func main() {
 		}
 		*repoCacheDir = dir
 	}
+	languageMap, err := zoektctags.ParseLanguageMap(*ctagsMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var ignorePatterns []string
+	if *ignoreStr != "" {
+		ignorePatterns = strings.Split(*ignoreStr, ",")
+	}
 	opts := build.Options{
 		Parallelism:      *parallelism,
 		SizeMax:          *sizeMax,
 		ShardMax:         *shardLimit,
 		IndexDir:         *indexDir,
+		CTags:            *ctagsBin,
 		CTagsMustSucceed: *ctags,
+		CTagsSandbox:     *ctagsSandbox,
+		CTagsLanguageMap: languageMap,
+		IgnorePatterns:   ignorePatterns,
+		Checkpoint:       *checkpoint,
+		KeepVersions:     *keepVersions,
+		FileNamesOnly:    *fileNamesOnly,
+
+		ContentCompression: *compression,
+		PostingEncoding:    *postingEncoding,
+		LFSPointers:        *lfs,
 	}
 	opts.SetDefaults()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	urlRewrites, err := gitindex.ParseURLRewrites(*submoduleRewrites)
+	if err != nil {
+		log.Fatal(err)
+	}
+	submoduleConfig := gitindex.SubmoduleConfig{URLRewrites: urlRewrites}
+	if *submoduleInclude != "" {
+		submoduleConfig.Include = strings.Split(*submoduleInclude, ",")
+	}
+	if *submoduleExclude != "" {
+		submoduleConfig.Exclude = strings.Split(*submoduleExclude, ",")
+	}
+
 	var branches []string
 	if *branchesStr != "" {
 		branches = strings.Split(*branchesStr, ",")
@@ -98,17 +152,24 @@ func main() {
 			BranchPrefix:       *branchPrefix,
 			Incremental:        *incremental,
 			Submodules:         *submodules,
+			SubmoduleConfig:    submoduleConfig,
 			RepoCacheDir:       *repoCacheDir,
 			AllowMissingBranch: *allowMissing,
 			BuildOptions:       opts,
 			Branches:           branches,
 			RepoDir:            dir,
+			Worktree:           *worktree,
+			WorktreeStaged:     *worktreeStaged,
+			FileNamesOnlyAbove: *fileNamesOnlyAbove,
 		}
 
-		if err := gitindex.IndexGitRepo(gitOpts); err != nil {
+		if err := gitindex.IndexGitRepoContext(ctx, gitOpts); err != nil {
 			log.Printf("indexGitRepo(%s): %v", dir, err)
 			exitStatus = 1
 		}
+		if ctx.Err() != nil {
+			break
+		}
 	}
 	os.Exit(exitStatus)
 }
@@ -0,0 +1,279 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary compares the repositories in two index directories, or
+// an index directory and a list of repositories, and reports what is
+// missing or different. Use it to validate migrations, or to find out
+// why a file is not searchable.
+//
+// Example:
+//
+//	zoekt-index-diff -docs $HOME/.zoekt /mnt/new-index
+//	zoekt-index-diff -repos repos.txt $HOME/.zoekt
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// repoInfo summarizes a repository in an index.
+type repoInfo struct {
+	// Branch name => version. Nil if versions are unknown.
+	branches map[string]string
+
+	// If set, the version expected for one of the branches.
+	commit string
+
+	// Number of documents, or -1 if unknown.
+	documents int
+
+	// Set of file names. Nil if not loaded.
+	files map[string]bool
+}
+
+// loadIndex reads the repositories of all shards in dir. If docs is
+// set, it also lists their files.
+func loadIndex(dir string, docs bool) (map[string]*repoInfo, error) {
+	fs, err := filepath.Glob(filepath.Join(dir, "*.zoekt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(fs) == 0 {
+		return nil, fmt.Errorf("no shards in %s", dir)
+	}
+
+	repos := map[string]*repoInfo{}
+	for _, fn := range fs {
+		if err := loadShard(fn, docs, repos); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	return repos, nil
+}
+
+func loadShard(fn string, docs bool, repos map[string]*repoInfo) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	s, err := zoekt.NewSearcher(iFile)
+	if err != nil {
+		iFile.Close()
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	list, err := s.List(ctx, &query.Repo{})
+	if err != nil {
+		return err
+	}
+	for _, e := range list.Repos {
+		r := repos[e.Repository.Name]
+		if r == nil {
+			r = &repoInfo{branches: map[string]string{}}
+			repos[e.Repository.Name] = r
+		}
+		for _, b := range e.Repository.Branches {
+			r.branches[b.Name] = b.Version
+		}
+		r.documents += e.Stats.Documents
+	}
+
+	if !docs {
+		return nil
+	}
+	res, err := s.Search(ctx, &query.Const{Value: true}, &zoekt.SearchOptions{
+		ShardMaxMatchCount:     math.MaxInt32,
+		ShardMaxImportantMatch: math.MaxInt32,
+	})
+	if err != nil {
+		return err
+	}
+	for _, fm := range res.Files {
+		r := repos[fm.Repository]
+		if r.files == nil {
+			r.files = map[string]bool{}
+		}
+		r.files[fm.FileName] = true
+	}
+	return nil
+}
+
+// loadRepoList reads a list of repositories, one per line, optionally
+// followed by the commit expected on one of its branches.
+func loadRepoList(fn string) (map[string]*repoInfo, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	repos := map[string]*repoInfo{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		r := &repoInfo{documents: -1}
+		if len(fields) > 1 {
+			r.commit = fields[1]
+		}
+		repos[fields[0]] = r
+	}
+	return repos, scanner.Err()
+}
+
+// diff returns the differences between the repositories of a and b,
+// sorted by repository.
+func diff(a, b map[string]*repoInfo) []string {
+	names := map[string]bool{}
+	for n := range a {
+		names[n] = true
+	}
+	for n := range b {
+		names[n] = true
+	}
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	var out []string
+	for _, n := range sorted {
+		ra, rb := a[n], b[n]
+		switch {
+		case rb == nil:
+			out = append(out, fmt.Sprintf("%s: only in A", n))
+			continue
+		case ra == nil:
+			out = append(out, fmt.Sprintf("%s: only in B", n))
+			continue
+		}
+
+		if ra.branches != nil && rb.branches != nil {
+			for _, br := range unionKeys(keys(ra.branches), keys(rb.branches)) {
+				if va, vb := ra.branches[br], rb.branches[br]; va != vb {
+					out = append(out, fmt.Sprintf("%s: branch %s: %q != %q", n, br, va, vb))
+				}
+			}
+		}
+		if ra.commit != "" && !hasVersion(rb.branches, ra.commit) {
+			out = append(out, fmt.Sprintf("%s: no branch at %s in B", n, ra.commit))
+		}
+		if ra.documents >= 0 && rb.documents >= 0 && ra.documents != rb.documents {
+			out = append(out, fmt.Sprintf("%s: %d != %d documents", n, ra.documents, rb.documents))
+		}
+		if ra.files != nil && rb.files != nil {
+			for _, f := range unionKeys(ra.files, rb.files) {
+				if !rb.files[f] {
+					out = append(out, fmt.Sprintf("%s: %s: only in A", n, f))
+				} else if !ra.files[f] {
+					out = append(out, fmt.Sprintf("%s: %s: only in B", n, f))
+				}
+			}
+		}
+	}
+	return out
+}
+
+func hasVersion(branches map[string]string, version string) bool {
+	for _, v := range branches {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func keys(m map[string]string) map[string]bool {
+	set := map[string]bool{}
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+// unionKeys returns the sorted keys present in a or b.
+func unionKeys(a, b map[string]bool) []string {
+	var res []string
+	for k := range a {
+		res = append(res, k)
+	}
+	for k := range b {
+		if !a[k] {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func main() {
+	docs := flag.Bool("docs", false, "also compare the file names of each repository. This loads all shards fully.")
+	repoList := flag.String("repos", "", "compare INDEX-DIR against this list of repositories instead of a second index directory. Each line holds a name, optionally followed by the commit expected on one of its branches.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [options] INDEX-DIR-A INDEX-DIR-B\n  %s [options] -repos FILE INDEX-DIR\n\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var a, b map[string]*repoInfo
+	var err error
+	switch {
+	case *repoList != "" && flag.NArg() == 1:
+		if a, err = loadRepoList(*repoList); err != nil {
+			log.Fatal(err)
+		}
+		if b, err = loadIndex(flag.Arg(0), false); err != nil {
+			log.Fatal(err)
+		}
+	case *repoList == "" && flag.NArg() == 2:
+		if a, err = loadIndex(flag.Arg(0), *docs); err != nil {
+			log.Fatal(err)
+		}
+		if b, err = loadIndex(flag.Arg(1), *docs); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	out := diff(a, b)
+	for _, l := range out {
+		fmt.Println(l)
+	}
+	if len(out) > 0 {
+		os.Exit(1)
+	}
+}
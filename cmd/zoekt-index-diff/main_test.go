@@ -0,0 +1,56 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	a := map[string]*repoInfo{
+		"only-a": {documents: 1},
+		"same":   {branches: map[string]string{"master": "1"}, documents: 2},
+		"changed": {
+			branches:  map[string]string{"master": "1"},
+			documents: 2,
+			files:     map[string]bool{"x": true, "y": true},
+		},
+		"listed": {commit: "2", documents: -1},
+	}
+	b := map[string]*repoInfo{
+		"only-b": {documents: 1},
+		"same":   {branches: map[string]string{"master": "1"}, documents: 2},
+		"changed": {
+			branches:  map[string]string{"master": "2"},
+			documents: 3,
+			files:     map[string]bool{"x": true, "z": true},
+		},
+		"listed": {branches: map[string]string{"HEAD": "1"}, documents: 5},
+	}
+
+	want := []string{
+		`changed: branch master: "1" != "2"`,
+		`changed: 2 != 3 documents`,
+		`changed: y: only in A`,
+		`changed: z: only in B`,
+		`listed: no branch at 2 in B`,
+		`only-a: only in A`,
+		`only-b: only in B`,
+	}
+	if got := diff(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary prints statistics for index shards: the repository and
+// branches they hold, their document and ngram counts, and how much
+// disk and memory they take. Use it for capacity planning, or to find
+// out why a shard is large.
+//
+// Example:
+//
+//	zoekt-index-stats $HOME/.zoekt
+//	zoekt-index-stats -json $HOME/.zoekt/repo_v16.00000.zoekt
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/zoekt"
+)
+
+// shardFiles expands the directories among args into the shards they
+// contain.
+func shardFiles(args []string) ([]string, error) {
+	var fns []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			fns = append(fns, arg)
+			continue
+		}
+		fs, err := filepath.Glob(filepath.Join(arg, "*.zoekt"))
+		if err != nil {
+			return nil, err
+		}
+		fns = append(fns, fs...)
+	}
+	return fns, nil
+}
+
+func loadShard(fn string) (*zoekt.ShardInfo, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer iFile.Close()
+	return zoekt.ReadShardInfo(iFile)
+}
+
+func branches(bs []zoekt.RepositoryBranch) string {
+	var ss []string
+	for _, b := range bs {
+		v := b.Version
+		if len(v) > 12 {
+			v = v[:12]
+		}
+		ss = append(ss, b.Name+"@"+v)
+	}
+	return strings.Join(ss, ",")
+}
+
+// printTable writes one line per shard, followed by the totals.
+func printTable(w io.Writer, infos []*zoekt.ShardInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "shard\trepo\tbranches\tdocs\tcontent\tngrams\tpostings\tfile ngrams\tsymbols\tdisk\tmemory\t")
+
+	var total zoekt.ShardInfo
+	for _, s := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+			filepath.Base(s.Name), s.Repository, branches(s.Branches),
+			s.Documents, s.ContentBytes, s.Ngrams, s.PostingBytes,
+			s.FileNameNgrams, s.Symbols, s.DiskBytes, s.MemoryBytes)
+		total.Documents += s.Documents
+		total.ContentBytes += s.ContentBytes
+		total.Ngrams += s.Ngrams
+		total.PostingBytes += s.PostingBytes
+		total.FileNameNgrams += s.FileNameNgrams
+		total.Symbols += s.Symbols
+		total.DiskBytes += s.DiskBytes
+		total.MemoryBytes += s.MemoryBytes
+	}
+	if len(infos) > 1 {
+		fmt.Fprintf(tw, "total (%d shards)\t\t\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+			len(infos), total.Documents, total.ContentBytes, total.Ngrams,
+			total.PostingBytes, total.FileNameNgrams, total.Symbols,
+			total.DiskBytes, total.MemoryBytes)
+	}
+	return tw.Flush()
+}
+
+func main() {
+	jsonOut := flag.Bool("json", false, "print the statistics as a JSON array instead of a table.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [options] SHARD-OR-INDEX-DIR...\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fns, err := shardFiles(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	infos := []*zoekt.ShardInfo{}
+	for _, fn := range fns {
+		info, err := loadShard(fn)
+		if err != nil {
+			log.Fatalf("%s: %v", fn, err)
+		}
+		infos = append(infos, info)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(infos)
+	} else {
+		err = printTable(os.Stdout, infos)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
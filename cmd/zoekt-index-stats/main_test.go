@@ -0,0 +1,51 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/zoekt"
+)
+
+func TestPrintTable(t *testing.T) {
+	infos := []*zoekt.ShardInfo{
+		{
+			Name:       "/data/index/repo_v16.00000.zoekt",
+			Repository: "repo",
+			Branches:   []zoekt.RepositoryBranch{{Name: "main", Version: "0123456789abcdef"}},
+			Documents:  2,
+			DiskBytes:  100,
+		},
+		{Name: "other_v16.00000.zoekt", Repository: "other", Documents: 3, DiskBytes: 50},
+	}
+
+	var buf bytes.Buffer
+	if err := printTable(&buf, infos); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4:\n%s", len(lines), buf.String())
+	}
+	if f := strings.Fields(lines[1]); f[0] != "repo_v16.00000.zoekt" || f[2] != "main@0123456789ab" {
+		t.Errorf("got shard line %q", lines[1])
+	}
+	if f := strings.Fields(lines[3]); f[3] != "5" || f[len(f)-2] != "150" {
+		t.Errorf("got total line %q", lines[3])
+	}
+}
@@ -15,17 +15,30 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime/pprof"
 	"strings"
 
+	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
 )
 
+// root is a source tree that is mounted under Prefix in a composite
+// repository. The embedded Repository holds the name and URL
+// templates used to link files in this tree back to their origin.
+type root struct {
+	Prefix string
+	Dir    string
+	zoekt.Repository
+}
+
 type fileAggregator struct {
 	ignoreDirs map[string]struct{}
 	sizeMax    int64
@@ -61,6 +74,10 @@ func main() {
 
 	ignoreDirs := flag.String("ignore_dirs", ".git,.hg,.svn", "comma separated list of directories to ignore.")
 	indexDir := flag.String("index", build.DefaultDir, "directory for search indices")
+	name := flag.String("name", "", "name of the repository built from -roots.")
+	compression := flag.String("compress", "", "compress file contents in the shards with this algorithm; only zstd is supported. Compressed shards are smaller but slower to search.")
+	postingEncoding := flag.String("posting_encoding", "", "encoding of ngram posting lists: empty for varint deltas, or roaring for roaring bitmaps, which are smaller for corpora with dense ngrams.")
+	rootsFile := flag.String("roots", "", "JSON file listing source roots (Prefix, Dir, Name, URL templates) to merge into a single repository.")
 	flag.Parse()
 
 	opts := build.Options{
@@ -68,6 +85,9 @@ func main() {
 		SizeMax:     *sizeMax,
 		ShardMax:    *shardLimit,
 		IndexDir:    *indexDir,
+
+		ContentCompression: *compression,
+		PostingEncoding:    *postingEncoding,
 	}
 	opts.SetDefaults()
 
@@ -91,6 +111,16 @@ func main() {
 		}
 	}
 
+	if *rootsFile != "" {
+		roots, err := readRoots(*rootsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := indexRoots(*name, roots, opts, ignoreDirMap); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	for _, arg := range flag.Args() {
 		if err := indexArg(arg, opts, ignoreDirMap); err != nil {
 			log.Fatal(err)
@@ -98,6 +128,63 @@ func main() {
 	}
 }
 
+func readRoots(fn string) ([]root, error) {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var roots []root
+	if err := json.Unmarshal(content, &roots); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return roots, nil
+}
+
+// indexRoots builds a single repository out of several source
+// trees. The root with an empty prefix describes the repository
+// itself; all others become sub repositories mounted at their prefix.
+func indexRoots(name string, roots []root, opts build.Options, ignore map[string]struct{}) error {
+	opts.RepositoryDescription.Name = name
+	opts.SubRepositories = map[string]*zoekt.Repository{}
+	for i := range roots {
+		r := &roots[i]
+		r.Prefix = strings.Trim(path.Clean("/"+r.Prefix), "/")
+		if r.Prefix == "" {
+			desc := r.Repository
+			if desc.Name == "" {
+				desc.Name = name
+			}
+			opts.RepositoryDescription = desc
+			continue
+		}
+		if _, ok := opts.SubRepositories[r.Prefix]; ok {
+			return fmt.Errorf("duplicate root prefix %q", r.Prefix)
+		}
+		if r.Name == "" {
+			r.Name = path.Join(name, r.Prefix)
+		}
+		opts.SubRepositories[r.Prefix] = &r.Repository
+	}
+	if opts.RepositoryDescription.Name == "" {
+		return fmt.Errorf("must set -name or a root with empty prefix")
+	}
+
+	builder, err := build.NewBuilder(opts)
+	if err != nil {
+		return err
+	}
+	for _, r := range roots {
+		dir, err := filepath.Abs(filepath.Clean(r.Dir))
+		if err != nil {
+			return err
+		}
+		if err := addDir(builder, dir, r.Prefix, opts, ignore); err != nil {
+			return err
+		}
+	}
+	return builder.Finish()
+}
+
 func indexArg(arg string, opts build.Options, ignore map[string]struct{}) error {
 	dir, err := filepath.Abs(filepath.Clean(arg))
 	if err != nil {
@@ -110,6 +197,15 @@ func indexArg(arg string, opts build.Options, ignore map[string]struct{}) error
 		return err
 	}
 
+	if err := addDir(builder, dir, "", opts, ignore); err != nil {
+		return err
+	}
+	return builder.Finish()
+}
+
+// addDir adds all files below dir to the builder, with names
+// relative to dir, prefixed by prefix.
+func addDir(builder *build.Builder, dir, prefix string, opts build.Options, ignore map[string]struct{}) error {
 	comm := make(chan string, 100)
 	agg := fileAggregator{
 		ignoreDirs: ignore,
@@ -129,10 +225,17 @@ func indexArg(arg string, opts build.Options, ignore map[string]struct{}) error
 		if err != nil {
 			return err
 		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
 
-		f = strings.TrimPrefix(f, dir+"/")
-		builder.AddFile(f, content)
+		builder.Add(zoekt.Document{
+			Name:       path.Join(prefix, strings.TrimPrefix(f, dir+"/")),
+			Content:    content,
+			Executable: fi.Mode()&0111 != 0,
+			ModTime:    fi.ModTime(),
+		})
 	}
-
-	return builder.Finish()
+	return nil
 }
@@ -18,7 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -110,7 +110,7 @@ func watchFile(path string) (<-chan struct{}, error) {
 				}
 			case err := <-watcher.Errors:
 				if err != nil {
-					log.Printf("watcher error: %v", err)
+					slog.Error("watcher error", "file", path, "error", err)
 				}
 			}
 		}
@@ -122,14 +122,14 @@ func periodicMirrorFile(repoDir string, cfgFile string, interval time.Duration)
 	t := time.NewTicker(interval)
 	watcher, err := watchFile(cfgFile)
 	if err != nil {
-		log.Printf("watchFile(%q): %v", cfgFile, err)
+		slog.Error("watching mirror config failed", "file", cfgFile, "error", err)
 	}
 
 	var lastCfg []configEntry
 	for {
 		cfg, err := readConfigFile(cfgFile)
 		if err != nil {
-			log.Printf("readConfig(%s): %v", cfgFile, err)
+			slog.Error("reading mirror config failed", "file", cfgFile, "error", err)
 		} else {
 			lastCfg = cfg
 		}
@@ -138,7 +138,7 @@ func periodicMirrorFile(repoDir string, cfgFile string, interval time.Duration)
 
 		select {
 		case <-watcher:
-			log.Printf("mirror config %s changed", cfgFile)
+			slog.Info("mirror config changed", "file", cfgFile)
 		case <-t.C:
 		}
 	}
@@ -151,7 +151,7 @@ func periodicMirrorURL(repoDir string, u string, interval time.Duration) {
 	for {
 		cfg, err := readConfigURL(u)
 		if err != nil {
-			log.Printf("readConfigURL(%s): %v", u, err)
+			slog.Error("reading mirror config failed", "url", u, "error", err)
 		} else {
 			lastCfg = cfg
 		}
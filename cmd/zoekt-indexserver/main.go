@@ -21,9 +21,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
 	"net/url"
 	"os"
@@ -33,23 +35,35 @@ import (
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/gitindex"
+	"github.com/google/zoekt/logging"
+	"github.com/google/zoekt/tracing"
 )
 
 const day = time.Hour * 24
 
+var tracer = otel.Tracer("github.com/google/zoekt/cmd/zoekt-indexserver")
+
 func loggedRun(cmd *exec.Cmd) {
+	_, span := tracer.Start(context.Background(), "exec "+filepath.Base(cmd.Path), trace.WithAttributes(attribute.StringSlice("args", cmd.Args)))
 	out := &bytes.Buffer{}
 	errOut := &bytes.Buffer{}
 	cmd.Stdout = out
 	cmd.Stderr = errOut
 
-	if err := cmd.Run(); err != nil {
-		log.Printf("command %s failed: %v\nOUT: %s\nERR: %s",
-			cmd.Args, err, out.String(), errOut.String())
+	start := time.Now()
+	err := cmd.Run()
+	tracing.End(span, err)
+	if err != nil {
+		slog.Error("command failed", "args", cmd.Args, "duration", time.Since(start), "error", err,
+			"stdout", out.String(), "stderr", errOut.String())
 	} else {
-		log.Printf("ran successfully %s", cmd.Args)
+		slog.Info("ran successfully", "args", cmd.Args, "duration", time.Since(start))
 	}
 }
 
@@ -61,11 +75,11 @@ func refresh(repoDir, indexDir, indexConfigFile string, indexFlags []string, fet
 	for {
 		repos, err := gitindex.FindGitRepos(repoDir)
 		if err != nil {
-			log.Println(err)
+			slog.Error("finding repositories failed", "dir", repoDir, "error", err)
 			continue
 		}
 		if len(repos) == 0 {
-			log.Printf("no repos found under %s", repoDir)
+			slog.Warn("no repositories found", "dir", repoDir)
 		}
 		for _, dir := range repos {
 			cmd := exec.Command("git", "--git-dir", dir, "fetch", "origin")
@@ -113,7 +127,7 @@ func runIndexCommand(indexDir, repoDir, indexConfigFile string, indexFlags []str
 		var err error
 		indexConfig, err = readIndexConfig(indexConfigFile)
 		if err != nil {
-			log.Printf("index config: %v", err)
+			slog.Error("reading index config failed", "file", indexConfigFile, "error", err)
 		}
 
 		repoIndexCommand(indexDir, repoDir, indexConfig.RepoHosts)
@@ -121,7 +135,7 @@ func runIndexCommand(indexDir, repoDir, indexConfigFile string, indexFlags []str
 
 	repos, err := gitindex.FindGitRepos(repoDir)
 	if err != nil {
-		log.Println("FindGitRepos", err)
+		slog.Error("finding repositories failed", "dir", repoDir, "error", err)
 		return
 	}
 
@@ -197,7 +211,8 @@ func deleteIfStale(repoDir string, fn string) error {
 	repoDir = gitindex.Path(repoDir, repo.Name)
 	_, err = os.Stat(repoDir)
 	if os.IsNotExist(err) {
-		log.Printf("deleting stale shard %s; dir %q not found", fn, repoDir)
+		slog.Info("repository not found, deleting shard", "repo", repo.Name, "dir", repoDir, "shard", fn)
+		os.Remove(zoekt.ShardMetaName(fn))
 		return os.Remove(fn)
 	}
 
@@ -211,12 +226,12 @@ func deleteStaleIndexes(indexDir, repoDir string, watchInterval time.Duration) {
 	for {
 		fs, err := filepath.Glob(expr)
 		if err != nil {
-			log.Printf("Glob(%q): %v", expr, err)
+			slog.Error("listing shards failed", "glob", expr, "error", err)
 		}
 
 		for _, f := range fs {
 			if err := deleteIfStale(repoDir, f); err != nil {
-				log.Printf("deleteIfStale(%q): %v", f, err)
+				slog.Error("deleting stale shard failed", "shard", f, "error", err)
 			}
 		}
 		<-t.C
@@ -237,8 +252,20 @@ func main() {
 	cpuFraction := flag.Float64("cpu_fraction", 0.25,
 		"use this fraction of the cores for indexing.")
 	indexFlagsStr := flag.String("git_index_flags", "", "space separated list of flags passed through to zoekt-git-index (e.g. -git_index_flags='-symbols=false -submodules=false'")
+	logFormat := flag.String("log_format", "json", "format of logs: json or text.")
+	logLevel := flag.String("log_level", "info", "minimum level of logs: debug, info, warn or error.")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "export traces to this OTLP/HTTP collector, e.g. http://localhost:4318. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT.")
 	flag.Parse()
 
+	if err := logging.Init("zoekt-indexserver", *logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), "zoekt-indexserver", *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	if *cpuFraction <= 0.0 || *cpuFraction > 1.0 {
 		log.Fatal("cpu_fraction must be between 0.0 and 1.0")
 	}
@@ -254,6 +254,24 @@ func updateConfig(destDir string, r *github.Repository) error {
 		return err
 	}
 
+	for k, v := range map[string]*bool{
+		"archived": r.Archived,
+		"fork":     r.Fork,
+	} {
+		if v != nil {
+			cfg.Raw.SetOption("zoekt", "", k, strconv.FormatBool(*v))
+		}
+	}
+	if r.Description != nil {
+		cfg.Raw.SetOption("zoekt", "", "description", *r.Description)
+	}
+	if len(r.Topics) > 0 {
+		cfg.Raw.SetOption("zoekt", "", "topics", strings.Join(r.Topics, ","))
+	}
+	if r.Private != nil {
+		cfg.Raw.SetOption("zoekt", "", "public", strconv.FormatBool(!*r.Private))
+	}
+
 	for k, v := range map[string]*int{
 		"github-stars":       r.StargazersCount,
 		"github-watchers":    r.WatchersCount,
@@ -0,0 +1,159 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary upgrades shards of an older format version to the
+// current one, without access to the indexed repositories. It reads
+// the documents back from each shard and writes them anew, replacing
+// the old shard. Shards too old to be read must be reindexed from
+// their repositories instead.
+//
+// Example:
+//
+//	zoekt-reindex-shard -index $HOME/.zoekt
+//	zoekt-reindex-shard $HOME/.zoekt/repo_v22.00000.zoekt
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+)
+
+var shardVersion = regexp.MustCompile(`_v[0-9]+(\.[0-9]+\.zoekt)$`)
+
+// upgradedName returns the name of the upgraded shard fn. Shard names
+// contain the format version by convention; other names are kept.
+func upgradedName(fn string) string {
+	return shardVersion.ReplaceAllString(fn, fmt.Sprintf("_v%d${1}", zoekt.IndexFormatVersion))
+}
+
+// readVersion returns the format version of the shard fn.
+func readVersion(fn string) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return 0, err
+	}
+	defer iFile.Close()
+	_, md, err := zoekt.ReadMetadata(iFile)
+	if err != nil {
+		return 0, err
+	}
+	return md.IndexFormatVersion, nil
+}
+
+// upgrade writes the shard fn in the current format version, and
+// replaces fn with it.
+func upgrade(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	defer iFile.Close()
+
+	dest := upgradedName(fn)
+	if _, err := os.Stat(dest); err == nil && dest != fn {
+		// The repository was reindexed in the meantime.
+		return fmt.Errorf("%s already exists", dest)
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if fi, err := os.Stat(fn); err == nil {
+		out.Chmod(fi.Mode())
+	}
+	if err := zoekt.UpgradeShard(iFile, out); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), dest); err != nil {
+		return err
+	}
+	// The upgraded shard includes the sidecar metadata.
+	os.Remove(zoekt.ShardMetaName(fn))
+	if dest != fn {
+		return os.Remove(fn)
+	}
+	return nil
+}
+
+// upgradeAll upgrades the shards fs that are older than the current
+// format version. It returns the number of shards that could not be
+// upgraded.
+func upgradeAll(fs []string, verbose bool) int {
+	failed := 0
+	for _, fn := range fs {
+		v, err := readVersion(fn)
+		switch {
+		case err != nil:
+			log.Printf("%s: %v", fn, err)
+			failed++
+		case v == zoekt.IndexFormatVersion:
+			if verbose {
+				fmt.Printf("%s: up to date\n", fn)
+			}
+		case v < zoekt.MinIndexFormatVersion || v > zoekt.IndexFormatVersion:
+			fmt.Printf("%s: v%d cannot be upgraded, reindex its repository\n", fn, v)
+			failed++
+		default:
+			if err := upgrade(fn); err != nil {
+				log.Printf("%s: %v", fn, err)
+				failed++
+				continue
+			}
+			fmt.Printf("%s: upgraded from v%d to %s\n", fn, v, upgradedName(fn))
+		}
+	}
+	return failed
+}
+
+func main() {
+	indexDir := flag.String("index", build.DefaultDir, "index directory to upgrade, if no shards are given.")
+	verbose := flag.Bool("v", false, "also list shards that are up to date.")
+	flag.Parse()
+
+	fs := flag.Args()
+	if len(fs) == 0 {
+		var err error
+		fs, err = zoekt.ListShards(*indexDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if failed := upgradeAll(fs, *verbose); failed > 0 {
+		fmt.Printf("%d shards not upgraded\n", failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+)
+
+func TestUpgradedName(t *testing.T) {
+	for in, want := range map[string]string{
+		"/data/repo_v16.00001.zoekt":     fmt.Sprintf("/data/repo_v%d.00001.zoekt", zoekt.IndexFormatVersion),
+		"/data/repo@tag_v16.00000.zoekt": fmt.Sprintf("/data/repo@tag_v%d.00000.zoekt", zoekt.IndexFormatVersion),
+		"/data/custom.zoekt":             "/data/custom.zoekt",
+	} {
+		if got := upgradedName(in); got != want {
+			t.Errorf("upgradedName(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUpgradeAllCurrent(t *testing.T) {
+	dir := t.TempDir()
+	b, err := build.NewBuilder(build.Options{
+		IndexDir:              dir,
+		RepositoryDescription: zoekt.Repository{Name: "repo"},
+	})
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("F", []byte("needle haystack"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	fs, err := filepath.Glob(filepath.Join(dir, "*.zoekt"))
+	if err != nil || len(fs) != 1 {
+		t.Fatalf("Glob: %v, %v", fs, err)
+	}
+	before, err := os.Stat(fs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := upgradeAll(fs, false); failed != 0 {
+		t.Errorf("got %d failures, want 0", failed)
+	}
+	after, err := os.Stat(fs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("shard in the current version was rewritten")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary keeps an index directory in sync with the shards served
+// by a zoekt-webserver running with -replication.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/google/zoekt/build"
+	"github.com/google/zoekt/replicate"
+)
+
+func main() {
+	source := flag.String("source", "", "replication URL of the source, eg. http://primary:6070/replicate/")
+	index := flag.String("index", build.DefaultDir, "index directory to keep in sync.")
+	interval := flag.Duration("interval", time.Minute, "time between syncs.")
+	once := flag.Bool("once", false, "sync once and exit.")
+	flag.Parse()
+
+	if *source == "" {
+		log.Fatal("must set -source")
+	}
+	if err := os.MkdirAll(*index, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	r := &replicate.Replica{
+		Source: *source,
+		Dir:    *index,
+	}
+	if *once {
+		stats, err := r.Sync(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%+v", *stats)
+		return
+	}
+	r.Run(ctx, *interval)
+}
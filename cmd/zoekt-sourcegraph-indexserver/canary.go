@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Canary enables extra zoekt-archive-index arguments for a percentage
+// of the repositories, so new indexing options are tried on part of
+// the corpus before all of it is rebuilt.
+type Canary struct {
+	// Args are added to the arguments of zoekt-archive-index.
+	Args []string
+
+	// Percent is the percentage of repositories indexed with Args.
+	Percent float64
+}
+
+// ParseCanaries parses comma separated PERCENT:ARGS pairs, eg.
+// "10:-compress=zstd,1:-posting_encoding=roaring -require_ctags".
+// ARGS are separated by spaces.
+func ParseCanaries(s string) ([]Canary, error) {
+	var canaries []Canary
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		i := strings.Index(c, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("canary %q: want PERCENT:ARGS", c)
+		}
+		p, err := strconv.ParseFloat(strings.TrimSuffix(c[:i], "%"), 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("canary %q: percentage must be between 0 and 100", c)
+		}
+		args := strings.Fields(c[i+1:])
+		if len(args) == 0 {
+			return nil, fmt.Errorf("canary %q: no arguments", c)
+		}
+		canaries = append(canaries, Canary{Args: args, Percent: p})
+	}
+	return canaries, nil
+}
+
+// Enabled returns whether repo is indexed with the canary's Args. The
+// repositories are chosen by hashing their name, so raising Percent
+// only adds repositories, and different canaries choose different
+// ones.
+func (c *Canary) Enabled(repo string) bool {
+	bucket := weight(strings.Join(c.Args, " "), repo) % 10000
+	return float64(bucket) < c.Percent*100
+}
+
+// canaryArgs returns the arguments of the canaries enabled for repo.
+func canaryArgs(canaries []Canary, repo string) []string {
+	var args []string
+	for i := range canaries {
+		if canaries[i].Enabled(repo) {
+			args = append(args, canaries[i].Args...)
+		}
+	}
+	return args
+}
+
+// flagValue returns the value of the last flag name in args, or "" if
+// it is not set. Boolean flags given without a value are "true"; the
+// value of other flags may also be the next argument.
+func flagValue(args []string, name string, isBool bool) string {
+	v := ""
+	for i, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		a = strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		switch {
+		case strings.HasPrefix(a, name+"="):
+			v = a[len(name)+1:]
+		case a != name:
+		case isBool:
+			v = "true"
+		case i+1 < len(args):
+			v = args[i+1]
+		}
+	}
+	return v
+}
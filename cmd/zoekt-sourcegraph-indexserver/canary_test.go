@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseCanaries(t *testing.T) {
+	got, err := ParseCanaries("10:-compress=zstd, 0.5%:-posting_encoding=roaring -require_ctags")
+	if err != nil {
+		t.Fatalf("ParseCanaries: %v", err)
+	}
+	want := []Canary{
+		{Args: []string{"-compress=zstd"}, Percent: 10},
+		{Args: []string{"-posting_encoding=roaring", "-require_ctags"}, Percent: 0.5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"-compress=zstd", "101:-compress=zstd", "x:-compress=zstd", "10:"} {
+		if _, err := ParseCanaries(s); err == nil {
+			t.Errorf("ParseCanaries(%q) succeeded", s)
+		}
+	}
+}
+
+func TestCanaryEnabled(t *testing.T) {
+	small := Canary{Args: []string{"-compress=zstd"}, Percent: 10}
+	large := Canary{Args: small.Args, Percent: 50}
+	other := Canary{Args: []string{"-require_ctags"}, Percent: 10}
+
+	n, nOther, both := 0, 0, 0
+	for i := 0; i < 10000; i++ {
+		repo := fmt.Sprintf("github.com/org/repo%d", i)
+		if small.Enabled(repo) {
+			n++
+			if !large.Enabled(repo) {
+				t.Fatalf("%s is in the 10%% canary, but not in the 50%% one", repo)
+			}
+			if other.Enabled(repo) {
+				both++
+			}
+		}
+		if other.Enabled(repo) {
+			nOther++
+		}
+	}
+	if n < 800 || n > 1200 || nOther < 800 || nOther > 1200 {
+		t.Errorf("got %d and %d of 10000 repos in 10%% canaries", n, nOther)
+	}
+	// Independent canaries overlap in about 1% of the repos.
+	if both > 300 {
+		t.Errorf("%d repos are in both canaries", both)
+	}
+
+	if args := canaryArgs([]Canary{{Args: []string{"-a"}, Percent: 100}, {Args: []string{"-b"}}}, "repo"); !reflect.DeepEqual(args, []string{"-a"}) {
+		t.Errorf("got canary args %v, want [-a]", args)
+	}
+}
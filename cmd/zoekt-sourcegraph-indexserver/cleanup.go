@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/google/zoekt"
+)
+
+var metricOrphanedBytes = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "index_orphaned_bytes_removed_total",
+	Help: "Bytes of build artifacts left behind by interrupted builds that were removed.",
+})
+
+// tempShardRE matches the temporary files of shards being written.
+var tempShardRE = regexp.MustCompile(`\.zoekt[0-9]+$`)
+
+// isBuildArtifact returns whether the file name is left behind by an
+// interrupted build: a temporary shard or metadata file, a checkpoint
+// of finished shards or a downloaded tarball.
+func isBuildArtifact(name string) bool {
+	return tempShardRE.MatchString(name) ||
+		strings.HasSuffix(name, ".tmp") ||
+		strings.HasSuffix(name, ".checkpoint") ||
+		strings.HasPrefix(name, ".download-")
+}
+
+// removeOrphans removes the build artifacts in the index directory dir
+// and its tenant subdirectories that were last modified before cutoff.
+// It returns the number of files and bytes removed.
+func removeOrphans(dir string, cutoff time.Time) (files int, bytes int64, err error) {
+	dirs := []string{dir}
+	tenants, err := filepath.Glob(filepath.Join(dir, zoekt.TenantDirPrefix+"*"))
+	if err != nil {
+		return 0, 0, err
+	}
+	dirs = append(dirs, tenants...)
+
+	for _, d := range dirs {
+		fis, err := ioutil.ReadDir(d)
+		if err != nil {
+			if d == dir {
+				return files, bytes, err
+			}
+			continue
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() || !isBuildArtifact(fi.Name()) || !fi.ModTime().Before(cutoff) {
+				continue
+			}
+			fn := filepath.Join(d, fi.Name())
+			if err := os.Remove(fn); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return files, bytes, err
+			}
+			slog.Debug("removed orphaned build artifact", "file", fn, "modified", fi.ModTime())
+			files++
+			bytes += fi.Size()
+		}
+	}
+	return files, bytes, nil
+}
+
+// cleanupOrphans calls removeOrphans on IndexDir every interval, for
+// artifacts older than OrphanMaxAge.
+func (s *Server) cleanupOrphans(interval time.Duration) {
+	for {
+		files, bytes, err := removeOrphans(s.IndexDir, time.Now().Add(-s.OrphanMaxAge))
+		metricOrphanedBytes.Add(float64(bytes))
+		if err != nil {
+			slog.Error("removing orphaned build artifacts failed", "dir", s.IndexDir, "error", err)
+		}
+		if files > 0 {
+			slog.Info("removed orphaned build artifacts", "dir", s.IndexDir, "files", files, "bytes", bytes)
+		}
+		time.Sleep(interval)
+	}
+}
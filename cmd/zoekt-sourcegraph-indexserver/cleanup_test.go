@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRemoveOrphans(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tenant-acme"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	for fn, mtime := range map[string]time.Time{
+		"repo_v16.00000.zoekt":                  old,
+		"repo_v16.00000.zoekt.meta":             old,
+		"repo_v16.00001.zoekt123":               old,
+		"repo_v16.00000.zoekt.meta.tmp":         old,
+		"repo_v16.checkpoint":                   old,
+		".download-456.tar":                     old,
+		".indexserver-state.json":               old,
+		"tenant-acme/repo_v16.00000.zoekt789":   old,
+		"tenant-acme/repo_v16.00000.zoekt":      old,
+		"building_v16.00000.zoekt123":           now,
+		".download-789.tar":                     now,
+		".indexserver-state.json.12345.tmp":     now,
+		"tenant-acme/building_v16.checkpoint":   now,
+		"tenant-acme/repo_v16.00000.zoekt1.tmp": old,
+	} {
+		fn = filepath.Join(dir, fn)
+		if err := ioutil.WriteFile(fn, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, bytes, err := removeOrphans(dir, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("removeOrphans: %v", err)
+	}
+	if files != 6 || bytes != 6*int64(len("data")) {
+		t.Errorf("removed %d files, %d bytes, want 6 files", files, bytes)
+	}
+
+	var got []string
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(got)
+	want := []string{
+		".download-789.tar",
+		".indexserver-state.json",
+		".indexserver-state.json.12345.tmp",
+		"building_v16.00000.zoekt123",
+		"repo_v16.00000.zoekt",
+		"repo_v16.00000.zoekt.meta",
+		"tenant-acme/building_v16.checkpoint",
+		"tenant-acme/repo_v16.00000.zoekt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
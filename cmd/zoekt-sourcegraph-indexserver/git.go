@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/net/trace"
+
+	"github.com/google/zoekt/gitindex"
+)
+
+// packRatio is roughly how much smaller git packs source code than
+// the files it holds. It turns the size of a clone into a size hint
+// for parallelism.
+const packRatio = 4
+
+// cloneURL returns the URL to clone repo name from Sourcegraph.
+func cloneURL(root *url.URL, name string) string {
+	return root.ResolveReference(&url.URL{Path: fmt.Sprintf("/.internal/git/%s", name)}).String()
+}
+
+// fetchGit brings the bare clone of repo name in GitCacheDir up to
+// date, cloning it first if needed. It returns the directory of the
+// clone and the estimated size of the files it holds.
+func (s *Server) fetchGit(ctx context.Context, tr trace.Trace, name string) (string, int64, error) {
+	dir := gitindex.Path(s.GitCacheDir, name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		tr.LazyPrintf("cloning into %s", dir)
+		// zoekt.name keeps zoekt-git-index from naming the
+		// repository after the Sourcegraph URL it was cloned from.
+		settings := map[string]string{"zoekt.name": name}
+		if err := gitindex.CloneRepoContext(ctx, s.GitCacheDir, name, cloneURL(s.Root, name), settings); err != nil {
+			// Do not fetch into a partial clone.
+			os.RemoveAll(dir)
+			return "", 0, fmt.Errorf("git clone %s: %v", name, err)
+		}
+	} else {
+		cmd := exec.CommandContext(ctx, "git", "-C", dir, "fetch", "--prune", "origin")
+		// Prevent prompting
+		cmd.Stdin = &bytes.Buffer{}
+		if err := s.loggedRun(ctx, tr, cmd); err != nil {
+			return "", 0, err
+		}
+	}
+
+	size, err := dirSize(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	return dir, packRatio * size, nil
+}
+
+// dirSize returns the size of the files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// gitIndexArgs returns the arguments of zoekt-git-index for indexing
+// the Branches of repo name from its clone dir, whose files add up to
+// about size bytes.
+func (s *Server) gitIndexArgs(name, dir string, size int64) []string {
+	args := []string{
+		fmt.Sprintf("-parallelism=%d", s.parallelism(size)),
+		"-index", s.IndexDir,
+		"-file_limit", strconv.Itoa(1 << 20),
+		"-incremental",
+		"-keep_versions", strconv.Itoa(s.KeepVersions),
+		"-ignore", s.Ignore,
+		"-branches", s.Branches,
+		"-allow_missing_branches",
+		"-repo_cache", s.GitCacheDir,
+		// Sourcegraph does not serve submodules of repositories.
+		"-submodules=false",
+	}
+	if s.FileNamesOnly != nil && s.FileNamesOnly.MatchString(name) {
+		args = append(args, "-file_names_only")
+	}
+	args = append(args, canaryArgs(s.Canaries, name)...)
+	return append(args, dir)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/trace"
+
+	"github.com/google/zoekt/gitindex"
+)
+
+func TestFetchGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	origin := t.TempDir()
+	cache := t.TempDir()
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(cmd.Environ(),
+			"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+			"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out.String())
+		}
+		return strings.TrimSpace(out.String())
+	}
+	git(origin, "init", "-q", "-b", "main")
+	git(origin, "commit", "-q", "--allow-empty", "-m", "first")
+
+	// Clone as fetchGit would, from a local origin rather than
+	// Sourcegraph.
+	const name = "github.com/org/repo"
+	if err := gitindex.CloneRepo(cache, name, origin, map[string]string{"zoekt.name": name}); err != nil {
+		t.Fatalf("CloneRepo: %v", err)
+	}
+	git(origin, "commit", "-q", "--allow-empty", "-m", "second")
+	git(origin, "branch", "release-1")
+	head := git(origin, "rev-parse", "HEAD")
+
+	s := &Server{GitCacheDir: cache, CPUCount: 4, Branches: "HEAD,release-*"}
+	tr := trace.New("test", "fetch")
+	defer tr.Finish()
+	dir, size, err := s.fetchGit(context.Background(), tr, name)
+	if err != nil {
+		t.Fatalf("fetchGit: %v", err)
+	}
+	if want := filepath.Join(cache, name+".git"); dir != want {
+		t.Errorf("got dir %s, want %s", dir, want)
+	}
+	if size <= 0 {
+		t.Errorf("got size %d", size)
+	}
+	if got := git(dir, "rev-parse", "HEAD"); got != head {
+		t.Errorf("got HEAD %s after fetch, want %s", got, head)
+	}
+	if got := git(dir, "rev-parse", "release-1"); got != head {
+		t.Errorf("got release-1 %s after fetch, want %s", got, head)
+	}
+	if got := git(dir, "config", "zoekt.name"); got != name {
+		t.Errorf("got zoekt.name %q, want %q", got, name)
+	}
+
+	args := s.gitIndexArgs(name, dir, size)
+	if args[len(args)-1] != dir || args[0] != "-parallelism=1" ||
+		!strings.Contains(strings.Join(args, " "), "-branches HEAD,release-* -allow_missing_branches") {
+		t.Errorf("got args %v", args)
+	}
+}
@@ -4,27 +4,53 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/trace"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
+	"github.com/google/zoekt/gitindex"
+	"github.com/google/zoekt/logging"
+	"github.com/google/zoekt/objstore"
+	"github.com/google/zoekt/tlsconfig"
+	"github.com/google/zoekt/tracing"
 )
 
+var tracer = otel.Tracer("github.com/google/zoekt/cmd/zoekt-sourcegraph-indexserver")
+
+// queueStateFile is the file in the index directory keeping the state
+// of the queue across restarts.
+const queueStateFile = ".indexserver-state.json"
+
 // Server is the main functionality of zoekt-sourcegraph-indexserver. It
 // exists to conveniently use all the options passed in via func main.
 type Server struct {
@@ -38,20 +64,112 @@ type Server struct {
 	// Interval is how often we sync with Sourcegraph.
 	Interval time.Duration
 
-	// CPUCount is the amount of parallelism to use when indexing a
-	// repository.
+	// CPUCount is the most parallelism to use when indexing a
+	// repository. Smaller repositories use less, see parallelism.
 	CPUCount int
 
+	// MaxConcurrentDownloads is the number of repository tarballs
+	// downloaded at the same time. Defaults to 1.
+	MaxConcurrentDownloads int
+
+	// IndexTimeout limits the time to download a repository, and
+	// the time to index it. Builds running longer are killed, so a
+	// hung build does not take a slot forever. Zero means no limit.
+	IndexTimeout time.Duration
+
+	// TombstoneGrace is how long the shards of a repository that is
+	// no longer listed are kept, tombstoned so they are not
+	// searched, before they are deleted. If the repository is listed
+	// again meanwhile, eg. after a bad response from Sourcegraph,
+	// its shards are revived without reindexing. Zero deletes them
+	// right away.
+	TombstoneGrace time.Duration
+
+	// OrphanMaxAge is the age after which temporary files and
+	// tarballs of interrupted builds are removed from IndexDir. It
+	// must exceed IndexTimeout, so running builds keep theirs. Zero
+	// keeps them.
+	OrphanMaxAge time.Duration
+
+	// MaxConcurrentBuilds is the number of downloaded repositories
+	// indexed at the same time, each using up to CPUCount cores.
+	// Defaults to 1.
+	MaxConcurrentBuilds int
+
 	// Debug when true will output extra debug logs.
 	Debug bool
+
+	// KeepVersions is the number of earlier versions of each
+	// repository to keep, for searches pinned to a commit.
+	KeepVersions int
+
+	// Ignore is a comma separated list of gitignore-style patterns
+	// of files not to index, passed to zoekt-archive-index.
+	Ignore string
+
+	// ReadyMaxLag is the longest a repository may wait to be
+	// indexed before /readyz reports the server as not ready. Zero
+	// disables the check.
+	ReadyMaxLag time.Duration
+
+	// FileNamesOnly matches the names of repositories that are
+	// too large to index fully. Only their file names and the
+	// lines defining symbols are indexed.
+	FileNamesOnly *regexp.Regexp
+
+	// Replicas, if set, divides the repositories between several
+	// indexserver replicas. Only the repositories owned by this
+	// replica are indexed, and shards of other repositories are
+	// deleted.
+	Replicas *Replicas
+
+	// Canaries add arguments of zoekt-archive-index for a
+	// percentage of the repositories each.
+	Canaries []Canary
+
+	// GitCacheDir, if set, holds bare clones of the repositories,
+	// named like a gitindex.RepoCache. Repositories are indexed by
+	// fetching into their clone and running zoekt-git-index, rather
+	// than by downloading a tarball of every commit.
+	GitCacheDir string
+
+	// Branches are the comma separated branches or branch patterns
+	// indexed from the clones in GitCacheDir, eg. "HEAD,release-*".
+	// Branches missing from a repository are skipped.
+	Branches string
+
+	// Uploader, if set, uploads the shards to object storage after
+	// every successful build.
+	Uploader *objstore.Uploader
+
+	queue Queue
+
+	semOnce   sync.Once
+	downloads *semaphore
+	builds    *semaphore
+
+	mu sync.Mutex
+	// indexing holds the repositories being indexed by Run.
+	indexing map[string]bool
+
+	// Set to 1 once the list of repositories was fetched from
+	// Sourcegraph. Accessed atomically.
+	listed int32
 }
 
-func (s *Server) loggedRun(tr trace.Trace, cmd *exec.Cmd) error {
+func (s *Server) loggedRun(ctx context.Context, tr trace.Trace, cmd *exec.Cmd) (err error) {
+	_, span := tracer.Start(ctx, "exec "+filepath.Base(cmd.Path), oteltrace.WithAttributes(attribute.StringSlice("args", cmd.Args)))
+	defer func() { tracing.End(span, err) }()
+
 	out := &bytes.Buffer{}
 	errOut := &bytes.Buffer{}
 	cmd.Stdout = out
 	cmd.Stderr = errOut
 
+	if cmd.Cancel != nil {
+		killGroupOnCancel(cmd)
+	}
+
 	tr.LazyPrintf("%s", cmd.Args)
 	if err := cmd.Run(); err != nil {
 		outS := out.String()
@@ -64,28 +182,42 @@ func (s *Server) loggedRun(tr trace.Trace, cmd *exec.Cmd) error {
 			cmd.Args, err, outS, errS)
 	}
 	tr.LazyPrintf("success")
-	if s.Debug {
-		log.Printf("ran successfully %s", cmd.Args)
-	}
+	slog.Debug("ran successfully", "args", cmd.Args)
 	return nil
 }
 
 // Run the sync loop. This blocks forever.
 func (s *Server) Run() {
-	queue := &Queue{}
+	queue := &s.queue
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "index_freshness_max_lag_seconds",
+		Help: "How long the most stale repository has been waiting to be indexed.",
+	}, func() float64 {
+		return queue.MaxLag().Seconds()
+	}))
+
+	if s.OrphanMaxAge > 0 {
+		go s.cleanupOrphans(time.Hour)
+	}
+
+	stateFile := filepath.Join(s.IndexDir, queueStateFile)
+	if err := queue.Load(stateFile); err != nil {
+		slog.Error("loading index queue state failed", "file", stateFile, "error", err)
+	}
 
 	// Start a goroutine which updates the queue with commits to index.
 	go func() {
 		t := time.NewTicker(s.Interval)
 		for {
-			repos, err := listRepos(s.Root)
+			all, err := listRepos(s.Root)
 			if err != nil {
-				log.Println(err)
+				slog.Error("listing repositories failed", "error", err)
 				<-t.C
 				continue
 			}
+			repos := s.Replicas.Filter(all)
 
-			log.Printf("updating index queue with %d repositories", len(repos))
+			slog.Info("updating index queue", "repos", len(repos), "listed", len(all))
 
 			// ResolveRevision is IO bound on the gitserver service. So we do
 			// them concurrently.
@@ -107,65 +239,300 @@ func (s *Server) Run() {
 			}
 			sem.Wait()
 			tr.Finish()
+			atomic.StoreInt32(&s.listed, 1)
 
 			// Only delete shards if we found repositories, to prevent strange
 			// bugs in responses causing us to delete everything.
-			if len(repos) > 0 {
+			if len(all) > 0 {
 				exists := make(map[string]bool)
 				for _, name := range repos {
 					exists[name] = true
 				}
-				s.deleteStaleIndexes(exists)
+				queue.Retain(exists, s.TombstoneGrace)
+				listed := make(map[string]bool)
+				for _, name := range all {
+					listed[name] = true
+				}
+				s.deleteStaleIndexes(exists, listed)
 			}
 
 			<-t.C
 		}
 	}()
 
-	// In the current goroutine process the queue forever.
+	// In the current goroutine process the queue forever. Enough
+	// repositories are in flight to keep all downloads and builds
+	// busy; a downloaded tarball waits for a free build.
+	downloads, builds := s.semaphores()
+	inflight := newSemaphore(cap(downloads.sema) + cap(builds.sema))
 	for {
+		inflight.Acquire()
 		name, commit, ok := queue.Pop()
 		if !ok {
+			inflight.Release()
 			time.Sleep(time.Second)
 			continue
 		}
-
-		err := s.Index(name, commit)
-		if err != nil {
-			log.Printf("error indexing %s@%s: %s", name, commit, err)
+		if !s.startIndexing(name) {
+			// Still indexing an earlier commit. The next sync
+			// queues the repository again.
+			inflight.Release()
 			continue
 		}
-		queue.SetIndexed(name, commit)
+
+		go func(name, commit string) {
+			defer inflight.Release()
+			defer s.doneIndexing(name)
+
+			start := time.Now()
+			if err := s.Index(name, commit); err != nil {
+				backoff := queue.SetFailed(name, commit)
+				slog.Error("indexing failed", "repo", name, "commit", commit, "duration", time.Since(start), "retry_in", backoff, "error", err)
+			} else {
+				slog.Info("indexed", "repo", name, "commit", commit, "duration", time.Since(start))
+				queue.SetIndexed(name, commit)
+			}
+			if err := queue.Save(stateFile); err != nil {
+				slog.Error("saving index queue state failed", "file", stateFile, "error", err)
+			}
+		}(name, commit)
 	}
 }
 
+// withIndexTimeout limits ctx to IndexTimeout, if set.
+func (s *Server) withIndexTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.IndexTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.IndexTimeout)
+}
+
+// cleanBuild removes the temporary files left by a killed build of repo
+// name.
+func (s *Server) cleanBuild(name string) {
+	opts := build.Options{
+		IndexDir:              s.IndexDir,
+		RepositoryDescription: zoekt.Repository{Name: name},
+	}
+	if err := opts.CleanTemporaryFiles(); err != nil {
+		slog.Error("removing temporary files of killed build failed", "repo", name, "error", err)
+	}
+}
+
+// semaphores returns the semaphores limiting concurrent downloads and
+// builds.
+func (s *Server) semaphores() (downloads, builds *semaphore) {
+	s.semOnce.Do(func() {
+		n := s.MaxConcurrentDownloads
+		if n < 1 {
+			n = 1
+		}
+		s.downloads = newSemaphore(n)
+		if n = s.MaxConcurrentBuilds; n < 1 {
+			n = 1
+		}
+		s.builds = newSemaphore(n)
+	})
+	return s.downloads, s.builds
+}
+
+// startIndexing marks repo name as being indexed. It returns false if
+// it already was.
+func (s *Server) startIndexing(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indexing[name] {
+		return false
+	}
+	if s.indexing == nil {
+		s.indexing = map[string]bool{}
+	}
+	s.indexing[name] = true
+	return true
+}
+
+func (s *Server) doneIndexing(name string) {
+	s.mu.Lock()
+	delete(s.indexing, name)
+	s.mu.Unlock()
+}
+
 // Index starts an index job for repo name at commit.
-func (s *Server) Index(name, commit string) error {
+func (s *Server) Index(name, commit string) (err error) {
 	tr := trace.New("index", name)
 	defer tr.Finish()
+	ctx, span := tracer.Start(context.Background(), "index", oteltrace.WithAttributes(
+		attribute.String("repo", name),
+		attribute.String("commit", commit)))
+	defer func() { tracing.End(span, err) }()
 
 	tr.LazyPrintf("commit: %v", commit)
 
+	downloads, builds := s.semaphores()
 	if commit == "" {
-		return s.createEmptyShard(tr, name)
+		builds.Acquire()
+		err = s.createEmptyShard(ctx, tr, name)
+		builds.Release()
+	} else if s.GitCacheDir == "" && s.upToDate(name, commit) {
+		// zoekt-archive-index -incremental would not read the
+		// tarball, so do not download it.
+		tr.LazyPrintf("already indexed")
+	} else {
+		downloads.Acquire()
+		dctx, cancel := s.withIndexTimeout(ctx)
+		var args []string
+		if s.GitCacheDir != "" {
+			var dir string
+			var size int64
+			dir, size, err = s.fetchGit(dctx, tr, name)
+			args = append([]string{"zoekt-git-index"}, s.gitIndexArgs(name, dir, size)...)
+		} else {
+			var archive string
+			var size int64
+			archive, size, err = s.download(dctx, name, commit)
+			if err == nil {
+				defer os.Remove(archive)
+				tr.LazyPrintf("downloaded %d bytes", size)
+			}
+			args = append([]string{"zoekt-archive-index"}, s.indexArgs(name, commit, archive, size)...)
+		}
+		cancel()
+		downloads.Release()
+		if err != nil {
+			return err
+		}
+
+		builds.Acquire()
+		bctx, cancel := s.withIndexTimeout(ctx)
+		cmd := exec.CommandContext(bctx, args[0], args[1:]...)
+		// Prevent prompting
+		cmd.Stdin = &bytes.Buffer{}
+		err = s.loggedRun(bctx, tr, cmd)
+		if bctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("killed after %v: %v", s.IndexTimeout, err)
+			s.cleanBuild(name)
+		}
+		cancel()
+		builds.Release()
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.Uploader != nil {
+		// The shards are built; failing to upload them is no
+		// reason to build them again. The next upload retries.
+		if stats, err := s.Uploader.Sync(ctx); err != nil {
+			tr.LazyPrintf("upload failed: %v", err)
+			slog.Error("uploading shards failed", "repo", name, "error", err)
+		} else {
+			tr.LazyPrintf("uploaded %d shard files", stats.Transferred)
+		}
+	}
+	return nil
+}
+
+// download fetches the tarball of repo name at commit into a temporary
+// file in the index directory, and returns its name and size.
+func (s *Server) download(ctx context.Context, name, commit string) (_ string, _ int64, err error) {
+	_, span := tracer.Start(ctx, "download")
+	defer func() { tracing.End(span, err) }()
+
+	u := tarballURL(s.Root, name, commit)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("failed to download %s: status %s", u, resp.Status)
+	}
+	var r io.Reader = resp.Body
+	if resp.Header.Get("Content-Type") == "application/x-gzip" {
+		if r, err = gzip.NewReader(r); err != nil {
+			return "", 0, err
+		}
+	}
+
+	f, err := ioutil.TempFile(s.IndexDir, ".download-*.tar")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, fmt.Errorf("failed to download %s: %v", u, err)
+	}
+	return f.Name(), size, nil
+}
+
+// bytesPerCore is the size of a repository tarball that warrants
+// another core to index it. zoekt-archive-index builds shards in
+// parallel, so it is the default build.Options.ShardMax.
+const bytesPerCore = 128 << 20
+
+// parallelism returns the number of cores to index a repository whose
+// tarball has size bytes: one per shard it is expected to produce, up
+// to CPUCount. Small repositories use a single core, so they leave the
+// others to concurrent builds.
+func (s *Server) parallelism(size int64) int {
+	n := int((size + bytesPerCore - 1) / bytesPerCore)
+	if n > s.CPUCount {
+		n = s.CPUCount
+	}
+	if n < 1 {
+		n = 1
 	}
+	return n
+}
 
-	cmd := exec.Command("zoekt-archive-index",
-		fmt.Sprintf("-parallelism=%d", s.CPUCount),
+// indexArgs returns the arguments of zoekt-archive-index for indexing
+// repo name at commit from the tarball archive of size bytes.
+func (s *Server) indexArgs(name, commit, archive string, size int64) []string {
+	args := []string{
+		fmt.Sprintf("-parallelism=%d", s.parallelism(size)),
 		"-index", s.IndexDir,
-		"-file_limit", strconv.Itoa(1<<20), // 1 MB; match https://sourcegraph.sgdev.org/github.com/sourcegraph/sourcegraph/-/blob/cmd/symbols/internal/symbols/search.go#L22
+		"-file_limit", strconv.Itoa(1 << 20), // 1 MB; match https://sourcegraph.sgdev.org/github.com/sourcegraph/sourcegraph/-/blob/cmd/symbols/internal/symbols/search.go#L22
 		"-incremental",
+		"-keep_versions", strconv.Itoa(s.KeepVersions),
+		"-ignore", s.Ignore,
 		"-branch", "HEAD",
 		"-commit", commit,
 		"-name", name,
-		tarballURL(s.Root, name, commit))
-	// Prevent prompting
-	cmd.Stdin = &bytes.Buffer{}
-	return s.loggedRun(tr, cmd)
+	}
+	if s.FileNamesOnly != nil && s.FileNamesOnly.MatchString(name) {
+		args = append(args, "-file_names_only")
+	}
+	args = append(args, canaryArgs(s.Canaries, name)...)
+	return append(args, archive)
+}
+
+// upToDate returns whether the shards of repo name hold commit, built
+// with the options zoekt-archive-index would use.
+func (s *Server) upToDate(name, commit string) bool {
+	args := s.indexArgs(name, commit, "-", 0)
+	opts := build.Options{
+		IndexDir:              s.IndexDir,
+		RepositoryDescription: zoekt.Repository{Name: name},
+		FileNamesOnly:         flagValue(args, "file_names_only", true) == "true",
+		ContentCompression:    flagValue(args, "compress", false),
+		PostingEncoding:       flagValue(args, "posting_encoding", false),
+	}
+	want := []zoekt.RepositoryBranch{{Name: "HEAD", Version: commit}}
+	return reflect.DeepEqual(opts.IndexVersions(), want)
 }
 
-func (s *Server) createEmptyShard(tr trace.Trace, name string) error {
-	cmd := exec.Command("zoekt-archive-index",
+func (s *Server) createEmptyShard(ctx context.Context, tr trace.Trace, name string) error {
+	ctx, cancel := s.withIndexTimeout(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "zoekt-archive-index",
 		"-index", s.IndexDir,
 		"-incremental",
 		"-branch", "HEAD",
@@ -175,19 +542,46 @@ func (s *Server) createEmptyShard(tr trace.Trace, name string) error {
 		"-")
 	// Empty archive
 	cmd.Stdin = bytes.NewBuffer(bytes.Repeat([]byte{0}, 1024))
-	return s.loggedRun(tr, cmd)
+	return s.loggedRun(ctx, tr, cmd)
 }
 
-func (s *Server) deleteStaleIndexes(exists map[string]bool) {
+// deleteStaleIndexes tombstones and eventually deletes the shards of
+// repositories not in exists, see deleteIfStale. If their repository
+// is not in listed either, so no replica indexes it any more, deleted
+// shards are deleted from object storage as well; otherwise only
+// the objects this replica uploaded are, see objstore.Uploader. The clones of
+// repositories whose shards were deleted are removed from GitCacheDir.
+func (s *Server) deleteStaleIndexes(exists, listed map[string]bool) {
 	expr := s.IndexDir + "/*"
 	fs, err := filepath.Glob(expr)
 	if err != nil {
-		log.Printf("Glob(%q): %v", expr, err)
+		slog.Error("listing shards failed", "glob", expr, "error", err)
 	}
 
 	for _, f := range fs {
-		if err := deleteIfStale(exists, f); err != nil {
-			log.Printf("deleteIfStale(%q): %v", f, err)
+		repo, err := deleteIfStale(exists, f, s.TombstoneGrace)
+		if err != nil {
+			slog.Error("deleting stale shard failed", "shard", f, "error", err)
+			continue
+		}
+		if repo != "" && s.GitCacheDir != "" {
+			if err := os.RemoveAll(gitindex.Path(s.GitCacheDir, repo)); err != nil {
+				slog.Error("deleting clone of stale repository failed", "repo", repo, "error", err)
+			}
+		}
+		if repo == "" || listed[repo] || s.Uploader == nil {
+			continue
+		}
+		if err := s.Uploader.Remove(context.Background(), f); err != nil {
+			slog.Error("deleting stale shard from bucket failed", "shard", f, "error", err)
+		}
+	}
+
+	// Remove the sidecars of tombstoned shards from the bucket,
+	// and the shards deleted after the grace period.
+	if s.Uploader != nil {
+		if _, err := s.Uploader.Sync(context.Background()); err != nil {
+			slog.Error("uploading shards failed", "error", err)
 		}
 	}
 }
@@ -195,6 +589,7 @@ func (s *Server) deleteStaleIndexes(exists map[string]bool) {
 var repoTmpl = template.Must(template.New("name").Parse(`
 <html><body>
 <a href="debug/requests">Traces</a><br>
+<a href="debug/freshness">Stale repositories</a><br>
 {{.IndexMsg}}<br />
 <br />
 <h3>Re-index repository</h3>
@@ -211,6 +606,22 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		trace.Traces(w, r)
 		return
 	}
+	if r.URL.Path == "/debug/freshness" {
+		s.serveFreshness(w, r)
+		return
+	}
+	if r.URL.Path == "/metrics" {
+		promhttp.Handler().ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/healthz" {
+		w.Write([]byte("OK"))
+		return
+	}
+	if r.URL.Path == "/readyz" {
+		s.serveReadyz(w, r)
+		return
+	}
 
 	var data struct {
 		Repos    []string
@@ -241,10 +652,51 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	data.Repos = s.Replicas.Filter(data.Repos)
 
 	repoTmpl.Execute(w, data)
 }
 
+// serveFreshness lists the repositories whose index lags behind the
+// most, as JSON. The "n" parameter limits the number of repositories
+// (default 100).
+func (s *Server) serveFreshness(w http.ResponseWriter, r *http.Request) {
+	n := 100
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			http.Error(w, "bad n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	type staleRepo struct {
+		StaleRepo
+		LagSeconds float64
+	}
+	stale := []staleRepo{}
+	for _, r := range s.queue.Stale(n) {
+		stale = append(stale, staleRepo{r, r.Lag.Seconds()})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(stale)
+}
+
+// serveReadyz returns 200 OK once the repositories were listed and no
+// repository has waited longer than ReadyMaxLag to be indexed, and 503
+// otherwise.
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.listed) == 0 {
+		http.Error(w, "not ready: repositories not listed yet", http.StatusServiceUnavailable)
+		return
+	}
+	if lag := s.queue.MaxLag(); s.ReadyMaxLag > 0 && lag > s.ReadyMaxLag {
+		http.Error(w, fmt.Sprintf("not ready: index lags %v behind", lag.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
 func listRepos(root *url.URL) ([]string, error) {
 	u := root.ResolveReference(&url.URL{Path: "/.internal/repos/list"})
 	resp, err := http.Post(u.String(), "application/json; charset=utf8", bytes.NewReader([]byte(`{"Enabled": true}`)))
@@ -299,32 +751,51 @@ func tarballURL(root *url.URL, repo, commit string) string {
 	return root.ResolveReference(&url.URL{Path: fmt.Sprintf("/.internal/git/%s/tar/%s", repo, commit)}).String()
 }
 
-// deleteIfStale deletes the shard if its corresponding repo name is not in
-// exists.
-func deleteIfStale(exists map[string]bool, fn string) error {
+// deleteIfStale tombstones the shard if its corresponding repo name is
+// not in exists, and deletes it once it was tombstoned for longer than
+// grace. The time of the tombstone is that of the sidecar metadata. A
+// tombstoned shard whose repo is in exists again is revived. It
+// returns the name of the repo of a deleted shard, or "".
+func deleteIfStale(exists map[string]bool, fn string, grace time.Duration) (string, error) {
 	f, err := os.Open(fn)
 	if err != nil {
-		return nil
+		return "", nil
 	}
 	defer f.Close()
 
 	ifile, err := zoekt.NewIndexFile(f)
 	if err != nil {
-		return nil
+		return "", nil
 	}
 	defer ifile.Close()
 
 	repo, _, err := zoekt.ReadMetadata(ifile)
 	if err != nil {
-		return nil
-	}
-
-	if !exists[repo.Name] {
-		log.Printf("%s no longer exists, deleting %s", repo.Name, fn)
-		return os.Remove(fn)
+		return "", nil
+	}
+
+	switch {
+	case exists[repo.Name] && repo.Tombstone:
+		slog.Info("repository exists again, reviving shard", "repo", repo.Name, "shard", fn)
+		return "", zoekt.UpdateShardMeta(fn, func(r *zoekt.Repository) { r.Tombstone = false })
+	case exists[repo.Name]:
+		return "", nil
+	case !repo.Tombstone && grace > 0:
+		slog.Info("repository no longer exists, tombstoning shard", "repo", repo.Name, "shard", fn, "grace", grace)
+		return "", zoekt.UpdateShardMeta(fn, func(r *zoekt.Repository) { r.Tombstone = true })
+	case repo.Tombstone:
+		fi, err := os.Stat(zoekt.ShardMetaName(fn))
+		if err != nil {
+			return "", err
+		}
+		if time.Since(fi.ModTime()) < grace {
+			return "", nil
+		}
 	}
 
-	return nil
+	slog.Info("repository no longer exists, deleting shard", "repo", repo.Name, "shard", fn)
+	os.Remove(zoekt.ShardMetaName(fn))
+	return repo.Name, os.Remove(fn)
 }
 
 func main() {
@@ -332,12 +803,64 @@ func main() {
 	interval := flag.Duration("interval", 10*time.Minute, "sync with sourcegraph this often")
 	index := flag.String("index", build.DefaultDir, "set index directory to use")
 	listen := flag.String("listen", "", "listen on this address.")
+	tlsCert := flag.String("tls_cert", "", "serve HTTPS with the certificate in this .pem file.")
+	tlsKey := flag.String("tls_key", "", "serve HTTPS with the key in this .pem file.")
+	clientCA := flag.String("client_ca", "", "with -tls_cert, require client certificates signed by a CA in this .pem file.")
 	cpuFraction := flag.Float64("cpu_fraction", 0.25,
 		"use this fraction of the cores for indexing.")
 	debug := flag.Bool("debug", false,
 		"turn on more verbose logging.")
+	keepVersions := flag.Int("keep_versions", 0,
+		"number of earlier versions of each repository to keep, for searches pinned to a commit.")
+	logFormat := flag.String("log_format", "json", "format of logs: json or text.")
+	logLevel := flag.String("log_level", "info", "minimum level of logs: debug, info, warn or error.")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "export traces to this OTLP/HTTP collector, e.g. http://localhost:4318. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT.")
+	ignorePatterns := flag.String("ignore", "",
+		"comma separated gitignore-style patterns of files not to index, in addition to those in the .zoektignore file of each repository.")
+	readyMaxLag := flag.Duration("ready_max_lag", 0,
+		"report not ready on /readyz if a repository waits longer than this to be indexed. 0 disables the check.")
+	fileNamesOnly := flag.String("file_names_only", "",
+		"regular expression matching the names of repositories too large to index fully; only their file names and the lines defining symbols are indexed.")
+	hostname := flag.String("hostname", "",
+		"name of this replica in -replicas. Defaults to the host name.")
+	replicas := flag.String("replicas", "",
+		"comma separated names of all indexserver replicas. Each replica only indexes the repositories it owns by rendezvous hashing.")
+	replica := flag.String("replica", "",
+		"N/M: this is replica N of replicas 0 up to M-1. An alternative to -hostname and -replicas.")
+	bucket := flag.String("bucket", "",
+		"upload the shards to this bucket after every build, e.g. s3://bucket/prefix, gs://bucket/prefix or file:///dir. zoekt-webserver -bucket downloads them.")
+	gitCacheDir := flag.String("git_cache_dir", "",
+		"index repositories by fetching them into bare clones in this directory and running zoekt-git-index, instead of downloading a tarball of every commit.")
+	branches := flag.String("branches", "HEAD",
+		"with -git_cache_dir, comma separated branches to index, eg. HEAD,release-*. Branches may be shell patterns; those missing from a repository are skipped.")
+	canaries := flag.String("canary", "",
+		"comma separated PERCENT:ARGS pairs, eg. 10:-compress=zstd. ARGS, separated by spaces, are passed to zoekt-archive-index for PERCENT of the repositories, chosen by hashing their name.")
+	maxDownloads := flag.Int("max_concurrent_downloads", 2,
+		"number of repository tarballs to download at the same time.")
+	indexTimeout := flag.Duration("index_timeout", 2*time.Hour,
+		"kill downloads and builds of a repository that take longer than this. 0 disables the limit.")
+	tombstoneGrace := flag.Duration("tombstone_grace", 24*time.Hour,
+		"keep the shards of repositories no longer listed by Sourcegraph this long, tombstoned so they are not searched, before deleting them. 0 deletes them right away.")
+	orphanMaxAge := flag.Duration("orphan_max_age", 24*time.Hour,
+		"remove temporary files and tarballs of interrupted builds older than this from -index. Must exceed -index_timeout. 0 keeps them.")
+	maxBuilds := flag.Int("max_concurrent_builds", 1,
+		"number of repositories to index at the same time, each using up to -cpu_fraction of the cores depending on its size.")
+	replicationFactor := flag.Int("replication_factor", 1,
+		"with -replicas or -replica, index each repository on this many replicas, so its shards stay searchable if one is lost. Search them with zoekt-webserver -backends, listing each replica as a partition of its own.")
 	flag.Parse()
 
+	if *debug {
+		*logLevel = "debug"
+	}
+	if err := logging.Init("zoekt-sourcegraph-indexserver", *logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), "zoekt-sourcegraph-indexserver", *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	if *cpuFraction <= 0.0 || *cpuFraction > 1.0 {
 		log.Fatal("cpu_fraction must be between 0.0 and 1.0")
 	}
@@ -369,11 +892,76 @@ func main() {
 		cpuCount = 1
 	}
 	s := &Server{
-		Root:     rootURL,
-		IndexDir: *index,
-		Interval: *interval,
-		CPUCount: cpuCount,
-		Debug:    *debug,
+		Root:         rootURL,
+		IndexDir:     *index,
+		Interval:     *interval,
+		CPUCount:     cpuCount,
+		Debug:        *debug,
+		KeepVersions: *keepVersions,
+		Ignore:       *ignorePatterns,
+		ReadyMaxLag:  *readyMaxLag,
+
+		MaxConcurrentDownloads: *maxDownloads,
+		MaxConcurrentBuilds:    *maxBuilds,
+		IndexTimeout:           *indexTimeout,
+		OrphanMaxAge:           *orphanMaxAge,
+		TombstoneGrace:         *tombstoneGrace,
+		GitCacheDir:            *gitCacheDir,
+		Branches:               *branches,
+	}
+	if s.Branches != "HEAD" && s.GitCacheDir == "" {
+		log.Fatal("-branches requires -git_cache_dir, since tarballs only hold HEAD")
+	}
+	if *fileNamesOnly != "" {
+		re, err := regexp.Compile(*fileNamesOnly)
+		if err != nil {
+			log.Fatalf("file_names_only: %v", err)
+		}
+		s.FileNamesOnly = re
+	}
+	if s.OrphanMaxAge > 0 && (s.IndexTimeout <= 0 || s.OrphanMaxAge <= s.IndexTimeout) {
+		log.Fatal("-orphan_max_age must exceed -index_timeout, so files of running builds are kept")
+	}
+	if s.Canaries, err = ParseCanaries(*canaries); err != nil {
+		log.Fatal(err)
+	}
+	if *replica != "" && *replicas != "" {
+		log.Fatal("set only one of -replica and -replicas")
+	}
+	if *replica != "" {
+		if s.Replicas, err = ParseReplica(*replica); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replicas != "" {
+		if *hostname == "" {
+			if *hostname, err = os.Hostname(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if s.Replicas, err = NewReplicas(*hostname, *replicas); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if s.Replicas != nil {
+		s.Replicas.Factor = *replicationFactor
+	}
+	if *bucket != "" {
+		b, err := objstore.Open(*bucket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Uploader = &objstore.Uploader{Bucket: b, Dir: *index}
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err = tlsconfig.Load(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *clientCA != "" {
+		log.Fatal("-client_ca needs -tls_cert and -tls_key")
 	}
 
 	if *listen != "" {
@@ -381,8 +969,8 @@ func main() {
 			trace.AuthRequest = func(req *http.Request) (any, sensitive bool) {
 				return true, true
 			}
-			log.Printf("serving HTTP on %s", *listen)
-			log.Fatal(http.ListenAndServe(*listen, s))
+			slog.Info("serving", "addr", *listen, "tls", tlsConfig != nil)
+			log.Fatal(tlsconfig.ListenAndServe(*listen, tlsConfig, s))
 		}()
 	}
 
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/trace"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+)
+
+func TestReadyz(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := &Server{ReadyMaxLag: time.Minute}
+	s.queue.now = func() time.Time { return now }
+
+	status := func() int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("before listing: got %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	s.queue.AddOrUpdate("repo", "1")
+	atomic.StoreInt32(&s.listed, 1)
+	if got := status(); got != http.StatusOK {
+		t.Errorf("after listing: got %d, want %d", got, http.StatusOK)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("lagging: got %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	s.queue.SetIndexed("repo", "1")
+	if got := status(); got != http.StatusOK {
+		t.Errorf("after indexing: got %d, want %d", got, http.StatusOK)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("healthz: got %d", w.Code)
+	}
+}
+
+func TestIndexArgsFileNamesOnly(t *testing.T) {
+	root, _ := url.Parse("http://sourcegraph")
+	s := &Server{Root: root, FileNamesOnly: regexp.MustCompile(`^huge/`)}
+
+	has := func(args []string) bool {
+		for _, a := range args {
+			if a == "-file_names_only" {
+				return true
+			}
+		}
+		return false
+	}
+	if !has(s.indexArgs("huge/repo", "abc", "repo.tar", 0)) {
+		t.Errorf("huge/repo is not indexed with -file_names_only")
+	}
+	if has(s.indexArgs("small/repo", "abc", "repo.tar", 0)) {
+		t.Errorf("small/repo is indexed with -file_names_only")
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	b, err := build.NewBuilder(build.Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name:     "repo",
+			Branches: []zoekt.RepositoryBranch{{Name: "HEAD", Version: "abc"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddFile("f", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{IndexDir: dir}
+	if !s.upToDate("repo", "abc") {
+		t.Errorf("repo at abc is not up to date")
+	}
+	if s.upToDate("repo", "def") || s.upToDate("other", "abc") {
+		t.Errorf("other commit or repository is up to date")
+	}
+
+	// A canary changing how the shards are stored rebuilds them.
+	s.Canaries = []Canary{{Args: []string{"-compress", "zstd"}, Percent: 100}}
+	if s.upToDate("repo", "abc") {
+		t.Errorf("repo is up to date for a compression canary")
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	args := []string{"-index", "dir", "-compress=zstd", "--file_names_only", "-posting_encoding", "roaring", "-compress", "", "repo.tar"}
+	for _, tc := range []struct {
+		name   string
+		isBool bool
+		want   string
+	}{
+		{"index", false, "dir"},
+		{"compress", false, ""},
+		{"posting_encoding", false, "roaring"},
+		{"file_names_only", true, "true"},
+		{"require_ctags", true, ""},
+	} {
+		if got := flagValue(args, tc.name, tc.isBool); got != tc.want {
+			t.Errorf("flagValue(%s) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.internal/git/plain/tar/abc":
+			w.Write([]byte("tarball"))
+		case "/.internal/git/gzip/tar/abc":
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write([]byte("tarball"))
+			zw.Close()
+			w.Header().Set("Content-Type", "application/x-gzip")
+			w.Write(buf.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	root, _ := url.Parse(srv.URL)
+	dir := t.TempDir()
+	s := &Server{Root: root, IndexDir: dir}
+
+	for _, repo := range []string{"plain", "gzip"} {
+		fn, size, err := s.download(context.Background(), repo, "abc")
+		if err != nil {
+			t.Fatalf("download %s: %v", repo, err)
+		}
+		if size != int64(len("tarball")) {
+			t.Errorf("download %s: got size %d", repo, size)
+		}
+		if data, err := ioutil.ReadFile(fn); err != nil || string(data) != "tarball" {
+			t.Errorf("download %s: got %q, %v", repo, data, err)
+		}
+		os.Remove(fn)
+	}
+	if _, _, err := s.download(context.Background(), "missing", "abc"); err == nil {
+		t.Errorf("download of missing repo succeeded")
+	}
+	if fs, _ := ioutil.ReadDir(dir); len(fs) != 0 {
+		t.Errorf("left %d files behind", len(fs))
+	}
+}
+
+func TestStartIndexing(t *testing.T) {
+	s := &Server{}
+	if !s.startIndexing("repo") {
+		t.Fatal("startIndexing failed")
+	}
+	if s.startIndexing("repo") {
+		t.Error("repo indexed twice at the same time")
+	}
+	s.doneIndexing("repo")
+	if !s.startIndexing("repo") {
+		t.Error("startIndexing after doneIndexing failed")
+	}
+}
+
+func TestParallelism(t *testing.T) {
+	s := &Server{CPUCount: 8}
+	for size, want := range map[int64]int{
+		0:                  1,
+		1 << 20:            1,
+		bytesPerCore + 1:   2,
+		3 * bytesPerCore:   3,
+		100 * bytesPerCore: 8,
+	} {
+		if got := s.parallelism(size); got != want {
+			t.Errorf("parallelism(%d) = %d, want %d", size, got, want)
+		}
+	}
+}
+
+func TestLoggedRunKillsGroup(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The background sleep inherits the output of the command; it
+	// must be killed too for Run to return.
+	cmd := exec.CommandContext(ctx, "sh", "-c", "sleep 60 & sleep 60")
+	tr := trace.New("test", "kill")
+	defer tr.Finish()
+
+	start := time.Now()
+	if err := (&Server{}).loggedRun(ctx, tr, cmd); err == nil {
+		t.Fatal("loggedRun succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("loggedRun took %v after its timeout", d)
+	}
+}
+
+func TestDeleteIfStale(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "repo"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	fn := filepath.Join(t.TempDir(), "repo_v16.00000.zoekt")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tombstoned := func() bool {
+		t.Helper()
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ifile, err := zoekt.NewIndexFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ifile.Close()
+		repo, _, err := zoekt.ReadMetadata(ifile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo.Tombstone
+	}
+	listed := map[string]bool{"repo": true}
+	unlisted := map[string]bool{"other": true}
+
+	if repo, err := deleteIfStale(listed, fn, time.Hour); err != nil || repo != "" || tombstoned() {
+		t.Fatalf("listed repo: got %q, %v, tombstone %v", repo, err, tombstoned())
+	}
+	if repo, err := deleteIfStale(unlisted, fn, time.Hour); err != nil || repo != "" || !tombstoned() {
+		t.Fatalf("unlisted repo: got %q, %v, tombstone %v, want tombstone", repo, err, tombstoned())
+	}
+	if repo, err := deleteIfStale(unlisted, fn, time.Hour); err != nil || repo != "" {
+		t.Fatalf("unlisted repo within grace: got %q, %v, want it kept", repo, err)
+	}
+	if repo, err := deleteIfStale(listed, fn, time.Hour); err != nil || repo != "" || tombstoned() {
+		t.Fatalf("listed again: got %q, %v, tombstone %v, want revived", repo, err, tombstoned())
+	}
+
+	deleteIfStale(unlisted, fn, time.Hour)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(zoekt.ShardMetaName(fn), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if repo, err := deleteIfStale(unlisted, fn, time.Hour); err != nil || repo != "repo" {
+		t.Fatalf("unlisted repo after grace: got %q, %v, want it deleted", repo, err)
+	}
+	for _, f := range []string{fn, zoekt.ShardMetaName(fn)} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", f, err)
+		}
+	}
+}
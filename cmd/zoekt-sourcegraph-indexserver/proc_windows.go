@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killGroupOnCancel only kills cmd itself once its context is done;
+// there are no process groups to kill.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.WaitDelay = 10 * time.Second
+}
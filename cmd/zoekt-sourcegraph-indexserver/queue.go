@@ -2,9 +2,25 @@ package main
 
 import (
 	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var metricIndexLag = promauto.NewSummary(prometheus.SummaryOpts{
+	Name:       "index_freshness_lag_seconds",
+	Help:       "Time between noticing a new commit for a repository and indexing it.",
+	Objectives: map[float64]float64{0.5: 0.05, 0.95: 0.01},
+})
+
 type queueItem struct {
 	// repoName is the name of the repo
 	repoName string
@@ -17,8 +33,38 @@ type queueItem struct {
 	// not on the heap.
 	heapIdx int
 	// seq is a sequence number used as a tie breaker. This is to ensure we
-	// act like a FIFO queue.
+	// act like a FIFO queue. It is zero if the repo was popped and not
+	// queued again since.
 	seq int64
+	// staleSince is when we first saw latestCommit differ from
+	// indexedCommit. It is zero if the repo is up to date.
+	staleSince time.Time
+	// failures is the number of times in a row indexing latestCommit
+	// failed.
+	failures int
+	// retryAfter is when latestCommit may be indexed again after a
+	// failure. Until then the repo is not added to the heap.
+	retryAfter time.Time
+	// goneSince is when the repo was first missing from the repos
+	// passed to Retain. It is zero if the repo exists.
+	goneSince time.Time
+}
+
+// maxFailureBackoff is the longest a repo that fails to index waits
+// before it is retried.
+const maxFailureBackoff = 6 * time.Hour
+
+// failureBackoff returns how long to wait before retrying a repo that
+// failed to index failures times in a row.
+func failureBackoff(failures int) time.Duration {
+	d := time.Minute
+	for i := 1; i < failures && d < maxFailureBackoff; i++ {
+		d *= 2
+	}
+	if d > maxFailureBackoff {
+		d = maxFailureBackoff
+	}
+	return d
 }
 
 // Queue is a priority queue which returns the next repo to index. It is safe
@@ -35,6 +81,13 @@ type Queue struct {
 	items map[string]*queueItem
 	pq    pqueue
 	seq   int64
+
+	// saveMu serializes Save, so an older state never replaces a
+	// newer one.
+	saveMu sync.Mutex
+
+	// now returns the current time. Defaults to time.Now.
+	now func() time.Time
 }
 
 // Pop returns the repoName and commit of the next repo to index. If the queue
@@ -46,6 +99,7 @@ func (q *Queue) Pop() (repoName string, commit string, ok bool) {
 		return "", "", false
 	}
 	item := heap.Pop(&q.pq).(*queueItem)
+	item.seq = 0
 	repoName = item.repoName
 	commit = item.latestCommit
 	q.mu.Unlock()
@@ -61,17 +115,32 @@ func (q *Queue) Len() int {
 }
 
 // AddOrUpdate sets which commit to index next for repoName. If repoName is
-// already in the queue, it is updated.
+// already in the queue, it is updated. A repo whose latest commit failed to
+// index is not added back until its backoff expired.
 func (q *Queue) AddOrUpdate(repoName, commit string) {
 	q.mu.Lock()
 	item := q.get(repoName)
+	item.goneSince = time.Time{}
+	if commit != item.latestCommit {
+		// A new commit may well index fine.
+		item.failures = 0
+		item.retryAfter = time.Time{}
+	}
 	item.latestCommit = commit
-	if item.heapIdx < 0 {
-		q.seq++
-		item.seq = q.seq
-		heap.Push(&q.pq, item)
-	} else {
+	if commit == item.indexedCommit {
+		item.staleSince = time.Time{}
+	} else if item.staleSince.IsZero() {
+		item.staleSince = q.timeNow()
+	}
+	if item.heapIdx >= 0 {
 		heap.Fix(&q.pq, item.heapIdx)
+	} else if !q.timeNow().Before(item.retryAfter) {
+		// A repo restored by Load keeps its place.
+		if item.seq == 0 {
+			q.seq++
+			item.seq = q.seq
+		}
+		heap.Push(&q.pq, item)
 	}
 	q.mu.Unlock()
 }
@@ -81,6 +150,12 @@ func (q *Queue) SetIndexed(repoName, indexed string) {
 	q.mu.Lock()
 	item := q.get(repoName)
 	item.indexedCommit = indexed
+	item.failures = 0
+	item.retryAfter = time.Time{}
+	if indexed == item.latestCommit && !item.staleSince.IsZero() {
+		metricIndexLag.Observe(q.timeNow().Sub(item.staleSince).Seconds())
+		item.staleSince = time.Time{}
+	}
 	if item.heapIdx >= 0 {
 		// We only update the position in the queue, never add it.
 		heap.Fix(&q.pq, item.heapIdx)
@@ -88,6 +163,216 @@ func (q *Queue) SetIndexed(repoName, indexed string) {
 	q.mu.Unlock()
 }
 
+// SetFailed records that indexing commit of repoName failed. The repo is
+// not retried at that commit before the returned backoff, which doubles
+// with every failure in a row.
+func (q *Queue) SetFailed(repoName, commit string) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item := q.get(repoName)
+	if commit != item.latestCommit {
+		// A newer commit was queued meanwhile; try that instead.
+		return 0
+	}
+	item.failures++
+	backoff := failureBackoff(item.failures)
+	item.retryAfter = q.timeNow().Add(backoff)
+	if item.heapIdx >= 0 {
+		heap.Remove(&q.pq, item.heapIdx)
+	}
+	item.seq = 0
+	return backoff
+}
+
+// Retain removes the repos not in exists from the queue, eg. because
+// they were deleted. Their state is forgotten once they were missing
+// for grace, so a repo that comes back within the tombstone grace
+// period of its shards is not reindexed.
+func (q *Queue) Retain(exists map[string]bool, grace time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.timeNow()
+	for name, item := range q.items {
+		if exists[name] {
+			item.goneSince = time.Time{}
+			continue
+		}
+		if item.heapIdx >= 0 {
+			heap.Remove(&q.pq, item.heapIdx)
+		}
+		item.seq = 0
+		if item.goneSince.IsZero() {
+			item.goneSince = now
+		}
+		if now.Sub(item.goneSince) >= grace {
+			delete(q.items, name)
+		}
+	}
+}
+
+// StaleRepo describes a repository whose index is behind.
+type StaleRepo struct {
+	Name          string
+	IndexedCommit string
+	LatestCommit  string
+	StaleSince    time.Time
+	Lag           time.Duration
+}
+
+// Stale returns up to n repositories that are not indexed at their
+// latest commit, the longest lagging first.
+func (q *Queue) Stale(n int) []StaleRepo {
+	q.mu.Lock()
+	now := q.timeNow()
+	var stale []StaleRepo
+	for _, item := range q.items {
+		if item.staleSince.IsZero() || !item.goneSince.IsZero() {
+			continue
+		}
+		stale = append(stale, StaleRepo{
+			Name:          item.repoName,
+			IndexedCommit: item.indexedCommit,
+			LatestCommit:  item.latestCommit,
+			StaleSince:    item.staleSince,
+			Lag:           now.Sub(item.staleSince),
+		})
+	}
+	q.mu.Unlock()
+
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].Lag != stale[j].Lag {
+			return stale[i].Lag > stale[j].Lag
+		}
+		return stale[i].Name < stale[j].Name
+	})
+	if len(stale) > n {
+		stale = stale[:n]
+	}
+	return stale
+}
+
+// MaxLag returns how long the most stale repository has been waiting
+// to be indexed.
+func (q *Queue) MaxLag() time.Duration {
+	if s := q.Stale(1); len(s) > 0 {
+		return s[0].Lag
+	}
+	return 0
+}
+
+// repoState is the state of a repo kept across restarts by Save.
+type repoState struct {
+	Name          string
+	IndexedCommit string `json:",omitempty"`
+	LatestCommit  string `json:",omitempty"`
+	StaleSince    time.Time
+	Failures      int `json:",omitempty"`
+	RetryAfter    time.Time
+
+	// Seq is the place of the repo in the queue, see queueItem.seq.
+	Seq       int64 `json:",omitempty"`
+	GoneSince time.Time
+}
+
+// queueStateVersion is the version of the file written by Save. Files
+// of other versions are ignored by Load.
+const queueStateVersion = 1
+
+type queueState struct {
+	Version int
+	Repos   []repoState
+}
+
+// Save writes the indexed commit, failure backoff and place in the
+// queue of every repo to fn, so a restarted indexserver neither
+// reindexes everything nor retries failing repos right away, and
+// indexes the repos in the same order. fn is replaced atomically.
+func (q *Queue) Save(fn string) error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	state := queueState{Version: queueStateVersion}
+	q.mu.Lock()
+	for _, item := range q.items {
+		state.Repos = append(state.Repos, repoState{
+			Name:          item.repoName,
+			IndexedCommit: item.indexedCommit,
+			LatestCommit:  item.latestCommit,
+			StaleSince:    item.staleSince,
+			Failures:      item.failures,
+			RetryAfter:    item.retryAfter,
+			Seq:           item.seq,
+			GoneSince:     item.goneSince,
+		})
+	}
+	q.mu.Unlock()
+	sort.Slice(state.Repos, func(i, j int) bool { return state.Repos[i].Name < state.Repos[j].Name })
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// Load restores the state written by Save to fn. The repos are not
+// added to the heap; the next AddOrUpdate does that. A missing file is
+// not an error.
+func (q *Queue) Load(fn string) error {
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state queueState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	if state.Version != queueStateVersion {
+		return fmt.Errorf("%s: unknown version %d", fn, state.Version)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, r := range state.Repos {
+		item := q.get(r.Name)
+		item.indexedCommit = r.IndexedCommit
+		item.latestCommit = r.LatestCommit
+		item.staleSince = r.StaleSince
+		item.failures = r.Failures
+		item.retryAfter = r.RetryAfter
+		item.seq = r.Seq
+		item.goneSince = r.GoneSince
+		if r.Seq > q.seq {
+			q.seq = r.Seq
+		}
+	}
+	return nil
+}
+
+func (q *Queue) timeNow() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
 // get returns the item for repoName. If the repoName hasn't been seen before,
 // it is added to q.items.
 //
@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestQueue(t *testing.T) {
@@ -68,3 +71,158 @@ func TestQueueFIFO(t *testing.T) {
 		t.Fatalf("only popped %d items", want)
 	}
 }
+
+func TestQueueStale(t *testing.T) {
+	now := time.Unix(1000, 0)
+	queue := &Queue{now: func() time.Time { return now }}
+
+	queue.AddOrUpdate("a", "1")
+	queue.SetIndexed("a", "1")
+	queue.AddOrUpdate("b", "1")
+	now = now.Add(time.Minute)
+	queue.AddOrUpdate("c", "1")
+	now = now.Add(time.Minute)
+
+	// Seeing the same commit again doesn't reset the lag.
+	queue.AddOrUpdate("b", "1")
+
+	got := queue.Stale(10)
+	want := []StaleRepo{
+		{Name: "b", LatestCommit: "1", StaleSince: time.Unix(1000, 0), Lag: 2 * time.Minute},
+		{Name: "c", LatestCommit: "1", StaleSince: time.Unix(1060, 0), Lag: time.Minute},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := queue.MaxLag(); got != 2*time.Minute {
+		t.Errorf("got max lag %v, want 2m", got)
+	}
+
+	queue.SetIndexed("b", "1")
+	if got := queue.Stale(10); len(got) != 1 || got[0].Name != "c" {
+		t.Errorf("got %+v, want only c", got)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	queue := &Queue{now: func() time.Time { return now }}
+
+	queue.AddOrUpdate("a", "1")
+	queue.Pop()
+	if got := queue.SetFailed("a", "1"); got != time.Minute {
+		t.Errorf("got backoff %v after 1 failure, want 1m", got)
+	}
+	queue.AddOrUpdate("a", "1")
+	if _, _, ok := queue.Pop(); ok {
+		t.Fatal("failed repo was queued during its backoff")
+	}
+
+	now = now.Add(time.Minute)
+	queue.AddOrUpdate("a", "1")
+	if _, _, ok := queue.Pop(); !ok {
+		t.Fatal("failed repo was not queued after its backoff")
+	}
+	if got := queue.SetFailed("a", "1"); got != 2*time.Minute {
+		t.Errorf("got backoff %v after 2 failures, want 2m", got)
+	}
+
+	// A new commit is tried right away.
+	queue.AddOrUpdate("a", "2")
+	if name, commit, ok := queue.Pop(); !ok || name != "a" || commit != "2" {
+		t.Fatalf("got %s %s %v, want a 2", name, commit, ok)
+	}
+
+	if got := failureBackoff(100); got != maxFailureBackoff {
+		t.Errorf("got backoff %v, want %v", got, maxFailureBackoff)
+	}
+}
+
+func TestQueueSaveLoad(t *testing.T) {
+	now := time.Unix(1000, 0).UTC()
+	fn := filepath.Join(t.TempDir(), queueStateFile)
+
+	queue := &Queue{now: func() time.Time { return now }}
+	for _, name := range []string{"indexed", "stale", "stale2", "failing", "deleted"} {
+		queue.AddOrUpdate(name, "2")
+		queue.SetIndexed(name, "1")
+	}
+	queue.SetIndexed("indexed", "2")
+	queue.SetFailed("failing", "2")
+	queue.Retain(map[string]bool{"indexed": true, "stale": true, "stale2": true, "failing": true}, 0)
+	if err := queue.Save(fn); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	restarted := &Queue{now: func() time.Time { return now }}
+	if err := restarted.Load(fn); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(restarted.Stale(10), queue.Stale(10)) {
+		t.Errorf("got stale %+v, want %+v", restarted.Stale(10), queue.Stale(10))
+	}
+	// The repos are listed in another order after the restart.
+	for _, name := range []string{"failing", "stale2", "stale", "indexed"} {
+		restarted.AddOrUpdate(name, "2")
+	}
+	var popped []string
+	for {
+		name, _, ok := restarted.Pop()
+		if !ok {
+			break
+		}
+		popped = append(popped, name)
+	}
+	// The stale repos come first, in their order before the restart,
+	// the indexed one is queued behind them and the failing one is
+	// still backing off.
+	if want := []string{"stale", "stale2", "indexed"}; !reflect.DeepEqual(popped, want) {
+		t.Errorf("popped %v, want %v", popped, want)
+	}
+
+	if err := (&Queue{}).Load(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("Load of missing file: %v", err)
+	}
+}
+
+func TestQueueRetainGrace(t *testing.T) {
+	now := time.Unix(1000, 0).UTC()
+	fn := filepath.Join(t.TempDir(), queueStateFile)
+	queue := &Queue{now: func() time.Time { return now }}
+	queue.AddOrUpdate("gone", "1")
+	queue.Pop()
+	queue.SetIndexed("gone", "1")
+
+	queue.Retain(map[string]bool{}, time.Hour)
+	if queue.Len() != 0 {
+		t.Errorf("got %d queued, want 0", queue.Len())
+	}
+	if err := queue.Save(fn); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// The state survives a restart within the grace period, so the
+	// repo is not reindexed when it comes back.
+	now = now.Add(30 * time.Minute)
+	queue = &Queue{now: func() time.Time { return now }}
+	if err := queue.Load(fn); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	queue.Retain(map[string]bool{}, time.Hour)
+	queue.AddOrUpdate("gone", "1")
+	if name, _, ok := queue.Pop(); !ok || name != "gone" {
+		t.Fatalf("got %q, %v, want gone", name, ok)
+	}
+	if stale := queue.Stale(1); len(stale) != 0 {
+		t.Errorf("got stale %+v after coming back", stale)
+	}
+
+	// After the grace period it is forgotten.
+	queue.Retain(map[string]bool{}, time.Hour)
+	now = now.Add(time.Hour)
+	queue.Retain(map[string]bool{}, time.Hour)
+	queue.AddOrUpdate("gone", "1")
+	if stale := queue.Stale(1); len(stale) != 1 {
+		t.Errorf("got stale %+v, want the forgotten repo", stale)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Replicas divides the repositories between several indexserver
+// replicas. Each repository is owned by Factor replicas, chosen by
+// rendezvous hashing: adding or removing a replica only moves the
+// repositories owned by that replica.
+type Replicas struct {
+	// Self is the name of this replica. It must be one of Names.
+	Self string
+
+	// Names lists all replicas.
+	Names []string
+
+	// Factor is the number of replicas indexing each repository,
+	// so that its shards stay searchable if a replica is lost. It
+	// defaults to 1.
+	Factor int
+}
+
+// NewReplicas returns the replicas named by hostnames, a comma
+// separated list. self is the name of this replica.
+func NewReplicas(self, hostnames string) (*Replicas, error) {
+	r := &Replicas{Self: self}
+	found := false
+	for _, n := range strings.Split(hostnames, ",") {
+		if n = strings.TrimSpace(n); n == "" {
+			continue
+		}
+		if n == self {
+			found = true
+		}
+		r.Names = append(r.Names, n)
+	}
+	if !found {
+		return nil, fmt.Errorf("hostname %q is not in the list of replicas %q", self, hostnames)
+	}
+	return r, nil
+}
+
+// ParseReplica parses "N/M", meaning replica N of replicas 0 up to
+// M-1.
+func ParseReplica(s string) (*Replicas, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("replica %q: want N/M", s)
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return nil, fmt.Errorf("replica %q: %v", s, err)
+	}
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("replica %q: %v", s, err)
+	}
+	if m < 1 || n < 0 || n >= m {
+		return nil, fmt.Errorf("replica %q: want 0 <= N < M", s)
+	}
+
+	r := &Replicas{Self: strconv.Itoa(n)}
+	for i := 0; i < m; i++ {
+		r.Names = append(r.Names, strconv.Itoa(i))
+	}
+	return r, nil
+}
+
+// weight is the rendezvous hash of repo on replica name.
+func weight(name, repo string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(repo))
+	x := h.Sum64()
+
+	// FNV mixes the last bytes poorly, so finish with the
+	// splitmix64 finalizer.
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Owners returns the names of the replicas that index repo, highest
+// weight first.
+func (r *Replicas) Owners(repo string) []string {
+	weights := make(map[string]uint64, len(r.Names))
+	owners := make([]string, len(r.Names))
+	for i, n := range r.Names {
+		weights[n] = weight(n, repo)
+		owners[i] = n
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return weights[owners[i]] > weights[owners[j]]
+	})
+
+	factor := r.Factor
+	if factor < 1 {
+		factor = 1
+	}
+	if factor < len(owners) {
+		owners = owners[:factor]
+	}
+	return owners
+}
+
+// Owns returns whether this replica indexes repo.
+func (r *Replicas) Owns(repo string) bool {
+	for _, n := range r.Owners(repo) {
+		if n == r.Self {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the repositories in repos owned by this replica. A
+// nil Replicas owns all repositories.
+func (r *Replicas) Filter(repos []string) []string {
+	if r == nil {
+		return repos
+	}
+	var owned []string
+	for _, repo := range repos {
+		if r.Owns(repo) {
+			owned = append(owned, repo)
+		}
+	}
+	return owned
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestReplicasFilter(t *testing.T) {
+	var repos []string
+	for i := 0; i < 1000; i++ {
+		repos = append(repos, fmt.Sprintf("github.com/org/repo%d", i))
+	}
+
+	owners := map[string]string{}
+	for n := 0; n < 3; n++ {
+		r, err := ParseReplica(fmt.Sprintf("%d/3", n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		owned := r.Filter(repos)
+		if len(owned) < 250 || len(owned) > 420 {
+			t.Errorf("replica %d owns %d of %d repos", n, len(owned), len(repos))
+		}
+		for _, repo := range owned {
+			if o, ok := owners[repo]; ok {
+				t.Fatalf("%s owned by %s and %d", repo, o, n)
+			}
+			owners[repo] = r.Self
+		}
+	}
+	if len(owners) != len(repos) {
+		t.Fatalf("got %d owned repos, want %d", len(owners), len(repos))
+	}
+
+	// Adding a replica only moves repositories to the new replica.
+	r, err := ParseReplica("3/4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range repos {
+		if o := r.Owners(repo)[0]; o != "3" && o != owners[repo] {
+			t.Errorf("%s moved from %s to %s", repo, owners[repo], o)
+		}
+	}
+
+	var all *Replicas
+	if got := all.Filter(repos); !reflect.DeepEqual(got, repos) {
+		t.Errorf("nil Replicas filtered repos")
+	}
+}
+
+func TestReplicasFactor(t *testing.T) {
+	r, err := ParseReplica("0/4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Factor = 2
+
+	count := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		repo := fmt.Sprintf("github.com/org/repo%d", i)
+		owners := r.Owners(repo)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("%s: got owners %v, want 2 distinct", repo, owners)
+		}
+		for _, o := range owners {
+			count[o]++
+		}
+		// Replication keeps the primary owner.
+		r.Factor = 1
+		if primary := r.Owners(repo); primary[0] != owners[0] {
+			t.Errorf("%s: primary owner %s, want %s", repo, primary[0], owners[0])
+		}
+		r.Factor = 2
+	}
+	for n, c := range count {
+		if c < 400 || c > 600 {
+			t.Errorf("replica %s owns %d of 1000 repos", n, c)
+		}
+	}
+
+	r.Factor = 10
+	if got := r.Owners("repo"); len(got) != 4 {
+		t.Errorf("got %d owners with a factor above the number of replicas, want 4", len(got))
+	}
+}
+
+func TestNewReplicas(t *testing.T) {
+	r, err := NewReplicas("b", "a, b,c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(r.Names, want) {
+		t.Errorf("got %v, want %v", r.Names, want)
+	}
+	if _, err := NewReplicas("d", "a,b,c"); err == nil {
+		t.Errorf("NewReplicas succeeded for a hostname not in the list")
+	}
+
+	for _, s := range []string{"", "1", "3/3", "-1/2", "a/2", "1/b"} {
+		if _, err := ParseReplica(s); err == nil {
+			t.Errorf("ParseReplica(%q) succeeded", s)
+		}
+	}
+}
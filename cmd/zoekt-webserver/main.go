@@ -17,23 +17,34 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/trace"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
+	"github.com/google/zoekt/client"
+	"github.com/google/zoekt/logging"
+	"github.com/google/zoekt/objstore"
+	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/replicate"
 	"github.com/google/zoekt/shards"
+	"github.com/google/zoekt/tlsconfig"
+	"github.com/google/zoekt/tracing"
 	"github.com/google/zoekt/web"
 )
 
@@ -53,7 +64,7 @@ func divertLogs(dir string, interval time.Duration) {
 			os.Exit(2)
 		}
 
-		log.SetOutput(f)
+		logging.SetOutput(f)
 		last.Close()
 
 		last = f
@@ -70,7 +81,7 @@ func loadTemplates(tpl *template.Template, dir string) error {
 		log.Fatalf("Glob: %v", err)
 	}
 
-	log.Printf("loading templates: %v", fs)
+	slog.Info("loading templates", "files", fs)
 	for _, fn := range fs {
 		content, err := ioutil.ReadFile(fn)
 		if err != nil {
@@ -88,7 +99,7 @@ func loadTemplates(tpl *template.Template, dir string) error {
 
 func writeTemplates(dir string) error {
 	if dir == "" {
-		return fmt.Errorf("must set --template_dir")
+		return fmt.Errorf("must set --html_dir")
 	}
 
 	for k, v := range web.TemplateText {
@@ -100,6 +111,60 @@ func writeTemplates(dir string) error {
 	return nil
 }
 
+// parseBackends parses the -backends flag: partitions separated by
+// commas, each a list of replica addresses separated by |.
+func parseBackends(s string) [][]string {
+	var partitions [][]string
+	for _, p := range strings.Split(s, ",") {
+		var addrs []string
+		for _, a := range strings.Split(p, "|") {
+			if a = strings.TrimSpace(a); a != "" {
+				addrs = append(addrs, a)
+			}
+		}
+		if len(addrs) > 0 {
+			partitions = append(partitions, addrs)
+		}
+	}
+	return partitions
+}
+
+// readBasicAuth reads users for basic authentication from a file
+// with "user:password" lines.
+func readBasicAuth(fn string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]string{}
+	for _, l := range strings.Split(string(content), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.SplitN(l, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: invalid line %q", fn, l)
+		}
+		users[fields[0]] = fields[1]
+	}
+	return users, nil
+}
+
+// readACL reads a JSON object mapping users to the repositories they
+// may search.
+func readACL(fn string) (web.StaticACL, error) {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var acl web.StaticACL
+	if err := json.Unmarshal(content, &acl); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return acl, nil
+}
+
 func main() {
 	logDir := flag.String("log_dir", "", "log to this directory rather than stderr.")
 	logRefresh := flag.Duration("log_refresh", 24*time.Hour, "if using --log_dir, start writing a new file this often.")
@@ -107,18 +172,60 @@ func main() {
 	listen := flag.String("listen", ":6070", "listen on this address.")
 	index := flag.String("index", build.DefaultDir, "set index directory to use")
 	html := flag.Bool("html", true, "enable HTML interface")
-	enableRPC := flag.Bool("rpc", false, "enable go/net RPC")
+	enableRPC := flag.Bool("rpc", false, "enable go/net RPC. Cannot be combined with -acl_file or -tenant_header.")
 	print := flag.Bool("print", false, "enable local result URLs")
+	serveFiles := flag.Bool("serve_files", false, "serve files on /print and /raw/, and link results there for repositories without a file URL template.")
+	highlight := flag.Bool("highlight", false, "color code in results and shown files by language.")
 	enablePprof := flag.Bool("pprof", false, "set to enable remote profiling.")
-	sslCert := flag.String("ssl_cert", "", "set path to SSL .pem holding certificate.")
-	sslKey := flag.String("ssl_key", "", "set path to SSL .pem holding key.")
+	tlsCert := flag.String("tls_cert", "", "serve HTTPS with the certificate in this .pem file.")
+	tlsKey := flag.String("tls_key", "", "serve HTTPS with the key in this .pem file.")
+	clientCA := flag.String("client_ca", "", "with -tls_cert, require client certificates signed by a CA in this .pem file.")
+	flag.StringVar(tlsCert, "ssl_cert", "", "deprecated: use -tls_cert.")
+	flag.StringVar(tlsKey, "ssl_key", "", "deprecated: use -tls_key.")
 	hostCustomization := flag.String(
 		"host_customization", "",
 		"specify host customization, as HOST1=QUERY,HOST2=QUERY")
 
-	templateDir := flag.String("template_dir", "", "set directory from which to load custom .html.tpl template files")
-	dumpTemplates := flag.Bool("dump_templates", false, "dump templates into --template_dir and exit.")
+	htmlDir := flag.String("html_dir", "", "load .html.tpl templates from this directory in place of the built-in ones of the same name, and serve its static/ subdirectory on /static/.")
+	flag.StringVar(htmlDir, "template_dir", "", "deprecated: use -html_dir.")
+	dumpTemplates := flag.Bool("dump_templates", false, "dump templates into --html_dir and exit.")
 	version := flag.Bool("version", false, "Print version number")
+	maxSearches := flag.Int("max_concurrent_searches", 0, "maximum number of searches running in parallel. Defaults to the number of CPUs.")
+	cachePopular := flag.Int("cache_popular_queries", 0, "number of most frequent queries to cache, and recompute in the background after index updates.")
+	cacheResults := flag.Int("cache_results", 0, "number of results of recent queries to cache, until the shards they searched change.")
+	slowQueryThreshold := flag.Duration("slow_query_threshold", 0, "log searches taking longer than this, with the shards that took longest. 0 disables the slow query log.")
+	slowQuerySampleRate := flag.Float64("slow_query_sample_rate", 1, "fraction of slow searches to log.")
+	maxQueued := flag.Int("max_queued_searches", 0, "maximum number of searches waiting to run; further searches fail. 0 means no limit.")
+	maxMatchBytes := flag.Int64("max_match_bytes", 0, "stop a search once its matches hold this many bytes of lines and content. 0 means no limit.")
+	maxCandidateDocs := flag.Int("max_candidate_docs", 0, "stop a search after evaluating this many candidate documents. 0 means no limit.")
+	maxRegexpSize := flag.Int("max_regexp_size", 20000, "fail searches with a regexp that compiles to more than this many instructions. 0 means no limit.")
+	analyticsRate := flag.Float64("analytics_sample_rate", 0, "fraction of search results whose repositories and files are recorded for /api/popularity. 0 disables analytics. Cannot be combined with -acl_file or -tenant_header.")
+	analyticsExclude := flag.String("analytics_exclude", "", "regular expression for repositories that are never recorded by analytics.")
+	basicAuthFile := flag.String("basic_auth_file", "", "require HTTP basic authentication, for the users in this file of user:password lines.")
+	readyMaxAge := flag.Duration("ready_max_age", 0, "report not ready on /readyz if no repository was indexed within this duration. 0 disables the check.")
+	oidcIssuer := flag.String("oidc_issuer", "", "require logging in with this OpenID Connect provider.")
+	oidcClientID := flag.String("oidc_client_id", "", "OAuth2 client ID for --oidc_issuer.")
+	oidcClientSecret := flag.String("oidc_client_secret", "", "OAuth2 client secret for --oidc_issuer.")
+	oidcRedirectURL := flag.String("oidc_redirect_url", "", "URL of this server that --oidc_issuer redirects to after logging in, for example https://zoekt.example.com/oidc/callback.")
+	aclFile := flag.String("acl_file", "", "JSON file mapping users to the repositories they may search; the user \"*\" applies to other users, the repository \"*\" to all repositories.")
+	tenantHeader := flag.String("tenant_header", "", "serve several tenants: take the tenant ID of each request from this HTTP header, which must be set by a trusted proxy, and only search the repositories of that tenant.")
+	rateLimitQPS := flag.Float64("rate_limit_qps", 0, "requests per second each client may make. 0 means no limit.")
+	rateLimitBurst := flag.Int("rate_limit_burst", 10, "requests each client may make at once before --rate_limit_qps applies.")
+	maxConcurrentPerClient := flag.Int("max_concurrent_per_client", 0, "requests each client may have running at once. 0 means no limit.")
+	compress := flag.Bool("compress", true, "compress responses with zstd or gzip for clients that accept it.")
+	accessLog := flag.Bool("access_log", false, "log every request with its method, path, a hash of its query, status and duration.")
+	corsOrigins := flag.String("cors_origins", "", "comma separated web page origins, such as https://tools.example.com, from which browsers may call the JSON API. \"*\" allows any origin, without credentials.")
+	trustForwardedFor := flag.Bool("trust_forwarded_for", false, "identify clients by the X-Forwarded-For header set by a reverse proxy.")
+	serveReplication := flag.Bool("replication", false, "serve the index shards on /replicate/ for zoekt-replicate. With -basic_auth_file, replicas must log in, eg. with a user and password in the URL of their primary. Cannot be combined with -acl_file or -tenant_header.")
+	logStyle := flag.String("log_format", "json", "format of logs: json or text.")
+	logLevel := flag.String("log_level", "info", "minimum level of logs: debug, info, warn or error.")
+	backends := flag.String("backends", "", "search these zoekt-webservers with -rpc instead of a local index, merging their results. Partitions of the index are separated by commas, replicas of a partition by |, e.g. host1:6070|host2:6070,host3:6070. Partitions may overlap, as with zoekt-sourcegraph-indexserver -replication_factor; each repository's matches are then taken from one of them.")
+	hedgeDelay := flag.Duration("hedge_delay", 0, "with -backends, also send a search to another replica of a partition if the first has not answered after this long. 0 disables hedging.")
+	bucket := flag.String("bucket", "", "keep the index directory in sync with the shards in this bucket, e.g. s3://bucket/prefix, gs://bucket/prefix or file:///dir. See zoekt-sourcegraph-indexserver -bucket.")
+	bucketInterval := flag.Duration("bucket_sync_interval", time.Minute, "time between syncs with -bucket.")
+	bucketCacheMB := flag.Int64("bucket_cache_mb", 0, "with -bucket, instead of downloading all shards, fetch those of the repositories named by repo: in a search when first needed, and evict the least recently used to keep at most this many MB. Searches without repo: only search the cached shards. 0 downloads all shards.")
+	bucketMaxFetches := flag.Int("bucket_max_fetches", 100, "with -bucket_cache_mb, the most shards a search fetches. Searches that need more, e.g. because of an -acl_file granting many repositories, only search the cached shards. A negative value means no limit.")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "export traces to this OTLP/HTTP collector, e.g. http://localhost:4318. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT.")
 	flag.Parse()
 
 	if *version {
@@ -127,12 +234,21 @@ func main() {
 	}
 
 	if *dumpTemplates {
-		if err := writeTemplates(*templateDir); err != nil {
+		if err := writeTemplates(*htmlDir); err != nil {
 			log.Fatal(err)
 		}
 		os.Exit(0)
 	}
 
+	if err := logging.Init("zoekt-webserver", *logStyle, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), "zoekt-webserver", *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	if *logDir != "" {
 		if fi, err := os.Lstat(*logDir); err != nil || !fi.IsDir() {
 			log.Fatalf("%s is not a directory", *logDir)
@@ -143,13 +259,41 @@ func main() {
 		go divertLogs(*logDir, *logRefresh)
 	}
 
-	if err := os.MkdirAll(*index, 0755); err != nil {
-		log.Fatal(err)
-	}
+	var searcher zoekt.Searcher
+	if *backends != "" {
+		searcher = client.NewFanout(parseBackends(*backends), &client.FanoutOptions{
+			HedgeDelay: *hedgeDelay,
+		})
+	} else {
+		if err := os.MkdirAll(*index, 0755); err != nil {
+			log.Fatal(err)
+		}
 
-	searcher, err := shards.NewDirectorySearcher(*index)
-	if err != nil {
-		log.Fatal(err)
+		opts := shards.Options{
+			MaxConcurrentSearches: *maxSearches,
+			MaxQueuedSearches:     *maxQueued,
+			CachePopularQueries:   *cachePopular,
+			CacheResults:          *cacheResults,
+			MultiTenant:           *tenantHeader != "",
+			BucketSyncInterval:    *bucketInterval,
+			BucketCacheBytes:      *bucketCacheMB << 20,
+			BucketMaxFetches:      *bucketMaxFetches,
+		}
+		if *bucket != "" {
+			if opts.Bucket, err = objstore.Open(*bucket); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *slowQueryThreshold > 0 {
+			opts.SlowQueries = &shards.SlowQueries{
+				Threshold:  *slowQueryThreshold,
+				SampleRate: *slowQuerySampleRate,
+			}
+		}
+		searcher, err = shards.NewDirectorySearcherWithOptions(*index, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	s := &web.Server{
@@ -158,15 +302,78 @@ func main() {
 		Version:  zoekt.Version,
 	}
 
-	if *templateDir != "" {
-		if err := loadTemplates(s.Top, *templateDir); err != nil {
+	if *htmlDir != "" {
+		if err := loadTemplates(s.Top, *htmlDir); err != nil {
 			log.Fatalf("loadTemplates: %v", err)
 		}
+		if fi, err := os.Stat(filepath.Join(*htmlDir, "static")); err == nil && fi.IsDir() {
+			s.StaticDir = filepath.Join(*htmlDir, "static")
+		}
 	}
 
 	s.Print = *print
+	s.ServeFiles = *serveFiles
+	s.Highlight = *highlight
 	s.HTML = *html
 	s.RPC = *enableRPC
+	s.TenantHeader = *tenantHeader
+	s.MaxMatchBytes = *maxMatchBytes
+	s.MaxCandidateDocs = *maxCandidateDocs
+	s.MaxRegexpSize = *maxRegexpSize
+
+	if *analyticsRate > 0 {
+		s.Analytics = &web.Analytics{SampleRate: *analyticsRate}
+		if *analyticsExclude != "" {
+			re, err := regexp.Compile(*analyticsExclude)
+			if err != nil {
+				log.Fatalf("analytics_exclude: %v", err)
+			}
+			s.Analytics.Exclude = re
+		}
+	}
+
+	if *basicAuthFile != "" && *oidcIssuer != "" {
+		log.Fatal("cannot use both --basic_auth_file and --oidc_issuer")
+	}
+	if *basicAuthFile != "" {
+		users, err := readBasicAuth(*basicAuthFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Auth = &web.BasicAuth{Realm: "zoekt", Users: users}
+	}
+	if *oidcIssuer != "" {
+		s.Auth = &web.OIDC{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  *oidcRedirectURL,
+		}
+	}
+	if *aclFile != "" {
+		acl, err := readACL(*aclFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.ACL = acl
+	}
+
+	if *rateLimitQPS > 0 || *maxConcurrentPerClient > 0 {
+		s.Limits = &web.Limits{
+			QPS:               *rateLimitQPS,
+			Burst:             *rateLimitBurst,
+			MaxConcurrent:     *maxConcurrentPerClient,
+			TrustForwardedFor: *trustForwardedFor,
+		}
+	}
+
+	s.Compress = *compress
+	s.AccessLog = *accessLog
+	for _, o := range strings.Split(*corsOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			s.CORSOrigins = append(s.CORSOrigins, o)
+		}
+	}
 
 	if *hostCustomization != "" {
 		s.HostCustomQueries = map[string]string{}
@@ -183,6 +390,10 @@ func main() {
 		}
 	}
 
+	if *serveReplication {
+		s.Replication = replicate.Handler(*index)
+	}
+
 	handler, err := web.NewMux(s)
 	if err != nil {
 		log.Fatal(err)
@@ -199,31 +410,83 @@ func main() {
 	}
 
 	handler.HandleFunc("/healthz", healthz)
+	handler.HandleFunc("/readyz", readyz(searcher, *readyMaxAge))
+	handler.Handle("/metrics", promhttp.Handler())
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err = tlsconfig.Load(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *clientCA != "" {
+		log.Fatal("-client_ca needs -tls_cert and -tls_key")
+	}
 
 	watchdogAddr := "http://" + *listen
-	if *sslCert != "" || *sslKey != "" {
+	if tlsConfig != nil {
 		watchdogAddr = "https://" + *listen
 	}
-	go watchdog(30*time.Second, watchdogAddr)
-
-	if *sslCert != "" || *sslKey != "" {
-		log.Printf("serving HTTPS on %s", *listen)
-		err = http.ListenAndServeTLS(*listen, *sslCert, *sslKey, handler)
+	if s.Auth != nil {
+		// The watchdog cannot log in.
+		watchdogAddr += "/healthz"
+	}
+	if *clientCA != "" {
+		// The watchdog has no client certificate.
+		slog.Info("client certificates required, disabling watchdog")
 	} else {
-		log.Printf("serving HTTP on %s", *listen)
-		err = http.ListenAndServe(*listen, handler)
+		go watchdog(30*time.Second, watchdogAddr)
 	}
-	log.Printf("ListenAndServe: %v", err)
+
+	slog.Info("serving", "addr", *listen, "tls", tlsConfig != nil)
+	err = tlsconfig.ListenAndServe(*listen, tlsConfig, handler)
+	slog.Error("ListenAndServe failed", "error", err)
 }
 
 // Always returns 200 OK.
-// Used for kubernetes liveness and readiness checks.
+// Used for kubernetes liveness checks.
 // https://kubernetes.io/docs/tasks/configure-pod-container/configure-liveness-readiness-probes/
 func healthz(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Write([]byte("OK"))
 }
 
+// readyz returns the handler for kubernetes readiness checks. It
+// returns 200 OK once shards are loaded and, if maxAge is set, the
+// most recently indexed repository was indexed within maxAge, and
+// 503 otherwise.
+func readyz(searcher zoekt.Searcher, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+		defer cancel()
+
+		// Readiness depends on the shards of all tenants.
+		rl, err := searcher.List(zoekt.WithAllTenants(ctx), &query.Const{Value: true})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		if len(rl.Repos) == 0 {
+			http.Error(w, "not ready: no shards loaded", http.StatusServiceUnavailable)
+			return
+		}
+		if maxAge > 0 {
+			var newest time.Time
+			for _, r := range rl.Repos {
+				if r.IndexMetadata.IndexTime.After(newest) {
+					newest = r.IndexMetadata.IndexTime
+				}
+			}
+			if age := time.Since(newest); age > maxAge {
+				http.Error(w, fmt.Sprintf("not ready: newest shard is %v old", age.Round(time.Second)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("OK"))
+	}
+}
+
 func watchdogOnce(ctx context.Context, client *http.Client, addr string) error {
 	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(30*time.Second))
 	defer cancel()
@@ -18,6 +18,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -31,10 +32,16 @@ import (
 
 const CONTEXT = 20
 
-func displayMatches(files []zoekt.FileMatch, pat string) {
+func displayMatches(w io.Writer, files []zoekt.FileMatch, debugScore bool) {
 	for _, f := range files {
+		if debugScore {
+			fmt.Fprintf(w, "%s: score %f: %s\n", f.FileName, f.Score, f.Debug)
+		}
 		for _, m := range f.LineMatches {
-			fmt.Printf("%s:%d:%s\n", f.FileName, m.LineNumber, m.Line)
+			fmt.Fprintf(w, "%s:%d:%s\n", f.FileName, m.LineNumber, m.Line)
+			if debugScore {
+				fmt.Fprintf(w, "  score %f: %s\n", m.Score, m.Debug)
+			}
 		}
 	}
 }
@@ -65,16 +72,39 @@ func main() {
 	cpuProfile := flag.String("cpu_profile", "", "write cpu profile to `file`")
 	profileTime := flag.Duration("profile_time", time.Second, "run this long to gather stats.")
 	verbose := flag.Bool("v", false, "print some background data")
+	debugScore := flag.Bool("debug_score", false, "explain the score of each match")
+	remote := flag.String("remote", "", "search the zoekt-webserver at this `URL`, e.g. http://localhost:6070, instead of local index files")
+	num := flag.Int("num", 0, "maximum number of files to show. 0 means all of them, or the server default with -remote.")
+	interactive := flag.Bool("i", false, "read queries interactively, keeping the index loaded")
 
 	flag.Usage = func() {
 		name := os.Args[0]
-		fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [option] QUERY\n"+
-			"for example\n\n  %s 'byte file:java -file:test'\n\n", name, name)
+		fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [option] QUERY\n  %s [option] -i\n"+
+			"for example\n\n  %s 'byte file:java -file:test'\n\n", name, name, name)
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n")
 	}
 	flag.Parse()
 
+	if *interactive {
+		r := &repl{remote: *remote, limit: *num, debugScore: *debugScore}
+		if *remote == "" {
+			var err error
+			if *shard != "" {
+				r.searcher, err = loadShard(*shard)
+			} else {
+				r.searcher, err = shards.NewDirectorySearcher(*index)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := r.run(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if len(flag.Args()) == 0 {
 		fmt.Fprintf(os.Stderr, "Pattern is missing.\n")
 		flag.Usage()
@@ -82,6 +112,17 @@ func main() {
 	}
 	pat := flag.Arg(0)
 
+	if *remote != "" {
+		stats, err := searchRemote(context.Background(), *remote, pat, *num, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *verbose {
+			log.Printf("stats: %#v", *stats)
+		}
+		return
+	}
+
 	var searcher zoekt.Searcher
 	var err error
 	if *shard != "" {
@@ -102,7 +143,7 @@ func main() {
 		log.Println("query:", query)
 	}
 
-	var sOpts zoekt.SearchOptions
+	sOpts := zoekt.SearchOptions{DebugScore: *debugScore, MaxDocDisplayCount: *num}
 	sres, err := searcher.Search(context.Background(), query, &sOpts)
 	if *cpuProfile != "" {
 		// If profiling, do it another time so we measure with
@@ -131,7 +172,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	displayMatches(sres.Files, pat)
+	displayMatches(os.Stdout, sres.Files, *debugScore)
 	if *verbose {
 		log.Printf("stats: %#v", sres.Stats)
 	}
@@ -0,0 +1,143 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/web"
+)
+
+// maxEventSize bounds the size of a server-sent event.
+const maxEventSize = 64 << 20
+
+// searchRemote runs pat on the zoekt-webserver at base through its
+// /api/stream endpoint, printing matches to out as they arrive. num
+// limits the number of files; zero uses the default of the server.
+func searchRemote(ctx context.Context, base, pat string, num int, out io.Writer) (*zoekt.Stats, error) {
+	u, err := url.Parse(strings.TrimSuffix(base, "/") + "/api/stream")
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{"q": {pat}}
+	if num > 0 {
+		v.Set("num", strconv.Itoa(num))
+	}
+	u.RawQuery = v.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s: %s: %s", u.Host, resp.Status, bytes.TrimSpace(body))
+	}
+
+	var stats *zoekt.Stats
+	err = readEvents(resp.Body, func(event string, data []byte) error {
+		switch event {
+		case "matches":
+			var m web.StreamMatches
+			if err := json.Unmarshal(data, &m); err != nil {
+				return err
+			}
+			displayRemoteMatches(out, m.FileMatches)
+		case "done":
+			var d web.StreamDone
+			if err := json.Unmarshal(data, &d); err != nil {
+				return err
+			}
+			stats = &d.Stats
+		case "error":
+			var e web.StreamError
+			if err := json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+			if e.Code != "" {
+				return fmt.Errorf("%s: %s", e.Code, e.Error)
+			}
+			return fmt.Errorf("%s", e.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		return nil, fmt.Errorf("%s: stream ended before the search finished", u.Host)
+	}
+	return stats, nil
+}
+
+// readEvents calls f for each server-sent event in r.
+func readEvents(r io.Reader, f func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxEventSize)
+
+	var event string
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event != "" || data != nil {
+				if err := f(event, data); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+	return scanner.Err()
+}
+
+func displayRemoteMatches(out io.Writer, files []*web.FileMatch) {
+	for _, f := range files {
+		for _, m := range f.Matches {
+			var line strings.Builder
+			for _, frag := range m.Fragments {
+				line.WriteString(frag.Pre)
+				line.WriteString(frag.Match)
+				line.WriteString(frag.Post)
+			}
+			fmt.Fprintf(out, "%s:%d:%s\n", f.FileName, m.LineNum, line.String())
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/web"
+	"github.com/google/zoekt/zoekttest"
+)
+
+func TestSearchRemote(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "repo"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, d := range []zoekt.Document{
+		{Name: "a.go", Content: []byte("package a\nfunc water() {}\n")},
+		{Name: "b.go", Content: []byte("drink water\n")},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	mux, err := web.NewMux(&web.Server{
+		Searcher: zoekttest.SearcherForBuilder(t, b),
+		Top:      web.Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var out bytes.Buffer
+	stats, err := searchRemote(context.Background(), ts.URL+"/", "water", 0, &out)
+	if err != nil {
+		t.Fatalf("searchRemote: %v", err)
+	}
+	if stats.FileCount != 2 {
+		t.Errorf("got FileCount %d, want 2", stats.FileCount)
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := map[string]bool{"a.go:2:func water() {}": true, "b.go:1:drink water": true}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %v", got, want)
+	}
+	for _, l := range got {
+		if !want[l] {
+			t.Errorf("unexpected line %q", l)
+		}
+	}
+
+	if _, err := searchRemote(context.Background(), ts.URL, "(", 0, &out); err == nil {
+		t.Errorf("bad query succeeded")
+	}
+}
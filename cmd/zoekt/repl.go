@@ -0,0 +1,230 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/readline"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+const replHelp = `Type a query to search, or a command:
+  :case auto|yes|no   set case sensitivity (default auto)
+  :branch [NAME]      only search branch NAME; no NAME searches all
+  :limit [N]          show at most N files; no N shows all
+  :stats              toggle printing search statistics
+  :settings           show the current settings
+  :help               show this help
+  :quit               leave (also Ctrl-D)
+`
+
+// repl is an interactive session. Either searcher or remote is set.
+type repl struct {
+	searcher zoekt.Searcher
+	remote   string
+	out      io.Writer
+
+	debugScore bool
+
+	caseMode string
+	branch   string
+	limit    int
+	stats    bool
+}
+
+// query returns the query string for input with the toggles applied.
+func (r *repl) query(input string) string {
+	var prefix []string
+	if r.caseMode != "" && r.caseMode != "auto" {
+		prefix = append(prefix, "case:"+r.caseMode)
+	}
+	if r.branch != "" {
+		prefix = append(prefix, "branch:"+r.branch)
+	}
+	if len(prefix) == 0 {
+		return input
+	}
+	return strings.Join(prefix, " ") + " (" + input + ")"
+}
+
+// search runs input and prints the matches.
+func (r *repl) search(ctx context.Context, input string) error {
+	qStr := r.query(input)
+	if r.remote != "" {
+		stats, err := searchRemote(ctx, r.remote, qStr, r.limit, r.out)
+		if err != nil {
+			return err
+		}
+		r.printStats(stats)
+		return nil
+	}
+
+	q, err := query.Parse(qStr)
+	if err != nil {
+		return err
+	}
+	opts := zoekt.SearchOptions{
+		DebugScore:         r.debugScore,
+		MaxDocDisplayCount: r.limit,
+	}
+	sres, err := r.searcher.Search(ctx, q, &opts)
+	if err != nil {
+		return err
+	}
+	displayMatches(r.out, sres.Files, r.debugScore)
+	r.printStats(&sres.Stats)
+	return nil
+}
+
+func (r *repl) printStats(stats *zoekt.Stats) {
+	if r.stats {
+		fmt.Fprintf(r.out, "%d files, %d matches in %v\n", stats.FileCount, stats.MatchCount, stats.Duration)
+	}
+}
+
+// command runs a command line starting with ':'. It returns true if
+// the session should end.
+func (r *repl) command(line string) (bool, error) {
+	fields := strings.Fields(strings.TrimPrefix(line, ":"))
+	if len(fields) == 0 {
+		return false, fmt.Errorf("empty command; try :help")
+	}
+	args := fields[1:]
+	switch fields[0] {
+	case "quit", "q", "exit":
+		return true, nil
+	case "help", "h", "?":
+		fmt.Fprint(r.out, replHelp)
+		return false, nil
+	case "case":
+		if len(args) != 1 || (args[0] != "auto" && args[0] != "yes" && args[0] != "no") {
+			return false, fmt.Errorf("usage: :case auto|yes|no")
+		}
+		r.caseMode = args[0]
+	case "branch":
+		if len(args) > 1 {
+			return false, fmt.Errorf("usage: :branch [NAME]")
+		}
+		r.branch = strings.Join(args, "")
+	case "limit":
+		if len(args) > 1 {
+			return false, fmt.Errorf("usage: :limit [N]")
+		}
+		r.limit = 0
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return false, fmt.Errorf("invalid limit %q", args[0])
+			}
+			r.limit = n
+		}
+	case "stats":
+		r.stats = !r.stats
+	case "settings":
+	default:
+		return false, fmt.Errorf("unknown command %q; try :help", fields[0])
+	}
+	r.printSettings()
+	return false, nil
+}
+
+func (r *repl) printSettings() {
+	caseMode := r.caseMode
+	if caseMode == "" {
+		caseMode = "auto"
+	}
+	branch := r.branch
+	if branch == "" {
+		branch = "(all)"
+	}
+	limit := "(none)"
+	if r.limit > 0 {
+		limit = strconv.Itoa(r.limit)
+	}
+	fmt.Fprintf(r.out, "case: %s, branch: %s, limit: %s, stats: %v\n", caseMode, branch, limit, r.stats)
+}
+
+// handle processes one line of input. It returns true if the session
+// should end.
+func (r *repl) handle(ctx context.Context, line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "":
+		return false, nil
+	case strings.HasPrefix(line, ":"):
+		return r.command(line)
+	}
+	return false, r.search(ctx, line)
+}
+
+// run reads input with a readline prompt until the user quits. The
+// history is kept in ~/.zoekt_history. Ctrl-C cancels a running
+// search, or clears the line at the prompt.
+func (r *repl) run() error {
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          "zoekt> ",
+		HistoryFile:     filepath.Join(os.Getenv("HOME"), ".zoekt_history"),
+		InterruptPrompt: "^C",
+		EOFPrompt:       "",
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	r.out = rl.Stdout()
+
+	fmt.Fprintf(r.out, "Type :help for commands.\n")
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			continue
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			select {
+			case <-sig:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		quit, err := r.handle(ctx, line)
+		signal.Stop(sig)
+		cancel()
+
+		if err != nil {
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/zoekttest"
+)
+
+func TestREPL(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "repo"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, d := range []zoekt.Document{
+		{Name: "a.go", Content: []byte("Water\n")},
+		{Name: "b.go", Content: []byte("water\n")},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	var out bytes.Buffer
+	r := &repl{searcher: zoekttest.SearcherForBuilder(t, b), out: &out}
+
+	lines := func(input string) []string {
+		out.Reset()
+		quit, err := r.handle(context.Background(), input)
+		if err != nil || quit {
+			t.Fatalf("handle(%q): %v, %v", input, quit, err)
+		}
+		return strings.Split(strings.TrimSpace(out.String()), "\n")
+	}
+
+	if got := lines("water"); len(got) != 2 {
+		t.Errorf("case auto: got %q", got)
+	}
+	lines(":case yes")
+	if got := lines("water"); len(got) != 1 || got[0] != "b.go:1:water" {
+		t.Errorf("case yes: got %q", got)
+	}
+	lines(":case no")
+	lines(":limit 1")
+	if got := lines("water"); len(got) != 1 {
+		t.Errorf("limit 1: got %q", got)
+	}
+
+	lines(":branch main")
+	if got, want := r.query("water or fire"), "case:no branch:main (water or fire)"; got != want {
+		t.Errorf("got query %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{":case maybe", ":limit x", ":frobnicate", "("} {
+		if _, err := r.handle(context.Background(), bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+	if quit, err := r.handle(context.Background(), ":quit"); !quit || err != nil {
+		t.Errorf(":quit: got %v, %v", quit, err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ContentCompressionZstd is the IndexMetadata.ContentCompression of
+// shards whose file contents are compressed with zstd, each file on
+// its own.
+const ContentCompressionZstd = "zstd"
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns the encoder and decoder shared by all shards.
+// Both are safe for concurrent use through EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compressContent compresses the content of a file.
+func compressContent(content []byte) ([]byte, error) {
+	enc, _, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(content, nil), nil
+}
+
+// decompressContent decompresses the content of a file, which is sz
+// bytes long.
+func decompressContent(blob []byte, sz uint32) ([]byte, error) {
+	_, dec, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dec.DecodeAll(blob, make([]byte, 0, sz))
+	if err != nil {
+		return nil, Errorf(CodeShardCorrupt, "decompressing content: %v", err)
+	}
+	if uint32(len(data)) != sz {
+		return nil, Errorf(CodeShardCorrupt, "decompressed content has %d bytes, want %d", len(data), sz)
+	}
+	return data, nil
+}
+
+// checkContentCompression returns an error if c is not a supported
+// content compression.
+func checkContentCompression(c string) error {
+	switch c {
+	case "", ContentCompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown content compression %q, want %q or none", c, ContentCompressionZstd)
+}
@@ -15,9 +15,10 @@
 package zoekt
 
 import (
-	"bytes"
+	"fmt"
 	"log"
 	"sort"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -87,6 +88,25 @@ func (p *contentProvider) data(fileName bool) []byte {
 	return p._data
 }
 
+// wordMatch returns whether m starts and ends at word boundaries,
+// using the same definition as \b in regular expressions.
+func (p *contentProvider) wordMatch(m *candidateMatch) bool {
+	data := p.data(m.fileName)
+	return wordBoundary(data, m.byteOffset) && wordBoundary(data, m.byteOffset+m.byteMatchSz)
+}
+
+// wordBoundary returns whether there is an ASCII word boundary at
+// data[off].
+func wordBoundary(data []byte, off uint32) bool {
+	before := off > 0 && isWordByte(data[off-1])
+	after := off < uint32(len(data)) && isWordByte(data[off])
+	return before != after
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
 // Find offset in bytes (relative to corpus start) for an offset in
 // runes (relative to document start). If filename is set, the corpus
 // is the set of filenames, with the document being the name itself.
@@ -116,6 +136,18 @@ func (p *contentProvider) findOffset(filename bool, r uint32) uint32 {
 
 	if filename {
 		data = p.id.fileNameContent[byteOff:]
+	} else if p.id.compressedBoundaries != nil {
+		// Only this file is decompressed, so walk from its
+		// start if the sample lies in an earlier file.
+		if byteOff < fileStartByte {
+			byteOff = fileStartByte
+			left = r
+		}
+		data = p.data(false)
+		if p.err != nil {
+			return 0
+		}
+		data = data[byteOff-fileStartByte:]
 	} else {
 		data, p.err = p.id.readContentSlice(byteOff, 3*runeOffsetFrequency)
 		if p.err != nil {
@@ -133,7 +165,7 @@ func (p *contentProvider) findOffset(filename bool, r uint32) uint32 {
 	return byteOff
 }
 
-func (p *contentProvider) fillMatches(ms []*candidateMatch) []LineMatch {
+func (p *contentProvider) fillMatches(ms []*candidateMatch, weights *ScoreWeights, debug bool) []LineMatch {
 	var result []LineMatch
 	if ms[0].fileName {
 		// There is only "line" in a filename.
@@ -143,11 +175,11 @@ func (p *contentProvider) fillMatches(ms []*candidateMatch) []LineMatch {
 		}
 
 		for _, m := range ms {
-			res.LineFragments = append(res.LineFragments, LineFragmentMatch{
+			res.LineFragments = append(res.LineFragments, runeFragment(res.Line, 0, LineFragmentMatch{
 				LineOffset:  int(m.byteOffset),
 				MatchLength: int(m.byteMatchSz),
 				Offset:      m.byteOffset,
-			})
+			}))
 
 			result = []LineMatch{res}
 		}
@@ -155,9 +187,14 @@ func (p *contentProvider) fillMatches(ms []*candidateMatch) []LineMatch {
 		result = p.fillContentMatches(ms)
 	}
 
-	sects := p.docSections()
+	// Symbol sections refer to the content, so they don't apply
+	// to file name matches.
+	var sects []DocumentSection
+	if !ms[0].fileName {
+		sects = p.docSections()
+	}
 	for i, m := range result {
-		result[i].Score = matchScore(sects, &m)
+		result[i].Score, result[i].Debug = matchScore(sects, &m, weights, debug)
 	}
 
 	return result
@@ -197,14 +234,14 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch) []LineMatch {
 		// Due to merging matches, we may have a match that
 		// crosses a line boundary. Prevent confusion by
 		// taking lines until we pass the last match
-		for lineEnd < len(data) && endMatch > uint32(lineEnd) {
-			next := bytes.IndexByte(data[lineEnd+1:], '\n')
-			if next == -1 {
-				lineEnd = len(data)
-			} else {
-				// TODO(hanwen): test that checks "+1" part here.
-				lineEnd += next + 1
-			}
+		if lineEnd < len(data) && endMatch > uint32(lineEnd) {
+			_, _, lineEnd = (&candidateMatch{byteOffset: endMatch - 1}).line(p.newlines(), p.fileSize)
+		}
+
+		// Leave the "\r" of "\r\n" out of the line, unless it
+		// was matched.
+		if e := trimCR(data, lineEnd); uint32(e) >= endMatch {
+			lineEnd = e
 		}
 
 		finalMatch := LineMatch{
@@ -215,11 +252,11 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch) []LineMatch {
 		finalMatch.Line = p.data(false)[lineStart:lineEnd]
 
 		for _, m := range lineCands {
-			fragment := LineFragmentMatch{
+			fragment := runeFragment(data, lineStart, LineFragmentMatch{
 				Offset:      m.byteOffset,
 				LineOffset:  int(m.byteOffset) - lineStart,
 				MatchLength: int(m.byteMatchSz),
-			}
+			})
 			finalMatch.LineFragments = append(finalMatch.LineFragments, fragment)
 		}
 		result = append(result, finalMatch)
@@ -227,6 +264,128 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch) []LineMatch {
 	return result
 }
 
+// runeFragment fills in the rune counts of f, a match in data on the
+// line starting at lineStart.
+func runeFragment(data []byte, lineStart int, f LineFragmentMatch) LineFragmentMatch {
+	f.Column = utf8.RuneCount(data[lineStart:f.Offset]) + 1
+	f.MatchRunes = utf8.RuneCount(data[f.Offset : int(f.Offset)+f.MatchLength])
+	return f
+}
+
+// fillChunkMatches groups line matches, which must be in file
+// order, into chunks of consecutive lines, adding numContextLines
+// lines of context around each match.
+func (p *contentProvider) fillChunkMatches(lms []LineMatch, numContextLines int) []ChunkMatch {
+	if len(lms) == 0 {
+		return nil
+	}
+	if lms[0].FileName {
+		name := lms[0].Line
+		cm := ChunkMatch{
+			Content:      name,
+			ContentStart: Location{LineNumber: 1, Column: 1},
+			FileName:     true,
+			Score:        lms[0].Score,
+		}
+		for _, f := range lms[0].LineFragments {
+			end := f.Offset + uint32(f.MatchLength)
+			cm.Ranges = append(cm.Ranges, Range{
+				Start: Location{ByteOffset: f.Offset, LineNumber: 1, Column: uint32(utf8.RuneCount(name[:f.Offset])) + 1},
+				End:   Location{ByteOffset: end, LineNumber: 1, Column: uint32(utf8.RuneCount(name[:end])) + 1},
+			})
+		}
+		return []ChunkMatch{cm}
+	}
+
+	data := p.data(false)
+	nls := p.newlines()
+	lineStart := func(n int) int {
+		if n <= 1 {
+			return 0
+		}
+		return int(nls[n-2]) + 1
+	}
+	lineEnd := func(n int) int {
+		if n-1 < len(nls) {
+			return trimCR(data, int(nls[n-1]))
+		}
+		return len(data)
+	}
+	numLines := len(nls) + 1
+	if len(nls) > 0 && int(nls[len(nls)-1]) == len(data)-1 {
+		numLines--
+	}
+
+	var result []ChunkMatch
+	var firstLine, lastLine int
+	finish := func() {
+		cm := &result[len(result)-1]
+		cm.Content = data[lineStart(firstLine):lineEnd(lastLine)]
+	}
+	for _, lm := range lms {
+		first := lm.LineNumber - numContextLines
+		if first < 1 {
+			first = 1
+		}
+		last := int(p.location(uint32(lm.LineEnd)).LineNumber) + numContextLines
+		if last > numLines {
+			last = numLines
+		}
+
+		if len(result) == 0 || first > lastLine+1 {
+			if len(result) > 0 {
+				finish()
+			}
+			firstLine = first
+			result = append(result, ChunkMatch{
+				ContentStart: p.location(uint32(lineStart(first))),
+			})
+		}
+		if last > lastLine {
+			lastLine = last
+		}
+
+		cm := &result[len(result)-1]
+		for _, f := range lm.LineFragments {
+			cm.Ranges = append(cm.Ranges, Range{
+				Start: p.location(f.Offset),
+				End:   p.location(f.Offset + uint32(f.MatchLength)),
+			})
+		}
+		if lm.Score > cm.Score {
+			cm.Score = lm.Score
+		}
+	}
+	finish()
+	return result
+}
+
+// trimCR returns the end of the line terminated at offset nl, leaving
+// out the "\r" of a "\r\n" terminator.
+func trimCR(data []byte, nl int) int {
+	if nl > 0 && nl < len(data) && data[nl] == '\n' && data[nl-1] == '\r' {
+		return nl - 1
+	}
+	return nl
+}
+
+// location returns the position of a byte offset in the document.
+func (p *contentProvider) location(off uint32) Location {
+	nls := p.newlines()
+	idx := sort.Search(len(nls), func(i int) bool {
+		return nls[i] >= off
+	})
+	start := uint32(0)
+	if idx > 0 {
+		start = nls[idx-1] + 1
+	}
+	return Location{
+		ByteOffset: off,
+		LineNumber: uint32(idx + 1),
+		Column:     uint32(utf8.RuneCount(p.data(false)[start:off])) + 1,
+	}
+}
+
 const (
 	// TODO - how to scale this relative to rank?
 	scorePartialWordMatch   = 50.0
@@ -236,6 +395,8 @@ const (
 	scoreSymbol             = 7000.0
 	scoreFactorAtomMatch    = 400.0
 	scoreShardRankFactor    = 20.0
+	scoreDocRankFactor      = 100.0
+	scoreCategoryPenalty    = 1000.0
 	scoreFileOrderFactor    = 10.0
 	scoreLineOrderFactor    = 1.0
 )
@@ -255,9 +416,13 @@ func findSection(secs []DocumentSection, off, sz uint32) *DocumentSection {
 	return nil
 }
 
-func matchScore(secs []DocumentSection, m *LineMatch) float64 {
+// matchScore returns the score of the best fragment of a line, and
+// if debug is set, its breakdown.
+func matchScore(secs []DocumentSection, m *LineMatch, weights *ScoreWeights, debug bool) (float64, string) {
 	var maxScore float64
+	var maxWhat []string
 	for _, f := range m.LineFragments {
+		var what []string
 		startBoundary := f.LineOffset < len(m.Line) && (f.LineOffset == 0 || byteClass(m.Line[f.LineOffset-1]) != byteClass(m.Line[f.LineOffset]))
 
 		end := int(f.LineOffset) + f.MatchLength
@@ -266,46 +431,111 @@ func matchScore(secs []DocumentSection, m *LineMatch) float64 {
 		score := 0.0
 		if startBoundary && endBoundary {
 			score = scoreWordMatch
+			if debug {
+				what = append(what, fmt.Sprintf("word:%f", score))
+			}
 		} else if startBoundary || endBoundary {
 			score = scorePartialWordMatch
+			if debug {
+				what = append(what, fmt.Sprintf("partial-word:%f", score))
+			}
 		}
 
 		sec := findSection(secs, f.Offset, uint32(f.MatchLength))
 		if sec != nil {
 			startMatch := sec.Start == f.Offset
 			endMatch := sec.End == f.Offset+uint32(f.MatchLength)
+			var sym float64
 			if startMatch && endMatch {
-				score += scoreSymbol
+				sym = weights.Symbol * scoreSymbol
 			} else if startMatch || endMatch {
-				score += (scoreSymbol + scorePartialSymbol) / 2
+				sym = weights.Symbol * (scoreSymbol + scorePartialSymbol) / 2
 			} else {
-				score += scorePartialSymbol
+				sym = weights.Symbol * scorePartialSymbol
+			}
+			score += sym
+			if debug {
+				what = append(what, fmt.Sprintf("symbol:%f", sym))
+			}
+		}
+		if m.FileName {
+			score *= weights.FileName
+			if debug {
+				what = append(what, fmt.Sprintf("filename-weight:%f", weights.FileName))
 			}
 		}
 		if score > maxScore {
 			maxScore = score
+			maxWhat = what
 		}
 	}
-	return maxScore
+	if !debug {
+		return maxScore, ""
+	}
+	return maxScore, strings.Join(maxWhat, ", ")
 }
 
+type chunkScoreSlice []ChunkMatch
+
+func (m chunkScoreSlice) Len() int           { return len(m) }
+func (m chunkScoreSlice) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m chunkScoreSlice) Less(i, j int) bool { return m[i].Score > m[j].Score }
+
 type matchScoreSlice []LineMatch
 
 func (m matchScoreSlice) Len() int           { return len(m) }
 func (m matchScoreSlice) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
 func (m matchScoreSlice) Less(i, j int) bool { return m[i].Score > m[j].Score }
 
-type fileMatchSlice []FileMatch
+type fileMatchSlice struct {
+	files []FileMatch
+	order SortOrder
+}
 
-func (m fileMatchSlice) Len() int           { return len(m) }
-func (m fileMatchSlice) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
-func (m fileMatchSlice) Less(i, j int) bool { return m[i].Score > m[j].Score }
+func (m fileMatchSlice) Len() int      { return len(m.files) }
+func (m fileMatchSlice) Swap(i, j int) { m.files[i], m.files[j] = m.files[j], m.files[i] }
+func (m fileMatchSlice) Less(i, j int) bool {
+	return m.order.less(&m.files[i], &m.files[j])
+}
+
+// less orders files by o. Ties are broken by repository and file
+// name, so the order is the same for every search, which pagination
+// relies on.
+func (o SortOrder) less(a, b *FileMatch) bool {
+	switch o {
+	case SortByPath:
+		if a.FileName != b.FileName {
+			return a.FileName < b.FileName
+		}
+	case SortByModTime:
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.After(b.ModTime)
+		}
+	case SortByScore:
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+	}
+	if a.Repository != b.Repository {
+		return a.Repository < b.Repository
+	}
+	return a.FileName < b.FileName
+}
 
 func sortMatchesByScore(ms []LineMatch) {
 	sort.Sort(matchScoreSlice(ms))
 }
 
+func sortChunksByScore(ms []ChunkMatch) {
+	sort.Sort(chunkScoreSlice(ms))
+}
+
 // Sort a slice of results.
 func SortFilesByScore(ms []FileMatch) {
-	sort.Sort(fileMatchSlice(ms))
+	SortFiles(ms, SortByScore)
+}
+
+// SortFiles sorts results in the given order.
+func SortFiles(ms []FileMatch, order SortOrder) {
+	sort.Sort(fileMatchSlice{ms, order})
 }
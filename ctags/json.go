@@ -23,13 +23,78 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const debug = false
 
+// ParserOptions configures a Parser.
+type ParserOptions struct {
+	// Bin is the universal-ctags binary. It must support the JSON
+	// protocol of --_interactive.
+	Bin string
+
+	// Sandbox restricts the ctags processes, for parsing
+	// untrusted code: ctags confines itself with seccomp, and on
+	// Linux the processes run in new user, network and IPC
+	// namespaces.
+	Sandbox bool
+
+	// LanguageMap maps file name patterns to the ctags language
+	// of matching files, eg. ".pyx" => "Python" or "(BUILD)" =>
+	// "Python". It adds to the built-in map of ctags.
+	LanguageMap map[string]string
+
+	// Processes is the number of ctags processes, which bounds the
+	// number of files parsed concurrently. The default is 1.
+	Processes int
+
+	// Timeout bounds the time to parse a single file. If it is
+	// exceeded, the process is killed and restarted. The default
+	// is 5 seconds.
+	Timeout time.Duration
+}
+
+// ParseLanguageMap parses a comma separated list of pattern=language
+// pairs, eg. ".pyx=Python,(BUILD)=Python", for
+// ParserOptions.LanguageMap.
+func ParseLanguageMap(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		i := strings.LastIndex(kv, "=")
+		if i <= 0 || i == len(kv)-1 {
+			return nil, fmt.Errorf("language map entry %q: want pattern=language", kv)
+		}
+		m[kv[:i]] = kv[i+1:]
+	}
+	return m, nil
+}
+
+// args returns the command line of a ctags process.
+func (o *ParserOptions) args() []string {
+	mode := "default"
+	if o.Sandbox {
+		mode = "sandbox"
+	}
+	args := []string{"--_interactive=" + mode, "--fields=*"}
+
+	var patterns []string
+	for p := range o.LanguageMap {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		args = append(args, fmt.Sprintf("--map-%s=+%s", o.LanguageMap[p], p))
+	}
+	return args
+}
+
 type ctagsProcess struct {
 	cmd     *exec.Cmd
 	in      io.WriteCloser
@@ -37,13 +102,11 @@ type ctagsProcess struct {
 	outPipe io.ReadCloser
 }
 
-func newProcess(bin string) (*ctagsProcess, error) {
-	opt := "default"
-	if runtime.GOOS == "linux" {
-		opt = "sandbox"
+func newProcess(opts ParserOptions) (*ctagsProcess, error) {
+	cmd := exec.Command(opts.Bin, opts.args()...)
+	if opts.Sandbox {
+		sandbox(cmd)
 	}
-
-	cmd := exec.Command(bin, "--_interactive="+opt, "--fields=*")
 	in, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, err
@@ -61,6 +124,8 @@ func newProcess(bin string) (*ctagsProcess, error) {
 		out:     bufio.NewScanner(out),
 		outPipe: out,
 	}
+	// Tags repeat the line they are on, which may be long.
+	proc.out.Buffer(nil, 1<<20)
 
 	if err := cmd.Start(); err != nil {
 		return nil, err
@@ -68,7 +133,8 @@ func newProcess(bin string) (*ctagsProcess, error) {
 
 	var init reply
 	if err := proc.read(&init); err != nil {
-		return nil, err
+		proc.Close()
+		return nil, fmt.Errorf("starting %s: %v", opts.Bin, err)
 	}
 
 	return &proc, nil
@@ -86,6 +152,9 @@ func (p *ctagsProcess) read(rep *reply) error {
 		err := p.cmd.Wait()
 		p.outPipe.Close()
 		p.in.Close()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
 		return err
 	}
 	if debug {
@@ -187,33 +256,95 @@ func (p *ctagsProcess) Parse(name string, content []byte) ([]*Entry, error) {
 	return es, nil
 }
 
+// Parser extracts symbols from source files.
 type Parser interface {
 	Parse(name string, content []byte) ([]*Entry, error)
+
+	// Close stops the ctags processes.
+	Close()
 }
 
-type lockedParser struct {
-	p Parser
-	l sync.Mutex
+// processPool is a Parser that runs a fixed number of long-lived
+// ctags processes, started on first use and restarted when they fail.
+type processPool struct {
+	opts ParserOptions
+
+	// idle processes. A nil entry is a process that is not
+	// running.
+	idle chan *ctagsProcess
+
+	closeOnce sync.Once
 }
 
-func (lp *lockedParser) Parse(name string, content []byte) ([]*Entry, error) {
-	lp.l.Lock()
-	defer lp.l.Unlock()
-	return lp.p.Parse(name, content)
+// NewParser returns a Parser that is implemented by a universal-ctags
+// binary. It starts one process to check that the binary works. The
+// parser is safe for concurrent use.
+func NewParser(opts ParserOptions) (Parser, error) {
+	if opts.Processes <= 0 {
+		opts.Processes = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	proc, err := newProcess(opts)
+	if err != nil {
+		return nil, err
+	}
+	p := &processPool{
+		opts: opts,
+		idle: make(chan *ctagsProcess, opts.Processes),
+	}
+	p.idle <- proc
+	for i := 1; i < opts.Processes; i++ {
+		p.idle <- nil
+	}
+	return p, nil
 }
 
-// NewParser creates a parser that is implemented by the given
-// universal-ctags binary. The parser is safe for concurrent use.
-func NewParser(bin string) (Parser, error) {
-	if strings.Contains(bin, "universal-ctags") {
-		// todo: restart, parallelization.
-		proc, err := newProcess(bin)
-		if err != nil {
+// Parse implements Parser.
+func (p *processPool) Parse(name string, content []byte) ([]*Entry, error) {
+	proc := <-p.idle
+	var err error
+	if proc == nil {
+		if proc, err = newProcess(p.opts); err != nil {
+			p.idle <- nil
 			return nil, err
 		}
-		return &lockedParser{p: proc}, nil
 	}
 
-	log.Fatal("not implemented")
-	return nil, nil
+	var timedOut bool
+	var mu sync.Mutex
+	timer := time.AfterFunc(p.opts.Timeout, func() {
+		mu.Lock()
+		timedOut = true
+		mu.Unlock()
+		proc.Close()
+	})
+	es, err := proc.Parse(name, content)
+	timer.Stop()
+
+	mu.Lock()
+	if timedOut {
+		err = fmt.Errorf("ctags timed out on %s after %v", name, p.opts.Timeout)
+	}
+	mu.Unlock()
+	if err != nil {
+		// The protocol state is unknown after an error, so start
+		// afresh.
+		proc.Close()
+		proc = nil
+	}
+	p.idle <- proc
+	return es, err
+}
+
+// Close implements Parser. Parse must not be called after Close.
+func (p *processPool) Close() {
+	p.closeOnce.Do(func() {
+		for i := 0; i < p.opts.Processes; i++ {
+			if proc := <-p.idle; proc != nil {
+				proc.Close()
+			}
+		}
+	})
 }
@@ -15,17 +15,144 @@
 package ctags
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	if os.Getenv("ZOEKT_FAKE_CTAGS") != "" {
+		fakeCTags()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeCTags speaks the JSON protocol of universal-ctags. It tags
+// lines starting with "func", crashes on "crash" and hangs on
+// "hang".
+func fakeCTags() {
+	fmt.Println(`{"_type": "program", "name": "Universal Ctags", "version": "0.0.0"}`)
+	in := bufio.NewReader(os.Stdin)
+	for {
+		line, err := in.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req request
+		if err := json.Unmarshal(line, &req); err != nil {
+			os.Exit(2)
+		}
+		content := make([]byte, req.Size)
+		if _, err := io.ReadFull(in, content); err != nil {
+			os.Exit(2)
+		}
+		switch string(content) {
+		case "crash":
+			os.Exit(1)
+		case "hang":
+			time.Sleep(time.Hour)
+		}
+		for i, l := range strings.Split(string(content), "\n") {
+			if f := strings.Fields(l); len(f) > 1 && f[0] == "func" {
+				tag, _ := json.Marshal(reply{Typ: "tag", Name: f[1], Path: req.Filename, Language: "Go", Line: i + 1, Kind: "func"})
+				fmt.Println(string(tag))
+			}
+		}
+		fmt.Println(`{"_type": "completed", "command": "generate-tags"}`)
+	}
+}
+
+func newFakeParser(t *testing.T, opts ParserOptions) Parser {
+	t.Setenv("ZOEKT_FAKE_CTAGS", "1")
+	opts.Bin = os.Args[0]
+	p, err := NewParser(opts)
+	if err != nil {
+		t.Fatalf("NewParser: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestParserPool(t *testing.T) {
+	p := newFakeParser(t, ParserOptions{Processes: 3})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("f%d.go", i)
+			es, err := p.Parse(name, []byte("package x\nfunc a\nfunc b\n"))
+			if err != nil {
+				t.Errorf("Parse: %v", err)
+				return
+			}
+			want := []*Entry{
+				{Sym: "a", Path: name, Line: 2, Kind: "func", Language: "Go"},
+				{Sym: "b", Path: name, Line: 3, Kind: "func", Language: "Go"},
+			}
+			if !reflect.DeepEqual(es, want) {
+				t.Errorf("got %v, want %v", es, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestParserRestart(t *testing.T) {
+	p := newFakeParser(t, ParserOptions{Timeout: 500 * time.Millisecond})
+
+	if _, err := p.Parse("crash.go", []byte("crash")); err == nil {
+		t.Error("Parse of crashing file succeeded")
+	}
+	if _, err := p.Parse("hang.go", []byte("hang")); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Parse of hanging file: got %v, want timeout", err)
+	}
+	es, err := p.Parse("ok.go", []byte("func ok"))
+	if err != nil || len(es) != 1 {
+		t.Errorf("Parse after restart: got %v, %v", es, err)
+	}
+}
+
+func TestParserSandbox(t *testing.T) {
+	t.Setenv("ZOEKT_FAKE_CTAGS", "1")
+	p, err := NewParser(ParserOptions{Bin: os.Args[0], Sandbox: true})
+	if err != nil {
+		// Unprivileged user namespaces may be disabled.
+		t.Skip(err)
+	}
+	defer p.Close()
+	if es, err := p.Parse("x.go", []byte("func x")); err != nil || len(es) != 1 {
+		t.Errorf("got %v, %v", es, err)
+	}
+}
+
+func TestParserArgs(t *testing.T) {
+	opts := ParserOptions{
+		Sandbox:     true,
+		LanguageMap: map[string]string{".pyx": "Python", "(BUILD)": "Python"},
+	}
+	want := []string{"--_interactive=sandbox", "--fields=*", "--map-Python=+(BUILD)", "--map-Python=+.pyx"}
+	if got := opts.args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestJSON(t *testing.T) {
 	if _, err := exec.LookPath("universal-ctags"); err != nil {
 		t.Skip(err)
 	}
 
-	p, err := newProcess("universal-ctags")
+	p, err := newProcess(ParserOptions{Bin: "universal-ctags"})
 	if err != nil {
 		t.Fatal("newProcess", err)
 	}
@@ -104,3 +231,16 @@ class Back implements Future extends Frob {
 		}
 	}
 }
+
+func TestParseLanguageMap(t *testing.T) {
+	got, err := ParseLanguageMap(".pyx=Python,(BUILD)=Python,")
+	want := map[string]string{".pyx": "Python", "(BUILD)": "Python"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, %v, want %v", got, err, want)
+	}
+	for _, bad := range []string{"Python", "=Python", ".pyx="} {
+		if _, err := ParseLanguageMap(bad); err == nil {
+			t.Errorf("ParseLanguageMap(%q) succeeded", bad)
+		}
+	}
+}
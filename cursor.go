@@ -0,0 +1,104 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// cursor is the position of a file in the order of SortFiles.
+type cursor struct {
+	Order      SortOrder  `json:"o,omitempty"`
+	Score      float64    `json:"s"`
+	Repository string     `json:"r"`
+	FileName   string     `json:"f"`
+	ModTime    *time.Time `json:"t,omitempty"`
+}
+
+func newCursor(order SortOrder, f *FileMatch) *cursor {
+	c := &cursor{Order: order, Score: f.Score, Repository: f.Repository, FileName: f.FileName}
+	if order == SortByModTime {
+		t := f.ModTime
+		c.ModTime = &t
+	}
+	return c
+}
+
+func (c *cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, Errorf(CodeQueryParse, "invalid cursor %q", s)
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, Errorf(CodeQueryParse, "invalid cursor %q", s)
+	}
+	return &c, nil
+}
+
+// after returns whether f sorts after the file at c.
+func (c *cursor) after(f *FileMatch) bool {
+	at := FileMatch{Score: c.Score, Repository: c.Repository, FileName: c.FileName}
+	if c.ModTime != nil {
+		at.ModTime = *c.ModTime
+	}
+	return c.Order.less(&at, f)
+}
+
+// AfterCursor returns the files that come after the cursor cur, a
+// SearchResult.NextCursor of a search with the same order. The order
+// of files is unchanged.
+func AfterCursor(files []FileMatch, order SortOrder, cur string) ([]FileMatch, error) {
+	if cur == "" {
+		return files, nil
+	}
+	c, err := decodeCursor(cur)
+	if err != nil {
+		return nil, err
+	}
+	if c.Order != order {
+		return nil, Errorf(CodeQueryParse, "cursor %q is for results sorted by %s, not %s", cur, c.Order, order)
+	}
+	var res []FileMatch
+	for _, f := range files {
+		if c.after(&f) {
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
+
+// Page returns the page of files, sorted by SortFiles in the given
+// order, that follows the cursor cur, or the first page if cur is
+// empty. Pages hold max files; if there are more, next is the cursor
+// for the following page. A max of zero means a single page.
+func Page(files []FileMatch, order SortOrder, cur string, max int) (page []FileMatch, next string, err error) {
+	page, err = AfterCursor(files, order, cur)
+	if err != nil {
+		return nil, "", err
+	}
+	if max > 0 && len(page) > max {
+		page = page[:max]
+		next = newCursor(order, &page[max-1]).encode()
+	}
+	return page, next, nil
+}
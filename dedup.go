@@ -0,0 +1,89 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DedupKey identifies the matches of f: file matches with the same
+// key are the same file with the same matching lines, typically
+// found on several branches.
+func DedupKey(f *FileMatch) string {
+	var b strings.Builder
+	for _, s := range []string{f.Repository, f.SubRepositoryPath, f.FileName} {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+	for _, lm := range f.LineMatches {
+		b.Write(lm.Line)
+		b.WriteByte(0)
+		for _, fr := range lm.LineFragments {
+			b.WriteString(strconv.Itoa(fr.LineOffset))
+			b.WriteByte(',')
+			b.WriteString(strconv.Itoa(fr.MatchLength))
+			b.WriteByte(0)
+		}
+	}
+	for _, cm := range f.ChunkMatches {
+		b.Write(cm.Content)
+		b.WriteByte(0)
+		for _, r := range cm.Ranges {
+			b.WriteString(strconv.Itoa(int(r.Start.ByteOffset - cm.ContentStart.ByteOffset)))
+			b.WriteByte(',')
+			b.WriteString(strconv.Itoa(int(r.End.ByteOffset - r.Start.ByteOffset)))
+			b.WriteByte(0)
+		}
+	}
+	return b.String()
+}
+
+// DedupBranches merges file matches with the same DedupKey into the
+// first of them, which gets the branches of all. The order of files
+// is kept otherwise. See SearchOptions.DedupBranches.
+func DedupBranches(files []FileMatch) []FileMatch {
+	seen := make(map[string]int, len(files))
+	res := files[:0]
+	for _, f := range files {
+		k := DedupKey(&f)
+		if i, ok := seen[k]; ok {
+			res[i].Branches = mergeBranches(res[i].Branches, f.Branches)
+			continue
+		}
+		seen[k] = len(res)
+		res = append(res, f)
+	}
+	return res
+}
+
+// mergeBranches returns the branches of a followed by those of b
+// missing from a.
+func mergeBranches(a, b []string) []string {
+	a = append([]string(nil), a...)
+	for _, br := range b {
+		found := false
+		for _, x := range a {
+			if x == br {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, br)
+		}
+	}
+	return a
+}
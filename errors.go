@@ -0,0 +1,139 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/zoekt/query"
+)
+
+// ErrorCode classifies errors returned by searchers, so callers can
+// decide whether to retry or fall back without looking at the
+// error text.
+type ErrorCode int
+
+const (
+	// CodeUnknown is used for errors without a code.
+	CodeUnknown ErrorCode = iota
+
+	// CodeQueryParse means the query could not be parsed.
+	CodeQueryParse
+
+	// CodeQueryTooExpensive means the query exceeds the resources
+	// the searcher is willing to spend on it.
+	CodeQueryTooExpensive
+
+	// CodeShardCorrupt means an index shard could not be read.
+	CodeShardCorrupt
+
+	// CodeOverloaded means the searcher is too busy; the search
+	// may be retried later.
+	CodeOverloaded
+
+	// CodePermissionDenied means the caller may not run the search.
+	CodePermissionDenied
+
+	// CodeIndexStale means the index was written in a format this
+	// searcher does not support, and must be rebuilt.
+	CodeIndexStale
+
+	// CodeCommitNotIndexed means a query.RepoCommit asked for a
+	// version of a repository that is not in the index. Callers
+	// may fall back to searching the repository without the
+	// index.
+	CodeCommitNotIndexed
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeUnknown:           "Unknown",
+	CodeQueryParse:        "QueryParseError",
+	CodeQueryTooExpensive: "QueryTooExpensive",
+	CodeShardCorrupt:      "ShardCorrupt",
+	CodeOverloaded:        "Overloaded",
+	CodePermissionDenied:  "PermissionDenied",
+	CodeIndexStale:        "IndexStale",
+	CodeCommitNotIndexed:  "CommitNotIndexed",
+}
+
+func (c ErrorCode) String() string {
+	if s, ok := codeNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// Temporary returns true if an operation failing with this code may
+// succeed when retried.
+func (c ErrorCode) Temporary() bool {
+	return c == CodeOverloaded
+}
+
+// Error is an error with a code.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Errorf returns an *Error with the given code and formatted message.
+func Errorf(code ErrorCode, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Error returns the code and message. The format is understood by
+// ErrorFromString, so codes survive transports that only carry the
+// error text, such as RPC.
+func (e *Error) Error() string {
+	return e.Code.String() + ": " + e.Message
+}
+
+// ErrorCode returns e.Code.
+func (e *Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// Temporary returns true if the operation may succeed when retried.
+func (e *Error) Temporary() bool {
+	return e.Code.Temporary()
+}
+
+// ErrorFromString reconstructs an *Error from its Error() text. It
+// returns nil if s does not start with a known code.
+func ErrorFromString(s string) *Error {
+	for code, name := range codeNames {
+		if code == CodeUnknown {
+			continue
+		}
+		if strings.HasPrefix(s, name+": ") {
+			return &Error{Code: code, Message: s[len(name)+2:]}
+		}
+	}
+	return nil
+}
+
+// ErrorCodeOf returns the code of err. Errors from other packages may
+// provide a code with an ErrorCode() method.
+func ErrorCodeOf(err error) ErrorCode {
+	switch e := err.(type) {
+	case nil:
+		return CodeUnknown
+	case interface{ ErrorCode() ErrorCode }:
+		return e.ErrorCode()
+	case *query.SuggestQueryError:
+		return CodeQueryParse
+	}
+	return CodeUnknown
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"path"
 	"sort"
 	"strings"
 
@@ -29,23 +30,61 @@ import (
 const maxUInt16 = 0xffff
 
 // DebugScore controls whether we collect data on match scores are
-// constructed. Intended for use in tests.
+// constructed for all searches, as if SearchOptions.DebugScore were
+// set. Intended for use in tests.
 var DebugScore = false
 
-func (m *FileMatch) addScore(what string, s float64) {
-	if DebugScore {
+func (m *FileMatch) addScore(what string, s float64, debug bool) {
+	if debug {
 		m.Debug += fmt.Sprintf("%s:%f, ", what, s)
 	}
 	m.Score += s
 }
 
-func (d *indexData) simplify(in query.Q) query.Q {
-	eval := query.Map(in, func(q query.Q) query.Q {
+// SimplifyRepo replaces the atoms of q that only depend on the
+// repository, such as repo: and its negation, by their value for
+// repo, and simplifies the result. If it returns a false
+// query.Const, nothing in repo can match, so searchers over many
+// shards use it to skip shards without searching them.
+func SimplifyRepo(q query.Q, repo *Repository) query.Q {
+	return query.Simplify(evalRepoAtoms(q, repo))
+}
+
+func evalRepoAtoms(in query.Q, repo *Repository) query.Q {
+	return query.Map(in, func(q query.Q) query.Q {
 		switch r := q.(type) {
 		case *query.Repo:
-			return &query.Const{Value: strings.Contains(d.repoMetaData.Name, r.Pattern)}
+			return &query.Const{Value: strings.Contains(repo.Name, r.Pattern)}
+		case *query.RepoRegexp:
+			return &query.Const{Value: r.Regexp.MatchString(repo.Name)}
 		case *query.RepoSet:
-			return &query.Const{Value: r.Set[d.repoMetaData.Name]}
+			return &query.Const{Value: r.Set[repo.Name]}
+		case *query.RepoIDs:
+			return &query.Const{Value: repo.ID != 0 && r.Set[repo.ID]}
+		case *query.RepoBranches:
+			// The branches are checked per document.
+			if _, ok := r.Set[repo.Name]; !ok {
+				return &query.Const{Value: false}
+			}
+		case *query.RepoFlag:
+			return &query.Const{Value: repoHasFlag(repo, r.Flag)}
+		case *query.RepoCommit:
+			// The branches are checked per document.
+			if r.Repo != repo.Name || !hasBranchVersion(repo, r.Commit) {
+				return &query.Const{Value: false}
+			}
+		case *query.RepoDescription:
+			return &query.Const{Value: strings.Contains(strings.ToLower(repo.Description), strings.ToLower(r.Pattern))}
+		case *query.Topic:
+			return &query.Const{Value: repoHasTopic(repo, r.Topic)}
+		}
+		return q
+	})
+}
+
+func (d *indexData) simplify(in query.Q) query.Q {
+	eval := query.Map(evalRepoAtoms(in, &d.repoMetaData), func(q query.Q) query.Q {
+		switch r := q.(type) {
 		case *query.Language:
 			_, has := d.metaData.LanguageMap[r.Language]
 			if !has {
@@ -57,6 +96,48 @@ func (d *indexData) simplify(in query.Q) query.Q {
 	return query.Simplify(eval)
 }
 
+// hasBranchVersion returns whether a branch of repo is at version.
+func hasBranchVersion(repo *Repository, version string) bool {
+	for _, b := range repo.Branches {
+		if b.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// repoHasTopic returns whether repo has topic, ignoring case.
+func repoHasTopic(repo *Repository, topic string) bool {
+	for _, t := range repo.Topics {
+		if strings.EqualFold(t, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoHasFlag returns whether the query.RepoFlag flag is set for
+// repo.
+func repoHasFlag(repo *Repository, flag uint8) bool {
+	switch flag {
+	case query.RepoFlagArchived:
+		return repo.Archived
+	case query.RepoFlagFork:
+		return repo.Fork
+	case query.RepoFlagPublic:
+		return repo.Public
+	}
+	return false
+}
+
+// queryFileCategories maps the categories of query.FileCategory to
+// the FileCategory of documents.
+var queryFileCategories = map[uint8]FileCategory{
+	query.FileCategoryGenerated: FileCategoryGenerated,
+	query.FileCategoryVendored:  FileCategoryVendored,
+	query.FileCategoryTest:      FileCategoryTest,
+}
+
 func (o *SearchOptions) SetDefaults() {
 	if o.ShardMaxMatchCount == 0 {
 		// We cap the total number of matches, so overly broad
@@ -88,6 +169,9 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 	select {
 	case <-ctx.Done():
 		res.Stats.ShardsSkipped++
+		if ctx.Err() == context.DeadlineExceeded {
+			res.Stats.Truncated = TruncatedDeadline
+		}
 		return &res, nil
 	default:
 	}
@@ -106,12 +190,30 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 		tr.Finish()
 	}()
 
+	if opts.SmartCase {
+		q = query.SmartCase(q)
+	}
 	q = d.simplify(q)
 	tr.LazyLog(q, true)
 	if c, ok := q.(*query.Const); ok && !c.Value {
 		return &res, nil
 	}
 
+	// For type:repo, the first matching file decides the match of
+	// the repository.
+	repoOnly := false
+	fileNameOnly := false
+	if t, ok := q.(*query.Type); ok {
+		repoOnly = t.Type == query.TypeRepo
+		fileNameOnly = t.Type == query.TypeFileName
+		q = t.Child
+	}
+	if fileNameOnly {
+		if q, err = fileNameQuery(q); err != nil {
+			return nil, err
+		}
+	}
+
 	if opts.EstimateDocCount {
 		res.Stats.ShardFilesConsidered = len(d.fileBranchMasks)
 		return &res, nil
@@ -119,7 +221,7 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 
 	q = query.Map(q, query.ExpandFileContent)
 
-	mt, err := d.newMatchTree(q, &res.Stats)
+	mt, err := d.newMatchTree(q, &res.Stats, regexpCacheFor(ctx, opts))
 	if err != nil {
 		return nil, err
 	}
@@ -134,6 +236,11 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 		stats: &res.Stats,
 	}
 
+	weights := opts.ScoreWeights.withDefaults()
+	debug := opts.DebugScore || DebugScore
+
+	budget := searchBudgetFor(ctx, opts)
+
 	docCount := uint32(len(d.fileBranchMasks))
 	lastDoc := int(-1)
 
@@ -157,6 +264,16 @@ nextFileMatch:
 
 		if canceled || res.Stats.MatchCount >= opts.ShardMaxMatchCount ||
 			importantMatchCount >= opts.ShardMaxImportantMatch {
+			if !canceled {
+				res.Stats.Truncated = TruncatedShardMatchLimit
+			} else if ctx.Err() == context.DeadlineExceeded {
+				res.Stats.Truncated = TruncatedDeadline
+			}
+			res.Stats.FilesSkipped += d.repoListEntry.Stats.Documents - lastDoc
+			break
+		}
+		if r := budget.addDoc(); r != NotTruncated {
+			res.Stats.Truncated = r
 			res.Stats.FilesSkipped += d.repoListEntry.Stats.Documents - lastDoc
 			break
 		}
@@ -179,12 +296,24 @@ nextFileMatch:
 			}
 		}
 
+		if opts.CountOnly {
+			d.countMatch(&res, nextDoc, mt, known)
+			if repoOnly {
+				break
+			}
+			continue
+		}
+
 		fileMatch := FileMatch{
-			Repository: d.repoMetaData.Name,
-			FileName:   string(d.fileName(nextDoc)),
-			Checksum:   d.getChecksum(nextDoc),
-			Language:   d.languageMap[d.languages[nextDoc]],
+			Repository:   d.repoMetaData.Name,
+			RepositoryID: d.repoMetaData.ID,
+			FileName:     string(d.fileName(nextDoc)),
+			Checksum:     d.getChecksum(nextDoc),
+			Language:     d.languageMap[d.languages[nextDoc]],
+			LineEnding:   LineEnding(d.lineEndings[nextDoc]),
+			Category:     FileCategory(d.categories[nextDoc]),
 		}
+		fileMatch.Size, fileMatch.ModTime, fileMatch.Executable = d.fileInfo(nextDoc)
 
 		if s := d.subRepos[nextDoc]; s > 0 {
 			if s >= uint32(len(d.subRepoPaths)) {
@@ -217,50 +346,89 @@ nextFileMatch:
 					caseSensitive: false,
 					fileName:      true,
 					substrBytes:   nm,
-					substrLowered: nm,
+					substrFolded:  nm,
 					file:          nextDoc,
 					runeOffset:    0,
 					byteOffset:    0,
 					byteMatchSz:   uint32(len(nm)),
 				})
 		}
-		fileMatch.LineMatches = cp.fillMatches(finalCands)
+		fileMatch.LineMatches = cp.fillMatches(finalCands, &weights, debug)
 
 		maxFileScore := 0.0
+		fragment := "fragment"
 		for i := range fileMatch.LineMatches {
-			if maxFileScore < fileMatch.LineMatches[i].Score {
-				maxFileScore = fileMatch.LineMatches[i].Score
-
+			lm := &fileMatch.LineMatches[i]
+			if maxFileScore < lm.Score {
+				maxFileScore = lm.Score
+				if debug {
+					fragment = fmt.Sprintf("fragment(%s)", lm.Debug)
+				}
 			}
 
 			// Order by ordering in file.
-			fileMatch.LineMatches[i].Score += scoreLineOrderFactor * (1.0 - (float64(i) / float64(len(fileMatch.LineMatches))))
+			order := scoreLineOrderFactor * (1.0 - (float64(i) / float64(len(fileMatch.LineMatches))))
+			lm.Score += order
+			if debug {
+				lm.Debug = strings.TrimPrefix(lm.Debug+fmt.Sprintf(", line-order:%f", order), ", ")
+			}
 		}
 
 		// Maintain ordering of input files. This
 		// strictly dominates the in-file ordering of
 		// the matches.
-		fileMatch.addScore("fragment", maxFileScore)
-		fileMatch.addScore("atom", float64(atomMatchCount)/float64(totalAtomCount)*scoreFactorAtomMatch)
+		fileMatch.addScore(fragment, maxFileScore, debug)
+		fileMatch.addScore("atom", float64(atomMatchCount)/float64(totalAtomCount)*scoreFactorAtomMatch, debug)
 
 		// Prefer earlier docs.
-		fileMatch.addScore("doc-order", scoreFileOrderFactor*(1.0-float64(nextDoc)/float64(len(d.boundaries))))
-		fileMatch.addScore("shard-order", scoreShardRankFactor*float64(d.repoMetaData.Rank)/maxUInt16)
+		fileMatch.addScore("doc-order", scoreFileOrderFactor*(1.0-float64(nextDoc)/float64(len(d.boundaries))), debug)
+		fileMatch.addScore("shard-order", scoreShardRankFactor*float64(d.repoMetaData.Rank)/maxUInt16, debug)
+		fileMatch.addScore("doc-rank", weights.DocRank*scoreDocRankFactor*d.docRank(nextDoc), debug)
+		if fileMatch.Category != 0 {
+			fileMatch.addScore("category", -weights.Category*scoreCategoryPenalty, debug)
+		}
 
 		if fileMatch.Score > scoreImportantThreshold {
 			importantMatchCount++
 		}
 		fileMatch.Branches = d.gatherBranches(nextDoc, mt, known)
-		sortMatchesByScore(fileMatch.LineMatches)
-		if opts.Whole {
+		matchCount := len(fileMatch.LineMatches)
+		if opts.ChunkMatches {
+			fileMatch.ChunkMatches = cp.fillChunkMatches(fileMatch.LineMatches, opts.NumContextLines)
+			fileMatch.LineMatches = nil
+			sortChunksByScore(fileMatch.ChunkMatches)
+		} else {
+			sortMatchesByScore(fileMatch.LineMatches)
+		}
+		if opts.Whole && !fileNameOnly {
 			fileMatch.Content = cp.data(false)
 		}
 
+		if opts.Facets {
+			addFacets(&res, &fileMatch, matchCount)
+		}
+
 		res.Files = append(res.Files, fileMatch)
-		res.Stats.MatchCount += len(fileMatch.LineMatches)
+		res.Stats.MatchCount += matchCount
 		res.Stats.FileCount++
+		if repoOnly {
+			break
+		}
+		if r := budget.addMatch(&fileMatch); r != NotTruncated {
+			res.Stats.Truncated = r
+			res.Stats.FilesSkipped += d.repoListEntry.Stats.Documents - lastDoc - 1
+			break
+		}
+	}
+	SortFiles(res.Files, opts.SortBy)
+	if opts.DedupBranches {
+		res.Files = DedupBranches(res.Files)
+	}
+	files, next, err := Page(res.Files, opts.SortBy, opts.Cursor, opts.MaxDocDisplayCount)
+	if err != nil {
+		return nil, err
 	}
-	SortFilesByScore(res.Files)
+	res.Files, res.NextCursor = files, next
 
 	addRepo(&res, &d.repoMetaData)
 	for _, v := range d.repoMetaData.SubRepoMap {
@@ -271,6 +439,75 @@ nextFileMatch:
 	return &res, nil
 }
 
+// fileNameQuery rewrites the text atoms of q to match file names
+// only, for type:filename queries. Only the file name index is used
+// to evaluate the result.
+func fileNameQuery(q query.Q) (query.Q, error) {
+	var err error
+	q = query.Map(q, func(q query.Q) query.Q {
+		switch s := q.(type) {
+		case *query.Substring:
+			if s.Content {
+				err = Errorf(CodeQueryParse, "content search not supported with type:filename: %s", s)
+			}
+			c := *s
+			c.FileName = true
+			return &c
+		case *query.Regexp:
+			if s.Content {
+				err = Errorf(CodeQueryParse, "content search not supported with type:filename: %s", s)
+			}
+			c := *s
+			c.FileName = true
+			return &c
+		case *query.Symbol:
+			err = Errorf(CodeQueryParse, "symbol search not supported with type:filename: %s", s)
+		}
+		return q
+	})
+	return q, err
+}
+
+// countMatch counts a matching document for SearchOptions.CountOnly,
+// without loading its content or splitting matches into lines.
+func (d *indexData) countMatch(res *SearchResult, doc uint32, mt matchTree, known map[matchTree]bool) {
+	matchCount := len(gatherMatches(mt, known))
+	if matchCount == 0 {
+		// Only atoms without positions matched, eg. a
+		// branch or repo; count the file name.
+		matchCount = 1
+	}
+
+	fm := FileMatch{
+		Repository:   d.repoMetaData.Name,
+		RepositoryID: d.repoMetaData.ID,
+		FileName:     string(d.fileName(doc)),
+		Language:     d.languageMap[d.languages[doc]],
+	}
+	addFacets(res, &fm, matchCount)
+	res.Stats.MatchCount += matchCount
+	res.Stats.FileCount++
+}
+
+// addFacets counts the matches of a file in res.RepoStats.
+func addFacets(res *SearchResult, fm *FileMatch, matchCount int) {
+	if res.RepoStats == nil {
+		res.RepoStats = map[string]*RepoMatchStats{}
+	}
+	st := res.RepoStats[fm.Repository]
+	if st == nil {
+		st = &RepoMatchStats{
+			Languages:  map[string]int{},
+			Extensions: map[string]int{},
+		}
+		res.RepoStats[fm.Repository] = st
+	}
+	st.FileCount++
+	st.MatchCount += matchCount
+	st.Languages[fm.Language] += matchCount
+	st.Extensions[path.Ext(fm.FileName)] += matchCount
+}
+
 func addRepo(res *SearchResult, repo *Repository) {
 	if res.RepoURLs == nil {
 		res.RepoURLs = map[string]string{}
@@ -365,25 +602,26 @@ func (d *indexData) gatherBranches(docID uint32, mt matchTree, known map[matchTr
 	foundBranchQuery := false
 	var branches []string
 
+	var queryMask uint64
 	visitMatches(mt, known, func(mt matchTree) {
 		bq, ok := mt.(*branchQueryMatchTree)
 		if ok {
 			foundBranchQuery = true
-			branches = append(branches,
-				d.branchNames[uint(bq.mask)])
+			queryMask |= bq.mask
 		}
 	})
 
-	if !foundBranchQuery {
-		mask := d.fileBranchMasks[docID]
-		id := uint32(1)
-		for mask != 0 {
-			if mask&0x1 != 0 {
-				branches = append(branches, d.branchNames[uint(id)])
-			}
-			id <<= 1
-			mask >>= 1
+	mask := d.fileBranchMasks[docID]
+	if foundBranchQuery {
+		mask &= queryMask
+	}
+	id := uint32(1)
+	for mask != 0 {
+		if mask&0x1 != 0 {
+			branches = append(branches, d.branchNames[uint(id)])
 		}
+		id <<= 1
+		mask >>= 1
 	}
 	return branches
 }
@@ -403,6 +641,14 @@ func (d *indexData) List(ctx context.Context, q query.Q) (rl *RepoList, err erro
 	}()
 
 	q = d.simplify(q)
+	// Listing is per repository, so branches do not matter.
+	q = query.Simplify(query.Map(q, func(q query.Q) query.Q {
+		switch q.(type) {
+		case *query.RepoBranches, *query.RepoCommit:
+			return &query.Const{Value: true}
+		}
+		return q
+	}))
 	tr.LazyLog(q, true)
 	c, ok := q.(*query.Const)
 
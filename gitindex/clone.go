@@ -16,6 +16,7 @@ package gitindex
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"os"
 	"os/exec"
@@ -26,6 +27,12 @@ import (
 // CloneRepo clones one repository, adding the given config
 // settings. It returns the bare repo directory.
 func CloneRepo(destDir, name, cloneURL string, settings map[string]string) error {
+	return CloneRepoContext(context.Background(), destDir, name, cloneURL, settings)
+}
+
+// CloneRepoContext is like CloneRepo, but kills git when ctx is
+// canceled.
+func CloneRepoContext(ctx context.Context, destDir, name, cloneURL string, settings map[string]string) error {
 	parent := filepath.Join(destDir, filepath.Dir(name))
 	if err := os.MkdirAll(parent, 0755); err != nil {
 		return err
@@ -47,10 +54,8 @@ func CloneRepo(destDir, name, cloneURL string, settings map[string]string) error
 		config = append(config, "--config", k+"="+settings[k])
 	}
 
-	cmd := exec.Command(
-		"git", "clone", "--bare", "--verbose", "--progress",
-		// Only fetch branch heads, and ignore note branches.
-		"--config", "remote.origin.fetch=+refs/heads/*:refs/heads/*")
+	cmd := exec.CommandContext(ctx,
+		"git", "clone", "--bare", "--verbose", "--progress")
 	cmd.Args = append(cmd.Args, config...)
 	cmd.Args = append(cmd.Args, cloneURL, repoDest)
 
@@ -60,5 +65,11 @@ func CloneRepo(destDir, name, cloneURL string, settings map[string]string) error
 	if err := cmd.Run(); err != nil {
 		return err
 	}
-	return nil
+
+	// Only fetch branch heads, and ignore note branches. Recent
+	// versions of git refuse this refspec while cloning, since the
+	// bare clone already writes the branch heads.
+	cmd = exec.CommandContext(ctx, "git", "-C", repoDest,
+		"config", "remote.origin.fetch", "+refs/heads/*:refs/heads/*")
+	return cmd.Run()
 }
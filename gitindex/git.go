@@ -16,6 +16,7 @@
 package gitindex
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -180,6 +181,16 @@ func configLookupString(sec *plumcfg.Section, key string) string {
 	return ""
 }
 
+// configLookupBool returns whether the boolean option key is set to
+// true, using git's spelling of booleans.
+func configLookupBool(sec *plumcfg.Section, key string) bool {
+	switch strings.ToLower(configLookupString(sec, key)) {
+	case "true", "yes", "on", "1":
+		return true
+	}
+	return false
+}
+
 func isMissingBranchError(err error) bool {
 	return err != nil && err.Error() == "reference not found"
 }
@@ -258,6 +269,29 @@ func setTemplatesFromConfig(desc *zoekt.Repository, repoDir string) error {
 		desc.Rank = uint16((1.0 - 1.0/math.Pow(1+l, 0.6)) * 10000)
 	}
 
+	// An explicit priority overrides the one derived from traction.
+	desc.Priority = float64(traction)
+	if p, err := strconv.ParseFloat(configLookupString(sec, "priority"), 64); err == nil {
+		desc.Priority = p
+	}
+
+	if id, err := strconv.ParseUint(configLookupString(sec, "repoid"), 10, 32); err == nil {
+		desc.ID = uint32(id)
+	}
+	desc.TenantID = configLookupString(sec, "tenant")
+
+	desc.Archived = configLookupBool(sec, "archived")
+	desc.Fork = configLookupBool(sec, "fork")
+	desc.Public = configLookupBool(sec, "public")
+
+	desc.Description = configLookupString(sec, "description")
+	desc.Topics = nil
+	for _, t := range strings.Split(configLookupString(sec, "topics"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			desc.Topics = append(desc.Topics, t)
+		}
+	}
+
 	return nil
 }
 
@@ -283,6 +317,10 @@ type Options struct {
 	// If set, follow submodule links. This requires RepoCacheDir to be set.
 	Submodules bool
 
+	// SubmoduleConfig selects the submodules followed with
+	// Submodules, and rewrites their URLs.
+	SubmoduleConfig SubmoduleConfig
+
 	// If set, skip indexing if the existing index shard is newer
 	// than the refs in the repository.
 	Incremental bool
@@ -299,12 +337,37 @@ type Options struct {
 	// Prefix of the branch to index, e.g. `remotes/origin`.
 	BranchPrefix string
 
-	// List of branch names to index, e.g. []string{"HEAD", "stable"}
+	// List of branch names to index, e.g. []string{"HEAD", "stable"}.
+	// Names containing *, ? or [ are patterns, as in filepath.Match,
+	// matched against the branches of the repository, e.g.
+	// "release-*". A branch named several times is indexed once.
 	Branches []string
+
+	// If set, index the checked-out working tree instead of
+	// Branches: the files tracked in the git index, with their
+	// contents as found on disk, including uncommitted changes.
+	// The result is indexed as branch WorktreeBranch. Incremental
+	// indexing only stats the tracked files to detect changes.
+	Worktree bool
+
+	// If set with Worktree, index the staged contents of the
+	// tracked files rather than their contents on disk.
+	WorktreeStaged bool
+
+	// If positive, repositories whose files add up to more than
+	// this many bytes are indexed with BuildOptions.FileNamesOnly.
+	FileNamesOnlyAbove int64
 }
 
 func expandBranches(repo *git.Repository, bs []string, prefix string) ([]string, error) {
 	var result []string
+	seen := map[string]bool{}
+	add := func(b string) {
+		if !seen[b] {
+			seen[b] = true
+			result = append(result, b)
+		}
+	}
 	for _, b := range bs {
 		if b == "HEAD" {
 			ref, err := repo.Head()
@@ -312,17 +375,21 @@ func expandBranches(repo *git.Repository, bs []string, prefix string) ([]string,
 				return nil, err
 			}
 
-			result = append(result, strings.TrimPrefix(ref.Name().String(), prefix))
+			add(strings.TrimPrefix(ref.Name().String(), prefix))
 			continue
 		}
 
-		if strings.Contains(b, "*") {
+		if strings.ContainsAny(b, "*?[") {
 			iter, err := repo.Branches()
 			if err != nil {
 				return nil, err
 			}
 
 			defer iter.Close()
+			// Sorted, so the branches of the index do not change
+			// order between runs, which would defeat incremental
+			// indexing.
+			var matches []string
 			for {
 				ref, err := iter.Next()
 				if err == io.EOF {
@@ -339,12 +406,16 @@ func expandBranches(repo *git.Repository, bs []string, prefix string) ([]string,
 					continue
 				}
 
-				result = append(result, strings.TrimPrefix(name, prefix))
+				matches = append(matches, strings.TrimPrefix(name, prefix))
+			}
+			sort.Strings(matches)
+			for _, m := range matches {
+				add(m)
 			}
 			continue
 		}
 
-		result = append(result, b)
+		add(b)
 	}
 
 	return result, nil
@@ -352,6 +423,12 @@ func expandBranches(repo *git.Repository, bs []string, prefix string) ([]string,
 
 // IndexGitRepo indexes the git repository as specified by the options.
 func IndexGitRepo(opts Options) error {
+	return IndexGitRepoContext(context.Background(), opts)
+}
+
+// IndexGitRepoContext is like IndexGitRepo, but stops indexing when
+// ctx is canceled. See build.NewBuilderContext.
+func IndexGitRepoContext(ctx context.Context, opts Options) error {
 	// Set max thresholds, since we use them in this function.
 	opts.BuildOptions.SetDefaults()
 	if opts.RepoDir == "" {
@@ -365,8 +442,21 @@ func IndexGitRepo(opts Options) error {
 	if err := setTemplatesFromConfig(&opts.BuildOptions.RepositoryDescription, opts.RepoDir); err != nil {
 		log.Printf("setTemplatesFromConfig(%s): %s", opts.RepoDir, err)
 	}
+	if opts.BuildOptions.LFSPointers == build.LFSPointersFetch && opts.BuildOptions.LFSFetch == nil {
+		opts.BuildOptions.LFSFetch = lfsFetcher(opts.RepoDir)
+	}
 
-	repoCache := NewRepoCache(opts.RepoCacheDir)
+	if opts.Worktree {
+		return indexWorktree(ctx, repo, opts)
+	}
+
+	var repoCache *RepoCache
+	if opts.Submodules {
+		if err := opts.SubmoduleConfig.validate(); err != nil {
+			return err
+		}
+		repoCache = NewRepoCache(opts.RepoCacheDir)
+	}
 
 	// branch => (path, sha1) => repo.
 	repos := map[fileKey]BlobLocation{}
@@ -377,6 +467,9 @@ func IndexGitRepo(opts Options) error {
 	// Branch => Repo => SHA1
 	branchVersions := map[string]map[string]plumbing.Hash{}
 
+	// Branch => commit time
+	branchTimes := map[string]time.Time{}
+
 	branches, err := expandBranches(repo, opts.Branches, opts.BranchPrefix)
 	if err != nil {
 		return err
@@ -400,7 +493,7 @@ func IndexGitRepo(opts Options) error {
 			return err
 		}
 
-		files, subVersions, err := TreeToFiles(repo, tree, opts.BuildOptions.RepositoryDescription.URL, repoCache)
+		files, subVersions, err := treeToFiles(repo, tree, opts.BuildOptions.RepositoryDescription.URL, repoCache, &opts.SubmoduleConfig, "")
 		if err != nil {
 			return err
 		}
@@ -410,6 +503,20 @@ func IndexGitRepo(opts Options) error {
 		}
 
 		branchVersions[b] = subVersions
+		branchTimes[b] = commit.Committer.When
+	}
+	if len(opts.BuildOptions.RepositoryDescription.Branches) == 0 {
+		return fmt.Errorf("gitindex: none of the branches %v found in %s", opts.Branches, opts.RepoDir)
+	}
+
+	if opts.FileNamesOnlyAbove > 0 {
+		size, err := blobsSize(repos)
+		if err != nil {
+			return err
+		}
+		if size > opts.FileNamesOnlyAbove {
+			opts.BuildOptions.FileNamesOnly = true
+		}
 	}
 
 	if opts.Incremental {
@@ -445,7 +552,10 @@ func IndexGitRepo(opts Options) error {
 		}
 	}
 
-	builder, err := build.NewBuilder(opts.BuildOptions)
+	// TreeToFiles read the .gitattributes files of all
+	// directories, not just the root one.
+	opts.BuildOptions.PresetCategories = true
+	builder, err := build.NewBuilderContext(ctx, opts.BuildOptions)
 	if err != nil {
 		return err
 	}
@@ -463,20 +573,40 @@ func IndexGitRepo(opts Options) error {
 
 	for _, name := range names {
 		keys := fileKeys[name]
+		// Keep the order of documents stable, so checkpointed
+		// builds can resume.
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].ID.String() < keys[j].ID.String()
+		})
 
 		for _, key := range keys {
 			brs := branchMap[key]
-			blob, err := repos[key].Repo.BlobObject(key.ID)
+			loc := repos[key]
+			blob, err := loc.Repo.BlobObject(key.ID)
 			if err != nil {
 				return err
 			}
 
+			// The time of the newest commit holding the file;
+			// finding the commit that last changed it would
+			// mean walking the history.
+			var modTime time.Time
+			for _, br := range brs {
+				if t := branchTimes[br]; t.After(modTime) {
+					modTime = t
+				}
+			}
+
 			if blob.Size > int64(opts.BuildOptions.SizeMax) {
 				if err := builder.Add(zoekt.Document{
 					SkipReason:        fmt.Sprintf("file size %d exceeds maximum size %d", blob.Size, opts.BuildOptions.SizeMax),
 					Name:              key.FullPath(),
 					Branches:          brs,
 					SubRepositoryPath: key.SubRepoPath,
+					Size:              blob.Size,
+					Executable:        loc.Executable,
+					Category:          loc.Category(key.FullPath(), nil),
+					ModTime:           modTime,
 				}); err != nil {
 					return err
 				}
@@ -492,6 +622,9 @@ func IndexGitRepo(opts Options) error {
 				Name:              key.FullPath(),
 				Content:           contents,
 				Branches:          brs,
+				Executable:        loc.Executable,
+				Category:          loc.Category(key.FullPath(), contents),
+				ModTime:           modTime,
 			}); err != nil {
 				return err
 			}
@@ -500,6 +633,19 @@ func IndexGitRepo(opts Options) error {
 	return builder.Finish()
 }
 
+// blobsSize returns the total size of the files in repos.
+func blobsSize(repos map[fileKey]BlobLocation) (int64, error) {
+	var size int64
+	for key, loc := range repos {
+		blob, err := loc.Repo.BlobObject(key.ID)
+		if err != nil {
+			return 0, err
+		}
+		size += blob.Size
+	}
+	return size, nil
+}
+
 func blobContents(blob *object.Blob) ([]byte, error) {
 	r, err := blob.Reader()
 	if err != nil {
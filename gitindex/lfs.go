@@ -0,0 +1,60 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/google/zoekt/build"
+)
+
+// lfsFetcher returns a build.Options.LFSFetch for the repository in
+// repoDir. It reads objects from the LFS store of the repository,
+// and otherwise runs git lfs smudge, which downloads them from the
+// LFS server of the repository.
+func lfsFetcher(repoDir string) func(context.Context, build.LFSPointer) ([]byte, error) {
+	gitDir := repoDir
+	if fi, err := os.Stat(filepath.Join(repoDir, ".git")); err == nil && fi.IsDir() {
+		gitDir = filepath.Join(repoDir, ".git")
+	}
+	local := build.LFSDirFetcher(filepath.Join(gitDir, "lfs", "objects"))
+
+	return func(ctx context.Context, p build.LFSPointer) ([]byte, error) {
+		content, err := local(ctx, p)
+		if !os.IsNotExist(err) {
+			return content, err
+		}
+		if _, err := exec.LookPath("git-lfs"); err != nil {
+			return nil, &os.PathError{Op: "fetch", Path: p.OID, Err: os.ErrNotExist}
+		}
+
+		cmd := exec.CommandContext(ctx, "git", "lfs", "smudge")
+		cmd.Dir = repoDir
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		cmd.Stdin = bytes.NewReader(p.Bytes())
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("git lfs smudge: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return stdout.Bytes(), nil
+	}
+}
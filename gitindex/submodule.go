@@ -16,6 +16,9 @@ package gitindex
 
 import (
 	"bytes"
+	"fmt"
+	"path"
+	"strings"
 
 	"gopkg.in/src-d/go-git.v4/plumbing/format/config"
 )
@@ -62,3 +65,88 @@ func ParseGitModules(content []byte) (map[string]*SubmoduleEntry, error) {
 
 	return result, nil
 }
+
+// SubmoduleConfig selects the submodules to index and where to find
+// their repositories.
+type SubmoduleConfig struct {
+	// URLRewrites maps URL prefixes of submodules to their
+	// replacements, like the url.<base>.insteadOf setting of git,
+	// eg. to find submodules on an internal host in the RepoCache
+	// under the name of their mirror. The longest matching prefix
+	// is replaced.
+	URLRewrites map[string]string
+
+	// Include, if not empty, holds path.Match patterns of the
+	// paths of submodules to index, relative to the root of the
+	// indexed repository. Other submodules are skipped.
+	Include []string
+
+	// Exclude holds patterns of submodules not to index. It takes
+	// precedence over Include.
+	Exclude []string
+}
+
+// ParseURLRewrites parses comma separated FROM=TO pairs of URL
+// prefixes, for SubmoduleConfig.URLRewrites.
+func ParseURLRewrites(s string) (map[string]string, error) {
+	rewrites := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("URL rewrite %q: want FROM=TO", pair)
+		}
+		rewrites[pair[:i]] = pair[i+1:]
+	}
+	return rewrites, nil
+}
+
+// validate checks the patterns of c.
+func (c *SubmoduleConfig) validate() error {
+	for _, pat := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("submodule pattern %q: %v", pat, err)
+		}
+	}
+	return nil
+}
+
+// rewriteURL applies the rewrite of the longest matching prefix to
+// the URL u. A nil config leaves u alone.
+func (c *SubmoduleConfig) rewriteURL(u string) string {
+	if c == nil {
+		return u
+	}
+	from := ""
+	for prefix := range c.URLRewrites {
+		if strings.HasPrefix(u, prefix) && len(prefix) > len(from) {
+			from = prefix
+		}
+	}
+	if from == "" {
+		return u
+	}
+	return c.URLRewrites[from] + u[len(from):]
+}
+
+// selected returns whether the submodule at p should be indexed. A
+// nil config selects all submodules.
+func (c *SubmoduleConfig) selected(p string) bool {
+	if c == nil {
+		return true
+	}
+	match := func(patterns []string) bool {
+		for _, pat := range patterns {
+			if ok, _ := path.Match(pat, p); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(c.Include) > 0 && !match(c.Include) {
+		return false
+	}
+	return !match(c.Exclude)
+}
@@ -41,3 +41,41 @@ func TestParseGitModules(t *testing.T) {
 		t.Fatalf("got %v, want %v", got, want)
 	}
 }
+
+func TestSubmoduleConfig(t *testing.T) {
+	rewrites, err := ParseURLRewrites("https://git.corp/=https://github.com/,https://git.corp/mirrors/=https://mirror.corp/")
+	if err != nil {
+		t.Fatalf("ParseURLRewrites: %v", err)
+	}
+	if _, err := ParseURLRewrites("https://git.corp/"); err == nil {
+		t.Errorf("ParseURLRewrites without replacement succeeded")
+	}
+	c := &SubmoduleConfig{
+		URLRewrites: rewrites,
+		Include:     []string{"third_party/*", "plugins/*"},
+		Exclude:     []string{"plugins/large"},
+	}
+
+	for u, want := range map[string]string{
+		"https://git.corp/org/repo":         "https://github.com/org/repo",
+		"https://git.corp/mirrors/org/repo": "https://mirror.corp/org/repo",
+		"https://gitlab.com/org/repo":       "https://gitlab.com/org/repo",
+	} {
+		if got := c.rewriteURL(u); got != want {
+			t.Errorf("rewriteURL(%s) = %s, want %s", u, got, want)
+		}
+	}
+	for p, want := range map[string]bool{
+		"third_party/zlib": true,
+		"plugins/small":    true,
+		"plugins/large":    false,
+		"docs":             false,
+	} {
+		if got := c.selected(p); got != want {
+			t.Errorf("selected(%s) = %v, want %v", p, got, want)
+		}
+	}
+	if c := (*SubmoduleConfig)(nil); !c.selected("docs") || c.rewriteURL("https://a/b") != "https://a/b" {
+		t.Errorf("nil config changes submodules")
+	}
+}
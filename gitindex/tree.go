@@ -21,8 +21,12 @@ import (
 	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
@@ -47,6 +51,13 @@ type repoWalker struct {
 
 	// If set, don't gasp on missing submodules.
 	ignoreMissingSubmodules bool
+
+	// submoduleConfig selects the submodules to recurse into.
+	submoduleConfig *SubmoduleConfig
+
+	// subPath is the path of the repository in the indexed one,
+	// or "" for the indexed repository itself.
+	subPath string
 }
 
 // subURL returns the URL for a submodule.
@@ -99,9 +110,23 @@ func (rw *repoWalker) parseModuleMap(t *object.Tree) error {
 // TreeToFiles fetches the blob SHA1s for a tree. If repoCache is
 // non-nil, recurse into submodules. In addition, it returns a mapping
 // that indicates in which repo each SHA1 can be found.
+//
+// Files with the export-ignore attribute are left out, as from the
+// archives of git archive. The linguist-generated and
+// linguist-vendored attributes of the others are recorded in their
+// BlobLocation, see BlobLocation.Category.
 func TreeToFiles(r *git.Repository, t *object.Tree,
 	repoURL string, repoCache *RepoCache) (map[fileKey]BlobLocation, map[string]plumbing.Hash, error) {
+	return treeToFiles(r, t, repoURL, repoCache, nil, "")
+}
+
+// treeToFiles is TreeToFiles for the repository at subPath in the
+// indexed one, recursing only into the submodules selected by cfg.
+func treeToFiles(r *git.Repository, t *object.Tree,
+	repoURL string, repoCache *RepoCache, cfg *SubmoduleConfig, subPath string) (map[fileKey]BlobLocation, map[string]plumbing.Hash, error) {
 	rw := newRepoWalker(r, repoURL, repoCache)
+	rw.submoduleConfig = cfg
+	rw.subPath = subPath
 
 	if err := rw.parseModuleMap(t); err != nil {
 		return nil, nil, err
@@ -118,9 +143,87 @@ func TreeToFiles(r *git.Repository, t *object.Tree,
 			return nil, nil, err
 		}
 	}
+	if err := rw.applyGitAttributes(); err != nil {
+		return nil, nil, err
+	}
 	return rw.tree, rw.subRepoVersions, nil
 }
 
+// dirAttributes are the attributes of the .gitattributes file in
+// dir, whose patterns are relative to dir.
+type dirAttributes struct {
+	dir   string
+	attrs build.GitAttributes
+}
+
+// applyGitAttributes reads the .gitattributes files of the
+// repository, drops the files they mark export-ignore and sets the
+// categories of the others. As in git, the file of a directory takes
+// precedence over those of its parents. Files of submodules were
+// handled by the walker of the submodule.
+func (rw *repoWalker) applyGitAttributes() error {
+	var files []dirAttributes
+	for k, loc := range rw.tree {
+		if k.SubRepoPath != "" || path.Base(k.Path) != build.GitAttributesFile {
+			continue
+		}
+		content, err := loc.Blob(&k.ID)
+		if err != nil {
+			return err
+		}
+		attrs, err := build.ParseGitAttributes(content)
+		if err != nil {
+			log.Printf("ignoring %s: %v", k.Path, err)
+			continue
+		}
+		dir := path.Dir(k.Path)
+		if dir == "." {
+			dir = ""
+		}
+		files = append(files, dirAttributes{dir: dir, attrs: attrs})
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	depth := func(dir string) int {
+		if dir == "" {
+			return 0
+		}
+		return strings.Count(dir, "/") + 1
+	}
+	sort.Slice(files, func(i, j int) bool { return depth(files[i].dir) < depth(files[j].dir) })
+
+	for k, loc := range rw.tree {
+		if k.SubRepoPath != "" {
+			continue
+		}
+		// Follow what the attributes do to a file with no
+		// categories and one with all of them, which tells the
+		// categories they set apart from those they leave alone.
+		ignored := false
+		set, kept := zoekt.FileCategory(0), allCategories
+		for _, f := range files {
+			name := k.Path
+			if f.dir != "" {
+				if !strings.HasPrefix(name, f.dir+"/") {
+					continue
+				}
+				name = name[len(f.dir)+1:]
+			}
+			ignored = f.attrs.ExportIgnore(name, ignored)
+			set = f.attrs.Category(name, set)
+			kept = f.attrs.Category(name, kept)
+		}
+		if ignored {
+			delete(rw.tree, k)
+			continue
+		}
+		loc.attrCategory, loc.detectedCategory = set, kept
+		rw.tree[k] = loc
+	}
+	return nil
+}
+
 func (r *repoWalker) tryHandleSubmodule(p string, id *plumbing.Hash) error {
 	err := r.handleSubmodule(p, id)
 	if r.ignoreMissingSubmodules && err != nil {
@@ -141,6 +244,11 @@ func (r *repoWalker) handleSubmodule(p string, id *plumbing.Hash) error {
 	if err != nil {
 		return err
 	}
+	if rewritten := r.submoduleConfig.rewriteURL(subURL.String()); rewritten != subURL.String() {
+		if subURL, err = url.Parse(rewritten); err != nil {
+			return err
+		}
+	}
 
 	subRepo, err := r.repoCache.Open(subURL)
 	if err != nil {
@@ -158,7 +266,7 @@ func (r *repoWalker) handleSubmodule(p string, id *plumbing.Hash) error {
 
 	r.subRepoVersions[p] = *id
 
-	subTree, subVersions, err := TreeToFiles(subRepo, tree, subURL.String(), r.repoCache)
+	subTree, subVersions, err := treeToFiles(subRepo, tree, subURL.String(), r.repoCache, r.submoduleConfig, path.Join(r.subPath, p))
 	if err != nil {
 		return err
 	}
@@ -176,7 +284,7 @@ func (r *repoWalker) handleSubmodule(p string, id *plumbing.Hash) error {
 }
 
 func (r *repoWalker) handleEntry(p string, e *object.TreeEntry) error {
-	if e.Mode == filemode.Submodule && r.repoCache != nil {
+	if e.Mode == filemode.Submodule && r.repoCache != nil && r.submoduleConfig.selected(path.Join(r.subPath, p)) {
 		if err := r.tryHandleSubmodule(p, &e.Hash); err != nil {
 			return fmt.Errorf("submodule %s: %v", p, err)
 		}
@@ -192,8 +300,11 @@ func (r *repoWalker) handleEntry(p string, e *object.TreeEntry) error {
 		Path: p,
 		ID:   e.Hash,
 	}] = BlobLocation{
-		Repo: r.repo,
-		URL:  r.repoURL,
+		Repo:       r.repo,
+		URL:        r.repoURL,
+		Executable: e.Mode == filemode.Executable,
+
+		detectedCategory: allCategories,
 	}
 	return nil
 }
@@ -214,6 +325,24 @@ func (k *fileKey) FullPath() string {
 type BlobLocation struct {
 	Repo *git.Repository
 	URL  *url.URL
+
+	// Executable is set if the tree entry of the blob has the
+	// executable mode.
+	Executable bool
+
+	// attrCategory holds the categories set by the linguist
+	// attributes of the file, and detectedCategory those left to
+	// build.DetectCategory.
+	attrCategory, detectedCategory zoekt.FileCategory
+}
+
+// allCategories has every bit of a zoekt.FileCategory set.
+const allCategories = ^zoekt.FileCategory(0)
+
+// Category returns the categories of the file name with the given
+// content, following its linguist attributes where they have any.
+func (l *BlobLocation) Category(name string, content []byte) zoekt.FileCategory {
+	return l.attrCategory | build.DetectCategory(name, content)&l.detectedCategory
 }
 
 func (l *BlobLocation) Blob(id *plumbing.Hash) ([]byte, error) {
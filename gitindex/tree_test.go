@@ -17,6 +17,7 @@ package gitindex
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"net/url"
@@ -25,13 +26,16 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
 	"github.com/google/zoekt/query"
 	"github.com/google/zoekt/shards"
 
+	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
@@ -251,6 +255,56 @@ func TestSubmoduleIndex(t *testing.T) {
 	}
 }
 
+func TestSubmoduleIndexConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := createSubmoduleRepo(dir); err != nil {
+		t.Fatalf("createSubmoduleRepo: %v", err)
+	}
+
+	for _, c := range []struct {
+		config SubmoduleConfig
+		want   string
+	}{
+		{SubmoduleConfig{}, "gerrit.googlesource.com/bdir"},
+		{SubmoduleConfig{URLRewrites: map[string]string{
+			"http://gerrit.googlesource.com/": "http://gerrit.googlesource.com/sub/",
+		}}, "gerrit.googlesource.com/sub/bdir"},
+		{SubmoduleConfig{Include: []string{"other"}}, ""},
+		{SubmoduleConfig{Exclude: []string{"bn*"}}, ""},
+	} {
+		indexDir := t.TempDir()
+		opts := Options{
+			RepoDir:         filepath.Join(dir, "gerrit.googlesource.com", "adir.git"),
+			BuildOptions:    build.Options{IndexDir: indexDir},
+			BranchPrefix:    "refs/heads/",
+			Branches:        []string{"master"},
+			Submodules:      true,
+			SubmoduleConfig: c.config,
+			RepoCacheDir:    dir,
+		}
+		if err := IndexGitRepo(opts); err != nil {
+			t.Fatalf("IndexGitRepo: %v", err)
+		}
+
+		searcher, err := shards.NewDirectorySearcher(indexDir)
+		if err != nil {
+			t.Fatal("NewDirectorySearcher", err)
+		}
+		results, err := searcher.Search(context.Background(), &query.Substring{Pattern: "bcont"}, &zoekt.SearchOptions{})
+		searcher.Close()
+		if err != nil {
+			t.Fatal("Search", err)
+		}
+		got := ""
+		if len(results.Files) > 0 {
+			got = results.Files[0].SubRepositoryName
+		}
+		if got != c.want {
+			t.Errorf("%+v: got submodule %q, want %q", c.config, got, c.want)
+		}
+	}
+}
+
 func TestAllowMissingBranch(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -376,6 +430,50 @@ func TestBranchWildcard(t *testing.T) {
 	}
 }
 
+func TestExpandBranches(t *testing.T) {
+	dir := t.TempDir()
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+	repo, err := git.PlainOpen(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatalf("PlainOpen: %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	def := head.Name().Short()
+
+	for in, want := range map[string][]string{
+		"HEAD," + def:                 {def},
+		"branchdir/?,c":               {"branchdir/a", "branchdir/b", "c"},
+		"c,branchdir/[b-z],branch*/*": {"c", "branchdir/b", "branchdir/a"},
+		"nonexist,HEAD":               {"nonexist", def},
+	} {
+		got, err := expandBranches(repo, strings.Split(in, ","), "refs/heads/")
+		if err != nil {
+			t.Fatalf("expandBranches(%s): %v", in, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expandBranches(%s) = %v, want %v", in, got, want)
+		}
+	}
+
+	// Indexing fails if none of the branches exist, even when missing
+	// branches are allowed.
+	opts := Options{
+		RepoDir:            filepath.Join(dir, "repo"),
+		BuildOptions:       build.Options{IndexDir: t.TempDir(), RepositoryDescription: zoekt.Repository{Name: "repo"}},
+		BranchPrefix:       "refs/heads/",
+		Branches:           []string{"main", "trunk-*"},
+		AllowMissingBranch: true,
+	}
+	if err := IndexGitRepo(opts); err == nil {
+		t.Errorf("IndexGitRepo without any branch succeeded")
+	}
+}
+
 func TestSkipSubmodules(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -477,3 +575,332 @@ func TestUniq(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestWorktree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo committed > afile
+echo deleted > bfile
+git add afile bfile
+git commit -am amsg
+
+echo modified > afile
+rm bfile
+echo staged > cfile
+git add cfile
+echo untracked > dfile
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+	}
+	opts := Options{
+		RepoDir:      filepath.Join(dir, "repo"),
+		BuildOptions: buildOpts,
+		Worktree:     true,
+		Incremental:  true,
+	}
+
+	contents := func() map[string]string {
+		searcher, err := shards.NewDirectorySearcher(indexDir)
+		if err != nil {
+			t.Fatal("NewDirectorySearcher", err)
+		}
+		defer searcher.Close()
+
+		res, err := searcher.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{Whole: true})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		got := map[string]string{}
+		for _, f := range res.Files {
+			got[f.FileName] = string(f.Content)
+		}
+		return got
+	}
+
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	want := map[string]string{
+		"afile": "modified\n",
+		"cfile": "staged\n",
+	}
+	if got := contents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	fs, err := filepath.Glob(filepath.Join(indexDir, "*.zoekt"))
+	if err != nil || len(fs) != 1 {
+		t.Fatalf("got shards %v (%v), want 1", fs, err)
+	}
+	before, err := os.Stat(fs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	if after, err := os.Stat(fs[0]); err != nil {
+		t.Fatal(err)
+	} else if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("unchanged worktree was indexed again")
+	}
+
+	opts.WorktreeStaged = true
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	want = map[string]string{
+		"afile": "committed\n",
+		"bfile": "deleted\n",
+		"cfile": "staged\n",
+	}
+	if got := contents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("staged: got %v, want %v", got, want)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	dir := t.TempDir()
+	script := `mkdir repo
+cd repo
+git init
+echo "#!/bin/sh" > run.sh
+chmod +x run.sh
+echo plain > afile
+git add run.sh afile
+GIT_COMMITTER_DATE="2020-01-02T03:04:05Z" git commit -am amsg
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir := t.TempDir()
+	opts := Options{
+		RepoDir: filepath.Join(dir, "repo"),
+		BuildOptions: build.Options{
+			IndexDir: indexDir,
+			RepositoryDescription: zoekt.Repository{
+				Name: "repo",
+			},
+		},
+		Branches: []string{"HEAD"},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewDirectorySearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewDirectorySearcher", err)
+	}
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range res.Files {
+		got[f.FileName] = fmt.Sprintf("%d %v %s", f.Size, f.Executable, f.ModTime.UTC().Format(time.RFC3339))
+	}
+	want := map[string]string{
+		"run.sh": "10 true 2020-01-02T03:04:05Z",
+		"afile":  "6 false 2020-01-02T03:04:05Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestGitAttributes(t *testing.T) {
+	dir := t.TempDir()
+	script := `mkdir repo
+cd repo
+git init
+mkdir -p gen dist lib/sub
+printf 'gen/** linguist-generated\ndist/** export-ignore\n*.dep.js linguist-vendored\n' > .gitattributes
+printf 'keep.js -export-ignore\n' > dist/.gitattributes
+printf '*.go -linguist-generated\n' > gen/.gitattributes
+echo needle > gen/api.pb.go
+echo needle > gen/schema.json
+echo needle > dist/bundle.js
+echo needle > dist/keep.js
+echo needle > lib/sub/app.dep.js
+echo needle > main.go
+git add .
+git commit -am amsg
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir := t.TempDir()
+	opts := Options{
+		RepoDir: filepath.Join(dir, "repo"),
+		BuildOptions: build.Options{
+			IndexDir: indexDir,
+			RepositoryDescription: zoekt.Repository{
+				Name: "repo",
+			},
+		},
+		Branches: []string{"HEAD"},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewDirectorySearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewDirectorySearcher", err)
+	}
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got := map[string]zoekt.FileCategory{}
+	for _, f := range res.Files {
+		got[f.FileName] = f.Category
+	}
+	want := map[string]zoekt.FileCategory{
+		"gen/api.pb.go":      0,
+		"gen/schema.json":    zoekt.FileCategoryGenerated,
+		"dist/keep.js":       0,
+		"lib/sub/app.dep.js": zoekt.FileCategoryVendored,
+		"main.go":            0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLFSFetch(t *testing.T) {
+	dir := t.TempDir()
+	object := []byte("needle in a large file\n")
+	p := build.LFSPointer{OID: fmt.Sprintf("%x", sha256.Sum256(object)), Size: int64(len(object))}
+	script := `mkdir repo
+cd repo
+git init
+cat > big.txt
+git add big.txt
+git commit -am amsg
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(p.Bytes())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+	fn := build.LFSObjectPath(filepath.Join(dir, "repo", ".git", "lfs", "objects"), p)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, object, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	indexDir := t.TempDir()
+	opts := Options{
+		RepoDir: filepath.Join(dir, "repo"),
+		BuildOptions: build.Options{
+			IndexDir: indexDir,
+			RepositoryDescription: zoekt.Repository{
+				Name: "repo",
+			},
+			LFSPointers: build.LFSPointersFetch,
+		},
+		Branches: []string{"HEAD"},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewDirectorySearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewDirectorySearcher", err)
+	}
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "big.txt" {
+		t.Errorf("got %v, want a match in big.txt", res.Files)
+	}
+}
+
+func TestFileNamesOnlyAbove(t *testing.T) {
+	dir := t.TempDir()
+	script := `mkdir repo
+cd repo
+git init
+echo needle in a haystack > afile
+git add afile
+git commit -am amsg
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	for above, wantFiles := range map[int64]int{5: 0, 1000: 1} {
+		indexDir := t.TempDir()
+		opts := Options{
+			RepoDir: filepath.Join(dir, "repo"),
+			BuildOptions: build.Options{
+				IndexDir: indexDir,
+				RepositoryDescription: zoekt.Repository{
+					Name: "repo",
+				},
+			},
+			Branches:           []string{"HEAD"},
+			FileNamesOnlyAbove: above,
+		}
+		if err := IndexGitRepo(opts); err != nil {
+			t.Fatalf("IndexGitRepo: %v", err)
+		}
+
+		searcher, err := shards.NewDirectorySearcher(indexDir)
+		if err != nil {
+			t.Fatal("NewDirectorySearcher", err)
+		}
+		res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+		searcher.Close()
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) != wantFiles {
+			t.Errorf("above %d: got %d files, want %d", above, len(res.Files), wantFiles)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+)
+
+// WorktreeBranch is the branch name under which a working tree is
+// indexed.
+const WorktreeBranch = "HEAD"
+
+// worktreeFile is a file tracked in the git index.
+type worktreeFile struct {
+	entry *index.Entry
+
+	// Stat of the file in the working tree, or nil if it was
+	// deleted.
+	fi os.FileInfo
+}
+
+// worktreeFiles lists the regular files tracked in the git index of
+// repo, along with a version that changes whenever the index or the
+// working tree files change. If staged is set, only the index is
+// taken into account.
+func worktreeFiles(repo *git.Repository, root string, staged bool) ([]worktreeFile, string, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, "", err
+	}
+
+	head := "none"
+	if ref, err := repo.Head(); err == nil {
+		head = ref.Hash().String()
+	}
+
+	h := sha1.New()
+	var files []worktreeFile
+	for _, e := range idx.Entries {
+		switch e.Mode {
+		case filemode.Regular, filemode.Executable:
+		default:
+			continue
+		}
+		// Skip unresolved conflicts and files that are
+		// announced but not added. Merged entries are decoded
+		// as stage 0, not index.Merged.
+		if e.Stage != 0 || e.IntentToAdd {
+			continue
+		}
+
+		f := worktreeFile{entry: e}
+		fmt.Fprintf(h, "%s\x00%s\x00", e.Name, e.Hash)
+		if !staged {
+			fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(e.Name)))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, "", err
+			}
+			if err == nil && fi.Mode().IsRegular() {
+				f.fi = fi
+				fmt.Fprintf(h, "%d\x00%d\x00", fi.Size(), fi.ModTime().UnixNano())
+			} else {
+				fmt.Fprintf(h, "deleted\x00")
+			}
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].entry.Name < files[j].entry.Name
+	})
+
+	mode := "worktree"
+	if staged {
+		mode = "staged"
+	}
+	return files, fmt.Sprintf("%s+%s.%x", head, mode, h.Sum(nil)[:6]), nil
+}
+
+// indexWorktree indexes the checked-out working tree of repo as
+// branch WorktreeBranch. Uncommitted changes are included; see
+// Options.Worktree.
+func indexWorktree(ctx context.Context, repo *git.Repository, opts Options) error {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("gitindex: worktree: %v", err)
+	}
+	root := wt.Filesystem.Root()
+
+	files, version, err := worktreeFiles(repo, root, opts.WorktreeStaged)
+	if err != nil {
+		return err
+	}
+
+	opts.BuildOptions.RepositoryDescription.Branches = []zoekt.RepositoryBranch{{
+		Name:    WorktreeBranch,
+		Version: version,
+	}}
+	if opts.Incremental {
+		versions := opts.BuildOptions.IndexVersions()
+		if reflect.DeepEqual(versions, opts.BuildOptions.RepositoryDescription.Branches) {
+			return nil
+		}
+	}
+
+	builder, err := build.NewBuilderContext(ctx, opts.BuildOptions)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		doc, err := worktreeDocument(repo, root, f, &opts)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			continue
+		}
+		if err := builder.Add(*doc); err != nil {
+			return err
+		}
+	}
+	return builder.Finish()
+}
+
+// worktreeDocument returns the document for f, or nil if the file
+// was deleted from the working tree.
+func worktreeDocument(repo *git.Repository, root string, f worktreeFile, opts *Options) (*zoekt.Document, error) {
+	doc := &zoekt.Document{
+		Name:       f.entry.Name,
+		Branches:   []string{WorktreeBranch},
+		Size:       int64(f.entry.Size),
+		Executable: f.entry.Mode == filemode.Executable,
+		ModTime:    f.entry.ModifiedAt,
+	}
+
+	if !opts.WorktreeStaged {
+		if f.fi == nil {
+			return nil, nil
+		}
+		doc.Size = f.fi.Size()
+		doc.Executable = f.fi.Mode().IsRegular() && f.fi.Mode()&0111 != 0
+		doc.ModTime = f.fi.ModTime()
+	}
+	if doc.Size > int64(opts.BuildOptions.SizeMax) {
+		doc.SkipReason = fmt.Sprintf("file size %d exceeds maximum size %d", doc.Size, opts.BuildOptions.SizeMax)
+		return doc, nil
+	}
+
+	if opts.WorktreeStaged {
+		blob, err := repo.BlobObject(f.entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if doc.Content, err = blobContents(blob); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(f.entry.Name)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	doc.Content = content
+	return doc, nil
+}
@@ -133,7 +133,16 @@ func (d *indexData) trigramHitIterator(ng ngram, caseSensitive, fileName bool) (
 		if err != nil {
 			return nil, err
 		}
-		if len(blob) > 0 {
+		if len(blob) == 0 {
+			continue
+		}
+		if d.metaData.PostingEncoding == PostingEncodingRoaring {
+			it, err := newRoaringPostingIterator(blob, v)
+			if err != nil {
+				return nil, err
+			}
+			iters = append(iters, it)
+		} else {
 			iters = append(iters, newCompressedPostingIterator(blob, v))
 		}
 	}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ignore matches file names against gitignore-style
+// patterns, to exclude vendored, generated or minified files from
+// the index.
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FileName is the name of the file, at the root of a repository,
+// that holds the patterns of files not to index.
+const FileName = ".zoektignore"
+
+// rule is a single pattern.
+type rule struct {
+	re *regexp.Regexp
+
+	// If set, the pattern started with "!" and re-includes files.
+	negate bool
+
+	// If set, the pattern ended in "/" and only matches directories.
+	dirOnly bool
+}
+
+// Matcher decides which files are ignored. The zero value ignores
+// nothing.
+type Matcher struct {
+	rules []rule
+}
+
+// New returns a Matcher for patterns, which use the syntax of
+// .gitignore files:
+//
+//   - "*" matches within a path component, "?" matches one
+//     character other than "/", and "**" matches across components.
+//   - A pattern without "/" matches files or directories of that
+//     name anywhere; otherwise it is relative to the root.
+//   - A pattern ending in "/" only matches directories.
+//   - A pattern starting with "!" re-includes files excluded by an
+//     earlier pattern.
+//
+// Files in an ignored directory are ignored. Blank patterns and
+// patterns starting with "#" are skipped.
+func New(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, p := range patterns {
+		if err := m.add(p); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Parse reads patterns, one per line, from the content of an ignore
+// file.
+func Parse(content []byte) (*Matcher, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return New(patterns)
+}
+
+func (m *Matcher) add(pattern string) error {
+	p := strings.TrimRight(pattern, " \t\r")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return nil
+	}
+
+	var r rule
+	if strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return fmt.Errorf("ignore pattern %q matches nothing", pattern)
+	}
+
+	re, err := regexp.Compile(globToRegexp(p, anchored))
+	if err != nil {
+		return fmt.Errorf("ignore pattern %q: %v", pattern, err)
+	}
+	r.re = re
+	m.rules = append(m.rules, r)
+	return nil
+}
+
+// Merge adds the patterns of o after those of m, so they take
+// precedence.
+func (m *Matcher) Merge(o *Matcher) {
+	if o != nil {
+		m.rules = append(m.rules, o.rules...)
+	}
+}
+
+// Match returns whether the file at path, relative to the root of
+// the repository, is ignored.
+func (m *Matcher) Match(path string) bool {
+	if m == nil || len(m.rules) == 0 {
+		return false
+	}
+
+	// A file is ignored if it or one of its directories is; the
+	// directories take precedence, as git does not descend into
+	// ignored directories.
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && m.match(path[:i], true) {
+			return true
+		}
+	}
+	return m.match(path, false)
+}
+
+// match returns the result of the last rule that matches path.
+func (m *Matcher) match(path string, isDir bool) bool {
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(path) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// globToRegexp translates a glob into an anchored regular
+// expression. Unless anchored, the glob may match the last
+// components of a path.
+func globToRegexp(glob string, anchored bool) string {
+	var b strings.Builder
+	if anchored {
+		b.WriteString("^")
+	} else {
+		b.WriteString("(?:^|/)")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ignore
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	m, err := Parse([]byte(`# generated code
+vendor/
+*.min.js
+/docs/*.pdf
+third_party/**/testdata
+!vendor.go
+*.pb.go
+!keep.pb.go
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]bool{
+		"main.go":                        false,
+		"vendor/x/y.go":                  true,
+		"a/vendor/x.go":                  true,
+		"vendor.go":                      false,
+		"vendor":                         false,
+		"static/app.min.js":              true,
+		"static/app.js":                  false,
+		"docs/manual.pdf":                true,
+		"docs/sub/manual.pdf":            false,
+		"a/docs/manual.pdf":              false,
+		"third_party/a/b/testdata/x.txt": true,
+		"third_party/testdata/x.txt":     true,
+		"api/api.pb.go":                  true,
+		"api/keep.pb.go":                 false,
+	} {
+		if got := m.Match(path); got != want {
+			t.Errorf("Match(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	m, _ := New([]string{"*.js"})
+	o, _ := New([]string{"!keep.js"})
+	m.Merge(o)
+	if !m.Match("a.js") || m.Match("keep.js") {
+		t.Errorf("merged matcher: got a.js %v, keep.js %v", m.Match("a.js"), m.Match("keep.js"))
+	}
+
+	var nilMatcher *Matcher
+	if nilMatcher.Match("a.js") {
+		t.Error("nil Matcher ignores files")
+	}
+}
+
+func TestNewError(t *testing.T) {
+	if _, err := New([]string{"/"}); err == nil {
+		t.Error("New(\"/\") succeeded")
+	}
+}
@@ -18,10 +18,16 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp/syntax"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kylelemons/godebug/pretty"
 
@@ -34,6 +40,9 @@ func clearScores(r *SearchResult) {
 		for j := range r.Files[i].LineMatches {
 			r.Files[i].LineMatches[j].Score = 0.0
 		}
+		for j := range r.Files[i].ChunkMatches {
+			r.Files[i].ChunkMatches[j].Score = 0.0
+		}
 		r.Files[i].Checksum = nil
 		r.Files[i].Debug = ""
 	}
@@ -140,12 +149,12 @@ func (s *memSeeker) Name() string {
 }
 
 func (s *memSeeker) Close() {}
-func (s *memSeeker) Read(off, sz uint32) ([]byte, error) {
+func (s *memSeeker) Read(off, sz uint64) ([]byte, error) {
 	return s.data[off : off+sz], nil
 }
 
-func (s *memSeeker) Size() (uint32, error) {
-	return uint32(len(s.data)), nil
+func (s *memSeeker) Size() (uint64, error) {
+	return uint64(len(s.data)), nil
 }
 
 func TestNewlines(t *testing.T) {
@@ -157,12 +166,15 @@ func TestNewlines(t *testing.T) {
 	matches := sres.Files
 	want := []FileMatch{{
 		FileName: "filename",
+		Size:     15,
 		LineMatches: []LineMatch{
 			{
 				LineFragments: []LineFragmentMatch{{
 					Offset:      8,
 					LineOffset:  2,
 					MatchLength: 3,
+					Column:      3,
+					MatchRunes:  3,
 				}},
 				Line:       []byte("line2"),
 				LineStart:  6,
@@ -378,6 +390,8 @@ func TestFileSearch(t *testing.T) {
 			Offset:      1,
 			LineOffset:  1,
 			MatchLength: 4,
+			Column:      2,
+			MatchRunes:  4,
 		}},
 		FileName: true,
 	}
@@ -726,6 +740,83 @@ func TestBranchVersions(t *testing.T) {
 	}
 }
 
+func TestRepoBranches(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name: "repo",
+		Branches: []RepositoryBranch{
+			{"master", "v-master"},
+			{"release-1.2", "v-release"},
+			{"release-1.3", "v-release13"},
+		},
+	}, Document{Name: "f1", Content: []byte("needle"), Branches: []string{"master"}},
+		Document{Name: "f2", Content: []byte("needle"), Branches: []string{"master", "release-1.2", "release-1.3"}},
+		Document{Name: "f3", Content: []byte("needle"), Branches: []string{"release-1.3"}},
+	)
+
+	for _, c := range []struct {
+		set  map[string][]string
+		want []string
+	}{
+		{map[string][]string{"repo": {"release-1.2"}}, []string{"f2:release-1.2"}},
+		{map[string][]string{"repo": {"HEAD"}}, []string{"f1:master", "f2:master"}},
+		{map[string][]string{"repo": {"release-1.2", "release-1.3"}}, []string{"f2:release-1.2,release-1.3", "f3:release-1.3"}},
+		{map[string][]string{"repo": {"release"}}, nil},
+		{map[string][]string{"other": {"master"}}, nil},
+	} {
+		sres := searchForTest(t, b, query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.RepoBranches{Set: c.set}))
+		var got []string
+		for _, f := range sres.Files {
+			got = append(got, f.FileName+":"+strings.Join(f.Branches, ","))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %v, want %v", c.set, got, c.want)
+		}
+	}
+
+	searcher := searcherForTest(t, b)
+	rl, err := searcher.List(context.Background(), &query.RepoBranches{Set: map[string][]string{"repo": {"master"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.Repos) != 1 {
+		t.Errorf("got %v, want 1 repo", rl.Repos)
+	}
+}
+
+func TestRepoCommit(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name: "repo",
+		Branches: []RepositoryBranch{
+			{"master", "abc"},
+			{"stable", "def"},
+		},
+	}, Document{Name: "f1", Content: []byte("needle"), Branches: []string{"master"}},
+		Document{Name: "f2", Content: []byte("needle"), Branches: []string{"stable"}},
+	)
+
+	for commit, want := range map[string]string{
+		"abc": "f1",
+		"def": "f2",
+		"xyz": "",
+	} {
+		sres := searchForTest(t, b, query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.RepoCommit{Repo: "repo", Commit: commit}))
+		var got string
+		if len(sres.Files) > 1 {
+			t.Fatalf("%s: got %v, want at most 1 file", commit, sres.Files)
+		} else if len(sres.Files) == 1 {
+			got = sres.Files[0].FileName
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", commit, got, want)
+		}
+	}
+}
+
 func mustParseRE(s string) *syntax.Regexp {
 	r, err := syntax.Parse(s, 0)
 	if err != nil {
@@ -758,6 +849,8 @@ func TestRegexp(t *testing.T) {
 			LineOffset:  3,
 			Offset:      3,
 			MatchLength: 11,
+			Column:      4,
+			MatchRunes:  11,
 		}},
 		Line:       content,
 		FileName:   false,
@@ -811,6 +904,30 @@ func TestRegexpOrder(t *testing.T) {
 	}
 }
 
+func TestRegexpAlternation(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("a foobaz here")},
+		Document{Name: "f2", Content: []byte("a barbaz here")},
+		Document{Name: "f3", Content: []byte("foo and baz, bar and baz")},
+		Document{Name: "f4", Content: []byte("colour and color")})
+
+	for re, want := range map[string][]string{
+		"(foo|bar)baz": {"f1", "f2"},
+		"colou?r":      {"f4"},
+		"ba[rz]{2}":    {},
+	} {
+		sres := searchForTest(t, b, &query.Regexp{Regexp: mustParseRE(re)})
+		var got []string
+		for _, f := range sres.Files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Errorf("%s: got %v, want %v", re, got, want)
+		}
+	}
+}
+
 func TestRepoName(t *testing.T) {
 	content := []byte("bla the needle")
 	// ----------------01234567890123
@@ -841,6 +958,111 @@ func TestRepoName(t *testing.T) {
 	}
 }
 
+func TestRepoRegexp(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "github.com/org/repo"},
+		Document{Name: "f1", Content: []byte("needle")})
+
+	for glob, want := range map[string]int{
+		"github.com/org/*":  1,
+		"github.com/*/repo": 1,
+		"github.com/*":      0,
+		"gitlab.com/org/*":  0,
+		"*.com/org/repo":    1,
+	} {
+		q, err := query.Parse("needle repo:" + glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sres := searchForTest(t, b, q); len(sres.Files) != want {
+			t.Errorf("%s: got %v, want %d matches", glob, sres.Files, want)
+		}
+	}
+}
+
+func TestRepoFlag(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repo", Archived: true},
+		Document{Name: "f1", Content: []byte("needle")})
+
+	for q, want := range map[string]int{
+		"needle":                        1,
+		"needle archived:yes":           1,
+		"needle archived:only":          1,
+		"needle archived:no":            0,
+		"needle fork:only":              0,
+		"needle fork:no":                1,
+		"needle archived:no or fork:no": 1,
+	} {
+		parsed, err := query.Parse(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sres := searchForTest(t, b, parsed)
+		if len(sres.Files) != want {
+			t.Errorf("%s: got %v, want %d matches", q, sres.Files, want)
+		}
+		if want == 0 && sres.Stats.FilesConsidered > 0 {
+			t.Errorf("%s: got FilesConsidered %d, should have short circuited", q, sres.Stats.FilesConsidered)
+		}
+	}
+}
+
+func TestNegatedFileNameSkipsDocuments(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "vendor/a.go", Content: []byte("needle")},
+		Document{Name: "vendor/b.go", Content: []byte("needle")},
+		Document{Name: "main.go", Content: []byte("needle")})
+
+	for _, q := range []query.Q{
+		query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.Not{Child: &query.Substring{Pattern: "vendor/", FileName: true}}),
+		query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.Not{Child: &query.Regexp{Regexp: mustParseRE("^vendor"), FileName: true}}),
+	} {
+		sres := searchForTest(t, b, q)
+		if len(sres.Files) != 1 || sres.Files[0].FileName != "main.go" {
+			t.Errorf("%s: got %v, want main.go", q, sres.Files)
+		}
+		if sres.Stats.FilesConsidered != 1 {
+			t.Errorf("%s: got FilesConsidered %d, want 1", q, sres.Stats.FilesConsidered)
+		}
+	}
+}
+
+func TestRepoMetadataAtoms(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name:        "repo",
+		Description: "A fast Compiler",
+		Topics:      []string{"Go", "tools"},
+	}, Document{Name: "f1", Content: []byte("needle")})
+
+	for q, want := range map[string]int{
+		"needle repo.desc:compiler": 1,
+		"needle repo.desc:database": 0,
+		"needle topic:go":           1,
+		"needle topic:tool":         0,
+		"needle -topic:tools":       0,
+	} {
+		parsed, err := query.Parse(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sres := searchForTest(t, b, parsed); len(sres.Files) != want {
+			t.Errorf("%s: got %v, want %d matches", q, sres.Files, want)
+		}
+	}
+
+	searcher := searcherForTest(t, b)
+	rl, err := searcher.List(context.Background(), &query.Topic{Topic: "tools"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.Repos) != 1 || rl.Repos[0].Repository.Description != "A fast Compiler" {
+		t.Errorf("got %v, want repo with description", rl.Repos)
+	}
+}
+
 func TestMergeMatches(t *testing.T) {
 	content := []byte("blablabla")
 	b := testIndexBuilder(t, nil,
@@ -971,6 +1193,76 @@ func TestSymbolRank(t *testing.T) {
 	}
 }
 
+func TestDocRank(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle")},
+		Document{Name: "f2", Content: []byte("needle"), Rank: 0.9},
+		Document{Name: "f3", Content: []byte("needle")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	if len(res.Files) != 3 {
+		t.Fatalf("got %d files, want 3 files. Full data: %v", len(res.Files), res.Files)
+	}
+	if res.Files[0].FileName != "f2" {
+		t.Errorf("got %#v, want 'f2' as top match", res.Files[0])
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle"},
+		SearchOptions{ScoreWeights: ScoreWeights{DocRank: 1e-6}})
+	if res.Files[0].FileName != "f1" {
+		t.Errorf("got %#v, want 'f1' as top match without doc rank", res.Files[0])
+	}
+}
+
+func TestDocRankOutOfRange(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "f1", Rank: 2}); err == nil {
+		t.Errorf("Add succeeded for rank 2")
+	}
+}
+
+func TestSymbolWeight(t *testing.T) {
+	content := []byte("func bla() blubxxxxx")
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: content,
+		}, Document{
+			Name:    "f2",
+			Content: content,
+			Symbols: []DocumentSection{{5, 8}},
+		})
+
+	searcher := searcherForTest(t, b)
+	score := func(weights ScoreWeights) float64 {
+		res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "bla"},
+			&SearchOptions{ScoreWeights: weights})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Files[0].FileName != "f2" {
+			t.Fatalf("got %#v, want 'f2' as top match", res.Files[0])
+		}
+		return res.Files[0].Score
+	}
+
+	base := score(ScoreWeights{})
+	if got := score(ScoreWeights{Symbol: 2}); math.Abs(got-base-scoreSymbol) > 1e-6 {
+		t.Errorf("got score %f, want %f", got, base+scoreSymbol)
+	}
+}
+
+func TestScoreWeightsDefaults(t *testing.T) {
+	got := ScoreWeights{Symbol: 2, Category: 0.5}.withDefaults()
+	want := ScoreWeights{FileName: 1, Symbol: 2, DocRank: 1, Category: 0.5}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
 func TestSymbolRankRegexpUTF8(t *testing.T) {
 	prefix := strings.Repeat(string([]rune{kelvinCodePoint}), 100) + "\n"
 	content := []byte(prefix +
@@ -1102,6 +1394,62 @@ func TestMetadata(t *testing.T) {
 	}
 }
 
+func TestReadShardInfo(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name:     "reponame",
+		Branches: []RepositoryBranch{{Name: "main", Version: "v1"}},
+	}, Document{Name: "f1", Content: []byte("needle haystack"), Branches: []string{"main"},
+		Symbols: []DocumentSection{{0, 6}}},
+		Document{Name: "f2", Content: []byte("banana"), Branches: []string{"main"}})
+
+	var buf bytes.Buffer
+	b.Write(&buf)
+	f := &memSeeker{buf.Bytes()}
+
+	info, err := ReadShardInfo(f)
+	if err != nil {
+		t.Fatalf("ReadShardInfo: %v", err)
+	}
+	if info.Repository != "reponame" || len(info.Branches) != 1 || info.Branches[0].Version != "v1" {
+		t.Errorf("got repo %q branches %v", info.Repository, info.Branches)
+	}
+	if info.Documents != 2 || info.Symbols != 1 {
+		t.Errorf("got %d documents, %d symbols, want 2, 1", info.Documents, info.Symbols)
+	}
+	if info.Ngrams == 0 || info.PostingBytes == 0 || info.MemoryBytes == 0 {
+		t.Errorf("got empty ngram statistics: %+v", info)
+	}
+	if info.DiskBytes != int64(buf.Len()) {
+		t.Errorf("got DiskBytes %d, want %d", info.DiskBytes, buf.Len())
+	}
+}
+
+func TestVerifyShard(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("needle haystack")},
+		Document{Name: "f2", Content: []byte("banana")})
+	var buf bytes.Buffer
+	b.Write(&buf)
+	data := buf.Bytes()
+
+	if err := VerifyShard(&memSeeker{data}); err != nil {
+		t.Fatalf("VerifyShard: %v", err)
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[bytes.Index(flipped, []byte("needle"))] = 'N'
+	if err := VerifyShard(&memSeeker{flipped}); ErrorCodeOf(err) != CodeShardCorrupt {
+		t.Errorf("VerifyShard of modified shard: got %v, want CodeShardCorrupt", err)
+	}
+
+	// Truncation must be caught when loading, not when searching.
+	for _, n := range []int{0, 7, len(data) / 2, len(data) - 1} {
+		if _, err := NewSearcher(&memSeeker{data[:n]}); ErrorCodeOf(err) != CodeShardCorrupt {
+			t.Errorf("NewSearcher of %d bytes: got %v, want CodeShardCorrupt", n, err)
+		}
+	}
+}
+
 func TestOr(t *testing.T) {
 	b := testIndexBuilder(t, nil,
 		Document{Name: "f1", Content: []byte("needle")},
@@ -1843,3 +2191,1044 @@ func TestCheckText(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkMatches(t *testing.T) {
+	content := []byte("one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\n")
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: content})
+
+	q := &query.Regexp{Regexp: mustParseRE("two|four|eight"), Content: true}
+	res := searchForTest(t, b, q, SearchOptions{ChunkMatches: true, NumContextLines: 1})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 0 {
+		t.Fatalf("got %v, want 1 file with only chunk matches", res.Files)
+	}
+
+	chunks := res.Files[0].ChunkMatches
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].ContentStart.ByteOffset < chunks[j].ContentStart.ByteOffset
+	})
+
+	// "two" and "four" share context line "three", "eight" is
+	// separated by "six".
+	want := []ChunkMatch{{
+		Content:      []byte("one\ntwo\nthree\nfour\nfive"),
+		ContentStart: Location{ByteOffset: 0, LineNumber: 1, Column: 1},
+		Ranges: []Range{
+			{Start: Location{4, 2, 1}, End: Location{7, 2, 4}},
+			{Start: Location{14, 4, 1}, End: Location{18, 4, 5}},
+		},
+	}, {
+		Content:      []byte("seven\neight"),
+		ContentStart: Location{ByteOffset: 28, LineNumber: 7, Column: 1},
+		Ranges: []Range{
+			{Start: Location{34, 8, 1}, End: Location{39, 8, 6}},
+		},
+	}}
+	if !reflect.DeepEqual(chunks, want) {
+		t.Errorf("got %+v, want %+v", chunks, want)
+	}
+	if res.MatchCount != 3 {
+		t.Errorf("got MatchCount %d, want 3", res.MatchCount)
+	}
+}
+
+func TestFacets(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1.go", Content: []byte("needle needle"), Language: "Go"},
+		Document{Name: "f2.go", Content: []byte("needle\nneedle"), Language: "Go"},
+		Document{Name: "README", Content: []byte("needle haystack")},
+		Document{Name: "f3.go", Content: []byte("haystack")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{Facets: true})
+	want := map[string]*RepoMatchStats{
+		"reponame": {
+			FileCount:  3,
+			MatchCount: 4,
+			Languages:  map[string]int{"Go": 3, "": 1},
+			Extensions: map[string]int{".go": 3, "": 1},
+		},
+	}
+	if !reflect.DeepEqual(res.RepoStats, want) {
+		t.Errorf("got %v, want %v", pretty.Sprint(res.RepoStats), pretty.Sprint(want))
+	}
+}
+
+func TestCountOnly(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1.go", Content: []byte("needle needle"), Language: "Go"},
+		Document{Name: "f2.go", Content: []byte("needle\nneedle"), Language: "Go"},
+		Document{Name: "f3.go", Content: []byte("haystack")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", CaseSensitive: true}, SearchOptions{CountOnly: true})
+	if len(res.Files) != 0 {
+		t.Errorf("got files %v, want none", res.Files)
+	}
+	if res.FileCount != 2 || res.MatchCount != 4 {
+		t.Errorf("got %d files, %d matches, want 2 files, 4 matches", res.FileCount, res.MatchCount)
+	}
+	if st := res.RepoStats["reponame"]; st == nil || st.FileCount != 2 || st.MatchCount != 4 {
+		t.Errorf("got repo stats %v", pretty.Sprint(res.RepoStats))
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	content := []byte("a\r\nneedle one\r\nb\rneedle two\n")
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: content})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	fm := res.Files[0]
+	if fm.LineEnding != LineEndingMixed {
+		t.Errorf("got line ending %v, want mixed", fm.LineEnding)
+	}
+
+	lms := fm.LineMatches
+	sort.Slice(lms, func(i, j int) bool { return lms[i].LineNumber < lms[j].LineNumber })
+	var got []string
+	for _, lm := range lms {
+		got = append(got, fmt.Sprintf("%d:%q:%d-%d", lm.LineNumber, lm.Line, lm.LineStart, lm.LineFragments[0].Offset))
+	}
+	want := []string{
+		`2:"needle one":3-3`,
+		`4:"needle two":17-17`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "one", Content: true}, SearchOptions{ChunkMatches: true, NumContextLines: 1})
+	chunks := res.Files[0].ChunkMatches
+	if len(chunks) != 1 || string(chunks[0].Content) != "a\r\nneedle one\r\nb" {
+		t.Errorf("got chunks %+v", chunks)
+	}
+}
+
+func TestDetectLineEnding(t *testing.T) {
+	for in, want := range map[string]LineEnding{
+		"":             LineEndingLF,
+		"a":            LineEndingLF,
+		"a\nb\n":       LineEndingLF,
+		"a\r\nb\r\n":   LineEndingCRLF,
+		"a\rb\r":       LineEndingCR,
+		"a\r\nb\n":     LineEndingMixed,
+		"a\rb\n":       LineEndingMixed,
+		"\r\n\r\n\r\n": LineEndingCRLF,
+		"a\r\r\nb\r\n": LineEndingMixed,
+	} {
+		if got := detectLineEnding([]byte(in)); got != want {
+			t.Errorf("%q: got %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestDebugScore(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: []byte("func bla() blubxxxxx"),
+			Symbols: []DocumentSection{{5, 8}},
+		})
+
+	searcher := searcherForTest(t, b)
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "bla"}, &SearchOptions{DebugScore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := res.Files[0]
+	for _, want := range []string{"fragment(word:500.000000, symbol:7000.000000)", "atom:", "doc-order:", "doc-rank:"} {
+		if !strings.Contains(fm.Debug, want) {
+			t.Errorf("file debug %q does not contain %q", fm.Debug, want)
+		}
+	}
+	if want := "word:500.000000, symbol:7000.000000, line-order:1.000000"; fm.LineMatches[0].Debug != want {
+		t.Errorf("got line debug %q, want %q", fm.LineMatches[0].Debug, want)
+	}
+
+	res, err = searcher.Search(context.Background(), &query.Substring{Pattern: "bla"}, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files[0].Debug != "" || res.Files[0].LineMatches[0].Debug != "" {
+		t.Errorf("got debug output without DebugScore: %+v", res.Files[0])
+	}
+}
+
+func TestRegexpBudget(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle haystack")})
+	searcher := searcherForTest(t, b)
+
+	q := &query.Regexp{Regexp: mustParseRE("nee.le"), Content: true}
+	res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || res.RegexpsCompiled != 1 {
+		t.Errorf("got %d files, %d regexps compiled, want 1, 1", len(res.Files), res.RegexpsCompiled)
+	}
+
+	_, err = searcher.Search(context.Background(), q, &SearchOptions{MaxRegexpSize: 5})
+	if code := ErrorCodeOf(err); code != CodeQueryTooExpensive {
+		t.Errorf("got error %v (%v), want %v", err, code, CodeQueryTooExpensive)
+	}
+
+	// Zero means no limit.
+	big := &query.Regexp{Regexp: mustParseRE(strings.Repeat("(nee.le)?", 3000) + "haystack"), Content: true}
+	if res, err := searcher.Search(context.Background(), big, &SearchOptions{}); err != nil || len(res.Files) != 1 {
+		t.Errorf("got %v, %v for a large regexp without limit, want 1 file", res, err)
+	}
+}
+
+func TestCompileRegexps(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle haystack")})
+	searcher := searcherForTest(t, b)
+
+	q := &query.Regexp{Regexp: mustParseRE("nee.le"), Content: true}
+	var stats Stats
+	ctx, err := CompileRegexps(context.Background(), q, &SearchOptions{}, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RegexpsCompiled != 1 {
+		t.Errorf("got %d regexps compiled up front, want 1", stats.RegexpsCompiled)
+	}
+
+	res, err := searcher.Search(ctx, q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || res.RegexpsCompiled != 0 {
+		t.Errorf("got %d files, %d regexps compiled, want 1, 0", len(res.Files), res.RegexpsCompiled)
+	}
+}
+
+func TestTypeRepo(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("needle haystack")},
+		Document{Name: "f2", Content: []byte("needle needle")},
+		Document{Name: "f3", Content: []byte("needle")})
+
+	q := &query.Type{Child: &query.Substring{Pattern: "needle"}, Type: query.TypeRepo}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || res.Files[0].Repository != "reponame" || res.Files[0].FileName != "f1" {
+		t.Fatalf("got %v, want one match for reponame in f1", res.Files)
+	}
+	if res.Stats.FilesConsidered != 1 {
+		t.Errorf("got %d files considered, want 1", res.Stats.FilesConsidered)
+	}
+
+	q = &query.Type{Child: &query.Substring{Pattern: "nomatch"}, Type: query.TypeRepo}
+	if res := searchForTest(t, b, q); len(res.Files) != 0 {
+		t.Errorf("got %v, want no matches", res.Files)
+	}
+}
+
+func TestTypeFileName(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "needle.go", Content: []byte("haystack")},
+		Document{Name: "haystack.go", Content: []byte("needle")},
+		Document{Name: "main.go", Content: []byte("needle")})
+
+	q := &query.Type{
+		Child: query.NewAnd(&query.Substring{Pattern: "needle"}, &query.Regexp{Regexp: mustParseRE(`\.go$`)}),
+		Type:  query.TypeFileName,
+	}
+	res := searchForTest(t, b, q, SearchOptions{Whole: true})
+	if len(res.Files) != 1 || res.Files[0].FileName != "needle.go" {
+		t.Fatalf("got %v, want needle.go", res.Files)
+	}
+	for _, l := range res.Files[0].LineMatches {
+		if !l.FileName {
+			t.Errorf("got content match %v", l)
+		}
+	}
+	if res.Stats.ContentBytesLoaded != 0 || res.Files[0].Content != nil {
+		t.Errorf("loaded %d bytes of content, want 0", res.Stats.ContentBytesLoaded)
+	}
+
+	q = &query.Type{Child: &query.Substring{Pattern: "needle", Content: true}, Type: query.TypeFileName}
+	if _, err := searcherForTest(t, b).Search(context.Background(), q, &SearchOptions{}); ErrorCodeOf(err) != CodeQueryParse {
+		t.Errorf("got error %v for content atom, want %v", err, CodeQueryParse)
+	}
+}
+
+func TestWordSubstring(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("if err != nil { return errors.New(err) }")},
+		Document{Name: "f2", Content: []byte("no errors here")},
+		Document{Name: "f3", Content: []byte("x := a.b")})
+
+	for _, c := range []struct {
+		q    *query.Substring
+		want map[string]int
+	}{
+		{&query.Substring{Pattern: "err", Content: true, Word: true}, map[string]int{"f1": 2}},
+		{&query.Substring{Pattern: "ERR", Content: true, Word: true}, map[string]int{"f1": 2}},
+		{&query.Substring{Pattern: "errors", Content: true, Word: true}, map[string]int{"f1": 1, "f2": 1}},
+		{&query.Substring{Pattern: "rro", Content: true, Word: true}, map[string]int{}},
+		// Short patterns are evaluated as regexps.
+		{&query.Substring{Pattern: "a", Content: true, Word: true}, map[string]int{"f3": 1}},
+	} {
+		res := searchForTest(t, b, c.q)
+		got := map[string]int{}
+		for _, f := range res.Files {
+			for _, l := range f.LineMatches {
+				got[f.FileName] += len(l.LineFragments)
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+	}
+}
+
+func TestWordBoundary(t *testing.T) {
+	data := []byte("a.bc d")
+	for off, want := range []bool{true, true, true, false, true, true, true} {
+		if got := wordBoundary(data, uint32(off)); got != want {
+			t.Errorf("wordBoundary(%q, %d) = %v, want %v", data, off, got, want)
+		}
+	}
+}
+
+func TestSmartCaseOption(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle")},
+		Document{Name: "f2", Content: []byte("Needle")})
+
+	for _, c := range []struct {
+		pattern string
+		want    int
+	}{
+		{"needle", 2},
+		{"Needle", 1},
+	} {
+		q := &query.Substring{Pattern: c.pattern, Content: true, CaseSensitive: true}
+		if res := searchForTest(t, b, q, SearchOptions{SmartCase: true}); len(res.Files) != c.want {
+			t.Errorf("%s: got %d files, want %d", c.pattern, len(res.Files), c.want)
+		}
+	}
+}
+
+func TestUnicodeCaseFolding(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("the myth of ΣΊΣΥΦΟΣ")},
+		Document{Name: "f2", Content: []byte("300 Kelvin")})
+
+	for _, c := range []struct {
+		pattern string
+		want    string
+	}{
+		{"σίσυφος", "f1"},
+		{"kelvin", "f2"},
+		{"KELVIN", "f2"},
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: c.pattern, Content: true})
+		if len(res.Files) != 1 || res.Files[0].FileName != c.want {
+			t.Errorf("%s: got %v, want %s", c.pattern, res.Files, c.want)
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	var docs []Document
+	for _, n := range []string{"e", "b", "d", "a", "c", "f"} {
+		docs = append(docs, Document{Name: n, Content: []byte("needle")})
+	}
+	searcher := searcherForTest(t, testIndexBuilder(t, nil, docs...))
+
+	q := &query.Substring{Pattern: "needle"}
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(docs) {
+			t.Fatalf("too many pages: %v", got)
+		}
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{
+			MaxDocDisplayCount: 2,
+			Cursor:             cursor,
+		})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) > 2 {
+			t.Fatalf("got %d files, want at most 2", len(res.Files))
+		}
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		cursor = res.NextCursor
+	}
+	all, err := searcher.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	var want []string
+	for _, f := range all.Files {
+		want = append(want, f.FileName)
+	}
+	if len(want) != len(docs) || !reflect.DeepEqual(got, want) {
+		t.Errorf("got pages %v, want %v", got, want)
+	}
+
+	_, err = searcher.Search(context.Background(), q, &SearchOptions{Cursor: "bogus"})
+	if code := ErrorCodeOf(err); code != CodeQueryParse {
+		t.Errorf("got error %v (%s) for bad cursor, want %s", err, code, CodeQueryParse)
+	}
+}
+
+func TestFileCategory(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1.pb.go", Content: []byte("needle"), Category: FileCategoryGenerated},
+		Document{Name: "f2.go", Content: []byte("needle")},
+		Document{Name: "f3_test.go", Content: []byte("needle"), Category: FileCategoryTest | FileCategoryVendored})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, fmt.Sprintf("%s:%v", f.FileName, f.Category))
+	}
+	want := []string{"f2.go:none", "f1.pb.go:generated", "f3_test.go:vendored,test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	res = searchForTest(t, b, query.NewAnd(
+		&query.Substring{Pattern: "needle"},
+		&query.Not{Child: &query.FileCategory{Category: query.FileCategoryGenerated}}))
+	if len(res.Files) != 2 {
+		t.Errorf("got %v, want 2 files without generated", res.Files)
+	}
+
+	res = searchForTest(t, b, &query.FileCategory{Category: query.FileCategoryTest})
+	if len(res.Files) != 1 || res.Files[0].FileName != "f3_test.go" {
+		t.Errorf("got %v, want f3_test.go", res.Files)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := testIndexBuilder(t, nil,
+		Document{Name: "small", Content: []byte("needle"), Executable: true, ModTime: mtime},
+		Document{Name: "large", Content: []byte("needle" + strings.Repeat("x", 2000))},
+		Document{Name: "skipped", SkipReason: "too large", Size: 1 << 30})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	if len(res.Files) != 2 {
+		t.Fatalf("got %v, want 2 files", res.Files)
+	}
+	for _, f := range res.Files {
+		switch f.FileName {
+		case "small":
+			if f.Size != 6 || !f.Executable || !f.ModTime.Equal(mtime) {
+				t.Errorf("got size %d, executable %v, mtime %v for small", f.Size, f.Executable, f.ModTime)
+			}
+		case "large":
+			if f.Size != 2006 || f.Executable || !f.ModTime.IsZero() {
+				t.Errorf("got size %d, executable %v, mtime %v for large", f.Size, f.Executable, f.ModTime)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		q    query.Q
+		want []string
+	}{
+		{&query.FileSize{Greater: true, Bytes: 1024}, []string{"large", "skipped"}},
+		{&query.FileSize{Bytes: 1024}, []string{"small"}},
+		{query.NewAnd(&query.Substring{Pattern: "needle"}, &query.Not{Child: &query.FileSize{Bytes: 10}}), []string{"large"}},
+	} {
+		res := searchForTest(t, b, tc.q)
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		sort.Strings(tc.want)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestContentCompression(t *testing.T) {
+	docs := []Document{
+		{Name: "f1", Content: []byte(strings.Repeat("bläh bläh\n", 100) + "needle ünicode\n")},
+		{Name: "f2", Content: []byte("ascii needle\n" + strings.Repeat("filler text\n", 50))},
+		{Name: "f3", Content: []byte(strings.Repeat("日本語 ", 200) + "needle")},
+	}
+	build := func(compression string) *IndexBuilder {
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatalf("NewIndexBuilder: %v", err)
+		}
+		if err := b.SetContentCompression(compression); err != nil {
+			t.Fatalf("SetContentCompression: %v", err)
+		}
+		for _, d := range docs {
+			if err := b.Add(d); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+		}
+		return b
+	}
+	plain := build("")
+	compressed := build(ContentCompressionZstd)
+
+	var plainBuf, compressedBuf bytes.Buffer
+	plain.Write(&plainBuf)
+	compressed.Write(&compressedBuf)
+	if compressedBuf.Len() >= plainBuf.Len() {
+		t.Errorf("compressed shard has %d bytes, uncompressed %d", compressedBuf.Len(), plainBuf.Len())
+	}
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Substring{Pattern: "ünicode", Content: true},
+		&query.Regexp{Regexp: mustParseRE("ne+dle")},
+	} {
+		want := searchForTest(t, plain, q, SearchOptions{Whole: true})
+		got := searchForTest(t, compressed, q, SearchOptions{Whole: true})
+		if d := pretty.Compare(got.Files, want.Files); d != "" {
+			t.Errorf("%s: compressed results differ (-got +want):\n%s", q, d)
+		}
+	}
+
+	if err := plain.SetContentCompression("gzip"); err == nil {
+		t.Errorf("SetContentCompression(gzip) succeeded")
+	}
+}
+
+func TestPostingEncoding(t *testing.T) {
+	var docs []Document
+	for i := 0; i < 50; i++ {
+		docs = append(docs, Document{
+			Name:    fmt.Sprintf("dir/file%d.go", i),
+			Content: []byte(fmt.Sprintf("package main\n\nfunc f%d() { return needle%d }\n%s", i, i%7, strings.Repeat("aaa ", i))),
+		})
+	}
+	build := func(encoding string) *IndexBuilder {
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatalf("NewIndexBuilder: %v", err)
+		}
+		if err := b.SetPostingEncoding(encoding); err != nil {
+			t.Fatalf("SetPostingEncoding: %v", err)
+		}
+		for _, d := range docs {
+			if err := b.Add(d); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+		}
+		return b
+	}
+	deltas := build("")
+	roaring := build(PostingEncodingRoaring)
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle3"},
+		&query.Substring{Pattern: "NEEDLE", CaseSensitive: false},
+		&query.Substring{Pattern: "file1", FileName: true},
+		&query.Substring{Pattern: "aaa aaa aaa", Content: true},
+		query.NewAnd(&query.Substring{Pattern: "func"}, &query.Not{Child: &query.Substring{Pattern: "needle2"}}),
+	} {
+		want := searchForTest(t, deltas, q)
+		got := searchForTest(t, roaring, q)
+		if len(want.Files) == 0 {
+			t.Errorf("%s: no results", q)
+		}
+		if d := pretty.Compare(got.Files, want.Files); d != "" {
+			t.Errorf("%s: roaring results differ (-got +want):\n%s", q, d)
+		}
+	}
+
+	if err := deltas.SetPostingEncoding("elias-fano"); err == nil {
+		t.Errorf("SetPostingEncoding(elias-fano) succeeded")
+	}
+}
+
+// BenchmarkPostingEncoding compares the shard size and search speed
+// of the posting encodings on a corpus with frequent ngrams.
+func BenchmarkPostingEncoding(b *testing.B) {
+	var docs []Document
+	for i := 0; i < 2000; i++ {
+		var content bytes.Buffer
+		for j := 0; j < 50; j++ {
+			fmt.Fprintf(&content, "func handler%d_%d(w http.ResponseWriter, r *http.Request) error { return nil }\n", i, j)
+		}
+		docs = append(docs, Document{Name: fmt.Sprintf("pkg%d/file%d.go", i%20, i), Content: content.Bytes()})
+	}
+
+	for _, encoding := range []string{"", PostingEncodingRoaring} {
+		name := encoding
+		if name == "" {
+			name = "varint"
+		}
+		b.Run(name, func(b *testing.B) {
+			ib, err := NewIndexBuilder(nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ib.SetPostingEncoding(encoding)
+			for _, d := range docs {
+				if err := ib.Add(d); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var buf bytes.Buffer
+			if err := ib.Write(&buf); err != nil {
+				b.Fatal(err)
+			}
+			s, err := NewSearcher(&memSeeker{buf.Bytes()})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+
+			q := &query.Substring{Pattern: "ResponseWriter", CaseSensitive: true}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Search(context.Background(), q, &SearchOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "shard-bytes")
+		})
+	}
+}
+
+func TestUpgradeShard(t *testing.T) {
+	b, err := NewIndexBuilder(&Repository{
+		Name:     "repo",
+		Branches: []RepositoryBranch{{Name: "main", Version: "v1"}, {Name: "dev", Version: "v2"}},
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.SetContentCompression(ContentCompressionZstd); err != nil {
+		t.Fatalf("SetContentCompression: %v", err)
+	}
+	for _, d := range []Document{
+		{
+			Name:       "main.go",
+			Content:    []byte("package main\n\nfunc needle() {}\n"),
+			Branches:   []string{"main", "dev"},
+			Language:   "Go",
+			Symbols:    []DocumentSection{{19, 25}},
+			Rank:       0.25,
+			Executable: true,
+			ModTime:    time.Unix(1500000000, 0),
+		},
+		{Name: "gen.go", Content: []byte("// generated\r\n"), Branches: []string{"dev"}, Category: FileCategoryGenerated},
+		{Name: "blob.bin", SkipReason: "too large", Size: 1 << 20, Branches: []string{"main"}},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	indexTime := time.Unix(1600000000, 0)
+	var old, want bytes.Buffer
+	if err := b.write(&old, IndexMetadata{
+		IndexFormatVersion:  MinIndexFormatVersion,
+		IndexTime:           indexTime,
+		IndexFeatureVersion: FeatureVersion - 1,
+	}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := b.write(&want, IndexMetadata{
+		IndexFormatVersion:  IndexFormatVersion,
+		IndexTime:           indexTime,
+		IndexFeatureVersion: FeatureVersion - 1,
+	}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var got bytes.Buffer
+	if err := UpgradeShard(&memSeeker{old.Bytes()}, &got); err != nil {
+		t.Fatalf("UpgradeShard: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("upgraded shard differs from a shard written in v%d", IndexFormatVersion)
+	}
+
+	_, md, err := ReadMetadata(&memSeeker{got.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if md.IndexFormatVersion != IndexFormatVersion || md.IndexFeatureVersion != FeatureVersion-1 || !md.IndexTime.Equal(indexTime) {
+		t.Errorf("got metadata %+v, want v%d, feature version %d, index time %v", md, IndexFormatVersion, FeatureVersion-1, indexTime)
+	}
+}
+
+func TestShardMeta(t *testing.T) {
+	b, err := NewIndexBuilder(&Repository{
+		Name:     "old/name",
+		Branches: []RepositoryBranch{{Name: "main", Version: "v1"}},
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(Document{Name: "f", Content: []byte("needle"), Branches: []string{"main"}}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	fn := filepath.Join(t.TempDir(), "shard.zoekt")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateShardMeta(fn, func(r *Repository) {
+		r.Name = "new/name"
+		r.Priority = 42
+	}); err != nil {
+		t.Fatalf("UpdateShardMeta: %v", err)
+	}
+
+	open := func() IndexFile {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iFile, err := NewIndexFile(f)
+		if err != nil {
+			t.Fatalf("NewIndexFile: %v", err)
+		}
+		return iFile
+	}
+
+	iFile := open()
+	repo, _, err := ReadMetadata(iFile)
+	iFile.Close()
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if repo.Name != "new/name" || repo.Priority != 42 || len(repo.Branches) != 1 || repo.Branches[0].Version != "v1" {
+		t.Errorf("got repository %+v, want new/name with priority 42 at v1", repo)
+	}
+
+	s, err := NewSearcher(open())
+	if err != nil {
+		t.Fatalf("NewSearcher: %v", err)
+	}
+	res, err := s.Search(context.Background(), &query.Substring{Pattern: "needle"}, &SearchOptions{})
+	s.Close()
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 || res.Files[0].Repository != "new/name" {
+		t.Errorf("got %+v, want a match in new/name", res.Files)
+	}
+
+	if err := WriteShardMeta(fn, &Repository{Name: "new/name"}); err != nil {
+		t.Fatalf("WriteShardMeta: %v", err)
+	}
+	if _, err := NewSearcher(open()); err == nil {
+		t.Errorf("NewSearcher succeeded with a sidecar that removes all branches")
+	}
+}
+
+func TestRepoIDs(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repo", ID: 7},
+		Document{Name: "f", Content: []byte("needle")})
+	noID := testIndexBuilder(t, &Repository{Name: "other"},
+		Document{Name: "f", Content: []byte("needle")})
+
+	needle := &query.Substring{Pattern: "needle"}
+	res := searchForTest(t, b, query.NewAnd(query.NewRepoIDs(7, 9), needle))
+	if len(res.Files) != 1 || res.Files[0].RepositoryID != 7 {
+		t.Errorf("got %+v, want a match with repository ID 7", res.Files)
+	}
+	if res := searchForTest(t, b, query.NewAnd(query.NewRepoIDs(8), needle)); len(res.Files) != 0 {
+		t.Errorf("got %+v for another ID, want no matches", res.Files)
+	}
+	if res := searchForTest(t, noID, query.NewAnd(query.NewRepoIDs(0), needle)); len(res.Files) != 0 {
+		t.Errorf("got %+v for a repository without ID, want no matches", res.Files)
+	}
+	if res := searchForTest(t, noID, needle); len(res.Files) != 1 || res.Files[0].RepositoryID != 0 {
+		t.Errorf("got %+v, want a match without repository ID", res.Files)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "main.go", Content: []byte("func Hello() {}")},
+		Document{Name: "README", Content: []byte("Grüße")})
+	d := searcherForTest(t, b).(*indexData)
+
+	for _, tc := range []struct {
+		q    query.Q
+		want bool
+	}{
+		{&query.Substring{Pattern: "Hello"}, true},
+		{&query.Substring{Pattern: "hello"}, true},
+		{&query.Substring{Pattern: "grüß"}, true},
+		{&query.Substring{Pattern: "main.go", FileName: true}, true},
+		{&query.Substring{Pattern: "goodbye"}, false},
+		{&query.Substring{Pattern: "xy"}, true},
+		{query.NewAnd(&query.Substring{Pattern: "Hello"}, &query.Substring{Pattern: "goodbye"}), false},
+		{query.NewOr(&query.Substring{Pattern: "Hello"}, &query.Substring{Pattern: "goodbye"}), true},
+		{&query.Not{Child: &query.Substring{Pattern: "goodbye"}}, true},
+		{&query.Symbol{Atom: &query.Substring{Pattern: "goodbye"}}, false},
+		{&query.Regexp{Regexp: mustParseRE("Hel+o")}, true},
+		{&query.Regexp{Regexp: mustParseRE("good(bye|night)")}, false},
+	} {
+		if got := d.MayMatch(tc.q); got != tc.want {
+			t.Errorf("MayMatch(%s): got %v, want %v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestNgramDocFrequency(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("common common rare")},
+		Document{Name: "f2", Content: []byte("common")},
+		Document{Name: "f3", Content: []byte("common")})
+	d := searcherForTest(t, b).(*indexData)
+
+	for ng, want := range map[string]uint32{
+		"com": 3,
+		"rar": 1,
+		"n c": 1,
+		"xyz": 0,
+	} {
+		if got := d.ngramDocFrequency(stringToNGram(ng), false); got != want {
+			t.Errorf("ngramDocFrequency(%q): got %d, want %d", ng, got, want)
+		}
+	}
+
+	// The rare child of AND is checked first.
+	mt, err := d.newMatchTree(query.NewAnd(
+		&query.Substring{Pattern: "common"},
+		&query.Substring{Pattern: "rare"}), &Stats{}, newRegexpCache(0))
+	if err != nil {
+		t.Fatalf("newMatchTree: %v", err)
+	}
+	and, ok := mt.(*andMatchTree)
+	if !ok {
+		t.Fatalf("got %T, want *andMatchTree", mt)
+	}
+	if st, ok := and.children[0].(*substrMatchTree); !ok || st.query.Pattern != "rare" {
+		t.Errorf("got first child %v, want the substring rare", and.children[0])
+	}
+
+	res := searchForTest(t, b, query.NewAnd(
+		&query.Substring{Pattern: "common"},
+		&query.Substring{Pattern: "rare"}))
+	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
+		t.Errorf("got %v, want f1", res.Files)
+	}
+}
+
+func TestSearchBudget(t *testing.T) {
+	var docs []Document
+	for i := 0; i < 10; i++ {
+		docs = append(docs, Document{
+			Name:    fmt.Sprintf("f%d", i),
+			Content: []byte("needle in a haystack"),
+		})
+	}
+	b := testIndexBuilder(t, nil, docs...)
+	q := &query.Substring{Pattern: "needle"}
+
+	res := searchForTest(t, b, q, SearchOptions{MaxCandidateDocs: 3})
+	if len(res.Files) != 3 || res.Stats.Truncated != TruncatedCandidateDocs {
+		t.Errorf("MaxCandidateDocs: got %d files, truncated %v, want 3, %v",
+			len(res.Files), res.Stats.Truncated, TruncatedCandidateDocs)
+	}
+
+	// Each match holds the file name and the 20 byte line.
+	res = searchForTest(t, b, q, SearchOptions{MaxMatchBytes: 50})
+	if len(res.Files) != 3 || res.Stats.Truncated != TruncatedMatchBytes {
+		t.Errorf("MaxMatchBytes: got %d files, truncated %v, want 3, %v",
+			len(res.Files), res.Stats.Truncated, TruncatedMatchBytes)
+	}
+
+	res = searchForTest(t, b, q, SearchOptions{MaxCandidateDocs: 10})
+	if len(res.Files) != 10 || res.Stats.Truncated != NotTruncated {
+		t.Errorf("got %d files, truncated %v, want 10, not truncated",
+			len(res.Files), res.Stats.Truncated)
+	}
+
+	// Searches sharing a context share the budget.
+	opts := &SearchOptions{MaxCandidateDocs: 15}
+	ctx := WithSearchBudget(context.Background(), opts)
+	var stats Stats
+	for i := 0; i < 2; i++ {
+		res, err := searcherForTest(t, b).Search(ctx, q, opts)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		stats.Add(res.Stats)
+	}
+	if stats.FileCount != 15 || stats.Truncated != TruncatedCandidateDocs {
+		t.Errorf("shared budget: got %d files, truncated %v, want 15, %v",
+			stats.FileCount, stats.Truncated, TruncatedCandidateDocs)
+	}
+}
+
+func TestTruncateReason(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle")},
+		Document{Name: "f2", Content: []byte("needle")})
+	q := &query.Substring{Pattern: "needle"}
+
+	res := searchForTest(t, b, q, SearchOptions{ShardMaxMatchCount: 1})
+	if res.Stats.Truncated != TruncatedShardMatchLimit {
+		t.Errorf("got %v, want %v", res.Stats.Truncated, TruncatedShardMatchLimit)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	res, err := searcherForTest(t, b).Search(ctx, q, &SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if res.Stats.Truncated != TruncatedDeadline {
+		t.Errorf("got %v, want %v", res.Stats.Truncated, TruncatedDeadline)
+	}
+
+	res = searchForTest(t, b, q)
+	if res.Stats.Truncated != NotTruncated {
+		t.Errorf("got %v, want %v", res.Stats.Truncated, NotTruncated)
+	}
+}
+
+func TestLineFragmentRunes(t *testing.T) {
+	content := []byte("abc\nxäöy näöl\n")
+	b := testIndexBuilder(t, nil,
+		Document{Name: "fääl", Content: content})
+
+	for _, tc := range []struct {
+		q        query.Q
+		wantCol  int
+		wantLen  int
+		wantByte int
+	}{
+		{&query.Substring{Pattern: "näöl", Content: true}, 6, 4, 7},
+		{&query.Substring{Pattern: "äl", FileName: true}, 3, 2, 3},
+	} {
+		res := searchForTest(t, b, tc.q)
+		if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+			t.Fatalf("%s: got %v, want 1 line match", tc.q, res.Files)
+		}
+		f := res.Files[0].LineMatches[0].LineFragments[0]
+		if f.Column != tc.wantCol || f.MatchRunes != tc.wantLen || f.LineOffset != tc.wantByte {
+			t.Errorf("%s: got column %d, %d runes at byte %d, want %d, %d at %d",
+				tc.q, f.Column, f.MatchRunes, f.LineOffset, tc.wantCol, tc.wantLen, tc.wantByte)
+		}
+	}
+}
+
+func TestDedupBranches(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Branches: []RepositoryBranch{
+			{"master", "v-master"},
+			{"stable", "v-stable"},
+			{"bonzai", "v-bonzai"},
+		},
+	}, Document{Name: "f1", Content: []byte("needle\nold"), Branches: []string{"master"}},
+		Document{Name: "f1", Content: []byte("needle\nnew"), Branches: []string{"stable"}},
+		Document{Name: "f1", Content: []byte("other needle"), Branches: []string{"bonzai"}},
+	)
+	q := &query.Substring{Pattern: "needle"}
+
+	if res := searchForTest(t, b, q); len(res.Files) != 3 {
+		t.Fatalf("got %d files, want 3", len(res.Files))
+	}
+
+	res := searchForTest(t, b, q, SearchOptions{DedupBranches: true})
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, strings.Join(f.Branches, ","))
+	}
+	sort.Strings(got)
+	if want := []string{"bonzai", "master,stable"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	base := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	var docs []Document
+	for i, n := range []string{"e", "b", "d", "a", "c", "f"} {
+		docs = append(docs, Document{
+			Name:    n,
+			Content: []byte(strings.Repeat("needle ", i+1)),
+			ModTime: base.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	searcher := searcherForTest(t, testIndexBuilder(t, nil, docs...))
+	q := &query.Substring{Pattern: "needle"}
+
+	search := func(order SortOrder) []string {
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(docs) {
+				t.Fatalf("%s: too many pages: %v", order, got)
+			}
+			res, err := searcher.Search(context.Background(), q, &SearchOptions{
+				SortBy:             order,
+				MaxDocDisplayCount: 4,
+				Cursor:             cursor,
+			})
+			if err != nil {
+				t.Fatalf("%s: Search: %v", order, err)
+			}
+			for _, f := range res.Files {
+				got = append(got, f.FileName)
+			}
+			if res.NextCursor == "" {
+				return got
+			}
+			cursor = res.NextCursor
+		}
+	}
+
+	for order, want := range map[SortOrder][]string{
+		SortByPath:    {"a", "b", "c", "d", "e", "f"},
+		SortByRepo:    {"a", "b", "c", "d", "e", "f"},
+		SortByModTime: {"f", "c", "a", "d", "b", "e"},
+	} {
+		if got := search(order); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", order, got, want)
+		}
+	}
+
+	res, err := searcher.Search(context.Background(), q, &SearchOptions{MaxDocDisplayCount: 1})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	_, err = searcher.Search(context.Background(), q, &SearchOptions{
+		SortBy: SortByPath,
+		Cursor: res.NextCursor,
+	})
+	if code := ErrorCodeOf(err); code != CodeQueryParse {
+		t.Errorf("got error %v (code %v) for cursor of another order, want CodeQueryParse", err, code)
+	}
+}
+
+func TestParseSortOrder(t *testing.T) {
+	for _, o := range []SortOrder{SortByScore, SortByPath, SortByRepo, SortByModTime} {
+		if got, err := ParseSortOrder(o.String()); err != nil || got != o {
+			t.Errorf("ParseSortOrder(%q) = %v, %v, want %v", o.String(), got, err, o)
+		}
+	}
+	if got, err := ParseSortOrder(""); err != nil || got != SortByScore {
+		t.Errorf("ParseSortOrder(\"\") = %v, %v, want score", got, err)
+	}
+	if _, err := ParseSortOrder("size"); ErrorCodeOf(err) != CodeQueryParse {
+		t.Errorf("ParseSortOrder(\"size\") = %v, want CodeQueryParse", err)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"log"
 	"path/filepath"
 	"sort"
+	"time"
 	"unicode/utf8"
 )
 
@@ -41,8 +42,13 @@ var Version string
 const runeOffsetFrequency = 100
 
 type postingsBuilder struct {
-	postings    map[ngram][]byte
-	lastOffsets map[ngram]uint32
+	postings map[ngram][]byte
+	last     map[ngram]lastPosting
+
+	// Number of documents, and the number of documents
+	// containing each ngram.
+	docs     uint32
+	docFreqs map[ngram]uint32
 
 	// To support UTF-8 searching, we must map back runes to byte
 	// offsets. As a first attempt, we sample regularly. The
@@ -57,10 +63,21 @@ type postingsBuilder struct {
 	endByte  uint32
 }
 
+// lastPosting is the last occurrence of an ngram.
+type lastPosting struct {
+	// Rune offset.
+	off uint32
+
+	// Document number plus one, so the zero value is no
+	// document.
+	doc uint32
+}
+
 func newPostingsBuilder() *postingsBuilder {
 	return &postingsBuilder{
 		postings:     map[ngram][]byte{},
-		lastOffsets:  map[ngram]uint32{},
+		last:         map[ngram]lastPosting{},
+		docFreqs:     map[ngram]uint32{},
 		isPlainASCII: true,
 	}
 }
@@ -86,6 +103,7 @@ func (s *postingsBuilder) newSearchableString(data []byte, byteSections []Docume
 	var runeSectionBoundaries []uint32
 
 	endRune := s.runeCount
+	s.docs++
 	for ; len(data) > 0; runeIndex++ {
 		c, sz := utf8.DecodeRune(data)
 		if sz > 1 {
@@ -111,12 +129,15 @@ func (s *postingsBuilder) newSearchableString(data []byte, byteSections []Docume
 		}
 
 		ng := runesToNGram(runeGram)
-		lastOff := s.lastOffsets[ng]
+		last := s.last[ng]
 		newOff := endRune + uint32(runeIndex) - 2
 
-		m := binary.PutUvarint(buf[:], uint64(newOff-lastOff))
+		m := binary.PutUvarint(buf[:], uint64(newOff-last.off))
 		s.postings[ng] = append(s.postings[ng], buf[:m]...)
-		s.lastOffsets[ng] = newOff
+		if last.doc != s.docs {
+			s.docFreqs[ng]++
+		}
+		s.last[ng] = lastPosting{off: newOff, doc: s.docs}
 	}
 	s.runeCount += runeIndex
 
@@ -171,6 +192,25 @@ type IndexBuilder struct {
 
 	// languages codes
 	languages []byte
+
+	// document ranks, 2 bytes each
+	docRanks []byte
+
+	// LineEnding of each document
+	lineEndings []byte
+
+	// FileCategory of each document
+	categories []byte
+
+	// Size, ModTime and Executable of each document, see
+	// fileInfoSize.
+	fileInfos []byte
+
+	// How to store file contents, see SetContentCompression.
+	contentCompression string
+
+	// How to store posting lists, see SetPostingEncoding.
+	postingEncoding string
 }
 
 func (d *Repository) verify() error {
@@ -207,6 +247,32 @@ func NewIndexBuilder(r *Repository) (*IndexBuilder, error) {
 	return b, nil
 }
 
+// SetContentCompression sets how the contents of files are stored:
+// uncompressed if c is empty, or compressed file by file with
+// ContentCompressionZstd. Compressed shards are smaller, but files
+// must be decompressed whenever they are searched.
+func (b *IndexBuilder) SetContentCompression(c string) error {
+	if err := checkContentCompression(c); err != nil {
+		return err
+	}
+	b.contentCompression = c
+	return nil
+}
+
+// SetPostingEncoding sets how the ngram posting lists are stored: as
+// varint encoded deltas if e is empty, or as roaring bitmaps with
+// PostingEncodingRoaring. Roaring bitmaps are smaller for dense
+// posting lists, such as those of long runs of repeated characters,
+// but typically larger for source code; BenchmarkPostingEncoding
+// compares the two.
+func (b *IndexBuilder) SetPostingEncoding(e string) error {
+	if err := checkPostingEncoding(e); err != nil {
+		return err
+	}
+	b.postingEncoding = e
+	return nil
+}
+
 func (b *IndexBuilder) setRepository(desc *Repository) error {
 	if len(b.contentStrings) > 0 {
 		return fmt.Errorf("AddSubRepository called after adding files.")
@@ -259,6 +325,29 @@ type Document struct {
 
 	// Document sections for symbols. Offsets should use bytes.
 	Symbols []DocumentSection
+
+	// Rank of the document between 0 and 1, higher is better, for
+	// example derived from link analysis or usage. It is stored in
+	// the index and added to the score of matches, see
+	// ScoreWeights.DocRank.
+	Rank float64
+
+	// Category of the document. Files in a category, such as
+	// generated files, score lower and can be excluded with
+	// the category: query atom.
+	Category FileCategory
+
+	// Size of the file in bytes. If zero, the size of Content is
+	// used; set it for files skipped without their content.
+	Size int64
+
+	// Executable is set if the file has its executable bit set.
+	Executable bool
+
+	// ModTime is the time the file was last changed, such as
+	// the time of the commit that is indexed. It is stored with
+	// a precision of seconds.
+	ModTime time.Time
 }
 
 type docSectionSlice []DocumentSection
@@ -267,6 +356,51 @@ func (m docSectionSlice) Len() int           { return len(m) }
 func (m docSectionSlice) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
 func (m docSectionSlice) Less(i, j int) bool { return m[i].Start < m[j].Start }
 
+// fileInfoSize is the size of the file info of a document: its size
+// and modification time in seconds since the Unix epoch, as 8-byte
+// big-endian integers, and a byte of flags. A zero time is stored as
+// 0.
+const fileInfoSize = 17
+
+// fileInfoExecutable is the flag for Document.Executable.
+const fileInfoExecutable = 1
+
+func marshalFileInfo(size int64, modTime time.Time, executable bool) []byte {
+	var buf [fileInfoSize]byte
+	binary.BigEndian.PutUint64(buf[0:], uint64(size))
+	if !modTime.IsZero() {
+		binary.BigEndian.PutUint64(buf[8:], uint64(modTime.Unix()))
+	}
+	if executable {
+		buf[16] |= fileInfoExecutable
+	}
+	return buf[:]
+}
+
+// detectLineEnding returns the line terminator convention of content.
+func detectLineEnding(content []byte) LineEnding {
+	var lf, crlf, cr bool
+	for i, c := range content {
+		switch {
+		case c == '\n' && i > 0 && content[i-1] == '\r':
+			crlf = true
+		case c == '\n':
+			lf = true
+		case c == '\r' && (i+1 == len(content) || content[i+1] != '\n'):
+			cr = true
+		}
+	}
+	switch {
+	case lf && !crlf && !cr, !lf && !crlf && !cr:
+		return LineEndingLF
+	case crlf && !lf && !cr:
+		return LineEndingCRLF
+	case cr && !lf && !crlf:
+		return LineEndingCR
+	}
+	return LineEndingMixed
+}
+
 // AddFile is a convenience wrapper for Add
 func (b *IndexBuilder) AddFile(name string, content []byte) error {
 	return b.Add(Document{Name: name, Content: content})
@@ -333,6 +467,10 @@ const notIndexedMarker = "NOT-INDEXED: "
 func (b *IndexBuilder) Add(doc Document) error {
 	hasher := crc64.New(crc64.MakeTable(crc64.ISO))
 
+	if doc.Size == 0 {
+		doc.Size = int64(len(doc.Content))
+	}
+
 	if idx := bytes.IndexByte(doc.Content, 0); idx >= 0 {
 		doc.SkipReason = fmt.Sprintf("binary content at byte offset %d", idx)
 		doc.Language = "binary"
@@ -356,6 +494,9 @@ func (b *IndexBuilder) Add(doc Document) error {
 	if last.End > uint32(len(doc.Content)) {
 		return fmt.Errorf("section goes past end of content")
 	}
+	if doc.Rank < 0 || doc.Rank > 1 {
+		return fmt.Errorf("rank %g out of range [0, 1]", doc.Rank)
+	}
 
 	if doc.SubRepositoryPath != "" {
 		rel, err := filepath.Rel(doc.SubRepositoryPath, doc.Name)
@@ -363,6 +504,12 @@ func (b *IndexBuilder) Add(doc Document) error {
 			return fmt.Errorf("path %q must start subrepo path %q", doc.Name, doc.SubRepositoryPath)
 		}
 	}
+	// The contents and names are indexed with 32-bit offsets, see
+	// compoundSection.relativeIndex.
+	if uint64(b.contentPostings.endByte)+uint64(len(doc.Content)) > maxUInt32 ||
+		uint64(b.namePostings.endByte)+uint64(len(doc.Name)) > maxUInt32 {
+		return fmt.Errorf("adding %s would make the shard content exceed 4G", doc.Name)
+	}
 	docStr, runeSecs, err := b.contentPostings.newSearchableString(doc.Content, doc.Symbols)
 	if err != nil {
 		return err
@@ -408,6 +555,13 @@ func (b *IndexBuilder) Add(doc Document) error {
 	}
 	b.languages = append(b.languages, langCode)
 
+	var rank [2]byte
+	binary.BigEndian.PutUint16(rank[:], uint16(doc.Rank*maxUInt16))
+	b.docRanks = append(b.docRanks, rank[:]...)
+	b.lineEndings = append(b.lineEndings, byte(detectLineEnding(doc.Content)))
+	b.categories = append(b.categories, byte(doc.Category))
+	b.fileInfos = append(b.fileInfos, marshalFileInfo(doc.Size, doc.ModTime, doc.Executable)...)
+
 	return nil
 }
 
@@ -15,8 +15,12 @@
 package zoekt
 
 import (
+	"encoding/binary"
 	"fmt"
 	"hash/crc64"
+	"math"
+	"sort"
+	"time"
 	"unicode/utf8"
 
 	"github.com/google/zoekt/query"
@@ -30,10 +34,10 @@ type indexData struct {
 
 	ngrams map[ngram]simpleSection
 
-	newlinesStart uint32
+	newlinesStart uint64
 	newlinesIndex []uint32
 
-	docSectionsStart uint32
+	docSectionsStart uint64
 	docSectionsIndex []uint32
 
 	runeDocSections []DocumentSection
@@ -42,9 +46,14 @@ type indexData struct {
 	runeOffsets []uint32
 
 	// offsets of file contents; includes end of last file
-	boundariesStart uint32
+	boundariesStart uint64
 	boundaries      []uint32
 
+	// If the contents are compressed, the offsets of the
+	// compressed files relative to boundariesStart, while
+	// boundaries are the offsets in the uncompressed content.
+	compressedBoundaries []uint32
+
 	// rune offsets for the file content boundaries
 	fileEndRunes []uint32
 
@@ -52,6 +61,16 @@ type indexData struct {
 	fileNameIndex   []uint32
 	fileNameNgrams  map[ngram][]uint32
 
+	// Bloom filter of the ngrams.
+	bloom *bloomFilter
+
+	// The sorted content ngrams as big endian uint64, and the
+	// number of documents containing each as uint32. The
+	// frequencies are nil for files of the previous format
+	// version.
+	ngramText     []byte
+	ngramDocFreqs []byte
+
 	// rune offset=>byte offset mapping, relative to the start of the filename corpus
 	fileNameRuneOffsets []uint32
 
@@ -78,6 +97,20 @@ type indexData struct {
 	// languages for all the files.
 	languages []byte
 
+	// Rank of each file, as 2-byte big-endian fractions of
+	// maxUInt16.
+	docRanks []byte
+
+	// LineEnding of each file.
+	lineEndings []byte
+
+	// FileCategory of each file.
+	categories []byte
+
+	// Size, ModTime and Executable of each file, at fileInfoSize
+	// intervals.
+	fileInfos []byte
+
 	// inverse of LanguageMap in metaData
 	languageMap map[byte]string
 
@@ -89,6 +122,22 @@ func (d *indexData) getChecksum(idx uint32) []byte {
 	return d.checksums[start : start+crc64.Size]
 }
 
+// docRank returns the rank of a file, between 0 and 1.
+func (d *indexData) docRank(idx uint32) float64 {
+	return float64(binary.BigEndian.Uint16(d.docRanks[2*idx:])) / maxUInt16
+}
+
+// fileInfo returns the size, modification time and executable bit
+// of a file.
+func (d *indexData) fileInfo(idx uint32) (size int64, modTime time.Time, executable bool) {
+	buf := d.fileInfos[fileInfoSize*idx:]
+	size = int64(binary.BigEndian.Uint64(buf))
+	if secs := int64(binary.BigEndian.Uint64(buf[8:])); secs != 0 {
+		modTime = time.Unix(secs, 0)
+	}
+	return size, modTime, buf[16]&fileInfoExecutable != 0
+}
+
 func (d *indexData) calculateStats() {
 	var last uint32
 	if len(d.boundaries) > 0 {
@@ -109,6 +158,7 @@ func (d *indexData) calculateStats() {
 		Repository:    d.repoMetaData,
 		IndexMetadata: d.metaData,
 		Stats:         stats,
+		ShardFiles:    []string{d.file.Name()},
 	}
 }
 
@@ -120,7 +170,7 @@ func (d *indexData) memoryUse() int {
 	sz := 0
 	for _, a := range [][]uint32{
 		d.newlinesIndex, d.docSectionsIndex,
-		d.boundaries, d.fileNameIndex,
+		d.boundaries, d.compressedBoundaries, d.fileNameIndex,
 		d.runeOffsets, d.fileNameRuneOffsets,
 		d.fileEndRunes, d.fileNameEndRunes,
 	} {
@@ -137,8 +187,8 @@ func (d *indexData) memoryUse() int {
 
 const maxUInt32 = 0xffffffff
 
-func firstMinarg(xs []uint32) uint32 {
-	m := uint32(maxUInt32)
+func firstMinarg(xs []uint64) uint32 {
+	m := uint64(math.MaxUint64)
 	j := len(xs)
 	for i, x := range xs {
 		if x < m {
@@ -149,8 +199,8 @@ func firstMinarg(xs []uint32) uint32 {
 	return uint32(j)
 }
 
-func lastMinarg(xs []uint32) uint32 {
-	m := uint32(maxUInt32)
+func lastMinarg(xs []uint64) uint32 {
+	m := uint64(math.MaxUint64)
 	j := len(xs)
 	for i, x := range xs {
 		if x <= m {
@@ -166,7 +216,27 @@ func (data *indexData) ngramFrequency(ng ngram, filename bool) uint32 {
 		return uint32(len(data.fileNameNgrams[ng]))
 	}
 
-	return data.ngrams[ng].sz
+	return uint32(data.ngrams[ng].sz)
+}
+
+// ngramDocFrequency returns the number of documents containing ng.
+// For file names, and shards without recorded document frequencies,
+// it returns ngramFrequency instead, which is larger.
+func (d *indexData) ngramDocFrequency(ng ngram, filename bool) uint32 {
+	if filename || d.ngramDocFreqs == nil {
+		return d.ngramFrequency(ng, filename)
+	}
+	if _, ok := d.ngrams[ng]; !ok {
+		return 0
+	}
+	n := len(d.ngramText) / 8
+	i := sort.Search(n, func(i int) bool {
+		return ngram(binary.BigEndian.Uint64(d.ngramText[8*i:])) >= ng
+	})
+	if i == n {
+		return 0
+	}
+	return binary.BigEndian.Uint32(d.ngramDocFreqs[4*i:])
 }
 
 type ngramIterationResults struct {
@@ -175,7 +245,10 @@ type ngramIterationResults struct {
 	caseSensitive bool
 	fileName      bool
 	substrBytes   []byte
-	substrLowered []byte
+	substrFolded  []byte
+
+	// Upper bound for the number of documents that match.
+	docFreq uint32
 }
 
 func (r *ngramIterationResults) String() string {
@@ -188,7 +261,7 @@ func (r *ngramIterationResults) candidates() []*candidateMatch {
 		c.caseSensitive = r.caseSensitive
 		c.fileName = r.fileName
 		c.substrBytes = r.substrBytes
-		c.substrLowered = r.substrLowered
+		c.substrFolded = r.substrFolded
 	}
 	return cs
 }
@@ -196,17 +269,21 @@ func (r *ngramIterationResults) candidates() []*candidateMatch {
 func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResults, error) {
 	str := query.Pattern
 
-	// Find the 2 least common ngrams from the string.
+	// Find the 2 ngrams of the string that occur in the fewest
+	// documents, and then the fewest times, to generate
+	// candidates from.
 	ngramOffs := splitNGrams([]byte(query.Pattern))
-	frequencies := make([]uint32, 0, len(ngramOffs))
+	costs := make([]uint64, 0, len(ngramOffs))
+	minDocFreq := uint32(maxUInt32)
 	for _, o := range ngramOffs {
-		var freq uint32
-		if query.CaseSensitive {
-			freq = d.ngramFrequency(o.ngram, query.FileName)
-		} else {
-			for _, v := range generateCaseNgrams(o.ngram) {
-				freq += d.ngramFrequency(v, query.FileName)
-			}
+		var freq, docFreq uint32
+		variants := []ngram{o.ngram}
+		if !query.CaseSensitive {
+			variants = generateCaseNgrams(o.ngram)
+		}
+		for _, v := range variants {
+			freq += d.ngramFrequency(v, query.FileName)
+			docFreq += d.ngramDocFrequency(v, query.FileName)
 		}
 
 		if freq == 0 {
@@ -217,11 +294,14 @@ func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResult
 			}, nil
 		}
 
-		frequencies = append(frequencies, freq)
+		if docFreq < minDocFreq {
+			minDocFreq = docFreq
+		}
+		costs = append(costs, uint64(docFreq)<<32|uint64(freq))
 	}
-	firstI := firstMinarg(frequencies)
-	frequencies[firstI] = maxUInt32
-	lastI := lastMinarg(frequencies)
+	firstI := firstMinarg(costs)
+	costs[firstI] = math.MaxUint64
+	lastI := lastMinarg(costs)
 	if firstI > lastI {
 		lastI, firstI = firstI, lastI
 	}
@@ -255,14 +335,15 @@ func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResult
 	}
 
 	patBytes := []byte(query.Pattern)
-	lowerPatBytes := toLower(patBytes)
+	foldedPatBytes := foldCase(patBytes)
 
 	return &ngramIterationResults{
 		matchIterator: iter,
 		caseSensitive: query.CaseSensitive,
 		fileName:      query.FileName,
 		substrBytes:   patBytes,
-		substrLowered: lowerPatBytes,
+		substrFolded:  foldedPatBytes,
+		docFreq:       minDocFreq,
 	}, nil
 }
 
@@ -17,7 +17,6 @@
 package zoekt
 
 import (
-	"fmt"
 	"os"
 )
 
@@ -31,25 +30,19 @@ type indexFileFromOS struct {
 	f *os.File
 }
 
-func (f *indexFileFromOS) Read(off, sz uint32) ([]byte, error) {
+func (f *indexFileFromOS) Read(off, sz uint64) ([]byte, error) {
 	r := make([]byte, sz)
 	_, err := f.f.ReadAt(r, int64(off))
 	return r, err
 }
 
-func (f indexFileFromOS) Size() (uint32, error) {
+func (f indexFileFromOS) Size() (uint64, error) {
 	fi, err := f.f.Stat()
 	if err != nil {
 		return 0, err
 	}
 
-	sz := fi.Size()
-
-	if sz >= maxUInt32 {
-		return 0, fmt.Errorf("overflow")
-	}
-
-	return uint32(sz), nil
+	return uint64(fi.Size()), nil
 }
 
 func (f indexFileFromOS) Close() {
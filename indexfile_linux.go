@@ -22,12 +22,12 @@ import (
 
 type mmapedIndexFile struct {
 	name string
-	size uint32
+	size uint64
 	data []byte
 }
 
-func (f *mmapedIndexFile) Read(off, sz uint32) ([]byte, error) {
-	if off+sz > uint32(len(f.data)) {
+func (f *mmapedIndexFile) Read(off, sz uint64) ([]byte, error) {
+	if off+sz > uint64(len(f.data)) {
 		return nil, fmt.Errorf("out of bounds: %d, len %d", off+sz, len(f.data))
 	}
 	return f.data[off : off+sz], nil
@@ -37,7 +37,7 @@ func (f *mmapedIndexFile) Name() string {
 	return f.name
 }
 
-func (f *mmapedIndexFile) Size() (uint32, error) {
+func (f *mmapedIndexFile) Size() (uint64, error) {
 	return f.size, nil
 }
 
@@ -56,15 +56,15 @@ func NewIndexFile(f *os.File) (IndexFile, error) {
 	}
 
 	sz := fi.Size()
-	if sz >= maxUInt32 {
-		return nil, fmt.Errorf("file %s too large: %d", f.Name(), sz)
-	}
 	r := &mmapedIndexFile{
 		name: f.Name(),
-		size: uint32(sz),
+		size: uint64(sz),
 	}
 
 	rounded := (r.size + 4095) &^ 4095
+	if uint64(int(rounded)) != rounded {
+		return nil, fmt.Errorf("file %s too large: %d", f.Name(), sz)
+	}
 	r.data, err = syscall.Mmap(int(f.Fd()), 0, int(rounded), syscall.PROT_READ, syscall.MAP_SHARED)
 	if err != nil {
 		return nil, err
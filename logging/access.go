@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes on flushes, which streaming responses rely on.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// queryHash returns a short hash of a URL query, so requests with
+// the same query can be grouped without logging what was searched.
+func queryHash(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(rawQuery))
+	return hex.EncodeToString(h[:8])
+}
+
+// AccessHandler wraps h so every request is logged once it
+// completes, with its method, path, a hash of its query, status,
+// response size and duration. Wrap it in Handler to log request
+// IDs too.
+func AccessHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		slog.InfoContext(r.Context(), "access",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query_hash", queryHash(r.URL.RawQuery),
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration", time.Since(start))
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+
+	if err := Init("test", "json", "info"); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	slog.InfoContext(WithRequestID(context.Background(), "abc"), "hello", "repo", "r")
+	slog.Debug("hidden")
+	log.Printf("from %s", "log")
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2: %v", len(records), records)
+	}
+	for k, want := range map[string]string{"msg": "hello", "component": "test", "repo": "r", "request_id": "abc", "level": "INFO"} {
+		if got := records[0][k]; got != want {
+			t.Errorf("%s: got %v, want %q", k, got, want)
+		}
+	}
+	if got := records[1]["msg"]; got != "from log" {
+		t.Errorf("log package: got %v, want %q", got, "from log")
+	}
+
+	if err := Init("test", "xml", "info"); err == nil {
+		t.Errorf("Init with bad format succeeded")
+	}
+	if err := Init("test", "json", "loud"); err == nil {
+		t.Errorf("Init with bad level succeeded")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var got string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestID(r.Context())
+	}))
+
+	for _, tc := range []struct {
+		header string
+		keep   bool
+	}{
+		{"", false},
+		{"req-1.a_B", true},
+		{"bad id\n", false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.header != "" {
+			req.Header.Set(RequestIDHeader, tc.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got == "" || w.Header().Get(RequestIDHeader) != got {
+			t.Errorf("%q: context has %q, response %q", tc.header, got, w.Header().Get(RequestIDHeader))
+		}
+		if (got == tc.header) != tc.keep {
+			t.Errorf("%q: got ID %q, keep %v", tc.header, got, tc.keep)
+		}
+	}
+}
+
+func TestAccessHandler(t *testing.T) {
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+	if err := Init("test", "json", "info"); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	h := Handler(AccessHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	})))
+	req := httptest.NewRequest("GET", "/search?q=secret", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", buf.Bytes(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"msg":        "access",
+		"method":     "GET",
+		"path":       "/search",
+		"query_hash": queryHash("q=secret"),
+		"status":     float64(http.StatusTeapot),
+		"request_id": "req-1",
+	} {
+		if rec[k] != want {
+			t.Errorf("%s: got %v, want %v", k, rec[k], want)
+		}
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Errorf("access log %q contains the query", buf.Bytes())
+	}
+}
@@ -28,8 +28,8 @@ type candidateMatch struct {
 	caseSensitive bool
 	fileName      bool
 
-	substrBytes   []byte
-	substrLowered []byte
+	substrBytes  []byte
+	substrFolded []byte
 
 	file uint32
 
@@ -54,7 +54,7 @@ func (m *candidateMatch) matchContent(content []byte) bool {
 		// as upper case variant). We can only degrade to
 		// ASCII if we are sure that both the corpus and the
 		// query is ASCII only
-		sz, ok := caseFoldingEqualsRunes(m.substrLowered, content[m.byteOffset:])
+		sz, ok := caseFoldingEqualsRunes(m.substrFolded, content[m.byteOffset:])
 		m.byteMatchSz = uint32(sz)
 		return ok
 	}
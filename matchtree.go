@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"sort"
 	"strings"
 	"unicode/utf8"
 
@@ -129,6 +130,7 @@ type substrMatchTree struct {
 	query         *query.Substring
 	caseSensitive bool
 	fileName      bool
+	word          bool
 
 	// mutable
 	current       []*candidateMatch
@@ -482,7 +484,7 @@ func (t *substrMatchTree) matches(cp *contentProvider, cost int, known map[match
 		if m.byteOffset == 0 && m.runeOffset > 0 {
 			m.byteOffset = cp.findOffset(m.fileName, m.runeOffset)
 		}
-		if m.matchContent(cp.data(m.fileName)) {
+		if m.matchContent(cp.data(m.fileName)) && (!t.word || cp.wordMatch(m)) {
 			pruned = append(pruned, m)
 		}
 	}
@@ -491,7 +493,7 @@ func (t *substrMatchTree) matches(cp *contentProvider, cost int, known map[match
 	return len(t.current) > 0, true
 }
 
-func (d *indexData) newMatchTree(q query.Q, stats *Stats) (matchTree, error) {
+func (d *indexData) newMatchTree(q query.Q, stats *Stats, rc *regexpCache) (matchTree, error) {
 	switch s := q.(type) {
 	case *query.Regexp:
 		subQ := query.RegexpToQuery(s.Regexp, ngramSize)
@@ -503,18 +505,17 @@ func (d *indexData) newMatchTree(q query.Q, stats *Stats) (matchTree, error) {
 			return q
 		})
 
-		subMT, err := d.newMatchTree(subQ, stats)
+		subMT, err := d.newMatchTree(subQ, stats, rc)
 		if err != nil {
 			return nil, err
 		}
 
-		prefix := ""
-		if !s.CaseSensitive {
-			prefix = "(?i)"
+		re, err := rc.compile(regexpExpr(s), stats)
+		if err != nil {
+			return nil, err
 		}
-
 		tr := &regexpMatchTree{
-			regexp:   regexp.MustCompile(prefix + s.Regexp.String()),
+			regexp:   re,
 			fileName: s.FileName,
 		}
 
@@ -526,17 +527,22 @@ func (d *indexData) newMatchTree(q query.Q, stats *Stats) (matchTree, error) {
 	case *query.And:
 		var r []matchTree
 		for _, ch := range s.Children {
-			ct, err := d.newMatchTree(ch, stats)
+			ct, err := d.newMatchTree(ch, stats, rc)
 			if err != nil {
 				return nil, err
 			}
 			r = append(r, ct)
 		}
+		// Check the most selective children first, so
+		// documents are rejected early.
+		sort.SliceStable(r, func(i, j int) bool {
+			return d.estimateDocs(r[i]) < d.estimateDocs(r[j])
+		})
 		return &andMatchTree{r}, nil
 	case *query.Or:
 		var r []matchTree
 		for _, ch := range s.Children {
-			ct, err := d.newMatchTree(ch, stats)
+			ct, err := d.newMatchTree(ch, stats, rc)
 			if err != nil {
 				return nil, err
 			}
@@ -544,13 +550,25 @@ func (d *indexData) newMatchTree(q query.Q, stats *Stats) (matchTree, error) {
 		}
 		return &orMatchTree{r}, nil
 	case *query.Not:
-		ct, err := d.newMatchTree(s.Child, stats)
+		if docs, ok, err := d.fileNameExcludedDocs(s.Child, stats, rc); err != nil {
+			return nil, err
+		} else if ok {
+			return &docMatchTree{
+				docs: docs,
+			}, nil
+		}
+		ct, err := d.newMatchTree(s.Child, stats, rc)
 		return &notMatchTree{
 			child: ct,
 		}, err
 
+	case *query.Type:
+		// The result type is handled by the caller; nested
+		// types have no effect.
+		return d.newMatchTree(s.Child, stats, rc)
+
 	case *query.Substring:
-		return d.newSubstringMatchTree(s, stats)
+		return d.newSubstringMatchTree(s, stats, rc)
 
 	case *query.Branch:
 		mask := uint64(0)
@@ -567,6 +585,30 @@ func (d *indexData) newMatchTree(q query.Q, stats *Stats) (matchTree, error) {
 			mask:      mask,
 			fileMasks: d.fileBranchMasks,
 		}, nil
+	case *query.RepoBranches:
+		mask := uint64(0)
+		for _, b := range s.Set[d.repoMetaData.Name] {
+			if b == "HEAD" {
+				mask |= 1
+			} else if id, ok := d.branchIDs[b]; ok {
+				mask |= uint64(id)
+			}
+		}
+		return &branchQueryMatchTree{
+			mask:      mask,
+			fileMasks: d.fileBranchMasks,
+		}, nil
+	case *query.RepoCommit:
+		mask := uint64(0)
+		for _, b := range d.repoMetaData.Branches {
+			if b.Version == s.Commit {
+				mask |= uint64(d.branchIDs[b.Name])
+			}
+		}
+		return &branchQueryMatchTree{
+			mask:      mask,
+			fileMasks: d.fileBranchMasks,
+		}, nil
 	case *query.Const:
 		if s.Value {
 			return &bruteForceMatchTree{}, nil
@@ -588,8 +630,33 @@ func (d *indexData) newMatchTree(q query.Q, stats *Stats) (matchTree, error) {
 			docs: docs,
 		}, nil
 
+	case *query.FileCategory:
+		c := byte(queryFileCategories[s.Category])
+		docs := make([]uint32, 0, len(d.categories))
+		for d, cat := range d.categories {
+			if cat&c != 0 {
+				docs = append(docs, uint32(d))
+			}
+		}
+		return &docMatchTree{
+			docs: docs,
+		}, nil
+
+	case *query.FileSize:
+		n := len(d.fileInfos) / fileInfoSize
+		docs := make([]uint32, 0, n)
+		for i := 0; i < n; i++ {
+			size, _, _ := d.fileInfo(uint32(i))
+			if s.Greater && size > s.Bytes || !s.Greater && size < s.Bytes {
+				docs = append(docs, uint32(i))
+			}
+		}
+		return &docMatchTree{
+			docs: docs,
+		}, nil
+
 	case *query.Symbol:
-		mt, err := d.newSubstringMatchTree(s.Atom, stats)
+		mt, err := d.newSubstringMatchTree(s.Atom, stats, rc)
 		if err != nil {
 			return nil, err
 		}
@@ -609,20 +676,88 @@ func (d *indexData) newMatchTree(q query.Q, stats *Stats) (matchTree, error) {
 	return nil, nil
 }
 
-func (d *indexData) newSubstringMatchTree(s *query.Substring, stats *Stats) (matchTree, error) {
+// fileNameExcludedDocs returns the documents whose name does not
+// match q, if q only looks at file names. Negated file name filters
+// such as -file: are resolved up front this way, so the documents
+// they exclude are skipped rather than considered one by one.
+func (d *indexData) fileNameExcludedDocs(q query.Q, stats *Stats, rc *regexpCache) ([]uint32, bool, error) {
+	var expr string
+	switch s := q.(type) {
+	case *query.Substring:
+		if !s.FileName {
+			return nil, false, nil
+		}
+		expr = substringExpr(s)
+	case *query.Regexp:
+		if !s.FileName {
+			return nil, false, nil
+		}
+		expr = regexpExpr(s)
+	default:
+		return nil, false, nil
+	}
+
+	re, err := rc.compile(expr, stats)
+	if err != nil {
+		return nil, false, err
+	}
+	docs := make([]uint32, 0, len(d.fileBranchMasks))
+	for i := range d.fileBranchMasks {
+		if !re.Match(d.fileName(uint32(i))) {
+			docs = append(docs, uint32(i))
+		}
+	}
+	return docs, true, nil
+}
+
+// estimateDocs returns an upper bound for the number of documents
+// matching mt, from the document frequencies of the ngrams.
+func (d *indexData) estimateDocs(mt matchTree) uint32 {
+	n := uint32(len(d.fileBranchMasks))
+	switch t := mt.(type) {
+	case *noMatchTree:
+		return 0
+	case *docMatchTree:
+		return uint32(len(t.docs))
+	case *substrMatchTree:
+		if r, ok := t.matchIterator.(*ngramIterationResults); ok && r.docFreq < n {
+			return r.docFreq
+		}
+	case *noVisitMatchTree:
+		return d.estimateDocs(t.matchTree)
+	case *andMatchTree:
+		for _, ch := range t.children {
+			if e := d.estimateDocs(ch); e < n {
+				n = e
+			}
+		}
+	case *orMatchTree:
+		var sum uint64
+		for _, ch := range t.children {
+			sum += uint64(d.estimateDocs(ch))
+		}
+		if sum < uint64(n) {
+			return uint32(sum)
+		}
+	}
+	return n
+}
+
+func (d *indexData) newSubstringMatchTree(s *query.Substring, stats *Stats, rc *regexpCache) (matchTree, error) {
 	st := &substrMatchTree{
 		query:         s,
 		caseSensitive: s.CaseSensitive,
 		fileName:      s.FileName,
+		word:          s.Word,
 	}
 
 	if utf8.RuneCountInString(s.Pattern) < ngramSize {
-		prefix := ""
-		if !s.CaseSensitive {
-			prefix = "(?i)"
+		re, err := rc.compile(substringExpr(s), stats)
+		if err != nil {
+			return nil, err
 		}
 		t := &regexpMatchTree{
-			regexp:   regexp.MustCompile(prefix + regexp.QuoteMeta(s.Pattern)),
+			regexp:   re,
 			fileName: s.FileName,
 		}
 		return t, nil
@@ -0,0 +1,92 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ShardMetaName returns the name of the sidecar metadata file of the
+// shard fn. The sidecar holds the repository metadata as JSON, so it
+// can be changed, eg. to rename or tombstone a repository, without
+// rewriting the shard. Fields present in the sidecar override the
+// metadata stored in the shard. Whoever replaces or removes a shard
+// must also remove its sidecar.
+func ShardMetaName(fn string) string {
+	return fn + ".meta"
+}
+
+// readShardMeta applies the sidecar metadata of the shard fn to repo,
+// if there is a sidecar.
+func readShardMeta(fn string, repo *Repository) error {
+	blob, err := ioutil.ReadFile(ShardMetaName(fn))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The branch masks of the documents refer to the branches by
+	// position, so only their names and versions may change.
+	n := len(repo.Branches)
+	if err := json.Unmarshal(blob, repo); err != nil {
+		return fmt.Errorf("%s: %v", ShardMetaName(fn), err)
+	}
+	if len(repo.Branches) != n {
+		return fmt.Errorf("%s: got %d branches, shard has %d", ShardMetaName(fn), len(repo.Branches), n)
+	}
+	return nil
+}
+
+// WriteShardMeta writes repo as the sidecar metadata of the shard fn.
+func WriteShardMeta(fn string, repo *Repository) error {
+	blob, err := json.Marshal(repo)
+	if err != nil {
+		return err
+	}
+	tmp := ShardMetaName(fn) + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ShardMetaName(fn)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// UpdateShardMeta changes the repository metadata of the shard fn
+// with update, and writes the result to its sidecar.
+func UpdateShardMeta(fn string, update func(*Repository)) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	iFile, err := NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	repo, _, err := ReadMetadata(iFile)
+	iFile.Close()
+	if err != nil {
+		return err
+	}
+
+	update(repo)
+	return WriteShardMeta(fn, repo)
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dirBucket stores objects as files in a directory, eg. on a network
+// filesystem.
+type dirBucket struct {
+	dir string
+}
+
+func (b *dirBucket) path(name string) (string, error) {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(b.dir, filepath.FromSlash(name)), nil
+}
+
+func (b *dirBucket) List(ctx context.Context) ([]Object, error) {
+	var objs []Object
+	err := filepath.Walk(b.dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && fn == b.dir {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(fn, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(b.dir, fn)
+		if err != nil {
+			return err
+		}
+		sum, err := md5File(fn)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, Object{Name: filepath.ToSlash(rel), Size: fi.Size(), MD5: sum})
+		return nil
+	})
+	return objs, err
+}
+
+func (b *dirBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	fn, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fn)
+}
+
+func (b *dirBucket) Put(ctx context.Context, name string, r io.ReadSeeker) error {
+	fn, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+func (b *dirBucket) Delete(ctx context.Context, name string) error {
+	fn, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *dirBucket) String() string {
+	return "file://" + b.dir
+}
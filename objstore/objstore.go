@@ -0,0 +1,224 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package objstore persists index shards in object storage, such as
+// S3 or GCS.
+//
+// Indexers upload the shards they build with an Uploader. Webservers
+// keep their index directory in sync with the bucket with a
+// Downloader, so a new or recovering node loads the shards from the
+// bucket instead of reindexing everything.
+//
+// Objects are named by the path of the shard relative to the index
+// directory, eg. "repo_v16.00000.zoekt" or
+// "tenant-acme/repo_v16.00000.zoekt.meta".
+package objstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+)
+
+// Object describes an object in a bucket.
+type Object struct {
+	// Name is the name of the object, relative to the prefix of
+	// the bucket.
+	Name string
+	Size int64
+
+	// MD5 is the hex encoded MD5 of the contents, or "" if the
+	// bucket does not know it, as for multipart uploads to S3.
+	MD5 string
+}
+
+// Bucket stores objects under a prefix of a bucket.
+type Bucket interface {
+	// List returns all objects.
+	List(ctx context.Context) ([]Object, error)
+
+	// Get returns the contents of an object. It returns an error
+	// satisfying os.IsNotExist if the object does not exist.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Put stores the contents of r as an object.
+	Put(ctx context.Context, name string, r io.ReadSeeker) error
+
+	// Delete deletes an object. Deleting an object that does not
+	// exist is not an error.
+	Delete(ctx context.Context, name string) error
+
+	String() string
+}
+
+// Open returns the bucket at u, one of
+//
+//	s3://bucket/prefix
+//	gs://bucket/prefix
+//	file:///directory
+//
+// S3 buckets use the credentials in $AWS_ACCESS_KEY_ID,
+// $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN, and the region in
+// $AWS_REGION. The query parameters "region" and "endpoint" override
+// the region and the endpoint, eg. for S3 compatible stores such as
+// MinIO. GCS buckets are accessed through their S3 compatible API,
+// with HMAC keys in the same variables.
+func Open(u string) (Bucket, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(pu.Path, "/")
+	switch pu.Scheme {
+	case "s3", "gs":
+		if pu.Host == "" {
+			return nil, fmt.Errorf("bucket %q: missing bucket name", u)
+		}
+		return newS3Bucket(pu.Scheme, pu.Host, prefix, pu.Query())
+	case "file":
+		if pu.Path == "" {
+			return nil, fmt.Errorf("bucket %q: missing directory", u)
+		}
+		return &dirBucket{dir: pu.Path}, nil
+	default:
+		return nil, fmt.Errorf("bucket %q: unsupported scheme %q", u, pu.Scheme)
+	}
+}
+
+// Stats summarizes a sync between an index directory and a bucket.
+type Stats struct {
+	Transferred int
+	Deleted     int
+	Unchanged   int
+	Bytes       int64
+}
+
+// validName returns whether name may name a shard or its metadata
+// sidecar in an index directory.
+func validName(name string) bool {
+	if !strings.HasSuffix(name, ".zoekt") && !strings.HasSuffix(name, ".zoekt.meta") {
+		return false
+	}
+	dir, base := path.Split(name)
+	if base == "" || base[0] == '.' {
+		return false
+	}
+	if dir == "" {
+		return true
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	return strings.HasPrefix(dir, zoekt.TenantDirPrefix) && zoekt.ValidTenantID(strings.TrimPrefix(dir, zoekt.TenantDirPrefix))
+}
+
+// localFile is a shard file in an index directory.
+type localFile struct {
+	size    int64
+	modTime time.Time
+	md5     string
+}
+
+// checksummer computes MD5 sums of the shards in an index directory,
+// remembering them as long as the size and modification time of a
+// file do not change.
+type checksummer struct {
+	mu    sync.Mutex
+	cache map[string]localFile
+}
+
+// list returns the shards and sidecars in dir, by object name.
+func (c *checksummer) list(dir string) (map[string]localFile, error) {
+	shards, err := zoekt.ListShards(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fs []string
+	for _, fn := range shards {
+		fs = append(fs, fn, zoekt.ShardMetaName(fn))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[string]localFile{}
+	}
+
+	res := map[string]localFile{}
+	for _, fn := range fs {
+		rel, err := filepath.Rel(dir, fn)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.ToSlash(rel)
+
+		fi, err := os.Stat(fn)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		f, ok := c.cache[name]
+		if !ok || f.size != fi.Size() || !f.modTime.Equal(fi.ModTime()) {
+			sum, err := md5File(fn)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			f = localFile{size: fi.Size(), modTime: fi.ModTime(), md5: sum}
+			c.cache[name] = f
+		}
+		res[name] = f
+	}
+
+	for name := range c.cache {
+		if _, ok := res[name]; !ok {
+			delete(c.cache, name)
+		}
+	}
+	return res, nil
+}
+
+func md5File(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// same returns whether the local file has the contents of o.
+func (f localFile) same(o Object) bool {
+	if f.size != o.Size {
+		return false
+	}
+	return o.MD5 == "" || o.MD5 == f.md5
+}
@@ -0,0 +1,340 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	res := map[string]string{}
+	err := filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		c, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, fn)
+		res[filepath.ToSlash(rel)] = string(c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// testSync uploads shards to b from one directory, and downloads
+// them into another.
+func testSync(t *testing.T, b Bucket) {
+	ctx := context.Background()
+	src, dst := t.TempDir(), t.TempDir()
+
+	writeFiles(t, src, map[string]string{
+		"a.zoekt":                    "shard a",
+		"a.zoekt.meta":               "meta a",
+		"tenant-acme/b.zoekt":        "shard b",
+		"a.zoekt.12345.tmp":          "partial",
+		"tenant-acme/notes.txt":      "not a shard",
+		"tenant-acme/c.zoekt.meta":   "sidecar without shard",
+		"other/d.zoekt":              "not a tenant",
+		"tenant-acme/sub/e.zoekt":    "too deep",
+		"tenant-acme/b.zoekt.x.meta": "bad name",
+	})
+	u := &Uploader{Bucket: b, Dir: src}
+	stats, err := u.Sync(ctx)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if stats.Transferred != 3 {
+		t.Errorf("uploaded %d files, want 3", stats.Transferred)
+	}
+
+	// Shards built locally are kept.
+	writeFiles(t, dst, map[string]string{"local.zoekt": "local"})
+	d := &Downloader{Bucket: b, Dir: dst}
+	if _, err := d.Sync(ctx); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	want := map[string]string{
+		"a.zoekt":             "shard a",
+		"a.zoekt.meta":        "meta a",
+		"tenant-acme/b.zoekt": "shard b",
+		"local.zoekt":         "local",
+	}
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("after download got %v, want %v", got, want)
+	}
+
+	// A second sync transfers nothing.
+	if stats, err := u.Sync(ctx); err != nil || stats.Transferred != 0 {
+		t.Errorf("second upload: %+v, %v", stats, err)
+	}
+	if stats, err := d.Sync(ctx); err != nil || stats.Transferred != 0 || stats.Deleted != 0 {
+		t.Errorf("second download: %+v, %v", stats, err)
+	}
+
+	// Changes and deletions propagate.
+	writeFiles(t, src, map[string]string{"a.zoekt": "shard a, v2"})
+	if _, err := u.Sync(ctx); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if err := u.Remove(ctx, filepath.Join(src, "tenant-acme", "b.zoekt")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	stats, err = d.Sync(ctx)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if stats.Transferred != 1 || stats.Deleted != 1 {
+		t.Errorf("got %+v, want 1 download and 1 deletion", stats)
+	}
+	want["a.zoekt"] = "shard a, v2"
+	delete(want, "tenant-acme/b.zoekt")
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("after changes got %v, want %v", got, want)
+	}
+
+	// Shards a rebuild dropped are deleted from the bucket, unless
+	// another indexer uploaded its own version.
+	writeFiles(t, src, map[string]string{"f.zoekt": "shard f"})
+	if _, err := u.Sync(ctx); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	other := t.TempDir()
+	writeFiles(t, other, map[string]string{"f.zoekt": "shard f, other build"})
+	if _, err := (&Uploader{Bucket: b, Dir: other}).Sync(ctx); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	// Remove left b in src, so the last Sync uploaded it again.
+	for _, fn := range []string{"a.zoekt.meta", "f.zoekt", "tenant-acme/b.zoekt"} {
+		if err := os.Remove(filepath.Join(src, fn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, err := u.Sync(ctx); err != nil || stats.Deleted != 2 {
+		t.Errorf("upload after deletion: %+v, %v, want 2 deletions", stats, err)
+	}
+	if _, err := d.Sync(ctx); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	delete(want, "a.zoekt.meta")
+	want["f.zoekt"] = "shard f, other build"
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("after deletion got %v, want %v", got, want)
+	}
+
+	// Tombstones stay local, and remove the sidecar of the bucket.
+	writeFiles(t, src, map[string]string{"a.zoekt.meta": `{"Name": "a"}`})
+	if stats, err := u.Sync(ctx); err != nil || stats.Transferred != 1 {
+		t.Errorf("upload of sidecar: %+v, %v, want 1 upload", stats, err)
+	}
+	writeFiles(t, src, map[string]string{"a.zoekt.meta": `{"Name": "a", "Tombstone": true}`})
+	if stats, err := u.Sync(ctx); err != nil || stats.Transferred != 0 || stats.Deleted != 1 {
+		t.Errorf("upload of tombstone: %+v, %v, want only 1 deletion", stats, err)
+	}
+	if _, err := d.Sync(ctx); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("after tombstone got %v, want %v", got, want)
+	}
+}
+
+func TestDirBucket(t *testing.T) {
+	b, err := Open("file://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSync(t, b)
+}
+
+// fakeS3 is an S3 server for one bucket, returning lists in pages
+// of two objects.
+type fakeS3 struct {
+	t      *testing.T
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("X-Amz-Date") == "" {
+		s.t.Errorf("%s %s: bad authorization %q", r.Method, r.URL, auth)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+s.bucket)
+	if key == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == "GET" && key == "":
+		s.list(w, r)
+	case r.Method == "GET":
+		data, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sum := md5.Sum(data)
+		if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	keys = keys[start:]
+
+	var res listResult
+	if len(keys) > 2 {
+		keys = keys[:2]
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	for _, k := range keys {
+		sum := md5.Sum(s.objects[k])
+		res.Contents = append(res.Contents, struct {
+			Key  string
+			Size int64
+			ETag string
+		}{k, int64(len(s.objects[k])), `"` + hex.EncodeToString(sum[:]) + `"`})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listResult
+	}{listResult: res})
+}
+
+func TestS3Bucket(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	s := &fakeS3{t: t, bucket: "shards", objects: map[string][]byte{
+		"elsewhere/x.zoekt": []byte("outside the prefix"),
+	}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	b, err := Open("s3://shards/index/prod?endpoint=" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSync(t, b)
+
+	if _, err := b.Get(context.Background(), "missing.zoekt"); !os.IsNotExist(err) {
+		t.Errorf("Get of a missing object: got %v, want not exist", err)
+	}
+	if _, ok := s.objects["index/prod/a.zoekt"]; !ok {
+		t.Errorf("objects not stored under the prefix: %v", s.objects)
+	}
+	if _, ok := s.objects["elsewhere/x.zoekt"]; !ok {
+		t.Errorf("object outside the prefix deleted")
+	}
+}
+
+func TestS3Sign(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	b, err := Open("gs://shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := b.(*s3Bucket)
+	if got, want := s3.url("a b+c.zoekt", nil).String(), "https://storage.googleapis.com/shards/a%20b%2Bc.zoekt"; got != want {
+		t.Errorf("got URL %s, want %s", got, want)
+	}
+
+	b, err = Open("s3://shards/prefix?region=eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 = b.(*s3Bucket)
+	u := s3.url(s3.key("a.zoekt"), nil)
+	if want := "https://shards.s3.eu-west-1.amazonaws.com/prefix/a.zoekt"; u.String() != want {
+		t.Errorf("got URL %s, want %s", u, want)
+	}
+
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	s3.sign(req)
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("got Authorization %q", got)
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Bucket talks to the S3 REST API, signing requests with AWS
+// Signature Version 4.
+type s3Bucket struct {
+	scheme string
+	bucket string
+	prefix string
+
+	// endpoint is the service URL. With pathStyle, the bucket is
+	// the first element of the path; otherwise it is a subdomain
+	// of the endpoint.
+	endpoint  *url.URL
+	pathStyle bool
+	region    string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+func newS3Bucket(scheme, bucket, prefix string, params url.Values) (*s3Bucket, error) {
+	b := &s3Bucket{
+		scheme:       scheme,
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       params.Get("region"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       http.DefaultClient,
+		now:          time.Now,
+	}
+	if b.region == "" {
+		b.region = os.Getenv("AWS_REGION")
+	}
+
+	endpoint := params.Get("endpoint")
+	switch {
+	case endpoint != "":
+		b.pathStyle = true
+	case scheme == "gs":
+		endpoint = "https://storage.googleapis.com"
+		b.pathStyle = true
+		if b.region == "" {
+			b.region = "auto"
+		}
+	default:
+		if b.region == "" {
+			b.region = "us-east-1"
+		}
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", b.region)
+	}
+	if b.region == "" {
+		b.region = "us-east-1"
+	}
+
+	var err error
+	if b.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("endpoint %q: %v", endpoint, err)
+	}
+	if b.accessKey == "" || b.secretKey == "" {
+		return nil, fmt.Errorf("%s: $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY must be set", b)
+	}
+	return b, nil
+}
+
+func (b *s3Bucket) String() string {
+	if b.prefix == "" {
+		return b.scheme + "://" + b.bucket
+	}
+	return b.scheme + "://" + b.bucket + "/" + b.prefix
+}
+
+// key returns the key of the object name.
+func (b *s3Bucket) key(name string) string {
+	if b.prefix == "" {
+		return name
+	}
+	return b.prefix + "/" + name
+}
+
+// url returns the URL of key, or of the bucket if key is "".
+func (b *s3Bucket) url(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if b.pathStyle {
+		p += "/" + b.bucket
+	} else {
+		u.Host = b.bucket + "." + u.Host
+	}
+	u.Path = p + "/" + key
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// s3Error is an error response of the S3 API.
+type s3Error struct {
+	method string
+	url    string
+	status int
+	code   string
+	msg    string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s %s: status %d: %s %s", e.method, e.url, e.status, e.code, e.msg)
+}
+
+// do signs and sends a request. body may be nil. The response has a
+// 2xx status; other responses are returned as *s3Error.
+func (b *s3Bucket) do(ctx context.Context, method string, u *url.URL, body io.ReadSeeker, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the escaping used for the signature.
+	req.URL.RawPath = u.RawPath
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		size, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+	b.sign(req)
+
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	e := &s3Error{method: method, url: u.String(), status: resp.StatusCode}
+	var xe struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &xe) == nil {
+		e.code, e.msg = xe.Code, xe.Message
+	}
+	return nil, e
+}
+
+// sign adds the AWS Signature Version 4 headers to req. The payload
+// is not signed, so uploads are read only once; Content-MD5 protects
+// their integrity instead.
+func (b *s3Bucket) sign(req *http.Request) {
+	now := b.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath escapes p as S3 expects: everything but unreserved
+// characters and '/'.
+func escapePath(p string) string {
+	return strings.Replace(escape(p), "%2F", "/", -1)
+}
+
+// escape escapes everything but the unreserved characters of RFC
+// 3986.
+func escape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// canonicalQuery encodes q sorted by key, as the signature requires.
+func canonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string{}, q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// listResult is the response of ListObjectsV2.
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key  string
+		Size int64
+		ETag string
+	}
+}
+
+func (b *s3Bucket) List(ctx context.Context) ([]Object, error) {
+	prefix := ""
+	if b.prefix != "" {
+		prefix = b.prefix + "/"
+	}
+
+	var objs []Object
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := b.do(ctx, "GET", b.url("", q), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %v", b, err)
+		}
+
+		for _, c := range res.Contents {
+			o := Object{
+				Name: strings.TrimPrefix(c.Key, prefix),
+				Size: c.Size,
+			}
+			// The ETag of a multipart upload is not the MD5 of
+			// the contents.
+			if etag := strings.Trim(c.ETag, `"`); len(etag) == 2*md5.Size && !strings.Contains(etag, "-") {
+				o.MD5 = strings.ToLower(etag)
+			}
+			objs = append(objs, o)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return objs, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (b *s3Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, "GET", b.url(b.key(name), nil), nil, nil)
+	if e, ok := err.(*s3Error); ok && e.status == http.StatusNotFound {
+		return nil, &os.PathError{Op: "get", Path: b.String() + "/" + name, Err: os.ErrNotExist}
+	} else if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *s3Bucket) Put(ctx context.Context, name string, r io.ReadSeeker) error {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Md5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := b.do(ctx, "PUT", b.url(b.key(name), nil), r, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *s3Bucket) Delete(ctx context.Context, name string) error {
+	resp, err := b.do(ctx, "DELETE", b.url(b.key(name), nil), nil, nil)
+	if e, ok := err.(*s3Error); ok && e.status == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,317 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+)
+
+// Uploader copies the shards of an index directory to a bucket. As
+// several indexers may upload the same shards, it only deletes the
+// objects it uploaded itself, once their shard is gone from the
+// directory and no other indexer overwrote them; see also Remove.
+// It is safe for concurrent use.
+type Uploader struct {
+	Bucket Bucket
+
+	// Dir is the index directory.
+	Dir string
+
+	mu   sync.Mutex
+	sums checksummer
+
+	// uploaded holds the MD5 of the objects known to be in the
+	// bucket. It is nil until the bucket was listed.
+	uploaded map[string]string
+
+	// mine holds the MD5 of the objects this Uploader put.
+	mine map[string]string
+}
+
+// Sync uploads the shards of Dir that are new or changed since the
+// last Sync. The first Sync lists the bucket, so shards that are
+// already there are not uploaded again. Objects uploaded by an
+// earlier Sync whose shard was deleted since, eg. because a rebuild
+// made fewer shards, are deleted. Sidecars tombstoning their shard
+// are not uploaded, and count as deleted.
+func (u *Uploader) Sync(ctx context.Context) (*Stats, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.uploaded == nil {
+		objs, err := u.Bucket.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		u.uploaded = map[string]string{}
+		for _, o := range objs {
+			u.uploaded[o.Name] = o.MD5
+		}
+	}
+
+	local, err := u.sums.list(u.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for name := range local {
+		// Tombstones are local to an indexer: another one may
+		// own the repository now, and upload shards of the same
+		// name.
+		if strings.HasSuffix(name, ".meta") && tombstoned(filepath.Join(u.Dir, filepath.FromSlash(name))) {
+			delete(local, name)
+		}
+	}
+
+	var stats Stats
+	for name, f := range local {
+		if sum, ok := u.uploaded[name]; ok && (sum == "" || sum == f.md5) {
+			stats.Unchanged++
+			continue
+		}
+		if err := u.put(ctx, name); err != nil {
+			return &stats, err
+		}
+		u.uploaded[name] = f.md5
+		if u.mine == nil {
+			u.mine = map[string]string{}
+		}
+		u.mine[name] = f.md5
+		stats.Transferred++
+		stats.Bytes += f.size
+	}
+
+	var gone []string
+	for name := range u.mine {
+		if _, ok := local[name]; !ok {
+			gone = append(gone, name)
+		}
+	}
+	if len(gone) == 0 {
+		return &stats, nil
+	}
+	objs, err := u.Bucket.List(ctx)
+	if err != nil {
+		return &stats, err
+	}
+	remote := map[string]string{}
+	for _, o := range objs {
+		remote[o.Name] = o.MD5
+	}
+	for _, name := range gone {
+		// A different MD5 means another indexer uploaded its
+		// own build of the shard.
+		if sum, ok := remote[name]; ok && (sum == "" || sum == u.mine[name]) {
+			if err := u.Bucket.Delete(ctx, name); err != nil {
+				return &stats, err
+			}
+			stats.Deleted++
+		}
+		delete(u.mine, name)
+		delete(u.uploaded, name)
+	}
+	return &stats, nil
+}
+
+// tombstoned returns whether the sidecar metadata fn tombstones its
+// shard.
+func tombstoned(fn string) bool {
+	blob, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return false
+	}
+	var repo struct{ Tombstone bool }
+	return json.Unmarshal(blob, &repo) == nil && repo.Tombstone
+}
+
+func (u *Uploader) put(ctx context.Context, name string) error {
+	f, err := os.Open(filepath.Join(u.Dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := u.Bucket.Put(ctx, name, f); err != nil {
+		return fmt.Errorf("upload %s: %v", name, err)
+	}
+	slog.Debug("uploaded shard", "shard", name, "bucket", u.Bucket.String())
+	return nil
+}
+
+// Remove deletes the objects of the shard fn in Dir and of its
+// metadata sidecar, eg. because its repository was deleted.
+func (u *Uploader) Remove(ctx context.Context, fn string) error {
+	rel, err := filepath.Rel(u.Dir, fn)
+	if err != nil {
+		return err
+	}
+	name := filepath.ToSlash(rel)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, n := range []string{name, zoekt.ShardMetaName(name)} {
+		if err := u.Bucket.Delete(ctx, n); err != nil {
+			return err
+		}
+		delete(u.uploaded, n)
+		delete(u.mine, n)
+	}
+	return nil
+}
+
+// Downloader keeps an index directory in sync with the shards in a
+// bucket.
+type Downloader struct {
+	Bucket Bucket
+
+	// Dir is the index directory.
+	Dir string
+
+	sums checksummer
+
+	// seen holds the objects found in the bucket by earlier
+	// syncs.
+	seen map[string]bool
+}
+
+// Sync downloads the shards that are new or changed in the bucket.
+// Shards are downloaded into temporary files and renamed into place,
+// so a directory watcher only sees complete shards.
+//
+// A local shard is deleted only once its object, seen in the bucket
+// by an earlier Sync, is gone from it. Shards built locally that were
+// never uploaded are left alone.
+func (d *Downloader) Sync(ctx context.Context) (*Stats, error) {
+	objs, err := d.Bucket.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local, err := d.sums.list(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats Stats
+	remote := map[string]bool{}
+	for _, o := range objs {
+		if !validName(o.Name) {
+			continue
+		}
+		remote[o.Name] = true
+		if f, ok := local[o.Name]; ok && f.same(o) {
+			stats.Unchanged++
+			continue
+		}
+		if err := d.Fetch(ctx, o); err != nil {
+			return &stats, err
+		}
+		stats.Transferred++
+		stats.Bytes += o.Size
+	}
+
+	for name := range d.seen {
+		if remote[name] {
+			continue
+		}
+		if _, ok := local[name]; !ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(d.Dir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+			return &stats, err
+		}
+		stats.Deleted++
+	}
+	d.seen = remote
+	return &stats, nil
+}
+
+// Fetch downloads the object o into Dir. It is written to a
+// temporary file, verified against the MD5 of o if known and renamed
+// into place.
+func (d *Downloader) Fetch(ctx context.Context, o Object) error {
+	rc, err := d.Bucket.Get(ctx, o.Name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dst := filepath.Join(d.Dir, filepath.FromSlash(o.Name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dst), path.Base(o.Name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, h), rc)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("download %s: %v", o.Name, err)
+	}
+
+	if n != o.Size {
+		return fmt.Errorf("download %s: got %d bytes, want %d", o.Name, n, o.Size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); o.MD5 != "" && got != o.MD5 {
+		return fmt.Errorf("download %s: MD5 %s, want %s", o.Name, got, o.MD5)
+	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return err
+	}
+	slog.Info("downloaded shard", "shard", o.Name, "bytes", o.Size, "bucket", d.Bucket.String())
+	return nil
+}
+
+// Run calls Sync every interval until ctx is canceled.
+func (d *Downloader) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if stats, err := d.Sync(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("syncing shards from bucket failed", "bucket", d.Bucket.String(), "error", err)
+		} else if stats.Transferred > 0 || stats.Deleted > 0 {
+			slog.Info("synced shards from bucket", "bucket", d.Bucket.String(),
+				"downloaded", stats.Transferred, "deleted", stats.Deleted, "bytes", stats.Bytes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// PostingEncodingRoaring is the IndexMetadata.PostingEncoding of
+// shards whose ngram posting lists are roaring bitmaps. Otherwise
+// they are lists of varint encoded deltas.
+const PostingEncodingRoaring = "roaring"
+
+// checkPostingEncoding returns an error if e is not a supported
+// posting encoding.
+func checkPostingEncoding(e string) error {
+	switch e {
+	case "", PostingEncodingRoaring:
+		return nil
+	}
+	return fmt.Errorf("unknown posting encoding %q, want %q or none", e, PostingEncodingRoaring)
+}
+
+// encodePostings converts a posting list of varint deltas, as built
+// by postingsBuilder, to encoding.
+func encodePostings(deltas []byte, encoding string) ([]byte, error) {
+	if encoding == "" {
+		return deltas, nil
+	}
+	bm := roaring.BitmapOf(fromDeltas(deltas, nil)...)
+	bm.RunOptimize()
+	return bm.ToBytes()
+}
+
+// decodePostings returns the offsets of a posting list.
+func decodePostings(data []byte, encoding string) ([]uint32, error) {
+	if encoding == "" {
+		return fromDeltas(data, nil), nil
+	}
+	bm := roaring.New()
+	if _, err := bm.FromUnsafeBytes(data); err != nil {
+		return nil, Errorf(CodeShardCorrupt, "roaring posting list: %v", err)
+	}
+	return bm.ToArray(), nil
+}
+
+// roaringPostingIterator goes over a posting list encoded as a
+// roaring bitmap.
+type roaringPostingIterator struct {
+	it     roaring.IntPeekable
+	_first uint32
+	size   int
+	what   ngram
+}
+
+func newRoaringPostingIterator(b []byte, w ngram) (*roaringPostingIterator, error) {
+	bm := roaring.New()
+	if _, err := bm.FromUnsafeBytes(b); err != nil {
+		return nil, Errorf(CodeShardCorrupt, "roaring posting list of %s: %v", w, err)
+	}
+	i := &roaringPostingIterator{
+		it:     bm.Iterator(),
+		_first: maxUInt32,
+		size:   len(b),
+		what:   w,
+	}
+	if i.it.HasNext() {
+		i._first = i.it.Next()
+	}
+	return i, nil
+}
+
+func (i *roaringPostingIterator) String() string {
+	return fmt.Sprintf("roaring(%s, %d, [%d bytes])", i.what, i._first, i.size)
+}
+
+func (i *roaringPostingIterator) first() uint32 {
+	return i._first
+}
+
+func (i *roaringPostingIterator) next(limit uint32) {
+	if i._first > limit {
+		return
+	}
+	if limit == maxUInt32 {
+		i._first = maxUInt32
+		return
+	}
+	i.it.AdvanceIfNeeded(limit + 1)
+	if i.it.HasNext() {
+		i._first = i.it.Next()
+	} else {
+		i._first = maxUInt32
+	}
+}
+
+func (i *roaringPostingIterator) updateStats(s *Stats) {
+	// The bitmap is read as a whole.
+	s.IndexBytesLoaded += int64(i.size)
+	i.size = 0
+}
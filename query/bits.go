@@ -14,13 +14,17 @@
 
 package query
 
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
 func toLower(in []byte) []byte {
-	out := make([]byte, len(in))
-	for i, c := range in {
-		if c >= 'A' && c <= 'Z' {
-			c = c - 'A' + 'a'
-		}
-		out[i] = c
+	out := make([]byte, 0, len(in))
+	var buf [utf8.UTFMax]byte
+	for _, c := range string(in) {
+		n := utf8.EncodeRune(buf[:], unicode.ToLower(c))
+		out = append(out, buf[:n]...)
 	}
 	return out
 }
@@ -0,0 +1,59 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"regexp"
+	"strings"
+)
+
+// isGlob returns whether a file: or repo: argument is a glob rather
+// than a regular expression. Globs have a "*" at the start or after
+// a "/", which is invalid or unusual in a regular expression.
+func isGlob(s string) bool {
+	return strings.HasPrefix(s, "*") || strings.Contains(s, "/*")
+}
+
+// globToRegexp translates a glob into an anchored regular
+// expression. "*" matches within a path component, "?" matches one
+// character other than "/", and "**" matches across components. If
+// basename is set and the glob has no "/", it may match the last
+// component of a path, so "*.go" matches "a/b.go".
+func globToRegexp(glob string, basename bool) string {
+	var b strings.Builder
+	if basename && !strings.Contains(glob, "/") {
+		b.WriteString("(?:^|/)")
+	} else {
+		b.WriteString("^")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,328 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+)
+
+// JSONVersion is the version of the encoding written by Marshal. It
+// is incremented on incompatible changes; Unmarshal rejects versions
+// it does not know.
+const JSONVersion = 1
+
+// jsonEnvelope is the top-level object written by Marshal.
+type jsonEnvelope struct {
+	Version int    `json:"version"`
+	Query   *jsonQ `json:"query"`
+}
+
+// jsonQ is the encoding of a single query node. Kind selects the
+// node type, and determines which of the other fields are used.
+type jsonQ struct {
+	Kind string `json:"kind"`
+
+	Pattern       string `json:"pattern,omitempty"`
+	CaseSensitive bool   `json:"case_sensitive,omitempty"`
+	FileName      bool   `json:"file_name,omitempty"`
+	Content       bool   `json:"content,omitempty"`
+	Word          bool   `json:"word,omitempty"`
+
+	Value bool     `json:"value,omitempty"`
+	Set   []string `json:"set,omitempty"`
+	IDs   []uint32 `json:"ids,omitempty"`
+	Type  string   `json:"type,omitempty"`
+	Bytes int64    `json:"bytes,omitempty"`
+
+	Commit       string              `json:"commit,omitempty"`
+	RepoBranches map[string][]string `json:"repo_branches,omitempty"`
+
+	Child    *jsonQ   `json:"child,omitempty"`
+	Children []*jsonQ `json:"children,omitempty"`
+}
+
+// Marshal encodes q as versioned JSON. Unlike q.String(), the
+// encoding is lossless, so it can be used to send queries to other
+// processes, or to log queries and replay them later.
+func Marshal(q Q) ([]byte, error) {
+	j, err := toJSON(q)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonEnvelope{
+		Version: JSONVersion,
+		Query:   j,
+	})
+}
+
+// Unmarshal decodes a query encoded by Marshal.
+func Unmarshal(data []byte) (Q, error) {
+	var env jsonEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if env.Version != JSONVersion {
+		return nil, fmt.Errorf("query: unsupported JSON version %d", env.Version)
+	}
+	if env.Query == nil {
+		return nil, fmt.Errorf("query: missing query")
+	}
+	return fromJSON(env.Query)
+}
+
+var typeNames = map[uint8]string{
+	TypeFileMatch: "filematch",
+	TypeRepo:      "repo",
+	TypeFileName:  "filename",
+}
+
+func toJSONList(qs []Q) ([]*jsonQ, error) {
+	var res []*jsonQ
+	for _, q := range qs {
+		j, err := toJSON(q)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, j)
+	}
+	return res, nil
+}
+
+func toJSON(q Q) (*jsonQ, error) {
+	var err error
+	switch s := q.(type) {
+	case *And:
+		j := &jsonQ{Kind: "and"}
+		j.Children, err = toJSONList(s.Children)
+		return j, err
+	case *Or:
+		j := &jsonQ{Kind: "or"}
+		j.Children, err = toJSONList(s.Children)
+		return j, err
+	case *Not:
+		j := &jsonQ{Kind: "not"}
+		j.Child, err = toJSON(s.Child)
+		return j, err
+	case *Type:
+		name, ok := typeNames[s.Type]
+		if !ok {
+			return nil, fmt.Errorf("query: unknown type %d", s.Type)
+		}
+		j := &jsonQ{Kind: "type", Type: name}
+		j.Child, err = toJSON(s.Child)
+		return j, err
+	case *Substring:
+		return &jsonQ{
+			Kind:          "substring",
+			Pattern:       s.Pattern,
+			CaseSensitive: s.CaseSensitive,
+			FileName:      s.FileName,
+			Content:       s.Content,
+			Word:          s.Word,
+		}, nil
+	case *Regexp:
+		return &jsonQ{
+			Kind:          "regexp",
+			Pattern:       s.Regexp.String(),
+			CaseSensitive: s.CaseSensitive,
+			FileName:      s.FileName,
+			Content:       s.Content,
+		}, nil
+	case *Symbol:
+		j := &jsonQ{Kind: "symbol"}
+		j.Child, err = toJSON(s.Atom)
+		return j, err
+	case *Language:
+		return &jsonQ{Kind: "language", Pattern: s.Language}, nil
+	case *Const:
+		return &jsonQ{Kind: "const", Value: s.Value}, nil
+	case *Repo:
+		return &jsonQ{Kind: "repo", Pattern: s.Pattern}, nil
+	case *RepoRegexp:
+		return &jsonQ{Kind: "repo_regexp", Pattern: s.Regexp.String()}, nil
+	case *RepoSet:
+		j := &jsonQ{Kind: "repo_set", Set: []string{}}
+		for r := range s.Set {
+			j.Set = append(j.Set, r)
+		}
+		sort.Strings(j.Set)
+		return j, nil
+	case *RepoIDs:
+		j := &jsonQ{Kind: "repo_ids"}
+		for id := range s.Set {
+			j.IDs = append(j.IDs, id)
+		}
+		sort.Slice(j.IDs, func(a, b int) bool { return j.IDs[a] < j.IDs[b] })
+		return j, nil
+	case *RepoBranches:
+		return &jsonQ{Kind: "repo_branches", RepoBranches: s.Set}, nil
+	case *RepoCommit:
+		return &jsonQ{Kind: "repo_commit", Pattern: s.Repo, Commit: s.Commit}, nil
+	case *RepoDescription:
+		return &jsonQ{Kind: "repo_description", Pattern: s.Pattern}, nil
+	case *Topic:
+		return &jsonQ{Kind: "topic", Pattern: s.Topic}, nil
+	case *RepoFlag:
+		name, ok := repoFlagNames[s.Flag]
+		if !ok {
+			return nil, fmt.Errorf("query: unknown repository flag %d", s.Flag)
+		}
+		return &jsonQ{Kind: "repo_flag", Type: name}, nil
+	case *FileCategory:
+		name, ok := fileCategoryNames[s.Category]
+		if !ok {
+			return nil, fmt.Errorf("query: unknown file category %d", s.Category)
+		}
+		return &jsonQ{Kind: "file_category", Type: name}, nil
+	case *FileSize:
+		return &jsonQ{Kind: "file_size", Value: s.Greater, Bytes: s.Bytes}, nil
+	case *Branch:
+		return &jsonQ{Kind: "branch", Pattern: s.Pattern}, nil
+	}
+	return nil, fmt.Errorf("query: cannot marshal %T", q)
+}
+
+func fromJSONList(js []*jsonQ) ([]Q, error) {
+	var res []Q
+	for _, j := range js {
+		q, err := fromJSON(j)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, q)
+	}
+	return res, nil
+}
+
+func fromJSONChild(j *jsonQ) (Q, error) {
+	if j.Child == nil {
+		return nil, fmt.Errorf("query: %s without child", j.Kind)
+	}
+	return fromJSON(j.Child)
+}
+
+func fromJSON(j *jsonQ) (Q, error) {
+	switch j.Kind {
+	case "and":
+		children, err := fromJSONList(j.Children)
+		if err != nil {
+			return nil, err
+		}
+		return &And{Children: children}, nil
+	case "or":
+		children, err := fromJSONList(j.Children)
+		if err != nil {
+			return nil, err
+		}
+		return &Or{Children: children}, nil
+	case "not":
+		child, err := fromJSONChild(j)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Child: child}, nil
+	case "type":
+		child, err := fromJSONChild(j)
+		if err != nil {
+			return nil, err
+		}
+		for t, name := range typeNames {
+			if name == j.Type {
+				return &Type{Child: child, Type: t}, nil
+			}
+		}
+		return nil, fmt.Errorf("query: unknown type %q", j.Type)
+	case "substring":
+		return &Substring{
+			Pattern:       j.Pattern,
+			CaseSensitive: j.CaseSensitive,
+			FileName:      j.FileName,
+			Content:       j.Content,
+			Word:          j.Word,
+		}, nil
+	case "regexp":
+		r, err := syntax.Parse(j.Pattern, regexpFlags)
+		if err != nil {
+			return nil, err
+		}
+		return &Regexp{
+			Regexp:        r,
+			CaseSensitive: j.CaseSensitive,
+			FileName:      j.FileName,
+			Content:       j.Content,
+		}, nil
+	case "symbol":
+		child, err := fromJSONChild(j)
+		if err != nil {
+			return nil, err
+		}
+		atom, ok := child.(*Substring)
+		if !ok {
+			return nil, fmt.Errorf("query: symbol of %s, want substring", j.Child.Kind)
+		}
+		return &Symbol{Atom: atom}, nil
+	case "language":
+		return &Language{Language: j.Pattern}, nil
+	case "const":
+		return &Const{Value: j.Value}, nil
+	case "repo":
+		return &Repo{Pattern: j.Pattern}, nil
+	case "repo_regexp":
+		r, err := regexp.Compile(j.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &RepoRegexp{Regexp: r}, nil
+	case "repo_set":
+		return NewRepoSet(j.Set...), nil
+	case "repo_ids":
+		return NewRepoIDs(j.IDs...), nil
+	case "repo_branches":
+		set := j.RepoBranches
+		if set == nil {
+			set = map[string][]string{}
+		}
+		return &RepoBranches{Set: set}, nil
+	case "repo_commit":
+		return &RepoCommit{Repo: j.Pattern, Commit: j.Commit}, nil
+	case "repo_description":
+		return &RepoDescription{Pattern: j.Pattern}, nil
+	case "topic":
+		return &Topic{Topic: j.Pattern}, nil
+	case "repo_flag":
+		for f, name := range repoFlagNames {
+			if name == j.Type {
+				return &RepoFlag{Flag: f}, nil
+			}
+		}
+		return nil, fmt.Errorf("query: unknown repository flag %q", j.Type)
+	case "file_category":
+		for c, name := range fileCategoryNames {
+			if name == j.Type {
+				return &FileCategory{Category: c}, nil
+			}
+		}
+		return nil, fmt.Errorf("query: unknown file category %q", j.Type)
+	case "file_size":
+		return &FileSize{Greater: j.Value, Bytes: j.Bytes}, nil
+	case "branch":
+		return &Branch{Pattern: j.Pattern}, nil
+	}
+	return nil, fmt.Errorf("query: unknown kind %q", j.Kind)
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		"needle",
+		"case:yes Needle file:java",
+		`\bword\b -hay`,
+		"(foo or bar) and -(baz qux)",
+		"f:\\.go$ content:\"a b\"",
+		"sym:Data lang:go branch:master",
+		"repo:github.com/org/* file:*.go",
+		"type:repo needle",
+		"type:filename main",
+		"archived:no fork:only public:only",
+		"repo.desc:\"fast compiler\" topic:go",
+		"abc -category:vendored category:test",
+		"size:>1mb -size:<10",
+	} {
+		q, err := Parse(in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", in, err)
+		}
+		data, err := Marshal(q)
+		if err != nil {
+			t.Fatalf("Marshal(%s): %v", q, err)
+		}
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+		if got.String() != q.String() {
+			t.Errorf("%s: got %s, want %s", data, got, q)
+		}
+	}
+
+	for _, q := range []Q{
+		&Const{Value: true},
+		&Const{Value: false},
+		NewRepoSet("a", "b"),
+		NewRepoIDs(3, 1, 2),
+		&RepoCommit{Repo: "a", Commit: "abc"},
+		&RepoBranches{Set: map[string][]string{"a": {"main"}, "b": {"release-1.2", "HEAD"}}},
+		&Substring{Pattern: "x", Word: true, Content: true},
+	} {
+		data, err := Marshal(q)
+		if err != nil {
+			t.Fatalf("Marshal(%s): %v", q, err)
+		}
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+		if !reflect.DeepEqual(got, q) {
+			t.Errorf("%s: got %#v, want %#v", data, got, q)
+		}
+	}
+}
+
+func TestMarshalStable(t *testing.T) {
+	q := NewAnd(
+		&Substring{Pattern: "needle", CaseSensitive: true},
+		&Not{Child: &Repo{Pattern: "hay"}},
+	)
+	data, err := Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"version":1,"query":{"kind":"and","children":[{"kind":"substring","pattern":"needle","case_sensitive":true},{"kind":"not","child":{"kind":"repo","pattern":"hay"}}]}}`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, in := range []string{
+		`{"version":2,"query":{"kind":"const"}}`,
+		`{"version":1}`,
+		`{"version":1,"query":{"kind":"bogus"}}`,
+		`{"version":1,"query":{"kind":"not"}}`,
+		`{"version":1,"query":{"kind":"regexp","pattern":"("}}`,
+		`{"version":1,"query":{"kind":"type","type":"bogus","child":{"kind":"const"}}}`,
+		`{"version":1,"query":{"kind":"symbol","child":{"kind":"const"}}}`,
+	} {
+		if q, err := Unmarshal([]byte(in)); err == nil {
+			t.Errorf("Unmarshal(%s): got %s, want error", in, q)
+		}
+	}
+
+	if _, err := Marshal(&caseQ{"yes"}); err == nil {
+		t.Errorf("Marshal(caseQ) succeeded")
+	}
+}
@@ -18,7 +18,10 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"regexp"
 	"regexp/syntax"
+	"strconv"
+	"strings"
 )
 
 var _ = log.Printf
@@ -77,6 +80,15 @@ func (o *orOperator) String() string {
 	return "orOp"
 }
 
+// andOperator is a placeholder for an explicit "and". Juxtaposed
+// expressions are and-ed already, so it only has to be checked for
+// operands.
+type andOperator struct{}
+
+func (o *andOperator) String() string {
+	return "andOp"
+}
+
 func isSpace(c byte) bool {
 	return c == ' ' || c == '\t'
 }
@@ -116,11 +128,31 @@ done:
 	return arg, len(in) - len(left), true, nil
 }
 
-// Parse parses a string into a query.
+// Parse parses a string into a query. Atoms use smart case, as for
+// "case:auto": they match case-sensitively only if they contain upper
+// case characters.
+//
+// Expressions separated by white space, or by "and", must all match.
+// This binds more tightly than "or", so "a b or c" is "(a b) or c".
+// Parentheses followed by white space group expressions, and "-"
+// negates the expression that follows it, including a group, as in
+// "-(a or b)". Parentheses inside a word, as in "(ab)", are part of
+// a regular expression.
 func Parse(qStr string) (Q, error) {
+	return ParseWithCase(qStr, "auto")
+}
+
+// ParseWithCase is like Parse, but uses defaultCase, one of "yes",
+// "no" or "auto", for atoms unless the query has a case: atom.
+func ParseWithCase(qStr string, defaultCase string) (Q, error) {
+	switch defaultCase {
+	case "yes", "no", "auto":
+	default:
+		return nil, fmt.Errorf("query: unknown case %q, want {yes,no,auto}", defaultCase)
+	}
 	b := []byte(qStr)
 
-	qs, _, err := parseExprList(b)
+	qs, _, err := parseExprList(b, defaultCase)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +167,7 @@ func Parse(qStr string) (Q, error) {
 
 // parseExpr parses a single expression, returning the result, and the
 // number of bytes consumed.
-func parseExpr(in []byte) (Q, int, error) {
+func parseExpr(in []byte, defaultCase string) (Q, int, error) {
 	b := in[:]
 	var expr Q
 	for len(b) > 0 && isSpace(b[0]) {
@@ -163,9 +195,52 @@ func parseExpr(in []byte) (Q, int, error) {
 		}
 		expr = &caseQ{text}
 	case tokRepo:
-		expr = &Repo{Pattern: text}
+		if isGlob(text) {
+			re, err := regexp.Compile(globToRegexp(text, false))
+			if err != nil {
+				return nil, 0, err
+			}
+			expr = &RepoRegexp{Regexp: re}
+		} else {
+			expr = &Repo{Pattern: text}
+		}
 	case tokBranch:
 		expr = &Branch{Pattern: text}
+	case tokRepoDesc:
+		expr = &RepoDescription{Pattern: text}
+	case tokTopic:
+		if text == "" {
+			return nil, 0, fmt.Errorf("the topic: atom must have an argument")
+		}
+		expr = &Topic{Topic: text}
+	case tokArchived, tokFork, tokPublic:
+		flag := &RepoFlag{Flag: repoFlagTokens[tok.Type]}
+		switch text {
+		case "yes":
+			expr = &Const{Value: true}
+		case "no":
+			expr = &Not{Child: flag}
+		case "only":
+			expr = flag
+		default:
+			return nil, 0, fmt.Errorf("query: unknown %s argument %q, want {yes,no,only}", repoFlagNames[flag.Flag], text)
+		}
+	case tokCategory:
+		expr = nil
+		for c, name := range fileCategoryNames {
+			if name == text {
+				expr = &FileCategory{Category: c}
+			}
+		}
+		if expr == nil {
+			return nil, 0, fmt.Errorf("query: unknown category argument %q, want {generated,vendored,test}", text)
+		}
+	case tokSize:
+		q, err := parseFileSize(text)
+		if err != nil {
+			return nil, 0, err
+		}
+		expr = q
 	case tokText, tokRegex:
 		q, err := regexpQuery(text, false, false)
 		if err != nil {
@@ -173,6 +248,9 @@ func parseExpr(in []byte) (Q, int, error) {
 		}
 		expr = q
 	case tokFile:
+		if isGlob(text) {
+			text = globToRegexp(text, true)
+		}
 		q, err := regexpQuery(text, false, true)
 		if err != nil {
 			return nil, 0, err
@@ -188,6 +266,18 @@ func parseExpr(in []byte) (Q, int, error) {
 	case tokLang:
 		expr = &Language{Language: text}
 
+	case tokType:
+		switch text {
+		case "repo":
+			expr = &Type{Type: TypeRepo}
+		case "file", "filematch":
+			expr = &Type{Type: TypeFileMatch}
+		case "filename":
+			expr = &Type{Type: TypeFileName}
+		default:
+			return nil, 0, fmt.Errorf("query: unknown type argument %q, want {repo,filematch,filename}", text)
+		}
+
 	case tokSym:
 		if text == "" {
 			return nil, 0, fmt.Errorf("the sym: atom must have an argument")
@@ -199,7 +289,7 @@ func parseExpr(in []byte) (Q, int, error) {
 		expr = nil
 
 	case tokParenOpen:
-		qs, n, err := parseExprList(b)
+		qs, n, err := parseExprList(b, defaultCase)
 		b = b[n:]
 		if err != nil {
 			return nil, 0, err
@@ -219,10 +309,13 @@ func parseExpr(in []byte) (Q, int, error) {
 			return nil, 0, err
 		}
 	case tokNegate:
-		subQ, n, err := parseExpr(b)
+		subQ, n, err := parseExpr(b, defaultCase)
 		if err != nil {
 			return nil, 0, err
 		}
+		if _, ok := subQ.(*Type); ok {
+			return nil, 0, fmt.Errorf("query: cannot negate type:")
+		}
 		b = b[n:]
 		expr = &Not{subQ}
 
@@ -231,6 +324,61 @@ func parseExpr(in []byte) (Q, int, error) {
 	return expr, len(in) - len(b), nil
 }
 
+// sizeUnits are the multipliers of the units of size: atoms.
+var sizeUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+}
+
+// parseFileSize parses the argument of a size: atom, a comparison
+// such as ">1mb" or "<=100k".
+func parseFileSize(text string) (Q, error) {
+	arg := text
+	q := &FileSize{}
+	orEqual := false
+	switch {
+	case strings.HasPrefix(arg, ">"):
+		q.Greater = true
+		arg = arg[1:]
+	case strings.HasPrefix(arg, "<"):
+		arg = arg[1:]
+	default:
+		return nil, fmt.Errorf("query: size argument %q must start with > or <", text)
+	}
+	if strings.HasPrefix(arg, "=") {
+		orEqual = true
+		arg = arg[1:]
+	}
+
+	arg = strings.ToLower(arg)
+	i := strings.IndexFunc(arg, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(arg)
+	}
+	n, err := strconv.ParseFloat(arg[:i], 64)
+	unit, ok := sizeUnits[arg[i:]]
+	if err != nil || !ok || n < 0 {
+		return nil, fmt.Errorf("query: unknown size argument %q, want for example >1mb or <10k", text)
+	}
+	q.Bytes = int64(n * unit)
+	if orEqual {
+		if q.Greater {
+			q.Bytes--
+		} else {
+			q.Bytes++
+		}
+	}
+	return q, nil
+}
+
 const regexpFlags syntax.Flags = syntax.ClassNL | syntax.PerlX | syntax.UnicodeGroups
 
 // regexpQuery parses an atom into either a regular expression, or a
@@ -249,6 +397,13 @@ func regexpQuery(text string, content, file bool) (Q, error) {
 			FileName: file,
 			Content:  content,
 		}
+	} else if lit, ok := wordLiteral(r); ok {
+		expr = &Substring{
+			Pattern:  lit,
+			FileName: file,
+			Content:  content,
+			Word:     true,
+		}
 	} else {
 		expr = &Regexp{
 			Regexp:   r,
@@ -260,13 +415,35 @@ func regexpQuery(text string, content, file bool) (Q, error) {
 	return expr, nil
 }
 
+// wordLiteral returns the literal of a regexp \bliteral\b, which
+// can be evaluated as a whole-word substring search.
+func wordLiteral(r *syntax.Regexp) (string, bool) {
+	if r.Op != syntax.OpConcat || len(r.Sub) != 3 {
+		return "", false
+	}
+	if r.Sub[0].Op != syntax.OpWordBoundary || r.Sub[2].Op != syntax.OpWordBoundary {
+		return "", false
+	}
+	lit := r.Sub[1]
+	if lit.Op != syntax.OpLiteral || lit.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	return string(lit.Rune), true
+}
+
 // parseOperators interprets the orOperator in a list of queries.
 func parseOperators(in []Q) (Q, error) {
 	top := &Or{}
 	cur := &And{}
 
 	seenOr := false
-	for _, q := range in {
+	for i, q := range in {
+		if _, ok := q.(*andOperator); ok {
+			if len(cur.Children) == 0 || i+1 == len(in) || isOperator(in[i+1]) {
+				return nil, fmt.Errorf("query: AND operator should have operands")
+			}
+			continue
+		}
 		if _, ok := q.(*orOperator); ok {
 			seenOr = true
 			if len(cur.Children) == 0 {
@@ -286,9 +463,17 @@ func parseOperators(in []Q) (Q, error) {
 	return top, nil
 }
 
+func isOperator(q Q) bool {
+	switch q.(type) {
+	case *orOperator, *andOperator:
+		return true
+	}
+	return false
+}
+
 // parseExprList parses a list of query expressions. It is the
 // workhorse of the Parse function.
-func parseExprList(in []byte) ([]Q, int, error) {
+func parseExprList(in []byte, defaultCase string) ([]Q, int, error) {
 	b := in[:]
 	var qs []Q
 	for len(b) > 0 {
@@ -302,9 +487,13 @@ func parseExprList(in []byte) ([]Q, int, error) {
 			qs = append(qs, &orOperator{})
 			b = b[len(tok.Input):]
 			continue
+		} else if tok != nil && tok.Type == tokAnd {
+			qs = append(qs, &andOperator{})
+			b = b[len(tok.Input):]
+			continue
 		}
 
-		q, n, err := parseExpr(b)
+		q, n, err := parseExpr(b, defaultCase)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -317,11 +506,14 @@ func parseExprList(in []byte) ([]Q, int, error) {
 		b = b[n:]
 	}
 
-	setCase := "auto"
+	setCase := defaultCase
+	var typ *Type
 	newQS := qs[:0]
 	for _, q := range qs {
 		if sc, ok := q.(*caseQ); ok {
 			setCase = sc.Flavor
+		} else if t, ok := q.(*Type); ok && t.Child == nil {
+			typ = t
 		} else {
 			newQS = append(newQS, q)
 		}
@@ -334,6 +526,15 @@ func parseExprList(in []byte) ([]Q, int, error) {
 			return q
 		})
 	})
+	if typ != nil {
+		// type: applies to the whole list of expressions.
+		child, err := parseOperators(qs)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ.Child = child
+		qs = []Q{typ}
+	}
 	return qs, len(in) - len(b), nil
 }
 
@@ -366,8 +567,24 @@ const (
 	tokContent    = 11
 	tokLang       = 12
 	tokSym        = 13
+	tokType       = 14
+	tokAnd        = 15
+	tokArchived   = 16
+	tokFork       = 17
+	tokPublic     = 18
+	tokRepoDesc   = 19
+	tokTopic      = 20
+	tokCategory   = 21
+	tokSize       = 22
 )
 
+// repoFlagTokens maps tokens to the RepoFlag they select.
+var repoFlagTokens = map[int]uint8{
+	tokArchived: RepoFlagArchived,
+	tokFork:     RepoFlagFork,
+	tokPublic:   RepoFlagPublic,
+}
+
 var tokNames = map[int]string{
 	tokBranch:     "Branch",
 	tokCase:       "Case",
@@ -382,25 +599,44 @@ var tokNames = map[int]string{
 	tokText:       "Text",
 	tokLang:       "Language",
 	tokSym:        "Symbol",
+	tokType:       "Type",
+	tokAnd:        "And",
+	tokArchived:   "Archived",
+	tokFork:       "Fork",
+	tokPublic:     "Public",
+	tokRepoDesc:   "RepoDescription",
+	tokTopic:      "Topic",
+	tokCategory:   "Category",
+	tokSize:       "Size",
 }
 
 var prefixes = map[string]int{
-	"b:":       tokBranch,
-	"branch:":  tokBranch,
-	"c:":       tokContent,
-	"case:":    tokCase,
-	"content:": tokContent,
-	"f:":       tokFile,
-	"file:":    tokFile,
-	"r:":       tokRepo,
-	"regex:":   tokRegex,
-	"repo:":    tokRepo,
-	"lang:":    tokLang,
-	"sym:":     tokSym,
+	"archived:":  tokArchived,
+	"b:":         tokBranch,
+	"branch:":    tokBranch,
+	"c:":         tokContent,
+	"case:":      tokCase,
+	"category:":  tokCategory,
+	"content:":   tokContent,
+	"f:":         tokFile,
+	"file:":      tokFile,
+	"fork:":      tokFork,
+	"r:":         tokRepo,
+	"regex:":     tokRegex,
+	"repo:":      tokRepo,
+	"repo.desc:": tokRepoDesc,
+	"lang:":      tokLang,
+	"public:":    tokPublic,
+	"select:":    tokType,
+	"size:":      tokSize,
+	"sym:":       tokSym,
+	"topic:":     tokTopic,
+	"type:":      tokType,
 }
 
 var reservedWords = map[string]int{
-	"or": tokOr,
+	"and": tokAnd,
+	"or":  tokOr,
 }
 
 func (t *token) setType() {
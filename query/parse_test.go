@@ -17,6 +17,7 @@ package query
 import (
 	"log"
 	"reflect"
+	"regexp"
 	"regexp/syntax"
 	"testing"
 )
@@ -36,7 +37,9 @@ func TestParseQuery(t *testing.T) {
 	}
 
 	for _, c := range []testcase{
-		{`\bword\b`, &Regexp{Regexp: mustParseRE(`\bword\b`)}},
+		{`\bword\b`, &Substring{Pattern: "word", Word: true}},
+		{`\bword`, &Regexp{Regexp: mustParseRE(`\bword`)}},
+		{`f:\bword\b`, &Substring{Pattern: "word", FileName: true, Word: true}},
 		{"fi\"le:bla\"", &Substring{Pattern: "file:bla"}},
 		{"abc or def", NewOr(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"})},
 		{"(abc or def)", NewOr(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"})},
@@ -97,15 +100,59 @@ func TestParseQuery(t *testing.T) {
 			&Not{Child: &Substring{Pattern: "def", FileName: true, CaseSensitive: true}},
 		)},
 
+		{"type:repo abc", &Type{Child: &Substring{Pattern: "abc"}, Type: TypeRepo}},
+		{"abc select:repo", &Type{Child: &Substring{Pattern: "abc"}, Type: TypeRepo}},
+		{"type:repo abc or def", &Type{
+			Child: NewOr(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"}),
+			Type:  TypeRepo,
+		}},
+		{"type:repo", &Type{Child: &Const{Value: true}, Type: TypeRepo}},
+		{"type:file abc", &Type{Child: &Substring{Pattern: "abc"}, Type: TypeFileMatch}},
+		{"type:filename abc", &Type{Child: &Substring{Pattern: "abc"}, Type: TypeFileName}},
+		{"abc archived:no", NewAnd(&Substring{Pattern: "abc"}, &Not{&RepoFlag{Flag: RepoFlagArchived}})},
+		{"abc fork:only", NewAnd(&Substring{Pattern: "abc"}, &RepoFlag{Flag: RepoFlagFork})},
+		{"abc public:yes", &Substring{Pattern: "abc"}},
+		{"abc fork:maybe", nil},
+		{"repo.desc:compiler", &RepoDescription{Pattern: "compiler"}},
+		{"abc topic:database", NewAnd(&Substring{Pattern: "abc"}, &Topic{Topic: "database"})},
+		{"abc -category:generated", NewAnd(&Substring{Pattern: "abc"}, &Not{&FileCategory{Category: FileCategoryGenerated}})},
+		{"category:test", &FileCategory{Category: FileCategoryTest}},
+		{"category:docs", nil},
+		{"abc size:>1mb", NewAnd(&Substring{Pattern: "abc"}, &FileSize{Greater: true, Bytes: 1 << 20})},
+		{"size:<=1.5K", &FileSize{Bytes: 1537}},
+		{"size:10k", nil},
+		{"size:>1tb", nil},
+		{"topic:", nil},
+
+		{"abc and def", NewAnd(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"})},
+		{"(abc or def) and f:ghi", NewAnd(
+			NewOr(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"}),
+			&Substring{Pattern: "ghi", FileName: true},
+		)},
+		{"abc def or ghi", NewOr(
+			NewAnd(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"}),
+			&Substring{Pattern: "ghi"},
+		)},
+		{"-(abc and def) ghi", NewAnd(
+			&Not{NewAnd(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"})},
+			&Substring{Pattern: "ghi"},
+		)},
+		{"--abc", &Substring{Pattern: "abc"}},
+
 		// errors.
 		{"\"abc", nil},
 		{"\"a\\", nil},
 		{"case:foo", nil},
 
+		{"type:foo", nil},
+		{"-type:repo abc", nil},
 		{"sym:", nil},
 		{"abc or", nil},
 		{"or abc", nil},
 		{"def or or abc", nil},
+		{"abc and", nil},
+		{"and abc", nil},
+		{"abc and or def", nil},
 
 		{"", &Const{Value: true}},
 	} {
@@ -161,3 +208,78 @@ func TestTokenize(t *testing.T) {
 		}
 	}
 }
+
+func TestParseWithCase(t *testing.T) {
+	for _, c := range []struct {
+		in, defaultCase string
+		want            Q
+	}{
+		{"abc", "yes", &Substring{Pattern: "abc", CaseSensitive: true}},
+		{"ABC", "no", &Substring{Pattern: "ABC"}},
+		{"ABC", "auto", &Substring{Pattern: "ABC", CaseSensitive: true}},
+		{"ABC case:auto", "no", &Substring{Pattern: "ABC", CaseSensitive: true}},
+		{"ärger", "auto", &Substring{Pattern: "ärger"}},
+		{"Ärger", "auto", &Substring{Pattern: "Ärger", CaseSensitive: true}},
+		{"(abc def)", "yes", NewAnd(
+			&Substring{Pattern: "abc", CaseSensitive: true},
+			&Substring{Pattern: "def", CaseSensitive: true})},
+	} {
+		got, err := ParseWithCase(c.in, c.defaultCase)
+		if err != nil {
+			t.Errorf("ParseWithCase(%q, %q): %v", c.in, c.defaultCase, err)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseWithCase(%q, %q): got %v, want %v", c.in, c.defaultCase, got, c.want)
+		}
+	}
+
+	if _, err := ParseWithCase("abc", "maybe"); err == nil {
+		t.Errorf("ParseWithCase(maybe) succeeded")
+	}
+}
+
+func TestParseGlob(t *testing.T) {
+	for _, c := range []struct {
+		in    string
+		match []string
+		miss  []string
+	}{
+		{"file:*.go", []string{"a.go", "dir/b.go"}, []string{"a.golang", "a_go"}},
+		{"file:**/testdata/**", []string{"testdata/x", "a/b/testdata/c/d"}, []string{"mytestdata/x", "testdata"}},
+		{"file:src/*.go", []string{"src/a.go"}, []string{"src/a/b.go", "x/src/a.go"}},
+		{"repo:github.com/org/*", []string{"github.com/org/repo"}, []string{"github.com/org/repo/sub", "github.com/other/repo"}},
+	} {
+		q, err := Parse(c.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", c.in, err)
+		}
+		var match func(string) bool
+		switch s := q.(type) {
+		case *Regexp:
+			if !s.FileName {
+				t.Fatalf("Parse(%q): got %v, want file name regexp", c.in, q)
+			}
+			re := regexp.MustCompile(s.Regexp.String())
+			match = re.MatchString
+		case *RepoRegexp:
+			match = s.Regexp.MatchString
+		default:
+			t.Fatalf("Parse(%q): got %v", c.in, q)
+		}
+		for _, m := range c.match {
+			if !match(m) {
+				t.Errorf("%s (%v) does not match %q", c.in, q, m)
+			}
+		}
+		for _, m := range c.miss {
+			if match(m) {
+				t.Errorf("%s (%v) matches %q", c.in, q, m)
+			}
+		}
+	}
+
+	// Regular expressions are left alone.
+	want := &Regexp{Regexp: mustParseRE(`foo.*\.go`), FileName: true}
+	if q, err := Parse(`file:foo.*\.go`); err != nil || !reflect.DeepEqual(q, want) {
+		t.Errorf("got %v, %v, want %v", q, err, want)
+	}
+}
@@ -19,8 +19,10 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"regexp"
 	"regexp/syntax"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -124,6 +126,31 @@ func (q *Repo) String() string {
 	return fmt.Sprintf("repo:%s", q.Pattern)
 }
 
+// RepoRegexp matches repositories whose name matches a regular
+// expression.
+type RepoRegexp struct {
+	Regexp *regexp.Regexp
+}
+
+func (q *RepoRegexp) String() string {
+	return fmt.Sprintf("reporegex:%q", q.Regexp.String())
+}
+
+// GobEncode implements gob.Encoder.
+func (q *RepoRegexp) GobEncode() ([]byte, error) {
+	return []byte(q.Regexp.String()), nil
+}
+
+// GobDecode implements gob.Decoder.
+func (q *RepoRegexp) GobDecode(data []byte) error {
+	re, err := regexp.Compile(string(data))
+	if err != nil {
+		return err
+	}
+	q.Regexp = re
+	return nil
+}
+
 // RepoSet is a list of repos to match. It is a Sourcegraph addition and only
 // used in the Rest interface for efficient checking of large repo lists.
 type RepoSet struct {
@@ -156,6 +183,76 @@ func NewRepoSet(repo ...string) *RepoSet {
 	return s
 }
 
+// RepoIDs is a set of repository IDs to match, see
+// zoekt.Repository.ID. Unlike RepoSet, it does not break when
+// repositories are renamed. Repositories without an ID do not match.
+type RepoIDs struct {
+	Set map[uint32]bool
+}
+
+func (q *RepoIDs) String() string {
+	var detail string
+	if len(q.Set) > 5 {
+		// Large sets being output are not useful
+		detail = fmt.Sprintf("size=%d", len(q.Set))
+	} else {
+		var ids []string
+		for id := range q.Set {
+			ids = append(ids, strconv.FormatUint(uint64(id), 10))
+		}
+		sort.Strings(ids)
+		detail = strings.Join(ids, " ")
+	}
+	return fmt.Sprintf("(repoids %s)", detail)
+}
+
+func NewRepoIDs(ids ...uint32) *RepoIDs {
+	s := &RepoIDs{Set: make(map[uint32]bool)}
+	for _, id := range ids {
+		s.Set[id] = true
+	}
+	return s
+}
+
+// RepoBranches limits a search to the given branches of each
+// repository, so it can look at "main" in one repository and at
+// "release-1.2" in another. Branch names must match exactly; "HEAD"
+// is the first branch of a repository. Repositories that are not in
+// Set do not match.
+type RepoBranches struct {
+	Set map[string][]string
+}
+
+func (q *RepoBranches) String() string {
+	var detail string
+	if len(q.Set) > 5 {
+		// Large sets being output are not useful
+		detail = fmt.Sprintf("size=%d", len(q.Set))
+	} else {
+		var repos []string
+		for repo, branches := range q.Set {
+			repos = append(repos, repo+"@"+strings.Join(branches, ":"))
+		}
+		sort.Strings(repos)
+		detail = strings.Join(repos, " ")
+	}
+	return fmt.Sprintf("(repobranches %s)", detail)
+}
+
+// RepoCommit matches the documents of repository Repo as indexed at
+// Commit, which must be the exact version of one of its branches.
+// Searchers keep earlier versions only if configured to do so; see
+// build.Options.KeepVersions. If Commit is not indexed, searching
+// fails with code zoekt.CodeCommitNotIndexed.
+type RepoCommit struct {
+	Repo   string
+	Commit string
+}
+
+func (q *RepoCommit) String() string {
+	return fmt.Sprintf("repocommit:%s@%s", q.Repo, q.Commit)
+}
+
 // Substring is the most basic query: a query for a substring.
 type Substring struct {
 	Pattern       string
@@ -166,6 +263,10 @@ type Substring struct {
 
 	// Match only content
 	Content bool
+
+	// Match only whole words: the match must start and end at
+	// word boundaries, as for \b in regular expressions.
+	Word bool
 }
 
 func (q *Substring) String() string {
@@ -177,6 +278,9 @@ func (q *Substring) String() string {
 	} else if q.Content {
 		t = "content_"
 	}
+	if q.Word {
+		t = "word_" + t
+	}
 
 	s += fmt.Sprintf("%ssubstr:%q", t, q.Pattern)
 	if q.CaseSensitive {
@@ -216,6 +320,29 @@ func (q *Regexp) setCase(k string) {
 	}
 }
 
+// SmartCase returns a copy of q in which substring, regexp and symbol
+// atoms match case-sensitively if their pattern contains upper case
+// characters, and case-insensitively otherwise.
+func SmartCase(q Q) Q {
+	return Map(q, func(q Q) Q {
+		switch s := q.(type) {
+		case *Substring:
+			c := *s
+			c.setCase("auto")
+			return &c
+		case *Regexp:
+			c := *s
+			c.setCase("auto")
+			return &c
+		case *Symbol:
+			c := *s.Atom
+			c.setCase("auto")
+			return &Symbol{Atom: &c}
+		}
+		return q
+	})
+}
+
 // Or is matched when any of its children is matched.
 type Or struct {
 	Children []Q
@@ -261,6 +388,130 @@ func NewOr(qs ...Q) Q {
 	return &Or{Children: qs}
 }
 
+// Type values.
+const (
+	// TypeFileMatch returns the matching files. This is the default.
+	TypeFileMatch uint8 = iota
+
+	// TypeRepo returns the matching repositories. Evaluation
+	// stops at the first matching file of each repository; that
+	// file is returned as the reason for the match.
+	TypeRepo
+
+	// TypeFileName matches text atoms against file names only, so
+	// the content of files is never read.
+	TypeFileName
+)
+
+// Type changes the result type of its child query.
+type Type struct {
+	Child Q
+	Type  uint8
+}
+
+func (q *Type) String() string {
+	switch q.Type {
+	case TypeRepo:
+		return fmt.Sprintf("(type:repo %s)", q.Child)
+	case TypeFileName:
+		return fmt.Sprintf("(type:filename %s)", q.Child)
+	default:
+		return fmt.Sprintf("(type:filematch %s)", q.Child)
+	}
+}
+
+// RepoDescription matches repositories whose description contains
+// Pattern, ignoring case.
+type RepoDescription struct {
+	Pattern string
+}
+
+func (q *RepoDescription) String() string {
+	return fmt.Sprintf("repo.desc:%q", q.Pattern)
+}
+
+// Topic matches repositories that have Topic among their topics,
+// ignoring case.
+type Topic struct {
+	Topic string
+}
+
+func (q *Topic) String() string {
+	return fmt.Sprintf("topic:%s", q.Topic)
+}
+
+// RepoFlag values.
+const (
+	// RepoFlagArchived matches archived repositories.
+	RepoFlagArchived uint8 = iota
+
+	// RepoFlagFork matches repositories that are forks.
+	RepoFlagFork
+
+	// RepoFlagPublic matches public repositories.
+	RepoFlagPublic
+)
+
+var repoFlagNames = map[uint8]string{
+	RepoFlagArchived: "archived",
+	RepoFlagFork:     "fork",
+	RepoFlagPublic:   "public",
+}
+
+// RepoFlag matches repositories that have a flag set in their
+// metadata, such as being archived.
+type RepoFlag struct {
+	Flag uint8
+}
+
+func (q *RepoFlag) String() string {
+	return fmt.Sprintf("%s:only", repoFlagNames[q.Flag])
+}
+
+// FileCategory values.
+const (
+	// FileCategoryGenerated matches generated files, such as
+	// protobuf stubs or minified JavaScript.
+	FileCategoryGenerated uint8 = iota
+
+	// FileCategoryVendored matches copies of third party code.
+	FileCategoryVendored
+
+	// FileCategoryTest matches tests.
+	FileCategoryTest
+)
+
+var fileCategoryNames = map[uint8]string{
+	FileCategoryGenerated: "generated",
+	FileCategoryVendored:  "vendored",
+	FileCategoryTest:      "test",
+}
+
+// FileCategory matches files that the index builder put in a
+// category, such as generated files.
+type FileCategory struct {
+	Category uint8
+}
+
+func (q *FileCategory) String() string {
+	return fmt.Sprintf("category:%s", fileCategoryNames[q.Category])
+}
+
+// FileSize matches files larger than Bytes or, unless Greater is
+// set, smaller than Bytes.
+type FileSize struct {
+	Greater bool
+	Bytes   int64
+}
+
+func (q *FileSize) String() string {
+	op := "<"
+	if q.Greater {
+		op = ">"
+	}
+	return fmt.Sprintf("size:%s%d", op, q.Bytes)
+}
+
 // Branch limits search to a specific branch.
 type Branch struct {
 	Pattern string
@@ -301,6 +552,7 @@ func flattenAndOr(children []Q, typ Q) ([]Q, bool) {
 }
 
 // (and (and x y) z) => (and x y z) , the same for "or"
+// (not (not x)) => x
 func flatten(q Q) (Q, bool) {
 	switch s := q.(type) {
 	case *And:
@@ -316,8 +568,15 @@ func flatten(q Q) (Q, bool) {
 		flatChildren, changed := flattenAndOr(s.Children, s)
 		return &Or{flatChildren}, changed
 	case *Not:
+		// (not (not x)) => x
+		if n, ok := s.Child.(*Not); ok {
+			return n.Child, true
+		}
 		child, changed := flatten(s.Child)
 		return &Not{child}, changed
+	case *Type:
+		child, changed := flatten(s.Child)
+		return &Type{Child: child, Type: s.Type}, changed
 	default:
 		return q, false
 	}
@@ -377,6 +636,12 @@ func evalConstants(q Q) Q {
 			return invertConst(ch)
 		}
 		return &Not{ch}
+	case *Type:
+		ch := evalConstants(s.Child)
+		if c, ok := ch.(*Const); ok && !c.Value {
+			return ch
+		}
+		return &Type{Child: ch, Type: s.Type}
 	case *Substring:
 		if len(s.Pattern) == 0 {
 			return &Const{true}
@@ -419,6 +684,8 @@ func Map(q Q, f func(q Q) Q) Q {
 		q = &Or{Children: mapQueryList(s.Children, f)}
 	case *Not:
 		q = &Not{Child: Map(s.Child, f)}
+	case *Type:
+		q = &Type{Child: Map(s.Child, f), Type: s.Type}
 	}
 	return f(q)
 }
@@ -454,6 +721,7 @@ func VisitAtoms(q Q, v func(q Q)) {
 		case *And:
 		case *Or:
 		case *Not:
+		case *Type:
 		default:
 			v(iQ)
 		}
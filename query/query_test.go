@@ -72,6 +72,14 @@ func TestSimplify(t *testing.T) {
 				&Substring{Pattern: "byte"},
 				&Not{&Substring{Pattern: "byte"}}),
 		},
+		{
+			in:   &Not{&Not{NewAnd(&Substring{Pattern: "byte"})}},
+			want: &Substring{Pattern: "byte"},
+		},
+		{
+			in:   &Not{&Not{&Not{&Substring{Pattern: "byte"}}}},
+			want: &Not{&Substring{Pattern: "byte"}},
+		},
 	}
 
 	for _, c := range cases {
@@ -108,3 +116,24 @@ func TestVisitAtoms(t *testing.T) {
 		t.Errorf("got %d, want 3", count)
 	}
 }
+
+func TestSmartCase(t *testing.T) {
+	in := NewAnd(
+		&Substring{Pattern: "abc", CaseSensitive: true},
+		&Substring{Pattern: "Abc"},
+		&Regexp{Regexp: mustParseRE("a.C")},
+		&Symbol{&Substring{Pattern: "sym", CaseSensitive: true}},
+	)
+	want := NewAnd(
+		&Substring{Pattern: "abc"},
+		&Substring{Pattern: "Abc", CaseSensitive: true},
+		&Regexp{Regexp: mustParseRE("a.C"), CaseSensitive: true},
+		&Symbol{&Substring{Pattern: "sym"}},
+	)
+	if got := SmartCase(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !in.(*And).Children[0].(*Substring).CaseSensitive {
+		t.Errorf("SmartCase modified its input")
+	}
+}
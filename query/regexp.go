@@ -17,6 +17,9 @@ package query
 import (
 	"log"
 	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 var _ = log.Println
@@ -27,11 +30,7 @@ func LowerRegexp(r *syntax.Regexp) *syntax.Regexp {
 	case syntax.OpLiteral, syntax.OpCharClass:
 		newRE.Rune = make([]rune, len(r.Rune))
 		for i, c := range r.Rune {
-			if c >= 'A' && c <= 'Z' {
-				newRE.Rune[i] = c + 'a' - 'A'
-			} else {
-				newRE.Rune[i] = c
-			}
+			newRE.Rune[i] = unicode.ToLower(c)
 		}
 	default:
 		newRE.Sub = make([]*syntax.Regexp, len(newRE.Sub))
@@ -46,43 +45,235 @@ func LowerRegexp(r *syntax.Regexp) *syntax.Regexp {
 // RegexpToQuery tries to distill a substring search query that
 // matches a superset of the regexp.
 func RegexpToQuery(r *syntax.Regexp, minTextSize int) Q {
-	q := regexpToQueryRecursive(r, minTextSize)
+	q := analyzeRegexp(r, minTextSize).query(minTextSize)
 	q = Simplify(q)
 	return q
 }
 
-func regexpToQueryRecursive(r *syntax.Regexp, minTextSize int) Q {
-	// TODO - we could perhaps transform Begin/EndText in '\n'?
-	// TODO - we could perhaps transform CharClass in (OrQuery )
-	// if there are just a few runes, and part of a OpConcat?
+// maxExactSet bounds the number of strings tracked for a regexp
+// fragment. Alternations and small character classes are expanded
+// into their exact strings, so concatenations like (foo|bar)baz
+// produce the longer literals foobaz and barbaz.
+const maxExactSet = 16
+
+// regexpInfo summarizes the text matched by a regexp fragment.
+type regexpInfo struct {
+	// isExact is set if the fragment matches exactly the strings in
+	// exact.
+	isExact bool
+	exact   []string
+
+	// match must hold for all texts the fragment matches. It is
+	// only used if isExact is not set.
+	match Q
+}
+
+func exactInfo(strs ...string) regexpInfo {
+	return regexpInfo{isExact: true, exact: strs}
+}
+
+func matchInfo(q Q) regexpInfo {
+	return regexpInfo{match: q}
+}
+
+// query returns a query that is true for all texts matched by the
+// fragment.
+func (i regexpInfo) query(minTextSize int) Q {
+	if i.isExact {
+		return exactQuery(i.exact, minTextSize)
+	}
+	if i.match == nil {
+		return &Const{true}
+	}
+	return i.match
+}
+
+// exactQuery returns a query requiring one of strs. Strings that
+// contain another member of strs are dropped, as the shorter string
+// is required anyway.
+func exactQuery(strs []string, minTextSize int) Q {
+	var qs []Q
+	for i, s := range strs {
+		redundant := false
+		for j, t := range strs {
+			if i != j && strings.Contains(s, t) && (len(s) > len(t) || j < i) {
+				redundant = true
+				break
+			}
+		}
+		if redundant {
+			continue
+		}
+		if utf8.RuneCountInString(s) < minTextSize {
+			return &Const{true}
+		}
+		qs = append(qs, &Substring{Pattern: s})
+	}
+	if len(qs) == 1 {
+		return qs[0]
+	}
+	return &Or{qs}
+}
+
+// unionStrings returns the union of a and b, preserving order.
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var r []string
+	for _, l := range [][]string{a, b} {
+		for _, s := range l {
+			if !seen[s] {
+				seen[s] = true
+				r = append(r, s)
+			}
+		}
+	}
+	return r
+}
+
+// crossStrings returns all concatenations of a string from a with a
+// string from b.
+func crossStrings(a, b []string) []string {
+	var r []string
+	seen := make(map[string]bool, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			if !seen[x+y] {
+				seen[x+y] = true
+				r = append(r, x+y)
+			}
+		}
+	}
+	return r
+}
+
+// charClassStrings returns the runes of a character class as
+// strings, or false if there are more than maxExactSet of them.
+func charClassStrings(r *syntax.Regexp) ([]string, bool) {
+	n := 0
+	for i := 0; i+1 < len(r.Rune); i += 2 {
+		n += int(r.Rune[i+1]-r.Rune[i]) + 1
+		if n > maxExactSet {
+			return nil, false
+		}
+	}
+
+	var strs []string
+	for i := 0; i+1 < len(r.Rune); i += 2 {
+		for c := r.Rune[i]; c <= r.Rune[i+1]; c++ {
+			strs = append(strs, string(c))
+		}
+	}
+	return unionStrings(strs, nil), true
+}
+
+func analyzeRegexp(r *syntax.Regexp, minTextSize int) regexpInfo {
 	switch r.Op {
+	case syntax.OpNoMatch:
+		return exactInfo()
+	case syntax.OpEmptyMatch,
+		syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return exactInfo("")
 	case syntax.OpLiteral:
-		s := string(r.Rune)
-		if len(s) >= minTextSize {
-			return &Substring{Pattern: s}
+		return exactInfo(string(r.Rune))
+	case syntax.OpCharClass:
+		if strs, ok := charClassStrings(r); ok {
+			return exactInfo(strs...)
 		}
 	case syntax.OpCapture:
-		return regexpToQueryRecursive(r.Sub[0], minTextSize)
-
+		return analyzeRegexp(r.Sub[0], minTextSize)
+	case syntax.OpQuest:
+		sub := analyzeRegexp(r.Sub[0], minTextSize)
+		if sub.isExact && len(sub.exact) < maxExactSet {
+			return exactInfo(unionStrings(sub.exact, []string{""})...)
+		}
 	case syntax.OpPlus:
-		return regexpToQueryRecursive(r.Sub[0], minTextSize)
-
+		return matchInfo(analyzeRegexp(r.Sub[0], minTextSize).query(minTextSize))
 	case syntax.OpRepeat:
-		if r.Min >= 1 {
-			return regexpToQueryRecursive(r.Sub[0], minTextSize)
+		return analyzeRepeat(r, minTextSize)
+	case syntax.OpConcat:
+		return analyzeConcat(r.Sub, minTextSize)
+	case syntax.OpAlternate:
+		infos := make([]regexpInfo, 0, len(r.Sub))
+		var strs []string
+		exact := true
+		for _, sub := range r.Sub {
+			info := analyzeRegexp(sub, minTextSize)
+			infos = append(infos, info)
+			if exact && info.isExact {
+				strs = unionStrings(strs, info.exact)
+			}
+			exact = exact && info.isExact && len(strs) <= maxExactSet
+		}
+		if exact {
+			return exactInfo(strs...)
 		}
 
-	case syntax.OpConcat, syntax.OpAlternate:
 		var qs []Q
-		for _, sr := range r.Sub {
-			if sq := regexpToQueryRecursive(sr, minTextSize); sq != nil {
-				qs = append(qs, sq)
-			}
+		for _, info := range infos {
+			qs = append(qs, info.query(minTextSize))
+		}
+		return matchInfo(&Or{qs})
+	}
+	return matchInfo(&Const{true})
+}
+
+// analyzeConcat multiplies out runs of exact fragments, so the
+// literals around an alternation or small character class are
+// joined into longer substrings.
+func analyzeConcat(subs []*syntax.Regexp, minTextSize int) regexpInfo {
+	var qs []Q
+	pending := []string{""}
+	exact := true
+	for _, sub := range subs {
+		info := analyzeRegexp(sub, minTextSize)
+		if info.isExact && len(pending)*len(info.exact) <= maxExactSet {
+			pending = crossStrings(pending, info.exact)
+			continue
 		}
-		if r.Op == syntax.OpConcat {
-			return &And{qs}
+
+		exact = false
+		qs = append(qs, exactQuery(pending, minTextSize))
+		if info.isExact {
+			pending = info.exact
+		} else {
+			pending = []string{""}
+			qs = append(qs, info.query(minTextSize))
 		}
-		return &Or{qs}
 	}
-	return &Const{true}
+	if exact {
+		return exactInfo(pending...)
+	}
+	qs = append(qs, exactQuery(pending, minTextSize))
+	return matchInfo(&And{qs})
+}
+
+// analyzeRepeat handles x{n,m}. A bounded repetition of an exact
+// fragment is expanded if small enough; otherwise the first r.Min
+// copies are required.
+func analyzeRepeat(r *syntax.Regexp, minTextSize int) regexpInfo {
+	if r.Min == 0 {
+		if r.Max == 0 {
+			return exactInfo("")
+		}
+		return matchInfo(&Const{true})
+	}
+
+	sub := analyzeRegexp(r.Sub[0], minTextSize)
+	if !sub.isExact {
+		return matchInfo(sub.query(minTextSize))
+	}
+
+	strs := []string{""}
+	for i := 0; i < r.Min; i++ {
+		if len(strs)*len(sub.exact) > maxExactSet {
+			return matchInfo(sub.query(minTextSize))
+		}
+		strs = crossStrings(strs, sub.exact)
+	}
+	if r.Min == r.Max {
+		return exactInfo(strs...)
+	}
+	return matchInfo(exactQuery(strs, minTextSize))
 }
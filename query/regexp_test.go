@@ -62,10 +62,9 @@ func TestRegexpParse(t *testing.T) {
 		{"(foo|)", &Const{true}},
 		{"(foo|bar)baz.*bla", &And{[]Q{
 			&Or{[]Q{
-				&Substring{Pattern: "foo"},
-				&Substring{Pattern: "bar"},
+				&Substring{Pattern: "foobaz"},
+				&Substring{Pattern: "barbaz"},
 			}},
-			&Substring{Pattern: "baz"},
 			&Substring{Pattern: "bla"},
 		}}},
 		{"^[a-z](People)+barrabas$",
@@ -73,6 +72,27 @@ func TestRegexpParse(t *testing.T) {
 				&Substring{Pattern: "People"},
 				&Substring{Pattern: "barrabas"},
 			}}},
+		{"(a|b)(c|d)e", &Or{[]Q{
+			&Substring{Pattern: "ace"},
+			&Substring{Pattern: "ade"},
+			&Substring{Pattern: "bce"},
+			&Substring{Pattern: "bde"},
+		}}},
+		{"colou?r", &Or{[]Q{
+			&Substring{Pattern: "colour"},
+			&Substring{Pattern: "color"},
+		}}},
+		{"x[0-9]{2}y", &Const{true}},
+		{"ab{3}", &Substring{Pattern: "abbb"}},
+		{"(ab){2,5}c", &Substring{Pattern: "abab"}},
+		{"(ab){0,5}c", &Const{true}},
+		{"[a-z]+foo", &Substring{Pattern: "foo"}},
+		{"(foo|ba.)qux", &Substring{Pattern: "qux"}},
+		{"(fo[ox]|bar)", &Or{[]Q{
+			&Substring{Pattern: "foo"},
+			&Substring{Pattern: "fox"},
+			&Substring{Pattern: "bar"},
+		}}},
 	}
 
 	for _, c := range cases {
@@ -0,0 +1,171 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Relaxation is a less strict version of a query.
+type Relaxation struct {
+	// Reason says how the query was relaxed, such as
+	// "case-insensitive".
+	Reason string
+
+	Q Q
+}
+
+// Relax returns cheap relaxations of q, to suggest when q finds
+// nothing. They match case-insensitively, drop file name filters
+// and split camelCase words, in that order. Relaxations that do not
+// change q, or that would match everything, are omitted.
+func Relax(q Q) []Relaxation {
+	var res []Relaxation
+	for _, r := range []struct {
+		reason string
+		relax  func(Q) (Q, bool)
+	}{
+		{"case-insensitive", ignoreCase},
+		{"without file filter", dropFileFilters},
+		{"split camelCase", splitCamelCase},
+	} {
+		rq, changed := r.relax(q)
+		if !changed {
+			continue
+		}
+		rq = Simplify(rq)
+		if _, ok := rq.(*Const); ok {
+			continue
+		}
+		res = append(res, Relaxation{Reason: r.reason, Q: rq})
+	}
+	return res
+}
+
+// ignoreCase makes all atoms of q case-insensitive.
+func ignoreCase(q Q) (Q, bool) {
+	changed := false
+	q = Map(q, func(q Q) Q {
+		switch s := q.(type) {
+		case *Substring:
+			if s.CaseSensitive {
+				c := *s
+				c.CaseSensitive = false
+				changed = true
+				return &c
+			}
+		case *Regexp:
+			if s.CaseSensitive {
+				c := *s
+				c.CaseSensitive = false
+				changed = true
+				return &c
+			}
+		case *Symbol:
+			if s.Atom.CaseSensitive {
+				c := *s.Atom
+				c.CaseSensitive = false
+				changed = true
+				return &Symbol{Atom: &c}
+			}
+		}
+		return q
+	})
+	return q, changed
+}
+
+// isFileFilter returns whether q only looks at file names.
+func isFileFilter(q Q) bool {
+	switch s := q.(type) {
+	case *Substring:
+		return s.FileName && !s.Content
+	case *Regexp:
+		return s.FileName && !s.Content
+	}
+	return false
+}
+
+// dropFileFilters removes the file name filters that q requires,
+// including negated ones. Filters inside an Or are kept, as
+// dropping them would match everything.
+func dropFileFilters(q Q) (Q, bool) {
+	switch s := q.(type) {
+	case *And:
+		changed := false
+		var children []Q
+		for _, ch := range s.Children {
+			ch, c := dropFileFilters(ch)
+			changed = changed || c
+			children = append(children, ch)
+		}
+		return &And{Children: children}, changed
+	case *Not:
+		if isFileFilter(s.Child) {
+			return &Const{Value: true}, true
+		}
+	case *Type:
+		ch, changed := dropFileFilters(s.Child)
+		return &Type{Child: ch, Type: s.Type}, changed
+	default:
+		if isFileFilter(q) {
+			return &Const{Value: true}, true
+		}
+	}
+	return q, false
+}
+
+// splitCamelCase replaces content substrings such as "readFile" by
+// a case-insensitive search for each of their words.
+func splitCamelCase(q Q) (Q, bool) {
+	changed := false
+	q = Map(q, func(q Q) Q {
+		s, ok := q.(*Substring)
+		if !ok || isFileFilter(s) {
+			return q
+		}
+		words := camelCaseWords(s.Pattern)
+		if len(words) < 2 {
+			return q
+		}
+		changed = true
+		var and []Q
+		for _, w := range words {
+			and = append(and, &Substring{
+				Pattern:  strings.ToLower(w),
+				FileName: s.FileName,
+				Content:  s.Content,
+			})
+		}
+		return NewAnd(and...)
+	})
+	return q, changed
+}
+
+// camelCaseWords splits s before each upper case letter that
+// follows a lower case letter or digit.
+func camelCaseWords(s string) []string {
+	var words []string
+	start := 0
+	var prev rune
+	for i, r := range s {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+			words = append(words, s[start:i])
+			start = i
+		}
+		prev = r
+	}
+	return append(words, s[start:])
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRelax(t *testing.T) {
+	for in, want := range map[string][]string{
+		"readFile": {
+			`case-insensitive: substr:"readFile"`,
+			`split camelCase: (and substr:"read" substr:"file")`,
+		},
+		"foo f:bar": {
+			`without file filter: substr:"foo"`,
+		},
+		"foo -f:_test": {
+			`without file filter: substr:"foo"`,
+		},
+		"case:yes foo f:Bar": {
+			`case-insensitive: (and substr:"foo" file_substr:"Bar")`,
+			`without file filter: case_substr:"foo"`,
+		},
+		"foo or f:bar": nil,
+		"f:bar":        nil,
+		"foo":          nil,
+	} {
+		q, err := Parse(in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", in, err)
+		}
+		var got []string
+		for _, r := range Relax(q) {
+			got = append(got, r.Reason+": "+r.Q.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
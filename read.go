@@ -18,14 +18,15 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"sort"
 )
 
 // IndexFile is a file suitable for concurrent read access. For performance
 // reasons, it allows a mmap'd implementation.
 type IndexFile interface {
-	Read(off uint32, sz uint32) ([]byte, error)
-	Size() (uint32, error)
+	Read(off uint64, sz uint64) ([]byte, error)
+	Size() (uint64, error)
 	Close()
 	Name() string
 }
@@ -33,10 +34,14 @@ type IndexFile interface {
 // reader is a stateful file
 type reader struct {
 	r   IndexFile
-	off uint32
+	off uint64
+
+	// narrow is set if the file uses 32-bit offsets, ie. was
+	// written before wideOffsetsVersion.
+	narrow bool
 }
 
-func (r *reader) seek(off uint32) {
+func (r *reader) seek(off uint64) {
 	r.off = off
 }
 
@@ -58,15 +63,53 @@ func (r *reader) U64() (uint64, error) {
 	return binary.BigEndian.Uint64(b), nil
 }
 
+// Offset reads an offset or size, using the width of the file's
+// format.
+func (r *reader) Offset() (uint64, error) {
+	if r.narrow {
+		n, err := r.U32()
+		return uint64(n), err
+	}
+	return r.U64()
+}
+
+// findTOC returns the location of the TOC, which is stored in the
+// last bytes of the file. Files with 64-bit offsets end in a 16 byte
+// trailer, older files in an 8 byte one. A narrow file cannot be
+// mistaken for a wide one: its last section entry would have to
+// start at offset 0.
+func (r *reader) findTOC(sz uint64) (simpleSection, error) {
+	var tocSection simpleSection
+	for _, narrow := range []bool{false, true} {
+		r.narrow = narrow
+		trailer := uint64(16)
+		if narrow {
+			trailer = 8
+		}
+		if sz < trailer {
+			continue
+		}
+		r.off = sz - trailer
+		if err := tocSection.read(r); err != nil {
+			return tocSection, err
+		}
+		if tocSection.off <= sz-trailer && tocSection.sz == sz-trailer-tocSection.off {
+			return tocSection, nil
+		}
+	}
+	if sz < 8 {
+		return tocSection, fmt.Errorf("file too small: %d bytes", sz)
+	}
+	return tocSection, fmt.Errorf("TOC at [%d, +%d) does not end at %d; truncated file?", tocSection.off, tocSection.sz, sz-8)
+}
+
 func (r *reader) readTOC(toc *indexTOC) error {
 	sz, err := r.r.Size()
 	if err != nil {
 		return err
 	}
-	r.off = sz - 8
-
-	var tocSection simpleSection
-	if err := tocSection.read(r); err != nil {
+	tocSection, err := r.findTOC(sz)
+	if err != nil {
 		return err
 	}
 
@@ -78,16 +121,59 @@ func (r *reader) readTOC(toc *indexTOC) error {
 	}
 
 	secs := toc.sections()
+	if len(secs) == int(sectionCount)+1 {
+		// The previous format version lacks the newest
+		// sections.
+		toc.prevVersion = true
+		secs = toc.sections()
+	}
 
 	if len(secs) != int(sectionCount) {
-		return fmt.Errorf("section count mismatch: got %d want %d", sectionCount, len(secs))
+		// Sections are only added along with a format version
+		// bump, so this is most likely an older index. The
+		// metadata comes first in every version, so it can
+		// still be read.
+		for i := 0; i < 2 && i < int(sectionCount); i++ {
+			if err := secs[i].read(r); err != nil {
+				return err
+			}
+		}
+		return Errorf(CodeIndexStale, "section count mismatch: got %d want %d", sectionCount, len(secs))
 	}
 
-	for _, s := range toc.sections() {
+	for _, s := range secs {
 		if err := s.read(r); err != nil {
 			return err
 		}
 	}
+	for _, s := range append(toc.checksummedSections(), toc.sectionChecksums) {
+		if s.off > tocSection.off || s.sz > tocSection.off-s.off {
+			return fmt.Errorf("section [%d, +%d) extends past the TOC at %d", s.off, s.sz, tocSection.off)
+		}
+	}
+	return nil
+}
+
+// verifyChecksums compares the sections of the file with their
+// checksums.
+func (r *reader) verifyChecksums(toc *indexTOC) error {
+	secs := toc.checksummedSections()
+	sums, err := readSectionU32(r.r, toc.sectionChecksums)
+	if err != nil {
+		return err
+	}
+	if len(sums) != len(secs) {
+		return fmt.Errorf("got %d section checksums, want %d", len(sums), len(secs))
+	}
+	for i, s := range secs {
+		blob, err := r.r.Read(s.off, s.sz)
+		if err != nil {
+			return err
+		}
+		if got := crc32.Checksum(blob, castagnoli); got != sums[i] {
+			return fmt.Errorf("checksum mismatch for section %d at [%d, +%d): got %08x, want %08x", i, s.off, s.sz, got, sums[i])
+		}
+	}
 	return nil
 }
 
@@ -158,8 +244,14 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
-	if d.metaData.IndexFormatVersion != IndexFormatVersion {
-		return nil, fmt.Errorf("file is v%d, want v%d", d.metaData.IndexFormatVersion, IndexFormatVersion)
+	if v := d.metaData.IndexFormatVersion; v < MinIndexFormatVersion || v > IndexFormatVersion {
+		return nil, Errorf(CodeIndexStale, "file is v%d, want v%d to v%d", v, MinIndexFormatVersion, IndexFormatVersion)
+	}
+	if narrow := d.metaData.IndexFormatVersion < wideOffsetsVersion; narrow != r.narrow {
+		return nil, Errorf(CodeShardCorrupt, "v%d file has the wrong offset width", d.metaData.IndexFormatVersion)
+	}
+	if prev := d.metaData.IndexFormatVersion < IndexFormatVersion; prev != toc.prevVersion {
+		return nil, Errorf(CodeShardCorrupt, "v%d file has the wrong number of sections", d.metaData.IndexFormatVersion)
 	}
 
 	blob, err = d.readSectionBlob(toc.repoMetaData)
@@ -169,13 +261,38 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 	if err := json.Unmarshal(blob, &d.repoMetaData); err != nil {
 		return nil, err
 	}
+	if err := readShardMeta(r.r.Name(), &d.repoMetaData); err != nil {
+		return nil, err
+	}
 
 	d.boundariesStart = toc.fileContents.data.off
-	d.boundaries = toc.fileContents.relativeIndex()
+	d.boundaries, err = toc.fileContents.relativeIndex()
+	if err != nil {
+		return nil, err
+	}
+	if c := d.metaData.ContentCompression; c != "" {
+		if err := checkContentCompression(c); err != nil {
+			return nil, Errorf(CodeIndexStale, "%v", err)
+		}
+		d.compressedBoundaries = d.boundaries
+		d.boundaries, err = readSectionU32(d.file, toc.contentBoundaries)
+		if err != nil {
+			return nil, err
+		}
+		if len(d.boundaries) != len(d.compressedBoundaries) {
+			return nil, Errorf(CodeShardCorrupt, "got %d content boundaries, want %d", len(d.boundaries), len(d.compressedBoundaries))
+		}
+	}
 	d.newlinesStart = toc.newlines.data.off
-	d.newlinesIndex = toc.newlines.relativeIndex()
+	d.newlinesIndex, err = toc.newlines.relativeIndex()
+	if err != nil {
+		return nil, err
+	}
 	d.docSectionsStart = toc.fileSections.data.off
-	d.docSectionsIndex = toc.fileSections.relativeIndex()
+	d.docSectionsIndex, err = toc.fileSections.relativeIndex()
+	if err != nil {
+		return nil, err
+	}
 
 	d.checksums, err = d.readSectionBlob(toc.contentChecksums)
 	if err != nil {
@@ -187,19 +304,60 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
+	d.docRanks, err = d.readSectionBlob(toc.docRanks)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lineEndings, err = d.readSectionBlob(toc.lineEndings)
+	if err != nil {
+		return nil, err
+	}
+
+	d.categories, err = d.readSectionBlob(toc.categories)
+	if err != nil {
+		return nil, err
+	}
+
+	d.fileInfos, err = d.readSectionBlob(toc.fileInfos)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err = d.readSectionBlob(toc.ngramBloom)
+	if err != nil {
+		return nil, err
+	}
+	if d.bloom, err = readBloomFilter(blob); err != nil {
+		return nil, err
+	}
+
+	if err := checkPostingEncoding(d.metaData.PostingEncoding); err != nil {
+		return nil, Errorf(CodeIndexStale, "%v", err)
+	}
+
 	textContent, err := d.readSectionBlob(toc.ngramText)
 	if err != nil {
 		return nil, err
 	}
-	postingsIndex := toc.postings.relativeIndex()
 
+	// The postings are addressed with absolute offsets, so
+	// together they may exceed 4G.
 	const ngramEncoding = 8
 	for i := 0; i < len(textContent); i += ngramEncoding {
 		j := i / ngramEncoding
 		ng := ngram(binary.BigEndian.Uint64(textContent[i : i+ngramEncoding]))
-		d.ngrams[ng] = simpleSection{
-			toc.postings.data.off + postingsIndex[j],
-			postingsIndex[j+1] - postingsIndex[j],
+		d.ngrams[ng] = toc.postings.item(j)
+	}
+	d.ngramText = textContent
+
+	if !toc.prevVersion {
+		d.ngramDocFreqs, err = d.readSectionBlob(toc.ngramDocFreqs)
+		if err != nil {
+			return nil, err
+		}
+		if len(d.ngramDocFreqs)/4 != len(textContent)/ngramEncoding {
+			return nil, fmt.Errorf("got %d ngram document frequencies, want %d", len(d.ngramDocFreqs)/4, len(textContent)/ngramEncoding)
 		}
 	}
 
@@ -213,7 +371,10 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
-	d.fileNameIndex = toc.fileNames.relativeIndex()
+	d.fileNameIndex, err = toc.fileNames.relativeIndex()
+	if err != nil {
+		return nil, err
+	}
 
 	nameNgramText, err := d.readSectionBlob(toc.nameNgramText)
 	if err != nil {
@@ -225,13 +386,19 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
-	fileNamePostingsIndex := toc.namePostings.relativeIndex()
+	fileNamePostingsIndex, err := toc.namePostings.relativeIndex()
+	if err != nil {
+		return nil, err
+	}
 	for i := 0; i < len(nameNgramText); i += ngramEncoding {
 		j := i / ngramEncoding
 		off := fileNamePostingsIndex[j]
 		end := fileNamePostingsIndex[j+1]
 		ng := ngram(binary.BigEndian.Uint64(nameNgramText[i : i+ngramEncoding]))
-		d.fileNameNgrams[ng] = fromDeltas(fileNamePostingsData[off:end], nil)
+		d.fileNameNgrams[ng], err = decodePostings(fileNamePostingsData[off:end], d.metaData.PostingEncoding)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	for j, br := range d.repoMetaData.Branches {
@@ -295,6 +462,10 @@ func (d *indexData) verify() error {
 		"branch masks":      len(d.fileBranchMasks),
 		"doc section index": len(d.docSectionsIndex) - 1,
 		"newlines index":    len(d.newlinesIndex) - 1,
+		"doc ranks":         len(d.docRanks) / 2,
+		"line endings":      len(d.lineEndings),
+		"categories":        len(d.categories),
+		"file infos":        len(d.fileInfos) / fileInfoSize,
 	} {
 		if got != n {
 			return fmt.Errorf("got %s %d, want %d", what, got, n)
@@ -304,9 +475,19 @@ func (d *indexData) verify() error {
 }
 
 func (d *indexData) readContents(i uint32) ([]byte, error) {
+	if d.compressedBoundaries != nil {
+		blob, err := d.readSectionBlob(simpleSection{
+			off: d.boundariesStart + uint64(d.compressedBoundaries[i]),
+			sz:  uint64(d.compressedBoundaries[i+1] - d.compressedBoundaries[i]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return decompressContent(blob, d.boundaries[i+1]-d.boundaries[i])
+	}
 	return d.readSectionBlob(simpleSection{
-		off: d.boundariesStart + d.boundaries[i],
-		sz:  d.boundaries[i+1] - d.boundaries[i],
+		off: d.boundariesStart + uint64(d.boundaries[i]),
+		sz:  uint64(d.boundaries[i+1] - d.boundaries[i]),
 	})
 }
 
@@ -314,34 +495,34 @@ func (d *indexData) readContentSlice(off uint32, sz uint32) ([]byte, error) {
 	// TODO(hanwen): cap result if it is at the end of the content
 	// section.
 	return d.readSectionBlob(simpleSection{
-		off: d.boundariesStart + off,
-		sz:  sz})
+		off: d.boundariesStart + uint64(off),
+		sz:  uint64(sz)})
 }
 
 func (d *indexData) readNewlines(i uint32, buf []uint32) ([]uint32, uint32, error) {
 	sec := simpleSection{
-		off: d.newlinesStart + d.newlinesIndex[i],
-		sz:  d.newlinesIndex[i+1] - d.newlinesIndex[i],
+		off: d.newlinesStart + uint64(d.newlinesIndex[i]),
+		sz:  uint64(d.newlinesIndex[i+1] - d.newlinesIndex[i]),
 	}
 	blob, err := d.readSectionBlob(sec)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return fromSizedDeltas(blob, buf), sec.sz, nil
+	return fromSizedDeltas(blob, buf), uint32(sec.sz), nil
 }
 
 func (d *indexData) readDocSections(i uint32, buf []DocumentSection) ([]DocumentSection, uint32, error) {
 	sec := simpleSection{
-		off: d.docSectionsStart + d.docSectionsIndex[i],
-		sz:  d.docSectionsIndex[i+1] - d.docSectionsIndex[i],
+		off: d.docSectionsStart + uint64(d.docSectionsIndex[i]),
+		sz:  uint64(d.docSectionsIndex[i+1] - d.docSectionsIndex[i]),
 	}
 	blob, err := d.readSectionBlob(sec)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return unmarshalDocSections(blob, buf), sec.sz, nil
+	return unmarshalDocSections(blob, buf), uint32(sec.sz), nil
 }
 
 // NewSearcher creates a Searcher for a single index file.  Search
@@ -353,32 +534,75 @@ func NewSearcher(r IndexFile) (Searcher, error) {
 
 	var toc indexTOC
 	if err := rd.readTOC(&toc); err != nil {
-		return nil, err
+		return nil, Errorf(CodeShardCorrupt, "%s: %v", r.Name(), err)
 	}
 	indexData, err := rd.readIndexData(&toc)
-	if err != nil {
-		return nil, err
+	if e, ok := err.(*Error); ok && e.Code == CodeIndexStale {
+		return nil, Errorf(CodeIndexStale, "%s: %s", r.Name(), e.Message)
+	} else if err != nil {
+		return nil, Errorf(CodeShardCorrupt, "%s: %v", r.Name(), err)
 	}
 	indexData.file = r
 	return indexData, nil
 }
 
+// VerifyShard checks that the index shard is intact: all sections
+// must be within the file and match their checksums, and the index
+// data must be consistent. Unlike NewSearcher, it reads the whole
+// file. It returns an error with CodeIndexStale for shards of another
+// format version, and with CodeShardCorrupt for damaged ones. The
+// IndexFile is not closed.
+func VerifyShard(f IndexFile) error {
+	rd := &reader{r: f}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		if e, ok := err.(*Error); ok && e.Code == CodeIndexStale {
+			return Errorf(CodeIndexStale, "%s: %s", f.Name(), e.Message)
+		}
+		return Errorf(CodeShardCorrupt, "%s: %v", f.Name(), err)
+	}
+	if err := rd.verifyChecksums(&toc); err != nil {
+		return Errorf(CodeShardCorrupt, "%s: %v", f.Name(), err)
+	}
+	_, err := rd.readIndexData(&toc)
+	if e, ok := err.(*Error); ok && e.Code == CodeIndexStale {
+		return Errorf(CodeIndexStale, "%s: %s", f.Name(), e.Message)
+	} else if err != nil {
+		return Errorf(CodeShardCorrupt, "%s: %v", f.Name(), err)
+	}
+	return nil
+}
+
 // ReadMetadata returns the metadata of index shard without reading
-// the index data. The IndexFile is not closed.
+// the index data. The repository metadata includes the sidecar of the
+// shard, see ShardMetaName. It also reads shards of format versions that
+// cannot be searched anymore, so callers can compare
+// IndexMetadata.IndexFormatVersion with MinIndexFormatVersion and
+// IndexFormatVersion. The IndexFile is not closed.
 func ReadMetadata(inf IndexFile) (*Repository, *IndexMetadata, error) {
 	rd := &reader{r: inf}
 	var toc indexTOC
-	if err := rd.readTOC(&toc); err != nil {
-		return nil, nil, err
+	tocErr := rd.readTOC(&toc)
+	if tocErr != nil && ErrorCodeOf(tocErr) != CodeIndexStale {
+		return nil, nil, tocErr
 	}
 
 	var md IndexMetadata
 	if err := rd.readJSON(&md, &toc.metaData); err != nil {
+		if tocErr != nil {
+			return nil, nil, tocErr
+		}
 		return nil, nil, err
 	}
 
 	var repo Repository
 	if err := rd.readJSON(&repo, &toc.repoMetaData); err != nil {
+		if tocErr != nil {
+			return nil, nil, tocErr
+		}
+		return nil, nil, err
+	}
+	if err := readShardMeta(inf.Name(), &repo); err != nil {
 		return nil, nil, err
 	}
 
@@ -98,3 +98,86 @@ func TestReadWriteNames(t *testing.T) {
 		t.Errorf("got trigram bcd at bits %v, want sz 2", data.fileNameNgrams)
 	}
 }
+
+func TestReadNarrowOffsets(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.AddFile("filename", []byte("abcde")); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+
+	var wide, narrow bytes.Buffer
+	if err := b.Write(&wide); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := b.write(&narrow, IndexMetadata{IndexFormatVersion: wideOffsetsVersion - 1}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if narrow.Len() >= wide.Len() {
+		t.Errorf("got narrow size %d, want less than wide size %d", narrow.Len(), wide.Len())
+	}
+
+	for _, tc := range []struct {
+		data   []byte
+		narrow bool
+	}{
+		{wide.Bytes(), false},
+		{narrow.Bytes(), true},
+	} {
+		r := reader{r: &memSeeker{tc.data}}
+		var toc indexTOC
+		if err := r.readTOC(&toc); err != nil {
+			t.Fatalf("readTOC: %v", err)
+		}
+		if r.narrow != tc.narrow {
+			t.Errorf("got narrow %v, want %v", r.narrow, tc.narrow)
+		}
+		if toc.fileContents.data.sz != 5 {
+			t.Errorf("got contents size %d, want 5", toc.fileContents.data.sz)
+		}
+		if tc.narrow && wideOffsetsVersion-1 < MinIndexFormatVersion {
+			// Narrow files are too old to search, but their
+			// version can still be read, eg. to upgrade them.
+			if _, md, err := ReadMetadata(&memSeeker{tc.data}); err != nil || md.IndexFormatVersion != wideOffsetsVersion-1 {
+				t.Errorf("ReadMetadata: got %+v, %v, want v%d", md, err, wideOffsetsVersion-1)
+			}
+			if _, err := NewSearcher(&memSeeker{tc.data}); ErrorCodeOf(err) != CodeIndexStale {
+				t.Errorf("NewSearcher: got %v, want IndexStale", err)
+			}
+			continue
+		}
+		data, err := r.readIndexData(&toc)
+		if err != nil {
+			t.Fatalf("readIndexData: %v", err)
+		}
+		if got, err := data.readContents(0); err != nil || string(got) != "abcde" {
+			t.Errorf("got contents %q, %v, want %q", got, err, "abcde")
+		}
+		if err := VerifyShard(&memSeeker{tc.data}); err != nil {
+			t.Errorf("VerifyShard: %v", err)
+		}
+	}
+
+	w := &writer{w: &bytes.Buffer{}, narrow: true}
+	w.Offset(1 << 32)
+	if w.err == nil {
+		t.Errorf("writing a 33-bit offset succeeded for a narrow file")
+	}
+}
+
+func TestAddBeyond4G(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	// Pretend the shard already holds almost 4G of content.
+	b.contentPostings.endByte = maxUInt32 - 3
+	if err := b.AddFile("small", []byte("abc")); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+	if err := b.AddFile("large", []byte("abcd")); err == nil {
+		t.Errorf("adding content beyond 4G succeeded")
+	}
+}
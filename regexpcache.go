@@ -0,0 +1,126 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"context"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt/query"
+)
+
+// regexpCache holds the compiled regexps of a search, so they are
+// compiled once rather than once per shard. It is safe for
+// concurrent use.
+type regexpCache struct {
+	maxSize int
+
+	mu       sync.Mutex
+	compiled map[string]*regexp.Regexp
+}
+
+func newRegexpCache(maxSize int) *regexpCache {
+	return &regexpCache{
+		maxSize:  maxSize,
+		compiled: map[string]*regexp.Regexp{},
+	}
+}
+
+// compile returns the compiled expr. On a cache miss, the cost of
+// compiling is added to stats. Regexps that compile to more than
+// maxSize instructions fail with CodeQueryTooExpensive.
+func (c *regexpCache) compile(expr string, stats *Stats) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if re, ok := c.compiled[expr]; ok {
+		return re, nil
+	}
+
+	start := time.Now()
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, Errorf(CodeQueryParse, "%v", err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, Errorf(CodeQueryParse, "%v", err)
+	}
+	if c.maxSize > 0 && len(prog.Inst) > c.maxSize {
+		return nil, Errorf(CodeQueryTooExpensive, "regexp %q compiles to %d instructions, more than the maximum %d", expr, len(prog.Inst), c.maxSize)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, Errorf(CodeQueryParse, "%v", err)
+	}
+
+	stats.RegexpsCompiled++
+	stats.RegexpCompileDuration += time.Since(start)
+	c.compiled[expr] = re
+	return re, nil
+}
+
+// regexpExpr returns the regexp used to evaluate a query.Regexp.
+func regexpExpr(s *query.Regexp) string {
+	if !s.CaseSensitive {
+		return "(?i)" + s.Regexp.String()
+	}
+	return s.Regexp.String()
+}
+
+// substringExpr returns the regexp used to evaluate a query.Substring
+// that is too short for the ngram index.
+func substringExpr(s *query.Substring) string {
+	expr := regexp.QuoteMeta(s.Pattern)
+	if s.Word {
+		expr = `\b` + expr + `\b`
+	}
+	if !s.CaseSensitive {
+		return "(?i)" + expr
+	}
+	return expr
+}
+
+type regexpCacheKey struct{}
+
+// CompileRegexps compiles the regular expressions in q up front,
+// checking them against opts.MaxRegexpSize, and adds the cost to
+// stats. Searches using the returned context share the compiled
+// regexps, so searchers over many shards should call it once per
+// search.
+func CompileRegexps(ctx context.Context, q query.Q, opts *SearchOptions, stats *Stats) (context.Context, error) {
+	c := newRegexpCache(opts.MaxRegexpSize)
+	var err error
+	query.VisitAtoms(q, func(q query.Q) {
+		if s, ok := q.(*query.Regexp); ok && err == nil {
+			_, err = c.compile(regexpExpr(s), stats)
+		}
+	})
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, regexpCacheKey{}, c), nil
+}
+
+// regexpCacheFor returns the cache set up by CompileRegexps, or a
+// fresh one.
+func regexpCacheFor(ctx context.Context, opts *SearchOptions) *regexpCache {
+	if c, ok := ctx.Value(regexpCacheKey{}).(*regexpCache); ok {
+		return c
+	}
+	return newRegexpCache(opts.MaxRegexpSize)
+}
@@ -0,0 +1,350 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replicate copies index shards from one index directory to
+// another over HTTP, so a standby webserver can be kept current
+// without a shared filesystem.
+//
+// The source serves Handler. The replica periodically calls Sync,
+// which downloads new and changed shards, verifies their checksums,
+// moves them into place atomically and removes shards that are gone
+// from the source. The shards of all tenants are replicated, together
+// with their metadata sidecars.
+package replicate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+)
+
+// Shard describes a shard file or shard metadata sidecar in an index
+// directory.
+type Shard struct {
+	// Name is the path relative to the index directory, with '/'
+	// separators, eg. "tenant-x/repo_v16.00000.zoekt".
+	Name    string
+	Size    int64
+	ModTime time.Time
+
+	// Hex encoded SHA-256 of the contents.
+	Checksum string
+}
+
+// checksummer computes shard checksums, remembering them as long as
+// the file size and modification time do not change.
+type checksummer struct {
+	mu    sync.Mutex
+	cache map[string]Shard
+}
+
+func (c *checksummer) list(dir string) ([]Shard, error) {
+	shards, err := zoekt.ListShards(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fs []string
+	for _, fn := range shards {
+		fs = append(fs, fn, zoekt.ShardMetaName(fn))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[string]Shard{}
+	}
+
+	var res []Shard
+	seen := map[string]bool{}
+	for _, fn := range fs {
+		fi, err := os.Stat(fn)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		s, ok := c.cache[fn]
+		if !ok || s.Size != fi.Size() || !s.ModTime.Equal(fi.ModTime()) {
+			sum, err := checksumFile(fn)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			rel, err := filepath.Rel(dir, fn)
+			if err != nil {
+				return nil, err
+			}
+			s = Shard{
+				Name:     filepath.ToSlash(rel),
+				Size:     fi.Size(),
+				ModTime:  fi.ModTime(),
+				Checksum: sum,
+			}
+			c.cache[fn] = s
+		}
+		seen[fn] = true
+		res = append(res, s)
+	}
+
+	for fn := range c.cache {
+		if !seen[fn] {
+			delete(c.cache, fn)
+		}
+	}
+	return res, nil
+}
+
+// validName returns whether name, as in Shard.Name, is a shard or
+// sidecar that may be replicated.
+func validName(name string) bool {
+	dir, base := path.Split(name)
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, "/")
+		if !strings.HasPrefix(dir, zoekt.TenantDirPrefix) ||
+			!zoekt.ValidTenantID(strings.TrimPrefix(dir, zoekt.TenantDirPrefix)) {
+			return false
+		}
+	}
+	return base != "" && base[0] != '.' &&
+		(strings.HasSuffix(base, ".zoekt") || strings.HasSuffix(base, ".zoekt.meta"))
+}
+
+func checksumFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type handler struct {
+	dir  string
+	sums checksummer
+}
+
+// Handler serves the shards of dir for replication. It must be
+// mounted so that it sees paths relative to its prefix, eg. with
+// http.StripPrefix. "list" returns the shards and sidecars as a JSON
+// []Shard; "shard/NAME" returns the contents of one of them.
+func Handler(dir string) http.Handler {
+	return &handler{dir: dir}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case p == "list":
+		shards, err := h.sums.list(h.dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(shards)
+	case strings.HasPrefix(p, "shard/"):
+		name := strings.TrimPrefix(p, "shard/")
+		if !validName(name) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(h.dir, filepath.FromSlash(name)))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Stats summarizes a Sync.
+type Stats struct {
+	Downloaded int
+	Deleted    int
+	Unchanged  int
+	Bytes      int64
+}
+
+// Replica keeps an index directory in sync with a source.
+type Replica struct {
+	// Source is the URL at which the source serves Handler.
+	Source string
+
+	// Dir is the local index directory.
+	Dir string
+
+	// Client is used for requests. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	sums checksummer
+}
+
+func (r *Replica) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	return http.DefaultClient
+}
+
+func (r *Replica) url(p string) string {
+	return strings.TrimSuffix(r.Source, "/") + "/" + p
+}
+
+func (r *Replica) get(ctx context.Context, p string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", r.url(p), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", r.url(p), resp.Status)
+	}
+	return resp, nil
+}
+
+// Sync makes Dir match the source. New and changed shards are
+// downloaded before shards missing from the source are deleted, so
+// the replica is never left with fewer shards than it started with
+// if Sync fails halfway.
+func (r *Replica) Sync(ctx context.Context) (*Stats, error) {
+	resp, err := r.get(ctx, "list")
+	if err != nil {
+		return nil, err
+	}
+	var remote []Shard
+	err = json.NewDecoder(resp.Body).Decode(&remote)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("list: %v", err)
+	}
+
+	local, err := r.sums.list(r.Dir)
+	if err != nil {
+		return nil, err
+	}
+	localSums := map[string]string{}
+	for _, s := range local {
+		localSums[s.Name] = s.Checksum
+	}
+
+	var stats Stats
+	want := map[string]bool{}
+	for _, s := range remote {
+		if !validName(s.Name) {
+			return &stats, fmt.Errorf("invalid shard name %q", s.Name)
+		}
+		want[s.Name] = true
+		if localSums[s.Name] == s.Checksum {
+			stats.Unchanged++
+			continue
+		}
+		if err := r.download(ctx, s); err != nil {
+			return &stats, err
+		}
+		stats.Downloaded++
+		stats.Bytes += s.Size
+	}
+
+	for _, s := range local {
+		if want[s.Name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(r.Dir, filepath.FromSlash(s.Name))); err != nil && !os.IsNotExist(err) {
+			return &stats, err
+		}
+		stats.Deleted++
+	}
+	return &stats, nil
+}
+
+// download fetches a shard into a temporary file, verifies its
+// checksum and renames it into place.
+func (r *Replica) download(ctx context.Context, s Shard) error {
+	resp, err := r.get(ctx, "shard/"+url.PathEscape(s.Name))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dst := filepath.Join(r.Dir, filepath.FromSlash(s.Name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dst), path.Base(s.Name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("download %s: %v", s.Name, err)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != s.Checksum {
+		return fmt.Errorf("download %s: checksum %s, want %s", s.Name, got, s.Checksum)
+	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return err
+	}
+	log.Printf("replicated %s (%d bytes)", s.Name, s.Size)
+	return nil
+}
+
+// Run calls Sync every interval until ctx is canceled.
+func (r *Replica) Run(ctx context.Context, interval time.Duration) {
+	for {
+		if stats, err := r.Sync(ctx); err != nil {
+			log.Printf("sync from %s: %v", r.Source, err)
+		} else if stats.Downloaded > 0 || stats.Deleted > 0 {
+			log.Printf("sync from %s: %+v", r.Source, *stats)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
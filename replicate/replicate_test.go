@@ -0,0 +1,187 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicate
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readDir(t *testing.T, dir string) map[string]string {
+	res := map[string]string{}
+	err := filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		c, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fn)
+		if err != nil {
+			return err
+		}
+		res[filepath.ToSlash(rel)] = string(c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestSync(t *testing.T) {
+	src, err := ioutil.TempDir("", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	writeFiles(t, src, map[string]string{
+		"a_v16.00000.zoekt": "shard a",
+		"b_v16.00000.zoekt": "shard b",
+		"ignored.tmp":       "temporary",
+	})
+	writeFiles(t, dst, map[string]string{
+		"b_v16.00000.zoekt": "shard b",
+		"c_v16.00000.zoekt": "deleted at source",
+	})
+
+	ts := httptest.NewServer(http.StripPrefix("/replicate", Handler(src)))
+	defer ts.Close()
+
+	r := &Replica{Source: ts.URL + "/replicate/", Dir: dst}
+	stats, err := r.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Downloaded: 1, Deleted: 1, Unchanged: 1, Bytes: 7}); *stats != want {
+		t.Errorf("got stats %+v, want %+v", *stats, want)
+	}
+
+	want := map[string]string{
+		"a_v16.00000.zoekt": "shard a",
+		"b_v16.00000.zoekt": "shard b",
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Changed content is downloaded again.
+	writeFiles(t, src, map[string]string{"b_v16.00000.zoekt": "shard b, v2"})
+	if stats, err = r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Downloaded: 1, Unchanged: 1, Bytes: 11}); *stats != want {
+		t.Errorf("got stats %+v, want %+v", *stats, want)
+	}
+	if got := readDir(t, dst)["b_v16.00000.zoekt"]; got != "shard b, v2" {
+		t.Errorf("got %q after update", got)
+	}
+}
+
+func TestSyncTenantsAndSidecars(t *testing.T) {
+	src, err := ioutil.TempDir("", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	files := map[string]string{
+		"a_v16.00000.zoekt":               "shard a",
+		"a_v16.00000.zoekt.meta":          "meta a",
+		"tenant-x/b_v16.00000.zoekt":      "shard b",
+		"tenant-x/b_v16.00000.zoekt.meta": "meta b",
+	}
+	writeFiles(t, src, files)
+	writeFiles(t, src, map[string]string{"tenant-x/ignored.tmp": "temporary"})
+
+	ts := httptest.NewServer(Handler(src))
+	defer ts.Close()
+
+	r := &Replica{Source: ts.URL, Dir: dst}
+	if _, err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDir(t, dst); !reflect.DeepEqual(got, files) {
+		t.Errorf("got %v, want %v", got, files)
+	}
+
+	// A removed sidecar is removed from the replica.
+	if err := os.Remove(filepath.Join(src, "tenant-x", "b_v16.00000.zoekt.meta")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := r.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Deleted: 1, Unchanged: 3}); *stats != want {
+		t.Errorf("got stats %+v, want %+v", *stats, want)
+	}
+	if _, ok := readDir(t, dst)["tenant-x/b_v16.00000.zoekt.meta"]; ok {
+		t.Errorf("sidecar not deleted")
+	}
+}
+
+func TestHandlerRejectsPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"secret": "x"})
+
+	ts := httptest.NewServer(Handler(filepath.Join(dir, "sub")))
+	defer ts.Close()
+
+	for _, p := range []string{"/shard/..%2fsecret", "/shard/secret", "/shard/tenant-..%2fsecret.zoekt", "/other"} {
+		resp, err := http.Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", p, resp.StatusCode)
+		}
+	}
+}
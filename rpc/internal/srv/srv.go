@@ -12,6 +12,11 @@ import (
 type SearchArgs struct {
 	Q    query.Q
 	Opts *zoekt.SearchOptions
+
+	// The tenant of the request, if HasTenant is set. See
+	// zoekt.WithTenant.
+	Tenant    string
+	HasTenant bool
 }
 
 type SearchReply struct {
@@ -20,6 +25,10 @@ type SearchReply struct {
 
 type ListArgs struct {
 	Q query.Q
+
+	// See SearchArgs.
+	Tenant    string
+	HasTenant bool
 }
 
 type ListReply struct {
@@ -34,9 +43,12 @@ func (s *Searcher) Search(ctx context.Context, args *SearchArgs, reply *SearchRe
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	log.Printf("got rpc query %q", args.Q)
+	if args.HasTenant {
+		ctx = zoekt.WithTenant(ctx, args.Tenant)
+	}
 	r, err := s.Searcher.Search(ctx, args.Q, args.Opts)
 	if err != nil {
-		return err
+		return codedError(err)
 	}
 	reply.Result = r
 	return nil
@@ -45,10 +57,25 @@ func (s *Searcher) Search(ctx context.Context, args *SearchArgs, reply *SearchRe
 func (s *Searcher) List(ctx context.Context, args *ListArgs, reply *ListReply) error {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
+	if args.HasTenant {
+		ctx = zoekt.WithTenant(ctx, args.Tenant)
+	}
 	r, err := s.Searcher.List(ctx, args.Q)
 	if err != nil {
-		return err
+		return codedError(err)
 	}
 	reply.List = r
 	return nil
 }
+
+// codedError converts errors with a code to *zoekt.Error, whose text
+// carries the code to the client.
+func codedError(err error) error {
+	if _, ok := err.(*zoekt.Error); ok {
+		return err
+	}
+	if code := zoekt.ErrorCodeOf(err); code != zoekt.CodeUnknown {
+		return &zoekt.Error{Code: code, Message: err.Error()}
+	}
+	return err
+}
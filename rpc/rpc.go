@@ -49,15 +49,29 @@ type client struct {
 }
 
 func (c *client) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	args := &srv.SearchArgs{Q: q, Opts: opts}
+	args.Tenant, args.HasTenant = zoekt.TenantFromContext(ctx)
 	var reply srv.SearchReply
-	err := c.call(ctx, "Searcher.Search", &srv.SearchArgs{Q: q, Opts: opts}, &reply)
-	return reply.Result, err
+	err := c.call(ctx, "Searcher.Search", args, &reply)
+	return reply.Result, decodeError(err)
 }
 
 func (c *client) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	args := &srv.ListArgs{Q: q}
+	args.Tenant, args.HasTenant = zoekt.TenantFromContext(ctx)
 	var reply srv.ListReply
-	err := c.call(ctx, "Searcher.List", &srv.ListArgs{Q: q}, &reply)
-	return reply.List, err
+	err := c.call(ctx, "Searcher.List", args, &reply)
+	return reply.List, decodeError(err)
+}
+
+// decodeError restores the *zoekt.Error sent by the server.
+func decodeError(err error) error {
+	if se, ok := err.(rpc.ServerError); ok {
+		if e := zoekt.ErrorFromString(string(se)); e != nil {
+			return e
+		}
+	}
+	return err
 }
 
 func (c *client) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
@@ -108,7 +122,11 @@ func (c *client) getRPCClient(ctx context.Context, gen int) (*rpc.Client, int, e
 }
 
 func (c *client) Close() {
-	c.cl.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cl != nil {
+		c.cl.Close()
+	}
 }
 
 func (c *client) String() string {
@@ -126,8 +144,19 @@ func registerGob() {
 		gob.Register(&query.Const{})
 		gob.Register(&query.Repo{})
 		gob.Register(&query.RepoSet{})
+		gob.Register(&query.RepoIDs{})
+		gob.Register(&query.RepoRegexp{})
+		gob.Register(&query.RepoFlag{})
+		gob.Register(&query.RepoDescription{})
+		gob.Register(&query.Topic{})
+		gob.Register(&query.RepoBranches{})
+		gob.Register(&query.RepoCommit{})
+		gob.Register(&query.FileCategory{})
+		gob.Register(&query.FileSize{})
 		gob.Register(&query.Substring{})
+		gob.Register(&query.Symbol{})
 		gob.Register(&query.Not{})
 		gob.Register(&query.Branch{})
+		gob.Register(&query.Type{})
 	})
 }
@@ -60,6 +60,69 @@ func TestClientServer(t *testing.T) {
 	}
 }
 
+type errSearcher struct {
+	mockSearcher
+	err error
+}
+
+func (s *errSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	return nil, s.err
+}
+
+func TestErrorCode(t *testing.T) {
+	ts := httptest.NewServer(rpc.Server(&errSearcher{
+		err: zoekt.Errorf(zoekt.CodeOverloaded, "busy"),
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.Client(u.Host)
+	defer client.Close()
+
+	_, err = client.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+	zerr, ok := err.(*zoekt.Error)
+	if !ok {
+		t.Fatalf("got %T (%v), want *zoekt.Error", err, err)
+	}
+	if zerr.Code != zoekt.CodeOverloaded || zerr.Message != "busy" || !zerr.Temporary() {
+		t.Errorf("got %#v", zerr)
+	}
+}
+
+type tenantSearcher struct {
+	mockSearcher
+	tenant string
+}
+
+func (s *tenantSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	s.tenant, _ = zoekt.TenantFromContext(ctx)
+	return &zoekt.SearchResult{}, nil
+}
+
+func TestTenant(t *testing.T) {
+	s := &tenantSearcher{}
+	ts := httptest.NewServer(rpc.Server(s))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.Client(u.Host)
+	defer client.Close()
+
+	ctx := zoekt.WithTenant(context.Background(), "acme")
+	if _, err := client.Search(ctx, &query.Const{Value: true}, &zoekt.SearchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.tenant != "acme" {
+		t.Errorf("got tenant %q, want acme", s.tenant)
+	}
+}
+
 type mockSearcher struct {
 	wantSearch   query.Q
 	searchResult *zoekt.SearchResult
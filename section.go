@@ -16,17 +16,32 @@ package zoekt
 
 import (
 	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"log"
 )
 
 var _ = log.Println
 
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // writer is an io.Writer that keeps track of errors and offsets
 type writer struct {
 	err error
 	w   io.Writer
-	off uint32
+	off uint64
+
+	// narrow is set to write 32-bit offsets, as used by format
+	// versions before wideOffsetsVersion.
+	narrow bool
+
+	// crc hashes the section being written.
+	crc hash.Hash32
+
+	// checksums of the sections written so far.
+	checksums map[simpleSection]uint32
 }
 
 func (w *writer) Write(b []byte) error {
@@ -36,11 +51,14 @@ func (w *writer) Write(b []byte) error {
 
 	var n int
 	n, w.err = w.w.Write(b)
-	w.off += uint32(n)
+	w.off += uint64(n)
+	if w.crc != nil {
+		w.crc.Write(b[:n])
+	}
 	return w.err
 }
 
-func (w *writer) Off() uint32 { return w.off }
+func (w *writer) Off() uint64 { return w.off }
 
 func (w *writer) B(b byte) {
 	s := []byte{b}
@@ -59,6 +77,22 @@ func (w *writer) U64(n uint64) {
 	w.Write(enc[:])
 }
 
+// Offset writes an offset or size into the file, using the width of
+// the format being written.
+func (w *writer) Offset(n uint64) {
+	if !w.narrow {
+		w.U64(n)
+		return
+	}
+	if n > maxUInt32 {
+		if w.err == nil {
+			w.err = fmt.Errorf("offset %d does not fit in 32 bits", n)
+		}
+		return
+	}
+	w.U32(uint32(n))
+}
+
 func (w *writer) Varint(n uint32) {
 	var enc [8]byte
 	m := binary.PutUvarint(enc[:], uint64(n))
@@ -67,10 +101,16 @@ func (w *writer) Varint(n uint32) {
 
 func (s *simpleSection) start(w *writer) {
 	s.off = w.Off()
+	w.crc = crc32.New(castagnoli)
 }
 
 func (s *simpleSection) end(w *writer) {
 	s.sz = w.Off() - s.off
+	if w.checksums == nil {
+		w.checksums = map[simpleSection]uint32{}
+	}
+	w.checksums[*s] = w.crc.Sum32()
+	w.crc = nil
 }
 
 // section is a range of bytes in the index file.
@@ -81,17 +121,17 @@ type section interface {
 
 // simpleSection is a simple range of bytes.
 type simpleSection struct {
-	off uint32
-	sz  uint32
+	off uint64
+	sz  uint64
 }
 
 func (s *simpleSection) read(r *reader) error {
 	var err error
-	s.off, err = r.U32()
+	s.off, err = r.Offset()
 	if err != nil {
 		return err
 	}
-	s.sz, err = r.U32()
+	s.sz, err = r.Offset()
 	if err != nil {
 		return err
 	}
@@ -99,8 +139,8 @@ func (s *simpleSection) read(r *reader) error {
 }
 
 func (s *simpleSection) write(w *writer) {
-	w.U32(s.off)
-	w.U32(s.sz)
+	w.Offset(s.off)
+	w.Offset(s.sz)
 }
 
 // compoundSection is a range of bytes containg a list of variable
@@ -108,7 +148,7 @@ func (s *simpleSection) write(w *writer) {
 type compoundSection struct {
 	data simpleSection
 
-	offsets []uint32
+	offsets []uint64
 	index   simpleSection
 }
 
@@ -120,7 +160,7 @@ func (s *compoundSection) end(w *writer) {
 	s.data.end(w)
 	s.index.start(w)
 	for _, o := range s.offsets {
-		w.U32(o)
+		w.Offset(o)
 	}
 	s.index.end(w)
 }
@@ -142,24 +182,44 @@ func (s *compoundSection) read(r *reader) error {
 	if err := s.index.read(r); err != nil {
 		return err
 	}
-	var err error
-	s.offsets, err = readSectionU32(r.r, s.index)
-	return err
+	if !r.narrow {
+		var err error
+		s.offsets, err = readSectionU64(r.r, s.index)
+		return err
+	}
+	offsets, err := readSectionU32(r.r, s.index)
+	if err != nil {
+		return err
+	}
+	s.offsets = make([]uint64, 0, len(offsets))
+	for _, o := range offsets {
+		s.offsets = append(s.offsets, uint64(o))
+	}
+	return nil
 }
 
 // relativeIndex returns the relative offsets of the items (first
-// element is 0), plus a final marking the end of the last item.
-func (s *compoundSection) relativeIndex() []uint32 {
+// element is 0), plus a final marking the end of the last item. The
+// section must be smaller than 4G.
+func (s *compoundSection) relativeIndex() ([]uint32, error) {
+	if s.data.sz > maxUInt32 {
+		return nil, fmt.Errorf("section at [%d, +%d) too large for a 32-bit index", s.data.off, s.data.sz)
+	}
 	ri := make([]uint32, 0, len(s.offsets)+1)
 	for _, o := range s.offsets {
-		ri = append(ri, o-s.offsets[0])
+		ri = append(ri, uint32(o-s.offsets[0]))
 	}
 	if len(s.offsets) > 0 {
-		ri = append(ri, s.data.sz)
+		ri = append(ri, uint32(s.data.sz))
 	}
-	return ri
+	return ri, nil
 }
 
-func (s *compoundSection) readBlob(r *indexData, i uint32) ([]byte, error) {
-	return r.readSectionBlob(simpleSection{s.offsets[i], s.offsets[i+1] - s.offsets[i]})
+// item returns the byte range of the i'th item.
+func (s *compoundSection) item(i int) simpleSection {
+	end := s.data.off + s.data.sz
+	if i+1 < len(s.offsets) {
+		end = s.offsets[i+1]
+	}
+	return simpleSection{s.offsets[i], end - s.offsets[i]}
 }
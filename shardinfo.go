@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import "time"
+
+// ShardInfo describes the contents and size of an index shard.
+type ShardInfo struct {
+	Name       string
+	Repository string
+	Branches   []RepositoryBranch
+
+	IndexFormatVersion  int
+	IndexFeatureVersion int
+	IndexTime           time.Time
+
+	Documents    int
+	ContentBytes int64
+
+	// Ngrams is the number of distinct content ngrams, and
+	// PostingBytes the size of their posting lists on disk.
+	Ngrams         int
+	PostingBytes   int64
+	FileNameNgrams int
+
+	// Symbols is the number of symbol definitions.
+	Symbols int
+
+	// DiskBytes is the size of the shard file; MemoryBytes is the
+	// memory the shard takes while loaded, excluding the parts
+	// that stay on disk.
+	DiskBytes   int64
+	MemoryBytes int64
+}
+
+// ReadShardInfo loads the shard f and returns its statistics. The
+// IndexFile is not closed.
+func ReadShardInfo(f IndexFile) (*ShardInfo, error) {
+	rd := &reader{r: f}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return nil, Errorf(CodeShardCorrupt, "%s: %v", f.Name(), err)
+	}
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		return nil, Errorf(CodeShardCorrupt, "%s: %v", f.Name(), err)
+	}
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ShardInfo{
+		Name:                f.Name(),
+		Repository:          d.repoMetaData.Name,
+		Branches:            d.repoMetaData.Branches,
+		IndexFormatVersion:  d.metaData.IndexFormatVersion,
+		IndexFeatureVersion: d.metaData.IndexFeatureVersion,
+		IndexTime:           d.metaData.IndexTime,
+		Documents:           d.repoListEntry.Stats.Documents,
+		ContentBytes:        d.repoListEntry.Stats.ContentBytes,
+		Ngrams:              len(d.ngrams),
+		FileNameNgrams:      len(d.fileNameNgrams),
+		Symbols:             len(d.runeDocSections),
+		DiskBytes:           int64(size),
+		MemoryBytes:         d.repoListEntry.Stats.IndexBytes,
+	}
+	for _, sec := range d.ngrams {
+		info.PostingBytes += int64(sec.sz)
+	}
+	return info, nil
+}
@@ -0,0 +1,524 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/objstore"
+	"github.com/google/zoekt/query"
+)
+
+var (
+	metricBucketCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zoekt_bucket_cache_bytes",
+		Help: "Bytes of shards cached from object storage.",
+	})
+	metricBucketCacheFetches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_bucket_cache_fetches_total",
+		Help: "Shards fetched from object storage.",
+	})
+	metricBucketCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_bucket_cache_evictions_total",
+		Help: "Shards evicted from the cache of object storage.",
+	})
+)
+
+// bucketCacheDir is the directory inside the index directory holding
+// the shards cached from object storage. The directory watcher does
+// not see it; the cache loads its shards itself.
+const bucketCacheDir = ".bucket-cache"
+
+// remoteShard is a shard in the bucket.
+type remoteShard struct {
+	objstore.Object
+
+	// meta is the metadata sidecar of the shard, if it has one.
+	meta *objstore.Object
+
+	// repo is the repository of the shard, as encoded in its
+	// name, or "" if the name was too long to encode it.
+	repo   string
+	tenant string
+
+	// kept is set for the shards of earlier versions, see
+	// build.Options.KeepVersions.
+	kept bool
+}
+
+func (r *remoteShard) size() int64 {
+	if r.meta != nil {
+		return r.Size + r.meta.Size
+	}
+	return r.Size
+}
+
+// parseShardName returns the remote shard of the object named name,
+// or false if name does not name a shard.
+func parseShardName(name string) (remoteShard, bool) {
+	r := remoteShard{Object: objstore.Object{Name: name}}
+	dir, base := path.Split(name)
+	if !strings.HasSuffix(base, ".zoekt") {
+		return r, false
+	}
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, "/")
+		if !strings.HasPrefix(dir, zoekt.TenantDirPrefix) || strings.Contains(dir, "/") {
+			return r, false
+		}
+		r.tenant = strings.TrimPrefix(dir, zoekt.TenantDirPrefix)
+	}
+
+	// The name is PREFIX_vN.NNNNN.zoekt or, for kept versions,
+	// PREFIX@TAG_vN.NNNNN.zoekt, where PREFIX is the query escaped
+	// repository name.
+	i := strings.LastIndex(base, "_v")
+	if i < 0 {
+		return r, true
+	}
+	prefix := base[:i]
+	if j := strings.Index(prefix, "@"); j >= 0 {
+		prefix = prefix[:j]
+		r.kept = true
+	}
+	// Longer prefixes are truncated and end in a hash.
+	if len(prefix) > 200 {
+		return r, true
+	}
+	if repo, err := url.QueryUnescape(prefix); err == nil {
+		r.repo = repo
+	}
+	return r, true
+}
+
+// evalRepoNames replaces the atoms of q that depend only on the
+// repository name by their value for name.
+func evalRepoNames(q query.Q, name string) query.Q {
+	return query.Simplify(query.Map(q, func(q query.Q) query.Q {
+		switch r := q.(type) {
+		case *query.Repo:
+			return &query.Const{Value: name != "" && strings.Contains(name, r.Pattern)}
+		case *query.RepoRegexp:
+			return &query.Const{Value: name != "" && r.Regexp.MatchString(name)}
+		case *query.RepoSet:
+			return &query.Const{Value: r.Set[name]}
+		case *query.RepoBranches:
+			_, ok := r.Set[name]
+			return &query.Const{Value: ok}
+		case *query.RepoCommit:
+			return &query.Const{Value: r.Repo == name}
+		}
+		return q
+	}))
+}
+
+// restrictsRepos returns whether q can only match repositories named
+// by its repo atoms.
+func restrictsRepos(q query.Q) bool {
+	c, ok := evalRepoNames(q, "").(*query.Const)
+	return ok && !c.Value
+}
+
+// mayMatch returns whether q may need the shard.
+func (r *remoteShard) mayMatch(ctx context.Context, q query.Q) bool {
+	if !zoekt.TenantMatches(ctx, &zoekt.Repository{Name: r.repo, TenantID: r.tenant}) {
+		return false
+	}
+	if r.repo == "" {
+		// Better to fetch too much than to miss matches.
+		return !r.kept
+	}
+	if r.kept {
+		pinned := false
+		query.VisitAtoms(q, func(q query.Q) {
+			if rc, ok := q.(*query.RepoCommit); ok && rc.Repo == r.repo {
+				pinned = true
+			}
+		})
+		return pinned
+	}
+	c, ok := evalRepoNames(q, r.repo).(*query.Const)
+	return !ok || c.Value
+}
+
+// cachedShard is a shard in the cache directory.
+type cachedShard struct {
+	remoteShard
+	lastUsed time.Time
+
+	// pins counts the searches using the shard. Pinned shards are
+	// not evicted.
+	pins int
+}
+
+// fetchCall is a download in progress.
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// bucketCache serves a corpus larger than the local disk from object
+// storage. Shards are fetched from the bucket when a search first
+// needs them, and evicted when they were not used for the longest
+// time once the cached shards exceed a disk budget.
+//
+// Only searches restricted by repo: atoms fetch shards; other
+// searches see the shards that happen to be cached.
+type bucketCache struct {
+	bucket objstore.Bucket
+	dir    string
+	budget int64
+	loader shardLoader
+
+	// throttle limits the number of concurrent downloads.
+	throttle chan struct{}
+
+	// maxFetches is the most shards a search may fetch, if
+	// positive.
+	maxFetches int
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	remote   map[string]*remoteShard
+	local    map[string]*cachedShard
+	used     int64
+	fetches  map[string]*fetchCall
+	evicting map[string]chan struct{}
+}
+
+func newBucketCache(bucket objstore.Bucket, dir string, budget int64, loader shardLoader) *bucketCache {
+	return &bucketCache{
+		bucket:   bucket,
+		dir:      dir,
+		budget:   budget,
+		loader:   loader,
+		throttle: make(chan struct{}, 8),
+		now:      time.Now,
+		remote:   map[string]*remoteShard{},
+		local:    map[string]*cachedShard{},
+		fetches:  map[string]*fetchCall{},
+		evicting: map[string]chan struct{}{},
+	}
+}
+
+func (c *bucketCache) path(name string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(name))
+}
+
+// restore loads the shards left in the cache directory by an earlier
+// run, as least recently used by their modification time.
+func (c *bucketCache) restore() error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	fs, err := zoekt.ListShards(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, fn := range fs {
+		rel, err := filepath.Rel(c.dir, fn)
+		if err != nil {
+			return err
+		}
+		r, ok := parseShardName(filepath.ToSlash(rel))
+		if !ok {
+			continue
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		r.Size = fi.Size()
+		if mi, err := os.Stat(zoekt.ShardMetaName(fn)); err == nil {
+			r.meta = &objstore.Object{Name: zoekt.ShardMetaName(r.Name), Size: mi.Size()}
+		}
+		c.local[r.Name] = &cachedShard{remoteShard: r, lastUsed: fi.ModTime()}
+		c.used += r.size()
+		c.loader.load(fn)
+	}
+	metricBucketCacheBytes.Set(float64(c.used))
+	c.evict()
+	return nil
+}
+
+// refresh lists the bucket. Cached shards that changed or are gone
+// from the bucket are evicted.
+func (c *bucketCache) refresh(ctx context.Context) error {
+	objs, err := c.bucket.List(ctx)
+	if err != nil {
+		return err
+	}
+	remote := map[string]*remoteShard{}
+	metas := map[string]objstore.Object{}
+	for _, o := range objs {
+		if strings.HasSuffix(o.Name, ".meta") {
+			metas[o.Name] = o
+			continue
+		}
+		r, ok := parseShardName(o.Name)
+		if !ok {
+			continue
+		}
+		r.Object = o
+		remote[o.Name] = &r
+	}
+	for name, r := range remote {
+		if m, ok := metas[zoekt.ShardMetaName(name)]; ok {
+			r.meta = &m
+		}
+	}
+
+	c.mu.Lock()
+	c.remote = remote
+	var stale []string
+	for name, s := range c.local {
+		if s.pins == 0 && !sameShard(&s.remoteShard, remote[name]) {
+			stale = append(stale, name)
+		}
+	}
+	c.mu.Unlock()
+	c.remove(stale)
+	return nil
+}
+
+// sameShard returns whether the cached shard c is current with the
+// remote shard r.
+func sameShard(c, r *remoteShard) bool {
+	if r == nil || c.Size != r.Size || (c.MD5 != "" && r.MD5 != "" && c.MD5 != r.MD5) {
+		return false
+	}
+	if (c.meta == nil) != (r.meta == nil) {
+		return false
+	}
+	return c.meta == nil || (c.meta.Size == r.meta.Size && (c.meta.MD5 == "" || c.meta.MD5 == r.meta.MD5))
+}
+
+// run refreshes the list of remote shards every interval until ctx
+// is canceled.
+func (c *bucketCache) run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := c.refresh(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("listing shards in bucket failed", "bucket", c.bucket.String(), "error", err)
+		}
+	}
+}
+
+// acquire makes sure the shards that q may need are cached and
+// loaded, and pins them until release is called. It returns the
+// number of shards that could not be fetched. If q needs more than
+// maxFetches shards that are not cached, nothing is fetched, and q
+// only sees the cached shards.
+func (c *bucketCache) acquire(ctx context.Context, q query.Q) (release func(), failed int) {
+	if !restrictsRepos(q) {
+		return func() {}, 0
+	}
+
+	c.mu.Lock()
+	var names []string
+	missing := 0
+	for name, r := range c.remote {
+		if r.mayMatch(ctx, q) {
+			names = append(names, name)
+			if _, ok := c.local[name]; !ok {
+				missing++
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	if c.maxFetches > 0 && missing > c.maxFetches {
+		slog.InfoContext(ctx, "not fetching shards for search", "shards", missing, "max", c.maxFetches, "bucket", c.bucket.String())
+		return func() {}, 0
+	}
+
+	var mu sync.Mutex
+	var pinned []*cachedShard
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			s, err := c.get(ctx, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				slog.ErrorContext(ctx, "fetching shard failed", "shard", name, "bucket", c.bucket.String(), "error", err)
+				return
+			}
+			pinned = append(pinned, s)
+		}(name)
+	}
+	wg.Wait()
+
+	c.evict()
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, s := range pinned {
+			s.pins--
+		}
+	}, failed
+}
+
+// get returns the cached shard name, pinned, fetching it if needed.
+func (c *bucketCache) get(ctx context.Context, name string) (*cachedShard, error) {
+	for {
+		c.mu.Lock()
+		if s, ok := c.local[name]; ok {
+			s.pins++
+			s.lastUsed = c.now()
+			c.mu.Unlock()
+			return s, nil
+		}
+		if done, ok := c.evicting[name]; ok {
+			c.mu.Unlock()
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		call, ok := c.fetches[name]
+		if !ok {
+			r := c.remote[name]
+			if r == nil {
+				c.mu.Unlock()
+				return nil, fmt.Errorf("shard %s is not in the bucket", name)
+			}
+			call = &fetchCall{done: make(chan struct{})}
+			c.fetches[name] = call
+			// Finish the download for other searches even if
+			// this one is canceled.
+			go c.fetch(*r, call)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+			if call.err != nil {
+				return nil, call.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fetch downloads and loads a shard.
+func (c *bucketCache) fetch(r remoteShard, call *fetchCall) {
+	c.throttle <- struct{}{}
+	d := &objstore.Downloader{Bucket: c.bucket, Dir: c.dir}
+	call.err = d.Fetch(context.Background(), r.Object)
+	if call.err == nil && r.meta != nil {
+		call.err = d.Fetch(context.Background(), *r.meta)
+	}
+	<-c.throttle
+	if call.err == nil {
+		metricBucketCacheFetches.Inc()
+		c.loader.load(c.path(r.Name))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fetches, r.Name)
+	if call.err == nil {
+		c.local[r.Name] = &cachedShard{remoteShard: r, lastUsed: c.now()}
+		c.used += r.size()
+		metricBucketCacheBytes.Set(float64(c.used))
+	}
+	close(call.done)
+}
+
+// evict removes the least recently used shards that are not pinned
+// until the cache fits its budget.
+func (c *bucketCache) evict() {
+	c.mu.Lock()
+	var victims []string
+	if c.used > c.budget {
+		var candidates []*cachedShard
+		for _, s := range c.local {
+			if s.pins == 0 {
+				candidates = append(candidates, s)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+		})
+		used := c.used
+		for _, s := range candidates {
+			if used <= c.budget {
+				break
+			}
+			victims = append(victims, s.Name)
+			used -= s.size()
+		}
+	}
+	c.mu.Unlock()
+	metricBucketCacheEvictions.Add(float64(len(victims)))
+	c.remove(victims)
+}
+
+// remove unloads and deletes cached shards.
+func (c *bucketCache) remove(names []string) {
+	c.mu.Lock()
+	var removed []string
+	for _, name := range names {
+		s, ok := c.local[name]
+		if !ok || s.pins > 0 {
+			continue
+		}
+		delete(c.local, name)
+		c.used -= s.size()
+		c.evicting[name] = make(chan struct{})
+		removed = append(removed, name)
+	}
+	metricBucketCacheBytes.Set(float64(c.used))
+	c.mu.Unlock()
+
+	for _, name := range removed {
+		fn := c.path(name)
+		c.loader.drop(fn)
+		os.Remove(zoekt.ShardMetaName(fn))
+		os.Remove(fn)
+
+		c.mu.Lock()
+		close(c.evicting[name])
+		delete(c.evicting, name)
+		c.mu.Unlock()
+	}
+}
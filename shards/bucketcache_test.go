@@ -0,0 +1,224 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/objstore"
+	"github.com/google/zoekt/query"
+)
+
+func TestParseShardName(t *testing.T) {
+	for name, want := range map[string]remoteShard{
+		"github.com%2Fa%2Fb_v16.00000.zoekt":            {repo: "github.com/a/b"},
+		"github.com%2Fa%2Fb@abc123_v16.00000.zoekt":     {repo: "github.com/a/b", kept: true},
+		"tenant-acme/github.com%2Fa%2Fb_v16.0000.zoekt": {repo: "github.com/a/b", tenant: "acme"},
+	} {
+		got, ok := parseShardName(name)
+		want.Name = name
+		if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseShardName(%q): got %+v, %v, want %+v", name, got, ok, want)
+		}
+	}
+	for _, name := range []string{"a_v16.00000.zoekt.meta", "other/a_v16.00000.zoekt", "notes.txt"} {
+		if _, ok := parseShardName(name); ok {
+			t.Errorf("parseShardName(%q) succeeded", name)
+		}
+	}
+}
+
+func TestRestrictsRepos(t *testing.T) {
+	for q, want := range map[string]bool{
+		"needle":                     false,
+		"repo:a needle":              true,
+		"-repo:a needle":             false,
+		"repo:a or repo:b":           true,
+		"(repo:a needle) or needle2": false,
+		"r:a":                        true,
+	} {
+		pq, err := query.Parse(q)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", q, err)
+		}
+		if got := restrictsRepos(pq); got != want {
+			t.Errorf("restrictsRepos(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+// bucketForTest returns a bucket with a shard for each of repos, its
+// directory and the total size of the shards.
+func bucketForTest(t *testing.T, repos ...string) (objstore.Bucket, string, int64) {
+	bucketDir := t.TempDir()
+	var total int64
+	for _, repo := range repos {
+		b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: repo})
+		if err != nil {
+			t.Fatalf("NewIndexBuilder: %v", err)
+		}
+		if err := b.AddFile("f", []byte("needle")); err != nil {
+			t.Fatalf("AddFile: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(bucketDir, repo+"_v16.00000.zoekt"), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		total += int64(buf.Len())
+	}
+	bucket, err := objstore.Open("file://" + bucketDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket, bucketDir, total
+}
+
+func TestBucketCache(t *testing.T) {
+	bucket, bucketDir, total := bucketForTest(t, "a", "b", "c")
+
+	// Too small for all three shards.
+	dir := t.TempDir()
+	s, err := NewDirectorySearcherWithOptions(dir, Options{
+		Bucket:           bucket,
+		BucketCacheBytes: total - 1,
+	})
+	if err != nil {
+		t.Fatalf("NewDirectorySearcherWithOptions: %v", err)
+	}
+	defer s.Close()
+
+	search := func(q string) []string {
+		t.Helper()
+		pq, err := query.Parse(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.Search(context.Background(), pq, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search(%s): %v", q, err)
+		}
+		if res.Crashes > 0 {
+			t.Errorf("Search(%s): %d crashes", q, res.Crashes)
+		}
+		var repos []string
+		for _, f := range res.Files {
+			repos = append(repos, f.Repository)
+		}
+		sort.Strings(repos)
+		return repos
+	}
+	cached := func() []string {
+		fs, err := zoekt.ListShards(filepath.Join(dir, bucketCacheDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fn := range fs {
+			names = append(names, filepath.Base(fn))
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if got := search("needle"); len(got) != 0 {
+		t.Errorf("search without repo: got %v before fetching", got)
+	}
+	if got := search("repo:a needle"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("got %v, want [a]", got)
+	}
+	if got := search("r:b needle"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got %v, want [b]", got)
+	}
+	if got := search("needle"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("search without repo: got %v, want the cached [a b]", got)
+	}
+
+	// Fetching c evicts a, the least recently used.
+	if got := search("repo:c needle"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("got %v, want [c]", got)
+	}
+	if got, want := cached(), []string{"b_v16.00000.zoekt", "c_v16.00000.zoekt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+	if got := search("needle"); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("search without repo: got %v, want [b c]", got)
+	}
+
+	// Shards deleted from the bucket are evicted.
+	if err := os.Remove(filepath.Join(bucketDir, "b_v16.00000.zoekt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(*shardedSearcher).cache.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if got, want := cached(), []string{"c_v16.00000.zoekt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+}
+
+func TestBucketCacheMaxFetches(t *testing.T) {
+	bucket, _, _ := bucketForTest(t, "a", "b", "c")
+	s, err := NewDirectorySearcherWithOptions(t.TempDir(), Options{
+		Bucket:           bucket,
+		BucketCacheBytes: 1 << 30,
+		BucketMaxFetches: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewDirectorySearcherWithOptions: %v", err)
+	}
+	defer s.Close()
+
+	search := func(q query.Q) []string {
+		t.Helper()
+		res, err := s.Search(context.Background(), q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search(%s): %v", q, err)
+		}
+		if res.Crashes > 0 {
+			t.Errorf("Search(%s): %d crashes", q, res.Crashes)
+		}
+		var repos []string
+		for _, f := range res.Files {
+			repos = append(repos, f.Repository)
+		}
+		sort.Strings(repos)
+		return repos
+	}
+	needle := &query.Substring{Pattern: "needle"}
+
+	// Like the query of a user whose ACL grants a and b.
+	ab := query.NewAnd(query.NewRepoSet("a", "b"), needle)
+	if got := search(ab); len(got) != 0 {
+		t.Errorf("got %v, want nothing fetched", got)
+	}
+	if got := search(query.NewAnd(&query.Repo{Pattern: "a"}, needle)); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("got %v, want [a]", got)
+	}
+	// Only b is missing now.
+	if got := search(ab); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got %v, want [a b]", got)
+	}
+}
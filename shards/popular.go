@@ -0,0 +1,320 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+const (
+	// refreshDelay is how long the shard set must be stable before
+	// popular queries are recomputed. This coalesces the burst of
+	// updates when many shards are (re)loaded.
+	refreshDelay = 10 * time.Second
+
+	// refreshBudget bounds the time spent on one refresh of all
+	// popular queries.
+	refreshBudget = time.Minute
+)
+
+type searchFunc func(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error)
+
+// popularQuery is a query seen by the cache.
+type popularQuery struct {
+	q    query.Q
+	opts zoekt.SearchOptions
+
+	// The tenant of the query, see zoekt.WithTenant.
+	tenant    string
+	hasTenant bool
+
+	// Number of times the query was asked, decayed over time.
+	count int
+
+	// Cached result, and the shard generation it was computed
+	// for. Only set for the most popular queries.
+	result     *zoekt.SearchResult
+	generation int64
+	computed   time.Time
+}
+
+// popularCache keeps the results of the most frequently asked
+// queries. When the shard set changes, their results are recomputed
+// in the background, so these queries never wait on a full search.
+type popularCache struct {
+	search searchFunc
+	size   int
+
+	mu      sync.Mutex
+	queries map[string]*popularQuery
+
+	changed chan struct{}
+	quit    chan struct{}
+}
+
+func newPopularCache(size int, search searchFunc) *popularCache {
+	return &popularCache{
+		search:  search,
+		size:    size,
+		queries: map[string]*popularQuery{},
+		changed: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+}
+
+// cacheKey returns the key of a query. Queries of different tenants
+// are kept apart, as their results differ. The query is encoded with
+// query.Marshal rather than q.String, which abbreviates large sets
+// of repositories, so queries restricted to different repositories,
+// eg. by an ACL, never share a key. Queries that cannot be encoded
+// have the key "" and are not cached.
+func cacheKey(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) string {
+	blob, err := query.Marshal(q)
+	if err != nil {
+		return ""
+	}
+	tenant, ok := zoekt.TenantFromContext(ctx)
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %t %s %s", tenant, ok, blob, opts.String())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached result for the query, if it was computed
+// for the current generation of shards. It also counts the query
+// towards its popularity.
+func (c *popularCache) get(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, generation int64) *zoekt.SearchResult {
+	key := cacheKey(ctx, q, opts)
+	if key == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pq := c.queries[key]
+	if pq == nil {
+		if len(c.queries) >= 10*c.size {
+			c.decay()
+		}
+		pq = &popularQuery{q: q, opts: *opts}
+		pq.tenant, pq.hasTenant = zoekt.TenantFromContext(ctx)
+		c.queries[key] = pq
+	}
+	pq.count++
+
+	if pq.result == nil || pq.generation != generation {
+		return nil
+	}
+
+	res := copyResult(pq.result)
+	res.CachedAt = pq.computed
+	return res
+}
+
+// put stores a result computed outside of the cache, if the query
+// is popular enough.
+func (c *popularCache) put(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, generation int64, res *zoekt.SearchResult) {
+	key := cacheKey(ctx, q, opts)
+	if key == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pq := c.queries[key]
+	if pq == nil || !c.isPopular(pq) {
+		return
+	}
+	pq.result = copyResult(res)
+	pq.generation = generation
+	pq.computed = time.Now()
+}
+
+// decay halves all counts, and forgets queries that were not asked
+// since the last decay. Must be called with c.mu held.
+func (c *popularCache) decay() {
+	for k, pq := range c.queries {
+		pq.count /= 2
+		if pq.count == 0 {
+			delete(c.queries, k)
+		}
+	}
+}
+
+// popular returns the most frequent queries. Must be called with
+// c.mu held.
+func (c *popularCache) popular() []*popularQuery {
+	var all []*popularQuery
+	for _, pq := range c.queries {
+		all = append(all, pq)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].count > all[j].count })
+	if len(all) > c.size {
+		// Drop results that fell out of the top.
+		for _, pq := range all[c.size:] {
+			pq.result = nil
+		}
+		all = all[:c.size]
+	}
+	return all
+}
+
+// isPopular returns true if pq is among the most frequent
+// queries. Must be called with c.mu held.
+func (c *popularCache) isPopular(pq *popularQuery) bool {
+	better := 0
+	for _, o := range c.queries {
+		if o.count > pq.count {
+			better++
+		}
+	}
+	return better < c.size
+}
+
+// invalidate signals that the shard set changed.
+func (c *popularCache) invalidate() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run recomputes the popular queries after the shard set changes.
+func (c *popularCache) run(generation func() int64) {
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-c.changed:
+		}
+
+		// Wait for the shard set to settle.
+		for settled := false; !settled; {
+			select {
+			case <-c.quit:
+				return
+			case <-c.changed:
+			case <-time.After(refreshDelay):
+				settled = true
+			}
+		}
+
+		c.refresh(generation())
+	}
+}
+
+// refresh recomputes the popular queries for the given generation,
+// giving up once refreshBudget is spent.
+func (c *popularCache) refresh(generation int64) {
+	c.mu.Lock()
+	todo := c.popular()
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), refreshBudget)
+	defer cancel()
+	for _, pq := range todo {
+		qctx := ctx
+		if pq.hasTenant {
+			qctx = zoekt.WithTenant(ctx, pq.tenant)
+		}
+		res, err := c.search(qctx, pq.q, &pq.opts)
+		if ctx.Err() != nil {
+			slog.Warn("popular queries: refresh budget exhausted")
+			return
+		}
+		if err != nil {
+			slog.Warn("popular queries: refresh failed", "query", pq.q.String(), "error", err)
+			continue
+		}
+
+		c.mu.Lock()
+		pq.result = res
+		pq.generation = generation
+		pq.computed = time.Now()
+		c.mu.Unlock()
+	}
+}
+
+func (c *popularCache) close() {
+	close(c.quit)
+}
+
+// copyResult returns a deep copy of res, so a cached result shares
+// no slices or maps with the results handed to callers, who may
+// modify them.
+func copyResult(res *zoekt.SearchResult) *zoekt.SearchResult {
+	c := *res
+	if res.Files != nil {
+		c.Files = make([]zoekt.FileMatch, len(res.Files))
+		for i := range res.Files {
+			c.Files[i] = copyFileMatch(&res.Files[i])
+		}
+	}
+	c.RepoURLs = copyStringMap(res.RepoURLs)
+	c.LineFragments = copyStringMap(res.LineFragments)
+	if res.RepoStats != nil {
+		c.RepoStats = make(map[string]*zoekt.RepoMatchStats, len(res.RepoStats))
+		for k, v := range res.RepoStats {
+			st := *v
+			c.RepoStats[k] = &st
+		}
+	}
+	c.Suggestions = append([]zoekt.QuerySuggestion(nil), res.Suggestions...)
+	return &c
+}
+
+func copyFileMatch(fm *zoekt.FileMatch) zoekt.FileMatch {
+	c := *fm
+	c.Branches = append([]string(nil), fm.Branches...)
+	c.Content = append([]byte(nil), fm.Content...)
+	c.Checksum = append([]byte(nil), fm.Checksum...)
+	if fm.LineMatches != nil {
+		c.LineMatches = make([]zoekt.LineMatch, len(fm.LineMatches))
+		for i, lm := range fm.LineMatches {
+			lm.Line = append([]byte(nil), lm.Line...)
+			lm.LineFragments = append([]zoekt.LineFragmentMatch(nil), lm.LineFragments...)
+			c.LineMatches[i] = lm
+		}
+	}
+	if fm.ChunkMatches != nil {
+		c.ChunkMatches = make([]zoekt.ChunkMatch, len(fm.ChunkMatches))
+		for i, cm := range fm.ChunkMatches {
+			cm.Content = append([]byte(nil), cm.Content...)
+			cm.Ranges = append([]zoekt.Range(nil), cm.Ranges...)
+			c.ChunkMatches[i] = cm
+		}
+	}
+	return c
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
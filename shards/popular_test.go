@@ -0,0 +1,143 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+func TestPopularCache(t *testing.T) {
+	calls := 0
+	search := func(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+		calls++
+		return &zoekt.SearchResult{Stats: zoekt.Stats{MatchCount: calls}}, nil
+	}
+	c := newPopularCache(1, search)
+	ctx := context.Background()
+	opts := &zoekt.SearchOptions{}
+	popular := &query.Substring{Pattern: "popular"}
+	rare := &query.Substring{Pattern: "rare"}
+
+	for i := 0; i < 3; i++ {
+		if res := c.get(ctx, popular, opts, 1); res != nil {
+			t.Fatalf("got cached result %v before put", res)
+		}
+	}
+	c.get(ctx, rare, opts, 1)
+
+	res, _ := search(ctx, popular, opts)
+	c.put(ctx, popular, opts, 1, res)
+	c.put(ctx, rare, opts, 1, res)
+
+	if res := c.get(ctx, rare, opts, 1); res != nil {
+		t.Errorf("rare query was cached")
+	}
+	if res := c.get(ctx, popular, opts, 1); res == nil || res.CachedAt.IsZero() {
+		t.Fatalf("got %v, want cached result", res)
+	}
+
+	// The shards changed; the cached result is stale until
+	// refreshed.
+	if res := c.get(ctx, popular, opts, 2); res != nil {
+		t.Errorf("got stale result %v", res)
+	}
+	c.refresh(2)
+	if res := c.get(ctx, popular, opts, 2); res == nil || res.MatchCount != 2 {
+		t.Errorf("got %v, want refreshed result", res)
+	}
+	if calls != 2 {
+		t.Errorf("got %d searches, want 2", calls)
+	}
+
+	// Other tenants do not see the cached result.
+	if res := c.get(zoekt.WithTenant(ctx, "acme"), popular, opts, 2); res != nil {
+		t.Errorf("got result %v cached for another tenant", res)
+	}
+}
+
+func TestPopularCacheRepoSets(t *testing.T) {
+	search := func(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+		return &zoekt.SearchResult{}, nil
+	}
+	c := newPopularCache(1, search)
+	ctx := context.Background()
+	opts := &zoekt.SearchOptions{}
+
+	// Sets of more than 5 repositories print only their size, so
+	// these queries have the same String.
+	restrict := func(repos ...string) query.Q {
+		return query.NewAnd(query.NewRepoSet(repos...), &query.Substring{Pattern: "needle"})
+	}
+	a := restrict("repo0", "repo1", "repo2", "repo3", "repo4", "repo5")
+	b := restrict("repo6", "repo7", "repo8", "repo9", "repo10", "repo11")
+	if a.String() != b.String() {
+		t.Fatalf("got distinct strings %s and %s", a, b)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.get(ctx, a, opts, 1)
+	}
+	c.put(ctx, a, opts, 1, &zoekt.SearchResult{Files: []zoekt.FileMatch{{Repository: "repo0"}}})
+	if res := c.get(ctx, a, opts, 1); res == nil {
+		t.Fatalf("popular query was not cached")
+	}
+	if res := c.get(ctx, b, opts, 1); res != nil {
+		t.Errorf("got result %v cached for another set of repositories", res)
+	}
+}
+
+func TestPopularCacheCopies(t *testing.T) {
+	newResult := func() *zoekt.SearchResult {
+		return &zoekt.SearchResult{
+			Files: []zoekt.FileMatch{{
+				FileName:     "f",
+				Content:      []byte("content"),
+				LineMatches:  []zoekt.LineMatch{{Line: []byte("line")}},
+				ChunkMatches: []zoekt.ChunkMatch{{Content: []byte("chunk")}},
+			}},
+			RepoURLs:      map[string]string{"r": "url"},
+			LineFragments: map[string]string{"r": "fragment"},
+		}
+	}
+	c := newPopularCache(1, nil)
+	ctx := context.Background()
+	opts := &zoekt.SearchOptions{}
+	q := &query.Substring{Pattern: "q"}
+	c.get(ctx, q, opts, 1)
+
+	res := newResult()
+	c.put(ctx, q, opts, 1, res)
+	scribble := func(res *zoekt.SearchResult) {
+		fm := &res.Files[0]
+		fm.Content[0] = 'X'
+		fm.LineMatches[0].Line[0] = 'X'
+		fm.ChunkMatches[0].Content[0] = 'X'
+		res.RepoURLs["r"] = "X"
+		res.LineFragments["r"] = "X"
+	}
+	scribble(res)
+	scribble(c.get(ctx, q, opts, 1))
+
+	got := c.get(ctx, q, opts, 1)
+	got.CachedAt = res.CachedAt
+	if want := newResult(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/google/zoekt"
+)
+
+var (
+	metricResultCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_result_cache_hits_total",
+		Help: "Searches answered from the result cache.",
+	})
+	metricResultCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_result_cache_misses_total",
+		Help: "Searches not found in the result cache, or whose shards changed since.",
+	})
+)
+
+// cachedResult is an entry of the resultCache.
+type cachedResult struct {
+	key         string
+	fingerprint string
+	result      *zoekt.SearchResult
+	computed    time.Time
+}
+
+// resultCache keeps the results of the most recently asked queries,
+// so identical queries repeated by dashboards and bots are cheap. A
+// result is only used while the query would search the same shards
+// as when it was computed, see shardFingerprint.
+type resultCache struct {
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List // of *cachedResult, most recently used first
+	entries map[string]*list.Element
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		size:    size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// shardFingerprint identifies the shards searched by a query,
+// including the version of each that is loaded.
+func shardFingerprint(shards []rankedShard) string {
+	ids := make([]int64, 0, len(shards))
+	for _, s := range shards {
+		ids = append(ids, s.loadID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	h := sha256.New()
+	var buf [8]byte
+	for _, id := range ids {
+		binary.LittleEndian.PutUint64(buf[:], uint64(id))
+		h.Write(buf[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached result for key, if it was computed on the
+// shards identified by fingerprint.
+func (c *resultCache) get(key, fingerprint string) *zoekt.SearchResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		metricResultCacheMisses.Inc()
+		return nil
+	}
+	cr := e.Value.(*cachedResult)
+	if cr.fingerprint != fingerprint {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		metricResultCacheMisses.Inc()
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	metricResultCacheHits.Inc()
+
+	res := copyResult(cr.result)
+	res.CachedAt = cr.computed
+	return res
+}
+
+// put stores a copy of a result, evicting the least recently used
+// ones beyond the size of the cache.
+func (c *resultCache) put(key, fingerprint string, res *zoekt.SearchResult) {
+	stored := copyResult(res)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cr := &cachedResult{
+		key:         key,
+		fingerprint: fingerprint,
+		result:      stored,
+		computed:    time.Now(),
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value = cr
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(cr)
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cachedResult).key)
+	}
+}
+
+// cacheable returns whether a result is complete enough to be
+// reused: no shard crashed or was skipped, and the search did not
+// run out of time.
+func cacheable(res *zoekt.SearchResult) bool {
+	return res.Crashes == 0 && res.ShardsSkipped == 0 && res.Truncated != zoekt.TruncatedDeadline
+}
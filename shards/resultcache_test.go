@@ -0,0 +1,141 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+func TestResultCache(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.results = newResultCache(2)
+	for i, repo := range []string{"a", "b"} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: zoekt.Repository{Name: repo}})
+	}
+
+	search := func(in string) *zoekt.SearchResult {
+		t.Helper()
+		q, err := query.Parse(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search(%s): %v", in, err)
+		}
+		return res
+	}
+
+	if res := search("bla"); !res.CachedAt.IsZero() {
+		t.Errorf("first search was cached")
+	} else {
+		// Callers may modify their results.
+		res.Files[0].Repository = "modified"
+	}
+	res := search("bla")
+	if res.CachedAt.IsZero() {
+		t.Fatalf("repeated search was not cached")
+	}
+	if len(res.Files) != 2 || res.Files[0].Repository == "modified" {
+		t.Errorf("got files %v", res.Files)
+	}
+	if res := search("bla repo:a"); !res.CachedAt.IsZero() {
+		t.Errorf("different query was cached")
+	}
+
+	// Reloading b invalidates the searches that include it only.
+	ss.replace("shard1", &repoSearcher{repo: zoekt.Repository{Name: "b"}})
+	if res := search("bla repo:a"); res.CachedAt.IsZero() {
+		t.Errorf("search of unchanged shards was not cached")
+	}
+	if res := search("bla"); !res.CachedAt.IsZero() {
+		t.Errorf("search of reloaded shard was cached")
+	}
+
+	// Adding a shard invalidates the searches it is part of.
+	ss.replace("shard2", &repoSearcher{repo: zoekt.Repository{Name: "c"}})
+	if res := search("bla"); !res.CachedAt.IsZero() || len(res.Files) != 3 {
+		t.Errorf("got cached %v, files %v, want 3 new files", res.CachedAt, res.Files)
+	}
+}
+
+func TestResultCacheRepoBranches(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.results = newResultCache(2)
+	branches := func(branch string) query.Q {
+		set := map[string][]string{}
+		for i := 0; i < 6; i++ {
+			repo := fmt.Sprintf("repo%d", i)
+			ss.replace(repo, &repoSearcher{repo: zoekt.Repository{Name: repo}})
+			set[repo] = []string{branch}
+		}
+		return query.NewAnd(&query.RepoBranches{Set: set}, &query.Substring{Pattern: "needle"})
+	}
+	main, release := branches("main"), branches("release")
+	// Both queries search the same shards, and large sets print
+	// only their size.
+	if main.String() != release.String() {
+		t.Fatalf("got distinct strings %s and %s", main, release)
+	}
+
+	search := func(q query.Q) *zoekt.SearchResult {
+		t.Helper()
+		res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search(%s): %v", q, err)
+		}
+		return res
+	}
+	search(main)
+	if res := search(release); !res.CachedAt.IsZero() {
+		t.Errorf("search of other branches got the cached result of main")
+	}
+	if res := search(release); res.CachedAt.IsZero() {
+		t.Errorf("repeated search was not cached")
+	}
+}
+
+func TestResultCacheCopies(t *testing.T) {
+	newResult := func() *zoekt.SearchResult {
+		return &zoekt.SearchResult{
+			Files: []zoekt.FileMatch{{
+				FileName:    "f",
+				LineMatches: []zoekt.LineMatch{{Line: []byte("line")}},
+			}},
+			RepoURLs: map[string]string{"r": "url"},
+		}
+	}
+	c := newResultCache(1)
+	res := newResult()
+	c.put("key", "fp", res)
+	scribble := func(res *zoekt.SearchResult) {
+		res.Files[0].LineMatches[0].Line[0] = 'X'
+		res.RepoURLs["r"] = "X"
+	}
+	scribble(res)
+	scribble(c.get("key", "fp"))
+
+	got := c.get("key", "fp")
+	got.CachedAt = res.CachedAt
+	if want := newResult(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
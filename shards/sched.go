@@ -0,0 +1,108 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// scheduler separates interactive queries from batch queries. Every
+// query starts out as interactive. Once it has spent more than
+// interactiveQuota searching shards, it is demoted to a batch query
+// and must hold one of the few batch slots before it may search
+// further shards. This way, expensive queries (eg. a regex over all
+// repositories) queue up behind each other instead of starving the
+// interactive queries.
+type scheduler struct {
+	batch            *semaphore.Weighted
+	interactiveQuota time.Duration
+}
+
+func newScheduler(batchSlots int64, interactiveQuota time.Duration) *scheduler {
+	if batchSlots < 1 {
+		batchSlots = 1
+	}
+	return &scheduler{
+		batch:            semaphore.NewWeighted(batchSlots),
+		interactiveQuota: interactiveQuota,
+	}
+}
+
+// process tracks the shard search time of a single query.
+type process struct {
+	sched *scheduler
+
+	mu sync.Mutex
+	// total time spent searching shards, summed over all workers.
+	spent time.Duration
+	// set once the query holds a batch slot.
+	batch bool
+	// set once the query has finished; no more slots are handed out.
+	done bool
+	// time spent waiting for a batch slot.
+	wait time.Duration
+}
+
+func (s *scheduler) newProcess() *process {
+	return &process{sched: s}
+}
+
+// yield must be called before searching a shard. If the query has
+// exceeded its interactive quota, it blocks until a batch slot is
+// available.
+func (p *process) yield(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return context.Canceled
+	}
+	if p.batch || p.spent <= p.sched.interactiveQuota {
+		return nil
+	}
+
+	start := time.Now()
+	if err := p.sched.batch.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	p.wait += time.Since(start)
+	p.batch = true
+	return nil
+}
+
+// account records time spent searching a shard.
+func (p *process) account(d time.Duration) {
+	p.mu.Lock()
+	p.spent += d
+	p.mu.Unlock()
+}
+
+// release gives back the batch slot, if any. It returns the time the
+// process spent waiting for the slot, and whether it was demoted to
+// batch. It is safe to call release more than once.
+func (p *process) release() (wait time.Duration, batch bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	batch = p.batch
+	if p.batch {
+		p.sched.batch.Release(1)
+		p.batch = false
+	}
+	return p.wait, batch
+}
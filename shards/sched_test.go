@@ -0,0 +1,73 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerInteractive(t *testing.T) {
+	s := newScheduler(1, time.Hour)
+	p1 := s.newProcess()
+	p2 := s.newProcess()
+	p1.account(time.Minute)
+
+	// Both fit in the interactive quota, so neither takes the
+	// single batch slot.
+	for _, p := range []*process{p1, p2} {
+		if err := p.yield(context.Background()); err != nil {
+			t.Fatalf("yield: %v", err)
+		}
+	}
+	for _, p := range []*process{p1, p2} {
+		if _, batch := p.release(); batch {
+			t.Errorf("got batch process, want interactive")
+		}
+	}
+}
+
+func TestSchedulerBatch(t *testing.T) {
+	s := newScheduler(1, time.Millisecond)
+	p1 := s.newProcess()
+	p1.account(time.Second)
+	if err := p1.yield(context.Background()); err != nil {
+		t.Fatalf("yield: %v", err)
+	}
+
+	// The only batch slot is taken, so p2 must queue.
+	p2 := s.newProcess()
+	p2.account(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p2.yield(ctx); err == nil {
+		t.Fatalf("yield succeeded, want timeout waiting for batch slot")
+	}
+
+	if _, batch := p1.release(); !batch {
+		t.Errorf("got interactive process, want batch")
+	}
+	if err := p1.yield(context.Background()); err == nil {
+		t.Errorf("yield after release succeeded")
+	}
+
+	if err := p2.yield(context.Background()); err != nil {
+		t.Fatalf("yield: %v", err)
+	}
+	if wait, batch := p2.release(); !batch || wait <= 0 {
+		t.Errorf("got batch %v wait %v, want queued batch process", batch, wait)
+	}
+}
@@ -17,26 +17,147 @@ package shards
 import (
 	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"sort"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/trace"
 	"golang.org/x/sync/semaphore"
 
 	"github.com/google/zoekt"
+	"github.com/google/zoekt/logging"
+	"github.com/google/zoekt/objstore"
 	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/tracing"
 )
 
+var tracer = otel.Tracer("github.com/google/zoekt/shards")
+
+var (
+	metricShardsLoaded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zoekt_shards_loaded",
+		Help: "The number of shards currently loaded.",
+	})
+	metricShardLoads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_shard_loads_total",
+		Help: "The number of shards loaded.",
+	})
+	metricShardLoadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_shard_load_failures_total",
+		Help: "The number of shards that failed to load.",
+	})
+	metricShardUnloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_shard_unloads_total",
+		Help: "The number of shards dropped.",
+	})
+	metricMmapBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zoekt_shard_mmap_bytes",
+		Help: "The size of all loaded shard files.",
+	})
+	metricSearchRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zoekt_search_running",
+		Help: "The number of searches in flight, including queued ones.",
+	})
+	metricSearchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "zoekt_search_duration_seconds",
+		Help:    "The wall clock time of searches, including queueing.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 9), // 1ms -> 65s
+	})
+	metricSearchShardsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_search_shards_skipped_total",
+		Help: "The number of shards not searched because a search was canceled or hit its limits.",
+	})
+	metricSearchFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "zoekt_search_failed_total",
+		Help: "The number of searches that failed, by error code.",
+	}, []string{"code"})
+	metricSearchFileCount = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "zoekt_search_file_count",
+		Help:    "The number of files with matches per search, before truncation.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9), // 1 -> 65536
+	})
+	metricSearchMatchCount = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "zoekt_search_match_count",
+		Help:    "The number of matches per search, before truncation.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9), // 1 -> 65536
+	})
+	metricSlowSearches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_search_slow_total",
+		Help: "The number of slow searches logged.",
+	})
+	metricIndexBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zoekt_shard_index_bytes",
+		Help: "The RAM used by the index data of all loaded shards, excluding mmap'ed file content.",
+	})
+	metricIndexOldest = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zoekt_index_oldest_timestamp_seconds",
+		Help: "The time the least recently indexed loaded shard was built, in seconds since the epoch.",
+	})
+	metricIndexNewest = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zoekt_index_newest_timestamp_seconds",
+		Help: "The time the most recently indexed loaded shard was built, in seconds since the epoch.",
+	})
+)
+
+// scoreRepoPriorityFactor is the score added to matches in the repo
+// with the highest priority. Other repos get a bonus scaled by the
+// logarithm of their priority.
+const scoreRepoPriorityFactor = 100.0
+
 type rankedShard struct {
 	zoekt.Searcher
 	rank uint16
+
+	// Repository name, tenant and priority, see
+	// zoekt.Repository.Priority.
+	repo     string
+	tenant   string
+	priority float64
+
+	// Repository metadata, used to skip shards that cannot match.
+	// Nil if unknown.
+	repoMeta *zoekt.Repository
+
+	// When the shard was indexed, and whether it holds an earlier
+	// version of its repository, kept for query.RepoCommit.
+	indexTime time.Time
+	kept      bool
+
+	// Size of the backing file, which is mmap'ed in full.
+	mmapBytes int64
+
+	// RAM used by the index data, outside the mmap'ed file.
+	indexBytes int64
+
+	// loadID identifies this load of the shard; it changes
+	// whenever the shard is reloaded.
+	loadID int64
 }
 
 type shardedSearcher struct {
+	// Searches waiting for the throttle, and the maximum number
+	// allowed to wait. Zero maxQueued means no limit. Accessed
+	// atomically, so keep it first for 64-bit alignment.
+	queued    int64
+	maxQueued int64
+
+	// Incremented whenever the shard set changes. Accessed
+	// atomically.
+	generation int64
+
 	// Limit the number of parallel queries. Since searching is
 	// CPU bound, we can't do better than #CPU queries in
 	// parallel.  If we do so, we just create more memory
@@ -44,30 +165,200 @@ type shardedSearcher struct {
 	throttle *semaphore.Weighted
 	capacity int64
 
+	// Separates long running (batch) queries from interactive ones.
+	sched *scheduler
+
+	// If set, caches the results of popular queries.
+	popular *popularCache
+
+	// If set, caches the results of recent queries.
+	results *resultCache
+
+	// If set, the watcher that loads shards; stopped on Close.
+	watcher io.Closer
+
+	// If set, stops syncing with object storage.
+	stopDownload context.CancelFunc
+
+	// If set, fetches the shards that searches need from object
+	// storage.
+	cache *bucketCache
+
+	// If set, logs slow searches.
+	slow *SlowQueries
+
+	// If set, requests must have a tenant, and only see its
+	// repositories.
+	multiTenant bool
+
+	// The index directory the shards are loaded from, if any.
+	// List returns shard files relative to it.
+	dir string
+
 	shards map[string]rankedShard
 }
 
+// interactiveQuota is the amount of shard search time a query may use
+// before it is treated as a batch query.
+const interactiveQuota = 5 * time.Second
+
 func newShardedSearcher(n int64) *shardedSearcher {
 	ss := &shardedSearcher{
 		shards:   make(map[string]rankedShard),
 		throttle: semaphore.NewWeighted(n),
 		capacity: n,
+		// A quarter of the CPUs are available to batch queries.
+		sched: newScheduler(n/4, interactiveQuota),
 	}
 	return ss
 }
 
+// Options configures the searcher returned by
+// NewDirectorySearcherWithOptions.
+type Options struct {
+	// MaxConcurrentSearches is the number of searches that may run
+	// in parallel. Defaults to the number of CPUs.
+	MaxConcurrentSearches int
+
+	// MaxQueuedSearches is the number of searches that may wait for
+	// one of the concurrent slots. Searches beyond that fail with
+	// *OverloadedError. Zero means no limit.
+	MaxQueuedSearches int
+
+	// CachePopularQueries is the number of most frequent queries
+	// whose results are kept in memory, and recomputed in the
+	// background when shards change. Zero disables the cache.
+	CachePopularQueries int
+
+	// CacheResults is the number of results of recent queries kept
+	// in memory, so identical queries are answered without
+	// searching. A result is reused while the shards it was
+	// computed on stay loaded and unchanged. Zero disables the
+	// cache.
+	CacheResults int
+
+	// SlowQueries, if set, logs searches that take long, with the
+	// shards that took longest.
+	SlowQueries *SlowQueries
+
+	// MultiTenant requires every request to carry a tenant, see
+	// zoekt.WithTenant, and restricts it to the repositories of
+	// that tenant. Requests without a tenant fail with
+	// zoekt.CodePermissionDenied.
+	MultiTenant bool
+
+	// Bucket, if set, is object storage holding the shards, see
+	// package objstore. The directory is kept in sync with it in
+	// the background: shards are loaded as they are downloaded,
+	// so a new node starts searching before it has all of them.
+	Bucket objstore.Bucket
+
+	// BucketSyncInterval is the time between syncs with Bucket.
+	// Defaults to a minute.
+	BucketSyncInterval time.Duration
+
+	// BucketCacheBytes, if positive, serves a corpus larger than
+	// the local disk from Bucket. Instead of downloading all
+	// shards, searches with repo: atoms fetch the shards of the
+	// repositories they name, and the least recently used shards
+	// are evicted to keep at most this many bytes in a cache
+	// directory inside dir. Other searches only see the cached
+	// shards.
+	BucketCacheBytes int64
+
+	// BucketMaxFetches caps the shards a search fetches with
+	// BucketCacheBytes. A search that needs more, eg. because an
+	// ACL restricts it to many repositories, only sees the cached
+	// shards instead of flushing the cache. Defaults to 100; a
+	// negative value means no cap.
+	BucketMaxFetches int
+}
+
+// OverloadedError is returned by Search if the maximum number of
+// searches is running and the queue is full. The search may be
+// retried later.
+type OverloadedError struct {
+	Running int
+	Queued  int
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("too many searches: %d running, %d queued", e.Running, e.Queued)
+}
+
+// Temporary returns true, since the search may succeed later.
+func (e *OverloadedError) Temporary() bool {
+	return true
+}
+
+// ErrorCode returns zoekt.CodeOverloaded.
+func (e *OverloadedError) ErrorCode() zoekt.ErrorCode {
+	return zoekt.CodeOverloaded
+}
+
 // NewDirectorySearcher returns a searcher instance that loads all
 // shards corresponding to a glob into memory.
 func NewDirectorySearcher(dir string) (zoekt.Searcher, error) {
-	ss := newShardedSearcher(int64(runtime.NumCPU()))
+	return NewDirectorySearcherWithOptions(dir, Options{})
+}
+
+// NewDirectorySearcherWithOptions is like NewDirectorySearcher, but
+// allows limiting the search load.
+func NewDirectorySearcherWithOptions(dir string, opts Options) (zoekt.Searcher, error) {
+	n := int64(opts.MaxConcurrentSearches)
+	if n <= 0 {
+		n = int64(runtime.NumCPU())
+	}
+	ss := newShardedSearcher(n)
+	ss.dir = dir
+	ss.maxQueued = int64(opts.MaxQueuedSearches)
+	ss.slow = opts.SlowQueries
+	ss.multiTenant = opts.MultiTenant
+	if opts.CachePopularQueries > 0 {
+		ss.popular = newPopularCache(opts.CachePopularQueries, func(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+			return ss.search(ctx, q, opts, nil)
+		})
+		go ss.popular.run(func() int64 { return atomic.LoadInt64(&ss.generation) })
+	}
+	if opts.CacheResults > 0 {
+		ss.results = newResultCache(opts.CacheResults)
+	}
 	tl := &throttledLoader{
 		ss:       ss,
 		throttle: make(chan struct{}, runtime.NumCPU()),
 	}
-	_, err := NewDirectoryWatcher(dir, tl)
+	dw, err := NewDirectoryWatcher(dir, tl)
 	if err != nil {
 		return nil, err
 	}
+	ss.watcher = dw
+
+	if opts.Bucket != nil {
+		interval := opts.BucketSyncInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		var ctx context.Context
+		ctx, ss.stopDownload = context.WithCancel(context.Background())
+		if opts.BucketCacheBytes > 0 {
+			ss.cache = newBucketCache(opts.Bucket, filepath.Join(dir, bucketCacheDir), opts.BucketCacheBytes, tl)
+			ss.cache.maxFetches = opts.BucketMaxFetches
+			if ss.cache.maxFetches == 0 {
+				ss.cache.maxFetches = 100
+			}
+			if err := ss.cache.restore(); err != nil {
+				ss.Close()
+				return nil, err
+			}
+			if err := ss.cache.refresh(ctx); err != nil {
+				slog.Error("listing shards in bucket failed", "bucket", opts.Bucket.String(), "error", err)
+			}
+			go ss.cache.run(ctx, interval)
+		} else {
+			d := &objstore.Downloader{Bucket: opts.Bucket, Dir: dir}
+			go d.Run(ctx, interval)
+		}
+	}
 
 	return ss, nil
 }
@@ -83,14 +374,22 @@ func (tl *throttledLoader) load(key string) {
 	shard, err := loadShard(key)
 	<-tl.throttle
 	if err != nil {
-		log.Printf("reloading: %s, err %v ", key, err)
+		metricShardLoadFailures.Inc()
+		slog.Error("loading shard failed", "shard", key, "error", err)
 		return
 	}
+	metricShardLoads.Inc()
 
+	if repo, _, _ := shardRepo(shard); repo.Tombstone {
+		slog.Info("not searching tombstoned shard", "shard", key, "repo", repo.Name)
+		shard.Close()
+		shard = nil
+	}
 	tl.ss.replace(key, shard)
 }
 
 func (tl *throttledLoader) drop(key string) {
+	metricShardUnloads.Inc()
 	tl.ss.replace(key, nil)
 }
 
@@ -100,49 +399,162 @@ func (ss *shardedSearcher) String() string {
 
 // Close closes references to open files. It may be called only once.
 func (ss *shardedSearcher) Close() {
+	if ss.stopDownload != nil {
+		ss.stopDownload()
+	}
+	if ss.watcher != nil {
+		ss.watcher.Close()
+	}
+	if ss.popular != nil {
+		ss.popular.close()
+	}
 	ss.lock(context.Background())
 	defer ss.unlock()
 	for _, s := range ss.shards {
 		s.Close()
 	}
+	// A scan that was in progress may still drop shards; make
+	// sure they are not closed twice.
+	ss.shards = map[string]rankedShard{}
+}
+
+func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	if ss.popular == nil {
+		return ss.searchSuggest(ctx, q, opts)
+	}
+	if err := ss.checkTenant(ctx); err != nil {
+		return nil, err
+	}
+
+	generation := atomic.LoadInt64(&ss.generation)
+	if res := ss.popular.get(ctx, q, opts, generation); res != nil {
+		return res, nil
+	}
+	res, err := ss.searchSuggest(ctx, q, opts)
+	if err == nil && ctx.Err() == nil {
+		ss.popular.put(ctx, q, opts, generation, res)
+	}
+	return res, err
+}
+
+// StreamSearch implements zoekt.Streamer. Files are sent as shards
+// complete, so they are ordered by score within a shard only.
+func (ss *shardedSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, sender zoekt.Sender) error {
+	sr, err := ss.search(ctx, q, opts, sender)
+	if err != nil {
+		return err
+	}
+	sender.Send(&zoekt.SearchResult{
+		Stats:     sr.Stats,
+		RepoStats: sr.RepoStats,
+	})
+	return nil
 }
 
-func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (sr *zoekt.SearchResult, err error) {
+// search runs a search. If sender is set, files are sent to it as
+// shards complete instead of being returned.
+func (ss *shardedSearcher) search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, sender zoekt.Sender) (sr *zoekt.SearchResult, err error) {
 	tr := trace.New("shardedSearcher.Search", "")
+	if id := logging.RequestID(ctx); id != "" {
+		tr.LazyPrintf("request: %s", id)
+	}
 	tr.LazyLog(q, true)
 	tr.LazyPrintf("opts: %+v", opts)
+	ctx, span := tracer.Start(ctx, "shards.Search", oteltrace.WithAttributes(attribute.String("query", q.String())))
 	defer func() {
 		if sr != nil {
 			tr.LazyPrintf("num files: %d", len(sr.Files))
 			tr.LazyPrintf("stats: %+v", sr.Stats)
+			span.SetAttributes(
+				attribute.Int("files", sr.FileCount),
+				attribute.Int("matches", sr.MatchCount),
+				attribute.Int("shards.skipped", sr.ShardsSkipped))
 		}
 		if err != nil {
 			tr.LazyPrintf("error: %v", err)
 			tr.SetError()
 		}
 		tr.Finish()
+		tracing.End(span, err)
 	}()
 
+	var costs []shardCost
+	if ss.slow != nil {
+		begin := time.Now()
+		defer func() {
+			ss.slow.log(ctx, q, opts, time.Since(begin), sr, costs)
+		}()
+	}
+
 	start := time.Now()
+	metricSearchRunning.Inc()
+	defer func() {
+		metricSearchRunning.Dec()
+		metricSearchDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			code := zoekt.ErrorCodeOf(err)
+			metricSearchFailed.WithLabelValues(code.String()).Inc()
+			slog.WarnContext(ctx, "search failed", "query", q.String(), "code", code.String(), "duration", time.Since(start), "error", err)
+		} else if sr != nil {
+			metricSearchShardsSkipped.Add(float64(sr.ShardsSkipped))
+			metricSearchFileCount.Observe(float64(sr.FileCount))
+			metricSearchMatchCount.Observe(float64(sr.MatchCount))
+		}
+	}()
+
+	// Reject bad cursors before doing any work.
+	if _, err := zoekt.AfterCursor(nil, opts.SortBy, opts.Cursor); err != nil {
+		return nil, err
+	}
+	if err := ss.checkTenant(ctx); err != nil {
+		return nil, err
+	}
 
 	aggregate := &zoekt.SearchResult{
 		RepoURLs:      map[string]string{},
 		LineFragments: map[string]string{},
 	}
+	// Streamed results are not kept, nor those of queries
+	// cacheKey cannot encode.
+	var resultKey string
+	if ss.results != nil && sender == nil {
+		resultKey = cacheKey(ctx, q, opts)
+	}
+
+	if ss.cache != nil {
+		release, failed := ss.cache.acquire(ctx, q)
+		defer release()
+		aggregate.Crashes += failed
+	}
 
 	// This critical section is large, but we don't want to deal with
 	// searches on shards that have just been closed.
-	if err := ss.rlock(ctx); err != nil {
+	if err := ss.rlockSearch(ctx); err != nil {
 		return aggregate, err
 	}
 	defer ss.runlock()
 	tr.LazyPrintf("acquired lock")
+	span.AddEvent("acquired lock")
 	aggregate.Wait = time.Now().Sub(start)
 	start = time.Now()
 
 	// TODO - allow for canceling the query.
-	shards := ss.getShards()
-	all := make(chan shardResult, len(shards))
+	shards := ss.tenantShards(ctx, ss.getShards())
+	if err := checkPins(q, shards); err != nil {
+		return nil, err
+	}
+	searched := pruneShards(q, shards)
+	var fingerprint string
+	if resultKey != "" {
+		fingerprint = shardFingerprint(searched)
+		if res := ss.results.get(resultKey, fingerprint); res != nil {
+			tr.LazyPrintf("cached result from %v", res.CachedAt)
+			return res, nil
+		}
+	}
+	tr.LazyPrintf("searching %d of %d shards", len(searched), len(shards))
+	span.SetAttributes(attribute.Int("shards", len(shards)), attribute.Int("shards.searched", len(searched)))
+	all := make(chan shardResult, len(searched))
 
 	var childCtx context.Context
 	var cancel context.CancelFunc
@@ -154,30 +566,86 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 
 	defer cancel()
 
+	// Compile regexps once, rather than once per shard. Apply
+	// smart case first, so the shards find them.
+	if opts.SmartCase {
+		q = query.SmartCase(q)
+	}
+	childCtx, err = zoekt.CompileRegexps(childCtx, q, opts, &aggregate.Stats)
+	if err != nil {
+		return nil, err
+	}
+	childCtx = zoekt.WithSearchBudget(childCtx, opts)
+
+	// Shards do not know the priority scores added to their
+	// files, so the cursor and page size are applied to the
+	// combined results.
+	shardOpts := *opts
+	shardOpts.Cursor = ""
+	shardOpts.MaxDocDisplayCount = 0
+
 	// For each query, throttle the number of parallel
 	// actions. Since searching is mostly CPU bound, we limit the
 	// number of parallel searches. This reduces the peak working
 	// set, which hopefully stops https://cs.bazel.build from crashing
 	// when looking for the string "com".
-	feeder := make(chan zoekt.Searcher, len(shards))
-	for _, s := range shards {
-		feeder <- s
+	feeder := make(chan shardJob, len(searched))
+	for i, s := range searched {
+		feeder <- shardJob{s, shardDeadline(start, opts.MaxWallTime, i, len(searched))}
 	}
 	close(feeder)
+
+	proc := ss.sched.newProcess()
+	defer proc.release()
 	for i := 0; i < runtime.NumCPU(); i++ {
 		go func() {
-			for s := range feeder {
-				searchOneShard(childCtx, s, q, opts, all)
+			for job := range feeder {
+				if err := proc.yield(childCtx); err != nil {
+					// Canceled while waiting for a batch slot.
+					st := zoekt.Stats{ShardsSkipped: 1}
+					if err == context.DeadlineExceeded {
+						st.Truncated = zoekt.TruncatedDeadline
+					}
+					all <- shardResult{sr: &zoekt.SearchResult{Stats: st}}
+					continue
+				}
+				ctx := childCtx
+				var cancel context.CancelFunc = func() {}
+				if !job.deadline.IsZero() {
+					ctx, cancel = context.WithDeadline(childCtx, job.deadline)
+				}
+				start := time.Now()
+				searchOneShard(ctx, job.s, q, &shardOpts, all)
+				proc.account(time.Since(start))
+				cancel()
 			}
 		}()
 	}
 
-	for range shards {
+	stream := &shardStream{
+		sender:   sender,
+		shards:   shards,
+		max:      opts.MaxDocDisplayCount,
+		cursor:   opts.Cursor,
+		order:    opts.SortBy,
+		repoOnly: isTypeRepo(q),
+		dedup:    opts.DedupBranches,
+		debug:    opts.DebugScore || zoekt.DebugScore,
+	}
+	totalLimit := false
+	for range searched {
 		r := <-all
 		if r.err != nil {
 			return nil, r.err
 		}
-		aggregate.Files = append(aggregate.Files, r.sr.Files...)
+		if ss.slow != nil {
+			costs = append(costs, shardCost{r.shard, r.duration, r.sr.MatchCount})
+		}
+		if sender != nil {
+			stream.send(r.sr)
+		} else {
+			aggregate.Files = append(aggregate.Files, r.sr.Files...)
+		}
 		aggregate.Stats.Add(r.sr.Stats)
 
 		if len(r.sr.Files) > 0 {
@@ -188,29 +656,87 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 				aggregate.LineFragments[k] = v
 			}
 		}
+		for k, v := range r.sr.RepoStats {
+			if aggregate.RepoStats == nil {
+				aggregate.RepoStats = map[string]*zoekt.RepoMatchStats{}
+			}
+			st := aggregate.RepoStats[k]
+			if st == nil {
+				st = &zoekt.RepoMatchStats{}
+				aggregate.RepoStats[k] = st
+			}
+			st.Add(v)
+		}
 
 		if cancel != nil && aggregate.Stats.MatchCount > opts.TotalMaxMatchCount {
 			cancel()
 			cancel = nil
+			totalLimit = true
 		}
 	}
+	if totalLimit {
+		// Shards canceled by the limit do not know why.
+		aggregate.Stats.Truncated = zoekt.TruncatedTotalMatchLimit
+	}
 
-	zoekt.SortFilesByScore(aggregate.Files)
-	if max := opts.MaxDocDisplayCount; max > 0 && len(aggregate.Files) > max {
-		aggregate.Files = aggregate.Files[:max]
+	batchWait, batch := proc.release()
+	if batch {
+		tr.LazyPrintf("ran as batch query, waited %v", batchWait)
 	}
-	for i := range aggregate.Files {
-		copySlice(&aggregate.Files[i].Content)
-		copySlice(&aggregate.Files[i].Checksum)
-		for l := range aggregate.Files[i].LineMatches {
-			copySlice(&aggregate.Files[i].LineMatches[l].Line)
-		}
+	aggregate.Wait += batchWait
+
+	addPriorityScores(aggregate.Files, shards, opts.DebugScore || zoekt.DebugScore)
+	zoekt.SortFiles(aggregate.Files, opts.SortBy)
+	if isTypeRepo(q) {
+		aggregate.Files = firstPerRepo(aggregate.Files)
 	}
+	if opts.DedupBranches {
+		aggregate.Files = zoekt.DedupBranches(aggregate.Files)
+	}
+	aggregate.Files, aggregate.NextCursor, err = zoekt.Page(aggregate.Files, opts.SortBy, opts.Cursor, opts.MaxDocDisplayCount)
+	if err != nil {
+		return nil, err
+	}
+	copyFiles(aggregate.Files)
 
 	aggregate.Duration = time.Now().Sub(start)
+	if resultKey != "" && ctx.Err() == nil && cacheable(aggregate) {
+		ss.results.put(resultKey, fingerprint, aggregate)
+	}
 	return aggregate, nil
 }
 
+// firstPerRepo keeps the first file of each repository. A
+// repository may span several shards, each of which returns a match
+// for type:repo queries.
+func firstPerRepo(files []zoekt.FileMatch) []zoekt.FileMatch {
+	seen := map[string]bool{}
+	res := files[:0]
+	for _, f := range files {
+		if seen[f.Repository] {
+			continue
+		}
+		seen[f.Repository] = true
+		res = append(res, f)
+	}
+	return res
+}
+
+// copyFiles copies the data of files that points into shards, so
+// it stays valid once the shards are unloaded.
+func copyFiles(files []zoekt.FileMatch) {
+	for i := range files {
+		copySlice(&files[i].Content)
+		copySlice(&files[i].Checksum)
+		for l := range files[i].LineMatches {
+			copySlice(&files[i].LineMatches[l].Line)
+		}
+		for c := range files[i].ChunkMatches {
+			copySlice(&files[i].ChunkMatches[c].Content)
+		}
+	}
+}
+
 func copySlice(src *[]byte) {
 	dst := make([]byte, len(*src))
 	copy(dst, *src)
@@ -220,21 +746,55 @@ func copySlice(src *[]byte) {
 type shardResult struct {
 	sr  *zoekt.SearchResult
 	err error
+
+	// The shard searched and how long it took, if it was
+	// searched.
+	shard    string
+	duration time.Duration
+}
+
+// shardJob is a shard to search, with the deadline of its search.
+type shardJob struct {
+	s        zoekt.Searcher
+	deadline time.Time
+}
+
+// shardDeadline returns the deadline for the i'th of n shards in rank
+// order, or the zero time if there is no MaxWallTime. Lower ranked
+// shards get less time, down to half of maxWallTime for the last
+// shard, so the higher ranked shards finish first when a search runs
+// out of time.
+func shardDeadline(start time.Time, maxWallTime time.Duration, i, n int) time.Time {
+	if maxWallTime == 0 {
+		return time.Time{}
+	}
+	frac := 1 - float64(i)/float64(2*n)
+	return start.Add(time.Duration(float64(maxWallTime) * frac))
 }
 
 func searchOneShard(ctx context.Context, s zoekt.Searcher, q query.Q, opts *zoekt.SearchOptions, sink chan shardResult) {
+	ctx, span := tracer.Start(ctx, "shard.Search", oteltrace.WithAttributes(attribute.String("shard", s.String())))
+	defer span.End()
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("crashed shard: %s: %s, %s", s.String(), r, debug.Stack())
+			slog.ErrorContext(ctx, "shard crashed", "shard", s.String(), "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			span.SetStatus(codes.Error, "crashed")
 
 			var r zoekt.SearchResult
 			r.Stats.Crashes = 1
-			sink <- shardResult{&r, nil}
+			sink <- shardResult{sr: &r}
 		}
 	}()
 
+	start := time.Now()
 	ms, err := s.Search(ctx, q, opts)
-	sink <- shardResult{ms, err}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if ms != nil {
+		span.SetAttributes(attribute.Int("files", ms.FileCount), attribute.Int("matches", ms.MatchCount))
+	}
+	sink <- shardResult{ms, err, s.String(), time.Since(start)}
 }
 
 func (ss *shardedSearcher) List(ctx context.Context, r query.Q) (rl *zoekt.RepoList, err error) {
@@ -257,13 +817,22 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q) (rl *zoekt.RepoL
 		err error
 	}
 
+	if err := ss.checkTenant(ctx); err != nil {
+		return nil, err
+	}
+	crashes := 0
+	if ss.cache != nil {
+		release, failed := ss.cache.acquire(ctx, r)
+		defer release()
+		crashes += failed
+	}
 	if err := ss.rlock(ctx); err != nil {
 		return nil, err
 	}
 	defer ss.runlock()
 	tr.LazyPrintf("acquired lock")
 
-	shards := ss.getShards()
+	shards := pruneShards(r, ss.tenantShards(ctx, ss.getShards()))
 	shardCount := len(shards)
 	all := make(chan res, shardCount)
 	tr.LazyPrintf("shardCount: %d", len(shards))
@@ -282,7 +851,6 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q) (rl *zoekt.RepoL
 		}(s.Searcher)
 	}
 
-	crashes := 0
 	uniq := map[string]*zoekt.RepoListEntry{}
 
 	for i := 0; i < shardCount; i++ {
@@ -295,15 +863,21 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q) (rl *zoekt.RepoL
 			prev, ok := uniq[r.Repository.Name]
 			if !ok {
 				cp := *r
+				cp.ShardFiles = append([]string(nil), r.ShardFiles...)
 				uniq[r.Repository.Name] = &cp
 			} else {
 				prev.Stats.Add(&r.Stats)
+				prev.ShardFiles = append(prev.ShardFiles, r.ShardFiles...)
 			}
 		}
 	}
 
 	aggregate := make([]*zoekt.RepoListEntry, 0, len(uniq))
 	for _, v := range uniq {
+		for i, fn := range v.ShardFiles {
+			v.ShardFiles[i] = ss.relativeShardFile(fn)
+		}
+		sort.Strings(v.ShardFiles)
 		aggregate = append(aggregate, v)
 	}
 	return &zoekt.RepoList{
@@ -312,10 +886,108 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q) (rl *zoekt.RepoL
 	}, nil
 }
 
+// relativeShardFile returns the name of the shard file fn relative to
+// the index directory, with '/' separators, so listings do not reveal
+// where the index is stored.
+func (ss *shardedSearcher) relativeShardFile(fn string) string {
+	if ss.dir == "" {
+		return fn
+	}
+	rel, err := filepath.Rel(ss.dir, fn)
+	if err != nil {
+		return filepath.Base(fn)
+	}
+	return filepath.ToSlash(rel)
+}
+
 func (s *shardedSearcher) rlock(ctx context.Context) error {
 	return s.throttle.Acquire(ctx, 1)
 }
 
+// rlockSearch is like rlock, but fails with *OverloadedError rather
+// than waiting if the queue of searches is full.
+func (s *shardedSearcher) rlockSearch(ctx context.Context) error {
+	if s.maxQueued <= 0 {
+		return s.rlock(ctx)
+	}
+	if s.throttle.TryAcquire(1) {
+		return nil
+	}
+
+	queued := atomic.AddInt64(&s.queued, 1)
+	defer atomic.AddInt64(&s.queued, -1)
+	if queued > s.maxQueued {
+		return &OverloadedError{
+			Running: int(s.capacity),
+			Queued:  int(queued - 1),
+		}
+	}
+	return s.rlock(ctx)
+}
+
+// checkTenant fails requests without a tenant if ss serves several
+// tenants.
+func (ss *shardedSearcher) checkTenant(ctx context.Context) error {
+	if !ss.multiTenant {
+		return nil
+	}
+	if !zoekt.HasTenant(ctx) {
+		return zoekt.Errorf(zoekt.CodePermissionDenied, "request has no tenant")
+	}
+	return nil
+}
+
+// tenantShards returns the shards the tenant of ctx may see. Shards
+// without repository metadata are never shown to tenants.
+func (ss *shardedSearcher) tenantShards(ctx context.Context, shards []rankedShard) []rankedShard {
+	if !ss.multiTenant {
+		return shards
+	}
+	var res []rankedShard
+	for _, s := range shards {
+		if s.repoMeta != nil && zoekt.TenantMatches(ctx, s.repoMeta) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// bloomShard is implemented by shards with a bloom filter of their
+// ngrams.
+type bloomShard interface {
+	// MayMatch returns false if no file of the shard can match q.
+	MayMatch(q query.Q) bool
+}
+
+// pruneShards returns the shards whose repository can match q. This
+// evaluates repo: atoms, including negated ones such as -repo:, so
+// excluded repositories are never searched. Shards of kept versions
+// are only searched for the query.RepoCommit atoms that select them.
+// Shards whose bloom filter rules out the strings of q are skipped
+// too.
+func pruneShards(q query.Q, shards []rankedShard) []rankedShard {
+	var res []rankedShard
+	for _, s := range shards {
+		if b, ok := s.Searcher.(bloomShard); ok && !b.MayMatch(q) {
+			continue
+		}
+		if s.kept {
+			pins := pinsFor(q, s.repoMeta)
+			if pins == nil {
+				continue
+			}
+			s.Searcher = &pinnedSearcher{Searcher: s.Searcher, pins: pins}
+		}
+		if s.repoMeta != nil {
+			if c, ok := zoekt.SimplifyRepo(q, s.repoMeta).(*query.Const); ok && !c.Value {
+				continue
+			}
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
 // getShards returns the currently loaded shards. The shards must be
 // accessed under a rlock call. The shards are sorted by decreasing
 // rank.
@@ -326,11 +998,44 @@ func (s *shardedSearcher) getShards() []rankedShard {
 	}
 	// TODO: precompute this.
 	sort.Slice(res, func(i, j int) bool {
+		if res[i].priority != res[j].priority {
+			return res[i].priority > res[j].priority
+		}
 		return res[i].rank > res[j].rank
 	})
 	return res
 }
 
+// addPriorityScores adds a bonus for the priority of their repository
+// to the scores of files, so popular repositories surface first.
+func addPriorityScores(files []zoekt.FileMatch, shards []rankedShard, debug bool) {
+	max := 0.0
+	priorities := map[string]float64{}
+	for _, s := range shards {
+		if s.priority > 0 {
+			priorities[s.repo] = s.priority
+		}
+		if s.priority > max {
+			max = s.priority
+		}
+	}
+	if max == 0 {
+		return
+	}
+
+	for i := range files {
+		p := priorities[files[i].Repository]
+		if p == 0 {
+			continue
+		}
+		score := scoreRepoPriorityFactor * math.Log1p(p) / math.Log1p(max)
+		files[i].Score += score
+		if debug {
+			files[i].Debug += fmt.Sprintf("repo-priority:%f, ", score)
+		}
+	}
+}
+
 func (s *shardedSearcher) runlock() {
 	s.throttle.Release(1)
 }
@@ -343,34 +1048,89 @@ func (s *shardedSearcher) unlock() {
 	s.throttle.Release(s.capacity)
 }
 
-func shardRank(s zoekt.Searcher) uint16 {
+// shardRepo returns the repository of a shard, the time it was
+// indexed and the RAM used by its index data.
+func shardRepo(s zoekt.Searcher) (*zoekt.Repository, time.Time, int64) {
 	q := query.Repo{}
 	result, err := s.List(context.Background(), &q)
-	if err != nil {
-		return 0
+	if err != nil || len(result.Repos) == 0 {
+		return &zoekt.Repository{}, time.Time{}, 0
 	}
-	if len(result.Repos) == 0 {
-		return 0
+	r := result.Repos[0]
+	return &r.Repository, r.IndexMetadata.IndexTime, r.Stats.IndexBytes
+}
+
+// updateIndexTimes sets the gauges for the index time of the oldest
+// and newest shard. Must be called with the lock held.
+func (s *shardedSearcher) updateIndexTimes() {
+	var oldest, newest time.Time
+	for _, sh := range s.shards {
+		if sh.indexTime.IsZero() {
+			continue
+		}
+		if oldest.IsZero() || sh.indexTime.Before(oldest) {
+			oldest = sh.indexTime
+		}
+		if sh.indexTime.After(newest) {
+			newest = sh.indexTime
+		}
 	}
-	return result.Repos[0].Repository.Rank
+	if oldest.IsZero() {
+		metricIndexOldest.Set(0)
+		metricIndexNewest.Set(0)
+		return
+	}
+	metricIndexOldest.Set(float64(oldest.Unix()))
+	metricIndexNewest.Set(float64(newest.Unix()))
 }
 
 func (s *shardedSearcher) replace(key string, shard zoekt.Searcher) {
 	s.lock(context.Background())
 	defer s.unlock()
+	generation := atomic.AddInt64(&s.generation, 1)
+	if s.popular != nil {
+		s.popular.invalidate()
+	}
+
 	old := s.shards[key]
 	if old.Searcher != nil {
 		old.Close()
+		metricShardsLoaded.Dec()
+		metricMmapBytes.Sub(float64(old.mmapBytes))
+		metricIndexBytes.Sub(float64(old.indexBytes))
 	}
 
 	if shard == nil {
 		delete(s.shards, key)
 	} else {
-
+		var size int64
+		if fi, err := os.Stat(key); err == nil {
+			size = fi.Size()
+		}
+		repo, indexTime, indexBytes := shardRepo(shard)
 		s.shards[key] = rankedShard{
-			rank:     shardRank(shard),
-			Searcher: shard,
+			rank:       repo.Rank,
+			repo:       repo.Name,
+			tenant:     repo.TenantID,
+			priority:   repo.Priority,
+			repoMeta:   repo,
+			indexTime:  indexTime,
+			Searcher:   shard,
+			mmapBytes:  size,
+			indexBytes: indexBytes,
+			loadID:     generation,
 		}
+		metricShardsLoaded.Inc()
+		metricMmapBytes.Add(float64(size))
+		metricIndexBytes.Add(float64(indexBytes))
+	}
+	s.updateIndexTimes()
+
+	if old.Searcher != nil {
+		s.markKeptVersions(old.tenant, old.repo)
+	}
+	if shard != nil {
+		s.markKeptVersions(s.shards[key].tenant, s.shards[key].repo)
 	}
 }
 
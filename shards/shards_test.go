@@ -17,15 +17,29 @@ package shards
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
 	"github.com/google/zoekt"
+	"github.com/google/zoekt/objstore"
 	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/zoekttest"
 )
 
 type testLoader struct {
@@ -161,21 +175,58 @@ func TestOrderByShard(t *testing.T) {
 	}
 }
 
-type memSeeker struct {
-	data []byte
+type repoSearcher struct {
+	rankSearcher
+	repo zoekt.Repository
+
+	// If set, listed as the shard file of repo.
+	shardFile string
 }
 
-func (s *memSeeker) Name() string {
-	return "memseeker"
+func (s *repoSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	return &zoekt.SearchResult{
+		Files: []zoekt.FileMatch{{Repository: s.repo.Name, FileName: "f", Score: 10}},
+	}, nil
 }
 
-func (s *memSeeker) Close() {}
-func (s *memSeeker) Read(off, sz uint32) ([]byte, error) {
-	return s.data[off : off+sz], nil
+func (s *repoSearcher) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	e := &zoekt.RepoListEntry{Repository: s.repo}
+	if s.shardFile != "" {
+		e.ShardFiles = []string{s.shardFile}
+	}
+	return &zoekt.RepoList{Repos: []*zoekt.RepoListEntry{e}}, nil
 }
 
-func (s *memSeeker) Size() (uint32, error) {
-	return uint32(len(s.data)), nil
+func TestOrderByPriority(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, repo := range []zoekt.Repository{
+		{Name: "none"},
+		{Name: "popular", Priority: 1000},
+		{Name: "less-popular", Priority: 10},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	var got []string
+	for _, s := range ss.getShards() {
+		got = append(got, s.repo)
+	}
+	want := []string{"popular", "less-popular", "none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got shard order %v, want %v", got, want)
+	}
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got = nil
+	for _, f := range res.Files {
+		got = append(got, f.Repository)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got result order %v, want %v", got, want)
+	}
 }
 
 func TestUnloadIndex(t *testing.T) {
@@ -196,7 +247,7 @@ func TestUnloadIndex(t *testing.T) {
 	var buf bytes.Buffer
 	b.Write(&buf)
 	indexBytes := buf.Bytes()
-	indexFile := &memSeeker{indexBytes}
+	indexFile := zoekttest.NewIndexFile("memseeker", indexBytes)
 	searcher, err := zoekt.NewSearcher(indexFile)
 	if err != nil {
 		t.Fatalf("NewSearcher: %v", err)
@@ -233,3 +284,610 @@ func TestUnloadIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestOverloaded(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.maxQueued = 1
+
+	// Occupy the only search slot.
+	if err := ss.rlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := ss.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+		queued <- err
+	}()
+	for atomic.LoadInt64(&ss.queued) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := ss.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+	if _, ok := err.(*OverloadedError); !ok {
+		t.Errorf("got error %v, want *OverloadedError", err)
+	}
+
+	ss.runlock()
+	if err := <-queued; err != nil {
+		t.Errorf("queued search: %v", err)
+	}
+}
+
+func TestTypeRepo(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, repo := range []zoekt.Repository{
+		{Name: "repo1"},
+		{Name: "repo1"},
+		{Name: "repo2"},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	q := &query.Type{Child: &query.Substring{Pattern: "bla"}, Type: query.TypeRepo}
+	res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, f.Repository)
+	}
+	sort.Strings(got)
+	if want := []string{"repo1", "repo2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStreamSearch(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, repo := range []zoekt.Repository{
+		{Name: "repo1"},
+		{Name: "repo1"},
+		{Name: "repo2"},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	for _, tc := range []struct {
+		q     query.Q
+		opts  zoekt.SearchOptions
+		files int
+	}{
+		{&query.Substring{Pattern: "bla"}, zoekt.SearchOptions{}, 3},
+		{&query.Substring{Pattern: "bla"}, zoekt.SearchOptions{MaxDocDisplayCount: 2}, 2},
+		{&query.Type{Child: &query.Substring{Pattern: "bla"}, Type: query.TypeRepo}, zoekt.SearchOptions{}, 2},
+		{&query.Substring{Pattern: "bla"}, zoekt.SearchOptions{DedupBranches: true}, 2},
+	} {
+		var results []*zoekt.SearchResult
+		err := ss.StreamSearch(context.Background(), tc.q, &tc.opts, zoekt.SenderFunc(func(sr *zoekt.SearchResult) {
+			results = append(results, sr)
+		}))
+		if err != nil {
+			t.Fatalf("StreamSearch: %v", err)
+		}
+		if len(results) == 0 {
+			t.Fatalf("%s: no results sent", tc.q)
+		}
+
+		files := 0
+		for _, sr := range results[:len(results)-1] {
+			if len(sr.Files) == 0 {
+				t.Errorf("%s: empty result before the last", tc.q)
+			}
+			files += len(sr.Files)
+		}
+		if files != tc.files {
+			t.Errorf("%s: got %d files, want %d", tc.q, files, tc.files)
+		}
+		if last := results[len(results)-1]; len(last.Files) != 0 {
+			t.Errorf("%s: last result has %d files, want only stats", tc.q, len(last.Files))
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, repo := range []zoekt.Repository{
+		{Name: "b"},
+		{Name: "popular", Priority: 1000},
+		{Name: "a"},
+		{Name: "less-popular", Priority: 10},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	var got []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{
+			MaxDocDisplayCount: 1,
+			Cursor:             cursor,
+		})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		for _, f := range res.Files {
+			got = append(got, f.Repository)
+		}
+		if cursor = res.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if want := []string{"popular", "less-popular", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPaginationWithinShard(t *testing.T) {
+	var docs []zoekt.Document
+	for i := 0; i < 6; i++ {
+		docs = append(docs, zoekt.Document{Name: fmt.Sprintf("f%d", i), Content: []byte("needle")})
+	}
+	ss := newShardedSearcher(1)
+	ss.replace("shard", zoekttest.NewSearcher(t, &zoekt.Repository{Name: "repo"}, docs...))
+
+	seen := map[string]bool{}
+	cursor := ""
+	pages := 0
+	for ; pages < 10; pages++ {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{
+			MaxDocDisplayCount: 2,
+			Cursor:             cursor,
+		})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		for _, f := range res.Files {
+			seen[f.FileName] = true
+		}
+		if cursor = res.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 6 || pages != 2 {
+		t.Errorf("got files %v in %d pages, want 6 files in 3 pages", seen, pages+1)
+	}
+}
+
+func TestDedupBranches(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, repo := range []zoekt.Repository{
+		{Name: "repo1"},
+		{Name: "repo1"},
+		{Name: "repo2"},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	for dedup, want := range map[bool]int{false: 3, true: 2} {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{DedupBranches: dedup})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) != want {
+			t.Errorf("DedupBranches %v: got %d files, want %d", dedup, len(res.Files), want)
+		}
+	}
+}
+
+func TestSortByRepo(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, repo := range []zoekt.Repository{
+		{Name: "b"},
+		{Name: "c", Priority: 1000},
+		{Name: "a"},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	for order, want := range map[zoekt.SortOrder][]string{
+		zoekt.SortByScore: {"c", "a", "b"},
+		zoekt.SortByRepo:  {"a", "b", "c"},
+	} {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{SortBy: order})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.Repository)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", order, got, want)
+		}
+	}
+}
+
+func TestListShardFiles(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.dir = filepath.Join("index", "dir")
+	for i, repo := range []zoekt.Repository{
+		{Name: "repo1"},
+		{Name: "repo1"},
+		{Name: "repo2"},
+	} {
+		fn := filepath.Join(ss.dir, fmt.Sprintf("shard%d", i))
+		if repo.Name == "repo2" {
+			fn = filepath.Join(ss.dir, zoekt.TenantDirPrefix+"x", fmt.Sprintf("shard%d", i))
+		}
+		ss.replace(fn, &repoSearcher{repo: repo, shardFile: fn})
+	}
+
+	rl, err := ss.List(context.Background(), &query.Const{Value: true})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	got := map[string][]string{}
+	for _, r := range rl.Repos {
+		got[r.Repository.Name] = r.ShardFiles
+	}
+	want := map[string][]string{
+		"repo1": {"shard0", "shard1"},
+		"repo2": {"tenant-x/shard2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got shard files %v, want %v", got, want)
+	}
+}
+
+func TestPruneShards(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, repo := range []zoekt.Repository{
+		{Name: "monorepo"},
+		{Name: "small"},
+		{Name: "old", Archived: true},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	for in, want := range map[string][]string{
+		"bla":                           {"monorepo", "old", "small"},
+		"bla -repo:monorepo":            {"old", "small"},
+		"bla -repo:mono archived:no":    {"small"},
+		"bla repo:small or repo:mono":   {"monorepo", "small"},
+		"bla -(repo:small or repo:old)": {"monorepo"},
+	} {
+		q, err := query.Parse(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// repoSearcher matches regardless of the query, so
+		// only pruned shards are missing from the results.
+		res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.Repository)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestSearchSpans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(old)
+
+	ss := newShardedSearcher(1)
+	ss.replace("shard1", &repoSearcher{repo: zoekt.Repository{Name: "repo1"}})
+	ss.replace("shard2", &repoSearcher{repo: zoekt.Repository{Name: "repo2"}})
+	if _, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{}); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+
+	var root string
+	children := 0
+	for _, s := range rec.Ended() {
+		if s.Name() == "shards.Search" {
+			root = s.SpanContext().SpanID().String()
+		}
+	}
+	for _, s := range rec.Ended() {
+		if s.Name() == "shard.Search" && s.Parent().SpanID().String() == root {
+			children++
+		}
+	}
+	if root == "" || children != 2 {
+		t.Errorf("got root span %q with %d shard spans, want 2", root, children)
+	}
+}
+
+func TestSlowQueries(t *testing.T) {
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(old)
+
+	ss := newShardedSearcher(1)
+	ss.replace("shard1", &repoSearcher{repo: zoekt.Repository{Name: "repo1"}})
+	ss.replace("shard2", &repoSearcher{repo: zoekt.Repository{Name: "repo2"}})
+	q := &query.Substring{Pattern: "bla"}
+
+	ss.slow = &SlowQueries{Threshold: time.Hour}
+	if _, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{}); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("fast search logged: %s", buf.String())
+	}
+
+	ss.slow = &SlowQueries{TopShards: 1}
+	if _, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{}); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	var rec struct {
+		Msg       string
+		Query     string
+		Shards    []string
+		QueryJSON json.RawMessage `json:"query_json"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", buf.String(), err)
+	}
+	if rec.Msg != "slow search" || rec.Query != q.String() || len(rec.Shards) != 1 {
+		t.Errorf("got %+v", rec)
+	}
+	if got, err := query.Unmarshal(rec.QueryJSON); err != nil || got.String() != q.String() {
+		t.Errorf("query_json %s: got %v, %v", rec.QueryJSON, got, err)
+	}
+}
+
+func TestSuggestQueries(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "repo"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for name, content := range map[string]string{
+		"main.go":  "func read_file() {}",
+		"other.go": "readFile()",
+	} {
+		if err := b.AddFile(name, []byte(content)); err != nil {
+			t.Fatalf("AddFile: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	searcher, err := zoekt.NewSearcher(zoekttest.NewIndexFile("memseeker", buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewSearcher: %v", err)
+	}
+	ss := newShardedSearcher(1)
+	defer ss.Close()
+	ss.replace("key", searcher)
+
+	q, err := query.Parse("readFile f:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 0 || len(res.Suggestions) != 0 {
+		t.Fatalf("got %d files, %d suggestions, want none", len(res.Files), len(res.Suggestions))
+	}
+
+	res, err = ss.Search(context.Background(), q, &zoekt.SearchOptions{SuggestQueries: true})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	var got []string
+	for _, s := range res.Suggestions {
+		got = append(got, fmt.Sprintf("%s: %s (%d)", s.Reason, s.Query, s.FileCount))
+	}
+	want := []string{
+		`without file filter: case_substr:"readFile" (1)`,
+		`split camelCase: (and substr:"read" substr:"file" file_substr:"main") (1)`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got suggestions %q, want %q", got, want)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "repo"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.AddFile("f", []byte("needle")); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	fn := filepath.Join(t.TempDir(), "repo_v1.00000.zoekt")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := newShardedSearcher(1)
+	defer ss.Close()
+	tl := &throttledLoader{ss: ss, throttle: make(chan struct{}, 1)}
+	tl.load(fn)
+	if len(ss.shards) != 1 {
+		t.Fatalf("got %d shards, want 1", len(ss.shards))
+	}
+
+	if err := zoekt.UpdateShardMeta(fn, func(r *zoekt.Repository) { r.Tombstone = true }); err != nil {
+		t.Fatalf("UpdateShardMeta: %v", err)
+	}
+	tl.load(fn)
+	if len(ss.shards) != 0 {
+		t.Errorf("got %d shards, want tombstoned shard to be unloaded", len(ss.shards))
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "repo"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.AddFile("f", []byte("needle")); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	bucketDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(bucketDir, "repo_v1.00000.zoekt"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := objstore.Open("file://" + bucketDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	ss, err := NewDirectorySearcherWithOptions(dir, Options{
+		Bucket:             bucket,
+		BucketSyncInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDirectorySearcherWithOptions: %v", err)
+	}
+	defer ss.Close()
+
+	q := &query.Substring{Pattern: "needle"}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shard from bucket not loaded")
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "repo_v1.00000.zoekt")); err != nil {
+		t.Errorf("shard not downloaded: %v", err)
+	}
+}
+
+func TestMultiTenant(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.multiTenant = true
+	for i, repo := range []zoekt.Repository{
+		{Name: "acme/repo", TenantID: "acme"},
+		{Name: "globex/repo", TenantID: "globex"},
+		{Name: "shared"},
+	} {
+		ss.replace(fmt.Sprintf("shard%d", i), &repoSearcher{repo: repo})
+	}
+
+	q := &query.Substring{Pattern: "bla"}
+	_, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+	if zoekt.ErrorCodeOf(err) != zoekt.CodePermissionDenied {
+		t.Errorf("Search without tenant: got %v, want PermissionDenied", err)
+	}
+	if _, err := ss.List(context.Background(), q); zoekt.ErrorCodeOf(err) != zoekt.CodePermissionDenied {
+		t.Errorf("List without tenant: got %v, want PermissionDenied", err)
+	}
+
+	res, err := ss.Search(zoekt.WithTenant(context.Background(), "acme"), q, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, f.Repository)
+	}
+	if want := []string{"acme/repo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got repos %v, want %v", got, want)
+	}
+
+	rl, err := ss.List(zoekt.WithAllTenants(context.Background()), q)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(rl.Repos) != 3 {
+		t.Errorf("got %d repos for all tenants, want 3", len(rl.Repos))
+	}
+}
+
+type bloomSearcher struct {
+	repoSearcher
+	mayMatch bool
+}
+
+func (s *bloomSearcher) MayMatch(q query.Q) bool {
+	return s.mayMatch
+}
+
+func TestPruneBloom(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace("yes", &bloomSearcher{repoSearcher{repo: zoekt.Repository{Name: "yes"}}, true})
+	ss.replace("no", &bloomSearcher{repoSearcher{repo: zoekt.Repository{Name: "no"}}, false})
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 || res.Files[0].Repository != "yes" {
+		t.Errorf("got %v, want only the file of repo yes", res.Files)
+	}
+}
+
+// deadlineSearcher records the deadline of its searches.
+type deadlineSearcher struct {
+	repoSearcher
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (s *deadlineSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	s.mu.Lock()
+	s.deadline, _ = ctx.Deadline()
+	s.mu.Unlock()
+	res, _ := s.repoSearcher.Search(ctx, q, opts)
+	res.Stats.MatchCount = 10
+	return res, nil
+}
+
+func TestShardDeadlines(t *testing.T) {
+	ss := newShardedSearcher(1)
+	var searchers []*deadlineSearcher
+	for i, repo := range []zoekt.Repository{
+		{Name: "popular", Priority: 1000},
+		{Name: "less-popular", Priority: 10},
+		{Name: "none"},
+	} {
+		s := &deadlineSearcher{repoSearcher: repoSearcher{repo: repo}}
+		searchers = append(searchers, s)
+		ss.replace(fmt.Sprintf("shard%d", i), s)
+	}
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{
+		MaxWallTime:        time.Hour,
+		TotalMaxMatchCount: 15,
+	})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if res.Stats.Truncated != zoekt.TruncatedTotalMatchLimit {
+		t.Errorf("got Truncated %v, want %v", res.Stats.Truncated, zoekt.TruncatedTotalMatchLimit)
+	}
+
+	for i := 1; i < len(searchers); i++ {
+		prev, cur := searchers[i-1].deadline, searchers[i].deadline
+		if prev.IsZero() || cur.IsZero() || !cur.Before(prev) {
+			t.Errorf("deadline of %s is %v, want before %v of %s",
+				searchers[i].repo.Name, cur, prev, searchers[i-1].repo.Name)
+		}
+	}
+	if d := time.Until(searchers[2].deadline); d < 30*time.Minute || d > 45*time.Minute {
+		t.Errorf("last shard gets %v, want at least half the wall time", d)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// SlowQueries configures the logging of slow searches.
+type SlowQueries struct {
+	// Threshold is how long a search must take to be logged.
+	Threshold time.Duration
+
+	// SampleRate is the fraction of slow searches that are
+	// logged, to bound the volume of the log. Zero means all of
+	// them.
+	SampleRate float64
+
+	// TopShards is the number of most expensive shards logged
+	// with a search. The default is 5.
+	TopShards int
+}
+
+// shardCost is the time a shard took to search.
+type shardCost struct {
+	shard    string
+	duration time.Duration
+	matches  int
+}
+
+// log records the search for q if it took longer than the threshold.
+func (s *SlowQueries) log(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, d time.Duration, sr *zoekt.SearchResult, costs []shardCost) {
+	if d < s.Threshold {
+		return
+	}
+	if s.SampleRate > 0 && rand.Float64() >= s.SampleRate {
+		return
+	}
+	metricSlowSearches.Inc()
+
+	top := s.TopShards
+	if top <= 0 {
+		top = 5
+	}
+	sort.Slice(costs, func(i, j int) bool { return costs[i].duration > costs[j].duration })
+	if len(costs) > top {
+		costs = costs[:top]
+	}
+	var shards []string
+	for _, c := range costs {
+		shards = append(shards, fmt.Sprintf("%s: %v, %d matches", c.shard, c.duration, c.matches))
+	}
+
+	attrs := []interface{}{
+		"query", q.String(),
+		"options", opts.String(),
+		"duration", d,
+		"shards", shards,
+	}
+	// The JSON encodings let zoekt-bench replay the search.
+	if data, err := query.Marshal(q); err == nil {
+		attrs = append(attrs, "query_json", json.RawMessage(data))
+	}
+	if data, err := json.Marshal(opts); err == nil {
+		attrs = append(attrs, "options_json", json.RawMessage(data))
+	}
+	if sr != nil {
+		attrs = append(attrs,
+			"files", sr.FileCount,
+			"matches", sr.MatchCount,
+			"files_considered", sr.FilesConsidered,
+			"files_loaded", sr.FilesLoaded,
+			"content_bytes_loaded", sr.ContentBytesLoaded,
+			"index_bytes_loaded", sr.IndexBytesLoaded,
+			"shards_skipped", sr.ShardsSkipped,
+			"wait", sr.Wait)
+	}
+	slog.WarnContext(ctx, "slow search", attrs...)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// shardStream sends the files found in each shard to a zoekt.Sender.
+type shardStream struct {
+	sender zoekt.Sender
+
+	// All shards, for the priority scores.
+	shards []rankedShard
+
+	// Maximum number of files to send; zero means no limit.
+	max int
+
+	// If set, only files after this cursor are sent.
+	cursor string
+
+	// The order of files within each result sent.
+	order zoekt.SortOrder
+
+	// If set, only the first file of each repository is sent.
+	repoOnly bool
+
+	// If set, files with the zoekt.DedupKey of a file sent before
+	// are dropped.
+	dedup bool
+
+	debug bool
+
+	sent  int
+	repos map[string]bool
+	keys  map[string]bool
+}
+
+func (s *shardStream) send(sr *zoekt.SearchResult) {
+	files := sr.Files
+	addPriorityScores(files, s.shards, s.debug)
+	zoekt.SortFiles(files, s.order)
+	files, _ = zoekt.AfterCursor(files, s.order, s.cursor) // checked by search
+
+	if s.repoOnly {
+		if s.repos == nil {
+			s.repos = map[string]bool{}
+		}
+		var first []zoekt.FileMatch
+		for _, f := range files {
+			if !s.repos[f.Repository] {
+				s.repos[f.Repository] = true
+				first = append(first, f)
+			}
+		}
+		files = first
+	}
+	if s.dedup {
+		if s.keys == nil {
+			s.keys = map[string]bool{}
+		}
+		var unseen []zoekt.FileMatch
+		for _, f := range zoekt.DedupBranches(files) {
+			if k := zoekt.DedupKey(&f); !s.keys[k] {
+				s.keys[k] = true
+				unseen = append(unseen, f)
+			}
+		}
+		files = unseen
+	}
+	if s.max > 0 {
+		if left := s.max - s.sent; len(files) > left {
+			files = files[:left]
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	s.sent += len(files)
+	copyFiles(files)
+	s.sender.Send(&zoekt.SearchResult{
+		Files:         files,
+		RepoURLs:      sr.RepoURLs,
+		LineFragments: sr.LineFragments,
+	})
+}
+
+// isTypeRepo returns whether q asks for repositories rather than
+// files.
+func isTypeRepo(q query.Q) bool {
+	t, ok := q.(*query.Type)
+	return ok && t.Type == query.TypeRepo
+}
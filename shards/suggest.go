@@ -0,0 +1,57 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// suggestMaxMatchCount limits the matches of each relaxed query. The
+// suggestions only need to know that a query finds something.
+const suggestMaxMatchCount = 100
+
+// searchSuggest runs a search. If it finds nothing and
+// opts.SuggestQueries is set, relaxed queries that do find files are
+// added to the result.
+func (ss *shardedSearcher) searchSuggest(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	res, err := ss.search(ctx, q, opts, nil)
+	if err != nil || !opts.SuggestQueries || res.FileCount > 0 {
+		return res, err
+	}
+	for _, r := range query.Relax(q) {
+		if ctx.Err() != nil {
+			break
+		}
+		rOpts := *opts
+		rOpts.SuggestQueries = false
+		rOpts.Cursor = ""
+		rOpts.ShardMaxMatchCount = suggestMaxMatchCount
+		rOpts.TotalMaxMatchCount = suggestMaxMatchCount
+		rOpts.MaxDocDisplayCount = 1
+		rRes, err := ss.search(ctx, r.Q, &rOpts, nil)
+		if err != nil || rRes.FileCount == 0 {
+			continue
+		}
+		res.Suggestions = append(res.Suggestions, zoekt.QuerySuggestion{
+			Reason:    r.Reason,
+			Query:     r.Q,
+			FileCount: rRes.FileCount,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// markKeptVersions marks the shards of repo of the given tenant that
+// hold an earlier version than its most recently indexed shard as
+// kept. Kept shards are only searched for query.RepoCommit atoms.
+// Must be called with the write lock held.
+func (s *shardedSearcher) markKeptVersions(tenant, repo string) {
+	var latest *rankedShard
+	for k := range s.shards {
+		sh := s.shards[k]
+		if sh.repoMeta == nil || sh.repo != repo || sh.tenant != tenant {
+			continue
+		}
+		if latest == nil || sh.indexTime.After(latest.indexTime) {
+			latest = &sh
+		}
+	}
+	if latest == nil {
+		return
+	}
+	current := latest.repoMeta.Branches
+	for k, sh := range s.shards {
+		if sh.repoMeta == nil || sh.repo != repo || sh.tenant != tenant {
+			continue
+		}
+		sh.kept = !reflect.DeepEqual(sh.repoMeta.Branches, current)
+		s.shards[k] = sh
+	}
+}
+
+// pinsFor returns the query.RepoCommit atoms of q that select a
+// version of repo, or nil if there are none.
+func pinsFor(q query.Q, repo *zoekt.Repository) []query.Q {
+	if repo == nil {
+		return nil
+	}
+	var pins []query.Q
+	query.VisitAtoms(q, func(q query.Q) {
+		rc, ok := q.(*query.RepoCommit)
+		if !ok || rc.Repo != repo.Name {
+			return
+		}
+		for _, b := range repo.Branches {
+			if b.Version == rc.Commit {
+				pins = append(pins, rc)
+				return
+			}
+		}
+	})
+	return pins
+}
+
+// checkPins returns an error with code zoekt.CodeCommitNotIndexed if
+// a query.RepoCommit of q asks for a version that none of shards
+// hold.
+func checkPins(q query.Q, shards []rankedShard) error {
+	var err error
+	query.VisitAtoms(q, func(q query.Q) {
+		rc, ok := q.(*query.RepoCommit)
+		if !ok || err != nil {
+			return
+		}
+		for _, s := range shards {
+			if s.repo == rc.Repo && pinsFor(rc, s.repoMeta) != nil {
+				return
+			}
+		}
+		err = zoekt.Errorf(zoekt.CodeCommitNotIndexed, "commit %s of repository %s is not indexed", rc.Commit, rc.Repo)
+	})
+	return err
+}
+
+// pinnedSearcher searches a shard of a kept version. Results are
+// limited to the documents selected by pins, the query.RepoCommit
+// atoms for the shard, so other parts of an "or" query do not match
+// in the kept version.
+type pinnedSearcher struct {
+	zoekt.Searcher
+	pins []query.Q
+}
+
+func (s *pinnedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	return s.Searcher.Search(ctx, query.NewAnd(q, query.NewOr(s.pins...)), opts)
+}
+
+func (s *pinnedSearcher) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	return s.Searcher.List(ctx, query.NewAnd(q, query.NewOr(s.pins...)))
+}
@@ -17,13 +17,15 @@ package shards
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+
+	"github.com/google/zoekt"
 )
 
 type shardLoader interface {
@@ -71,7 +73,7 @@ func (s *shardWatcher) String() string {
 }
 
 func (s *shardWatcher) scan() error {
-	fs, err := filepath.Glob(filepath.Join(s.dir, "*.zoekt"))
+	fs, err := zoekt.ListShards(s.dir)
 	if err != nil {
 		return err
 	}
@@ -83,7 +85,13 @@ func (s *shardWatcher) scan() error {
 			continue
 		}
 
-		ts[fn] = fi.ModTime()
+		// Changing the sidecar metadata also reloads the
+		// shard.
+		mtime := fi.ModTime()
+		if mi, err := os.Lstat(zoekt.ShardMetaName(fn)); err == nil && mi.ModTime().After(mtime) {
+			mtime = mi.ModTime()
+		}
+		ts[fn] = mtime
 	}
 
 	var toLoad []string
@@ -104,7 +112,7 @@ func (s *shardWatcher) scan() error {
 	}
 
 	for _, t := range toDrop {
-		log.Printf("unloading: %s", t)
+		slog.Info("unloading shard", "shard", t)
 		s.loader.drop(t)
 	}
 
@@ -129,15 +137,17 @@ func (s *shardWatcher) watch(quitter <-chan struct{}) error {
 	if err := watcher.Add(s.dir); err != nil {
 		return err
 	}
+	s.watchTenantDirs(watcher)
 
 	go func() {
 		for {
 			select {
 			case <-watcher.Events:
+				s.watchTenantDirs(watcher)
 				s.scan()
 			case err := <-watcher.Errors:
 				if err != nil {
-					log.Println("watcher error:", err)
+					slog.Error("watcher error", "dir", s.dir, "error", err)
 				}
 			case <-quitter:
 				watcher.Close()
@@ -147,3 +157,17 @@ func (s *shardWatcher) watch(quitter <-chan struct{}) error {
 	}()
 	return nil
 }
+
+// watchTenantDirs adds the per-tenant subdirectories of the index to
+// watcher. Adding a directory that is already watched is a no-op.
+func (s *shardWatcher) watchTenantDirs(watcher *fsnotify.Watcher) {
+	dirs, _ := filepath.Glob(filepath.Join(s.dir, zoekt.TenantDirPrefix+"*"))
+	for _, d := range dirs {
+		if fi, err := os.Stat(d); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := watcher.Add(d); err != nil {
+			slog.Error("watcher error", "dir", d, "error", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// TenantDirPrefix starts the names of the per-tenant subdirectories
+// of an index directory, see TenantDir.
+const TenantDirPrefix = "tenant-"
+
+// TenantDir returns the directory holding the shards of the tenant
+// with the given ID, see Repository.TenantID. Repositories without a
+// tenant are kept in indexDir itself.
+func TenantDir(indexDir, id string) string {
+	if id == "" {
+		return indexDir
+	}
+	return filepath.Join(indexDir, TenantDirPrefix+id)
+}
+
+// ListShards returns the shards in the index directory dir, including
+// those in per-tenant subdirectories.
+func ListShards(dir string) ([]string, error) {
+	fs, err := filepath.Glob(filepath.Join(dir, "*.zoekt"))
+	if err != nil {
+		return nil, err
+	}
+	tfs, err := filepath.Glob(filepath.Join(dir, TenantDirPrefix+"*", "*.zoekt"))
+	if err != nil {
+		return nil, err
+	}
+	return append(fs, tfs...), nil
+}
+
+// ValidTenantID returns whether id may be used as a tenant ID. Tenant
+// IDs name directories, so they are limited to letters, digits, '-',
+// '_' and '.', and may not start with a '.'.
+func ValidTenantID(id string) bool {
+	if id == "" || len(id) > 64 || id[0] == '.' {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type tenantKey struct{}
+
+// tenant is the value of tenantKey in contexts.
+type tenant struct {
+	id  string
+	all bool
+}
+
+// WithTenant returns a context for requests on behalf of the tenant
+// with the given ID. Searchers that serve several tenants only
+// search the repositories of that tenant.
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant{id: id})
+}
+
+// WithAllTenants returns a context for internal requests that may see
+// the repositories of all tenants, such as health checks. Never use
+// it for requests on behalf of users. It is not passed on to RPC
+// servers.
+func WithAllTenants(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant{all: true})
+}
+
+// TenantFromContext returns the tenant ID set by WithTenant, or false
+// if ctx has none.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	t, ok := ctx.Value(tenantKey{}).(tenant)
+	return t.id, ok && !t.all
+}
+
+// TenantMatches returns whether a request with the context ctx may
+// see repo. Requests without a tenant only see repositories without
+// one.
+func TenantMatches(ctx context.Context, repo *Repository) bool {
+	t, _ := ctx.Value(tenantKey{}).(tenant)
+	return t.all || t.id == repo.TenantID
+}
+
+// HasTenant returns whether ctx was set up by WithTenant or
+// WithAllTenants.
+func HasTenant(ctx context.Context) bool {
+	_, ok := ctx.Value(tenantKey{}).(tenant)
+	return ok
+}
@@ -27,7 +27,30 @@ package zoekt
 // 13: content checksums
 // 14: languages
 // 15: rune based symbol sections
-const IndexFormatVersion = 15
+// 16: document ranks
+// 17: line ending conventions; lone CR ends a line
+// 18: section checksums
+// 19: file categories
+// 20: file sizes, modification times and executable bits
+// 21: optional compression of file contents
+// 22: optional roaring bitmap posting lists
+// 23: 64-bit section offsets
+// 24: bloom filter of the ngrams
+// 25: document frequencies of the ngrams
+const IndexFormatVersion = 25
+
+// MinIndexFormatVersion is the oldest format version that can be
+// searched. Besides IndexFormatVersion, the reader supports the
+// version before it, so a new webserver can serve the shards of an
+// older indexer until they are rebuilt or upgraded with
+// zoekt-reindex-shard. Every format change must keep the previous
+// version readable.
+const MinIndexFormatVersion = IndexFormatVersion - 1
+
+// wideOffsetsVersion is the first format version that stores section
+// offsets and sizes as 64-bit numbers. Older files use 32-bit
+// numbers, which limits them to 4G.
+const wideOffsetsVersion = 23
 
 // FeatureVersion is increased if a feature is added that requires reindexing data
 // without changing the format version
@@ -61,10 +84,34 @@ type indexTOC struct {
 	nameEndRunes     simpleSection
 	contentChecksums simpleSection
 	runeDocSections  simpleSection
+	docRanks         simpleSection
+	lineEndings      simpleSection
+	categories       simpleSection
+	fileInfos        simpleSection
+
+	// Relative offsets of the uncompressed contents of the
+	// files, if fileContents is compressed. Empty otherwise.
+	contentBoundaries simpleSection
+
+	// Bloom filter of the case folded ngrams of the contents and
+	// names, see bloomFilter.
+	ngramBloom simpleSection
+
+	// Number of documents containing each content ngram, as
+	// uint32 in the order of ngramText.
+	ngramDocFreqs simpleSection
+
+	// CRC-32C of every other section, in the order of
+	// checksummedSections.
+	sectionChecksums simpleSection
+
+	// Set for files of the previous format version, which lack
+	// the sections added in IndexFormatVersion: ngramDocFreqs.
+	prevVersion bool
 }
 
 func (t *indexTOC) sections() []section {
-	return []section{
+	secs := []section{
 		// This must be first, so it can be reliably read across
 		// file format versions.
 		&t.metaData,
@@ -86,5 +133,33 @@ func (t *indexTOC) sections() []section {
 		&t.contentChecksums,
 		&t.languages,
 		&t.runeDocSections,
+		&t.docRanks,
+		&t.lineEndings,
+		&t.categories,
+		&t.fileInfos,
+		&t.contentBoundaries,
+		&t.ngramBloom,
+	}
+	if !t.prevVersion {
+		secs = append(secs, &t.ngramDocFreqs)
+	}
+	return append(secs, &t.sectionChecksums)
+}
+
+// checksummedSections returns the byte ranges of all sections except
+// sectionChecksums. Compound sections contribute their data and their
+// index.
+func (t *indexTOC) checksummedSections() []simpleSection {
+	var res []simpleSection
+	for _, s := range t.sections() {
+		switch s := s.(type) {
+		case *simpleSection:
+			if s != &t.sectionChecksums {
+				res = append(res, *s)
+			}
+		case *compoundSection:
+			res = append(res, s.data, s.index)
+		}
 	}
+	return res
 }
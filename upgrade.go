@@ -0,0 +1,93 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"io"
+)
+
+// document returns the i'th document of the shard, as it was passed
+// to IndexBuilder.Add. Skipped documents keep the marker content.
+func (d *indexData) document(i uint32) (*Document, error) {
+	content, err := d.readContents(i)
+	if err != nil {
+		return nil, err
+	}
+	symbols, _, err := d.readDocSections(i, nil)
+	if err != nil {
+		return nil, err
+	}
+	size, modTime, executable := d.fileInfo(i)
+
+	doc := &Document{
+		Name:              string(d.fileName(i)),
+		Content:           content,
+		SubRepositoryPath: d.subRepoPaths[d.subRepos[i]],
+		Language:          d.languageMap[d.languages[i]],
+		Symbols:           symbols,
+		Rank:              d.docRank(i),
+		Category:          FileCategory(d.categories[i]),
+		Size:              size,
+		Executable:        executable,
+		ModTime:           modTime,
+	}
+	for j, br := range d.repoMetaData.Branches {
+		if d.fileBranchMasks[i]&(uint64(1)<<uint(j)) != 0 {
+			doc.Branches = append(doc.Branches, br.Name)
+		}
+	}
+	return doc, nil
+}
+
+// UpgradeShard reads the shard f and writes it to out in
+// IndexFormatVersion, without access to the indexed repository. The
+// shard must be searchable, ie. at least MinIndexFormatVersion. As
+// the files are not reindexed, the index time and feature version of
+// the shard are kept. The IndexFile is not closed.
+func UpgradeShard(f IndexFile, out io.Writer) error {
+	s, err := NewSearcher(f)
+	if err != nil {
+		return err
+	}
+	d := s.(*indexData)
+
+	b, err := NewIndexBuilder(&d.repoMetaData)
+	if err != nil {
+		return err
+	}
+	if err := b.SetContentCompression(d.metaData.ContentCompression); err != nil {
+		return err
+	}
+	if err := b.SetPostingEncoding(d.metaData.PostingEncoding); err != nil {
+		return err
+	}
+
+	for i := range d.fileBranchMasks {
+		doc, err := d.document(uint32(i))
+		if err != nil {
+			return fmt.Errorf("%s: document %d: %v", f.Name(), i, err)
+		}
+		if err := b.Add(*doc); err != nil {
+			return fmt.Errorf("%s: %s: %v", f.Name(), doc.Name, err)
+		}
+	}
+
+	return b.write(out, IndexMetadata{
+		IndexFormatVersion:  IndexFormatVersion,
+		IndexTime:           d.metaData.IndexTime,
+		IndexFeatureVersion: d.metaData.IndexFeatureVersion,
+	})
+}
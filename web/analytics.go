@@ -0,0 +1,161 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/google/zoekt"
+)
+
+const defaultAnalyticsMaxFiles = 100
+
+// Analytics aggregates which repositories and files appear in the
+// search results served to users. The popularity it reports can feed
+// repository ranking and shard placement with real usage.
+type Analytics struct {
+	// SampleRate is the fraction of results that is recorded,
+	// between 0 and 1.
+	SampleRate float64
+
+	// If set, repositories matching Exclude are never recorded.
+	Exclude *regexp.Regexp
+
+	// MaxFiles bounds the number of files tracked per
+	// repository. Defaults to 100.
+	MaxFiles int
+
+	mu    sync.Mutex
+	repos map[string]*repoUsage
+}
+
+type repoUsage struct {
+	hits  int
+	files map[string]int
+}
+
+// RepoPopularity is the usage recorded for a repository.
+type RepoPopularity struct {
+	Repository string
+
+	// Number of sampled results that contained the repository.
+	Hits int
+
+	// The most frequent files, most popular first.
+	Files []FilePopularity
+}
+
+// FilePopularity is the usage recorded for a file.
+type FilePopularity struct {
+	FileName string
+	Hits     int
+}
+
+// Record adds the files of a served result, subject to sampling.
+func (a *Analytics) Record(res *zoekt.SearchResult) {
+	if len(res.Files) == 0 || rand.Float64() >= a.SampleRate {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.repos == nil {
+		a.repos = map[string]*repoUsage{}
+	}
+
+	seen := map[string]bool{}
+	for _, f := range res.Files {
+		if a.Exclude != nil && a.Exclude.MatchString(f.Repository) {
+			continue
+		}
+		u := a.repos[f.Repository]
+		if u == nil {
+			u = &repoUsage{files: map[string]int{}}
+			a.repos[f.Repository] = u
+		}
+		if !seen[f.Repository] {
+			seen[f.Repository] = true
+			u.hits++
+		}
+		u.files[f.FileName]++
+		a.trim(u)
+	}
+}
+
+// trim halves the file counts of u until it is within MaxFiles,
+// forgetting files that drop to zero. Must be called with a.mu held.
+func (a *Analytics) trim(u *repoUsage) {
+	max := a.MaxFiles
+	if max <= 0 {
+		max = defaultAnalyticsMaxFiles
+	}
+	for len(u.files) > max {
+		for f, n := range u.files {
+			if n/2 == 0 {
+				delete(u.files, f)
+			} else {
+				u.files[f] = n / 2
+			}
+		}
+	}
+}
+
+// Popularity returns the recorded usage, most popular repository
+// first.
+func (a *Analytics) Popularity() []RepoPopularity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var res []RepoPopularity
+	for name, u := range a.repos {
+		p := RepoPopularity{Repository: name, Hits: u.hits}
+		for f, n := range u.files {
+			p.Files = append(p.Files, FilePopularity{FileName: f, Hits: n})
+		}
+		sort.Slice(p.Files, func(i, j int) bool {
+			if p.Files[i].Hits != p.Files[j].Hits {
+				return p.Files[i].Hits > p.Files[j].Hits
+			}
+			return p.Files[i].FileName < p.Files[j].FileName
+		})
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Hits != res[j].Hits {
+			return res[i].Hits > res[j].Hits
+		}
+		return res[i].Repository < res[j].Repository
+	})
+	return res
+}
+
+// ServeHTTP serves the popularity as JSON. The "n" parameter limits
+// the number of repositories returned.
+func (a *Analytics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pop := a.Popularity()
+	if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && n >= 0 && n < len(pop) {
+		pop = pop[:n]
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(pop); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
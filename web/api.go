@@ -15,6 +15,7 @@
 package web
 
 import (
+	"html/template"
 	"time"
 
 	"github.com/google/zoekt"
@@ -37,6 +38,56 @@ type ResultInput struct {
 	Duration      time.Duration
 	FileMatches   []*FileMatch
 	SearchOptions string
+
+	// If set, the cursor for the next page of results.
+	NextCursor string
+}
+
+// SearchResponse is returned by the /api/search endpoint.
+type SearchResponse struct {
+	Query       string
+	Stats       zoekt.Stats
+	FileMatches []*FileMatch
+
+	// If set, pass it as the "cursor" parameter to get the next
+	// page of results.
+	NextCursor string `json:",omitempty"`
+
+	// If the query found nothing, relaxed queries that do find
+	// files.
+	Suggestions []Suggestion `json:",omitempty"`
+}
+
+// Suggestion is a relaxed query, see zoekt.QuerySuggestion.
+type Suggestion struct {
+	Reason    string
+	Query     string
+	FileCount int
+}
+
+// ExportRow is a matching line written by the /export endpoint, as
+// a line of NDJSON or a row of CSV. A match on the file name has
+// LineNumber 0.
+type ExportRow struct {
+	Repository string
+	Branches   []string
+	FileName   string
+	LineNumber int
+	Column     int
+	Line       string
+}
+
+// SuggestResponse is returned by the /api/suggest endpoint.
+type SuggestResponse struct {
+	// Repository names with a path component starting with the
+	// prefix.
+	Repos []string
+
+	// File paths with a path component starting with the prefix.
+	Files []string
+
+	// Symbols starting with the prefix.
+	Symbols []string
 }
 
 // FileMatch holds the per file data provided to search results template
@@ -45,6 +96,14 @@ type FileMatch struct {
 	Repo     string
 	ResultID string
 	Language string
+
+	// RepoID is the ID of the repository, or zero if it has none.
+	RepoID uint32 `json:",omitempty"`
+
+	// Size of the file in bytes, and the time it was last
+	// changed, if known.
+	Size    int64
+	ModTime time.Time
 	// If this was a duplicate result, this will contain the file
 	// of the first match.
 	DuplicateID string
@@ -61,6 +120,10 @@ type Match struct {
 	LineNum  int
 
 	Fragments []Fragment
+
+	// If set, the line with its code colored and the fragments
+	// in bold.
+	Highlighted template.HTML `json:",omitempty"`
 }
 
 // Fragment holds data of a single contiguous match within in a line
@@ -69,6 +132,10 @@ type Fragment struct {
 	Pre   string
 	Match string
 	Post  string
+
+	// Column is the 1-based column of Match in the line, counted
+	// in runes.
+	Column int
 }
 
 // SearchBoxInput is provided to the SearchBox template.
@@ -95,14 +162,50 @@ type Branch struct {
 
 // Repository holds the metadata for an indexed repository.
 type Repository struct {
-	Name      string
-	URL       string
-	IndexTime time.Time
-	Branches  []Branch
-	Files     int64
+	Name        string
+	ID          uint32 `json:",omitempty"`
+	URL         string
+	Description string
+	Topics      []string
+	IndexTime   time.Time
+	Branches    []Branch
+	Files       int64
 
 	// Total amount of content bytes.
 	Size int64
+
+	// Names of the index files holding the repository, relative
+	// to the index directory.
+	ShardFiles []string `json:",omitempty"`
+}
+
+// RepoListResponse is returned by the /api/repos endpoint.
+type RepoListResponse struct {
+	Stats zoekt.RepoStats
+	Repos []Repository
+}
+
+// TreeEntry is a file or directory in a TreeResponse.
+type TreeEntry struct {
+	// Name within the directory.
+	Name string
+
+	// Path from the root of the repository.
+	Path string
+
+	// Set for directories.
+	Dir bool `json:",omitempty"`
+}
+
+// TreeResponse is returned by the /api/tree endpoint.
+type TreeResponse struct {
+	Repo   string
+	Branch string `json:",omitempty"`
+	Path   string
+
+	// The entries of the directory, directories first, each
+	// sorted by name.
+	Entries []TreeEntry
 }
 
 // PrintInput is provided to the server.Print template.
@@ -110,4 +213,11 @@ type PrintInput struct {
 	Repo, Name string
 	Lines      []string
 	Last       LastInput
+
+	// If set, Lines as HTML, with the code colored and the
+	// matches of the query in bold.
+	HighlightedLines []template.HTML
+
+	// Link to the file as plain text.
+	RawURL string
 }
@@ -0,0 +1,198 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Authenticator identifies the user making a request.
+type Authenticator interface {
+	// Authenticate returns the user making r. If the user is
+	// unknown, it responds to the request itself, for example by
+	// asking for credentials, and returns false.
+	Authenticate(w http.ResponseWriter, r *http.Request) (user string, ok bool)
+}
+
+// authCallback is implemented by Authenticators that receive requests
+// of their own, such as the redirect back from a login page.
+type authCallback interface {
+	http.Handler
+
+	// CallbackPath is the path of the requests for ServeHTTP.
+	CallbackPath() string
+}
+
+// BasicAuth authenticates users with HTTP basic authentication.
+type BasicAuth struct {
+	// Realm is shown by browsers when asking for credentials.
+	Realm string
+
+	// Users maps user names to passwords.
+	Users map[string]string
+}
+
+// Authenticate implements Authenticator.
+func (a *BasicAuth) Authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if ok {
+		want, known := a.Users[user]
+		if known && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1 {
+			return user, true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.Realm))
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return "", false
+}
+
+// RepoACL decides which repositories a user may search.
+type RepoACL interface {
+	// Repos returns the repositories user may search, or nil if
+	// they may search all of them. The user is empty if the
+	// server has no Authenticator.
+	Repos(ctx context.Context, user string) (*query.RepoSet, error)
+}
+
+// RepoACLFunc adapts a function to the RepoACL interface.
+type RepoACLFunc func(ctx context.Context, user string) (*query.RepoSet, error)
+
+// Repos calls f(ctx, user).
+func (f RepoACLFunc) Repos(ctx context.Context, user string) (*query.RepoSet, error) {
+	return f(ctx, user)
+}
+
+// StaticACL maps users to the repositories they may search. The
+// entry for "*" applies to users without an entry of their own. The
+// repository "*" grants access to all repositories.
+type StaticACL map[string][]string
+
+// Repos implements RepoACL.
+func (a StaticACL) Repos(ctx context.Context, user string) (*query.RepoSet, error) {
+	repos, ok := a[user]
+	if !ok {
+		repos = a["*"]
+	}
+	for _, r := range repos {
+		if r == "*" {
+			return nil, nil
+		}
+	}
+	return query.NewRepoSet(repos...), nil
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user authenticated for the request of
+// ctx.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey{}).(string)
+	return user, ok
+}
+
+// authenticate wraps h so it only serves authenticated users, whose
+// name it adds to the request context.
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	if s.Auth == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := s.Auth.Authenticate(w, r)
+		if !ok {
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// tenant wraps h so it only serves requests with a valid tenant ID in
+// the TenantHeader, which it adds to the request context.
+func (s *Server) tenant(h http.Handler) http.Handler {
+	if s.TenantHeader == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(s.TenantHeader)
+		if !zoekt.ValidTenantID(id) {
+			http.Error(w, "missing or invalid tenant", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(zoekt.WithTenant(r.Context(), id)))
+	})
+}
+
+// aclSearcher restricts searches to the repositories that the user of
+// the request may search, by adding the query.RepoSet of the RepoACL
+// to every query.
+type aclSearcher struct {
+	zoekt.Searcher
+	acl RepoACL
+}
+
+func (s *aclSearcher) restrict(ctx context.Context, q query.Q) (query.Q, error) {
+	user, _ := UserFromContext(ctx)
+	repos, err := s.acl.Repos(ctx, user)
+	if err != nil {
+		return nil, zoekt.Errorf(zoekt.CodePermissionDenied, "repository ACL for %q: %v", user, err)
+	}
+	if repos == nil {
+		return q, nil
+	}
+	// Keep a type:repo query at the top, where the shards look for
+	// it.
+	if t, ok := q.(*query.Type); ok {
+		return &query.Type{Type: t.Type, Child: query.NewAnd(repos, t.Child)}, nil
+	}
+	return query.NewAnd(repos, q), nil
+}
+
+func (s *aclSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	q, err := s.restrict(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return s.Searcher.Search(ctx, q, opts)
+}
+
+func (s *aclSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, sender zoekt.Sender) error {
+	q, err := s.restrict(ctx, q)
+	if err != nil {
+		return err
+	}
+	if st, ok := s.Searcher.(zoekt.Streamer); ok {
+		return st.StreamSearch(ctx, q, opts, sender)
+	}
+	sr, err := s.Searcher.Search(ctx, q, opts)
+	if err != nil {
+		return err
+	}
+	sender.Send(sr)
+	sender.Send(&zoekt.SearchResult{Stats: sr.Stats})
+	return nil
+}
+
+func (s *aclSearcher) List(ctx context.Context, q query.Q) (*zoekt.RepoList, error) {
+	q, err := s.restrict(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return s.Searcher.List(ctx, q)
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a compressor for responses, which can be reused.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools hold the encoders of each supported content coding,
+// in order of preference.
+var encoderPools = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"zstd", &sync.Pool{New: func() interface{} {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return e
+	}}},
+	{"gzip", &sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}},
+}
+
+// acceptsEncoding returns whether the Accept-Encoding header accept
+// allows the content coding name.
+func acceptsEncoding(accept, name string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != name {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressWriter compresses a response, unless the handler already
+// encoded it or it has no body.
+type compressWriter struct {
+	http.ResponseWriter
+	name string
+	pool *sync.Pool
+
+	decided bool
+	enc     encoder
+
+	// status is the status of a compressed response, whose
+	// header is sent once the first bytes show its content type.
+	status     int
+	headerSent bool
+}
+
+func (w *compressWriter) decide(status int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	h := w.Header()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent || h.Get("Content-Encoding") != "" {
+		return
+	}
+	h.Set("Content-Encoding", w.name)
+	h.Del("Content-Length")
+	w.enc = w.pool.Get().(encoder)
+	w.enc.Reset(w.ResponseWriter)
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	w.decide(status)
+	if w.enc == nil {
+		w.ResponseWriter.WriteHeader(status)
+	} else if w.status == 0 {
+		w.status = status
+	}
+}
+
+// sendHeader sends the header of a compressed response. Unless the
+// handler set it, the content type is detected from p, the first
+// bytes of the body, as net/http would do for them uncompressed.
+func (w *compressWriter) sendHeader(p []byte) {
+	if w.headerSent {
+		return
+	}
+	w.headerSent = true
+	if h := w.Header(); h.Get("Content-Type") == "" && len(p) > 0 {
+		h.Set("Content-Type", http.DetectContentType(p))
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	w.decide(http.StatusOK)
+	if w.enc == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	w.sendHeader(p)
+	return w.enc.Write(p)
+}
+
+// Flush sends what was compressed so far, for streaming responses.
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		w.sendHeader(nil)
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) close() {
+	if w.enc == nil {
+		return
+	}
+	w.sendHeader(nil)
+	w.enc.Close()
+	w.enc.Reset(ioutil.Discard)
+	w.pool.Put(w.enc)
+	w.enc = nil
+}
+
+// compress wraps h so it compresses responses with zstd or gzip, as
+// negotiated with the client.
+func (s *Server) compress(h http.Handler) http.Handler {
+	if !s.Compress {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		accept := r.Header.Get("Accept-Encoding")
+		for _, e := range encoderPools {
+			if acceptsEncoding(accept, e.name) {
+				cw := &compressWriter{ResponseWriter: w, name: e.name, pool: e.pool}
+				defer cw.close()
+				h.ServeHTTP(cw, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -16,51 +16,40 @@ package web
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/shards"
+	"github.com/google/zoekt/zoekttest"
 )
 
 const jsonContentType = "application/json; charset=utf-8"
 
-// TODO(hanwen): cut & paste from ../ . Should create internal test
-// util package.
-type memSeeker struct {
-	data []byte
-}
-
-func (s *memSeeker) Close() {}
-func (s *memSeeker) Read(off, sz uint32) ([]byte, error) {
-	return s.data[off : off+sz], nil
-}
-
-func (s *memSeeker) Size() (uint32, error) {
-	return uint32(len(s.data)), nil
-}
-func (s *memSeeker) Name() string {
-	return "memSeeker"
-}
-
 func searcherForTest(t *testing.T, b *zoekt.IndexBuilder) zoekt.Searcher {
-	var buf bytes.Buffer
-	b.Write(&buf)
-	f := &memSeeker{buf.Bytes()}
-
-	searcher, err := zoekt.NewSearcher(f)
-	if err != nil {
-		t.Fatalf("NewSearcher: %v", err)
-	}
-
-	return searcher
+	return zoekttest.SearcherForBuilder(t, b)
 }
 
 func TestBasic(t *testing.T) {
@@ -218,6 +207,144 @@ func TestPrint(t *testing.T) {
 	}
 }
 
+func TestHighlight(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{
+		Name:    "main.go",
+		Content: []byte("package main\n\nfunc water() string { return \"<water>\" }\n"),
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher:  searcherForTest(t, b),
+		Top:       Top,
+		HTML:      true,
+		Print:     true,
+		Highlight: true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for req, needles := range map[string][]string{
+		"/search?q=water": []string{
+			`<span class="kd">func</span> <b><span class="nf">water</span></b>`,
+			`<span class="s">&#34;&lt;</span><b><span class="s">water</span></b>`,
+		},
+		"/print?q=water&r=name&f=main.go": []string{
+			`<span class="chroma"><span class="kn">package</span> <span class="nx">main</span></span>`,
+			`<span class="k">return</span>`,
+		},
+	} {
+		res, err := http.Get(ts.URL + req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resultBytes, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := string(resultBytes)
+		for _, want := range needles {
+			if !strings.Contains(result, want) {
+				t.Errorf("query %q: result did not have %q: %s", req, want, result)
+			}
+		}
+	}
+}
+
+func TestServeFiles(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name:     "github.com/org/name",
+		Branches: []zoekt.RepositoryBranch{{Name: "master", Version: "1234"}},
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	content := "to carry\n<water> in\nthe no later bla\n"
+	if err := b.Add(zoekt.Document{
+		Name:     "dir/f2",
+		Content:  []byte(content),
+		Branches: []string{"master"},
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher:   searcherForTest(t, b),
+		Top:        Top,
+		HTML:       true,
+		ServeFiles: true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(req string) (*http.Response, string) {
+		res, err := http.Get(ts.URL + req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(body)
+	}
+
+	for req, needles := range map[string][]string{
+		"/search?q=water": []string{
+			`href="print?b=master&amp;f=dir%2Ff2&amp;q=water&amp;r=github.com%2Forg%2Fname#l2"`,
+		},
+		"/print?q=water&r=github.com/org/name&f=dir/f2": []string{
+			`<a href="#l2">2</a>: </span><span class="chroma">&lt;<b>water</b>&gt; in</span></pre>`,
+			`<a href="raw/github.com/org/name@master/dir/f2">raw</a>`,
+		},
+	} {
+		res, body := get(req)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d", req, res.StatusCode)
+		}
+		for _, want := range needles {
+			if !strings.Contains(body, want) {
+				t.Errorf("query %q: result did not have %q: %s", req, want, body)
+			}
+		}
+	}
+
+	res, body := get("/raw/github.com/org/name@master/dir/f2")
+	if body != content {
+		t.Errorf("got raw content %q, want %q", body, content)
+	}
+	if got, want := res.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+
+	for req, want := range map[string]int{
+		"/raw/github.com/org/name@master/dir/f3": http.StatusNotFound,
+		"/raw/github.com/org/name@other/dir/f2":  http.StatusNotFound,
+		"/raw/github.com/org/name/dir/f2":        http.StatusBadRequest,
+		"/print?r=github.com/org/name&f=dir/f3":  http.StatusNotFound,
+	} {
+		if res, _ := get(req); res.StatusCode != want {
+			t.Errorf("%s: got status %d, want %d", req, res.StatusCode, want)
+		}
+	}
+}
+
 type crashSearcher struct {
 	zoekt.Searcher
 }
@@ -259,6 +386,49 @@ func TestCrash(t *testing.T) {
 	}
 }
 
+type errSearcher struct {
+	zoekt.Searcher
+	err error
+}
+
+func (s *errSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	return nil, s.err
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   error
+		want  int
+	}{
+		{"(water", nil, http.StatusBadRequest},
+		{"water", zoekt.Errorf(zoekt.CodePermissionDenied, "no"), http.StatusForbidden},
+		{"water", zoekt.Errorf(zoekt.CodeOverloaded, "busy"), http.StatusServiceUnavailable},
+		{"water", zoekt.Errorf(zoekt.CodeShardCorrupt, "bad"), http.StatusInternalServerError},
+		{"water", fmt.Errorf("other"), http.StatusTeapot},
+	} {
+		mux, err := NewMux(&Server{
+			Searcher: &errSearcher{err: tc.err},
+			Top:      Top,
+			HTML:     true,
+		})
+		if err != nil {
+			t.Fatalf("NewMux: %v", err)
+		}
+
+		ts := httptest.NewServer(mux)
+		res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape(tc.query))
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.want {
+			t.Errorf("%q, %v: got status %d, want %d", tc.query, tc.err, res.StatusCode, tc.want)
+		}
+	}
+}
+
 func TestHostCustomization(t *testing.T) {
 	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
 		Name: "name",
@@ -416,3 +586,1241 @@ func TestTruncateLine(t *testing.T) {
 		t.Fatalf("got %s, want substring %q", result, want)
 	}
 }
+
+func TestAnalytics(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "name"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, d := range []zoekt.Document{
+		{Name: "f1", Content: []byte("water")},
+		{Name: "f2", Content: []byte("water and fire")},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher:  searcherForTest(t, b),
+		Top:       Top,
+		HTML:      true,
+		Analytics: &Analytics{SampleRate: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, q := range []string{"water", "fire"} {
+		res, err := http.Get(ts.URL + "/search?q=" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get(ts.URL + "/api/popularity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var got []RepoPopularity
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []RepoPopularity{{
+		Repository: "name",
+		Hits:       2,
+		Files: []FilePopularity{
+			{FileName: "f2", Hits: 2},
+			{FileName: "f1", Hits: 1},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAnalyticsTrim(t *testing.T) {
+	a := &Analytics{SampleRate: 1, MaxFiles: 2, Exclude: regexp.MustCompile("^secret/")}
+	a.Record(&zoekt.SearchResult{Files: []zoekt.FileMatch{
+		{Repository: "repo", FileName: "a"},
+		{Repository: "secret/repo", FileName: "b"},
+	}})
+	a.Record(&zoekt.SearchResult{Files: []zoekt.FileMatch{
+		{Repository: "repo", FileName: "a"},
+		{Repository: "repo", FileName: "b"},
+		{Repository: "repo", FileName: "c"},
+	}})
+
+	want := []RepoPopularity{{
+		Repository: "repo",
+		Hits:       2,
+		Files:      []FilePopularity{{FileName: "a", Hits: 1}},
+	}}
+	if got := a.Popularity(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestStream(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, doc := range []zoekt.Document{
+		{Name: "f1", Content: []byte("to carry water")},
+		{Name: "f2", Content: []byte("water under the bridge")},
+	} {
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/stream?q=water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got, want := res.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	var matches StreamMatches
+	var done StreamDone
+	for _, ev := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		lines := strings.SplitN(ev, "\n", 2)
+		name := strings.TrimPrefix(lines[0], "event: ")
+		data := []byte(strings.TrimPrefix(lines[1], "data: "))
+		events = append(events, name)
+		switch name {
+		case "matches":
+			if err := json.Unmarshal(data, &matches); err != nil {
+				t.Fatal(err)
+			}
+		case "done":
+			if err := json.Unmarshal(data, &done); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if want := []string{"matches", "done"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %v, want %v: %s", events, want, body)
+	}
+	if len(matches.FileMatches) != 2 {
+		t.Errorf("got %d file matches, want 2", len(matches.FileMatches))
+	}
+	if done.Stats.MatchCount != 2 {
+		t.Errorf("got MatchCount %d, want 2", done.Stats.MatchCount)
+	}
+
+	res, err = http.Get(ts.URL + "/api/stream?q=(water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for parse error, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAPISearchPages(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, n := range []string{"f1", "f2", "f3"} {
+		if err := b.Add(zoekt.Document{Name: n, Content: []byte("water")}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 1; ; pages++ {
+		res, err := http.Get(ts.URL + "/api/search?q=water&num=2&cursor=" + url.QueryEscape(cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sr SearchResponse
+		err = json.NewDecoder(res.Body).Decode(&sr)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range sr.FileMatches {
+			if seen[f.FileName] {
+				t.Errorf("page %d: %s seen before", pages, f.FileName)
+			}
+			seen[f.FileName] = true
+		}
+		if sr.NextCursor == "" {
+			if pages != 2 {
+				t.Errorf("got %d pages, want 2", pages)
+			}
+			break
+		}
+		cursor = sr.NextCursor
+	}
+	if len(seen) != 3 {
+		t.Errorf("got files %v, want 3", seen)
+	}
+
+	res, err := http.Get(ts.URL + "/api/search?q=water&cursor=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for bad cursor, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAPISuggest(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "github.com/org/widgets",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, doc := range []zoekt.Document{
+		{Name: "src/widget.go", Content: []byte("func widgetize() {}"), Symbols: []zoekt.DocumentSection{{Start: 5, End: 14}}},
+		{Name: "src/gadget.go", Content: []byte("// uses widgetize")},
+	} {
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for prefix, want := range map[string]SuggestResponse{
+		"Widget": {
+			Repos:   []string{"github.com/org/widgets"},
+			Files:   []string{"src/widget.go"},
+			Symbols: []string{"widgetize"},
+		},
+		"wi": {
+			Repos: []string{"github.com/org/widgets"},
+			Files: []string{"src/widget.go"},
+		},
+		"idget": {},
+	} {
+		res, err := http.Get(ts.URL + "/api/suggest?prefix=" + url.QueryEscape(prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got SuggestResponse
+		err = json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%q: Decode: %v", prefix, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %+v, want %+v", prefix, got, want)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/api/suggest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d without prefix, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAPIRepos(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name:     "name",
+		Branches: []zoekt.RepositoryBranch{{Name: "master", Version: "abc123"}},
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, n := range []string{"f1", "f2"} {
+		if err := b.Add(zoekt.Document{Name: n, Content: []byte("water"), Branches: []string{"master"}}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for q, want := range map[string]int{"": 1, "r:name": 1, "r:other": 0} {
+		res, err := http.Get(ts.URL + "/api/repos?q=" + url.QueryEscape(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got RepoListResponse
+		err = json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%q: Decode: %v", q, err)
+		}
+		if len(got.Repos) != want || got.Stats.Repos != want {
+			t.Fatalf("%q: got %d repos, stats %+v, want %d", q, len(got.Repos), got.Stats, want)
+		}
+		if want == 0 {
+			continue
+		}
+		r := got.Repos[0]
+		if r.Name != "name" || r.Files != 2 || r.IndexTime.IsZero() || len(r.ShardFiles) != 1 {
+			t.Errorf("%q: got repo %+v", q, r)
+		}
+		if len(r.Branches) != 1 || r.Branches[0].Version != "abc123" {
+			t.Errorf("%q: got branches %+v, want master at abc123", q, r.Branches)
+		}
+	}
+
+	for _, q := range []string{"water", "r:name&order=bogus"} {
+		res, err := http.Get(ts.URL + "/api/repos?q=" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", q, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPITree(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+		Branches: []zoekt.RepositoryBranch{
+			{Name: "master", Version: "v1"},
+			{Name: "stable", Version: "v2"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, doc := range []zoekt.Document{
+		{Name: "README", Branches: []string{"master", "stable"}},
+		{Name: "src/main.go", Branches: []string{"master"}},
+		{Name: "src/main.go", Branches: []string{"stable"}},
+		{Name: "src/lib/lib.go", Branches: []string{"master"}},
+		{Name: "docs/guide.md", Branches: []string{"stable"}},
+	} {
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for params, want := range map[string][]TreeEntry{
+		"repo=name": {
+			{Name: "docs", Path: "docs", Dir: true},
+			{Name: "src", Path: "src", Dir: true},
+			{Name: "README", Path: "README"},
+		},
+		"repo=name&branch=master": {
+			{Name: "src", Path: "src", Dir: true},
+			{Name: "README", Path: "README"},
+		},
+		"repo=name&path=src/": {
+			{Name: "lib", Path: "src/lib", Dir: true},
+			{Name: "main.go", Path: "src/main.go"},
+		},
+	} {
+		res, err := http.Get(ts.URL + "/api/tree?" + params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got TreeResponse
+		err = json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", params, err)
+		}
+		if !reflect.DeepEqual(got.Entries, want) {
+			t.Errorf("%s: got %+v, want %+v", params, got.Entries, want)
+		}
+	}
+
+	for params, want := range map[string]int{
+		"":                      http.StatusBadRequest,
+		"repo=other":            http.StatusNotFound,
+		"repo=name&path=nosuch": http.StatusNotFound,
+		"repo=name&path=src/ma": http.StatusNotFound,
+	} {
+		res, err := http.Get(ts.URL + "/api/tree?" + params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("%q: got status %d, want %d", params, res.StatusCode, want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{Name: "f1", Content: []byte("water\nfire, water")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(params string) (*http.Response, []byte) {
+		res, err := http.Get(ts.URL + "/export?" + params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, body
+	}
+
+	res, body := get("q=water")
+	if got := res.Header.Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := [][]string{
+		{"repository", "branches", "file", "line", "column", "text"},
+		{"name", "", "f1", "1", "1", "water"},
+		{"name", "", "f1", "2", "7", "fire, water"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got CSV %q, want %q", records, want)
+	}
+
+	res, body = get("q=fire&format=ndjson")
+	if got := res.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	var row ExportRow
+	if err := json.Unmarshal(body, &row); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", body, err)
+	}
+	if wantRow := (ExportRow{Repository: "name", FileName: "f1", LineNumber: 2, Column: 1, Line: "fire, water"}); !reflect.DeepEqual(row, wantRow) {
+		t.Errorf("got row %+v, want %+v", row, wantRow)
+	}
+
+	if res, _ := get("q=water&format=xml"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for unknown format, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestCustomTemplatesAndStatic(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "name"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+
+	top := template.New("top").Funcs(Funcmap)
+	for k, v := range TemplateText {
+		if k == "customhead" {
+			v = `<link rel="stylesheet" href="static/theme.css">`
+		}
+		if _, err := top.New(k).Parse(v); err != nil {
+			t.Fatalf("Parse(%s): %v", k, err)
+		}
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "theme.css"), []byte("body { color: red; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, err := NewMux(&Server{
+		Searcher:  searcherForTest(t, b),
+		Top:       top,
+		HTML:      true,
+		StaticDir: dir,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/":                 `<link rel="stylesheet" href="static/theme.css">`,
+		"/static/theme.css": "body { color: red; }",
+	} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), want) {
+			t.Errorf("%s: got %q, want it to contain %q", path, body, want)
+		}
+	}
+}
+
+// recordingSearcher records the queries it searches.
+type recordingSearcher struct {
+	zoekt.Searcher
+	queries []string
+	tenants []string
+}
+
+func (s *recordingSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	s.queries = append(s.queries, q.String())
+	tenant, _ := zoekt.TenantFromContext(ctx)
+	s.tenants = append(s.tenants, tenant)
+	return s.Searcher.Search(ctx, q, opts)
+}
+
+func TestTenantHeader(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{Name: "f2", Content: []byte("to carry water")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	rec := &recordingSearcher{Searcher: searcherForTest(t, b)}
+	mux, err := NewMux(&Server{
+		Searcher:     rec,
+		Top:          Top,
+		HTML:         true,
+		TenantHeader: "X-Tenant",
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		tenant string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"../etc", http.StatusForbidden},
+		{"acme", http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", ts.URL+"/search?q=water", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.tenant != "" {
+			req.Header.Set("X-Tenant", tc.tenant)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("tenant %q: got status %d, want %d", tc.tenant, res.StatusCode, tc.status)
+		}
+	}
+	if len(rec.tenants) == 0 {
+		t.Fatal("no search ran")
+	}
+	for _, tenant := range rec.tenants {
+		if tenant != "acme" {
+			t.Errorf("got search for tenant %q, want acme", tenant)
+		}
+	}
+
+	if _, err := NewMux(&Server{
+		Searcher:     rec,
+		Top:          Top,
+		RPC:          true,
+		TenantHeader: "X-Tenant",
+	}); err == nil {
+		t.Errorf("NewMux with RPC and tenants succeeded")
+	}
+}
+
+func TestBasicAuthACL(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{Name: "f2", Content: []byte("to carry water")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	rec := &recordingSearcher{Searcher: searcherForTest(t, b)}
+	mux, err := NewMux(&Server{
+		Searcher: rec,
+		Top:      Top,
+		HTML:     true,
+		Auth: &BasicAuth{
+			Realm: "test",
+			Users: map[string]string{"alice": "secret", "bob": "hunter2"},
+		},
+		ACL: StaticACL{
+			"alice": {"name"},
+			"*":     {"other"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	search := func(user, password string) (int, string) {
+		req, err := http.NewRequest("GET", ts.URL+"/search?q=water", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+
+	for _, tc := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"eve", "secret", http.StatusUnauthorized},
+	} {
+		if status, _ := search(tc.user, tc.password); status != tc.status {
+			t.Errorf("%s:%s: got status %d, want %d", tc.user, tc.password, status, tc.status)
+		}
+	}
+	if len(rec.queries) != 0 {
+		t.Errorf("unauthenticated requests searched %v", rec.queries)
+	}
+
+	if status, body := search("alice", "secret"); status != http.StatusOK || !strings.Contains(body, "name:f2") {
+		t.Errorf("alice: got status %d, body without result: %s", status, body)
+	}
+	for _, q := range rec.queries {
+		if !strings.Contains(q, `(reposet name)`) {
+			t.Errorf("alice: query %s not restricted to her repositories", q)
+		}
+	}
+
+	if status, body := search("bob", "hunter2"); status != http.StatusOK || strings.Contains(body, "name:f2") {
+		t.Errorf("bob: got status %d, body with result: %s", status, body)
+	}
+
+	if _, err := NewMux(&Server{
+		Searcher:  rec,
+		Top:       Top,
+		ACL:       StaticACL{"*": {"*"}},
+		Analytics: &Analytics{SampleRate: 1},
+	}); err == nil {
+		t.Errorf("NewMux with analytics and ACL succeeded")
+	}
+}
+
+func TestACLTypeRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The repository spans two shards, each of which matches.
+	for i, repo := range []string{"name", "name", "other"} {
+		data, err := zoekttest.NewShard(&zoekt.Repository{Name: repo},
+			zoekt.Document{Name: fmt.Sprintf("f%d", i), Content: []byte("needle")})
+		if err != nil {
+			t.Fatalf("NewShard: %v", err)
+		}
+		fn := filepath.Join(dir, fmt.Sprintf("%s_v16.%05d.zoekt", repo, i))
+		if err := ioutil.WriteFile(fn, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ss, err := shards.NewDirectorySearcher(dir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher: %v", err)
+	}
+	defer ss.Close()
+
+	mux, err := NewMux(&Server{
+		Searcher: ss,
+		Top:      Top,
+		HTML:     true,
+		Auth: &BasicAuth{
+			Realm: "test",
+			Users: map[string]string{"alice": "secret"},
+		},
+		ACL: StaticACL{"alice": {"name"}},
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/search?q="+url.QueryEscape("type:repo needle"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sr SearchResponse
+	err = json.NewDecoder(res.Body).Decode(&sr)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.FileMatches) != 1 || sr.FileMatches[0].Repo != "name" {
+		t.Errorf("got %d matches, want 1 for repository name", len(sr.FileMatches))
+	}
+}
+
+func TestReplicationAuth(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "name"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	replication := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	})
+	srv := &Server{
+		Searcher:    searcherForTest(t, b),
+		Top:         Top,
+		Auth:        &BasicAuth{Realm: "test", Users: map[string]string{"replica": "secret"}},
+		Replication: replication,
+	}
+	mux, err := NewMux(srv)
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+
+	for _, tc := range []struct {
+		user   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"replica", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/replicate/list", nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, "secret")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("user %q: got status %d, want %d", tc.user, w.Code, tc.status)
+		}
+	}
+
+	// Replicas would get the shards of all repositories.
+	srv.ACL = StaticACL{"replica": {"name"}}
+	if _, err := NewMux(srv); err == nil {
+		t.Errorf("NewMux with replication and ACL succeeded")
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{Name: "f2", Content: []byte("to carry water")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	provider := http.NewServeMux()
+	ps := httptest.NewServer(provider)
+	defer ps.Close()
+	discoveryDown := true
+	provider.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if discoveryDown {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": ps.URL + "/authorize",
+			"token_endpoint":         ps.URL + "/token",
+			"userinfo_endpoint":      ps.URL + "/userinfo",
+		})
+	})
+	provider.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		// Log in right away.
+		v := url.Values{"code": {"the-code"}, "state": {r.FormValue("state")}}
+		http.Redirect(w, r, r.FormValue("redirect_uri")+"?"+v.Encode(), http.StatusFound)
+	})
+	provider.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "the-code" {
+			http.Error(w, "bad code", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "the-token", "token_type": "Bearer"}`)
+	})
+	emailVerified := false
+	provider.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer the-token" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"sub": "1234", "email": "alice@example.com", "email_verified": %v}`, emailVerified)
+	})
+
+	var mux http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var users []string
+	mux, err = NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+		Auth: &OIDC{
+			Issuer:      ps.URL,
+			ClientID:    "zoekt",
+			RedirectURL: ts.URL + "/oidc/callback",
+		},
+		ACL: RepoACLFunc(func(ctx context.Context, user string) (*query.RepoSet, error) {
+			users = append(users, user)
+			return nil, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+
+	res, err := http.Get(ts.URL + "/api/search?q=water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("API with discovery down: got status %d, want %d", res.StatusCode, http.StatusInternalServerError)
+	}
+
+	// Discovery is retried once the provider is back.
+	discoveryDown = false
+	res, err = http.Get(ts.URL + "/api/search?q=water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("API without session: got status %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	res, err = client.Get(ts.URL + "/search?q=water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || len(users) != 0 {
+		t.Fatalf("unverified email: got status %d, users %v, want %d", res.StatusCode, users, http.StatusForbidden)
+	}
+
+	emailVerified = true
+	res, err = client.Get(ts.URL + "/search?q=water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "name:f2") {
+		t.Fatalf("got status %d, body without result: %s", res.StatusCode, body)
+	}
+	if len(users) == 0 || users[0] != "alice@example.com" {
+		t.Errorf("got users %v, want alice@example.com", users)
+	}
+
+	// The session cookie lets API requests through.
+	res, err = client.Get(ts.URL + "/api/search?q=water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("API with session: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestIsLocalPath(t *testing.T) {
+	for p, want := range map[string]bool{
+		"/":                true,
+		"/search?q=water":  true,
+		"":                 false,
+		"//evil.com":       false,
+		"/\\evil.com":      false,
+		"/\t/evil.com":     false,
+		"https://evil.com": false,
+	} {
+		if got := isLocalPath(p); got != want {
+			t.Errorf("isLocalPath(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(Limits{QPS: 2, Burst: 2, MaxConcurrent: 3})
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.acquire("a"); !ok {
+			t.Fatalf("request %d rejected within burst", i)
+		}
+	}
+	if ok, wait := l.acquire("a"); ok || wait != 500*time.Millisecond {
+		t.Errorf("got %v, %v after burst, want false, 500ms", ok, wait)
+	}
+	if ok, _ := l.acquire("b"); !ok {
+		t.Errorf("other client rejected")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.acquire("a"); !ok {
+		t.Errorf("rejected after refill")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.acquire("a"); ok {
+		t.Errorf("admitted beyond MaxConcurrent")
+	}
+	l.release("a")
+	if ok, _ := l.acquire("a"); !ok {
+		t.Errorf("rejected after release")
+	}
+
+	// Idle clients are forgotten.
+	l.release("a")
+	l.release("a")
+	l.release("a")
+	l.release("b")
+	now = now.Add(time.Hour)
+	l.acquire("c")
+	if len(l.clients) != 1 {
+		t.Errorf("got %d clients after sweep, want 1", len(l.clients))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "name"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+		Limits:   &Limits{QPS: 0.001, Burst: 2, TrustForwardedFor: true},
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	token := 0
+	get := func(client string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/api/search?q=water", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", client)
+		// Without an Authenticator, tokens must not give a new bucket.
+		token++
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer token%d", token))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	for i := 0; i < 2; i++ {
+		if res := get("10.0.0.1"); res.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: got status %d", i, res.StatusCode)
+		}
+	}
+	res := get("10.0.0.1")
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Errorf("got status %d, Retry-After %q, want %d", res.StatusCode, res.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	// Only the address appended by the proxy is trusted.
+	if res := get("10.0.0.3, 10.0.0.1"); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("spoofed client: got status %d, want %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+	if res := get("10.0.0.1, 10.0.0.2"); res.StatusCode != http.StatusOK {
+		t.Errorf("other client: got status %d", res.StatusCode)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "name"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	ok := metricRequests.WithLabelValues("/api/search", "200")
+	bad := metricRequests.WithLabelValues("/api/search", "400")
+	okBefore, badBefore := testutil.ToFloat64(ok), testutil.ToFloat64(bad)
+
+	for _, q := range []string{"water", "water", "("} {
+		res, err := http.Get(ts.URL + "/api/search?q=" + url.QueryEscape(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	if got := testutil.ToFloat64(ok) - okBefore; got != 2 {
+		t.Errorf("got %v successful requests, want 2", got)
+	}
+	if got := testutil.ToFloat64(bad) - badBefore; got != 1 {
+		t.Errorf("got %v failed requests, want 1", got)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "name"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, tc := range []struct {
+		origins     []string
+		origin      string
+		wantAllow   string
+		credentials bool
+	}{
+		{nil, "https://tools.example.com", "", false},
+		{[]string{"https://tools.example.com"}, "https://tools.example.com", "https://tools.example.com", true},
+		{[]string{"https://tools.example.com"}, "https://evil.example.com", "", false},
+		{[]string{"*"}, "https://evil.example.com", "*", false},
+	} {
+		mux, err := NewMux(&Server{
+			Searcher:    searcherForTest(t, b),
+			Top:         Top,
+			HTML:        true,
+			CORSOrigins: tc.origins,
+			Auth: &BasicAuth{
+				Realm: "test",
+				Users: map[string]string{"alice": "secret"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewMux: %v", err)
+		}
+
+		// Preflight requests carry no credentials.
+		req := httptest.NewRequest("OPTIONS", "/api/search?q=water", nil)
+		req.Header.Set("Origin", tc.origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.wantAllow {
+			t.Errorf("%v %s: got Access-Control-Allow-Origin %q, want %q", tc.origins, tc.origin, got, tc.wantAllow)
+		}
+		if tc.wantAllow != "" && w.Code != http.StatusNoContent {
+			t.Errorf("%v %s: got preflight status %d, want %d", tc.origins, tc.origin, w.Code, http.StatusNoContent)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tc.credentials {
+			t.Errorf("%v %s: got credentials %v, want %v", tc.origins, tc.origin, got, tc.credentials)
+		}
+
+		req = httptest.NewRequest("GET", "/api/search?q=water", nil)
+		req.Header.Set("Origin", tc.origin)
+		req.SetBasicAuth("alice", "secret")
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v %s: got status %d, want %d", tc.origins, tc.origin, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.wantAllow {
+			t.Errorf("%v %s: got Access-Control-Allow-Origin %q on GET, want %q", tc.origins, tc.origin, got, tc.wantAllow)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: "name"})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{Name: "f1", Content: []byte("water")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	mux, err := NewMux(&Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+		Compress: true,
+	})
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for accept, want := range map[string]string{
+		"":                     "",
+		"gzip":                 "gzip",
+		"gzip, deflate, zstd":  "zstd",
+		"zstd;q=0, gzip;q=0.5": "gzip",
+		"br":                   "",
+	} {
+		for _, path := range []string{"/api/search?q=water", "/api/stream?q=water", "/search?q=water"} {
+			req, err := http.NewRequest("GET", ts.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accept != "" {
+				req.Header.Set("Accept-Encoding", accept)
+			} else {
+				// Keep the client from asking for gzip itself.
+				req.Header.Set("Accept-Encoding", "identity")
+			}
+			res, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body io.Reader = res.Body
+			switch got := res.Header.Get("Content-Encoding"); {
+			case got != want:
+				t.Errorf("%s with %q: got Content-Encoding %q, want %q", path, accept, got, want)
+			case got == "gzip":
+				if body, err = gzip.NewReader(res.Body); err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+			case got == "zstd":
+				d, err := zstd.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("zstd.NewReader: %v", err)
+				}
+				defer d.Close()
+				body = d
+			}
+			content, err := ioutil.ReadAll(body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("%s with %q: ReadAll: %v", path, accept, err)
+			}
+			if !strings.Contains(string(content), "water") {
+				t.Errorf("%s with %q: got %q, want the match", path, accept, content)
+			}
+			if ct := res.Header.Get("Content-Type"); path == "/search?q=water" && !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("%s with %q: got Content-Type %q, want text/html", path, accept, ct)
+			}
+		}
+	}
+}
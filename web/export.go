@@ -0,0 +1,203 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/zoekt"
+)
+
+// defaultNumExport is the number of files exported by default.
+const defaultNumExport = 10000
+
+// exportWriter writes the rows of an export.
+type exportWriter interface {
+	header() error
+	write(row *ExportRow) error
+	flush() error
+}
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) header() error {
+	return e.w.Write([]string{"repository", "branches", "file", "line", "column", "text"})
+}
+
+func (e *csvExport) write(row *ExportRow) error {
+	return e.w.Write([]string{
+		row.Repository,
+		strings.Join(row.Branches, " "),
+		row.FileName,
+		strconv.Itoa(row.LineNumber),
+		strconv.Itoa(row.Column),
+		row.Line,
+	})
+}
+
+func (e *csvExport) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExport) header() error {
+	return nil
+}
+
+func (e *ndjsonExport) write(row *ExportRow) error {
+	return e.enc.Encode(row)
+}
+
+func (e *ndjsonExport) flush() error {
+	return nil
+}
+
+// newExportWriter returns the writer for the format "csv" or
+// "ndjson", and the content type and file name extension of its
+// output.
+func newExportWriter(format string, w io.Writer) (ew exportWriter, contentType, ext string, ok bool) {
+	switch format {
+	case "", "csv":
+		return &csvExport{w: csv.NewWriter(w)}, "text/csv; charset=utf-8", "csv", true
+	case "ndjson":
+		return &ndjsonExport{enc: json.NewEncoder(w)}, "application/x-ndjson", "ndjson", true
+	}
+	return nil, "", "", false
+}
+
+// exportRows returns a row for every matching line of f.
+func exportRows(f *zoekt.FileMatch) []ExportRow {
+	var rows []ExportRow
+	for _, m := range f.LineMatches {
+		row := ExportRow{
+			Repository: f.Repository,
+			Branches:   f.Branches,
+			FileName:   f.FileName,
+			Line:       string(m.Line),
+		}
+		if !m.FileName {
+			row.LineNumber = m.LineNumber
+		}
+		if len(m.LineFragments) > 0 {
+			row.Column = m.LineFragments[0].Column
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// serveExport runs a search and writes every matching line as CSV
+// or NDJSON, for download. The parameters are "q" for the query,
+// "format" for "csv" (the default) or "ndjson", and "num" for the
+// maximum number of files. Results are written as the search
+// streams them, so they are not sorted, and an error after the
+// first results ends the output early.
+func (s *Server) serveExport(w http.ResponseWriter, r *http.Request) {
+	qvals := r.URL.Query()
+	queryStr := qvals.Get("q")
+	if queryStr == "" {
+		http.Error(w, "no query found", http.StatusBadRequest)
+		return
+	}
+	q, err := parseQuery(r.Context(), queryStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	num, err := strconv.Atoi(qvals.Get("num"))
+	if err != nil || num <= 0 {
+		num = defaultNumExport
+	}
+	ew, contentType, ext, ok := newExportWriter(qvals.Get("format"), w)
+	if !ok {
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	sOpts, err := s.searchOptions(ctx, q, num)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	started := false
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="zoekt-results.`+ext+`"`)
+		return ew.header()
+	}
+
+	var writeErr error
+	sender := zoekt.SenderFunc(func(sr *zoekt.SearchResult) {
+		if writeErr != nil || len(sr.Files) == 0 {
+			return
+		}
+		writeErr = start()
+		for i := range sr.Files {
+			for _, row := range exportRows(&sr.Files[i]) {
+				if writeErr == nil {
+					writeErr = ew.write(&row)
+				}
+			}
+		}
+		if writeErr == nil {
+			writeErr = ew.flush()
+		}
+	})
+
+	if st, ok := s.Searcher.(zoekt.Streamer); ok {
+		err = st.StreamSearch(ctx, q, sOpts, sender)
+	} else {
+		var sr *zoekt.SearchResult
+		if sr, err = s.Searcher.Search(ctx, q, sOpts); err == nil {
+			sender.Send(sr)
+		}
+	}
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		if !started {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		slog.WarnContext(ctx, "export failed", "query", queryStr, "error", err)
+		return
+	}
+	if err := start(); err != nil {
+		slog.WarnContext(ctx, "export failed", "query", queryStr, "error", err)
+		return
+	}
+	if err := ew.flush(); err != nil {
+		slog.WarnContext(ctx, "export failed", "query", queryStr, "error", err)
+	}
+}
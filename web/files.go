@@ -0,0 +1,235 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// errNoFile is returned by fetchFile if the file is not in the index.
+var errNoFile = errors.New("file not found")
+
+// fileQuery returns the query for the file name of repo. If branch is
+// set, the file must be on that branch.
+func fileQuery(repo, branch, name string) (query.Q, error) {
+	re, err := syntax.Parse("^"+regexp.QuoteMeta(name)+"$", 0)
+	if err != nil {
+		return nil, err
+	}
+	var repoQ query.Q = query.NewRepoSet(repo)
+	if branch != "" {
+		repoQ = &query.RepoBranches{Set: map[string][]string{repo: {branch}}}
+	}
+	return query.NewAnd(
+		&query.Regexp{Regexp: re, FileName: true, CaseSensitive: true},
+		repoQ,
+	), nil
+}
+
+// fetchFile returns the file name of repo, including its content.
+func (s *Server) fetchFile(ctx context.Context, repo, branch, name string) (*zoekt.FileMatch, query.Q, error) {
+	q, err := fileQuery(repo, branch, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := s.Searcher.Search(ctx, q, &zoekt.SearchOptions{Whole: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(result.Files) == 0 {
+		return nil, nil, errNoFile
+	}
+	if len(result.Files) != 1 {
+		var ss []string
+		for _, n := range result.Files {
+			ss = append(ss, n.FileName)
+		}
+		return nil, nil, fmt.Errorf("ambiguous result: %v", ss)
+	}
+	return &result.Files[0], q, nil
+}
+
+// fileLines returns the lines of f as HTML, with the matches of
+// queryStr in bold and the code colored if highlighting is enabled.
+// It returns nil if there is nothing to mark up. fileQ selects f.
+func (s *Server) fileLines(ctx context.Context, f *zoekt.FileMatch, fileQ query.Q, queryStr string) []template.HTML {
+	var tokens [][]token
+	if s.highlight != nil {
+		key := highlightKey{repo: f.Repository, name: f.FileName, version: f.Version}
+		tokens = s.highlight.tokenize(key, f.Language, string(f.Content))
+	}
+
+	// line number => fragments
+	matches := map[int][]Fragment{}
+	if q, err := query.Parse(queryStr); queryStr != "" && err == nil {
+		if result, err := s.Searcher.Search(ctx, query.NewAnd(fileQ, q), &zoekt.SearchOptions{}); err == nil {
+			for _, fm := range result.Files {
+				for _, m := range fm.LineMatches {
+					if !m.FileName {
+						matches[m.LineNumber] = lineFragments(m)
+					}
+				}
+			}
+		}
+	}
+	if tokens == nil && len(matches) == 0 {
+		return nil
+	}
+
+	var html []template.HTML
+	for i, l := range splitLines(f.Content) {
+		line := []token{{text: l}}
+		if tokens != nil {
+			line = tokens[i]
+		}
+		if frags := matches[i+1]; len(frags) > 0 {
+			html = append(html, renderMatch(line, len(l), frags, len(l)+1))
+		} else {
+			html = append(html, renderLine(line))
+		}
+	}
+	return html
+}
+
+// rawURL returns the link to a file on the /raw/ endpoint, relative
+// to the root of the server.
+func rawURL(repo, branch, name string) string {
+	return "raw/" + (&url.URL{Path: repo + "@" + branch + "/" + name}).EscapedPath()
+}
+
+// parseRawPath splits a path of the /raw/ endpoint, of the form
+// <repo>@<branch>/<name>.
+func parseRawPath(p string) (repo, branch, name string, ok bool) {
+	i := strings.Index(p, "@")
+	if i <= 0 {
+		return "", "", "", false
+	}
+	repo, rest := p[:i], p[i+1:]
+	j := strings.Index(rest, "/")
+	if j <= 0 || j == len(rest)-1 {
+		return "", "", "", false
+	}
+	return repo, rest[:j], rest[j+1:], true
+}
+
+// serveRaw serves the content of a file as plain text.
+func (s *Server) serveRaw(w http.ResponseWriter, r *http.Request) {
+	repo, branch, name, ok := parseRawPath(strings.TrimPrefix(r.URL.Path, "/raw/"))
+	if !ok {
+		http.Error(w, "want /raw/<repo>@<branch>/<path>", http.StatusBadRequest)
+		return
+	}
+
+	f, _, err := s.fetchFile(r.Context(), repo, branch, name)
+	if err == errNoFile {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(f.Content)
+}
+
+// serveAPITree lists a directory of a repository as a TreeResponse.
+// The tree is computed from the indexed file names, so files that
+// were not indexed are missing. The parameters are "repo", "branch",
+// which defaults to all indexed branches, and "path" for the
+// directory, which defaults to the root.
+func (s *Server) serveAPITree(w http.ResponseWriter, r *http.Request) {
+	qvals := r.URL.Query()
+	repo := qvals.Get("repo")
+	if repo == "" {
+		http.Error(w, "no repo found", http.StatusBadRequest)
+		return
+	}
+	res, err := s.listTree(r.Context(), repo, qvals.Get("branch"), strings.Trim(qvals.Get("path"), "/"))
+	if err == errNoFile {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// listTree lists the directory dir of repo. It returns errNoFile
+// if no indexed file is in dir.
+func (s *Server) listTree(ctx context.Context, repo, branch, dir string) (*TreeResponse, error) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	re, err := syntax.Parse("^"+regexp.QuoteMeta(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	var repoQ query.Q = query.NewRepoSet(repo)
+	if branch != "" {
+		repoQ = &query.RepoBranches{Set: map[string][]string{repo: {branch}}}
+	}
+	q := query.NewAnd(
+		&query.Regexp{Regexp: re, FileName: true, CaseSensitive: true},
+		repoQ,
+	)
+	result, err := s.Searcher.Search(ctx, q, &zoekt.SearchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Files) == 0 {
+		return nil, errNoFile
+	}
+
+	// A file may be on several branches.
+	dirs := map[string]bool{}
+	for _, f := range result.Files {
+		name := strings.TrimPrefix(f.FileName, prefix)
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			dirs[name[:i]] = true
+		} else if _, ok := dirs[name]; !ok {
+			dirs[name] = false
+		}
+	}
+	res := &TreeResponse{Repo: repo, Branch: branch, Path: dir}
+	for name, isDir := range dirs {
+		res.Entries = append(res.Entries, TreeEntry{Name: name, Path: prefix + name, Dir: isDir})
+	}
+	sort.Slice(res.Entries, func(i, j int) bool {
+		a, b := res.Entries[i], res.Entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		return a.Name < b.Name
+	})
+	return res, nil
+}
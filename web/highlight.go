@@ -0,0 +1,245 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// highlightStyle is the chroma style used for the CSS classes of
+// highlighted code.
+const highlightStyle = "github"
+
+// highlightCSS returns the style sheet for highlighted code, which
+// is wrapped in an element of class "chroma".
+var highlightCSS = func() func() template.CSS {
+	var once sync.Once
+	var css template.CSS
+	return func() template.CSS {
+		once.Do(func() {
+			var buf bytes.Buffer
+			if err := chromahtml.New(chromahtml.WithClasses()).WriteCSS(&buf, styles.Get(highlightStyle)); err == nil {
+				css = template.CSS(buf.String())
+			}
+		})
+		return css
+	}
+}()
+
+// token is a piece of highlighted text. Class is the CSS class of
+// its token type, possibly empty.
+type token struct {
+	class string
+	text  string
+}
+
+// lexerFor returns the lexer for a file in the given language, or nil
+// if there is none.
+func lexerFor(language, name string) chroma.Lexer {
+	l := lexers.Get(language)
+	if l == nil {
+		l = lexers.Match(name)
+	}
+	if l == nil {
+		return nil
+	}
+	return chroma.Coalesce(l)
+}
+
+// tokenClass returns the CSS class for t, as used by the chroma HTML
+// formatter.
+func tokenClass(t chroma.TokenType) string {
+	for ; t != 0; t = t.Parent() {
+		if cls, ok := chroma.StandardTypes[t]; ok {
+			return cls
+		}
+	}
+	return chroma.StandardTypes[t]
+}
+
+// tokenizeLines splits content into lines of tokens. It returns nil
+// if the content cannot be tokenized, or if its lines differ from
+// those of splitLines, so callers can fall back to plain text.
+func tokenizeLines(language, name, content string) [][]token {
+	lexer := lexerFor(language, name)
+	if lexer == nil {
+		return nil
+	}
+	it, err := lexer.Tokenise(nil, content)
+	if err != nil {
+		return nil
+	}
+
+	lines := [][]token{nil}
+	for _, t := range it.Tokens() {
+		cls := tokenClass(t.Type)
+		parts := strings.Split(t.Value, "\n")
+		for i, p := range parts {
+			if i > 0 {
+				lines = append(lines, nil)
+			}
+			if i < len(parts)-1 {
+				p = strings.TrimSuffix(p, "\r")
+			}
+			if p != "" {
+				lines[len(lines)-1] = append(lines[len(lines)-1], token{cls, p})
+			}
+		}
+	}
+
+	// Lexers may add a trailing newline.
+	want := len(splitLines([]byte(content)))
+	if len(lines) == want+1 && len(lines[want]) == 0 {
+		lines = lines[:want]
+	}
+	if len(lines) != want {
+		return nil
+	}
+	return lines
+}
+
+// renderTokens writes the HTML for bytes [start, end) of a line.
+func renderTokens(buf *bytes.Buffer, line []token, start, end int) {
+	off := 0
+	for _, t := range line {
+		lo, hi := start-off, end-off
+		off += len(t.text)
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(t.text) {
+			hi = len(t.text)
+		}
+		if lo >= hi {
+			continue
+		}
+		text := template.HTMLEscapeString(t.text[lo:hi])
+		if t.class == "" {
+			buf.WriteString(text)
+		} else {
+			fmt.Fprintf(buf, `<span class="%s">%s</span>`, t.class, text)
+		}
+	}
+}
+
+// renderLine returns the HTML for a complete line.
+func renderLine(line []token) template.HTML {
+	var buf bytes.Buffer
+	renderTokens(&buf, line, 0, 1<<31-1)
+	return template.HTML(buf.String())
+}
+
+// renderMatch returns the HTML for a line of a search result, with
+// the fragments in bold. Like the LimitPre and LimitPost template
+// functions, it skips all but limit bytes of context around the
+// matches.
+func renderMatch(line []token, lineLen int, fragments []Fragment, limit int) template.HTML {
+	var buf bytes.Buffer
+	off := 0
+	for i, f := range fragments {
+		start := off + len(f.Pre)
+		if len(f.Pre) >= limit {
+			fmt.Fprintf(&buf, "...(%d bytes skipped)...", len(f.Pre)-limit)
+			off = start - limit
+		}
+		renderTokens(&buf, line, off, start)
+		buf.WriteString("<b>")
+		renderTokens(&buf, line, start, start+len(f.Match))
+		buf.WriteString("</b>")
+		off = start + len(f.Match)
+
+		if i == len(fragments)-1 {
+			if len(f.Post) >= limit {
+				renderTokens(&buf, line, off, off+limit)
+				fmt.Fprintf(&buf, "...(%d bytes skipped)...", len(f.Post)-limit)
+			} else {
+				renderTokens(&buf, line, off, lineLen)
+			}
+		}
+	}
+	return template.HTML(buf.String())
+}
+
+// highlightKey identifies a file, or a line of it if line is
+// positive.
+type highlightKey struct {
+	repo, name, version string
+	line                int
+}
+
+type highlightEntry struct {
+	key   highlightKey
+	lines [][]token
+	size  int
+}
+
+// highlightCache holds tokenized files and lines, so popular files
+// are not tokenized on every request. It evicts the least recently
+// used entries once it holds more than maxBytes of text.
+type highlightCache struct {
+	maxBytes int
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[highlightKey]*list.Element
+}
+
+func newHighlightCache(maxBytes int) *highlightCache {
+	return &highlightCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[highlightKey]*list.Element{},
+	}
+}
+
+// tokenize returns the lines of content, tokenized, from the cache if
+// possible. The version should identify the content.
+func (c *highlightCache) tokenize(key highlightKey, language, content string) [][]token {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*highlightEntry).lines
+	}
+	c.mu.Unlock()
+
+	lines := tokenizeLines(language, key.name, content)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok || len(content) > c.maxBytes {
+		return lines
+	}
+	c.entries[key] = c.lru.PushFront(&highlightEntry{key, lines, len(content)})
+	c.size += len(content)
+	for c.size > c.maxBytes {
+		e := c.lru.Back().Value.(*highlightEntry)
+		c.lru.Remove(c.entries[e.key])
+		delete(c.entries, e.key)
+		c.size -= e.size
+	}
+	return lines
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "zoekt_http_requests_total",
+		Help: "The number of HTTP requests, by handler and status code.",
+	}, []string{"handler", "code"})
+	metricRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zoekt_http_request_duration_seconds",
+		Help:    "The time taken to serve HTTP requests, by handler.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 9), // 1ms -> 65s
+	}, []string{"handler"})
+)
+
+// instrument wraps h so it records requests to the handler for
+// pattern.
+func instrument(pattern string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": pattern}
+	h = promhttp.InstrumentHandlerCounter(metricRequests.MustCurryWith(labels), h)
+	return promhttp.InstrumentHandlerDuration(metricRequestDuration.MustCurryWith(labels), h)
+}
@@ -0,0 +1,295 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie = "zoekt-session"
+	stateCookie   = "zoekt-oidc-state"
+)
+
+// OIDC authenticates users with an OpenID Connect provider, using the
+// authorization code flow. Users are identified by their email
+// address, or their subject if the provider does not return an
+// email. Logins with an email the provider has not verified are
+// refused. Sessions are kept in a signed cookie.
+type OIDC struct {
+	// Issuer is the URL of the provider, for example
+	// "https://accounts.google.com". Its endpoints are found
+	// through OpenID Connect discovery.
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the URL the provider sends users back to
+	// after logging in. Its path is served by the Server.
+	RedirectURL string
+
+	// SessionKey signs the session cookies. If empty, a random
+	// key is used, so sessions end when the server restarts.
+	SessionKey []byte
+
+	// SessionDuration is how long a login lasts. The default is
+	// 24 hours.
+	SessionDuration time.Duration
+
+	// mu guards discovery, which is retried until it succeeds.
+	mu     sync.Mutex
+	ready  bool
+	config oauth2.Config
+	// userinfo endpoint of the provider.
+	userinfo string
+	key      []byte
+}
+
+func (o *OIDC) init() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ready {
+		return nil
+	}
+
+	key := o.SessionKey
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+	}
+
+	resp, err := http.Get(strings.TrimSuffix(o.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC discovery for %s: %s", o.Issuer, resp.Status)
+	}
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("OIDC discovery for %s: %v", o.Issuer, err)
+	}
+	o.key = key
+	o.userinfo = doc.UserinfoEndpoint
+	o.config = oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Scopes:       []string{"openid", "email"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  doc.AuthorizationEndpoint,
+			TokenURL: doc.TokenEndpoint,
+		},
+	}
+	o.ready = true
+	return nil
+}
+
+func (o *OIDC) sessionDuration() time.Duration {
+	if o.SessionDuration == 0 {
+		return 24 * time.Hour
+	}
+	return o.SessionDuration
+}
+
+func (o *OIDC) secure() bool {
+	return strings.HasPrefix(o.RedirectURL, "https:")
+}
+
+func (o *OIDC) sign(payload string) string {
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// session returns the cookie value for a session of user that ends at
+// expiry.
+func (o *OIDC) session(user string, expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "|" + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "|" + o.sign(payload)
+}
+
+// checkSession returns the user of a session cookie value, if it is
+// valid.
+func (o *OIDC) checkSession(value string, now time.Time) (string, bool) {
+	i := strings.LastIndex(value, "|")
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(o.sign(value[:i]))) {
+		return "", false
+	}
+	fields := strings.Split(value[:i], "|")
+	if len(fields) != 2 {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return "", false
+	}
+	return string(user), true
+}
+
+// Authenticate implements Authenticator. Browsers without a session
+// are sent to the provider to log in; API requests get an error.
+func (o *OIDC) Authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if err := o.init(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if user, ok := o.checkSession(c.Value, time.Now()); ok {
+			return user, true
+		}
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") || r.Method != "GET" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	stateStr := hex.EncodeToString(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    stateStr + "|" + url.QueryEscape(r.URL.RequestURI()),
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   o.secure(),
+	})
+	http.Redirect(w, r, o.config.AuthCodeURL(stateStr), http.StatusFound)
+	return "", false
+}
+
+// CallbackPath implements authCallback.
+func (o *OIDC) CallbackPath() string {
+	u, err := url.Parse(o.RedirectURL)
+	if err != nil || u.Path == "" {
+		return "/oidc/callback"
+	}
+	return u.Path
+}
+
+// isLocalPath returns whether redirecting to p stays on this server.
+// Browsers read a backslash as a slash, so "/\host" leaves it too.
+func isLocalPath(p string) bool {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return false
+	}
+	u, err := url.Parse(p)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// ServeHTTP handles the redirect back from the provider: it checks
+// the login, starts a session and sends the user to the page they
+// asked for.
+func (o *OIDC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := o.init(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c, err := r.Cookie(stateCookie)
+	if err != nil {
+		http.Error(w, "missing login state", http.StatusBadRequest)
+		return
+	}
+	fields := strings.SplitN(c.Value, "|", 2)
+	if len(fields) != 2 || r.FormValue("state") != fields[0] {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	returnTo, err := url.QueryUnescape(fields[1])
+	if err != nil || !isLocalPath(returnTo) {
+		returnTo = "/"
+	}
+
+	tok, err := o.config.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("login failed: %v", err), http.StatusUnauthorized)
+		return
+	}
+	resp, err := o.config.Client(r.Context(), tok).Get(o.userinfo)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("userinfo: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, fmt.Sprintf("userinfo: %s", resp.Status), http.StatusBadGateway)
+		return
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		http.Error(w, fmt.Sprintf("userinfo: %v", err), http.StatusBadGateway)
+		return
+	}
+	if info.Email != "" && !info.EmailVerified {
+		http.Error(w, "email not verified", http.StatusForbidden)
+		return
+	}
+	user := info.Email
+	if user == "" {
+		user = info.Subject
+	}
+	if user == "" {
+		http.Error(w, "userinfo: no user", http.StatusBadGateway)
+		return
+	}
+
+	d := o.sessionDuration()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    o.session(user, time.Now().Add(d)),
+		Path:     "/",
+		MaxAge:   int(d / time.Second),
+		HttpOnly: true,
+		Secure:   o.secure(),
+	})
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
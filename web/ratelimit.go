@@ -0,0 +1,176 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits bounds the load a single client can put on the server.
+// Clients are identified by their user if the server has an
+// Authenticator, else by their IP address. Unverified credentials,
+// such as a bearer token without an Authenticator, do not identify
+// clients, as a client could send a new one with every request.
+type Limits struct {
+	// QPS is the sustained number of requests per second a
+	// client may make. Zero means no limit.
+	QPS float64
+
+	// Burst is the number of requests a client may make at once
+	// before QPS applies. It is at least 1.
+	Burst int
+
+	// MaxConcurrent is the number of requests a client may have
+	// running at once. Zero means no limit.
+	MaxConcurrent int
+
+	// If set, take the IP address of clients from the
+	// X-Forwarded-For header, as set by a reverse proxy. The last
+	// address is used, since the proxy appends the one it saw to
+	// those sent by the client.
+	TrustForwardedFor bool
+}
+
+// clientState is the usage of a single client.
+type clientState struct {
+	// Tokens left in the bucket, as of last.
+	tokens float64
+	last   time.Time
+
+	running int
+}
+
+// limiter enforces Limits.
+type limiter struct {
+	limits Limits
+	now    func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*clientState
+	swept   time.Time
+}
+
+func newLimiter(l Limits) *limiter {
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	return &limiter{
+		limits:  l,
+		now:     time.Now,
+		clients: map[string]*clientState{},
+	}
+}
+
+// clientKey identifies the client of r.
+func (l *limiter) clientKey(r *http.Request) string {
+	if user, ok := UserFromContext(r.Context()); ok {
+		return "user:" + user
+	}
+	if l.limits.TrustForwardedFor {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			addrs := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return "ip:" + ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// acquire admits a request of client. If it is rejected, it returns
+// false and how long the client should wait. Admitted requests must
+// call release when done.
+func (l *limiter) acquire(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	c := l.clients[client]
+	if c == nil {
+		c = &clientState{tokens: float64(l.limits.Burst), last: now}
+		l.clients[client] = c
+	}
+
+	if l.limits.MaxConcurrent > 0 && c.running >= l.limits.MaxConcurrent {
+		return false, time.Second
+	}
+	if l.limits.QPS > 0 {
+		c.tokens = math.Min(float64(l.limits.Burst), c.tokens+now.Sub(c.last).Seconds()*l.limits.QPS)
+		c.last = now
+		if c.tokens < 1 {
+			return false, time.Duration((1 - c.tokens) / l.limits.QPS * float64(time.Second))
+		}
+		c.tokens--
+	}
+	c.running++
+	return true, 0
+}
+
+func (l *limiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c := l.clients[client]; c != nil {
+		c.running--
+	}
+}
+
+// sweep forgets idle clients whose bucket is full, at most once a
+// minute. Must be called with mu held.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for k, c := range l.clients {
+		full := l.limits.QPS == 0 || c.tokens+now.Sub(c.last).Seconds()*l.limits.QPS >= float64(l.limits.Burst)
+		if c.running == 0 && full {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// limit wraps h so it rejects requests of clients that exceed the
+// Limits of the server.
+func (s *Server) limit(h http.Handler) http.Handler {
+	if s.limiter == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := s.limiter.clientKey(r)
+		ok, wait := s.limiter.acquire(client)
+		if !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer s.limiter.release(client)
+		h.ServeHTTP(w, r)
+	})
+}
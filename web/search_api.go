@@ -0,0 +1,126 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// serveAPISearch runs a search and returns a page of results as a
+// SearchResponse. The parameters are "q" for the query, "num" for
+// the number of files per page, "sort" for the order of the files
+// (score, path, repo or modtime) and "cursor" for the page to
+// return, taken from the NextCursor of the previous page. If the
+// query finds nothing, the response suggests relaxed queries.
+func (s *Server) serveAPISearch(w http.ResponseWriter, r *http.Request) {
+	res, err := s.apiSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) apiSearch(r *http.Request) (*SearchResponse, error) {
+	qvals := r.URL.Query()
+	queryStr := qvals.Get("q")
+	if queryStr == "" {
+		return nil, zoekt.Errorf(zoekt.CodeQueryParse, "no query found")
+	}
+	q, err := parseQuery(r.Context(), queryStr)
+	if err != nil {
+		return nil, zoekt.Errorf(zoekt.CodeQueryParse, "%v", err)
+	}
+	num, err := strconv.Atoi(qvals.Get("num"))
+	if err != nil || num <= 0 {
+		num = defaultNumResults
+	}
+
+	ctx := r.Context()
+	sOpts, err := s.searchOptions(ctx, q, num)
+	if err != nil {
+		return nil, err
+	}
+	sOpts.Cursor = qvals.Get("cursor")
+	if sOpts.SortBy, err = zoekt.ParseSortOrder(qvals.Get("sort")); err != nil {
+		return nil, err
+	}
+	sOpts.SuggestQueries = true
+
+	result, err := s.Searcher.Search(ctx, q, sOpts)
+	if err != nil {
+		return nil, err
+	}
+	fileMatches, err := s.formatResults(result, queryStr, s.Print)
+	if err != nil {
+		return nil, fmt.Errorf("formatResults: %v", err)
+	}
+	res := &SearchResponse{
+		Query:       q.String(),
+		Stats:       result.Stats,
+		FileMatches: fileMatches,
+		NextCursor:  result.NextCursor,
+	}
+	for _, sug := range result.Suggestions {
+		res.Suggestions = append(res.Suggestions, Suggestion{
+			Reason:    sug.Reason,
+			Query:     sug.Query.String(),
+			FileCount: sug.FileCount,
+		})
+	}
+	return res, nil
+}
+
+// serveAPIRepos lists the indexed repositories as a
+// RepoListResponse, with their size, index time and indexed commits.
+// The parameters are "q" for a query of repositories, such as
+// "r:foo", which defaults to all repositories, and "order" as for
+// the repository list page.
+func (s *Server) serveAPIRepos(w http.ResponseWriter, r *http.Request) {
+	res, err := s.apiRepos(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) apiRepos(r *http.Request) (*RepoListResponse, error) {
+	qvals := r.URL.Query()
+	var q query.Q = &query.Const{Value: true}
+	if queryStr := qvals.Get("q"); queryStr != "" {
+		var err error
+		q, err = parseQuery(r.Context(), queryStr)
+		if err != nil {
+			return nil, zoekt.Errorf(zoekt.CodeQueryParse, "%v", err)
+		}
+		if !isRepoQuery(q) {
+			return nil, zoekt.Errorf(zoekt.CodeQueryParse, "query %q does not only select repositories", queryStr)
+		}
+	}
+	stats, repos, err := s.listRepos(r.Context(), q, qvals.Get("order"))
+	if err != nil {
+		return nil, err
+	}
+	return &RepoListResponse{Stats: stats, Repos: repos}, nil
+}
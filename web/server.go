@@ -18,24 +18,27 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"regexp"
-	"regexp/syntax"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel"
 	"golang.org/x/net/context"
 
 	"github.com/google/zoekt"
+	"github.com/google/zoekt/logging"
 	"github.com/google/zoekt/query"
 	"github.com/google/zoekt/rpc"
+	"github.com/google/zoekt/tracing"
 )
 
+var tracer = otel.Tracer("github.com/google/zoekt/web")
+
 var Funcmap = template.FuncMap{
 	"Inc": func(orig int) int {
 		return orig + 1
@@ -65,6 +68,7 @@ var Funcmap = template.FuncMap{
 		}
 		return fmt.Sprintf("...(%d bytes skipped)...%s", len(pre)-limit, pre[len(pre)-limit:])
 	},
+	"HighlightCSS": highlightCSS,
 	"LimitPost": func(limit int, post string) string {
 		if len(post) < limit {
 			return post
@@ -75,6 +79,10 @@ var Funcmap = template.FuncMap{
 
 const defaultNumResults = 50
 
+// highlightCacheBytes is the amount of source code whose tokens are
+// kept for highlighting.
+const highlightCacheBytes = 64 << 20
+
 type Server struct {
 	Searcher zoekt.Searcher
 
@@ -84,9 +92,23 @@ type Server struct {
 	// Serve RPC
 	RPC bool
 
-	// If set, show files from the index.
+	// If set, show files from the index, and link all results
+	// to them.
 	Print bool
 
+	// If set, show files from the index on /print and /raw/, and
+	// link results to them if their repository has no
+	// FileURLTemplate.
+	ServeFiles bool
+
+	// If set, color the code in search results and shown files
+	// according to its language.
+	Highlight bool
+
+	// If set, serve the files in this directory on /static/, such
+	// as style sheets and images used by custom templates.
+	StaticDir string
+
 	// Version string for this server.
 	Version string
 
@@ -97,6 +119,53 @@ type Server struct {
 	// domains.
 	HostCustomQueries map[string]string
 
+	// If set, only serve users identified by Auth. See BasicAuth
+	// and OIDC.
+	Auth Authenticator
+
+	// If set, limit the repositories each user may search.
+	ACL RepoACL
+
+	// If set, serve several tenants: each request must carry the
+	// ID of its tenant in this HTTP header, and only sees the
+	// repositories of that tenant. The header must be set by a
+	// trusted proxy. Cannot be combined with RPC, whose calls
+	// carry their own tenant.
+	TenantHeader string
+
+	// If set, limit the requests of each client.
+	Limits *Limits
+
+	// If set, serve the shards for replication on /replicate/,
+	// eg. a replicate.Handler. Like the other endpoints, it
+	// requires Auth and obeys Limits. Since it serves the shards
+	// of all repositories, it cannot be combined with ACL or
+	// TenantHeader.
+	Replication http.Handler
+
+	// If set, compress responses with zstd or gzip for clients
+	// that accept it.
+	Compress bool
+
+	// If set, log every request with its status and duration.
+	AccessLog bool
+
+	// Web page origins, such as "https://tools.example.com", from
+	// which browsers may call the server, for example to use the
+	// JSON API. "*" allows any origin.
+	CORSOrigins []string
+
+	// Budgets for each search, see zoekt.SearchOptions. Zero
+	// means no limit.
+	MaxMatchBytes    int64
+	MaxCandidateDocs int
+	MaxRegexpSize    int
+
+	// If set, record the repositories and files in search
+	// results, and serve their popularity on /api/popularity.
+	// Cannot be combined with ACL or TenantHeader.
+	Analytics *Analytics
+
 	// This should contain the following templates: "didyoumean"
 	// (for suggestions), "repolist" (for the repo search result
 	// page), "result" for the search results, "search" (for the
@@ -116,6 +185,9 @@ type Server struct {
 	templateMu    sync.Mutex
 	templateCache map[string]*template.Template
 
+	highlight *highlightCache
+	limiter   *limiter
+
 	lastStatsMu sync.Mutex
 	lastStats   *zoekt.RepoStats
 	lastStatsTS time.Time
@@ -131,7 +203,7 @@ func (s *Server) getTemplate(str string) *template.Template {
 
 	t, err := template.New("cache").Parse(str)
 	if err != nil {
-		log.Printf("template parse error: %v", err)
+		slog.Warn("template parse error", "template", str, "error", err)
 		t = template.Must(template.New("empty").Parse(""))
 	}
 	s.templateCache[str] = t
@@ -160,19 +232,79 @@ func NewMux(s *Server) (*http.ServeMux, error) {
 
 	s.templateCache = map[string]*template.Template{}
 	s.startTime = time.Now()
+	if s.Highlight {
+		s.highlight = newHighlightCache(highlightCacheBytes)
+	}
+
+	if s.Replication != nil && (s.ACL != nil || s.TenantHeader != "") {
+		return nil, fmt.Errorf("replication does not support repository ACLs or tenants")
+	}
+
+	// RPC clients pick the tenant of their searches themselves.
+	if s.TenantHeader != "" && s.RPC {
+		return nil, fmt.Errorf("RPC does not support tenants")
+	}
+
+	if s.ACL != nil {
+		if s.RPC {
+			return nil, fmt.Errorf("RPC does not support repository ACLs")
+		}
+		// Popularity would show the results of all users.
+		if s.Analytics != nil {
+			return nil, fmt.Errorf("analytics do not support repository ACLs")
+		}
+		s.Searcher = &aclSearcher{Searcher: s.Searcher, acl: s.ACL}
+	}
+
+	if s.TenantHeader != "" && s.Analytics != nil {
+		return nil, fmt.Errorf("analytics do not support tenants")
+	}
+
+	if s.Limits != nil {
+		s.limiter = newLimiter(*s.Limits)
+	}
 
 	mux := http.NewServeMux()
+	wrap := func(pattern string, h http.Handler) http.Handler {
+		h = tracing.Handler(pattern, instrument(pattern, s.cors(s.authenticate(s.limit(h)))))
+		if s.AccessLog {
+			h = logging.AccessHandler(h)
+		}
+		return logging.Handler(h)
+	}
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, wrap(pattern, s.compress(s.tenant(h))))
+	}
 
 	if s.HTML {
-		mux.HandleFunc("/search", s.serveSearch)
-		mux.HandleFunc("/", s.serveSearchBox)
-		mux.HandleFunc("/about", s.serveAbout)
+		handle("/search", http.HandlerFunc(s.serveSearch))
+		handle("/", http.HandlerFunc(s.serveSearchBox))
+		handle("/about", http.HandlerFunc(s.serveAbout))
+		handle("/api/search", http.HandlerFunc(s.serveAPISearch))
+		handle("/api/stream", http.HandlerFunc(s.serveStream))
+		handle("/api/suggest", http.HandlerFunc(s.serveAPISuggest))
+		handle("/api/repos", http.HandlerFunc(s.serveAPIRepos))
+		handle("/api/tree", http.HandlerFunc(s.serveAPITree))
+		handle("/export", http.HandlerFunc(s.serveExport))
+		if s.StaticDir != "" {
+			handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(s.StaticDir))))
+		}
 	}
 	if s.RPC {
-		mux.Handle(rpc.DefaultRPCPath, rpc.Server(s.Searcher)) // /rpc
+		mux.Handle(rpc.DefaultRPCPath, wrap(rpc.DefaultRPCPath, rpc.Server(s.Searcher))) // /rpc
+	}
+	if s.Print || s.ServeFiles {
+		handle("/print", http.HandlerFunc(s.servePrint))
+		handle("/raw/", http.HandlerFunc(s.serveRaw))
+	}
+	if s.Analytics != nil {
+		handle("/api/popularity", s.Analytics)
+	}
+	if s.Replication != nil {
+		mux.Handle("/replicate/", wrap("/replicate/", http.StripPrefix("/replicate", s.Replication)))
 	}
-	if s.Print {
-		mux.HandleFunc("/print", s.servePrint)
+	if cb, ok := s.Auth.(authCallback); ok {
+		mux.Handle(cb.CallbackPath(), cb)
 	}
 	return mux, nil
 }
@@ -190,11 +322,33 @@ func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The searcher is overloaded; ask the client to come back later.
+	if tmp, ok := err.(interface{ Temporary() bool }); ok && tmp.Temporary() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusTeapot)
+		http.Error(w, err.Error(), errorStatus(err))
 	}
 }
 
+// errorStatus returns the HTTP status for a search error.
+func errorStatus(err error) int {
+	switch zoekt.ErrorCodeOf(err) {
+	case zoekt.CodeQueryParse, zoekt.CodeQueryTooExpensive:
+		return http.StatusBadRequest
+	case zoekt.CodePermissionDenied:
+		return http.StatusForbidden
+	case zoekt.CodeOverloaded, zoekt.CodeIndexStale:
+		return http.StatusServiceUnavailable
+	case zoekt.CodeShardCorrupt:
+		return http.StatusInternalServerError
+	}
+	return http.StatusTeapot
+}
+
 func (s *Server) serveSearchErr(w http.ResponseWriter, r *http.Request) error {
 	qvals := r.URL.Query()
 	queryStr := qvals.Get("q")
@@ -202,18 +356,15 @@ func (s *Server) serveSearchErr(w http.ResponseWriter, r *http.Request) error {
 		return fmt.Errorf("no query found")
 	}
 
-	log.Printf("got query %q", queryStr)
-	q, err := query.Parse(queryStr)
-	if err != nil {
+	slog.InfoContext(r.Context(), "search", "query", queryStr)
+	q, err := parseQuery(r.Context(), queryStr)
+	if _, ok := err.(*query.SuggestQueryError); ok {
 		return err
+	} else if err != nil {
+		return zoekt.Errorf(zoekt.CodeQueryParse, "%v", err)
 	}
 
-	repoOnly := true
-	query.VisitAtoms(q, func(q query.Q) {
-		_, ok := q.(*query.Repo)
-		repoOnly = repoOnly && ok
-	})
-	if repoOnly {
+	if isRepoQuery(q) {
 		return s.serveListReposErr(q, queryStr, w, r)
 	}
 
@@ -224,43 +375,20 @@ func (s *Server) serveSearchErr(w http.ResponseWriter, r *http.Request) error {
 		num = defaultNumResults
 	}
 
-	sOpts := zoekt.SearchOptions{
-		MaxWallTime: 10 * time.Second,
-	}
-
-	sOpts.SetDefaults()
-
 	ctx := r.Context()
-	if result, err := s.Searcher.Search(ctx, q, &zoekt.SearchOptions{EstimateDocCount: true}); err != nil {
+	sOpts, err := s.searchOptions(ctx, q, num)
+	if err != nil {
 		return err
-	} else if numdocs := result.ShardFilesConsidered; numdocs > 10000 {
-		// If the search touches many shards and many files, we
-		// have to limit the number of matches.  This setting
-		// is based on the number of documents eligible after
-		// considering reponames, so large repos (both
-		// android, chromium are about 500k files) aren't
-		// covered fairly.
-
-		// 10k docs, 50 num -> max match = (250 + 250 / 10)
-		sOpts.ShardMaxMatchCount = num*5 + (5*num)/(numdocs/1000)
-
-		// 10k docs, 50 num -> max important match = 4
-		sOpts.ShardMaxImportantMatch = num/20 + num/(numdocs/500)
-	} else {
-		// Virtually no limits for a small corpus; important
-		// matches are just as expensive as normal matches.
-		n := numdocs + num*100
-		sOpts.ShardMaxImportantMatch = n
-		sOpts.ShardMaxMatchCount = n
-		sOpts.TotalMaxMatchCount = n
-		sOpts.TotalMaxImportantMatch = n
 	}
-	sOpts.MaxDocDisplayCount = num
+	sOpts.Cursor = qvals.Get("cursor")
 
-	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	result, err := s.Searcher.Search(ctx, q, sOpts)
 	if err != nil {
 		return err
 	}
+	if s.Analytics != nil {
+		s.Analytics.Record(result)
+	}
 
 	fileMatches, err := s.formatResults(result, queryStr, s.Print)
 	if err != nil {
@@ -278,6 +406,7 @@ func (s *Server) serveSearchErr(w http.ResponseWriter, r *http.Request) error {
 		QueryStr:      queryStr,
 		SearchOptions: sOpts.String(),
 		FileMatches:   fileMatches,
+		NextCursor:    result.NextCursor,
 	}
 	if res.Stats.Wait < res.Stats.Duration/10 {
 		// Suppress queueing stats if they are neglible.
@@ -293,9 +422,60 @@ func (s *Server) serveSearchErr(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// parseQuery parses queryStr in a span of the trace of ctx.
+func parseQuery(ctx context.Context, queryStr string) (query.Q, error) {
+	_, span := tracer.Start(ctx, "query.Parse")
+	q, err := query.Parse(queryStr)
+	tracing.End(span, err)
+	return q, err
+}
+
+// searchOptions returns the options for a search for q showing num
+// files. The match limits depend on the number of documents the
+// search considers.
+func (s *Server) searchOptions(ctx context.Context, q query.Q, num int) (*zoekt.SearchOptions, error) {
+	sOpts := &zoekt.SearchOptions{
+		MaxWallTime:      10 * time.Second,
+		MaxMatchBytes:    s.MaxMatchBytes,
+		MaxCandidateDocs: s.MaxCandidateDocs,
+		MaxRegexpSize:    s.MaxRegexpSize,
+	}
+
+	sOpts.SetDefaults()
+
+	if result, err := s.Searcher.Search(ctx, q, &zoekt.SearchOptions{EstimateDocCount: true}); err != nil {
+		return nil, err
+	} else if numdocs := result.ShardFilesConsidered; numdocs > 10000 {
+		// If the search touches many shards and many files, we
+		// have to limit the number of matches.  This setting
+		// is based on the number of documents eligible after
+		// considering reponames, so large repos (both
+		// android, chromium are about 500k files) aren't
+		// covered fairly.
+
+		// 10k docs, 50 num -> max match = (250 + 250 / 10)
+		sOpts.ShardMaxMatchCount = num*5 + (5*num)/(numdocs/1000)
+
+		// 10k docs, 50 num -> max important match = 4
+		sOpts.ShardMaxImportantMatch = num/20 + num/(numdocs/500)
+	} else {
+		// Virtually no limits for a small corpus; important
+		// matches are just as expensive as normal matches.
+		n := numdocs + num*100
+		sOpts.ShardMaxImportantMatch = n
+		sOpts.ShardMaxMatchCount = n
+		sOpts.TotalMaxMatchCount = n
+		sOpts.TotalMaxImportantMatch = n
+	}
+	sOpts.MaxDocDisplayCount = num
+	return sOpts, nil
+}
+
 func (s *Server) servePrint(w http.ResponseWriter, r *http.Request) {
 	err := s.servePrintErr(w, r)
-	if err != nil {
+	if err == errNoFile {
+		http.NotFound(w, r)
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusTeapot)
 	}
 }
@@ -305,7 +485,9 @@ const statsStaleNess = 30 * time.Second
 func (s *Server) fetchStats(ctx context.Context) (*zoekt.RepoStats, error) {
 	s.lastStatsMu.Lock()
 	stats := s.lastStats
-	if time.Now().Sub(s.lastStatsTS) > statsStaleNess {
+	if time.Now().Sub(s.lastStatsTS) > statsStaleNess || s.ACL != nil || s.TenantHeader != "" {
+		// The stats depend on the repositories the user may
+		// search.
 		stats = nil
 	}
 	s.lastStatsMu.Unlock()
@@ -404,14 +586,50 @@ func (s *Server) serveAbout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) serveListReposErr(q query.Q, qStr string, w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
-	repos, err := s.Searcher.List(ctx, q)
+	stats, repos, err := s.listRepos(r.Context(), q, r.URL.Query().Get("order"))
 	if err != nil {
 		return err
 	}
+	res := RepoListInput{
+		Last: LastInput{
+			Query:     qStr,
+			AutoFocus: true,
+		},
+		Stats: stats,
+		Repos: repos,
+	}
+
+	var buf bytes.Buffer
+	if err := s.repolist.Execute(&buf, &res); err != nil {
+		return err
+	}
+
+	w.Write(buf.Bytes())
+	return nil
+}
+
+// isRepoQuery returns whether q only selects repositories, so it
+// can be answered by listing them.
+func isRepoQuery(q query.Q) bool {
+	repoOnly := true
+	query.VisitAtoms(q, func(q query.Q) {
+		switch q.(type) {
+		case *query.Repo, *query.RepoRegexp, *query.RepoFlag, *query.RepoDescription, *query.Topic:
+		default:
+			repoOnly = false
+		}
+	})
+	return repoOnly
+}
+
+// listRepos lists the repositories matching q, in the given order:
+// "name", "size" or "time", or their reverse such as "revname".
+func (s *Server) listRepos(ctx context.Context, q query.Q, order string) (zoekt.RepoStats, []Repository, error) {
+	repos, err := s.Searcher.List(ctx, q)
+	if err != nil {
+		return zoekt.RepoStats{}, nil, err
+	}
 
-	qvals := r.URL.Query()
-	order := qvals.Get("order")
 	switch order {
 	case "", "name", "revname":
 		sort.Slice(repos.Repos, func(i, j int) bool {
@@ -427,7 +645,7 @@ func (s *Server) serveListReposErr(q query.Q, qStr string, w http.ResponseWriter
 				repos.Repos[j].IndexMetadata.IndexTime)
 		})
 	default:
-		return fmt.Errorf("got unknown sort key %q, allowed [rev]name, [rev]time, [rev]size", order)
+		return zoekt.RepoStats{}, nil, zoekt.Errorf(zoekt.CodeQueryParse, "got unknown sort key %q, allowed [rev]name, [rev]time, [rev]size", order)
 	}
 	if strings.HasPrefix(order, "rev") {
 		for i, j := 0, len(repos.Repos)-1; i < j; {
@@ -444,28 +662,26 @@ func (s *Server) serveListReposErr(q query.Q, qStr string, w http.ResponseWriter
 	for _, s := range repos.Repos {
 		aggregate.Add(&s.Stats)
 	}
-	res := RepoListInput{
-		Last: LastInput{
-			Query:     qStr,
-			AutoFocus: true,
-		},
-		Stats: aggregate,
-	}
 
+	var res []Repository
 	for _, r := range repos.Repos {
 		t := s.getTemplate(r.Repository.CommitURLTemplate)
 
 		repo := Repository{
-			Name:      r.Repository.Name,
-			URL:       r.Repository.URL,
-			IndexTime: r.IndexMetadata.IndexTime,
-			Size:      r.Stats.ContentBytes,
-			Files:     int64(r.Stats.Documents),
+			Name:        r.Repository.Name,
+			ID:          r.Repository.ID,
+			URL:         r.Repository.URL,
+			Description: r.Repository.Description,
+			Topics:      r.Repository.Topics,
+			IndexTime:   r.IndexMetadata.IndexTime,
+			Size:        r.Stats.ContentBytes,
+			Files:       int64(r.Stats.Documents),
+			ShardFiles:  r.ShardFiles,
 		}
 		for _, b := range r.Repository.Branches {
 			var buf bytes.Buffer
 			if err := t.Execute(&buf, b); err != nil {
-				return err
+				return zoekt.RepoStats{}, nil, err
 			}
 			repo.Branches = append(repo.Branches,
 				Branch{
@@ -474,20 +690,13 @@ func (s *Server) serveListReposErr(q query.Q, qStr string, w http.ResponseWriter
 					URL:     buf.String(),
 				})
 		}
-		res.Repos = append(res.Repos, repo)
-	}
-
-	var buf bytes.Buffer
-	if err := s.repolist.Execute(&buf, &res); err != nil {
-		return err
+		res = append(res, repo)
 	}
-
-	w.Write(buf.Bytes())
-	return nil
+	return aggregate, res, nil
 }
 
 func (s *Server) servePrintErr(w http.ResponseWriter, r *http.Request) error {
-	if !s.Print {
+	if !s.Print && !s.ServeFiles {
 		return fmt.Errorf("no printing template defined.")
 	}
 
@@ -501,46 +710,13 @@ func (s *Server) servePrintErr(w http.ResponseWriter, r *http.Request) error {
 		num = defaultNumResults
 	}
 
-	re, err := syntax.Parse("^"+regexp.QuoteMeta(fileStr)+"$", 0)
-	if err != nil {
-		return err
-	}
-	qs := []query.Q{
-		&query.Regexp{Regexp: re, FileName: true, CaseSensitive: true},
-		&query.Repo{Pattern: repoStr},
-	}
-
-	if branchStr := qvals.Get("b"); branchStr != "" {
-		qs = append(qs, &query.Branch{Pattern: branchStr})
-	}
-
-	q := &query.And{Children: qs}
-
-	sOpts := zoekt.SearchOptions{
-		Whole: true,
-	}
-
 	ctx := r.Context()
-	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	f, fileQ, err := s.fetchFile(ctx, repoStr, qvals.Get("b"), fileStr)
 	if err != nil {
 		return err
 	}
 
-	if len(result.Files) != 1 {
-		var ss []string
-		for _, n := range result.Files {
-			ss = append(ss, n.FileName)
-		}
-		return fmt.Errorf("ambiguous result: %v", ss)
-	}
-
-	f := result.Files[0]
-
-	byteLines := bytes.Split(f.Content, []byte{'\n'})
-	strLines := make([]string, 0, len(byteLines))
-	for _, l := range byteLines {
-		strLines = append(strLines, string(l))
-	}
+	strLines := splitLines(f.Content)
 
 	d := PrintInput{
 		Name:  f.FileName,
@@ -552,6 +728,10 @@ func (s *Server) servePrintErr(w http.ResponseWriter, r *http.Request) error {
 			AutoFocus: false,
 		},
 	}
+	if len(f.Branches) > 0 {
+		d.RawURL = rawURL(f.Repository, f.Branches[0], f.FileName)
+	}
+	d.HighlightedLines = s.fileLines(ctx, f, fileQ, queryStr)
 
 	var buf bytes.Buffer
 	if err := s.print.Execute(&buf, &d); err != nil {
@@ -561,3 +741,24 @@ func (s *Server) servePrintErr(w http.ResponseWriter, r *http.Request) error {
 	w.Write(buf.Bytes())
 	return nil
 }
+
+// splitLines splits content into lines. Like the index, it accepts
+// "\n", "\r\n" and a lone "\r" as line terminators.
+func splitLines(content []byte) []string {
+	var lines []string
+	start := 0
+	for i := 0; i < len(content); i++ {
+		switch content[i] {
+		case '\r':
+			lines = append(lines, string(content[start:i]))
+			if i+1 < len(content) && content[i+1] == '\n' {
+				i++
+			}
+			start = i + 1
+		case '\n':
+			lines = append(lines, string(content[start:i]))
+			start = i + 1
+		}
+	}
+	return append(lines, string(content[start:]))
+}
@@ -25,6 +25,11 @@ import (
 	"github.com/google/zoekt"
 )
 
+// snippetContext is the number of bytes shown around matches in
+// highlighted results, like the LimitPre and LimitPost calls of the
+// results template.
+const snippetContext = 100
+
 func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPrint bool) ([]*FileMatch, error) {
 	var fmatches []*FileMatch
 
@@ -32,14 +37,23 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 	fragmentMap := map[string]*template.Template{}
 	if !localPrint {
 		for repo, str := range result.RepoURLs {
-			templateMap[repo] = s.getTemplate(str)
+			if str != "" {
+				templateMap[repo] = s.getTemplate(str)
+			}
 		}
 		for repo, str := range result.LineFragments {
-			fragmentMap[repo] = s.getTemplate(str)
+			if str != "" {
+				fragmentMap[repo] = s.getTemplate(str)
+			}
 		}
 	}
+	// local returns whether results of repo link to the file view
+	// of this server.
+	local := func(repo string) bool {
+		return localPrint || s.ServeFiles && templateMap[repo] == nil
+	}
 	getFragment := func(repo string, linenum int) string {
-		if localPrint {
+		if local(repo) {
 			return "#l" + strconv.Itoa(linenum)
 		}
 		if tpl := fragmentMap[repo]; tpl != nil {
@@ -55,7 +69,7 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 		return ""
 	}
 	getURL := func(repo, filename string, branches []string, version string) string {
-		if localPrint {
+		if local(repo) {
 			v := make(url.Values)
 			v.Add("r", repo)
 			v.Add("f", filename)
@@ -92,9 +106,12 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 		fMatch := FileMatch{
 			FileName: f.FileName,
 			Repo:     f.Repository,
+			RepoID:   f.RepositoryID,
 			ResultID: f.Repository + ":" + f.FileName,
 			Branches: f.Branches,
 			Language: f.Language,
+			Size:     f.Size,
+			ModTime:  f.ModTime,
 		}
 
 		if dup, ok := seenFiles[string(f.Checksum)]; ok {
@@ -103,7 +120,11 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 			seenFiles[string(f.Checksum)] = fMatch.ResultID
 		}
 
-		if f.SubRepositoryName != "" {
+		// Files from a subrepository link to the origin of that
+		// subrepository, using its own URL templates.
+		urlRepo := f.Repository
+		if f.SubRepositoryName != "" && !local(f.SubRepositoryName) {
+			urlRepo = f.SubRepositoryName
 			fn := strings.TrimPrefix(fMatch.FileName[len(f.SubRepositoryPath):], "/")
 			fMatch.URL = getURL(f.SubRepositoryName, fn, f.Branches, f.Version)
 		} else {
@@ -111,7 +132,7 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 		}
 
 		for _, m := range f.LineMatches {
-			fragment := getFragment(f.Repository, m.LineNumber)
+			fragment := getFragment(urlRepo, m.LineNumber)
 			if !strings.HasPrefix(fragment, "#") && !strings.HasPrefix(fragment, ";") {
 				// TODO - remove this is backward compatibility glue.
 				fragment = "#" + fragment
@@ -122,22 +143,12 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 				URL:      fMatch.URL + fragment,
 			}
 
-			lastEnd := 0
-			line := m.Line
-			for i, f := range m.LineFragments {
-				l := f.LineOffset
-				e := l + f.MatchLength
-
-				frag := Fragment{
-					Pre:   string(line[lastEnd:l]),
-					Match: string(line[l:e]),
-				}
-				if i == len(m.LineFragments)-1 {
-					frag.Post = string(m.Line[e:])
+			md.Fragments = lineFragments(m)
+			if s.highlight != nil && len(md.Fragments) > 0 {
+				key := highlightKey{repo: f.Repository, name: f.FileName, version: f.Version, line: m.LineNumber}
+				if lines := s.highlight.tokenize(key, f.Language, string(m.Line)); len(lines) == 1 {
+					md.Highlighted = renderMatch(lines[0], len(m.Line), md.Fragments, snippetContext)
 				}
-
-				md.Fragments = append(md.Fragments, frag)
-				lastEnd = e
 			}
 			fMatch.Matches = append(fMatch.Matches, md)
 		}
@@ -145,3 +156,28 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 	}
 	return fmatches, nil
 }
+
+// lineFragments splits the line of m into fragments around its
+// matches.
+func lineFragments(m zoekt.LineMatch) []Fragment {
+	var frags []Fragment
+	lastEnd := 0
+	line := m.Line
+	for i, f := range m.LineFragments {
+		l := f.LineOffset
+		e := l + f.MatchLength
+
+		frag := Fragment{
+			Pre:    string(line[lastEnd:l]),
+			Match:  string(line[l:e]),
+			Column: f.Column,
+		}
+		if i == len(m.LineFragments)-1 {
+			frag.Post = string(m.Line[e:])
+		}
+
+		frags = append(frags, frag)
+		lastEnd = e
+	}
+	return frags
+}
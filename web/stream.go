@@ -0,0 +1,150 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/google/zoekt"
+)
+
+// StreamMatches is the data of a "matches" event of the /api/stream
+// endpoint.
+type StreamMatches struct {
+	FileMatches []*FileMatch
+}
+
+// StreamDone is the data of the final "done" event of the
+// /api/stream endpoint.
+type StreamDone struct {
+	Stats zoekt.Stats
+}
+
+// StreamError is the data of an "error" event of the /api/stream
+// endpoint. Code is the zoekt.ErrorCode of the error, if any.
+type StreamError struct {
+	Error string
+	Code  string `json:",omitempty"`
+}
+
+// eventWriter writes server-sent events.
+type eventWriter struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (e *eventWriter) event(name string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", name, buf); err != nil {
+		return err
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
+
+func (e *eventWriter) error(err error) {
+	se := StreamError{Error: err.Error()}
+	if code := zoekt.ErrorCodeOf(err); code != zoekt.CodeUnknown {
+		se.Code = code.String()
+	}
+	if err := e.event("error", &se); err != nil {
+		slog.WarnContext(e.ctx, "stream write failed", "error", err)
+	}
+}
+
+// serveStream runs a search and sends the results as server-sent
+// events: a "matches" event for every batch of files, typically one
+// per shard, followed by a "done" event with the statistics of the
+// search. Failures are sent as an "error" event.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	qvals := r.URL.Query()
+	queryStr := qvals.Get("q")
+	if queryStr == "" {
+		http.Error(w, "no query found", http.StatusBadRequest)
+		return
+	}
+	q, err := parseQuery(r.Context(), queryStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	num, err := strconv.Atoi(qvals.Get("num"))
+	if err != nil || num <= 0 {
+		num = defaultNumResults
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ew := &eventWriter{ctx: r.Context(), w: w}
+	ew.flusher, _ = w.(http.Flusher)
+
+	ctx := r.Context()
+	sOpts, err := s.searchOptions(ctx, q, num)
+	if err != nil {
+		ew.error(err)
+		return
+	}
+
+	var final *zoekt.SearchResult
+	var sendErr error
+	sender := zoekt.SenderFunc(func(sr *zoekt.SearchResult) {
+		if len(sr.Files) == 0 {
+			final = sr
+			return
+		}
+		if sendErr != nil {
+			return
+		}
+		fileMatches, err := s.formatResults(sr, queryStr, s.Print)
+		if err == nil {
+			err = ew.event("matches", &StreamMatches{FileMatches: fileMatches})
+		}
+		sendErr = err
+	})
+
+	if st, ok := s.Searcher.(zoekt.Streamer); ok {
+		err = st.StreamSearch(ctx, q, sOpts, sender)
+	} else {
+		var sr *zoekt.SearchResult
+		if sr, err = s.Searcher.Search(ctx, q, sOpts); err == nil {
+			sender.Send(sr)
+			sender.Send(&zoekt.SearchResult{Stats: sr.Stats})
+		}
+	}
+	if err == nil {
+		err = sendErr
+	}
+	if err != nil {
+		ew.error(err)
+		return
+	}
+	if final == nil {
+		final = &zoekt.SearchResult{}
+	}
+	if err := ew.event("done", &StreamDone{Stats: final.Stats}); err != nil {
+		slog.WarnContext(ctx, "stream write failed", "error", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// defaultNumSuggestions is the number of suggestions of each kind
+// that /api/suggest returns by default.
+const defaultNumSuggestions = 10
+
+// suggestWallTime bounds the searches for suggestions, which must
+// keep up with typing.
+const suggestWallTime = time.Second
+
+// minSymbolPrefix is the shortest prefix for which symbols are
+// suggested. Symbol search needs a full ngram.
+const minSymbolPrefix = 3
+
+// serveAPISuggest suggests repositories, files and symbols that
+// start with the "prefix" parameter, for autocompletion in the query
+// box. The "num" parameter limits the suggestions of each kind.
+func (s *Server) serveAPISuggest(w http.ResponseWriter, r *http.Request) {
+	qvals := r.URL.Query()
+	prefix := qvals.Get("prefix")
+	if prefix == "" {
+		http.Error(w, "no prefix found", http.StatusBadRequest)
+		return
+	}
+	num, err := strconv.Atoi(qvals.Get("num"))
+	if err != nil || num <= 0 {
+		num = defaultNumSuggestions
+	}
+
+	res, err := s.suggest(r.Context(), prefix, num)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) suggest(ctx context.Context, prefix string, num int) (*SuggestResponse, error) {
+	res := &SuggestResponse{}
+
+	// Repository names come from the shard metadata.
+	re := regexp.MustCompile(`(?i)(^|/)` + regexp.QuoteMeta(prefix))
+	repos, err := s.Searcher.List(ctx, &query.RepoRegexp{Regexp: re})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range repos.Repos {
+		res.Repos = append(res.Repos, r.Repository.Name)
+	}
+	sort.Slice(res.Repos, func(i, j int) bool {
+		// Names that start with the prefix come first.
+		pi, pj := hasPrefixFold(res.Repos[i], prefix), hasPrefixFold(res.Repos[j], prefix)
+		if pi != pj {
+			return pi
+		}
+		return res.Repos[i] < res.Repos[j]
+	})
+	if len(res.Repos) > num {
+		res.Repos = res.Repos[:num]
+	}
+
+	// File names and symbols come from searches, which return the
+	// best matches first.
+	opts := &zoekt.SearchOptions{
+		MaxWallTime:        suggestWallTime,
+		ShardMaxMatchCount: 10 * num,
+		TotalMaxMatchCount: 10 * num,
+		MaxDocDisplayCount: 10 * num,
+	}
+	files, err := s.Searcher.Search(ctx, &query.Substring{Pattern: prefix, FileName: true}, opts)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, f := range files.Files {
+		if len(res.Files) == num {
+			break
+		}
+		if !seen[f.FileName] && componentHasPrefix(f.FileName, prefix) {
+			seen[f.FileName] = true
+			res.Files = append(res.Files, f.FileName)
+		}
+	}
+
+	if utf8.RuneCountInString(prefix) < minSymbolPrefix {
+		return res, nil
+	}
+	syms, err := s.Searcher.Search(ctx, &query.Symbol{Atom: &query.Substring{Pattern: prefix, Content: true}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	seen = map[string]bool{}
+	for _, f := range syms.Files {
+		for _, m := range f.LineMatches {
+			for _, frag := range m.LineFragments {
+				sym, ok := identifierAt(m.Line, frag.LineOffset)
+				if ok && !seen[sym] && len(res.Symbols) < num {
+					seen[sym] = true
+					res.Symbols = append(res.Symbols, sym)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// hasPrefixFold returns whether s starts with prefix, ignoring case.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// componentHasPrefix returns whether a component of the path name
+// starts with prefix, ignoring case.
+func componentHasPrefix(name, prefix string) bool {
+	for {
+		if hasPrefixFold(name, prefix) {
+			return true
+		}
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// identifierAt returns the identifier starting at byte offset off of
+// line. It fails if off is inside an identifier.
+func identifierAt(line []byte, off int) (string, bool) {
+	if off > 0 {
+		if r, _ := utf8.DecodeLastRune(line[:off]); isIdentRune(r) {
+			return "", false
+		}
+	}
+	end := off
+	for end < len(line) {
+		r, size := utf8.DecodeRune(line[end:])
+		if !isIdentRune(r) {
+			break
+		}
+		end += size
+	}
+	if end == off {
+		return "", false
+	}
+	return string(line[off:end]), true
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
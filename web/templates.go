@@ -77,10 +77,17 @@ var TemplateText = map[string]string{
   }
   :target { background-color: #ccf; }
   table tbody tr td { border: none !important; padding: 2px !important; }
+  {{HighlightCSS}}
+  .chroma { background-color: unset; }
 </style>
+{{template "customhead"}}
 </head>
   `,
 
+	// added to the head of every page, for example to add style
+	// sheets from /static/ when templates are loaded from disk.
+	"customhead": ``,
+
 	"jsdep": `
 <script src="https://ajax.googleapis.com/ajax/libs/jquery/1.12.4/jquery.min.js"></script>
 <script src="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.7/js/bootstrap.min.js" integrity="sha384-Tc5IQib027qvyjSMfHjOMaLkfuWVxZxUPnCJA7l2mCWNIpG9mGCD8wGNIcPD7Txa" crossorigin="anonymous"></script>
@@ -95,13 +102,14 @@ var TemplateText = map[string]string{
               {{if .Query}}
               value={{.Query}}
               {{end}}
-              id="searchbox" type="text" name="q">
+              id="searchbox" type="text" name="q" list="suggestions" autocomplete="off">
       <div class="input-group-btn">
         <button class="btn btn-primary">Search</button>
       </div>
     </div>
   </div>
 </form>
+{{template "suggest"}}
 `,
 
 	"navbar": `
@@ -122,6 +130,7 @@ var TemplateText = map[string]string{
           <input class="form-control"
                 placeholder="Search for some code..." role="search"
                 id="navsearchbox" type="text" name="q" autofocus
+                list="suggestions" autocomplete="off"
                 {{if .Query}}
                 value={{.Query}}
                 {{end}}>
@@ -132,9 +141,56 @@ var TemplateText = map[string]string{
           <button class="btn btn-primary">Search</button>
         </div>
       </form>
+      {{template "suggest"}}
     </div>
   </div>
 </nav>
+`,
+
+	// autocompletion for the search boxes, from /api/suggest. The
+	// last word of the query is completed to a repository, file or
+	// symbol.
+	"suggest": `
+<datalist id="suggestions"></datalist>
+<script>
+(function() {
+  var list = document.getElementById("suggestions");
+  var pending = null;
+  function complete(box) {
+    var m = box.value.match(/^(.*?)(?:(?:r|repo|f|file|sym):)?(\S+)$/);
+    if (!m) {
+      return;
+    }
+    var rest = m[1], prefix = m[2];
+    if (pending) {
+      pending.abort();
+    }
+    var req = pending = new XMLHttpRequest();
+    req.onload = function() {
+      if (req.status != 200) {
+        return;
+      }
+      var res = JSON.parse(req.responseText);
+      list.innerHTML = "";
+      [["r:", res.Repos], ["f:", res.Files], ["sym:", res.Symbols]].forEach(function(kind) {
+        (kind[1] || []).forEach(function(s) {
+          var opt = document.createElement("option");
+          opt.value = rest + kind[0] + s;
+          list.appendChild(opt);
+        });
+      });
+    };
+    req.open("GET", "api/suggest?num=5&prefix=" + encodeURIComponent(prefix));
+    req.send();
+  }
+  ["searchbox", "navsearchbox"].forEach(function(id) {
+    var box = document.getElementById(id);
+    if (box) {
+      box.addEventListener("input", function() { complete(box); });
+    }
+  });
+})();
+</script>
 `,
 	// search box for the entry page.
 	"search": `
@@ -163,14 +219,22 @@ var TemplateText = map[string]string{
           <dt><a href="search?q=path+file:java">path file:java</a></dt><dd>search for the word "path" in files whose name contains "java"</dd>
           <dt><a href="search?q=needle+lang%3Apython&num=50">needle lang:python</a></dt><dd>search for "needle" in Python source code</dd>
           <dt><a href="search?q=f:%5C.c%24">f:\.c$</a></dt><dd>search for files whose name ends with ".c"</dd>
+          <dt><a href="search?q=needle+file:**/testdata/*.go">needle file:**/testdata/*.go</a></dt><dd>search for "needle" in Go files directly inside a "testdata" directory</dd>
           <dt><a href="search?q=path+-file:java">path -file:java</a></dt><dd>search for the word "path" excluding files whose name contains "java"</dd>
           <dt><a href="search?q=foo.*bar">foo.*bar</a></dt><dd>search for the regular expression "foo.*bar"</dd>
+          <dt><a href="search?q=%28thread+or+needle%29+and+file:java">(thread or needle) and file:java</a></dt><dd>search for "thread" or "needle" in files whose name contains "java"</dd>
           <dt><a href="search?q=-%28Path File%29 Stream">-(Path File) Stream</a></dt><dd>search "Stream", but exclude files containing both "Path" and "File"</dd>
           <dt><a href="search?q=-Path%5c+file+Stream">-Path\ file Stream</a></dt><dd>search "Stream", but exclude files containing "Path File"</dd>
           <dt><a href="search?q=sym:data">sym:data</a></span></dt><dd>search for symbol definitions containing "data"</dd>
           <dt><a href="search?q=phone+r:droid">phone r:droid</a></dt><dd>search for "phone" in repositories whose name contains "droid"</dd>
+          <dt><a href="search?q=phone+archived:no+fork:no">phone archived:no fork:no</a></dt><dd>search for "phone" in repositories that are neither archived nor forks</dd>
+          <dt><a href="search?q=phone+-category:generated+-category:vendored">phone -category:generated -category:vendored</a></dt><dd>search for "phone", skipping generated and vendored files. Tests can be excluded with <tt>-category:test</tt></dd>
+          <dt><a href="search?q=topic:database">topic:database</a></dt><dd>list repositories with the topic "database"</dd>
+          <dt><a href="search?q=repo.desc:compiler">repo.desc:compiler</a></dt><dd>list repositories whose description contains "compiler"</dd>
           <dt><a href="search?q=phone+b:master">phone b:master</a></dt><dd>for Git repos, find "phone" in files in branches whose name contains "master".</dd>
           <dt><a href="search?q=phone+b:HEAD">phone b:HEAD</a></dt><dd>for Git repos, find "phone" in the default ('HEAD') branch.</dd>
+          <dt><a href="search?q=phone+type:filename">phone type:filename</a></dt><dd>find files whose name contains "phone", without searching their content.</dd>
+          <dt><a href="search?q=phone+type:repo">phone type:repo</a></dt><dd>find repositories containing "phone", showing one matching file for each.</dd>
         </dl>
       </div>
       <div class="col-md-4">
@@ -205,12 +269,18 @@ var TemplateText = map[string]string{
   <div class="container-fluid container-results">
     <h5>
       {{if .Stats.Crashes}}<br><b>{{.Stats.Crashes}} shards crashed</b><br>{{end}}
+      {{if .Stats.Truncated}}<br><b>Search stopped early ({{.Stats.Truncated}})</b><br>{{end}}
       {{ $fileCount := len .FileMatches }}
       Found {{.Stats.MatchCount}} results in {{.Stats.FileCount}} files{{if or (lt $fileCount .Stats.FileCount) (or (gt .Stats.ShardsSkipped 0) (gt .Stats.FilesSkipped 0)) }},
         showing top {{ $fileCount }} files (<a rel="nofollow"
            href="search?q={{.Last.Query}}&num={{More .Last.Num}}">show more</a>).
       {{else}}.{{end}}
     </h5>
+    {{if .FileMatches}}
+    <p><small>Download all results as
+      <a rel="nofollow" href="export?q={{.Last.Query}}&format=csv">CSV</a> or
+      <a rel="nofollow" href="export?q={{.Last.Query}}&format=ndjson">NDJSON</a>.</small></p>
+    {{end}}
     {{range .FileMatches}}
     <table class="table table-hover table-condensed">
       <thead>
@@ -221,6 +291,7 @@ var TemplateText = map[string]string{
               {{.Repo}}:{{.FileName}}</a>:
               <span style="font-weight: normal">[ {{if .Branches}}{{range .Branches}}<span class="label label-default">{{.}}</span>,{{end}}{{end}} ]</span>
               {{if .Language}}<span class="label label-primary">{{.Language}}</span>{{end}}
+              <span class="label label-default" title="{{if not .ModTime.IsZero}}changed {{.ModTime.Format "Jan 02, 2006 15:04"}}{{end}}">{{HumanUnit .Size}}B</span>
               {{if .DuplicateID}}<a class="label label-dup" href="#{{.DuplicateID}}">Duplicate result</a>{{end}}
             </small>
           </th>
@@ -231,7 +302,7 @@ var TemplateText = map[string]string{
         {{range .Matches}}
         <tr>
           <td style="background-color: rgba(238, 238, 255, 0.6);">
-            <pre class="inline-pre"><span class="noselect">{{if .URL}}<a href="{{.URL}}">{{end}}<u>{{.LineNum}}</u>{{if .URL}}</a>{{end}}: </span>{{range .Fragments}}{{LimitPre 100 .Pre}}<b>{{.Match}}</b>{{LimitPost 100 .Post}}{{end}}</pre>
+            <pre class="inline-pre"><span class="noselect">{{if .URL}}<a href="{{.URL}}">{{end}}<u>{{.LineNum}}</u>{{if .URL}}</a>{{end}}: </span>{{if .Highlighted}}<span class="chroma">{{.Highlighted}}</span>{{else}}{{range .Fragments}}{{LimitPre 100 .Pre}}<b>{{.Match}}</b>{{LimitPost 100 .Post}}{{end}}{{end}}</pre>
           </td>
         </tr>
         {{end}}
@@ -239,6 +310,9 @@ var TemplateText = map[string]string{
       {{end}}
     </table>
     {{end}}
+    {{if .NextCursor}}
+    <p><a rel="nofollow" href="search?q={{.Last.Query}}&num={{.Last.Num}}&cursor={{.NextCursor}}">Next page</a></p>
+    {{end}}
 
   <nav class="navbar navbar-default navbar-bottom">
     <div class="container">
@@ -281,7 +355,10 @@ var TemplateText = map[string]string{
       <tbody>
 	{{range .Repos}}
 	<tr>
-	  <td>{{if .URL}}<a href="{{.URL}}">{{end}}{{.Name}}{{if .URL}}</a>{{end}}</td>
+	  <td>{{if .URL}}<a href="{{.URL}}">{{end}}{{.Name}}{{if .URL}}</a>{{end}}
+	    {{if .Description}}<br><small>{{.Description}}</small>{{end}}
+	    {{range .Topics}}<a class="label label-info small" href="search?q=topic:{{.}}">{{.}}</a> {{end}}
+	  </td>
 	  <td><small>{{.IndexTime.Format "Jan 02, 2006 15:04"}}</small></td>
 	  <td style="vertical-align: middle;">
 	    {{range .Branches}}
@@ -315,9 +392,10 @@ var TemplateText = map[string]string{
 <body id="results">
   {{template "navbar" .Last}}
   <div class="container-fluid container-results" >
+     {{if .RawURL}}<p><small>{{.Repo}}:{{.Name}} (<a href="{{.RawURL}}">raw</a>)</small></p>{{end}}
      <div class="table table-hover table-condensed" style="overflow:auto; background: #eef;">
        {{ range $index, $ln := .Lines}}
-	 <pre id="l{{Inc $index}}" class="inline-pre"><span class="noselect"><a href="#l{{Inc $index}}">{{Inc $index}}</a>: </span>{{$ln}}</pre>
+	 <pre id="l{{Inc $index}}" class="inline-pre"><span class="noselect"><a href="#l{{Inc $index}}">{{Inc $index}}</a>: </span>{{if $.HighlightedLines}}<span class="chroma">{{index $.HighlightedLines $index}}</span>{{else}}{{$ln}}{{end}}</pre>
        {{end}}
      </div>
   <nav class="navbar navbar-default navbar-bottom">
@@ -39,8 +39,25 @@ func (s *compoundSection) writeStrings(w *writer, strs []*searchableString) {
 	s.end(w)
 }
 
+// writeCompressedContents writes the contents of the files, each
+// compressed on its own so they can be read independently.
+func (b *IndexBuilder) writeCompressedContents(w *writer, toc *indexTOC) error {
+	toc.fileContents.start(w)
+	for _, f := range b.contentStrings {
+		blob, err := compressContent(f.data)
+		if err != nil {
+			return err
+		}
+		toc.fileContents.addItem(w, blob)
+	}
+	toc.fileContents.end(w)
+	return nil
+}
+
+// writePostings writes the ngrams of s with their postings, and their
+// document frequencies if docFreqs is set.
 func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
-	charOffsets *simpleSection, postings *compoundSection, endRunes *simpleSection) {
+	charOffsets *simpleSection, postings *compoundSection, endRunes *simpleSection, docFreqs *simpleSection, encoding string) error {
 	keys := make(ngramSlice, 0, len(s.postings))
 	for k := range s.postings {
 		keys = append(keys, k)
@@ -57,10 +74,22 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 
 	postings.start(w)
 	for _, k := range keys {
-		postings.addItem(w, s.postings[k])
+		blob, err := encodePostings(s.postings[k], encoding)
+		if err != nil {
+			return err
+		}
+		postings.addItem(w, blob)
 	}
 	postings.end(w)
 
+	if docFreqs != nil {
+		docFreqs.start(w)
+		for _, k := range keys {
+			w.U32(s.docFreqs[k])
+		}
+		docFreqs.end(w)
+	}
+
 	charOffsets.start(w)
 	w.Write(toSizedDeltas(s.runeOffsets))
 	charOffsets.end(w)
@@ -68,16 +97,51 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 	endRunes.start(w)
 	w.Write(toSizedDeltas(s.endRunes))
 	endRunes.end(w)
+	return nil
 }
 
 func (b *IndexBuilder) Write(out io.Writer) error {
+	return b.write(out, IndexMetadata{
+		IndexFormatVersion:  IndexFormatVersion,
+		IndexTime:           time.Now(),
+		IndexFeatureVersion: FeatureVersion,
+	})
+}
+
+// write writes the index with the format version, feature version
+// and index time of md. Besides IndexFormatVersion, only
+// MinIndexFormatVersion can be written, and versions before
+// wideOffsetsVersion in as far as they use 32-bit offsets.
+func (b *IndexBuilder) write(out io.Writer, md IndexMetadata) error {
 	buffered := bufio.NewWriterSize(out, 1<<20)
 	defer buffered.Flush()
 
-	w := &writer{w: buffered}
-	toc := indexTOC{}
+	w := &writer{
+		w:      buffered,
+		narrow: md.IndexFormatVersion < wideOffsetsVersion,
+	}
+	toc := indexTOC{
+		prevVersion: md.IndexFormatVersion < IndexFormatVersion,
+	}
+
+	if b.contentCompression == "" {
+		toc.fileContents.writeStrings(w, b.contentStrings)
+	} else if err := b.writeCompressedContents(w, &toc); err != nil {
+		return err
+	}
+
+	// The sizes of the files, if they are compressed.
+	toc.contentBoundaries.start(w)
+	if b.contentCompression != "" {
+		var off uint32
+		w.U32(off)
+		for _, f := range b.contentStrings {
+			off += uint32(len(f.data))
+			w.U32(off)
+		}
+	}
+	toc.contentBoundaries.end(w)
 
-	toc.fileContents.writeStrings(w, b.contentStrings)
 	toc.newlines.start(w)
 	for _, f := range b.contentStrings {
 		toc.newlines.addItem(w, toSizedDeltas(newLinesIndices(f.data)))
@@ -96,12 +160,20 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	}
 	toc.fileSections.end(w)
 
-	writePostings(w, b.contentPostings, &toc.ngramText, &toc.runeOffsets, &toc.postings, &toc.fileEndRunes)
+	docFreqs := &toc.ngramDocFreqs
+	if toc.prevVersion {
+		docFreqs = nil
+	}
+	if err := writePostings(w, b.contentPostings, &toc.ngramText, &toc.runeOffsets, &toc.postings, &toc.fileEndRunes, docFreqs, b.postingEncoding); err != nil {
+		return err
+	}
 
 	// names.
 	toc.fileNames.writeStrings(w, b.nameStrings)
 
-	writePostings(w, b.namePostings, &toc.nameNgramText, &toc.nameRuneOffsets, &toc.namePostings, &toc.nameEndRunes)
+	if err := writePostings(w, b.namePostings, &toc.nameNgramText, &toc.nameRuneOffsets, &toc.namePostings, &toc.nameEndRunes, nil, b.postingEncoding); err != nil {
+		return err
+	}
 
 	toc.subRepos.start(w)
 	w.Write(toSizedDeltas(b.subRepos))
@@ -119,12 +191,34 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	w.Write(marshalDocSections(b.runeDocSections))
 	toc.runeDocSections.end(w)
 
+	toc.docRanks.start(w)
+	w.Write(b.docRanks)
+	toc.docRanks.end(w)
+
+	toc.lineEndings.start(w)
+	w.Write(b.lineEndings)
+	toc.lineEndings.end(w)
+
+	toc.categories.start(w)
+	w.Write(b.categories)
+	toc.categories.end(w)
+
+	toc.fileInfos.start(w)
+	w.Write(b.fileInfos)
+	toc.fileInfos.end(w)
+
+	toc.ngramBloom.start(w)
+	w.Write(b.ngramBloom().marshal())
+	toc.ngramBloom.end(w)
+
 	if err := b.writeJSON(&IndexMetadata{
-		IndexFormatVersion:  IndexFormatVersion,
-		IndexTime:           time.Now(),
-		IndexFeatureVersion: FeatureVersion,
+		IndexFormatVersion:  md.IndexFormatVersion,
+		IndexTime:           md.IndexTime,
+		IndexFeatureVersion: md.IndexFeatureVersion,
 		PlainASCII:          b.contentPostings.isPlainASCII && b.namePostings.isPlainASCII,
 		LanguageMap:         b.languageMap,
+		ContentCompression:  b.contentCompression,
+		PostingEncoding:     b.postingEncoding,
 		ZoektVersion:        Version,
 	}, &toc.metaData, w); err != nil {
 		return err
@@ -133,6 +227,12 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 		return err
 	}
 
+	toc.sectionChecksums.start(w)
+	for _, s := range toc.checksummedSections() {
+		w.U32(w.checksums[s])
+	}
+	toc.sectionChecksums.end(w)
+
 	var tocSection simpleSection
 
 	tocSection.start(w)
@@ -153,10 +253,12 @@ func (b *IndexBuilder) writeJSON(data interface{}, sec *simpleSection, w *writer
 	return nil
 }
 
+// newLinesIndices returns the offsets of the last byte of each line
+// terminator: "\n", the "\n" of "\r\n", or a lone "\r".
 func newLinesIndices(in []byte) []uint32 {
 	out := make([]uint32, 0, len(in)/30)
 	for i, c := range in {
-		if c == '\n' {
+		if c == '\n' || c == '\r' && (i+1 == len(in) || in[i+1] != '\n') {
 			out = append(out, uint32(i))
 		}
 	}
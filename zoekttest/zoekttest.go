@@ -0,0 +1,106 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package zoekttest provides utilities for testing code that uses
+// zoekt. It builds small shards in memory, so tests need neither an
+// index directory nor the indexing commands.
+package zoekttest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/zoekt"
+)
+
+// memIndexFile is an IndexFile backed by a byte slice.
+type memIndexFile struct {
+	name string
+	data []byte
+}
+
+func (f *memIndexFile) Read(off, sz uint64) ([]byte, error) {
+	return f.data[off : off+sz], nil
+}
+
+func (f *memIndexFile) Size() (uint64, error) {
+	return uint64(len(f.data)), nil
+}
+
+func (f *memIndexFile) Close() {}
+
+func (f *memIndexFile) Name() string {
+	return f.name
+}
+
+// NewIndexFile returns an IndexFile reading from data. The data is
+// not copied.
+func NewIndexFile(name string, data []byte) zoekt.IndexFile {
+	return &memIndexFile{name: name, data: data}
+}
+
+// NewShard returns the contents of a shard for repo holding docs. A
+// nil repo is an unnamed repository without branches.
+func NewShard(repo *zoekt.Repository, docs ...zoekt.Document) ([]byte, error) {
+	b, err := zoekt.NewIndexBuilder(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range docs {
+		if err := b.Add(d); err != nil {
+			return nil, err
+		}
+	}
+	return Write(b)
+}
+
+// Write returns the shard built by b.
+func Write(b *zoekt.IndexBuilder) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewSearcher returns a Searcher over a shard for repo holding
+// docs. It fails the test on errors.
+func NewSearcher(t testing.TB, repo *zoekt.Repository, docs ...zoekt.Document) zoekt.Searcher {
+	t.Helper()
+	data, err := NewShard(repo, docs...)
+	if err != nil {
+		t.Fatalf("NewShard: %v", err)
+	}
+	return searcher(t, data)
+}
+
+// SearcherForBuilder returns a Searcher over the shard built by b. It
+// fails the test on errors.
+func SearcherForBuilder(t testing.TB, b *zoekt.IndexBuilder) zoekt.Searcher {
+	t.Helper()
+	data, err := Write(b)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return searcher(t, data)
+}
+
+func searcher(t testing.TB, data []byte) zoekt.Searcher {
+	t.Helper()
+	s, err := zoekt.NewSearcher(NewIndexFile("zoekttest", data))
+	if err != nil {
+		t.Fatalf("NewSearcher: %v", err)
+	}
+	return s
+}
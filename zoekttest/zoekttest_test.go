@@ -0,0 +1,38 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekttest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+func TestNewSearcher(t *testing.T) {
+	s := NewSearcher(t, &zoekt.Repository{Name: "repo"},
+		zoekt.Document{Name: "f1", Content: []byte("needle")},
+		zoekt.Document{Name: "f2", Content: []byte("haystack")})
+	defer s.Close()
+
+	res, err := s.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || res.Files[0].Repository != "repo" || res.Files[0].FileName != "f1" {
+		t.Errorf("got %v, want repo/f1", res.Files)
+	}
+}